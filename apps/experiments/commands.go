@@ -0,0 +1,489 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/stockparfait/table"
+)
+
+// command is a subcommand of the app. Its run function receives the arguments
+// following the command name, and writes its results to w.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string, w io.Writer) error
+}
+
+func commands() []command {
+	return []command{
+		{"run", "run the experiments from -conf (default command)", runCommand},
+		{"validate", "check the config in -conf without running it", validateCommand},
+		{"list", "list the supported experiments", listCommand},
+		{"describe", "describe <experiment>: print its config fields", describeCommand},
+		{"compare", "compare [<a.json> <b.json>]: diff two runs' -values-json and -json outputs", compareCommand},
+		{"serve", "serve the plots directory over HTTP", serveCommand},
+		{"calibrate", "fit a t-distribution to the data source in -conf", calibrateCommand},
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: experiments [command] [flags]\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands() {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.usage)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "Run 'experiments <command> -help' for the command's flags.\n")
+}
+
+// dispatch runs the subcommand named by args[0]. For backward compatibility,
+// when args start with a flag, it is the "run" command.
+func dispatch(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runCommand(ctx, args, w)
+	}
+	if args[0] == "help" {
+		usage(w)
+		return nil
+	}
+	for _, c := range commands() {
+		if c.name == args[0] {
+			if err := c.run(ctx, args[1:], w); err != nil {
+				return errors.Annotate(err, "command '%s' failed", c.name)
+			}
+			return nil
+		}
+	}
+	usage(w)
+	return errors.Reason("unknown command '%s'", args[0])
+}
+
+// newFlagSet creates a flag set for a subcommand with the flags shared by all
+// subcommands.
+func newFlagSet(name string, logLevel *logging.Level) *flag.FlagSet {
+	fs := flag.NewFlagSet("experiments "+name, flag.ExitOnError)
+	*logLevel = logging.Info
+	fs.Var(logLevel, "log-level", "Log level: debug, info, warning, error")
+	return fs
+}
+
+// defines is a flag.Value collecting repeated -define key=value flags.
+type defines map[string]string
+
+var _ flag.Value = defines{}
+
+const defineUsage = "define a ${key} variable for the config as key=value; may be repeated"
+
+func (d defines) String() string {
+	var keys []string
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var kvs []string
+	for _, k := range keys {
+		kvs = append(kvs, k+"="+d[k])
+	}
+	return strings.Join(kvs, ",")
+}
+
+func (d defines) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return errors.Reason("expected key=value, got '%s'", s)
+	}
+	d[k] = v
+	return nil
+}
+
+func useLogging(ctx context.Context, level logging.Level) context.Context {
+	return logging.Use(ctx, logging.DefaultGoLogger(level))
+}
+
+func runCommand(ctx context.Context, args []string, w io.Writer) error {
+	flags, err := parseFlags(args)
+	if err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	ctx = useLogging(ctx, flags.LogLevel)
+	if flags.Watch {
+		return watch(ctx, flags)
+	}
+	return run(useOutputs(ctx), flags)
+}
+
+// useOutputs adds fresh plots, values and summary tables to the context.
+func useOutputs(ctx context.Context) context.Context {
+	ctx = plot.Use(ctx, plot.NewCanvas())
+	ctx = experiments.UseValues(ctx, make(experiments.Values))
+	ctx = experiments.UseTypedValues(ctx, make(experiments.TypedValues))
+	ctx = experiments.UseSummaryTables(ctx, make(experiments.SummaryTables))
+	return ctx
+}
+
+func validateCommand(ctx context.Context, args []string, w io.Writer) error {
+	var logLevel logging.Level
+	var confPath string
+	vars := make(defines)
+	fs := newFlagSet("validate", &logLevel)
+	fs.StringVar(&confPath, "conf", "", "configuration file (required)")
+	fs.Var(vars, "define", defineUsage)
+	if err := fs.Parse(args); err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	if confPath == "" {
+		return errors.Reason("missing required -conf")
+	}
+	cfg, err := config.LoadWithVars(confPath, vars)
+	if err != nil {
+		return errors.Annotate(err, "invalid config")
+	}
+	fmt.Fprintf(w, "%s: %d groups, %d experiments\n", confPath,
+		len(cfg.Groups), len(cfg.Experiments))
+	for _, e := range cfg.Experiments {
+		fmt.Fprintf(w, "  %s", e.Config.Name())
+		if id := config.ExperimentID(e.Config); id != "" {
+			fmt.Fprintf(w, " [%s]", id)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func listCommand(ctx context.Context, args []string, w io.Writer) error {
+	var logLevel logging.Level
+	fs := newFlagSet("list", &logLevel)
+	if err := fs.Parse(args); err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	for _, name := range config.ExperimentNames() {
+		fmt.Fprintln(w, name)
+	}
+	return nil
+}
+
+// describeFields writes the config fields of the struct type t, one per line,
+// with their JSON names, types and tag constraints.
+func describeFields(w io.Writer, t reflect.Type) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		var notes []string
+		if f.Tag.Get("required") == "true" {
+			notes = append(notes, "required")
+		}
+		if d, ok := f.Tag.Lookup("default"); ok {
+			notes = append(notes, "default: "+d)
+		}
+		if c, ok := f.Tag.Lookup("choices"); ok {
+			notes = append(notes, "choices: "+c)
+		}
+		line := fmt.Sprintf("  %q\t%s", name, f.Type)
+		if len(notes) > 0 {
+			line += "\t" + strings.Join(notes, "; ")
+		}
+		fmt.Fprintln(tw, line)
+	}
+	tw.Flush()
+}
+
+func describeCommand(ctx context.Context, args []string, w io.Writer) error {
+	var logLevel logging.Level
+	fs := newFlagSet("describe", &logLevel)
+	if err := fs.Parse(args); err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	if fs.NArg() != 1 {
+		return errors.Reason("expected exactly one experiment name, got %d", fs.NArg())
+	}
+	c, err := config.NewExperimentConfig(fs.Arg(0))
+	if err != nil {
+		return errors.Annotate(err, "cannot describe '%s'", fs.Arg(0))
+	}
+	fmt.Fprintf(w, "%s (%T):\n", c.Name(), c)
+	describeFields(w, reflect.TypeOf(c).Elem())
+	return nil
+}
+
+func readValuesJSON(path string) (experiments.TypedValues, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot open '%s'", path)
+	}
+	defer f.Close()
+	return experiments.ReadValuesJSON(f)
+}
+
+// numeric value of v, if it is a number.
+func numeric(v experiments.Value) (float64, bool) {
+	switch v.Kind {
+	case experiments.IntKind:
+		return float64(v.Int), true
+	case experiments.FloatKind:
+		return v.Float, true
+	}
+	return 0, false
+}
+
+// compareFlags are the flags of the compare command.
+type compareFlags struct {
+	PlotsA     string // data.json of run A
+	PlotsB     string // data.json of run B
+	DataJsPath string // diff plots
+	JSONPath   string // diff plots
+	HTMLPath   string // diff plots report
+	CSVPath    string // values diff table
+}
+
+func compareCommand(ctx context.Context, args []string, w io.Writer) error {
+	var logLevel logging.Level
+	var flags compareFlags
+	fs := newFlagSet("compare", &logLevel)
+	fs.StringVar(&flags.PlotsA, "plots-a", "", "data.json (-json output) of run A")
+	fs.StringVar(&flags.PlotsB, "plots-b", "", "data.json (-json output) of run B")
+	fs.StringVar(&flags.DataJsPath, "js", "", "write B-A plots to this data.js file")
+	fs.StringVar(&flags.JSONPath, "json", "", "write B-A plots to this JSON file")
+	fs.StringVar(&flags.HTMLPath, "html", "", "write B-A plots and values report to this HTML file")
+	fs.StringVar(&flags.CSVPath, "csv", "", "write the values diff table to this CSV file")
+	if err := fs.Parse(args); err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	ctx = useLogging(ctx, logLevel)
+	if fs.NArg() != 0 && fs.NArg() != 2 {
+		return errors.Reason("expected two values files, got %d", fs.NArg())
+	}
+	if (flags.PlotsA == "") != (flags.PlotsB == "") {
+		return errors.Reason("-plots-a and -plots-b must be used together")
+	}
+	if fs.NArg() == 0 && flags.PlotsA == "" {
+		return errors.Reason("nothing to compare: expected values files or -plots-a/b")
+	}
+	ctx = useOutputs(ctx)
+	if fs.NArg() == 2 {
+		if err := compareValues(ctx, fs.Arg(0), fs.Arg(1), flags.CSVPath, w); err != nil {
+			return errors.Annotate(err, "failed to compare values")
+		}
+	}
+	if flags.PlotsA != "" {
+		a, err := readPlotsJSON(flags.PlotsA)
+		if err != nil {
+			return errors.Annotate(err, "failed to read plots A")
+		}
+		b, err := readPlotsJSON(flags.PlotsB)
+		if err != nil {
+			return errors.Annotate(err, "failed to read plots B")
+		}
+		if err := diffPlots(ctx, a, b); err != nil {
+			return errors.Annotate(err, "failed to compare plots")
+		}
+	}
+	err := writePlots(ctx, &Flags{
+		Config:       "compare",
+		DataJsPath:   flags.DataJsPath,
+		DataJSONPath: flags.JSONPath,
+		HTMLPath:     flags.HTMLPath,
+	})
+	if err != nil {
+		return errors.Annotate(err, "failed to write diff plots")
+	}
+	return nil
+}
+
+// compareValues prints the diff table of the two values files to w and
+// optionally writes it to csvPath. The numeric differences are also added as
+// "<key> B-A" values to the context for the HTML report.
+func compareValues(ctx context.Context, aPath, bPath, csvPath string, w io.Writer) error {
+	a, err := readValuesJSON(aPath)
+	if err != nil {
+		return errors.Annotate(err, "failed to read values A")
+	}
+	b, err := readValuesJSON(bPath)
+	if err != nil {
+		return errors.Annotate(err, "failed to read values B")
+	}
+	rows := diffValues(a, b)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	t := table.NewTable(valueDiffHeader()...)
+	fmt.Fprintln(tw, strings.Join(valueDiffHeader(), "\t"))
+	for _, r := range rows {
+		t.AddRow(r)
+		cells := r.CSV()
+		if cells[3] == "" {
+			cells = cells[:3]
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		if d, ok := r.Diff(); ok {
+			if err := experiments.AddTypedValue(ctx, "", r.Key+" B-A", experiments.FloatValue(d)); err != nil {
+				return errors.Annotate(err, "failed to add diff value for '%s'", r.Key)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Annotate(err, "failed to print the values diff")
+	}
+	if csvPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(csvPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "failed to open output CSV file '%s'", csvPath)
+	}
+	defer f.Close()
+	if err = t.WriteCSV(f, table.Params{}); err != nil {
+		return errors.Annotate(err, "failed to write CSV file '%s'", csvPath)
+	}
+	return nil
+}
+
+func serveCommand(ctx context.Context, args []string, w io.Writer) error {
+	var logLevel logging.Level
+	var dir, addr string
+	fs := newFlagSet("serve", &logLevel)
+	fs.StringVar(&dir, "dir", ".", "plots directory with plot.html and data.js")
+	fs.StringVar(&addr, "addr", "localhost:8080", "address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	ctx = useLogging(ctx, logLevel)
+	logging.Infof(ctx, "serving '%s' at http://%s/plot.html", dir, addr)
+	srv := &http.Server{Addr: addr, Handler: http.FileServer(http.Dir(dir))}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Annotate(err, "failed to serve '%s'", dir)
+	}
+	return nil
+}
+
+// calibrated is the output of the calibrate command, in the format of
+// config.AnalyticalDistribution.
+type calibrated struct {
+	Name  string  `json:"name"`
+	Mean  float64 `json:"mean"`
+	MAD   float64 `json:"MAD"`
+	Alpha float64 `json:"alpha"`
+}
+
+// calibrate fits a t-distribution to all the log-profits of the source. Note,
+// that it keeps all the samples in memory.
+func calibrate(ctx context.Context, c *config.Calibrate) (*calibrated, error) {
+	f := func(lps []experiments.LogProfits) []float64 {
+		var res []float64
+		for _, lp := range lps {
+			res = append(res, lp.Timeseries.Data()...)
+		}
+		return res
+	}
+	it, err := experiments.SourceMap(ctx, c.Data, f)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to read data")
+	}
+	defer it.Close()
+	acc := func(xs, res []float64) []float64 { return append(res, xs...) }
+	data := iterator.Reduce[[]float64, []float64](it, nil, acc)
+	if len(data) == 0 {
+		return nil, errors.Reason("no samples in the data")
+	}
+	buckets := c.Buckets // copy, to fit locally
+	if buckets.Auto {
+		if err := experiments.FitBuckets(&buckets, data); err != nil {
+			return nil, errors.Annotate(err, "failed to fit buckets")
+		}
+	}
+	h := stats.NewHistogram(&buckets)
+	h.Add(data...)
+	s := stats.NewSample(data)
+	logging.Infof(ctx, "calibrating on %d samples", len(data))
+	if c.Alpha.FitMethod == "mle" {
+		ws := make([]float64, len(data))
+		for i := range ws {
+			ws[i] = 1
+		}
+		fit, err := experiments.FitStudentsT(data, ws, c.Alpha)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to fit Student's T")
+		}
+		logging.Infof(ctx, "standard errors: alpha=%.4g mean=%.4g MAD=%.4g",
+			fit.AlphaErr, fit.MeanErr, fit.MADErr)
+		return &calibrated{
+			Name:  "t",
+			Mean:  fit.Mean,
+			MAD:   fit.MAD,
+			Alpha: fit.Alpha,
+		}, nil
+	}
+	return &calibrated{
+		Name:  "t",
+		Mean:  s.Mean(),
+		MAD:   s.MAD(),
+		Alpha: experiments.DeriveAlpha(h, s.Mean(), s.MAD(), c.Alpha),
+	}, nil
+}
+
+func calibrateCommand(ctx context.Context, args []string, w io.Writer) error {
+	var logLevel logging.Level
+	var confPath string
+	vars := make(defines)
+	fs := newFlagSet("calibrate", &logLevel)
+	fs.StringVar(&confPath, "conf", "", "calibration config file (required)")
+	fs.Var(vars, "define", defineUsage)
+	if err := fs.Parse(args); err != nil {
+		return errors.Annotate(err, "failed to parse flags")
+	}
+	if confPath == "" {
+		return errors.Reason("missing required -conf")
+	}
+	ctx = useLogging(ctx, logLevel)
+	var c config.Calibrate
+	if err := config.ReadFile(&c, confPath, vars); err != nil {
+		return errors.Annotate(err, "cannot read config '%s'", confPath)
+	}
+	res, err := calibrate(ctx, &c)
+	if err != nil {
+		return errors.Annotate(err, "failed to calibrate")
+	}
+	js, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return errors.Annotate(err, "failed to encode result")
+	}
+	fmt.Fprintln(w, string(js))
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_commands")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Subcommands work", t, func() {
+		ctx := logging.Use(context.Background(), logging.DefaultGoLogger(logging.Error))
+		var buf bytes.Buffer
+
+		Convey("unknown command", func() {
+			err := dispatch(ctx, []string{"foo"}, &buf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unknown command 'foo'")
+			So(buf.String(), ShouldContainSubstring, "Usage: experiments")
+		})
+
+		Convey("validate", func() {
+			confPath := filepath.Join(tmpdir, "config.json")
+			So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "xy", "graphs": [{"id": "r1"}]}],
+  "experiments": [{"test": {"id": "t1", "graph": "r1"}}]
+}`), ShouldBeNil)
+			So(dispatch(ctx, []string{"validate", "-conf", confPath}, &buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual,
+				confPath+": 1 groups, 1 experiments\n  test [t1]\n")
+		})
+
+		Convey("validate with variables", func() {
+			confPath := filepath.Join(tmpdir, "config_vars.json")
+			So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "xy", "graphs": [{"id": "r1"}]}],
+  "experiments": [{"test": {"id": "${ID}", "graph": "r1"}}]
+}`), ShouldBeNil)
+			So(dispatch(ctx, []string{
+				"validate", "-conf", confPath, "-define", "ID=t2"}, &buf), ShouldBeNil)
+			So(buf.String(), ShouldEndWith, "  test [t2]\n")
+
+			err := dispatch(ctx, []string{"validate", "-conf", confPath}, &buf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "undefined variable 'ID'")
+		})
+
+		Convey("list", func() {
+			So(dispatch(ctx, []string{"list"}, &buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "\ndistribution\n")
+			So(buf.String(), ShouldContainSubstring, "\npair\n")
+		})
+
+		Convey("describe", func() {
+			So(dispatch(ctx, []string{"describe", "test"}, &buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "test (*config.TestExperimentConfig):")
+			So(buf.String(), ShouldContainSubstring, `
+  "grade"   float64  default: 2.0
+  "passed"  bool
+  "graph"   string  required
+`)
+		})
+
+		Convey("compare", func() {
+			aPath := filepath.Join(tmpdir, "a.json")
+			bPath := filepath.Join(tmpdir, "b.json")
+			So(testutil.WriteFile(aPath, `
+{
+  "alpha": {"kind": "float", "value": 3},
+  "name": {"kind": "string", "value": "a"},
+  "only a": {"kind": "int", "value": 1}
+}`), ShouldBeNil)
+			So(testutil.WriteFile(bPath, `
+{
+  "alpha": {"kind": "float", "value": 3.5},
+  "name": {"kind": "string", "value": "b"}
+}`), ShouldBeNil)
+			So(dispatch(ctx, []string{"compare", aPath, bPath}, &buf), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `Name    A  B    B-A
+alpha   3  3.5  0.5
+name    a  b
+only a  1  -
+`)
+		})
+
+		Convey("compare plots", func() {
+			writeCanvas := func(path string, xs, ys []float64) {
+				ctx := plot.Use(ctx, plot.NewCanvas())
+				canvas := plot.Get(ctx)
+				So(canvas.AddGroup(plot.NewGroup(plot.KindXY, "g").SetTitle("Group")), ShouldBeNil)
+				So(canvas.AddGraph(plot.NewGraph(plot.KindXY, "gr").SetTitle("Graph"), "g"), ShouldBeNil)
+				p, err := plot.NewXYPlot(xs, ys)
+				So(err, ShouldBeNil)
+				So(canvas.AddPlot(p.SetLegend("dist"), "gr"), ShouldBeNil)
+				f, err := os.Create(path)
+				So(err, ShouldBeNil)
+				defer f.Close()
+				So(plot.WriteJSON(ctx, f), ShouldBeNil)
+			}
+			aPath := filepath.Join(tmpdir, "data_a.json")
+			bPath := filepath.Join(tmpdir, "data_b.json")
+			outPath := filepath.Join(tmpdir, "diff.json")
+			writeCanvas(aPath, []float64{1, 2, 3}, []float64{1, 1, 1})
+			writeCanvas(bPath, []float64{0, 2, 4}, []float64{0, 2, 4})
+			So(dispatch(ctx, []string{
+				"compare", "-plots-a", aPath, "-plots-b", bPath, "-json", outPath,
+			}, &buf), ShouldBeNil)
+			c, err := readPlotsJSON(outPath)
+			So(err, ShouldBeNil)
+			So(len(c.Groups), ShouldEqual, 1)
+			So(c.Groups[0].Title, ShouldEqual, "Group (B-A)")
+			So(len(c.Groups[0].Graphs), ShouldEqual, 1)
+			So(c.Groups[0].Graphs[0].Title, ShouldEqual, "Graph B-A")
+			So(len(c.Groups[0].Graphs[0].Plots), ShouldEqual, 1)
+			p := c.Groups[0].Graphs[0].Plots[0]
+			So(p.Legend, ShouldEqual, "dist B-A")
+			So(p.X, ShouldResemble, []float64{1, 2, 3})
+			So(p.Y, ShouldResemble, []float64{0, 1, 2})
+		})
+
+		Convey("compare values to CSV", func() {
+			aPath := filepath.Join(tmpdir, "va.json")
+			bPath := filepath.Join(tmpdir, "vb.json")
+			csvPath := filepath.Join(tmpdir, "diff.csv")
+			So(testutil.WriteFile(aPath, `{"MAD": {"kind": "float", "value": 0.01}}`), ShouldBeNil)
+			So(testutil.WriteFile(bPath, `{"MAD": {"kind": "float", "value": 0.015}}`), ShouldBeNil)
+			So(dispatch(ctx, []string{"compare", "-csv", csvPath, aPath, bPath}, &buf), ShouldBeNil)
+			b, err := os.ReadFile(csvPath)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "Name,A,B,B-A\nMAD,0.01,0.015,0.005\n")
+		})
+
+		Convey("compare requires inputs", func() {
+			So(dispatch(ctx, []string{"compare"}, &buf), ShouldNotBeNil)
+			So(dispatch(ctx, []string{"compare", "-plots-a", "a.json"}, &buf), ShouldNotBeNil)
+		})
+
+		Convey("calibrate", func() {
+			confPath := filepath.Join(tmpdir, "calibrate.json")
+			So(testutil.WriteFile(confPath, `
+{
+  "data": {
+    "daily distribution": {"name": "t", "alpha": 3, "MAD": 0.01},
+    "tickers": 10,
+    "days": 1000,
+    "seed": 42
+  },
+  "buckets": {"n": 51, "min": -0.1, "max": 0.1, "auto bounds": false},
+  "alpha": {"min x": 1.5, "max x": 10}
+}`), ShouldBeNil)
+			So(dispatch(ctx, []string{
+				"calibrate", "-conf", confPath, "-log-level", "error"}, &buf), ShouldBeNil)
+			var res calibrated
+			So(json.Unmarshal(buf.Bytes(), &res), ShouldBeNil)
+			So(res.Name, ShouldEqual, "t")
+			So(testutil.Round(res.MAD, 1), ShouldEqual, 0.01)
+			So(res.Alpha, ShouldBeBetween, 2, 4.5)
+		})
+	})
+}
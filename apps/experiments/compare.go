@@ -0,0 +1,283 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/stockparfait/table"
+)
+
+// The plots as decoded from a data.json file written by plot.WriteJSON. The
+// graph and group IDs are not saved, so the plots of two runs are matched by
+// the group and graph titles and the plot legends.
+type savedPlot struct {
+	Kind   string
+	X      []float64
+	Y      []float64
+	Dates  []db.Date
+	YLabel string
+	Legend string
+}
+
+type savedGraph struct {
+	Kind   string
+	Title  string
+	XLabel string
+	Plots  []*savedPlot
+}
+
+type savedGroup struct {
+	Kind      string
+	Title     string
+	XLogScale bool
+	Graphs    []*savedGraph
+}
+
+type savedCanvas struct {
+	Groups []*savedGroup
+}
+
+func readPlotsJSON(path string) (*savedCanvas, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot open '%s'", path)
+	}
+	defer f.Close()
+	var c savedCanvas
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, errors.Annotate(err, "failed to decode '%s'", path)
+	}
+	return &c, nil
+}
+
+// matchKeys assigns a key to each item by its name, numbering repeated names,
+// so that the n-th item with the same name is matched to the n-th one in the
+// other run. Returns the keys in the order of items, and the items by key.
+func matchKeys[T any](items []T, name func(T) string) ([]string, map[string]T) {
+	seen := make(map[string]int)
+	keys := make([]string, len(items))
+	byKey := make(map[string]T, len(items))
+	for i, it := range items {
+		n := name(it)
+		keys[i] = fmt.Sprintf("%s#%d", n, seen[n])
+		byKey[keys[i]] = it
+		seen[n]++
+	}
+	return keys, byKey
+}
+
+// interpolate y(x) linearly from the sorted xs, and false when x is out of
+// range.
+func interpolate(xs, ys []float64, x float64) (float64, bool) {
+	i := sort.SearchFloat64s(xs, x)
+	switch {
+	case i == len(xs):
+		return 0, false
+	case xs[i] == x:
+		return ys[i], true
+	case i == 0:
+		return 0, false
+	}
+	w := (x - xs[i-1]) / (xs[i] - xs[i-1])
+	return ys[i-1] + w*(ys[i]-ys[i-1]), true
+}
+
+// diffPlot creates the plot of B-A, or nil if a and b are not comparable. XY
+// plots are compared at the X points of a, interpolating b if necessary, and
+// timeseries at the dates present in both.
+func diffPlot(a, b *savedPlot) (*plot.Plot, error) {
+	if a.Kind != b.Kind || len(a.Y) == 0 || len(b.Y) == 0 {
+		return nil, nil
+	}
+	if a.Kind == plot.KindSeries.String() {
+		bs := make(map[db.Date]float64, len(b.Dates))
+		for i, d := range b.Dates {
+			bs[d] = b.Y[i]
+		}
+		var dates []db.Date
+		var ys []float64
+		for i, d := range a.Dates {
+			if y, ok := bs[d]; ok {
+				dates = append(dates, d)
+				ys = append(ys, y-a.Y[i])
+			}
+		}
+		if len(dates) == 0 {
+			return nil, nil
+		}
+		return plot.NewSeriesPlot(stats.NewTimeseries(dates, ys))
+	}
+	if !sort.Float64sAreSorted(b.X) {
+		return nil, nil
+	}
+	var xs, ys []float64
+	for i, x := range a.X {
+		if y, ok := interpolate(b.X, b.Y, x); ok {
+			xs = append(xs, x)
+			ys = append(ys, y-a.Y[i])
+		}
+	}
+	if len(xs) == 0 {
+		return nil, nil
+	}
+	return plot.NewXYPlot(xs, ys)
+}
+
+// diffPlots adds the B-A plots for all the matching plots of a and b to the
+// canvas in the context. The unmatched plots are skipped.
+func diffPlots(ctx context.Context, a, b *savedCanvas) error {
+	canvas := plot.Get(ctx)
+	if canvas == nil {
+		return errors.Reason("no canvas in context")
+	}
+	groupTitle := func(g *savedGroup) string { return g.Title }
+	graphTitle := func(g *savedGraph) string { return g.Title }
+	legend := func(p *savedPlot) string { return p.Legend }
+
+	groupKeys, _ := matchKeys(a.Groups, groupTitle)
+	_, bGroups := matchKeys(b.Groups, groupTitle)
+	var n int
+	for i, gk := range groupKeys {
+		ga, gb := a.Groups[i], bGroups[gk]
+		if gb == nil || ga.Kind != gb.Kind {
+			logging.Warningf(ctx, "group '%s' is missing or different in B", ga.Title)
+			continue
+		}
+		kind := plot.KindXY
+		if ga.Kind == plot.KindSeries.String() {
+			kind = plot.KindSeries
+		}
+		groupID := fmt.Sprintf("group %d", i)
+		group := plot.NewGroup(kind, groupID).SetTitle(ga.Title + " (B-A)").
+			SetXLogScale(ga.XLogScale)
+		if err := canvas.AddGroup(group); err != nil {
+			return errors.Annotate(err, "failed to add group '%s'", ga.Title)
+		}
+		graphKeys, _ := matchKeys(ga.Graphs, graphTitle)
+		_, bGraphs := matchKeys(gb.Graphs, graphTitle)
+		for j, grk := range graphKeys {
+			gra, grb := ga.Graphs[j], bGraphs[grk]
+			if grb == nil {
+				logging.Warningf(ctx, "graph '%s' is missing in B", gra.Title)
+				continue
+			}
+			graphID := fmt.Sprintf("%s graph %d", groupID, j)
+			graph := plot.NewGraph(kind, graphID).SetTitle(gra.Title + " B-A").
+				SetXLabel(gra.XLabel)
+			if err := canvas.AddGraph(graph, groupID); err != nil {
+				return errors.Annotate(err, "failed to add graph '%s'", gra.Title)
+			}
+			plotKeys, _ := matchKeys(gra.Plots, legend)
+			_, bPlots := matchKeys(grb.Plots, legend)
+			for k, pk := range plotKeys {
+				pa, pb := gra.Plots[k], bPlots[pk]
+				if pb == nil {
+					continue
+				}
+				p, err := diffPlot(pa, pb)
+				if err != nil {
+					return errors.Annotate(err, "failed to diff '%s'", pa.Legend)
+				}
+				if p == nil {
+					logging.Warningf(ctx, "plot '%s' in '%s' is not comparable",
+						pa.Legend, gra.Title)
+					continue
+				}
+				p.SetLegend(pa.Legend + " B-A").SetYLabel(pa.YLabel)
+				if err := canvas.AddPlot(p, graphID); err != nil {
+					return errors.Annotate(err, "failed to add plot '%s'", pa.Legend)
+				}
+				n++
+			}
+		}
+	}
+	logging.Infof(ctx, "compared %d plots", n)
+	return nil
+}
+
+// valueDiffRow is a row of the values comparison table.
+type valueDiffRow struct {
+	Key  string
+	A, B *experiments.Value // nil when missing
+}
+
+var _ table.Row = valueDiffRow{}
+
+func valueDiffHeader() []string {
+	return []string{"Name", "A", "B", "B-A"}
+}
+
+func (r valueDiffRow) CSV() []string {
+	res := []string{r.Key, "-", "-", ""}
+	if r.A != nil {
+		res[1] = r.A.String()
+	}
+	if r.B != nil {
+		res[2] = r.B.String()
+	}
+	if d, ok := r.Diff(); ok {
+		res[3] = fmt.Sprintf("%.4g", d)
+	}
+	return res
+}
+
+// Diff is B-A when both values are present and numeric.
+func (r valueDiffRow) Diff() (float64, bool) {
+	if r.A == nil || r.B == nil {
+		return 0, false
+	}
+	xa, okA := numeric(*r.A)
+	xb, okB := numeric(*r.B)
+	return xb - xa, okA && okB
+}
+
+// diffValues lists all the values of a and b sorted by name.
+func diffValues(a, b experiments.TypedValues) []valueDiffRow {
+	keySet := make(map[string]struct{})
+	for k := range a {
+		keySet[k] = struct{}{}
+	}
+	for k := range b {
+		keySet[k] = struct{}{}
+	}
+	var keys []string
+	for k := range keySet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var res []valueDiffRow
+	for _, k := range keys {
+		r := valueDiffRow{Key: k}
+		if v, ok := a[k]; ok {
+			r.A = &v
+		}
+		if v, ok := b[k]; ok {
+			r.B = &v
+		}
+		res = append(res, r)
+	}
+	return res
+}
@@ -16,50 +16,118 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"runtime/metrics"
 	"runtime/pprof"
 	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/experiments"
 	"github.com/stockparfait/experiments/autocorr"
 	"github.com/stockparfait/experiments/beta"
+	"github.com/stockparfait/experiments/compounding"
 	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/experiments/copula"
+	"github.com/stockparfait/experiments/crash"
+	"github.com/stockparfait/experiments/crosscorr"
+	"github.com/stockparfait/experiments/dataquality"
+	"github.com/stockparfait/experiments/deciles"
 	"github.com/stockparfait/experiments/distribution"
+	"github.com/stockparfait/experiments/eventstudy"
+	"github.com/stockparfait/experiments/export"
+	"github.com/stockparfait/experiments/extremes"
+	"github.com/stockparfait/experiments/generate"
 	"github.com/stockparfait/experiments/hold"
+	"github.com/stockparfait/experiments/liquidity"
+	"github.com/stockparfait/experiments/options"
+	"github.com/stockparfait/experiments/pair"
 	"github.com/stockparfait/experiments/portfolio"
 	"github.com/stockparfait/experiments/powerdist"
+	"github.com/stockparfait/experiments/render"
+	"github.com/stockparfait/experiments/report"
+	"github.com/stockparfait/experiments/seasonality"
 	"github.com/stockparfait/experiments/simulator"
 	"github.com/stockparfait/experiments/trading"
 	"github.com/stockparfait/logging"
 	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/table"
 )
 
 type Flags struct {
-	DBDir        string // default: ~/.stockparfait/sharadar
-	Config       string // required
-	LogLevel     logging.Level
-	DataJsPath   string // write data.js to this path
-	DataJSONPath string // write data.json to this path
-	CPUProf      string // write CPU profiling data to this file
+	DBDir         string // default: ~/.stockparfait/sharadar
+	Config        string // required
+	LogLevel      logging.Level
+	DataJsPath    string // write data.js to this path
+	DataJSONPath  string // write data.json to this path
+	HTMLPath      string // write a self-contained HTML report to this path
+	HTMLJSDir     string // inline Chart.js from this directory into the report
+	PNGDir        string // render each graph as a PNG image into this directory
+	SVGDir        string // render each graph as an SVG image into this directory
+	CPUProf       string // write CPU profiling data to this file
+	StreamValues  string // stream values as they are added to this file or "-"
+	SortedValues  bool   // print all values sorted at the end
+	ValuesJSON    string // write typed values to this JSON file
+	ValuesCSV     string // write typed values to this CSV file
+	MetricsCSV    string // write per-experiment runtime and allocations
+	SummaryCSV    string // write selected values, one row per experiment
+	SummaryValues string // comma-separated patterns of the summary values
+	Deterministic bool   // serialize parallel maps and fix random seeds
+	Watch         bool   // rerun whenever the config file changes
+	OutDir        string // directory for relative output paths
+	Manifest      string // write the run provenance to this JSON file
+	Defines       defines
 }
 
 func parseFlags(args []string) (*Flags, error) {
 	var flags Flags
-	fs := flag.NewFlagSet("experiments", flag.ExitOnError)
+	fs := newFlagSet("run", &flags.LogLevel)
 	fs.StringVar(&flags.DBDir, "cache",
 		filepath.Join(os.Getenv("HOME"), ".stockparfait", "sharadar"),
 		"database path")
 	fs.StringVar(&flags.Config, "conf", "", "configuration file (required)")
-	flags.LogLevel = logging.Info
-	fs.Var(&flags.LogLevel, "log-level", "Log level: debug, info, warning, error")
+	flags.Defines = make(defines)
+	fs.Var(flags.Defines, "define", defineUsage)
 	fs.StringVar(&flags.DataJsPath, "js", "", "file to write 'data.js' plots")
 	fs.StringVar(&flags.DataJSONPath, "json", "", "file to write 'data.json' plots")
+	fs.StringVar(&flags.HTMLPath, "html", "",
+		"file to write a self-contained HTML report with plots and values")
+	fs.StringVar(&flags.HTMLJSDir, "html-js", "",
+		"directory with Chart.js files to inline into the HTML report; by default, they are loaded from a CDN")
+	fs.StringVar(&flags.PNGDir, "png-dir", "",
+		"directory to write each graph as a static PNG image")
+	fs.StringVar(&flags.SVGDir, "svg-dir", "",
+		"directory to write each graph as a static SVG image")
 	fs.StringVar(&flags.CPUProf, "cpuprof", "",
 		"file to write CPU profile data in pprof format. Note: adds performance cost.")
+	fs.StringVar(&flags.StreamValues, "stream-values", "",
+		"print values as they are produced to this file, or to stdout when '-'")
+	fs.BoolVar(&flags.SortedValues, "sorted-values", true,
+		"print all the values sorted by key at the end of the run")
+	fs.StringVar(&flags.ValuesJSON, "values-json", "",
+		"file to write the typed values as JSON")
+	fs.StringVar(&flags.ValuesCSV, "values-csv", "",
+		"file to write the typed values as CSV")
+	fs.StringVar(&flags.MetricsCSV, "metrics-csv", "",
+		"file to write the runtime, total allocations and peak heap of each experiment")
+	fs.StringVar(&flags.SummaryCSV, "summary-csv", "",
+		"file to write a table of the values selected by -summary-values, one row per experiment instance")
+	fs.StringVar(&flags.SummaryValues, "summary-values", "*",
+		"comma-separated glob patterns of the value names, without the experiment ID, for -summary-csv")
+	fs.BoolVar(&flags.Deterministic, "deterministic", false,
+		"run on a single worker with fixed random seeds for bit-identical results; runtime and memory values are omitted")
+	fs.BoolVar(&flags.Watch, "watch", false,
+		"keep running, and rerun the config and rewrite all the outputs whenever the config file changes; stop with Ctrl-C")
+	fs.StringVar(&flags.OutDir, "out-dir", "",
+		"directory for all the output files given as relative paths, both in the flags and in the experiment configs, created if necessary")
+	fs.StringVar(&flags.Manifest, "manifest", "",
+		"file to write the run manifest: the resolved config and its hash, DBs, version, seeds and timing; default: manifest.json in -out-dir, if set")
 
 	err := fs.Parse(args)
 	if err != nil {
@@ -68,10 +136,109 @@ func parseFlags(args []string) (*Flags, error) {
 	if flags.Config == "" {
 		return nil, errors.Reason("missing required -conf")
 	}
+	if flags.OutDir != "" {
+		if flags.Manifest == "" {
+			flags.Manifest = "manifest.json"
+		}
+		outputs := []*string{
+			&flags.DataJsPath, &flags.DataJSONPath, &flags.HTMLPath, &flags.PNGDir,
+			&flags.SVGDir, &flags.CPUProf, &flags.StreamValues, &flags.ValuesJSON,
+			&flags.ValuesCSV, &flags.MetricsCSV, &flags.SummaryCSV, &flags.Manifest,
+		}
+		ctx := experiments.UseOutputDir(context.Background(), flags.OutDir)
+		for _, p := range outputs {
+			*p = experiments.OutputPath(ctx, *p)
+		}
+	}
 	return &flags, err
 }
 
-func runExperiment(ctx context.Context, ec config.ExperimentConfig) error {
+// metricsRow is a row of the per-experiment metrics table.
+type metricsRow struct {
+	Name     string
+	ID       string
+	Runtime  time.Duration
+	Alloc    uint64 // total bytes allocated during the run
+	PeakHeap uint64 // bytes of the largest live heap during the run
+}
+
+var _ table.Row = metricsRow{}
+
+func metricsHeader() []string {
+	return []string{"Experiment", "ID", "Runtime (s)", "Total alloc (MB)", "Peak heap (MB)"}
+}
+
+func (r metricsRow) CSV() []string {
+	return []string{
+		r.Name,
+		r.ID,
+		fmt.Sprintf("%g", r.Runtime.Seconds()),
+		fmt.Sprintf("%g", float64(r.Alloc)/(1<<20)),
+		fmt.Sprintf("%g", float64(r.PeakHeap)/(1<<20)),
+	}
+}
+
+// heapSampleInterval is how often the heap size is sampled for the peak heap
+// metric.
+var heapSampleInterval = 10 * time.Millisecond
+
+// heapMetric is the runtime metric of the heap occupied by live and not yet
+// swept objects, the equivalent of runtime.MemStats.HeapAlloc.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// peakHeap tracks the largest heap size by sampling it in the background until
+// stopped. Peaks shorter than heapSampleInterval may be missed.
+type peakHeap struct {
+	done chan struct{}
+	res  chan uint64
+}
+
+func heapBytes() uint64 {
+	s := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s[0].Value.Uint64()
+}
+
+func startPeakHeap() *peakHeap {
+	p := &peakHeap{done: make(chan struct{}), res: make(chan uint64)}
+	go func() {
+		peak := heapBytes()
+		t := time.NewTicker(heapSampleInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-p.done:
+				if h := heapBytes(); h > peak {
+					peak = h
+				}
+				p.res <- peak
+				return
+			}
+			if h := heapBytes(); h > peak {
+				peak = h
+			}
+		}
+	}()
+	return p
+}
+
+// stop sampling and return the peak heap size in bytes.
+func (p *peakHeap) stop() uint64 {
+	close(p.done)
+	return <-p.res
+}
+
+// runExperiment runs the experiment configured by ec, measuring its wall-clock
+// runtime, the total memory allocated and the peak heap size during the run.
+// These are added to the values as "runtime <id>", "alloc <id>" and "peak heap
+// <id>", where <id> is the experiment's ID or, if empty, its name, and to the
+// metrics table, if not nil. The peak heap includes the memory still held by
+// the previous experiments, e.g. their plots.
+func runExperiment(ctx context.Context, ec config.ExperimentConfig, metrics *table.Table) error {
 	var e experiments.Experiment
 	switch ec.(type) {
 	case *config.TestExperimentConfig:
@@ -88,16 +255,99 @@ func runExperiment(ctx context.Context, ec config.ExperimentConfig) error {
 		e = &autocorr.AutoCorrelation{}
 	case *config.Beta:
 		e = &beta.Beta{}
+	case *config.Hedge:
+		e = &beta.Hedge{}
 	case *config.Trading:
 		e = &trading.Trading{}
 	case *config.Simulator:
 		e = &simulator.Simulator{}
+	case *config.Extremes:
+		e = &extremes.Extremes{}
+	case *config.Crash:
+		e = &crash.Crash{}
+	case *config.Deciles:
+		e = &deciles.Deciles{}
+	case *config.Liquidity:
+		e = &liquidity.Liquidity{}
+	case *config.Compounding:
+		e = &compounding.Compounding{}
+	case *config.Pair:
+		e = &pair.Pair{}
+	case *config.CrossCorrelation:
+		e = &crosscorr.CrossCorrelation{}
+	case *config.EventStudy:
+		e = &eventstudy.EventStudy{}
+	case *config.Seasonality:
+		e = &seasonality.Seasonality{}
+	case *config.Copula:
+		e = &copula.Copula{}
+	case *config.Options:
+		e = &options.Options{}
+	case *config.DataQuality:
+		e = &dataquality.DataQuality{}
+	case *config.Generate:
+		e = &generate.Generate{}
+	case *config.Export:
+		e = &export.Export{}
 	default:
 		return errors.Reason("unsupported experiment '%s'", ec.Name())
 	}
-	if err := e.Run(ctx, ec); err != nil {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	peak := startPeakHeap()
+	err := e.Run(ctx, ec)
+	peakHeap := peak.stop()
+	if err != nil {
 		return errors.Annotate(err, "failed experiment '%s'", ec.Name())
 	}
+	row := metricsRow{
+		Name:     ec.Name(),
+		ID:       config.ExperimentID(ec),
+		Runtime:  time.Since(start),
+		PeakHeap: peakHeap,
+	}
+	runtime.ReadMemStats(&after)
+	row.Alloc = after.TotalAlloc - before.TotalAlloc
+	if metrics != nil {
+		metrics.AddRow(row)
+	}
+	// Runtime and allocations would break the reproducibility of values.
+	if experiments.Deterministic(ctx) {
+		return nil
+	}
+	id := row.ID
+	if id == "" {
+		id = row.Name
+	}
+	err = experiments.AddTypedValue(ctx, "", "runtime "+id,
+		experiments.FloatValue(row.Runtime.Seconds()).WithUnit("s"))
+	if err != nil {
+		return errors.Annotate(err, "failed to add runtime value")
+	}
+	err = experiments.AddTypedValue(ctx, "", "alloc "+id,
+		experiments.FloatValue(float64(row.Alloc)/(1<<20)).WithUnit("MB"))
+	if err != nil {
+		return errors.Annotate(err, "failed to add alloc value")
+	}
+	err = experiments.AddTypedValue(ctx, "", "peak heap "+id,
+		experiments.FloatValue(float64(row.PeakHeap)/(1<<20)).WithUnit("MB"))
+	if err != nil {
+		return errors.Annotate(err, "failed to add peak heap value")
+	}
+	return nil
+}
+
+func writeMetrics(path string, metrics *table.Table) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "cannot open file for writing :'%s'", path)
+	}
+	defer f.Close()
+
+	if err := metrics.WriteCSV(f, table.Params{}); err != nil {
+		return errors.Annotate(err, "failed to write '%s'", path)
+	}
 	return nil
 }
 
@@ -117,6 +367,60 @@ func printValues(ctx context.Context) error {
 	return nil
 }
 
+func writeValues(ctx context.Context, flags *Flags) error {
+	if flags.ValuesJSON == "" && flags.ValuesCSV == "" {
+		return nil
+	}
+	values := experiments.GetTypedValues(ctx)
+	if values == nil {
+		return errors.Reason("no typed values in context")
+	}
+	if flags.ValuesJSON != "" {
+		f, err := os.OpenFile(flags.ValuesJSON,
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Annotate(err, "cannot open file for writing :'%s'",
+				flags.ValuesJSON)
+		}
+		defer f.Close()
+
+		if err := experiments.WriteValuesJSON(f, values); err != nil {
+			return errors.Annotate(err, "failed to write '%s'", flags.ValuesJSON)
+		}
+	}
+	if flags.ValuesCSV != "" {
+		f, err := os.OpenFile(flags.ValuesCSV,
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Annotate(err, "cannot open file for writing :'%s'",
+				flags.ValuesCSV)
+		}
+		defer f.Close()
+
+		if err := experiments.WriteValuesCSV(f, values); err != nil {
+			return errors.Annotate(err, "failed to write '%s'", flags.ValuesCSV)
+		}
+	}
+	return nil
+}
+
+// writeSummaries writes the summary statistics tables of distribution plots,
+// each to its own CSV file.
+func writeSummaries(ctx context.Context) error {
+	for path, t := range experiments.GetSummaryTables(ctx) {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Annotate(err, "cannot open file for writing :'%s'", path)
+		}
+		err = t.WriteCSV(f, table.Params{})
+		f.Close()
+		if err != nil {
+			return errors.Annotate(err, "failed to write '%s'", path)
+		}
+	}
+	return nil
+}
+
 func writePlots(ctx context.Context, flags *Flags) error {
 	if flags.DataJsPath != "" {
 		f, err := os.OpenFile(flags.DataJsPath,
@@ -131,6 +435,33 @@ func writePlots(ctx context.Context, flags *Flags) error {
 			return errors.Annotate(err, "failed to write '%s'", flags.DataJsPath)
 		}
 	}
+	if flags.HTMLPath != "" {
+		f, err := os.OpenFile(flags.HTMLPath,
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Annotate(err, "cannot open file for writing :'%s'",
+				flags.HTMLPath)
+		}
+		defer f.Close()
+
+		err = report.WriteHTML(ctx, f, report.Params{
+			Title: filepath.Base(flags.Config),
+			JSDir: flags.HTMLJSDir,
+		})
+		if err != nil {
+			return errors.Annotate(err, "failed to write '%s'", flags.HTMLPath)
+		}
+	}
+	if flags.PNGDir != "" {
+		if err := render.WriteFiles(ctx, flags.PNGDir, render.PNG, render.Params{}); err != nil {
+			return errors.Annotate(err, "failed to write PNG images")
+		}
+	}
+	if flags.SVGDir != "" {
+		if err := render.WriteFiles(ctx, flags.SVGDir, render.SVG, render.Params{}); err != nil {
+			return errors.Annotate(err, "failed to write SVG images")
+		}
+	}
 	if flags.DataJSONPath != "" {
 		f, err := os.OpenFile(flags.DataJSONPath,
 			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
@@ -148,6 +479,11 @@ func writePlots(ctx context.Context, flags *Flags) error {
 }
 
 func run(ctx context.Context, flags *Flags) error {
+	if flags.OutDir != "" {
+		if err := os.MkdirAll(flags.OutDir, 0777); err != nil {
+			return errors.Annotate(err, "failed to create output directory")
+		}
+	}
 	if flags.CPUProf != "" {
 		f, err := os.OpenFile(flags.CPUProf, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
@@ -159,44 +495,178 @@ func run(ctx context.Context, flags *Flags) error {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	cfg, err := config.Load(flags.Config)
+	switch flags.StreamValues {
+	case "":
+	case "-":
+		ctx = experiments.UseValuesWriter(ctx, os.Stdout)
+	default:
+		f, err := os.OpenFile(flags.StreamValues,
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Annotate(err, "cannot open file for writing :'%s'",
+				flags.StreamValues)
+		}
+		defer f.Close()
+		ctx = experiments.UseValuesWriter(ctx, f)
+	}
+	if flags.Deterministic {
+		ctx = experiments.UseDeterministic(ctx)
+	}
+	cfg, err := config.LoadWithVars(flags.Config, flags.Defines)
 	if err != nil {
 		return errors.Annotate(err, "failed to load config")
 	}
+	var m *manifest
+	var seeds experiments.SeedLog
+	if flags.Manifest != "" {
+		if m, err = newManifest(flags, cfg); err != nil {
+			return errors.Annotate(err, "failed to create manifest")
+		}
+		ctx = experiments.UseSeedLog(ctx, &seeds)
+	}
 	if err := plot.ConfigureGroups(ctx, cfg.Groups); err != nil {
 		return errors.Annotate(err, "failed to add groups")
 	}
+	if cfg.AutoCreateGraphs {
+		ctx = experiments.UseAutoCreateGraphs(ctx)
+	}
+	if cfg.MaxPoints > 0 {
+		ctx = experiments.UseMaxPoints(ctx, cfg.MaxPoints)
+	}
+	if len(cfg.SharedBuckets) > 0 {
+		shared := experiments.NewSharedBuckets(cfg.SharedBuckets)
+		ctx = experiments.UseSharedBuckets(ctx, shared)
+	}
+	var metrics *table.Table
+	if flags.MetricsCSV != "" {
+		metrics = table.NewTable(metricsHeader()...)
+	}
+	var summary *valuesSummary
+	if flags.SummaryCSV != "" {
+		summary, err = newValuesSummary(strings.Split(flags.SummaryValues, ","))
+		if err != nil {
+			return errors.Annotate(err, "invalid -summary-values")
+		}
+	}
 	for _, e := range cfg.Experiments {
-		if err := runExperiment(ctx, e.Config); err != nil {
+		if ctx.Err() != nil {
+			logging.Warningf(ctx, "interrupted, skipping '%s' and the rest",
+				e.Config.Name())
+			break
+		}
+		ctx := ctx
+		if e.GraphPrefix != "" {
+			ctx = experiments.UseGraphPrefix(ctx, e.GraphPrefix)
+		}
+		if dir := filepath.Join(flags.OutDir, e.OutputSubdir); dir != "" {
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return errors.Annotate(err, "failed to create output directory for '%s'",
+					e.Config.Name())
+			}
+			ctx = experiments.UseOutputDir(ctx, dir)
+		}
+		var instance experiments.TypedValues
+		if summary != nil {
+			instance = make(experiments.TypedValues)
+			ctx = experiments.UseInstanceValues(ctx, instance)
+		}
+		if err := runExperiment(ctx, e.Config, metrics); err != nil {
 			return errors.Annotate(err, "failed to run experiment '%s'",
 				e.Config.Name())
 		}
+		if summary != nil {
+			summary.add(e.Config.Name(), config.ExperimentID(e.Config), instance)
+		}
+	}
+	if err := experiments.PlotSharedDistributions(ctx); err != nil {
+		return errors.Annotate(err, "failed to plot distributions with shared buckets")
+	}
+	if metrics != nil {
+		if err := writeMetrics(flags.MetricsCSV, metrics); err != nil {
+			return errors.Annotate(err, "failed to write metrics")
+		}
+	}
+	if summary != nil {
+		if err := summary.write(flags.SummaryCSV); err != nil {
+			return errors.Annotate(err, "failed to write values summary")
+		}
+	}
+	if flags.SortedValues {
+		if err := printValues(ctx); err != nil {
+			return errors.Annotate(err, "failed to print values")
+		}
 	}
-	if err := printValues(ctx); err != nil {
-		return errors.Annotate(err, "failed to print values")
+	if err := writeValues(ctx, flags); err != nil {
+		return errors.Annotate(err, "failed to write values")
+	}
+	if err := writeSummaries(ctx); err != nil {
+		return errors.Annotate(err, "failed to write summary tables")
 	}
 	if err := writePlots(ctx, flags); err != nil {
 		return errors.Annotate(err, "failed to write plots")
 	}
+	if m != nil {
+		if err := m.write(flags.Manifest, experiments.Deterministic(ctx), &seeds); err != nil {
+			return errors.Annotate(err, "failed to write manifest")
+		}
+	}
+	if ctx.Err() != nil {
+		return errors.Reason("interrupted; partial results are written")
+	}
 	return nil
 }
 
-// main should remain minimal, as it is not unit-tested due to os.Exit.
-func main() {
-	ctx := context.Background()
-	flags, err := parseFlags(os.Args[1:])
-	if err != nil {
-		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
-		logging.Errorf(ctx, "failed to parse flags:\n%s", err.Error())
-		os.Exit(1)
+// watchInterval is how often the config file is checked for changes in the
+// -watch mode.
+var watchInterval = 500 * time.Millisecond
+
+// fileStamp identifies a version of a file for detecting its changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watch reruns the config with fresh outputs whenever the config file changes,
+// until the context is canceled. Errors in a run, such as an invalid config
+// saved midway through editing, are logged and do not stop the watch.
+func watch(ctx context.Context, flags *Flags) error {
+	var last fileStamp
+	logging.Infof(ctx, "watching '%s' for changes; press Ctrl-C to stop", flags.Config)
+	for {
+		// The file may be briefly missing while an editor replaces it.
+		if fi, err := os.Stat(flags.Config); err == nil {
+			stamp := fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+			if stamp != last {
+				last = stamp
+				err := run(useOutputs(ctx), flags)
+				switch {
+				case ctx.Err() != nil: // interrupted; partial results are written
+				case err != nil:
+					logging.Errorf(ctx, "%s", err.Error())
+				default:
+					logging.Infof(ctx, "done; waiting for changes in '%s'", flags.Config)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchInterval):
+		}
 	}
-	ctx = logging.Use(ctx, logging.DefaultGoLogger(flags.LogLevel))
-	canvas := plot.NewCanvas()
-	values := make(experiments.Values)
-	ctx = plot.Use(ctx, canvas)
-	ctx = experiments.UseValues(ctx, values)
+}
 
-	if err := run(ctx, flags); err != nil {
+// main should remain minimal, as it is not unit-tested due to os.Exit.
+func main() {
+	ctx := logging.Use(context.Background(), logging.DefaultGoLogger(logging.Info))
+	// The first Ctrl-C cancels the context, letting the run stop early and write
+	// out whatever it has computed; a second one kills the process.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if err := dispatch(ctx, os.Args[1:], os.Stdout); err != nil {
 		logging.Errorf(ctx, err.Error())
 		os.Exit(1)
 	}
@@ -16,12 +16,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
 	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
 	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/testutil"
 
@@ -39,11 +45,24 @@ func TestMain(t *testing.T) {
 
 	Convey("parseFlags", t, func() {
 		flags, err := parseFlags([]string{
-			"-conf", "c.json", "-cache", "path/to/cache", "-log-level", "warning"})
+			"-conf", "c.json", "-cache", "path/to/cache", "-log-level", "warning",
+			"-define", "A=1", "-define", "B=x=y"})
 		So(err, ShouldBeNil)
 		So(flags.DBDir, ShouldEqual, "path/to/cache")
 		So(flags.Config, ShouldEqual, "c.json")
 		So(flags.LogLevel, ShouldEqual, logging.Warning)
+		So(flags.SortedValues, ShouldBeTrue)
+		So(flags.Defines, ShouldResemble, defines{"A": "1", "B": "x=y"})
+	})
+
+	Convey("peakHeap tracks the largest heap", t, func() {
+		p := startPeakHeap()
+		buf := make([]byte, 64<<20)
+		buf[len(buf)-1] = 1
+		time.Sleep(3 * heapSampleInterval)
+		peak := p.stop()
+		So(buf[len(buf)-1], ShouldEqual, 1) // keep buf alive until stopped
+		So(peak, ShouldBeGreaterThanOrEqualTo, uint64(len(buf)))
 	})
 
 	Convey("run a test experiment end to end", t, func() {
@@ -57,9 +76,16 @@ func TestMain(t *testing.T) {
 
 		dataJs := filepath.Join(tmpdir, "data.js")
 		dataJSON := filepath.Join(tmpdir, "data.json")
+		valuesPath := filepath.Join(tmpdir, "values.txt")
+		valuesJSON := filepath.Join(tmpdir, "values.json")
+		valuesCSV := filepath.Join(tmpdir, "values.csv")
+		metricsCSV := filepath.Join(tmpdir, "metrics.csv")
 
 		flags, err := parseFlags([]string{
-			"-conf", confPath, "-js", dataJs, "-json", dataJSON})
+			"-conf", confPath, "-js", dataJs, "-json", dataJSON,
+			"-stream-values", valuesPath, "-sorted-values=false",
+			"-values-json", valuesJSON, "-values-csv", valuesCSV,
+			"-metrics-csv", metricsCSV})
 		So(err, ShouldBeNil)
 
 		ctx := context.Background()
@@ -68,13 +94,40 @@ func TestMain(t *testing.T) {
 		values := make(experiments.Values)
 		ctx = plot.Use(ctx, canvas)
 		ctx = experiments.UseValues(ctx, values)
+		ctx = experiments.UseTypedValues(ctx, make(experiments.TypedValues))
 
 		So(run(ctx, flags), ShouldBeNil)
 
+		// Runtime metrics vary from run to run.
+		So(values, ShouldContainKey, "runtime test")
+		So(values, ShouldContainKey, "alloc test")
+		So(values, ShouldContainKey, "peak heap test")
+		delete(values, "runtime test")
+		delete(values, "alloc test")
+		delete(values, "peak heap test")
 		So(values, ShouldResemble, map[string]string{
 			"grade": "2",
 			"test":  "failed",
 		})
+		So(testutil.ReadFile(valuesPath), ShouldContainSubstring, "grade: 2\n")
+		So(testutil.ReadFile(valuesJSON), ShouldContainSubstring, `
+  "grade": {
+    "kind": "float",
+    "value": 2
+  },`)
+		So(testutil.ReadFile(valuesJSON), ShouldContainSubstring, `
+  "test": {
+    "kind": "string",
+    "value": "failed"
+  }
+}
+`)
+		So(testutil.ReadFile(valuesCSV), ShouldStartWith, `Name,Kind,Value,Unit
+alloc test,float,`)
+		So(testutil.ReadFile(valuesCSV), ShouldContainSubstring, "\ngrade,float,2,\n")
+		So(testutil.ReadFile(valuesCSV), ShouldEndWith, "\ntest,string,failed,\n")
+		So(testutil.ReadFile(metricsCSV), ShouldStartWith,
+			"Experiment,ID,Runtime (s),Total alloc (MB),Peak heap (MB)\ntest,,")
 
 		expectedJSON := `{"Groups":[{"Kind":"KindXY","Title":"xy","XLogScale":false,"Graphs":[{"Kind":"KindXY","Title":"","XLabel":"","YLogScale":false,"Plots":[{"Kind":"KindXY","X":[1,2],"Y":[21.5,42],"YLabel":"values","Legend":"Unnamed","ChartType":"ChartLine","LeftAxis":false}]}],"MinX":1,"MaxX":2}]}`
 
@@ -82,4 +135,279 @@ func TestMain(t *testing.T) {
 		So(testutil.ReadFile(dataJs), ShouldContainSubstring, "var DATA = "+expectedJSON)
 
 	})
+
+	Convey("summary table across experiment instances", t, func() {
+		confPath := filepath.Join(tmpdir, "config_summary.json")
+		So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "xy", "graphs": [{"id": "r1"}]}],
+  "experiments": [
+    {"test": {"id": "t1", "graph": "r1", "grade": 1.5}},
+    {"test": {"id": "t2", "graph": "r1", "grade": 3, "passed": true}},
+    {"test": {"graph": "r1"}},
+    {"test": {"graph": "r1", "grade": 4}},
+    {"test": {"id": "t1", "graph": "r1", "grade": 1.5}}
+  ]
+}`), ShouldBeNil)
+		summaryCSV := filepath.Join(tmpdir, "summary_values.csv")
+		flags, err := parseFlags([]string{
+			"-conf", confPath, "-sorted-values=false", "-deterministic",
+			"-summary-csv", summaryCSV, "-summary-values", "gr*,test"})
+		So(err, ShouldBeNil)
+
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Error))
+		ctx = plot.Use(ctx, plot.NewCanvas())
+		ctx = experiments.UseValues(ctx, make(experiments.Values))
+		ctx = experiments.UseTypedValues(ctx, make(experiments.TypedValues))
+
+		So(run(ctx, flags), ShouldBeNil)
+		So(testutil.ReadFile(summaryCSV), ShouldEqual, `Experiment,ID,grade,test
+test,t1,1.5,failed
+test,t2,3,passed
+test,,2,failed
+test,,4,failed
+test,t1,1.5,failed
+`)
+	})
+
+	Convey("deterministic runs are identical", t, func() {
+		confPath := filepath.Join(tmpdir, "config_deterministic.json")
+		So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "dist", "graphs": [{"id": "d"}]}],
+  "experiments": [{"distribution": {
+    "data": {
+      "daily distribution": {"name": "t", "alpha": 3},
+      "tickers": 5,
+      "days": 200,
+      "batch size": 1
+    },
+    "log-profits": {"graph": "d", "buckets": {"n": 11}}
+  }}]
+}`), ShouldBeNil)
+		dataJSON := filepath.Join(tmpdir, "data_deterministic.json")
+		flags, err := parseFlags([]string{
+			"-conf", confPath, "-json", dataJSON, "-sorted-values=false",
+			"-deterministic"})
+		So(err, ShouldBeNil)
+		So(flags.Deterministic, ShouldBeTrue)
+
+		runOnce := func() (experiments.Values, string) {
+			ctx := context.Background()
+			ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Error))
+			values := make(experiments.Values)
+			ctx = plot.Use(ctx, plot.NewCanvas())
+			ctx = experiments.UseValues(ctx, values)
+			So(run(ctx, flags), ShouldBeNil)
+			return values, testutil.ReadFile(dataJSON)
+		}
+		values, data := runOnce()
+		So(values, ShouldNotContainKey, "runtime distribution")
+		So(values["samples"], ShouldEqual, "995")
+		values2, data2 := runOnce()
+		So(values2, ShouldResemble, values)
+		So(data2, ShouldEqual, data)
+	})
+
+	Convey("interrupted run writes partial results", t, func() {
+		confPath := filepath.Join(tmpdir, "config_interrupted.json")
+		So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "xy", "graphs": [{"id": "r1"}]}],
+  "experiments": [{"test": {"graph": "r1"}}]
+}`), ShouldBeNil)
+		dataJSON := filepath.Join(tmpdir, "data_interrupted.json")
+		flags, err := parseFlags([]string{
+			"-conf", confPath, "-json", dataJSON, "-sorted-values=false"})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Error))
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, plot.NewCanvas())
+		ctx = experiments.UseValues(ctx, values)
+
+		err = run(ctx, flags)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "interrupted")
+		So(values, ShouldBeEmpty)
+		So(testutil.ReadFile(dataJSON), ShouldContainSubstring, `"Graphs":[{"Kind":"KindXY"`)
+	})
+
+	Convey("run interrupted midway writes the completed results", t, func() {
+		confPath := filepath.Join(tmpdir, "config_interrupted_midway.json")
+		So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "xy", "graphs": [{"id": "r1"}, {"id": "d"}]}],
+  "experiments": [
+    {"test": {"graph": "r1"}},
+    {"distribution": {
+      "data": {"daily distribution": {"name": "t"}, "tickers": 5, "days": 20},
+      "log-profits": {"graph": "d"}
+    }}
+  ]
+}`), ShouldBeNil)
+		dataJSON := filepath.Join(tmpdir, "data_interrupted_midway.json")
+		flags, err := parseFlags([]string{
+			"-conf", confPath, "-json", dataJSON, "-sorted-values=false"})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Error))
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, plot.NewCanvas())
+		ctx = experiments.UseValues(ctx, values)
+		// Cancel as soon as the first experiment streams its first value.
+		ctx = experiments.UseValuesWriter(ctx, cancelWriter(cancel))
+
+		err = run(ctx, flags)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "interrupted")
+		So(values["test"], ShouldEqual, "failed")
+		So(values, ShouldNotContainKey, "tickers") // the second experiment is skipped
+		data := testutil.ReadFile(dataJSON)
+		So(data, ShouldContainSubstring, `"Y":[21.5,42]`)
+		So(data, ShouldContainSubstring, `"Plots":null`) // graph "d" is empty
+	})
+
+	Convey("output directory", t, func() {
+		confPath := filepath.Join(tmpdir, "config_outdir.json")
+		So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "dist", "graphs": [{"id": "d"}]}],
+  "experiments": [{"distribution": {
+    "output subdir": "dist",
+    "data": {
+      "daily distribution": {"name": "t", "alpha": 3},
+      "tickers": 2,
+      "days": 20
+    },
+    "log-profits": {
+      "graph": "d",
+      "buckets": {"n": 11},
+      "summary CSV": "summary.csv",
+      "histogram file": "hist.json"
+    }
+  }}]
+}`), ShouldBeNil)
+		outDir := filepath.Join(tmpdir, "out")
+		absJSON := filepath.Join(tmpdir, "data_outdir.json")
+		flags, err := parseFlags([]string{
+			"-conf", confPath, "-out-dir", outDir, "-js", "data.js",
+			"-json", absJSON, "-stream-values", "-", "-sorted-values=false"})
+		So(err, ShouldBeNil)
+		So(flags.DataJsPath, ShouldEqual, filepath.Join(outDir, "data.js"))
+		So(flags.DataJSONPath, ShouldEqual, absJSON)
+		So(flags.StreamValues, ShouldEqual, "-")
+
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Error))
+		ctx = plot.Use(ctx, plot.NewCanvas())
+		ctx = experiments.UseValues(ctx, make(experiments.Values))
+		ctx = experiments.UseSummaryTables(ctx, make(experiments.SummaryTables))
+		So(run(ctx, flags), ShouldBeNil)
+
+		So(testutil.ReadFile(filepath.Join(outDir, "data.js")), ShouldStartWith, "var DATA = ")
+		So(testutil.ReadFile(absJSON), ShouldStartWith, "{")
+		So(testutil.ReadFile(filepath.Join(outDir, "dist", "summary.csv")),
+			ShouldStartWith, "Legend,")
+		So(testutil.ReadFile(filepath.Join(outDir, "dist", "hist.json")),
+			ShouldContainSubstring, `"counts"`)
+
+		var m manifest
+		So(json.Unmarshal([]byte(testutil.ReadFile(filepath.Join(outDir, "manifest.json"))), &m), ShouldBeNil)
+		So(m.ConfigFile, ShouldEqual, confPath)
+		So(len(m.ConfigHash), ShouldEqual, 64)
+		So(string(m.Config), ShouldContainSubstring, `"output subdir": "dist"`)
+		So(m.DBs, ShouldResemble, []dbProvenance{})
+		So(m.Version.Go, ShouldNotBeEmpty)
+		So(m.End.Before(m.Start), ShouldBeFalse)
+	})
+
+	Convey("manifest lists DBs", t, func() {
+		w := db.NewWriter(tmpdir, "manifestDB")
+		So(w.WriteTickers(map[string]db.TickerRow{"A": {}}), ShouldBeNil)
+		So(w.WriteMetadata(w.Metadata), ShouldBeNil)
+		confPath := filepath.Join(tmpdir, "config_manifest.json")
+		So(testutil.WriteFile(confPath, fmt.Sprintf(`
+{
+  "experiments": [
+    {"distribution": {"data": {"DB": {"DB path": "%[1]s", "DB": "manifestDB"}}}},
+    {"beta": {
+      "data": {"DB": {"DB path": "%[1]s", "DB": "manifestDB"}},
+      "reference": {"DB": {"DB path": "%[1]s", "DB": "missing"}}
+    }}
+  ]
+}`, tmpdir)), ShouldBeNil)
+		cfg, err := config.Load(confPath)
+		So(err, ShouldBeNil)
+		dbs := configDBs(cfg)
+		So(len(dbs), ShouldEqual, 2)
+		So(dbs[0].Path, ShouldEqual, filepath.Join(tmpdir, "manifestDB"))
+		So(dbs[0].Updated.IsZero(), ShouldBeFalse)
+		So(dbs[0].Metadata.NumTickers, ShouldEqual, 1)
+		So(dbs[1].Path, ShouldEqual, filepath.Join(tmpdir, "missing"))
+		So(dbs[1].Updated.IsZero(), ShouldBeTrue)
+		So(dbs[1].Metadata, ShouldBeNil)
+	})
+
+	Convey("watch reruns on config changes", t, func() {
+		watchInterval = 10 * time.Millisecond
+		confPath := filepath.Join(tmpdir, "config_watch.json")
+		confJSON := func(grade int) string {
+			return fmt.Sprintf(`
+{
+  "groups": [{"id": "xy", "graphs": [{"id": "r1"}]}],
+  "experiments": [{"test": {"graph": "r1", "grade": %d}}]
+}`, grade)
+		}
+		So(testutil.WriteFile(confPath, confJSON(2)), ShouldBeNil)
+		valuesJSON := filepath.Join(tmpdir, "values_watch.json")
+		flags, err := parseFlags([]string{
+			"-conf", confPath, "-values-json", valuesJSON,
+			"-sorted-values=false", "-watch"})
+		So(err, ShouldBeNil)
+		So(flags.Watch, ShouldBeTrue)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Error))
+		done := make(chan error)
+		go func() { done <- watch(ctx, flags) }()
+
+		// waitGrade waits for the values file to report the grade.
+		waitGrade := func(grade int) bool {
+			expected := fmt.Sprintf(`
+  "grade": {
+    "kind": "float",
+    "value": %d
+  },`, grade)
+			for i := 0; i < 500; i++ {
+				if b, err := os.ReadFile(valuesJSON); err == nil && strings.Contains(string(b), expected) {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+		So(waitGrade(2), ShouldBeTrue)
+		// An invalid config doesn't stop the watch.
+		So(testutil.WriteFile(confPath, `{"experiments": [{"unknown": {}}]}`), ShouldBeNil)
+		time.Sleep(50 * time.Millisecond)
+		So(testutil.WriteFile(confPath, confJSON(3)), ShouldBeNil)
+		So(waitGrade(3), ShouldBeTrue)
+		cancel()
+		So(<-done, ShouldBeNil)
+	})
+}
+
+// cancelWriter cancels its context on every write.
+type cancelWriter context.CancelFunc
+
+func (c cancelWriter) Write(p []byte) (int, error) {
+	c()
+	return len(p), nil
 }
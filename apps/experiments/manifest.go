@@ -0,0 +1,191 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/stockparfait/db"
+)
+
+// manifest is the provenance record of a run, so that the plots and values
+// can be traced back to exactly what produced them.
+type manifest struct {
+	ConfigFile string            `json:"config file"`
+	Defines    map[string]string `json:"defines,omitempty"`
+	ConfigHash string            `json:"config hash"` // SHA-256 of compact Config
+	// Fully resolved config: with the variables expanded and the defaults
+	// filled in.
+	Config        json.RawMessage `json:"config"`
+	DBs           []dbProvenance  `json:"DBs"`
+	Version       buildVersion    `json:"version"`
+	Deterministic bool            `json:"deterministic"`
+	// Seeds generated for the random sources not seeded in the config.
+	Seeds   []uint64  `json:"seeds"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Runtime float64   `json:"runtime seconds"`
+}
+
+// dbProvenance identifies a version of a DB used by the experiments.
+type dbProvenance struct {
+	Path string `json:"path"`
+	// Modification time of the DB metadata file, which is rewritten on every
+	// DB update. Zero if the DB does not exist.
+	Updated  time.Time    `json:"updated"`
+	Metadata *db.Metadata `json:"metadata,omitempty"`
+}
+
+type buildVersion struct {
+	Module   string `json:"module"`
+	Version  string `json:"version"`
+	Revision string `json:"revision,omitempty"` // VCS revision, if known
+	Modified bool   `json:"modified,omitempty"` // built with local changes
+	Go       string `json:"go"`
+}
+
+// newManifest starts the manifest of a run of cfg loaded as per flags.
+func newManifest(flags *Flags, cfg *config.Config) (*manifest, error) {
+	js, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to marshal the config")
+	}
+	hash := sha256.Sum256(js)
+	m := &manifest{
+		ConfigFile: flags.Config,
+		ConfigHash: hex.EncodeToString(hash[:]),
+		Config:     js,
+		DBs:        configDBs(cfg),
+		Version:    version(),
+		Start:      time.Now(),
+	}
+	if len(flags.Defines) > 0 {
+		m.Defines = flags.Defines
+	}
+	return m, nil
+}
+
+// configDBs lists all the DBs referenced in the experiment configs, sorted by
+// their paths.
+func configDBs(cfg *config.Config) []dbProvenance {
+	readers := make(map[string]*db.Reader)
+	for _, e := range cfg.Experiments {
+		findReaders(reflect.ValueOf(e.Config), readers)
+	}
+	var paths []string
+	for p := range readers {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	res := []dbProvenance{}
+	for _, p := range paths {
+		d := dbProvenance{Path: p}
+		// The same file name as used by db.Reader.
+		if fi, err := os.Stat(filepath.Join(p, "metadata.json")); err == nil {
+			d.Updated = fi.ModTime().UTC()
+			if md, err := readers[p].Metadata(); err == nil {
+				d.Metadata = &md
+			}
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+var readerType = reflect.TypeOf(&db.Reader{})
+
+// findReaders recursively collects all the DB readers in the exported fields
+// of v by their DB paths.
+func findReaders(v reflect.Value, readers map[string]*db.Reader) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if v.Type() == readerType {
+			r := v.Interface().(*db.Reader)
+			readers[filepath.Join(r.DBPath, r.DB)] = r
+			return
+		}
+		findReaders(v.Elem(), readers)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				findReaders(v.Field(i), readers)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			findReaders(v.Index(i), readers)
+		}
+	case reflect.Map:
+		it := v.MapRange()
+		for it.Next() {
+			findReaders(it.Value(), readers)
+		}
+	}
+}
+
+// version of the binary from its build info.
+func version() buildVersion {
+	v := buildVersion{Go: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.Module = bi.Main.Path
+	v.Version = bi.Main.Version
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+// write completes the manifest and writes it to path as JSON.
+func (m *manifest) write(path string, deterministic bool, seeds *experiments.SeedLog) error {
+	m.Deterministic = deterministic
+	m.Seeds = seeds.Seeds()
+	m.End = time.Now()
+	m.Runtime = m.End.Sub(m.Start).Seconds()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "cannot open file for writing :'%s'", path)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return errors.Annotate(err, "failed to write '%s'", path)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/stockparfait/table"
+)
+
+// valuesSummary collects the values of each experiment instance matching any
+// of the patterns into a table with one row per instance and one column per
+// value name. The patterns are path.Match globs applied to the value names
+// without the instance ID prefix, e.g. "alpha" or "MAD*".
+type valuesSummary struct {
+	patterns []string
+	rows     []summaryRow
+	columns  map[string]struct{}
+}
+
+type summaryRow struct {
+	Name   string
+	ID     string
+	Values map[string]experiments.Value
+}
+
+func newValuesSummary(patterns []string) (*valuesSummary, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Annotate(err, "invalid pattern '%s'", p)
+		}
+	}
+	return &valuesSummary{patterns: patterns, columns: make(map[string]struct{})}, nil
+}
+
+func (s *valuesSummary) match(key string) bool {
+	for _, p := range s.patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// add a row of the values added by the experiment instance.
+func (s *valuesSummary) add(name, id string, values experiments.TypedValues) {
+	row := summaryRow{Name: name, ID: id, Values: make(map[string]experiments.Value)}
+	for k, v := range values {
+		if id != "" {
+			if !strings.HasPrefix(k, id+" ") {
+				continue
+			}
+			k = strings.TrimPrefix(k, id+" ")
+		}
+		if s.match(k) {
+			row.Values[k] = v
+			s.columns[k] = struct{}{}
+		}
+	}
+	s.rows = append(s.rows, row)
+}
+
+// cells is a table row of preformatted cells.
+type cells []string
+
+var _ table.Row = cells{}
+
+func (c cells) CSV() []string { return c }
+
+// table with the value columns sorted by name. Missing values are empty.
+func (s *valuesSummary) table() *table.Table {
+	var columns []string
+	for c := range s.columns {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	t := table.NewTable(append([]string{"Experiment", "ID"}, columns...)...)
+	for _, r := range s.rows {
+		row := cells{r.Name, r.ID}
+		for _, c := range columns {
+			var cell string
+			if v, ok := r.Values[c]; ok {
+				cell = v.Plain()
+			}
+			row = append(row, cell)
+		}
+		t.AddRow(row)
+	}
+	return t
+}
+
+func (s *valuesSummary) write(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "cannot open file for writing :'%s'", path)
+	}
+	defer f.Close()
+	if err := s.table().WriteCSV(f, table.Params{}); err != nil {
+		return errors.Annotate(err, "failed to write '%s'", path)
+	}
+	return nil
+}
@@ -26,6 +26,8 @@ import (
 	"github.com/stockparfait/logging"
 	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/stockparfait/stats"
+
+	"gonum.org/v1/gonum/stat/distuv"
 )
 
 type AutoCorrelation struct {
@@ -113,6 +115,9 @@ func (j *jobResult) Merge(j2 *jobResult) *jobResult {
 func (e *AutoCorrelation) processLogProfits(lps []experiments.LogProfits) *jobResult {
 	res := e.newJobResult()
 	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
 		if len(lp.Timeseries.Data()) < e.config.MaxShift+2 {
 			logging.Warningf(e.context, "skipping %s, too few samples: %d",
 				lp.Ticker, len(lp.Timeseries.Data()))
@@ -125,38 +130,109 @@ func (e *AutoCorrelation) processLogProfits(lps []experiments.LogProfits) *jobRe
 	return res
 }
 
-func (e *AutoCorrelation) addPlot(total *jobResult) error {
-	xs := make([]float64, e.config.MaxShift)
-	ys := make([]float64, e.config.MaxShift)
-	for i := 0; i < e.config.MaxShift; i++ {
-		xs[i] = float64(i + 1)
-		if total.ns[i] != 0 {
-			ys[i] = total.sums[i] / float64(total.ns[i])
+// ACF computes the auto-correlation for shifts [1..max shift].
+func (j *jobResult) ACF() []float64 {
+	acf := make([]float64, len(j.sums))
+	for i := range j.sums {
+		if j.ns[i] != 0 {
+			acf[i] = j.sums[i] / float64(j.ns[i])
 		}
 	}
+	return acf
+}
+
+// PACF computes the partial auto-correlation from the auto-correlation
+// acf[k-1] = Corr(P(t), P(t-k)) for shifts k = 1..len(acf) using the
+// Durbin-Levinson recursion.
+func PACF(acf []float64) []float64 {
+	pacf := make([]float64, len(acf))
+	var phi []float64 // coefficients of the AR(k-1) fit
+	for k := 0; k < len(acf); k++ {
+		num, den := acf[k], 1.0
+		for j := 0; j < k; j++ {
+			num -= phi[j] * acf[k-1-j]
+			den -= phi[j] * acf[j]
+		}
+		if den == 0 {
+			break
+		}
+		pacf[k] = num / den
+		next := make([]float64, k+1)
+		for j := 0; j < k; j++ {
+			next[j] = phi[j] - pacf[k]*phi[k-1-j]
+		}
+		next[k] = pacf[k]
+		phi = next
+	}
+	return pacf
+}
+
+// LjungBox computes the Q statistic for each shift h = 1..len(acf) and its
+// p-value under the null hypothesis of no auto-correlation. Since the samples
+// are pooled across tickers, each squared correlation is weighted by its number
+// of sample pairs ns[k], which for a single long series of n samples is the
+// classic n(n+2)/(n-k) up to O(k/n).
+func LjungBox(acf []float64, ns []int) (qs, ps []float64) {
+	var q float64
+	for k := range acf {
+		q += float64(ns[k]) * acf[k] * acf[k]
+		qs = append(qs, q)
+		chi2 := distuv.ChiSquared{K: float64(k + 1)}
+		ps = append(ps, chi2.Survival(q))
+	}
+	return
+}
+
+func (e *AutoCorrelation) addPlot(ys []float64, legend, graph string) error {
+	xs := make([]float64, len(ys))
+	for i := range xs {
+		xs[i] = float64(i + 1)
+	}
 	plt, err := plot.NewXYPlot(xs, ys)
 	if err != nil {
-		return errors.Annotate(err, "failed to create auto-correlation plot")
+		return errors.Annotate(err, "failed to create '%s' plot", legend)
 	}
-	legend := e.Prefix("Auto-correlation")
+	legend = e.Prefix(legend)
 	plt.SetLegend(legend).SetYLabel("correlation")
-	if err := plot.Add(e.context, plt, e.config.Graph); err != nil {
+	if err := experiments.AddPlot(e.context, plt, graph); err != nil {
 		return errors.Annotate(err, "failed to add '%s' plot", legend)
 	}
 	return nil
 }
 
 func (e *AutoCorrelation) processTotal(total *jobResult) error {
-	err := e.AddValue(e.context, "tickers", fmt.Sprintf("%d", total.numTickers))
+	err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers))
 	if err != nil {
 		return errors.Annotate(err, "failed to add value for number of tickers")
 	}
-	err = e.AddValue(e.context, "samples", fmt.Sprintf("%d", total.ns[0]))
+	err = experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(total.ns[0]))
 	if err != nil {
 		return errors.Annotate(err, "failed to add value for number of samples")
 	}
-	if err := e.addPlot(total); err != nil {
+	acf := total.ACF()
+	if err := e.addPlot(acf, "Auto-correlation", e.config.Graph); err != nil {
 		return errors.Annotate(err, "failed to add correlation plot")
 	}
+	if e.config.PACFGraph != "" {
+		err := e.addPlot(PACF(acf), "Partial auto-correlation", e.config.PACFGraph)
+		if err != nil {
+			return errors.Annotate(err, "failed to add partial correlation plot")
+		}
+	}
+	if e.config.LjungBox {
+		qs, ps := LjungBox(acf, total.ns)
+		for i := range qs {
+			k := fmt.Sprintf("Ljung-Box Q(%d)", i+1)
+			err := experiments.AddTypedValue(e.context, e.config.ID, k, experiments.FloatValue(qs[i]))
+			if err != nil {
+				return errors.Annotate(err, "failed to add value for %s", k)
+			}
+			k = fmt.Sprintf("Ljung-Box p(%d)", i+1)
+			err = experiments.AddTypedValue(e.context, e.config.ID, k, experiments.FloatValue(ps[i]))
+			if err != nil {
+				return errors.Annotate(err, "failed to add value for %s", k)
+			}
+		}
+	}
 	return nil
 }
@@ -98,6 +98,32 @@ func TestAutoCorrelation(t *testing.T) {
 			})
 		})
 
+		Convey("with PACF and Ljung-Box", func() {
+			pg, err := canvas.EnsureGraph(plot.KindXY, "p", "dist")
+			So(err, ShouldBeNil)
+			var cfg config.AutoCorrelation
+			confJSON := `
+{
+  "id": "testID",
+  "data": {
+    "daily distribution": {"name": "t"},
+    "days": 150
+  },
+  "graph": "g",
+  "max shift": 3,
+  "PACF graph": "p",
+  "Ljung-Box": true
+}`
+			So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+			var ac AutoCorrelation
+			So(ac.Run(ctx, &cfg), ShouldBeNil)
+			So(len(pg.Plots), ShouldEqual, 1)
+			So(pg.Plots[0].Legend, ShouldEqual, "testID Partial auto-correlation")
+			So(len(pg.Plots[0].Y), ShouldEqual, 3)
+			So(values, ShouldContainKey, "testID Ljung-Box Q(1)")
+			So(values, ShouldContainKey, "testID Ljung-Box p(3)")
+		})
+
 		Convey("with synthetic data", func() {
 			var cfg config.AutoCorrelation
 			// Make the last batch fractional, for coverage of that branch.
@@ -120,3 +146,27 @@ func TestAutoCorrelation(t *testing.T) {
 		})
 	})
 }
+
+func TestStatistics(t *testing.T) {
+	t.Parallel()
+
+	Convey("PACF works", t, func() {
+		Convey("for AR(1)", func() {
+			pacf := PACF([]float64{0.5, 0.25, 0.125})
+			So(testutil.RoundFixedSlice(pacf, 5), ShouldResemble, []float64{0.5, 0, 0})
+		})
+
+		Convey("for MA(1)", func() {
+			// X(t) = e(t) + 0.5 e(t-1): rho(1) = 0.4, rho(k>1) = 0.
+			pacf := PACF([]float64{0.4, 0, 0})
+			So(testutil.RoundFixedSlice(pacf, 5), ShouldResemble,
+				[]float64{0.4, -0.19048, 0.09412})
+		})
+	})
+
+	Convey("LjungBox works", t, func() {
+		qs, ps := LjungBox([]float64{0.1, 0, -0.2}, []int{100, 99, 98})
+		So(testutil.RoundSlice(qs, 5), ShouldResemble, []float64{1, 1, 4.92})
+		So(testutil.RoundFixedSlice(ps, 3), ShouldResemble, []float64{0.317, 0.607, 0.178})
+	})
+}
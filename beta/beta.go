@@ -16,17 +16,19 @@
 //
 // Specifically, it models a stock as P = beta*I+R relative to the reference
 // price series I (typically, an index such as S&P500 or Nasdaq Composite) and
-// studies the properties of beta and R.
+// studies the properties of beta and R. When the reference yields several
+// series, each stock is modeled against each of them independently.
 package beta
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"math"
-	"math/rand"
 	"os"
 	"runtime"
-	"time"
+	"sort"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/experiments"
@@ -39,7 +41,17 @@ import (
 
 type Beta struct {
 	config *config.Beta
-	refTS  *stats.Timeseries // reference log-profit timeseries
+	refs   []reference
+	active map[string]bool // ticker -> listed at the end of the DB
+	rSeed  uint64          // for the priorities of R series
+	// Buckets of the R histogram, possibly shared by the group of its graph.
+	rBuckets *stats.Buckets
+}
+
+// reference log-profit timeseries.
+type reference struct {
+	name string
+	ts   *stats.Timeseries
 }
 
 var _ experiments.Experiment = &Beta{}
@@ -57,6 +69,10 @@ func (e *Beta) Run(ctx context.Context, cfg config.ExperimentConfig) error {
 	if e.config, ok = cfg.(*config.Beta); !ok {
 		return errors.Reason("unexpected config type: %T", cfg)
 	}
+	e.rSeed = experiments.Seed(ctx, 0)
+	if c := e.config.RPlot; c != nil {
+		e.rBuckets = experiments.PlotBuckets(ctx, c)
+	}
 	if err := e.processReference(ctx); err != nil {
 		return errors.Annotate(err, "failed to process reference data")
 	}
@@ -73,25 +89,77 @@ func (e *Beta) processReference(ctx context.Context) error {
 	}
 	lps := iterator.ToSlice[experiments.LogProfits](it)
 	it.Close()
-	if len(lps) != 1 {
-		return errors.Reason(
-			"reference should yield exactly one series, got %d", len(lps))
+	if len(lps) == 0 {
+		return errors.Reason("reference should yield at least one series")
+	}
+	// Sources may yield series in any order; keep the references stable.
+	sort.SliceStable(lps, func(i, j int) bool { return lps[i].Ticker < lps[j].Ticker })
+	names := make(map[string]bool)
+	for i, lp := range lps {
+		name := lp.Ticker
+		if names[name] { // e.g. synthetic series all have the same name
+			name = fmt.Sprintf("%s#%d", name, i+1)
+		}
+		names[name] = true
+		e.refs = append(e.refs, reference{name: name, ts: lp.Timeseries})
+	}
+	return nil
+}
+
+// refName is s qualified by the name of the i'th reference, or just s when
+// there is only one reference.
+func (e *Beta) refName(i int, s string) string {
+	if len(e.refs) <= 1 {
+		return s
+	}
+	return s + " vs " + e.refs[i].name
+}
+
+// groupName is s qualified by the survivorship group, if any.
+func groupName(group, s string) string {
+	if group == "" {
+		return s
+	}
+	return group + " " + s
+}
+
+// group is the survivorship group of the ticker, or "" when the experiment is
+// not in the "survivorship" mode.
+func (e *Beta) group(ticker string) string {
+	if e.active == nil {
+		return ""
+	}
+	active, ok := e.active[ticker]
+	switch {
+	case !ok:
+		return "unknown"
+	case active:
+		return "active"
+	}
+	return "delisted"
+}
+
+func (e *Beta) initActive() error {
+	if !e.config.Survivorship {
+		return nil
+	}
+	rows, err := e.config.Data.DB.AllTickerRows()
+	if err != nil {
+		return errors.Annotate(err, "failed to load ticker rows")
+	}
+	e.active = make(map[string]bool)
+	for t, row := range rows {
+		e.active[t] = row.Active
 	}
-	lp := lps[0]
-	e.refTS = lp.Timeseries
 	return nil
 }
 
 func (e *Beta) processData(ctx context.Context) error {
-	f := func(lps []experiments.LogProfits) *lpStats {
-		if e.config.Data.DailyDist != nil { // treat lps as R
-			for i, lp := range lps {
-				tss := stats.TimeseriesIntersect(e.refTS, lp.Timeseries)
-				lp.Timeseries = tss[0].MultC(e.config.Beta).Add(tss[1])
-				lps[i] = lp
-			}
-		}
-		return e.processLogProfits(ctx, lps)
+	if err := e.initActive(); err != nil {
+		return errors.Annotate(err, "failed to init survivorship groups")
+	}
+	f := func(lps []experiments.LogProfits) *jobResult {
+		return e.processLogProfits(ctx, e.synthesize(lps))
 	}
 	it, err := experiments.SourceMap(ctx, e.config.Data, f)
 	if err != nil {
@@ -99,50 +167,146 @@ func (e *Beta) processData(ctx context.Context) error {
 	}
 	defer it.Close()
 
-	if err := e.processLpStats(ctx, it); err != nil {
+	if err := e.processJobs(ctx, it); err != nil {
 		return errors.Annotate(err, "failed to process log-profit stats")
 	}
 	return nil
 }
 
-type csvRow struct {
-	Ticker  string
+// synthesize P = beta*Ref + R when the data source is synthetic, treating lps as
+// R. Real price series are returned as is.
+func (e *Beta) synthesize(lps []experiments.LogProfits) []experiments.LogProfits {
+	synthetic := e.config.Data.DailyDist != nil || e.config.Data.DailyHistogram != ""
+	if !synthetic {
+		return lps
+	}
+	for i, lp := range lps {
+		tss := stats.TimeseriesIntersect(e.refs[0].ts, lp.Timeseries)
+		lp.Timeseries = tss[0].MultC(e.config.Beta).Add(tss[1])
+		lps[i] = lp
+	}
+	return lps
+}
+
+// refColumns are the CSV columns of a ticker relative to a single reference.
+type refColumns struct {
 	Samples int
 	Beta    float64
+	Alpha   float64
+	R2      float64
+	Corr    float64
 	Pmean   float64
 	PMAD    float64
 	Rmean   float64
 	RMAD    float64
 }
 
-func csvRowHeader() []string {
-	return []string{"Ticker", "Samples", "Beta", "E[P]", "MAD[P]", "E[R]", "MAD[R]"}
+var refColumnsHeader = []string{
+	"Samples", "Beta", "Alpha", "R^2", "Corr", "E[P]", "MAD[P]", "E[R]", "MAD[R]"}
+
+func (c *refColumns) CSV() []string {
+	if c == nil { // the ticker was skipped for this reference
+		return make([]string, len(refColumnsHeader))
+	}
+	return []string{
+		fmt.Sprintf("%d", c.Samples),
+		fmt.Sprintf("%f", c.Beta),
+		fmt.Sprintf("%f", c.Alpha),
+		fmt.Sprintf("%f", c.R2),
+		fmt.Sprintf("%f", c.Corr),
+		fmt.Sprintf("%f", c.Pmean),
+		fmt.Sprintf("%f", c.PMAD),
+		fmt.Sprintf("%f", c.Rmean),
+		fmt.Sprintf("%f", c.RMAD),
+	}
+}
+
+type csvRow struct {
+	Ticker    string
+	Estimator string        // beta estimator
+	Refs      []*refColumns // one per reference
+}
+
+// csvRowHeader for the CSV table. Column names are qualified
+// by the reference name when there is more than one reference.
+func (e *Beta) csvRowHeader() []string {
+	res := []string{"Ticker", "Estimator"}
+	for i := range e.refs {
+		for _, h := range refColumnsHeader {
+			if len(e.refs) > 1 {
+				h = fmt.Sprintf("%s[%s]", h, e.refs[i].name)
+			}
+			res = append(res, h)
+		}
+	}
+	return res
 }
 
 func (r csvRow) CSV() []string {
-	return []string{
-		r.Ticker,
-		fmt.Sprintf("%d", r.Samples),
-		fmt.Sprintf("%f", r.Beta),
-		fmt.Sprintf("%f", r.Pmean),
-		fmt.Sprintf("%f", r.PMAD),
-		fmt.Sprintf("%f", r.Rmean),
-		fmt.Sprintf("%f", r.RMAD),
+	res := []string{r.Ticker, r.Estimator}
+	for _, c := range r.Refs {
+		res = append(res, c.CSV()...)
 	}
+	return res
 }
 
 type lpStats struct {
 	betas      []float64 // average beta
+	alphas     []float64
+	r2s        []float64 // R^2 of the regression
 	betaRatios []float64 // beta[subrange]/beta - 1
+	betaPoints experiments.StabilityPoints
+	betaSeries experiments.StabilitySeries
 	means      []float64
 	mads       []float64
 	sigmas     []float64
 	lengths    []float64
 	histR      *stats.Histogram
-	rs         []*stats.Timeseries // for computing cross-correlations
+	rs         []rSeries // for computing cross-correlations
+	maxRs      int       // keep at most this many rs when > 0
 	tickers    int
 	samples    int
-	rows       []table.Row
+}
+
+// rSeries is an R series with a pseudo-random priority. Keeping the series with
+// the lowest priorities yields a uniform sample of tickers (bottom-k sampling)
+// which, unlike the reservoir sampling, is trivially merged across batches.
+type rSeries struct {
+	priority uint64
+	ts       *stats.Timeseries
+}
+
+// addR adds an R series, trimming rs periodically to bound the memory.
+func (s *lpStats) addR(r rSeries) {
+	s.rs = append(s.rs, r)
+	if s.maxRs > 0 && len(s.rs) >= 2*s.maxRs {
+		s.trimRs()
+	}
+}
+
+// trimRs keeps at most maxRs series with the lowest priorities.
+func (s *lpStats) trimRs() {
+	if s.maxRs <= 0 || len(s.rs) <= s.maxRs {
+		return
+	}
+	sort.Slice(s.rs, func(i, j int) bool { return s.rs[i].priority < s.rs[j].priority })
+	// Copy to release the dropped series.
+	s.rs = append([]rSeries(nil), s.rs[:s.maxRs]...)
+}
+
+// rPriority is a pseudo-random priority of the ticker's R series. The series
+// data is hashed in as well, since synthetic tickers have the same name.
+func (e *Beta) rPriority(ticker string, r *stats.Timeseries) uint64 {
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, e.rSeed)
+	h.Write(b)
+	h.Write([]byte(ticker))
+	for _, x := range r.Data() {
+		binary.LittleEndian.PutUint64(b, math.Float64bits(x))
+		h.Write(b)
+	}
+	return h.Sum64()
 }
 
 // Merge s2 into s. If error is returned, s remains unmodified.
@@ -153,23 +317,85 @@ func (s *lpStats) Merge(s2 *lpStats) error {
 		}
 	}
 	s.betas = append(s.betas, s2.betas...)
+	s.alphas = append(s.alphas, s2.alphas...)
+	s.r2s = append(s.r2s, s2.r2s...)
 	s.betaRatios = append(s.betaRatios, s2.betaRatios...)
+	s.betaPoints.Merge(&s2.betaPoints)
+	s.betaSeries.Merge(&s2.betaSeries)
 	s.means = append(s.means, s2.means...)
 	s.mads = append(s.mads, s2.mads...)
 	s.sigmas = append(s.sigmas, s2.sigmas...)
 	s.lengths = append(s.lengths, s2.lengths...)
 	s.rs = append(s.rs, s2.rs...)
+	s.trimRs()
 	s.tickers += s2.tickers
 	s.samples += s2.samples
-	s.rows = append(s.rows, s2.rows...)
 	return nil
 }
 
-func (e *Beta) writeTable(rows []table.Row) error {
+func (e *Beta) newLpStats() *lpStats {
+	res := lpStats{maxRs: e.config.RCorrTickers}
+	if e.config.RPlot != nil {
+		res.histR = stats.NewHistogram(e.rBuckets)
+	}
+	return &res
+}
+
+// jobResult is a partially reduced result of a batch of tickers.
+type jobResult struct {
+	stats  []*lpStats            // one per reference
+	groups map[string][]*lpStats // survivorship group -> stats per reference
+	rows   []table.Row
+}
+
+func (e *Beta) newStats() []*lpStats {
+	res := make([]*lpStats, len(e.refs))
+	for i := range res {
+		res[i] = e.newLpStats()
+	}
+	return res
+}
+
+func (e *Beta) newJobResult() *jobResult {
+	return &jobResult{
+		stats:  e.newStats(),
+		groups: make(map[string][]*lpStats),
+	}
+}
+
+// groupStats returns the per-reference stats of the survivorship group,
+// creating them as needed.
+func (e *Beta) groupStats(j *jobResult, group string) []*lpStats {
+	res, ok := j.groups[group]
+	if !ok {
+		res = e.newStats()
+		j.groups[group] = res
+	}
+	return res
+}
+
+func mergeStats(ctx context.Context, s, s2 []*lpStats) {
+	for i := range s {
+		if err := s[i].Merge(s2[i]); err != nil {
+			logging.Warningf(ctx, "failed to merge some tickers: %s", err.Error())
+		}
+	}
+}
+
+// Merge j2 into j.
+func (e *Beta) merge(ctx context.Context, j, j2 *jobResult) {
+	mergeStats(ctx, j.stats, j2.stats)
+	for g, s2 := range j2.groups {
+		mergeStats(ctx, e.groupStats(j, g), s2)
+	}
+	j.rows = append(j.rows, j2.rows...)
+}
+
+func (e *Beta) writeTable(ctx context.Context, rows []table.Row) error {
 	if e.config.File == "" {
 		return nil
 	}
-	t := table.NewTable(csvRowHeader()...)
+	t := table.NewTable(e.csvRowHeader()...)
 	t.AddRow(rows...)
 	if e.config.File == "-" {
 		if err := t.WriteText(os.Stdout, table.Params{}); err != nil {
@@ -177,170 +403,307 @@ func (e *Beta) writeTable(rows []table.Row) error {
 		}
 		return nil
 	}
-	f, err := os.OpenFile(e.config.File, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	path := experiments.OutputPath(ctx, e.config.File)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return errors.Annotate(err, "failed to open output CSV file '%s'",
-			e.config.File)
+		return errors.Annotate(err, "failed to open output CSV file '%s'", path)
 	}
 	defer f.Close()
 	if err = t.WriteCSV(f, table.Params{}); err != nil {
-		return errors.Annotate(err, "failed to write CSV file '%s'", e.config.File)
+		return errors.Annotate(err, "failed to write CSV file '%s'", path)
 	}
 	return nil
 }
 
-// computeBeta for p = beta*ref+R which minimizes Var[R]. Assumes that p and ref
-// have the same length.
-func computeBeta(p, ref []float64) float64 {
+// computeBeta for p = beta*ref+R using the configured estimator. Assumes that p
+// and ref have the same length.
+func (e *Beta) computeBeta(p, ref []float64) float64 {
+	beta, _ := e.regression(p, ref)
+	return beta
+}
+
+// regression computes beta and alpha for p = alpha + beta*ref + R using the
+// configured estimator. Assumes that p and ref have the same length.
+func (e *Beta) regression(p, ref []float64) (beta, alpha float64) {
+	switch e.config.Estimator {
+	case "huber":
+		return huber(p, ref)
+	case "theil-sen":
+		return theilSen(p, ref)
+	case "vasicek":
+		beta = vasicek(p, ref, e.config.PriorSigma)
+	case "blume":
+		beta, _ = ols(p, ref)
+		beta = 1.0/3.0 + 2.0/3.0*beta
+	default:
+		return ols(p, ref)
+	}
+	if len(p) == 0 {
+		return 0, 0
+	}
+	alpha = stats.NewSample(p).Mean() - beta*stats.NewSample(ref).Mean()
+	return beta, alpha
+}
+
+// ols computes beta and alpha for p = alpha + beta*ref + R which minimize
+// Var[R]. Assumes that p and ref have the same length.
+func ols(p, ref []float64) (beta, alpha float64) {
 	if len(p) < 2 {
-		return 0
+		return 0, 0
 	}
-	beta, _, err := experiments.LeastSquares(ref, p)
+	beta, alpha, err := experiments.LeastSquares(ref, p)
 	if err != nil {
 		panic(errors.Annotate(err, "failed to compute beta"))
 	}
-	if math.IsInf(beta, 0) {
-		return 0
+	if math.IsInf(beta, 0) || math.IsInf(alpha, 0) {
+		return 0, 0
 	}
-	return beta
+	return beta, alpha
 }
 
-func (e *Beta) processLogProfits(ctx context.Context, lps []experiments.LogProfits) *lpStats {
-	var res lpStats
-	if e.config.RPlot != nil {
-		res.histR = stats.NewHistogram(&e.config.RPlot.Buckets)
+// median of xs; xs is not modified.
+func median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
 	}
-	for _, lp := range lps {
-		tss := stats.TimeseriesIntersect(lp.Timeseries, e.refTS)
-		p := tss[0]
-		ref := tss[1]
-		if c := e.config.BetaRatios; c != nil {
-			f := func(low, high int) float64 {
-				return computeBeta(p.Data()[low:high], ref.Data()[low:high])
+	ys := make([]float64, len(xs))
+	copy(ys, xs)
+	sort.Float64s(ys)
+	if n := len(ys); n%2 == 0 {
+		return (ys[n/2-1] + ys[n/2]) / 2
+	}
+	return ys[len(ys)/2]
+}
+
+// huber computes beta and alpha by the Huber robust regression using
+// iteratively reweighted least squares, starting from the OLS estimate.
+// Residuals beyond 1.345 robust sigmas (estimated from the median absolute
+// deviation) are down-weighted.
+func huber(p, ref []float64) (beta, alpha float64) {
+	const (
+		k       = 1.345
+		maxIter = 50
+	)
+	beta, alpha = ols(p, ref)
+	if len(p) < 3 {
+		return
+	}
+	rs := make([]float64, len(p))
+	for iter := 0; iter < maxIter; iter++ {
+		for i := range p {
+			rs[i] = p[i] - alpha - beta*ref[i]
+		}
+		m := median(rs)
+		devs := make([]float64, len(rs))
+		for i, r := range rs {
+			devs[i] = math.Abs(r - m)
+		}
+		threshold := k * 1.4826 * median(devs)
+		if threshold == 0 {
+			return
+		}
+		var sumW, sumX, sumY float64
+		ws := make([]float64, len(rs))
+		for i, r := range rs {
+			ws[i] = 1
+			if math.Abs(r) > threshold {
+				ws[i] = threshold / math.Abs(r)
 			}
-			res.betaRatios = append(res.betaRatios,
-				experiments.Stability(len(p.Data()), f, c)...)
+			sumW += ws[i]
+			sumX += ws[i] * ref[i]
+			sumY += ws[i] * p[i]
 		}
-		beta := computeBeta(p.Data(), ref.Data())
-		r := p.Sub(ref.MultC(beta))
-		if e.config.RCorrPlot != nil {
-			res.rs = append(res.rs, r)
+		meanX := sumX / sumW
+		meanY := sumY / sumW
+		var sxx, sxy float64
+		for i, w := range ws {
+			sxx += w * (ref[i] - meanX) * (ref[i] - meanX)
+			sxy += w * (ref[i] - meanX) * (p[i] - meanY)
 		}
-		sampleP := stats.NewSample(p.Data())
-		sampleR := stats.NewSample(r.Data())
-		if sampleR.MAD() == 0 {
-			logging.Warningf(ctx, "skipping %s: MAD = 0", lp.Ticker)
-			continue
+		if sxx == 0 {
+			return
+		}
+		b := sxy / sxx
+		a := meanY - b*meanX
+		done := math.Abs(b-beta) <= 1e-9*(1+math.Abs(beta)) &&
+			math.Abs(a-alpha) <= 1e-9*(1+math.Abs(alpha))
+		beta, alpha = b, a
+		if done {
+			break
 		}
-		sampleNorm, err := sampleR.Normalize()
-		if err != nil {
-			logging.Warningf(ctx, "skipping %s: failed to normalize R", lp.Ticker)
-			continue
-		}
-		if res.histR != nil {
-			res.histR.Add(sampleNorm.Data()...)
-		}
-		res.betas = append(res.betas, beta)
-		res.means = append(res.means, sampleR.Mean())
-		if madP := sampleP.MAD(); madP != 0 {
-			res.mads = append(res.mads, sampleR.MAD()/madP)
-		}
-		if sigmaP := sampleP.Sigma(); sigmaP != 0 {
-			res.sigmas = append(res.sigmas, sampleR.Sigma()/sigmaP)
-		}
-		res.lengths = append(res.lengths, float64(len(p.Data())))
-		res.tickers++
-		res.samples += len(p.Data())
-		res.rows = append(res.rows, csvRow{
-			Ticker:  lp.Ticker,
-			Samples: len(p.Data()),
-			Beta:    beta,
-			Pmean:   sampleP.Mean(),
-			PMAD:    sampleP.MAD(),
-			Rmean:   sampleR.Mean(),
-			RMAD:    sampleR.MAD(),
-		})
 	}
-	return &res
-}
-
-type intPair struct {
-	x int
-	y int
-}
-
-// nxnIter produces all pairs (i, j) such that i in [0..n-1] and j in
-// [i+1..n-1]. Total of n*(n-1)/2 values.
-type nxnPairs struct {
-	i int
-	j int
-	n int
+	return
 }
 
-var _ iterator.Iterator[intPair] = &nxnPairs{}
-
-func (it *nxnPairs) Next() (intPair, bool) {
-	if it.i+1 >= it.n {
-		return intPair{}, false
+// theilSen computes beta as the median of the slopes between all pairs of
+// points, and alpha as the median of p - beta*ref. Note, that it takes O(n^2)
+// time and memory in the length of the series.
+func theilSen(p, ref []float64) (beta, alpha float64) {
+	var slopes []float64
+	for i := 0; i < len(p); i++ {
+		for j := i + 1; j < len(p); j++ {
+			if dx := ref[j] - ref[i]; dx != 0 {
+				slopes = append(slopes, (p[j]-p[i])/dx)
+			}
+		}
 	}
-	if it.j <= it.i {
-		it.j = it.i + 1
+	if len(slopes) == 0 {
+		return 0, 0
 	}
-	res := intPair{it.i, it.j}
-	it.j++
-	if it.j >= it.n {
-		it.i++
-		it.j = it.i + 1
+	beta = median(slopes)
+	rs := make([]float64, len(p))
+	for i := range p {
+		rs[i] = p[i] - beta*ref[i]
 	}
-	return res, true
+	return beta, median(rs)
 }
 
-// randPairs returns k random pairs (i, j) such that i in [0..n-1] and j in
-// [i+1..n-1].
-type randPairs struct {
-	rand *rand.Rand
-	i    int
-	n    int
-	k    int
+// vasicek shrinks the OLS beta toward the prior of 1 with the standard
+// deviation priorSigma, weighting by the precision of the OLS estimate.
+func vasicek(p, ref []float64, priorSigma float64) float64 {
+	beta, alpha := ols(p, ref)
+	if len(p) < 3 {
+		return beta
+	}
+	var sumR2, sxx float64
+	meanX := stats.NewSample(ref).Mean()
+	for i := range p {
+		r := p[i] - alpha - beta*ref[i]
+		sumR2 += r * r
+		sxx += (ref[i] - meanX) * (ref[i] - meanX)
+	}
+	if sxx == 0 {
+		return beta
+	}
+	se2 := sumR2 / float64(len(p)-2) / sxx // variance of the OLS beta
+	prior2 := priorSigma * priorSigma
+	return (prior2*beta + se2) / (prior2 + se2)
 }
 
-var _ iterator.Iterator[intPair] = &randPairs{}
-
-// newRandPairs initializes the randPairs iterator. Use seed=0 in production
-// (this creates a new random seed), and seed>=1 in tests for deterministic
-// behavior.
-func newRandPairs(n, k int, seed int64) *randPairs {
-	if seed <= 0 {
-		seed = int64(time.Now().UnixNano())
-	}
-	return &randPairs{
-		rand: rand.New(rand.NewSource(seed)),
-		n:    n,
-		k:    k,
+func (e *Beta) processLogProfits(ctx context.Context, lps []experiments.LogProfits) *jobResult {
+	res := e.newJobResult()
+	for _, lp := range lps {
+		if ctx.Err() != nil {
+			break
+		}
+		row := csvRow{
+			Ticker:    lp.Ticker,
+			Estimator: e.config.Estimator,
+			Refs:      make([]*refColumns, len(e.refs)),
+		}
+		found := false
+		group := e.group(lp.Ticker)
+		for i, ref := range e.refs {
+			s := res.stats[i]
+			if group != "" {
+				s = e.newLpStats()
+			}
+			row.Refs[i] = e.addTicker(ctx, s, lp, ref)
+			if row.Refs[i] != nil {
+				found = true
+			}
+			if group != "" {
+				mergeStats(ctx, res.stats[i:i+1], []*lpStats{s})
+				mergeStats(ctx, e.groupStats(res, group)[i:i+1], []*lpStats{s})
+			}
+		}
+		if found {
+			res.rows = append(res.rows, row)
+		}
 	}
+	return res
 }
 
-func (it *randPairs) Next() (intPair, bool) {
-	if it.n < 2 || it.i >= it.k {
-		return intPair{}, false
+// addTicker adds the ticker's statistics relative to the reference to res, and
+// returns its CSV columns. Returns nil if the ticker is skipped.
+func (e *Beta) addTicker(ctx context.Context, res *lpStats, lp experiments.LogProfits, reference reference) *refColumns {
+	tss := stats.TimeseriesIntersect(lp.Timeseries, reference.ts)
+	p := tss[0]
+	ref := tss[1]
+	name := lp.Ticker
+	if len(e.refs) > 1 {
+		name += " vs " + reference.name
+	}
+	if c := e.config.BetaRatios; c != nil {
+		f := func(low, high int) float64 {
+			return e.computeBeta(p.Data()[low:high], ref.Data()[low:high])
+		}
+		res.betaRatios = append(res.betaRatios,
+			experiments.Stability(len(p.Data()), f, c)...)
+		res.betaPoints.Add(len(p.Data()), f, c)
+		res.betaSeries.Add(p.Dates(), f, c)
+	}
+	beta, alpha := e.regression(p.Data(), ref.Data())
+	// R^2 of a single-variable linear regression is the squared Pearson
+	// correlation; for rank correlations it is its rank analog.
+	corr, _ := e.correlation(p, ref)
+	r := p.Sub(ref.MultC(beta))
+	if e.config.RCorrPlot != nil {
+		res.addR(rSeries{priority: e.rPriority(lp.Ticker, r), ts: r})
+	}
+	sampleP := stats.NewSample(p.Data())
+	sampleR := stats.NewSample(r.Data())
+	if sampleR.MAD() == 0 {
+		logging.Warningf(ctx, "skipping %s: MAD = 0", name)
+		return nil
+	}
+	sampleNorm, err := sampleR.Normalize()
+	if err != nil {
+		logging.Warningf(ctx, "skipping %s: failed to normalize R", name)
+		return nil
+	}
+	if res.histR != nil {
+		res.histR.Add(sampleNorm.Data()...)
+	}
+	res.betas = append(res.betas, beta)
+	res.alphas = append(res.alphas, alpha)
+	res.r2s = append(res.r2s, corr*corr)
+	res.means = append(res.means, sampleR.Mean())
+	if madP := sampleP.MAD(); madP != 0 {
+		res.mads = append(res.mads, sampleR.MAD()/madP)
+	}
+	if sigmaP := sampleP.Sigma(); sigmaP != 0 {
+		res.sigmas = append(res.sigmas, sampleR.Sigma()/sigmaP)
+	}
+	res.lengths = append(res.lengths, float64(len(p.Data())))
+	res.tickers++
+	res.samples += len(p.Data())
+	return &refColumns{
+		Samples: len(p.Data()),
+		Beta:    beta,
+		Alpha:   alpha,
+		R2:      corr * corr,
+		Corr:    corr,
+		Pmean:   sampleP.Mean(),
+		PMAD:    sampleP.MAD(),
+		Rmean:   sampleR.Mean(),
+		RMAD:    sampleR.MAD(),
 	}
-	it.i++
-	i := it.rand.Intn(it.n - 1)
-	j := it.rand.Intn(it.n-i-1) + i + 1
-	return intPair{i, j}, true
 }
 
-// correlation between t1 and t2. When the second result is false, correlation
-// is undefined.
+// correlation between t1 and t2 of the configured type. When the second result
+// is false, correlation is undefined.
 func (e *Beta) correlation(t1, t2 *stats.Timeseries) (float64, bool) {
 	aligned := stats.TimeseriesIntersect(t1, t2)
-	t1 = aligned[0]
-	t2 = aligned[1]
-	if len(t1.Data()) < 3 {
+	xs := aligned[0].Data()
+	ys := aligned[1].Data()
+	if len(xs) < 3 {
 		return 0, false
 	}
-	sample1 := stats.NewSample(t1.Data())
-	sample2 := stats.NewSample(t2.Data())
+	switch e.config.CorrelationType {
+	case "spearman":
+		return pearson(ranks(xs), ranks(ys))
+	case "kendall":
+		return kendall(xs, ys)
+	}
+	return pearson(xs, ys)
+}
+
+// pearson correlation of xs and ys of the same length. When the second result
+// is false, correlation is undefined.
+func pearson(xs, ys []float64) (float64, bool) {
+	sample1 := stats.NewSample(xs)
+	sample2 := stats.NewSample(ys)
 	mean1 := sample1.Mean()
 	sigma1 := sample1.Sigma()
 	if sigma1 == 0 {
@@ -352,10 +715,10 @@ func (e *Beta) correlation(t1, t2 *stats.Timeseries) (float64, bool) {
 		return 0, false
 	}
 	var sum float64
-	for k := 0; k < len(t1.Data()); k++ {
-		sum += (t1.Data()[k] - mean1) * (t2.Data()[k] - mean2)
+	for k := 0; k < len(xs); k++ {
+		sum += (xs[k] - mean1) * (ys[k] - mean2)
 	}
-	corr := sum / float64(len(t1.Data())) / sigma1 / sigma2
+	corr := sum / float64(len(xs)) / sigma1 / sigma2
 	if corr < -1 || corr > 1 {
 		// This usually happens when sigma is too close to 0.
 		return 0, false
@@ -363,14 +726,69 @@ func (e *Beta) correlation(t1, t2 *stats.Timeseries) (float64, bool) {
 	return corr, true
 }
 
+// ranks of xs starting from 1. Tied values are assigned the average of their
+// ranks.
+func ranks(xs []float64) []float64 {
+	idx := make([]int, len(xs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return xs[idx[i]] < xs[idx[j]] })
+	res := make([]float64, len(xs))
+	for i := 0; i < len(idx); {
+		j := i + 1
+		for j < len(idx) && xs[idx[j]] == xs[idx[i]] {
+			j++
+		}
+		r := float64(i+j+1) / 2 // average of ranks i+1..j
+		for k := i; k < j; k++ {
+			res[idx[k]] = r
+		}
+		i = j
+	}
+	return res
+}
+
+// kendall tau-b rank correlation of xs and ys of the same length. Note, that
+// it takes O(n^2) time. When the second result is false, correlation is
+// undefined.
+func kendall(xs, ys []float64) (float64, bool) {
+	var concordant, discordant, tiesX, tiesY float64
+	for i := 0; i < len(xs); i++ {
+		for j := i + 1; j < len(xs); j++ {
+			dx := xs[i] - xs[j]
+			dy := ys[i] - ys[j]
+			switch {
+			case dx == 0 && dy == 0:
+			case dx == 0:
+				tiesX++
+			case dy == 0:
+				tiesY++
+			case (dx > 0) == (dy > 0):
+				concordant++
+			default:
+				discordant++
+			}
+		}
+	}
+	denom := math.Sqrt((concordant + discordant + tiesX) * (concordant + discordant + tiesY))
+	if denom == 0 {
+		return 0, false
+	}
+	return (concordant - discordant) / denom, true
+}
+
 // crossCorrelations computes pairwise correlations between the Timeseries and
 // populates a histogram with the results. The number of pairs is capped by
 // e.config.RCorrSamples.
 func (e *Beta) crossCorrelations(ctx context.Context, tss []*stats.Timeseries, buckets *stats.Buckets) stats.DistributionWithHistogram {
-	f := func(pairs []intPair) *stats.Histogram {
+	f := func(pairs []experiments.IntPair) *stats.Histogram {
 		h := stats.NewHistogram(buckets)
 		for _, p := range pairs {
-			corr, ok := e.correlation(tss[p.x], tss[p.y])
+			if ctx.Err() != nil {
+				break
+			}
+			corr, ok := e.correlation(tss[p.X], tss[p.Y])
 			if !ok {
 				continue
 			}
@@ -378,14 +796,9 @@ func (e *Beta) crossCorrelations(ctx context.Context, tss []*stats.Timeseries, b
 		}
 		return h
 	}
-	var pairsIter iterator.Iterator[intPair]
-	if e.config.RCorrSamples <= 0 || len(tss)*(len(tss)-1)/2 <= e.config.RCorrSamples {
-		pairsIter = &nxnPairs{n: len(tss)}
-	} else {
-		pairsIter = newRandPairs(len(tss), e.config.RCorrSamples, 0)
-	}
+	pairsIter := experiments.SamplePairs(len(tss), e.config.RCorrSamples, experiments.Seed(ctx, 0))
 	it := iterator.Batch(pairsIter, e.config.Data.BatchSize)
-	pm := iterator.ParallelMap(ctx, 2*runtime.NumCPU(), it, f)
+	pm := iterator.ParallelMap(ctx, experiments.Workers(ctx, 2*runtime.NumCPU()), it, f)
 	defer pm.Close()
 	h := stats.NewHistogram(buckets)
 	for v, ok := pm.Next(); ok; v, ok = pm.Next() {
@@ -394,102 +807,167 @@ func (e *Beta) crossCorrelations(ctx context.Context, tss []*stats.Timeseries, b
 	return stats.NewHistogramDistribution(h)
 }
 
-// processLpStats accumulates partially reduced statistics from the iterator and
-// generates the necessary plots.
-func (e *Beta) processLpStats(ctx context.Context, it iterator.Iterator[*lpStats]) error {
-	var res lpStats
-	if e.config.RPlot != nil {
-		res.histR = stats.NewHistogram(&e.config.RPlot.Buckets)
+// processJobs accumulates partially reduced results from the iterator, writes
+// the CSV table and generates the necessary plots for each reference.
+func (e *Beta) processJobs(ctx context.Context, it iterator.Iterator[*jobResult]) error {
+	res := e.newJobResult()
+	for j, ok := it.Next(); ok; j, ok = it.Next() {
+		e.merge(ctx, res, j)
 	}
-	for s, ok := it.Next(); ok; s, ok = it.Next() {
-		if err := res.Merge(s); err != nil {
-			logging.Warningf(ctx, "failed to merge some tickers", err.Error())
+	if err := e.writeTable(ctx, res.rows); err != nil {
+		return errors.Annotate(err, "failed to write table")
+	}
+	for i, s := range res.stats {
+		if err := e.processLpStats(ctx, i, "", s); err != nil {
+			return errors.Annotate(err, "failed to process reference %s",
+				e.refs[i].name)
 		}
 	}
-	if err := e.AddValue(ctx, "tickers", fmt.Sprintf("%d", res.tickers)); err != nil {
-		return errors.Annotate(err, "failed to add %s value", e.Prefix("tickers"))
+	var groups []string
+	for g := range res.groups {
+		groups = append(groups, g)
 	}
-	if err := e.AddValue(ctx, "samples", fmt.Sprintf("%d", res.samples)); err != nil {
-		return errors.Annotate(err, "failed to add %s value", e.Prefix("samples"))
+	sort.Strings(groups)
+	for _, g := range groups {
+		for i, s := range res.groups[g] {
+			if s.tickers == 0 {
+				continue
+			}
+			if err := e.processLpStats(ctx, i, g, s); err != nil {
+				return errors.Annotate(err, "failed to process %s tickers for reference %s",
+					g, e.refs[i].name)
+			}
+		}
+	}
+	return nil
+}
+
+// processLpStats generates the plots for the statistics relative to the i'th
+// reference, for all tickers or for the given survivorship group.
+func (e *Beta) processLpStats(ctx context.Context, i int, group string, res *lpStats) error {
+	name := func(s string) string { return groupName(group, e.refName(i, s)) }
+	if err := experiments.AddTypedValue(ctx, e.config.ID, name("tickers"), experiments.IntValue(res.tickers)); err != nil {
+		return errors.Annotate(err, "failed to add %s value", e.Prefix(name("tickers")))
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, name("samples"), experiments.IntValue(res.samples)); err != nil {
+		return errors.Annotate(err, "failed to add %s value", e.Prefix(name("samples")))
+	}
+	if group != "" && len(res.betas) > 0 {
+		mean := stats.NewSample(res.betas).Mean()
+		if err := experiments.AddTypedValue(ctx, e.config.ID, name("mean beta"), experiments.FloatValue(mean)); err != nil {
+			return errors.Annotate(err, "failed to add %s value", e.Prefix(name("mean beta")))
+		}
 	}
 	if e.config.BetaPlot != nil {
-		betasDist := stats.NewSampleDistribution(res.betas, &e.config.BetaPlot.Buckets)
+		betasDist := experiments.NewSampleDistribution(res.betas, e.config.BetaPlot)
 		err := experiments.PlotDistribution(ctx, betasDist, e.config.BetaPlot,
-			e.config.ID, "betas")
+			e.config.ID, name("betas"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot betas")
 		}
 	}
-	if err := e.writeTable(res.rows); err != nil {
-		return errors.Annotate(err, "failed to write table")
+	if e.config.AlphaPlot != nil {
+		alphasDist := experiments.NewSampleDistribution(res.alphas, e.config.AlphaPlot)
+		err := experiments.PlotDistribution(ctx, alphasDist, e.config.AlphaPlot,
+			e.config.ID, name("alphas"))
+		if err != nil {
+			return errors.Annotate(err, "failed to plot alphas")
+		}
+	}
+	if e.config.R2Plot != nil {
+		r2Dist := experiments.NewSampleDistribution(res.r2s, e.config.R2Plot)
+		err := experiments.PlotDistribution(ctx, r2Dist, e.config.R2Plot,
+			e.config.ID, name("R^2"))
+		if err != nil {
+			return errors.Annotate(err, "failed to plot R^2")
+		}
 	}
 	if e.config.RPlot != nil {
 		RDist := stats.NewHistogramDistribution(res.histR)
 		err := experiments.PlotDistribution(ctx, RDist, e.config.RPlot,
-			e.config.ID, "normalized R")
+			e.config.ID, name("normalized R"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot normalized R")
 		}
 	}
 	if e.config.RMeansPlot != nil {
-		meansDist := stats.NewSampleDistribution(
-			res.means, &e.config.RMeansPlot.Buckets)
+		meansDist := experiments.NewSampleDistribution(res.means, e.config.RMeansPlot)
 		err := experiments.PlotDistribution(ctx, meansDist, e.config.RMeansPlot,
-			e.config.ID, "R means")
+			e.config.ID, name("R means"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot R means")
 		}
 	}
 	if e.config.RMADsPlot != nil {
-		MADsDist := stats.NewSampleDistribution(res.mads, &e.config.RMADsPlot.Buckets)
+		MADsDist := experiments.NewSampleDistribution(res.mads, e.config.RMADsPlot)
 		err := experiments.PlotDistribution(ctx, MADsDist, e.config.RMADsPlot,
-			e.config.ID, "R MADs")
+			e.config.ID, name("R MADs"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot R MADs")
 		}
 	}
 	if e.config.RSigmasPlot != nil {
-		SigmasDist := stats.NewSampleDistribution(res.sigmas, &e.config.RSigmasPlot.Buckets)
+		SigmasDist := experiments.NewSampleDistribution(res.sigmas, e.config.RSigmasPlot)
 		err := experiments.PlotDistribution(ctx, SigmasDist, e.config.RSigmasPlot,
-			e.config.ID, "R Sigmas")
+			e.config.ID, name("R Sigmas"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot R Sigmas")
 		}
 	}
 	if e.config.RCorrPlot != nil {
-		corrDist := e.crossCorrelations(ctx, res.rs, &e.config.RCorrPlot.Buckets)
+		res.trimRs()
+		tss := make([]*stats.Timeseries, len(res.rs))
+		for j, r := range res.rs {
+			tss[j] = r.ts
+		}
+		if e.config.RCorrTickers > 0 {
+			err := experiments.AddTypedValue(ctx, e.config.ID, name("R correlations tickers"), experiments.IntValue(len(tss)))
+			if err != nil {
+				return errors.Annotate(err, "failed to add %s value",
+					e.Prefix(name("R correlations tickers")))
+			}
+		}
+		corrDist := e.crossCorrelations(ctx, tss, experiments.PlotBuckets(ctx, e.config.RCorrPlot))
 		counts := corrDist.Histogram().CountsTotal()
 		if counts < 2 { // too few for a plot
 			logging.Warningf(ctx, "skipping R correlations plot: only %d points", counts)
 		} else {
 			err := experiments.PlotDistribution(ctx, corrDist, e.config.RCorrPlot,
-				e.config.ID, "R cross-correlations")
+				e.config.ID, name("R cross-correlations"))
 			if err != nil {
 				return errors.Annotate(err, "failed to plot R cross-correlations")
 			}
-			err = e.AddValue(ctx, "R cross-correlations",
-				fmt.Sprintf("%d", counts))
+			err = experiments.AddTypedValue(ctx, e.config.ID, name("R cross-correlations"),
+				experiments.IntValue(int(counts)))
 			if err != nil {
 				return errors.Annotate(err, "failed to add %s value",
-					e.Prefix("R cross-correlations"))
+					e.Prefix(name("R cross-correlations")))
 			}
 		}
 	}
 	if e.config.LengthsPlot != nil {
-		dist := stats.NewSampleDistribution(res.lengths, &e.config.LengthsPlot.Buckets)
+		dist := experiments.NewSampleDistribution(res.lengths, e.config.LengthsPlot)
 		err := experiments.PlotDistribution(ctx, dist, e.config.LengthsPlot,
-			e.config.ID, "lengths")
+			e.config.ID, name("lengths"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot lengths")
 		}
 	}
-	if e.config.BetaRatios != nil && len(res.betaRatios) > 1 {
+	if e.config.BetaRatios != nil && e.config.BetaRatios.Plot != nil && len(res.betaRatios) > 1 {
 		c := e.config.BetaRatios.Plot
-		dist := stats.NewSampleDistribution(res.betaRatios, &c.Buckets)
-		err := experiments.PlotDistribution(ctx, dist, c, e.config.ID, "beta ratios")
+		dist := experiments.NewSampleDistribution(res.betaRatios, c)
+		err := experiments.PlotDistribution(ctx, dist, c, e.config.ID, name("beta ratios"))
 		if err != nil {
 			return errors.Annotate(err, "failed to plot beta ratios")
 		}
 	}
+	err := res.betaPoints.Plot(ctx, e.config.BetaRatios, e.config.ID, name("beta stability"))
+	if err != nil {
+		return errors.Annotate(err, "failed to plot beta stability scatter")
+	}
+	err = res.betaSeries.Plot(ctx, e.config.BetaRatios, e.config.ID, name("beta stability series"))
+	if err != nil {
+		return errors.Annotate(err, "failed to plot beta stability series")
+	}
 	return nil
 }
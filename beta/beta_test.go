@@ -23,10 +23,10 @@ import (
 
 	"github.com/stockparfait/experiments"
 	"github.com/stockparfait/experiments/config"
-	"github.com/stockparfait/iterator"
 	"github.com/stockparfait/logging"
 	"github.com/stockparfait/stockparfait/db"
 	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
 	"github.com/stockparfait/testutil"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -73,12 +73,16 @@ func TestBeta(t *testing.T) {
 		So(err, ShouldBeNil)
 		BetaRatios, err := canvas.EnsureGraph(plot.KindXY, "beta ratios", "group")
 		So(err, ShouldBeNil)
+		AlphaGraph, err := canvas.EnsureGraph(plot.KindXY, "alpha", "group")
+		So(err, ShouldBeNil)
+		R2Graph, err := canvas.EnsureGraph(plot.KindXY, "R2", "group")
+		So(err, ShouldBeNil)
 
 		Convey("with price data", func() {
 			dbName := "db"
 			tickers := map[string]db.TickerRow{
 				"I": {},
-				"A": {},
+				"A": {Active: true},
 				"B": {},
 				"C": {},
 			}
@@ -145,7 +149,9 @@ func TestBeta(t *testing.T) {
   "beta ratios": {
     "window": 3,
     "plot": {"graph": "beta ratios"}
-  }
+  },
+  "alpha plot": {"graph": "alpha"},
+  "R2 plot": {"graph": "R2"}
 }`, tmpdir, dbName, lengthsFile, tmpdir, dbName, csvFile)
 				So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
 				var betaExp Beta
@@ -160,6 +166,91 @@ func TestBeta(t *testing.T) {
 				So(len(SigmasGraph.Plots), ShouldEqual, 1)
 				So(len(LengthsGraph.Plots), ShouldEqual, 1)
 				So(len(BetaRatios.Plots), ShouldEqual, 1)
+				So(len(AlphaGraph.Plots), ShouldEqual, 1)
+				So(len(R2Graph.Plots), ShouldEqual, 1)
+
+				csvData, err := os.ReadFile(csvFile)
+				So(err, ShouldBeNil)
+				So(string(csvData), ShouldStartWith,
+					"Ticker,Estimator,Samples,Beta,Alpha,R^2,Corr,E[P],MAD[P],E[R],MAD[R]\n")
+			})
+
+			Convey("multiple references", func() {
+				var cfg config.Beta
+				csvFile := filepath.Join(tmpdir, "betas_multi.csv")
+				confJSON := fmt.Sprintf(`
+{
+  "id": "testID",
+  "reference": {"DB": {
+    "DB path": "%s",
+    "DB": "%s",
+    "tickers": ["I", "C"]
+  }},
+  "data": {"DB": {
+    "DB path": "%s",
+    "DB": "%s",
+    "tickers": ["A", "B"]
+  }},
+  "file": "%s",
+  "beta plot": {"graph": "beta"}
+}`, tmpdir, dbName, tmpdir, dbName, csvFile)
+				So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+				var betaExp Beta
+				So(betaExp.Run(ctx, &cfg), ShouldBeNil)
+
+				So(len(betaGraph.Plots), ShouldEqual, 2)
+				So(betaGraph.Plots[0].Legend, ShouldEqual, "testID betas vs C p.d.f.")
+				So(betaGraph.Plots[1].Legend, ShouldEqual, "testID betas vs I p.d.f.")
+				So(values["testID tickers vs I"], ShouldEqual, "2")
+				So(values["testID tickers vs C"], ShouldEqual, "2")
+
+				csvData, err := os.ReadFile(csvFile)
+				So(err, ShouldBeNil)
+				So(string(csvData), ShouldStartWith,
+					"Ticker,Estimator,Samples[C],Beta[C],Alpha[C],R^2[C],Corr[C],E[P][C],MAD[P][C],E[R][C],MAD[R][C],"+
+						"Samples[I],Beta[I],Alpha[I],R^2[I],Corr[I],E[P][I],MAD[P][I],E[R][I],MAD[R][I]\n")
+			})
+
+			Convey("survivorship", func() {
+				var cfg config.Beta
+				confJSON := fmt.Sprintf(`
+{
+  "id": "testID",
+  "reference": {"DB": {
+    "DB path": "%s",
+    "DB": "%s",
+    "tickers": ["I"]
+  }},
+  "data": {"DB": {
+    "DB path": "%s",
+    "DB": "%s",
+    "tickers": ["A", "B"]
+  }},
+  "beta plot": {"graph": "beta"},
+  "survivorship": true
+}`, tmpdir, dbName, tmpdir, dbName)
+				So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+				var betaExp Beta
+				So(betaExp.Run(ctx, &cfg), ShouldBeNil)
+
+				So(len(betaGraph.Plots), ShouldEqual, 3)
+				So(betaGraph.Plots[0].Legend, ShouldEqual, "testID betas p.d.f.")
+				So(betaGraph.Plots[1].Legend, ShouldEqual, "testID active betas p.d.f.")
+				So(betaGraph.Plots[2].Legend, ShouldEqual, "testID delisted betas p.d.f.")
+				So(values["testID tickers"], ShouldEqual, "2")
+				So(values["testID active tickers"], ShouldEqual, "1")
+				So(values["testID delisted tickers"], ShouldEqual, "1")
+				So(values["testID active mean beta"], ShouldNotBeEmpty)
+				So(values["testID delisted samples"], ShouldEqual, "4")
+			})
+
+			Convey("survivorship requires DB", func() {
+				var cfg config.Beta
+				So(cfg.InitMessage(testutil.JSON(`{
+  "reference": {"daily distribution": {"name": "normal"}},
+  "data": {"daily distribution": {"name": "normal"}},
+  "survivorship": true
+}`)), ShouldNotBeNil)
 			})
 		})
 
@@ -202,30 +293,162 @@ func TestBeta(t *testing.T) {
 			So(len(LengthsGraph.Plots), ShouldEqual, 1)
 			So(len(BetaRatios.Plots), ShouldEqual, 1)
 		})
+
+		Convey("with sampled R correlation tickers", func() {
+			var cfg config.Beta
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "testID",
+  "reference": {"daily distribution": {"name": "t"}, "days": 10},
+  "data": {
+    "daily distribution": {"name": "t"},
+    "tickers": 20,
+    "days": 10,
+    "batch size": 3
+  },
+  "R correlations": {"graph": "corr"},
+  "R correlations tickers": 4
+}`)), ShouldBeNil)
+			var betaExp Beta
+			So(betaExp.Run(ctx, &cfg), ShouldBeNil)
+			So(values["testID tickers"], ShouldEqual, "20")
+			So(values["testID R correlations tickers"], ShouldEqual, "4")
+			// All 6 pairs of the 4 sampled tickers.
+			So(values["testID R cross-correlations"], ShouldEqual, "6")
+			So(len(CorrGraph.Plots), ShouldEqual, 1)
+		})
+	})
+
+	Convey("R series sampling works", t, func() {
+		s := lpStats{maxRs: 2}
+		s2 := lpStats{maxRs: 2}
+		for i, p := range []uint64{5, 3, 8, 1} {
+			ts := stats.NewTimeseries([]db.Date{db.NewDate(2020, 1, 1)}, []float64{float64(i)})
+			if i < 2 {
+				s.addR(rSeries{priority: p, ts: ts})
+			} else {
+				s2.addR(rSeries{priority: p, ts: ts})
+			}
+		}
+		So(len(s.rs), ShouldEqual, 2)
+		So(s.Merge(&s2), ShouldBeNil)
+		So(len(s.rs), ShouldEqual, 2)
+		So(s.rs[0].priority, ShouldEqual, 1)
+		So(s.rs[1].priority, ShouldEqual, 3)
+
+		e := Beta{rSeed: 1}
+		ts := stats.NewTimeseries([]db.Date{db.NewDate(2020, 1, 1)}, []float64{1})
+		ts2 := stats.NewTimeseries([]db.Date{db.NewDate(2020, 1, 1)}, []float64{2})
+		So(e.rPriority("A", ts), ShouldEqual, e.rPriority("A", ts))
+		So(e.rPriority("A", ts), ShouldNotEqual, e.rPriority("A", ts2))
+		So(e.rPriority("A", ts), ShouldNotEqual, e.rPriority("B", ts))
 	})
 }
 
-func TestIterators(t *testing.T) {
+func TestRegression(t *testing.T) {
 	t.Parallel()
 
-	Convey("nxnPairs works", t, func() {
-		So(iterator.ToSlice[intPair](&nxnPairs{n: 4}), ShouldResemble, []intPair{
-			{0, 1},
-			{0, 2},
-			{0, 3},
-			{1, 2},
-			{1, 3},
-			{2, 3},
+	Convey("ols works", t, func() {
+		e := Beta{config: &config.Beta{Estimator: "ols"}}
+		beta, alpha := e.regression([]float64{1, 3, 5, 7}, []float64{0, 1, 2, 3})
+		So(beta, ShouldAlmostEqual, 2.0)
+		So(alpha, ShouldAlmostEqual, 1.0)
+		So(e.computeBeta([]float64{1, 3, 5, 7}, []float64{0, 1, 2, 3}),
+			ShouldAlmostEqual, 2.0)
+	})
+
+	Convey("regression is zero for too short a sequence", t, func() {
+		e := Beta{config: &config.Beta{Estimator: "ols"}}
+		beta, alpha := e.regression([]float64{1}, []float64{2})
+		So(beta, ShouldEqual, 0)
+		So(alpha, ShouldEqual, 0)
+	})
+
+	Convey("estimators work with an outlier", t, func() {
+		// p = 2*ref + 1, except for the last point.
+		ref := []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		p := []float64{1, 3, 5, 7, 9, 11, 13, 15, 17, 100}
+		estimate := func(estimator string) (float64, float64) {
+			e := Beta{config: &config.Beta{Estimator: estimator, PriorSigma: 0.5}}
+			return e.regression(p, ref)
+		}
+		olsBeta, _ := estimate("ols")
+		So(olsBeta, ShouldAlmostEqual, 6.4182, 0.0001)
+
+		Convey("huber", func() {
+			beta, alpha := estimate("huber")
+			So(beta, ShouldAlmostEqual, 2.0, 0.01)
+			So(alpha, ShouldAlmostEqual, 1.0, 0.05)
 		})
+
+		Convey("theil-sen", func() {
+			beta, alpha := estimate("theil-sen")
+			So(beta, ShouldAlmostEqual, 2.0)
+			So(alpha, ShouldAlmostEqual, 1.0)
+		})
+
+		Convey("vasicek", func() {
+			beta, _ := estimate("vasicek")
+			So(beta, ShouldBeGreaterThan, 1.0)
+			So(beta, ShouldBeLessThan, olsBeta)
+		})
+
+		Convey("blume", func() {
+			beta, alpha := estimate("blume")
+			So(beta, ShouldAlmostEqual, 1.0/3.0+2.0/3.0*olsBeta)
+			So(alpha, ShouldAlmostEqual, 18.1-beta*4.5)
+		})
+	})
+}
+
+func TestCorrelation(t *testing.T) {
+	t.Parallel()
+
+	Convey("ranks works", t, func() {
+		So(ranks([]float64{3, 1, 2, 1}), ShouldResemble, []float64{4, 1.5, 3, 1.5})
 	})
 
-	Convey("randPairs works", t, func() {
-		n, k := 10, 5
-		pairs := iterator.ToSlice[intPair](newRandPairs(n, k, 42))
-		So(len(pairs), ShouldEqual, k)
-		for _, p := range pairs {
-			So(p.x, ShouldBeLessThan, p.y)
-			So(p.y, ShouldBeLessThan, n)
+	Convey("correlation types work", t, func() {
+		dates := make([]db.Date, 5)
+		for i := range dates {
+			dates[i] = db.NewDate(2020, 1, uint8(i+1))
 		}
+		// Monotonic but non-linear relationship with an outlier.
+		ts1 := stats.NewTimeseries(dates, []float64{1, 2, 3, 4, 5})
+		ts2 := stats.NewTimeseries(dates, []float64{1, 2, 3, 4, 100})
+		ts3 := stats.NewTimeseries(dates, []float64{2, 1, 4, 3, 5})
+
+		Convey("pearson", func() {
+			e := Beta{config: &config.Beta{CorrelationType: "pearson"}}
+			corr, ok := e.correlation(ts1, ts2)
+			So(ok, ShouldBeTrue)
+			So(corr, ShouldAlmostEqual, 0.7250, 0.0001)
+		})
+
+		Convey("spearman", func() {
+			e := Beta{config: &config.Beta{CorrelationType: "spearman"}}
+			corr, ok := e.correlation(ts1, ts2)
+			So(ok, ShouldBeTrue)
+			So(corr, ShouldAlmostEqual, 1.0)
+			corr, ok = e.correlation(ts1, ts3)
+			So(ok, ShouldBeTrue)
+			So(corr, ShouldAlmostEqual, 0.8)
+		})
+
+		Convey("kendall", func() {
+			e := Beta{config: &config.Beta{CorrelationType: "kendall"}}
+			corr, ok := e.correlation(ts1, ts2)
+			So(ok, ShouldBeTrue)
+			So(corr, ShouldAlmostEqual, 1.0)
+			corr, ok = e.correlation(ts1, ts3)
+			So(ok, ShouldBeTrue)
+			So(corr, ShouldAlmostEqual, 0.6)
+		})
+
+		Convey("constant series", func() {
+			e := Beta{config: &config.Beta{CorrelationType: "kendall"}}
+			_, ok := e.correlation(ts1, stats.NewTimeseries(dates, []float64{1, 1, 1, 1, 1}))
+			So(ok, ShouldBeFalse)
+		})
 	})
 }
@@ -0,0 +1,229 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package beta
+
+import (
+	"context"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+// Hedge experiment compares the risk of beta-hedged and unhedged stocks.
+type Hedge struct {
+	config *config.Hedge
+	beta   Beta // reference series and the beta estimator
+	// Buckets of the returns histograms, possibly shared by the group of their
+	// graph.
+	returnsBuckets *stats.Buckets
+}
+
+var _ experiments.Experiment = &Hedge{}
+
+func (e *Hedge) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Hedge) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Hedge) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Hedge); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.beta.config = e.config.Beta
+	if c := e.config.ReturnsPlot; c != nil {
+		e.returnsBuckets = experiments.PlotBuckets(ctx, c)
+	}
+	if err := e.beta.processReference(ctx); err != nil {
+		return errors.Annotate(err, "failed to process reference data")
+	}
+	f := func(lps []experiments.LogProfits) *hedgeResult {
+		return e.processLogProfits(ctx, e.beta.synthesize(lps))
+	}
+	it, err := experiments.SourceMap(ctx, e.config.Beta.Data, f)
+	if err != nil {
+		return errors.Annotate(err, "failed to get data price series")
+	}
+	defer it.Close()
+
+	g := func(j1, j2 *hedgeResult) *hedgeResult { return j1.Merge(j2) }
+	total := iterator.Reduce[*hedgeResult, *hedgeResult](it, e.newHedgeResult(), g)
+	if err := e.processTotal(ctx, total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+type hedgeResult struct {
+	unhedged    *stats.Histogram // daily log-profits; nil when not plotted
+	hedged      *stats.Histogram
+	ddUnhedged  []float64 // per-ticker max. drawdowns
+	ddHedged    []float64
+	sigmaRatios []float64 // per-ticker sigma[hedged]/sigma[unhedged]
+	tickers     int
+}
+
+func (e *Hedge) newHedgeResult() *hedgeResult {
+	var res hedgeResult
+	if c := e.config.ReturnsPlot; c != nil {
+		res.unhedged = stats.NewHistogram(e.returnsBuckets)
+		res.hedged = stats.NewHistogram(e.returnsBuckets)
+	}
+	return &res
+}
+
+func (j *hedgeResult) Merge(j2 *hedgeResult) *hedgeResult {
+	if j.unhedged != nil {
+		j.unhedged.AddHistogram(j2.unhedged)
+		j.hedged.AddHistogram(j2.hedged)
+	}
+	j.ddUnhedged = append(j.ddUnhedged, j2.ddUnhedged...)
+	j.ddHedged = append(j.ddHedged, j2.ddHedged...)
+	j.sigmaRatios = append(j.sigmaRatios, j2.sigmaRatios...)
+	j.tickers += j2.tickers
+	return j
+}
+
+// maxDrawdown of the cumulative sum of the log-profits xs, as the fraction of
+// the value lost from its previous peak.
+func maxDrawdown(xs []float64) float64 {
+	var sum, peak, dd float64
+	for _, x := range xs {
+		sum += x
+		if sum > peak {
+			peak = sum
+		}
+		if peak-sum > dd {
+			dd = peak - sum
+		}
+	}
+	return 1 - math.Exp(-dd)
+}
+
+// hedge returns the unhedged and hedged daily log-profits of p against ref,
+// which are assumed to have the same length. With a window, the first window
+// days are used only for estimating beta.
+func (e *Hedge) hedge(p, ref []float64) (unhedged, hedged []float64) {
+	w := e.config.Window
+	if w == 0 {
+		beta := e.beta.computeBeta(p, ref)
+		hedged = make([]float64, len(p))
+		for i := range p {
+			hedged[i] = p[i] - beta*ref[i]
+		}
+		return p, hedged
+	}
+	if len(p) <= w {
+		return nil, nil
+	}
+	hedged = make([]float64, 0, len(p)-w)
+	for i := w; i < len(p); i++ {
+		beta := e.beta.computeBeta(p[i-w:i], ref[i-w:i])
+		hedged = append(hedged, p[i]-beta*ref[i])
+	}
+	return p[w:], hedged
+}
+
+func (e *Hedge) processLogProfits(ctx context.Context, lps []experiments.LogProfits) *hedgeResult {
+	res := e.newHedgeResult()
+	for _, lp := range lps {
+		if ctx.Err() != nil {
+			break
+		}
+		tss := stats.TimeseriesIntersect(lp.Timeseries, e.beta.refs[0].ts)
+		unhedged, hedged := e.hedge(tss[0].Data(), tss[1].Data())
+		if len(unhedged) < 2 {
+			logging.Warningf(ctx, "skipping %s: too few samples: %d",
+				lp.Ticker, len(tss[0].Data()))
+			continue
+		}
+		sigma := stats.NewSample(unhedged).Sigma()
+		if sigma == 0 {
+			logging.Warningf(ctx, "skipping %s: sigma = 0", lp.Ticker)
+			continue
+		}
+		if res.unhedged != nil {
+			res.unhedged.Add(unhedged...)
+			res.hedged.Add(hedged...)
+		}
+		res.ddUnhedged = append(res.ddUnhedged, maxDrawdown(unhedged))
+		res.ddHedged = append(res.ddHedged, maxDrawdown(hedged))
+		res.sigmaRatios = append(res.sigmaRatios,
+			stats.NewSample(hedged).Sigma()/sigma)
+		res.tickers++
+	}
+	return res
+}
+
+func (e *Hedge) processTotal(ctx context.Context, total *hedgeResult) error {
+	err := experiments.AddTypedValue(ctx, e.config.ID, "tickers", experiments.IntValue(total.tickers))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if total.tickers == 0 {
+		logging.Warningf(ctx, "no tickers to hedge")
+		return nil
+	}
+	for _, v := range []struct {
+		key string
+		xs  []float64
+	}{
+		{"mean sigma ratio", total.sigmaRatios},
+		{"mean unhedged max drawdown", total.ddUnhedged},
+		{"mean hedged max drawdown", total.ddHedged},
+	} {
+		x := experiments.FloatValue(stats.NewSample(v.xs).Mean())
+		if err := experiments.AddTypedValue(ctx, e.config.ID, v.key, x); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", v.key)
+		}
+	}
+	if c := e.config.ReturnsPlot; c != nil {
+		for _, h := range []struct {
+			legend string
+			hist   *stats.Histogram
+		}{
+			{"unhedged", total.unhedged},
+			{"hedged", total.hedged},
+		} {
+			dist := stats.NewHistogramDistribution(h.hist)
+			if err := experiments.PlotDistribution(ctx, dist, c, e.config.ID, h.legend); err != nil {
+				return errors.Annotate(err, "failed to plot %s log-profits", h.legend)
+			}
+		}
+	}
+	if c := e.config.DrawdownsPlot; c != nil {
+		for _, d := range []struct {
+			legend string
+			xs     []float64
+		}{
+			{"unhedged drawdowns", total.ddUnhedged},
+			{"hedged drawdowns", total.ddHedged},
+		} {
+			dist := experiments.NewSampleDistribution(d.xs, c)
+			if err := experiments.PlotDistribution(ctx, dist, c, e.config.ID, d.legend); err != nil {
+				return errors.Annotate(err, "failed to plot %s", d.legend)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package beta
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHedge(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_hedge")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("maxDrawdown works", t, func() {
+		So(maxDrawdown([]float64{0.1, -0.2, 0.05, -0.1, 0.5}), ShouldAlmostEqual,
+			0.2212, 0.0001) // 1-exp(-0.25)
+		So(maxDrawdown([]float64{0.1, 0.2}), ShouldEqual, 0)
+	})
+
+	Convey("Hedge experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		returnsGraph, err := canvas.EnsureGraph(plot.KindXY, "returns", "group")
+		So(err, ShouldBeNil)
+		drawdownsGraph, err := canvas.EnsureGraph(plot.KindXY, "drawdowns", "group")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"I": {}, "A": {}}
+		prices := make(map[string][]db.PriceRow)
+		for i, p := range []float32{100, 102, 99, 103, 101, 105, 100, 98} {
+			d := db.NewDate(2020, 1, uint8(i+1))
+			prices["I"] = append(prices["I"], db.TestPrice(d, p, p, p, 1000, true))
+			// A has exactly twice the log-profits of I.
+			a := p * p / 100
+			prices["A"] = append(prices["A"], db.TestPrice(d, a, a, a, 1000, true))
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		conf := func(window int) string {
+			return fmt.Sprintf(`
+{
+  "id": "test",
+  "beta": {
+    "reference": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["I"]}},
+    "data": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["A"]}}
+  },
+  "window": %[3]d,
+  "returns plot": {"graph": "returns"},
+  "drawdowns plot": {"graph": "drawdowns"}
+}`, tmpdir, dbName, window)
+		}
+
+		Convey("in-sample beta", func() {
+			var cfg config.Hedge
+			So(cfg.InitMessage(testutil.JSON(conf(0))), ShouldBeNil)
+			var e Hedge
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "1")
+			ratio, err := strconv.ParseFloat(values["test mean sigma ratio"], 64)
+			So(err, ShouldBeNil)
+			So(ratio, ShouldBeLessThan, 0.001)
+			dd, err := strconv.ParseFloat(values["test mean hedged max drawdown"], 64)
+			So(err, ShouldBeNil)
+			So(dd, ShouldBeLessThan, 0.001)
+			So(values["test mean unhedged max drawdown"], ShouldNotEqual, "0")
+			So(len(returnsGraph.Plots), ShouldEqual, 2)
+			So(returnsGraph.Plots[0].Legend, ShouldEqual, "test unhedged p.d.f.")
+			So(returnsGraph.Plots[1].Legend, ShouldEqual, "test hedged p.d.f.")
+			So(len(drawdownsGraph.Plots), ShouldEqual, 2)
+			So(drawdownsGraph.Plots[1].Legend, ShouldEqual, "test hedged drawdowns p.d.f.")
+		})
+
+		Convey("out-of-sample beta", func() {
+			var cfg config.Hedge
+			So(cfg.InitMessage(testutil.JSON(conf(3))), ShouldBeNil)
+			var e Hedge
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "1")
+			// Beta is exactly 2 in any window.
+			ratio, err := strconv.ParseFloat(values["test mean sigma ratio"], 64)
+			So(err, ShouldBeNil)
+			So(ratio, ShouldBeLessThan, 0.001)
+		})
+
+		Convey("config requires a plot", func() {
+			var cfg config.Hedge
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "beta": {
+    "reference": {"daily distribution": {"name": "t"}},
+    "data": {"daily distribution": {"name": "t"}}
+  }
+}`)), ShouldNotBeNil)
+		})
+	})
+}
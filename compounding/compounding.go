@@ -0,0 +1,174 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compounding is an experiment stress-testing compounded
+// distributions at multiple horizons.
+//
+// For each horizon n, it compares the distribution of realized overlapping
+// n-day log-profits with the reference daily distribution compounded n times,
+// quantifying the discrepancy by the Kolmogorov-Smirnov distance.
+package compounding
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Compounding struct {
+	config  *config.Compounding
+	context context.Context
+}
+
+var _ experiments.Experiment = &Compounding{}
+
+func (e *Compounding) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Compounding) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Compounding) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Compounding); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	it, err := experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j2.Merge(j1) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, e.newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+type jobResult struct {
+	hs         []*stats.Histogram // realized log-profits for each horizon
+	numTickers int
+	samples    int
+}
+
+func (e *Compounding) newJobResult() *jobResult {
+	buckets := &e.config.Buckets
+	if c := e.config.Plot; c != nil {
+		if b := experiments.LookupSharedBuckets(e.context, c); b != nil {
+			buckets = b
+		}
+	}
+	hs := make([]*stats.Histogram, len(e.config.Horizons))
+	for i := range hs {
+		hs[i] = stats.NewHistogram(buckets)
+	}
+	return &jobResult{hs: hs}
+}
+
+// Merge j2 into j and return j.
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	for i, h := range j.hs {
+		if err := h.AddHistogram(j2.hs[i]); err != nil {
+			panic(errors.Annotate(err, "failed to merge histograms"))
+		}
+	}
+	j.numTickers += j2.numTickers
+	j.samples += j2.samples
+	return j
+}
+
+func (e *Compounding) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := e.newJobResult()
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		data := lp.Timeseries.Data()
+		// sums[i] is the sum of data[0:i].
+		sums := make([]float64, len(data)+1)
+		for i, x := range data {
+			sums[i+1] = sums[i] + x
+		}
+		for k, n := range e.config.Horizons {
+			for i := n; i < len(sums); i++ {
+				res.hs[k].Add(sums[i] - sums[i-n])
+			}
+		}
+		res.numTickers++
+		res.samples += len(data)
+	}
+	return res
+}
+
+func (e *Compounding) processTotal(total *jobResult) error {
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(total.samples)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of samples")
+	}
+	var xs, ks []float64
+	for k, n := range e.config.Horizons {
+		h := total.hs[k]
+		if h.CountsTotal() == 0 {
+			continue
+		}
+		name := fmt.Sprintf("%dd", n)
+		ref := *e.config.Reference // shallow copy, to modify N locally
+		ref.N *= n
+		dist, _, err := experiments.CompoundDistribution(e.context, &ref)
+		if err != nil {
+			return errors.Annotate(err, "failed to compound reference for %s", name)
+		}
+		d := experiments.KSDistance(h, dist)
+		xs = append(xs, float64(n))
+		ks = append(ks, d)
+		if err := experiments.AddTypedValue(e.context, e.config.ID, "KS "+name, experiments.FloatValue(d)); err != nil {
+			return errors.Annotate(err, "failed to add value for KS %s", name)
+		}
+		if c := e.config.Plot; c != nil {
+			pc := *c // shallow copy, to set the reference locally
+			pc.RefDist = &ref
+			pc.AdjustRef = false
+			err := experiments.PlotDistribution(e.context,
+				stats.NewHistogramDistribution(h), &pc, e.config.ID, "realized "+name)
+			if err != nil {
+				return errors.Annotate(err, "failed to plot realized %s", name)
+			}
+		}
+	}
+	if e.config.KSGraph == "" || len(xs) == 0 {
+		return nil
+	}
+	plt, err := plot.NewXYPlot(xs, ks)
+	if err != nil {
+		return errors.Annotate(err, "failed to create KS plot")
+	}
+	plt.SetLegend(e.Prefix("KS distance")).SetYLabel("KS distance")
+	if err := experiments.AddPlot(e.context, plt, e.config.KSGraph); err != nil {
+		return errors.Annotate(err, "failed to add KS plot")
+	}
+	return nil
+}
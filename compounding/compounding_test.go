@@ -0,0 +1,78 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compounding
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompounding(t *testing.T) {
+	t.Parallel()
+
+	Convey("Compounding experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		distGraph, err := canvas.EnsureGraph(plot.KindXY, "dist", "g")
+		So(err, ShouldBeNil)
+		ksGraph, err := canvas.EnsureGraph(plot.KindXY, "ks", "g")
+		So(err, ShouldBeNil)
+
+		var cfg config.Compounding
+		So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "normal"},
+    "days": 4001
+  },
+  "reference distribution": {
+    "analytical source": {"name": "normal"},
+    "compound type": "fast",
+    "parameters": {"samples": 10000, "workers": 1}
+  },
+  "horizons": [1, 4],
+  "buckets": {"n": 101, "min": -10, "max": 10},
+  "plot": {"graph": "dist"},
+  "KS graph": "ks"
+}`)), ShouldBeNil)
+		var e Compounding
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		So(values["test tickers"], ShouldEqual, "1")
+		So(values["test samples"], ShouldEqual, "4000")
+		for _, k := range []string{"test KS 1d", "test KS 4d"} {
+			ks, err := strconv.ParseFloat(values[k], 64)
+			So(err, ShouldBeNil)
+			So(ks, ShouldBeLessThan, 0.1)
+		}
+		// Realized and reference distributions for each horizon.
+		So(len(distGraph.Plots), ShouldEqual, 4)
+		So(len(ksGraph.Plots), ShouldEqual, 1)
+		So(ksGraph.Plots[0].X, ShouldResemble, []float64{1, 4})
+	})
+}
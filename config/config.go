@@ -16,14 +16,24 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/stockparfait/db"
 	"github.com/stockparfait/stockparfait/message"
 	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/stockparfait/stats"
+	"gopkg.in/yaml.v3"
 )
 
 // ExperimentConfig is a custom configuration for an experiment.
@@ -33,6 +43,23 @@ type ExperimentConfig interface {
 	Name() string
 }
 
+// ExperimentID returns the "id" of the experiment config, or an empty string
+// if the config has no ID field.
+func ExperimentID(ec ExperimentConfig) string {
+	v := reflect.ValueOf(ec)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName("ID")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
+
 // TestExperimentConfig is only used in tests.
 type TestExperimentConfig struct {
 	ID     string  `json:"id"`
@@ -59,6 +86,13 @@ type ScatterPlot struct {
 	Intercept    float64 `json:"intercept"`
 	PlotExpected bool    `json:"plot expected"` // plot Y = incline*X+intercept
 	DeriveLine   bool    `json:"plot derived"`  // plot line from data
+	// When present, plot the means of Y for X in each bucket with +-stderr.
+	BinnedMeans *stats.Buckets `json:"binned means"`
+	// When present, plot the density of points instead of the raw points.
+	Density *ScatterDensity `json:"density"`
+	// Subsample the raw points to at most this many, when > 0. The derived
+	// overlays still use all the points.
+	MaxPoints int `json:"max points"`
 }
 
 var _ message.Message = &ScatterPlot{}
@@ -67,6 +101,30 @@ func (p *ScatterPlot) InitMessage(js any) error {
 	if err := message.Init(p, js); err != nil {
 		return errors.Annotate(err, "failed to init ScatterPlot")
 	}
+	if p.MaxPoints < 0 {
+		return errors.Reason("max points=%d must be >= 0", p.MaxPoints)
+	}
+	return nil
+}
+
+// ScatterDensity configures the 2D histogram mode of a scatter plot. Instead
+// of the raw points, it plots the centers of the non-empty (x, y) buckets,
+// grouped into the given number of logarithmically spaced density levels.
+type ScatterDensity struct {
+	XBuckets stats.Buckets `json:"x buckets"`
+	YBuckets stats.Buckets `json:"y buckets"`
+	Levels   int           `json:"levels" default:"5"`
+}
+
+var _ message.Message = &ScatterDensity{}
+
+func (d *ScatterDensity) InitMessage(js any) error {
+	if err := message.Init(d, js); err != nil {
+		return errors.Annotate(err, "failed to init ScatterDensity")
+	}
+	if d.Levels < 1 {
+		return errors.Reason("levels=%d must be >= 1", d.Levels)
+	}
 	return nil
 }
 
@@ -76,6 +134,10 @@ func (p *ScatterPlot) InitMessage(js any) error {
 // It computes (s[subrange] - s[total]), possibly normalized by s[total].  The
 // subrange is of size Window, and the values are sampled every Step points
 // along the Timeseries.
+//
+// Alternatively (or in addition), the raw s[subrange] can be plotted as a time
+// series by the end date of the subrange, averaged across tickers. At least one
+// of Plot or TimeseriesGraph must be present.
 type StabilityPlot struct {
 	Step      int  `json:"step" default:"1"`
 	Window    int  `json:"window" default:"1"`
@@ -83,7 +145,12 @@ type StabilityPlot struct {
 	// When Normalize is true, skip a ticker when the absolute value of its
 	// normalization coefficient is below the threshold.
 	Threshold float64           `json:"threshold"`
-	Plot      *DistributionPlot `json:"plot" required:"true"`
+	Plot      *DistributionPlot `json:"plot"`
+	// Graph for the time series of the statistic over the subranges.
+	TimeseriesGraph string `json:"timeseries graph"`
+	// Optional scatter plot of the statistic over subranges (Y) against its
+	// value over the total range (X). Threshold does not apply here.
+	Scatter *ScatterPlot `json:"scatter"`
 }
 
 var _ message.Message = &StabilityPlot{}
@@ -101,6 +168,9 @@ func (p *StabilityPlot) InitMessage(js any) error {
 	if p.Threshold < 0 {
 		return errors.Reason(`"threshold"=%f must be >= 0`, p.Threshold)
 	}
+	if p.Plot == nil && p.TimeseriesGraph == "" {
+		return errors.Reason(`at least one of "plot" or "timeseries graph" is required`)
+	}
 	return nil
 }
 
@@ -111,6 +181,10 @@ type HoldPosition struct {
 	Ticker     string  `json:"ticker" required:"true"`
 	Shares     float64 `json:"shares"`
 	StartValue float64 `json:"start value"`
+	// Relative share of each periodic contribution allocated to this
+	// position, >= 0. When all the positions have 0 weight, the contributions
+	// are split equally.
+	Weight float64 `json:"contribution weight"`
 }
 
 func (p *HoldPosition) InitMessage(js any) error {
@@ -122,6 +196,30 @@ func (p *HoldPosition) InitMessage(js any) error {
 			`exactly one of "shares" or "start value" must be non-zero for ticker %s`,
 			p.Ticker)
 	}
+	if p.Weight < 0 {
+		return errors.Reason("contribution weight=%g must be >= 0 for ticker %s",
+			p.Weight, p.Ticker)
+	}
+	return nil
+}
+
+// HoldContributions is a schedule of periodic contributions to the Hold
+// portfolio, modeling dollar-cost averaging. The amount is invested on the
+// first trading day of each period after the initial one.
+type HoldContributions struct {
+	Amount    float64 `json:"amount" required:"true"` // > 0
+	Frequency string  `json:"frequency" choices:"weekly,monthly,quarterly,yearly" default:"monthly"`
+}
+
+var _ message.Message = &HoldContributions{}
+
+func (c *HoldContributions) InitMessage(js any) error {
+	if err := message.Init(c, js); err != nil {
+		return errors.Annotate(err, "failed to init HoldContributions")
+	}
+	if c.Amount <= 0 {
+		return errors.Reason("amount=%g must be > 0", c.Amount)
+	}
 	return nil
 }
 
@@ -134,23 +232,51 @@ type Hold struct {
 	PositionsAxis  string         `json:"positions axis" choices:"left,right" default:"right"`
 	TotalGraph     string         `json:"total graph"` // plot portfolio value
 	TotalAxis      string         `json:"total axis" choices:"left,right" default:"right"`
+	// Benchmark ticker to compare the portfolio against. It is plotted in the
+	// total graph scaled to the initial portfolio value, and its total return,
+	// CAGR, max drawdown and Sharpe ratio are added as values alongside the
+	// portfolio's.
+	Benchmark string `json:"benchmark"`
+	// Plot the portfolio value relative to the scaled benchmark; requires
+	// "benchmark".
+	RelativeGraph string `json:"relative graph"`
+	// Periodic contributions allocated across the positions according to
+	// their weights. The money-weighted (IRR) and time-weighted returns are
+	// added as values.
+	Contributions *HoldContributions `json:"contributions"`
+	// When true, dividends buy more shares, which is equivalent to using the
+	// fully adjusted prices. Otherwise, positions use split-adjusted prices and
+	// the dividends implied by the fully adjusted prices accrue as cash.
+	ReinvestDividends bool `json:"reinvest dividends" default:"true"`
+	// Use split-adjusted prices ignoring dividends altogether, that is, plot
+	// the price return rather than the total return.
+	RawPrices bool `json:"raw prices"`
 }
 
 var _ ExperimentConfig = &Hold{}
 
 func (h *Hold) InitMessage(js any) error {
-	return errors.Annotate(message.Init(h, js), "failed to parse Hold config")
+	if err := message.Init(h, js); err != nil {
+		return errors.Annotate(err, "failed to parse Hold config")
+	}
+	if h.RelativeGraph != "" && h.Benchmark == "" {
+		return errors.Reason(`"relative graph" requires "benchmark"`)
+	}
+	return nil
 }
 
 func (h *Hold) experiment()  {}
 func (h *Hold) Name() string { return "hold" }
 
 // AnalyticalDistribution configures the type and parameters of a distibution.
+// The exponential distribution is defined only by its mean, and MAD is ignored.
+// The "stable" distribution is the symmetric alpha-stable one, which requires
+// alpha in (1..2].
 type AnalyticalDistribution struct {
-	Name  string  `json:"name" required:"true" choices:"t,normal"`
+	Name  string  `json:"name" required:"true" choices:"t,normal,exponential,stable"`
 	Mean  float64 `json:"mean" default:"0.0"`
 	MAD   float64 `json:"MAD" default:"1.0"`
-	Alpha float64 `json:"alpha" default:"3.0"` // T dist. parameter
+	Alpha float64 `json:"alpha" default:"3.0"` // T and stable dist. parameter
 }
 
 var _ message.Message = &AnalyticalDistribution{}
@@ -162,9 +288,45 @@ func (d *AnalyticalDistribution) InitMessage(js any) error {
 	if d.Name == "t" && d.Alpha <= 1.0 {
 		return errors.Reason("T-distribution requires alpha=%f > 1.0", d.Alpha)
 	}
+	if d.Name == "stable" && (d.Alpha <= 1.0 || d.Alpha > 2.0) {
+		return errors.Reason("stable distribution requires alpha=%f in (1..2]", d.Alpha)
+	}
 	if d.MAD <= 0.0 {
 		return errors.Reason("MAD=%f must be positive", d.MAD)
 	}
+	if d.Name == "exponential" && d.Mean <= 0.0 {
+		return errors.Reason("exponential distribution requires mean=%f > 0", d.Mean)
+	}
+	return nil
+}
+
+// HistogramData is the JSON content of a "histogram file": an empirical
+// distribution given as the buckets and the sample counts in each bucket.
+type HistogramData struct {
+	Buckets stats.Buckets `json:"buckets" required:"true"`
+	Counts  []float64     `json:"counts" required:"true"` // len = buckets.n
+}
+
+var _ message.Message = &HistogramData{}
+
+func (h *HistogramData) InitMessage(js any) error {
+	if err := message.Init(h, js); err != nil {
+		return errors.Annotate(err, "failed to init HistogramData")
+	}
+	if len(h.Counts) != h.Buckets.N {
+		return errors.Reason("len(counts)=%d != buckets.n=%d",
+			len(h.Counts), h.Buckets.N)
+	}
+	var total float64
+	for i, c := range h.Counts {
+		if c < 0 {
+			return errors.Reason("counts[%d]=%g must be >= 0", i, c)
+		}
+		total += c
+	}
+	if total <= 0 {
+		return errors.Reason("total count must be positive")
+	}
 	return nil
 }
 
@@ -173,9 +335,14 @@ func (d *AnalyticalDistribution) InitMessage(js any) error {
 // can in turn be a CompoundDistribution, yielding N1*N2 compounded source, to
 // arbitrary depth.
 type CompoundDistribution struct {
-	// Exactly one of the AnalyticalSource or CompoundSource must be present.
+	// Exactly one of the AnalyticalSource, CompoundSource or HistogramFile must
+	// be present.
 	AnalyticalSource *AnalyticalDistribution `json:"analytical source"`
 	CompoundSource   *CompoundDistribution   `json:"compound source"`
+	// Empirical distribution read from a file. A .csv file has "value,count"
+	// rows binned into the "parameters" buckets; any other file is read as
+	// HistogramData in JSON, JSON5 or YAML according to its extension.
+	HistogramFile string `json:"histogram file"`
 	// When > 0, use SampleDistribution with this many samples from the source
 	// distribution, rather than the source distribution directly.
 	SourceSamples int `json:"source samples"`
@@ -187,8 +354,15 @@ type CompoundDistribution struct {
 	//
 	// - direct: just sample the source N times for each compound sample;
 	// - fast: use Y_i = sum(X_i, ..., X_N+i) for a single stream of X_i;
-	// - biased: use variable substitution and Monte Carlo integration.
-	CompoundType string `json:"compound type" choices:"direct,fast,biased" default:"biased"`
+	// - biased: use variable substitution and Monte Carlo integration;
+	// - exact: the analytical compound distribution with the histogram computed
+	//   from its c.d.f.; requires an uncompounded normal or stable source for
+	//   N > 1;
+	// - fft: N-fold convolution of the source p.d.f. discretized on a grid
+	//   spanning the histogram buckets, computed via FFT.
+	CompoundType string `json:"compound type" choices:"direct,fast,biased,exact,fft" default:"biased"`
+	// Number of grid points for the "fft" compound type.
+	FFTGrid int `json:"FFT grid" default:"4096"`
 	// Compound algorithm parameters.
 	Params stats.ParallelSamplingConfig `json:"parameters"`
 }
@@ -199,13 +373,26 @@ func (d *CompoundDistribution) InitMessage(js any) error {
 	if err := message.Init(d, js); err != nil {
 		return errors.Annotate(err, "failed to init CompoundDistribution")
 	}
-	if (d.AnalyticalSource == nil) == (d.CompoundSource == nil) {
+	sources := 0
+	if d.AnalyticalSource != nil {
+		sources++
+	}
+	if d.CompoundSource != nil {
+		sources++
+	}
+	if d.HistogramFile != "" {
+		sources++
+	}
+	if sources != 1 {
 		return errors.Reason(
-			`exactly one of "analytical source" or "compound source" must be specified`)
+			`exactly one of "analytical source", "compound source" or "histogram file" must be specified`)
 	}
 	if d.N < 1 {
 		return errors.Reason("n=%d must be >= 1", d.N)
 	}
+	if d.FFTGrid < 16 {
+		return errors.Reason("FFT grid=%d must be >= 16", d.FFTGrid)
+	}
 	return nil
 }
 
@@ -214,19 +401,50 @@ func (d *CompoundDistribution) InitMessage(js any) error {
 type Source struct {
 	// Real price series database. When present, no synthetic distribution is
 	// allowed.
-	DB       *db.Reader `json:"DB"`
-	Compound int        `json:"compound" default:"1"`
+	DB *db.Reader `json:"DB"`
+	// Which DB close price to use for log-profits. Fully adjusted prices include
+	// dividends, split adjusted do not.
+	PriceAdjustment string `json:"price adjustment" default:"fully adjusted" choices:"fully adjusted,split adjusted,raw"`
+	// Use only the dividend component of log-profits, that is, the difference
+	// between fully and split adjusted log-profits. Ignores "price adjustment".
+	DividendsOnly bool `json:"dividends only"`
+	Compound      int  `json:"compound" default:"1"`
+	// Aggregate daily log-profits to weekly or monthly ones, as if computed from
+	// the last closing price of each period.
+	Resample string `json:"resample" default:"daily" choices:"daily,weekly,monthly"`
+	// Occasional jumps added to the synthetic daily log-profits.
+	Jump *Jump `json:"jump"`
+	// Cross-correlation between synthetic daily log-profits of different tickers.
+	Correlation *Correlation `json:"correlation"`
+	// With DB, replace each ticker's log-profits by a bootstrapped sequence of
+	// the same length, preserving the empirical distribution.
+	Bootstrap *Bootstrap `json:"bootstrap"`
+	// Clip each ticker's log-profits to the given bounds (winsorization) in
+	// SourceMap. The number of clipped samples is reported in LogProfits.
+	Winsorize *Winsorize `json:"winsorize"`
 	// Log-profit distribution for close[t]/close[t-1] by default, or
 	// open[t+1]/close[t] when intraday distribution is present.
 	DailyDist *AnalyticalDistribution `json:"daily distribution"`
+	// Empirical daily log-profit distribution in the HistogramData JSON format,
+	// e.g. written by DistributionPlot's "histogram file". An alternative to
+	// "daily distribution".
+	DailyHistogram string `json:"daily histogram file"`
 	// Skip log-profits that span two days.
 	IntradayOnly bool `json:"intraday only"`
 	// Required for generating OHLC prices or intraday series.
 	IntradayDist *AnalyticalDistribution `json:"intraday distribution"`
-	// Default: 9:30am - 4pm.
+	// Default: 9:30am - 4pm. With DB, intraday bars outside of the range are
+	// dropped.
 	IntradayRange *db.IntradayRange `json:"intraday range"`
-	// Resolution of the intraday samples in minutes: 1, 5, 15 or 30.
+	// Resolution of the intraday samples in minutes: 1, 5, 15 or 30. With DB,
+	// intraday bars are aggregated to this resolution.
 	IntradayRes int `json:"intraday resolution" default:"1"`
+	// Time-of-day dependent scale of the synthetic intraday samples' deviation
+	// from the mean. A sample timestamped in the range of an entry is scaled by
+	// the first such entry; samples outside of all ranges are not scaled.
+	IntradayProfile []*IntradayScale `json:"intraday profile"`
+	// Daily cash volume of the synthetic prices. Default: constant $1000.
+	Volume *SyntheticVolume `json:"volume"`
 	// With DB, saves the start date and the number of days for each ticker as a
 	// JSON file.  With synthetic distributions, read this file and generate
 	// synthetic tickers accordingly, overwriting the other parameters.
@@ -238,9 +456,15 @@ type Source struct {
 	Days    int `json:"days" default:"5000"` // #synthetic days per ticker
 	// All synthetic sequences start on this day; default:"1998-01-02".
 	StartDate db.Date `json:"start date"`
+	// When non-zero, seed the synthetic distributions and the bootstrap for
+	// reproducible results.
+	Seed int `json:"seed"`
 	// Parallel processing parameters.
 	Workers   int `json:"workers"`                 // default: 2*runtime.NumCPU()
 	BatchSize int `json:"batch size" default:"10"` // must be >= 1
+	// Tune the batch size (starting from "batch size") and the number of
+	// concurrently processed batches (up to "workers") at runtime.
+	Adaptive *Adaptive `json:"adaptive"`
 }
 
 func (s *Source) InitMessage(js any) error {
@@ -248,13 +472,61 @@ func (s *Source) InitMessage(js any) error {
 		return errors.Annotate(err, "failed to init Source")
 	}
 	if s.DB != nil {
-		if s.DailyDist != nil {
-			return errors.Reason(`cannot have both "DB" and "daily distribution"`)
+		if s.DailyDist != nil || s.DailyHistogram != "" {
+			return errors.Reason(
+				`cannot have both "DB" and "daily distribution" or "daily histogram file"`)
 		}
 		if s.IntradayDist != nil {
 			return errors.Reason(`cannot have both "DB" and "intraday distribution"`)
 		}
 	}
+	if s.DailyDist != nil && s.DailyHistogram != "" {
+		return errors.Reason(
+			`cannot have both "daily distribution" and "daily histogram file"`)
+	}
+	synthDaily := s.DailyDist != nil || s.DailyHistogram != ""
+	if s.Jump != nil && !synthDaily && s.IntradayDist == nil {
+		return errors.Reason(`"jump" requires a synthetic distribution`)
+	}
+	if s.Correlation != nil {
+		if !synthDaily {
+			return errors.Reason(
+				`"correlation" requires "daily distribution" or "daily histogram file"`)
+		}
+		if s.IntradayDist != nil || s.LengthsFile != "" {
+			return errors.Reason(
+				`"correlation" is incompatible with "intraday distribution" and "lengths file"`)
+		}
+		if n := len(s.Correlation.Matrix); n > 0 && n != s.Tickers {
+			return errors.Reason("correlation matrix size=%d != tickers=%d",
+				n, s.Tickers)
+		}
+	}
+	if s.Volume != nil && s.DB != nil {
+		return errors.Reason(`cannot have both "DB" and "volume"`)
+	}
+	if len(s.IntradayProfile) > 0 && s.IntradayDist == nil {
+		return errors.Reason(`"intraday profile" requires "intraday distribution"`)
+	}
+	if s.DividendsOnly && s.DB == nil {
+		return errors.Reason(`"dividends only" requires "DB"`)
+	}
+	if s.Bootstrap != nil {
+		if s.DB == nil {
+			return errors.Reason(`"bootstrap" requires "DB"`)
+		}
+		if s.Compound != 1 || s.IntradayOnly {
+			return errors.Reason(`"bootstrap" requires "compound"=1 and no "intraday only"`)
+		}
+	}
+	if s.Resample != "daily" {
+		if s.Compound != 1 {
+			return errors.Reason(`"compound" must be 1 with "resample"=%s`, s.Resample)
+		}
+		if s.IntradayDist != nil || s.IntradayOnly {
+			return errors.Reason(`intraday data cannot be resampled to %s`, s.Resample)
+		}
+	}
 	if s.IntradayRange == nil {
 		start := db.NewTimeOfDay(9, 30, 0, 0)
 		end := db.NewTimeOfDay(16, 0, 0, 0)
@@ -283,17 +555,213 @@ func (s *Source) InitMessage(js any) error {
 	if s.BatchSize < 1 {
 		return errors.Reason(`"batch size"=%d must be >= 1`, s.BatchSize)
 	}
+	if s.Seed < 0 {
+		return errors.Reason(`"seed"=%d must be >= 0`, s.Seed)
+	}
+	return nil
+}
+
+// SyntheticVolume configures the daily cash volume of synthetic prices as
+// exp(x + factor*|log-profit|), where x is sampled from the distribution, and
+// the log-profit is that of the day's close relative to the previous close.
+type SyntheticVolume struct {
+	// Distribution of the log of the cash volume.
+	Dist   *AnalyticalDistribution `json:"distribution" required:"true"`
+	Factor float64                 `json:"factor"` // correlation with |log-profit|
+}
+
+var _ message.Message = &SyntheticVolume{}
+
+func (v *SyntheticVolume) InitMessage(js any) error {
+	if err := message.Init(v, js); err != nil {
+		return errors.Annotate(err, "failed to init SyntheticVolume")
+	}
+	return nil
+}
+
+// IntradayScale is an element of the synthetic intraday volatility profile.
+type IntradayScale struct {
+	Range db.IntradayRange `json:"range"`
+	Scale float64          `json:"scale" default:"1"` // must be > 0
+}
+
+var _ message.Message = &IntradayScale{}
+
+func (s *IntradayScale) InitMessage(js any) error {
+	if err := message.Init(s, js); err != nil {
+		return errors.Annotate(err, "failed to init IntradayScale")
+	}
+	if s.Scale <= 0 {
+		return errors.Reason("scale=%g must be > 0", s.Scale)
+	}
+	return nil
+}
+
+// Jump configures a jump-diffusion component of synthetic log-profits: the
+// number of jumps on each day is Poisson-distributed with the given rate, and
+// each jump's log-profit is sampled from the jump distribution.
+type Jump struct {
+	Rate float64                 `json:"rate" default:"0.01"` // jumps per day, > 0
+	Dist *AnalyticalDistribution `json:"distribution" required:"true"`
+}
+
+var _ message.Message = &Jump{}
+
+func (j *Jump) InitMessage(js any) error {
+	if err := message.Init(j, js); err != nil {
+		return errors.Annotate(err, "failed to init Jump")
+	}
+	if j.Rate <= 0 {
+		return errors.Reason("rate=%g must be > 0", j.Rate)
+	}
+	return nil
+}
+
+// Correlation configures cross-correlated synthetic tickers. Exactly one of
+// the single-factor correlation or the full correlation matrix must be set.
+type Correlation struct {
+	// Single-factor model: each ticker's log-profit is a mix of a common and an
+	// independent sample, yielding this pairwise correlation; in [0..1).
+	Factor float64 `json:"factor"`
+	// Full symmetric positive definite correlation matrix, tickers x tickers.
+	Matrix [][]float64 `json:"matrix"`
+}
+
+var _ message.Message = &Correlation{}
+
+func (c *Correlation) InitMessage(js any) error {
+	if err := message.Init(c, js); err != nil {
+		return errors.Annotate(err, "failed to init Correlation")
+	}
+	if len(c.Matrix) > 0 {
+		if c.Factor != 0 {
+			return errors.Reason(`cannot have both "factor" and "matrix"`)
+		}
+		for i, row := range c.Matrix {
+			if len(row) != len(c.Matrix) {
+				return errors.Reason("correlation matrix must be square: row %d has %d elements, expected %d",
+					i, len(row), len(c.Matrix))
+			}
+			if row[i] != 1 {
+				return errors.Reason("correlation matrix diagonal [%d][%d]=%g must be 1",
+					i, i, row[i])
+			}
+			for j := 0; j < i; j++ {
+				if row[j] != c.Matrix[j][i] {
+					return errors.Reason("correlation matrix must be symmetric: [%d][%d]=%g != [%d][%d]=%g",
+						i, j, row[j], j, i, c.Matrix[j][i])
+				}
+			}
+		}
+		return nil
+	}
+	if c.Factor < 0 || c.Factor >= 1 {
+		return errors.Reason("factor=%g must be in [0..1)", c.Factor)
+	}
+	return nil
+}
+
+// Bootstrap configures resampling of real log-profits. With "block"=1 it is
+// an i.i.d. bootstrap; larger blocks preserve short-range dependence.
+type Bootstrap struct {
+	Block int `json:"block" default:"1"` // block length in samples
+}
+
+var _ message.Message = &Bootstrap{}
+
+func (b *Bootstrap) InitMessage(js any) error {
+	if err := message.Init(b, js); err != nil {
+		return errors.Annotate(err, "failed to init Bootstrap")
+	}
+	if b.Block < 1 {
+		return errors.Reason(`"block"=%d must be >= 1`, b.Block)
+	}
+	return nil
+}
+
+// Adaptive tuning of a Source's parallel processing. The batch size is adjusted
+// to approach the target processing time of a batch. When the heap exceeds the
+// memory ceiling, the number of concurrently processed batches is halved, and
+// it is restored one at a time while the heap is below half of the ceiling.
+type Adaptive struct {
+	BatchTime    float64 `json:"batch seconds" default:"1"`
+	MaxBatchSize int     `json:"max batch size" default:"1000"`
+	MaxMemory    float64 `json:"max memory MB"` // no ceiling when 0
+}
+
+var _ message.Message = &Adaptive{}
+
+func (a *Adaptive) InitMessage(js any) error {
+	if err := message.Init(a, js); err != nil {
+		return errors.Annotate(err, "failed to init Adaptive")
+	}
+	if a.BatchTime <= 0 {
+		return errors.Reason(`"batch seconds"=%g must be > 0`, a.BatchTime)
+	}
+	if a.MaxBatchSize < 1 {
+		return errors.Reason(`"max batch size"=%d must be >= 1`, a.MaxBatchSize)
+	}
+	if a.MaxMemory < 0 {
+		return errors.Reason(`"max memory MB"=%g must be >= 0`, a.MaxMemory)
+	}
+	return nil
+}
+
+// Winsorize configures clipping of the outliers of each ticker's log-profits.
+// Exactly one of Quantile or MADs must be present.
+type Winsorize struct {
+	// Clip to the [quantile..1-quantile] range of the samples, in (0..0.5).
+	Quantile float64 `json:"quantile"`
+	// Clip to mean +- MADs*MAD of the samples, > 0.
+	MADs float64 `json:"MADs"`
+}
+
+var _ message.Message = &Winsorize{}
+
+func (w *Winsorize) InitMessage(js any) error {
+	if err := message.Init(w, js); err != nil {
+		return errors.Annotate(err, "failed to init Winsorize")
+	}
+	if (w.Quantile == 0) == (w.MADs == 0) {
+		return errors.Reason(`exactly one of "quantile" or "MADs" must be present`)
+	}
+	if w.Quantile < 0 || w.Quantile >= 0.5 {
+		return errors.Reason("quantile=%g must be in (0..0.5)", w.Quantile)
+	}
+	if w.MADs < 0 {
+		return errors.Reason("MADs=%g must be > 0", w.MADs)
+	}
 	return nil
 }
 
 // DeriveAlpha configures parameters for finding the alpha parameter for a
 // Student's T distribution that fits best the data.
+//
+// The "distance" method minimizes the max log-distance between the histogram
+// buckets and the p.d.f. for the given mean and MAD. The "mle" method instead
+// estimates alpha, mean and MAD jointly by maximizing the likelihood of the
+// samples, and also yields their standard errors. The raw samples are fitted
+// when the distribution retains them. For the streamed log-profits of the
+// "distribution" experiment, a uniform random sample of 100,000 of them is
+// retained and fitted, with the standard errors reflecting the sample size.
+// Other histograms accumulated incrementally are fitted over their bucket
+// means as a binning approximation, with the standard errors based on the
+// sample counts rather than weights.
 type DeriveAlpha struct {
 	MinX          float64 `json:"min x" required:"true"`
 	MaxX          float64 `json:"max x" required:"true"`
 	Epsilon       float64 `json:"epsilon" default:"0.01"` // min size of the search interval
 	MaxIterations int     `json:"max iterations" default:"1000"`
 	IgnoreCounts  int     `json:"ignore counts" default:"10"`
+	FitMethod     string  `json:"fit method" choices:"distance,mle" default:"distance"`
+	// Plot the fit objective as a function of alpha over [MinX..MaxX] in this
+	// graph, to see how sharp the fit is: the distance for "distance", and the
+	// mean log-likelihood for "mle" at the fitted mean and MAD.
+	ScanGraph  string `json:"scan graph"`
+	ScanPoints int    `json:"scan points" default:"100"` // >= 2
+	// Additionally fit alpha separately to the left and the right tails, that
+	// is, the samples below and above the mean.
+	SeparateTails bool `json:"separate tails"`
 }
 
 var _ message.Message = &DeriveAlpha{}
@@ -311,16 +779,31 @@ func (f *DeriveAlpha) InitMessage(js any) error {
 	if f.MaxIterations < 1 {
 		return errors.Reason("max iterations = %d must be >= 1", f.MaxIterations)
 	}
+	if f.ScanPoints < 2 {
+		return errors.Reason("scan points = %d must be >= 2", f.ScanPoints)
+	}
 	if f.IgnoreCounts < 0 {
 		return errors.Reason("ignore counts = %d must be >= 0", f.IgnoreCounts)
 	}
 	return nil
 }
 
+// normalizeBy resolves the "normalize" flag and the optional "normalize by"
+// units into a consistent pair.
+func normalizeBy(normalize bool, by string) (bool, string) {
+	if by == "" {
+		if normalize {
+			return true, "MAD"
+		}
+		return false, "none"
+	}
+	return by != "none", by
+}
+
 // DistributionPlot is a config for plotting a given distribution's histogram,
 // its statistics, and its approximation by an analytical distribution.
 type DistributionPlot struct {
-	// At least one of Graph or CountsGraph must be present.
+	// At least one of Graph, CountsGraph or HistogramFile must be present.
 	Graph          string                `json:"graph"`        // plot distribution
 	CountsGraph    string                `json:"counts graph"` // plot buckets' counts
 	ErrorsGraph    string                `json:"errors graph"` // plot bucket's standard errors
@@ -334,6 +817,9 @@ type DistributionPlot struct {
 	CountsLeftAxis bool                  `json:"counts left axis"`
 	ErrorsLeftAxis bool                  `json:"errors left axis"`
 	RefDist        *CompoundDistribution `json:"reference distribution"`
+	// Additional reference distributions to overlay in the same Graph, each with
+	// its own legend. They are adjusted and fitted the same way as RefDist.
+	RefDists []*ReferenceDistribution `json:"reference distributions"`
 	// When RefDist is an uncompounded (N=1) analytical distribution, its mean and
 	// MAD will be automatically adjusted when AdjustRef is true.
 	AdjustRef bool `json:"adjust reference distribution"`
@@ -342,6 +828,46 @@ type DistributionPlot struct {
 	DeriveAlpha *DeriveAlpha `json:"derive alpha"`
 	PlotMean    bool         `json:"plot mean"`
 	Percentiles []float64    `json:"percentiles"` // in [0..100]
+	// Normalization units, overriding Normalize when set: "MAD" or "sigma" to
+	// normalize to mean=0 and MAD=1 or sigma=1, the robust "IQR" or "Qn" to
+	// normalize to mean=0 and the respective scale 1, or "none" to disable.
+	// After InitMessage, it is always set, and Normalize is true unless it's
+	// "none".
+	NormalizeBy string `json:"normalize by" choices:",MAD,sigma,IQR,Qn,none"`
+	// Append summary statistics of the distribution as a row to this CSV file,
+	// typically one file per graph.
+	SummaryCSV string `json:"summary CSV"`
+	// Fit a Generalized Pareto distribution to the tail of the histogram.
+	GPD *GPDFit `json:"GPD"`
+	// Confidence levels in (0..100), e.g. [95, 99], for the Value-at-Risk and
+	// the Expected Shortfall of the left tail, in the units of the samples: VaR
+	// is the (100-level)th percentile, and ES is the mean of the samples below
+	// it. Computed for both the sample and the reference distributions.
+	VaRLevels []float64 `json:"VaR levels"`
+	PlotVaR   bool      `json:"plot VaR"` // draw VaR verticals in Graph
+	// Write the accumulated (unnormalized) histogram to this file in the
+	// HistogramData JSON format, to be reused as a "histogram file" source.
+	HistogramFile string `json:"histogram file"`
+	// Automatic bucket selection for plots of samples, when "auto bounds" is
+	// set. By default, the buckets span the full range of the samples.
+	// "freedman-diaconis" also sets the number of buckets to
+	// range/(2*IQR*n^(-1/3)), clamped to [3..1000], and "quantile" fits the
+	// buckets to the samples in the ["bucket quantile", 1-"bucket quantile"]
+	// range, so the extreme tails collapse into the edge buckets. For a
+	// symmetric log scale, use "symmetric exponential" bucket spacing.
+	//
+	// The "distribution" experiment's "log-profits" histogram is accumulated
+	// from the streamed data, and its buckets are fitted to the first 100,000
+	// (or so) normalized log-profits as they arrive, in the same pass. Other
+	// histograms accumulated incrementally (e.g. "R plot" in "beta") have fixed
+	// buckets, and setting the rule for them is an error.
+	BucketRule     string  `json:"bucket rule" choices:",freedman-diaconis,quantile"`
+	BucketQuantile float64 `json:"bucket quantile"` // in (0..0.5)
+	// Plot a kernel density estimate in Graph.
+	KDE *KDE `json:"KDE"`
+	// When > 0, plot the p.d.f. +- ErrorBands standard errors in Graph as
+	// dashed lines.
+	ErrorBands float64 `json:"error bands"`
 }
 
 var _ message.Message = &DistributionPlot{}
@@ -350,20 +876,107 @@ func (dp *DistributionPlot) InitMessage(js any) error {
 	if err := message.Init(dp, js); err != nil {
 		return errors.Annotate(err, "failed to init DistributionPlot")
 	}
-	if dp.Graph == "" && dp.CountsGraph == "" {
-		return errors.Reason(`expected at least one of "graph" or "counts graph"`)
+	if dp.Graph == "" && dp.CountsGraph == "" && dp.HistogramFile == "" {
+		return errors.Reason(
+			`expected at least one of "graph", "counts graph" or "histogram file"`)
 	}
+	dp.Normalize, dp.NormalizeBy = normalizeBy(dp.Normalize, dp.NormalizeBy)
 	for _, p := range dp.Percentiles {
 		if p < 0.0 || 100.0 < p {
 			return errors.Reason("percentile=%g must be in [0..100]", p)
 		}
 	}
+	for _, l := range dp.VaRLevels {
+		if l <= 0.0 || 100.0 <= l {
+			return errors.Reason("VaR level=%g must be in (0..100)", l)
+		}
+	}
+	if dp.ErrorBands < 0 {
+		return errors.Reason("error bands=%g must be >= 0", dp.ErrorBands)
+	}
+	legends := make(map[string]struct{})
+	for _, r := range dp.RefDists {
+		if _, ok := legends[r.Legend]; ok {
+			return errors.Reason(`duplicate reference legend "%s"`, r.Legend)
+		}
+		legends[r.Legend] = struct{}{}
+	}
+	if dp.BucketRule == "quantile" && (dp.BucketQuantile <= 0 || dp.BucketQuantile >= 0.5) {
+		return errors.Reason("bucket quantile=%g must be in (0..0.5)", dp.BucketQuantile)
+	}
+	return nil
+}
+
+// ReferenceDistribution is a named reference distribution for a
+// DistributionPlot.
+type ReferenceDistribution struct {
+	Legend string                `json:"legend" required:"true"`
+	Dist   *CompoundDistribution `json:"distribution" required:"true"`
+}
+
+var _ message.Message = &ReferenceDistribution{}
+
+func (r *ReferenceDistribution) InitMessage(js any) error {
+	if err := message.Init(r, js); err != nil {
+		return errors.Annotate(err, "failed to init ReferenceDistribution")
+	}
+	if r.Legend == "ref" {
+		return errors.Reason(`legend "ref" is reserved for "reference distribution"`)
+	}
+	return nil
+}
+
+// KDE configures a kernel density estimate of a distribution. It uses the raw
+// samples when available, and the histogram bucket means weighted by their
+// counts otherwise.
+type KDE struct {
+	// Kernel bandwidth in the units of the samples. When 0, it is derived by
+	// Silverman's rule of thumb.
+	Bandwidth float64 `json:"bandwidth"`
+	Kernel    string  `json:"kernel" choices:"gaussian,epanechnikov" default:"gaussian"`
+	// Plot KDE instead of the bucket p.d.f.
+	Replace bool `json:"replace p.d.f."`
+}
+
+var _ message.Message = &KDE{}
+
+func (k *KDE) InitMessage(js any) error {
+	if err := message.Init(k, js); err != nil {
+		return errors.Annotate(err, "failed to init KDE")
+	}
+	if k.Bandwidth < 0 {
+		return errors.Reason("bandwidth=%g must be >= 0", k.Bandwidth)
+	}
+	return nil
+}
+
+// GPDFit configures fitting a Generalized Pareto distribution to the
+// exceedances of a distribution over a threshold (peaks over threshold), and
+// plotting the log10 of the survival function P(X > x) of the tail for the data
+// and the fit. The left tail is mirrored to positive values.
+type GPDFit struct {
+	Graph string `json:"graph" required:"true"`
+	// The threshold as a quantile of the distribution's tail, in (0..1).
+	Quantile float64 `json:"threshold quantile" default:"0.95"`
+	Tail     string  `json:"tail" choices:"right,left" default:"right"`
+}
+
+var _ message.Message = &GPDFit{}
+
+func (g *GPDFit) InitMessage(js any) error {
+	if err := message.Init(g, js); err != nil {
+		return errors.Annotate(err, "failed to init GPDFit")
+	}
+	if g.Quantile <= 0 || g.Quantile >= 1 {
+		return errors.Reason("threshold quantile = %g must be in (0..1)", g.Quantile)
+	}
 	return nil
 }
 
 // Distribution is the experiment config for deriving the distribution of
 // log-profits. By default, it normalizes the log-profits to have 0.0 mean and
-// 1.0 MAD; set "normalize" to false for the original distribution.  When
+// 1.0 MAD; set "normalize" to false for the original distribution, or
+// "normalize by" to "sigma" to normalize to 1.0 standard deviation.  When
 // plotting the reference (analytical) distribution for non-normalized samples,
 // setting "adjust reference distribution" flag sets the mean and MAD of the
 // reference to that of the sample.
@@ -376,6 +989,30 @@ type Distribution struct {
 	// mean[subrange] / mean[overall]. Same for MAD.
 	MeanStability *StabilityPlot `json:"mean stability"`
 	MADStability  *StabilityPlot `json:"MAD stability"`
+	// Same as MADs and MAD stability for the robust scale estimators: the
+	// inter-quartile range and the Rousseeuw-Croux Qn.
+	IQRs         *DistributionPlot `json:"IQRs"`
+	Qns          *DistributionPlot `json:"Qns"`
+	IQRStability *StabilityPlot    `json:"IQR stability"`
+	QnStability  *StabilityPlot    `json:"Qn stability"`
+	Tails        *TailIndex        `json:"tails"`
+	// Accumulate a separate log-profit histogram for each calendar period, and
+	// plot each one as a separate "log-profits" distribution.
+	SplitBy string `json:"split by" choices:"none,year,month" default:"none"`
+	// Partition tickers by their DB metadata or by the decile of their average
+	// daily cash volume (requires monthly data in the DB), and plot a separate
+	// "log-profits" distribution for each group. Combines with SplitBy.
+	// "activity" splits tickers into "active" (still listed at the end of the
+	// DB) and "delisted" ones, to quantify survivorship bias.
+	GroupBy string `json:"group by" choices:"none,sector,industry,exchange,volume decile,activity" default:"none"`
+	// Weight each ticker's samples in the "log-profits" histograms by its
+	// average daily cash volume (requires monthly data in the DB).
+	Weight string `json:"weight" choices:"none,volume" default:"none"`
+	// Skip tickers with the average daily cash volume below this value
+	// (requires monthly data in the DB).
+	MinVolume float64 `json:"min volume"`
+	// When > 0, use at most this many of the latest samples of each ticker.
+	MaxSamples int `json:"max samples"`
 }
 
 var _ ExperimentConfig = &Distribution{}
@@ -384,18 +1021,71 @@ func (e *Distribution) InitMessage(js any) error {
 	if err := message.Init(e, js); err != nil {
 		return errors.Annotate(err, "failed to init Distribution")
 	}
+	if e.SplitBy != "none" && e.LogProfits == nil {
+		return errors.Reason(`"split by" requires "log-profits"`)
+	}
+	if (e.Weight != "none" || e.MinVolume > 0) && e.Data.DB == nil {
+		return errors.Reason(`"weight" and "min volume" require "DB" data`)
+	}
+	if e.MaxSamples < 0 {
+		return errors.Reason(`"max samples"=%d must be >= 0`, e.MaxSamples)
+	}
+	if e.GroupBy != "none" {
+		if e.LogProfits == nil {
+			return errors.Reason(`"group by" requires "log-profits"`)
+		}
+		if e.Data.DB == nil {
+			return errors.Reason(`"group by" requires "DB" data`)
+		}
+	}
 	return nil
 }
 
 func (e *Distribution) experiment()  {}
 func (e *Distribution) Name() string { return "distribution" }
 
+// TailIndex configures the Hill estimator of the tail index alpha for the left
+// (negative) and the right (positive) tails of log-profits.
+type TailIndex struct {
+	// Hill plot: alpha as a function of k, the number of order statistics.
+	Graph string `json:"graph"`
+	// The number of the largest order statistics to keep for each tail.
+	MaxK int `json:"max k" default:"1000"`
+	// The number of order statistics for the estimate in Values. Default:
+	// sqrt(n) for n samples in the tail, but at most max k.
+	K int `json:"k"`
+	// Normalize each ticker's log-profits to mean=0, MAD=1.
+	Normalize bool `json:"normalize"`
+	// Same as in DistributionPlot.
+	NormalizeBy string `json:"normalize by" choices:",MAD,sigma,IQR,Qn,none"`
+}
+
+var _ message.Message = &TailIndex{}
+
+func (t *TailIndex) InitMessage(js any) error {
+	if err := message.Init(t, js); err != nil {
+		return errors.Annotate(err, "failed to init TailIndex")
+	}
+	t.Normalize, t.NormalizeBy = normalizeBy(t.Normalize, t.NormalizeBy)
+	if t.MaxK < 2 {
+		return errors.Reason("max k = %d must be >= 2", t.MaxK)
+	}
+	if t.K < 0 || t.K > t.MaxK {
+		return errors.Reason("k = %d must be in [0..%d]", t.K, t.MaxK)
+	}
+	return nil
+}
+
 // CumulativeStatistic is a statistic that accumulates over the number of
 // samples, like a mean or a MAD.  This configures a plot showing how such
 // accumulation behaves as the number of samples grow.  The plotted number of
 // Points are logarithmically spread out for each multiple of Samlpes. By
 // default, the first 10K samples are plotted with 200 points, 100M samples
 // (10K^2) - with 400 points, and so on.
+//
+// With Runs > 1, the statistic is accumulated over that many independent sample
+// streams, and the plot shows the median trajectory with the Percentiles as the
+// envelopes across the runs, rather than the percentiles within a single run.
 type CumulativeStatistic struct {
 	Graph   string `json:"graph" required:"true"`
 	Samples int    `json:"samples" default:"10000"` // >= 3
@@ -405,6 +1095,10 @@ type CumulativeStatistic struct {
 	Percentiles  []float64     `json:"percentiles"` // in [0..100]
 	Buckets      stats.Buckets `json:"buckets"`     // for estimating percentiles
 	PlotExpected bool          `json:"plot expected"`
+	// Plot log10|error| of the statistic vs. log10 of the number of samples
+	// and its linear fit, whose slope is the apparent convergence rate.
+	ConvergenceGraph string `json:"convergence graph"`
+	Runs             int    `json:"runs" default:"1"` // >= 1
 }
 
 var _ message.Message = &CumulativeStatistic{}
@@ -419,6 +1113,9 @@ func (c *CumulativeStatistic) InitMessage(js any) error {
 	if c.Points < 3 {
 		return errors.Reason("points=%d must be >= 3", c.Points)
 	}
+	if c.Runs < 1 {
+		return errors.Reason("runs=%d must be >= 1", c.Runs)
+	}
 	for _, p := range c.Percentiles {
 		if p < 0.0 || 100.0 < p {
 			return errors.Reason("percentile=%g must be in [0..100]", p)
@@ -427,6 +1124,25 @@ func (c *CumulativeStatistic) InitMessage(js any) error {
 	return nil
 }
 
+// QuantileDistribution configures the distribution plot of a sample quantile
+// statistic.
+type QuantileDistribution struct {
+	Percentile float64           `json:"percentile" required:"true"` // in (0..100)
+	Plot       *DistributionPlot `json:"plot" required:"true"`
+}
+
+var _ message.Message = &QuantileDistribution{}
+
+func (q *QuantileDistribution) InitMessage(js any) error {
+	if err := message.Init(q, js); err != nil {
+		return errors.Annotate(err, "failed to init QuantileDistribution")
+	}
+	if q.Percentile <= 0 || q.Percentile >= 100 {
+		return errors.Reason("percentile=%g must be in (0..100)", q.Percentile)
+	}
+	return nil
+}
+
 type PowerDist struct {
 	ID         string               `json:"id"` // experiment ID, for multiple instances
 	Dist       CompoundDistribution `json:"distribution"`
@@ -448,6 +1164,10 @@ type PowerDist struct {
 	MADDist   *DistributionPlot `json:"MAD distribution"`
 	SigmaDist *DistributionPlot `json:"sigma distribution"`
 	AlphaDist *DistributionPlot `json:"alpha distribution"`
+	// Quantile statistics, which unlike the moments remain well-behaved for
+	// fat-tailed distributions.
+	MedianDist    *DistributionPlot       `json:"median distribution"`
+	QuantileDists []*QuantileDistribution `json:"quantile distributions"`
 	// Default: alpha \in [1.01..100], e=0.01, max. iter=1000, ignore counts=10.
 	AlphaParams *DeriveAlpha `json:"alpha params"`
 	StatSamples int          `json:"statistic samples" default:"10000"` // >= 3
@@ -472,6 +1192,8 @@ func (e *PowerDist) InitMessage(js any) error {
 			Epsilon:       0.01,
 			MaxIterations: 1000,
 			IgnoreCounts:  10,
+			FitMethod:     "distance",
+			ScanPoints:    100,
 		}
 	}
 	return nil
@@ -483,12 +1205,20 @@ func (e *PowerDist) Name() string { return "power distribution" }
 // PortfolioPosition is a single position in a portfolio: a certain number of
 // split-adjusted shares of a particular ticker purchased at a certain total
 // price (cost basis) on a given date.
+//
+// A negative number of shares is a sale of the previously purchased shares on
+// the "purchase date", in which case the cost basis is the total proceeds of the
+// sale. Sales are matched against the purchased lots of the same ticker
+// according to the portfolio's "lot matching" method.
 type PortfolioPosition struct {
 	Ticker string `json:"ticker" required:"true"`
-	Shares int    `json:"shares" required:"true"` // number of shares owned, >= 0
+	Shares int    `json:"shares" required:"true"` // number of shares owned or sold
 	// Total cost of purchase; default is closing price at purchase date * shares.
 	CostBasis    float64 `json:"cost basis"` // >= 0
 	PurchaseDate db.Date `json:"purchase date" required:"true"`
+	// Lot identifies a purchase, or the purchase a sale is matched against for
+	// the "specific" lot matching.
+	Lot string `json:"lot"`
 }
 
 var _ message.Message = &PortfolioPosition{}
@@ -497,9 +1227,6 @@ func (e *PortfolioPosition) InitMessage(js any) error {
 	if err := message.Init(e, js); err != nil {
 		return errors.Annotate(err, "failed to init PortfolioPosition")
 	}
-	if e.Shares < 0 {
-		return errors.Reason("shares=%d must be >= 0", e.Shares)
-	}
 	if e.CostBasis < 0 {
 		return errors.Reason("cost basis=%g must be >= 0", e.CostBasis)
 	}
@@ -507,8 +1234,19 @@ func (e *PortfolioPosition) InitMessage(js any) error {
 }
 
 // PortfolioColumn defines the data for a single output table column.
+//
+// The "gain" (value - cost basis), "gain %", "annualized return" (in percent)
+// and "weight" (percent of the total portfolio value) columns are computed on
+// the given date, or on the latest available date for each ticker when the
+// date is not set. Similarly, "latest price" is the price on the latest date.
+//
+// Rows are the purchased lots, and the value is computed for the shares of the
+// lot still held on the date, net of sales. "open shares" are the shares
+// remaining after all the sales, "realized gain" is the P&L of the shares sold
+// from the lot by the date, "unrealized gain" is the P&L of the shares held on
+// the date, and "gain" is their sum.
 type PortfolioColumn struct {
-	Kind string  `json:"kind" required:"true" choices:"ticker,name,exchange,category,sector,industry,purchase date,cost basis,shares,price,value"`
+	Kind string  `json:"kind" required:"true" choices:"ticker,name,exchange,category,sector,industry,purchase date,cost basis,shares,price,value,latest price,gain,gain %,annualized return,weight,lot,open shares,realized gain,unrealized gain"`
 	Date db.Date `json:"date"` // required for "price" and "value"
 }
 
@@ -537,6 +1275,13 @@ type Portfolio struct {
 	Columns   []PortfolioColumn   `json:"columns"` // default: [{"kind": "ticker"}]
 	// CSV output file; empty string == text on stdout.
 	File string `json:"file"`
+	// Plot the mark-to-market value of the positions over time. Each position
+	// enters the series on its purchase date.
+	ValueGraph string `json:"value graph"`
+	// How sales are matched against the purchased lots of the same ticker: the
+	// earliest purchase first, the latest purchase first, or the purchase with
+	// the same "lot" as the sale.
+	LotMatching string `json:"lot matching" choices:"FIFO,LIFO,specific" default:"FIFO"`
 }
 
 var _ ExperimentConfig = &Portfolio{}
@@ -548,6 +1293,23 @@ func (e *Portfolio) InitMessage(js any) error {
 	if len(e.Columns) == 0 {
 		e.Columns = []PortfolioColumn{{Kind: "ticker"}}
 	}
+	if e.LotMatching == "specific" {
+		lots := make(map[string]bool)
+		for _, pos := range e.Positions {
+			if pos.Lot == "" {
+				return errors.Reason(
+					"lot is required for specific lot matching: %s on %s",
+					pos.Ticker, pos.PurchaseDate)
+			}
+			key := pos.Ticker + " " + pos.Lot
+			if pos.Shares >= 0 {
+				if lots[key] {
+					return errors.Reason("duplicate lot '%s' for %s", pos.Lot, pos.Ticker)
+				}
+				lots[key] = true
+			}
+		}
+	}
 	return nil
 }
 
@@ -560,6 +1322,10 @@ type AutoCorrelation struct {
 	Data     *Source `json:"data" required:"true"`
 	Graph    string  `json:"graph" required:"true"` // plot correlation vs. shift
 	MaxShift int     `json:"max shift" default:"5"` // shift range [1..max]
+	// Optional graph for the partial auto-correlation; may be the same as Graph.
+	PACFGraph string `json:"PACF graph"`
+	// Add Ljung-Box Q statistics and their p-values for each shift.
+	LjungBox bool `json:"Ljung-Box"`
 }
 
 var _ ExperimentConfig = &AutoCorrelation{}
@@ -580,12 +1346,27 @@ func (e *AutoCorrelation) Name() string { return "auto-correlation" }
 // Beta experiment studies cross-correlation between stocks and/or an index.
 type Beta struct {
 	ID string `json:"id"` // experiment ID, for multiple instances
-	// Reference is expected to produce exactly one price series.
+	// Reference produces one or more price series. With several references,
+	// plots and values are generated for each one separately, and the CSV
+	// file has a set of columns per reference.
 	Reference *Source `json:"reference" required:"true"`
 	// Data reads real prices from DB, or generates R sequences.
 	Data *Source `json:"data" required:"true"`
-	// Model P = beta * Ref + R for synthetic price series.
+	// Model P = beta * Ref + R for synthetic price series, where Ref is the
+	// first reference series in the order of tickers.
 	Beta float64 `json:"beta" default:"1.0"`
+	// Estimator of beta (and alpha) of each stock:
+	//
+	// - ols: ordinary least squares;
+	// - huber: Huber robust regression, less sensitive to outliers;
+	// - theil-sen: median of pairwise slopes, robust but O(n^2) in the series
+	//   length;
+	// - vasicek: OLS beta shrunk toward 1 according to its standard error and
+	//   the "prior sigma";
+	// - blume: 1/3 + 2/3 * OLS beta.
+	Estimator string `json:"estimator" choices:"ols,huber,theil-sen,vasicek,blume" default:"ols"`
+	// Standard deviation of the prior beta for the "vasicek" estimator.
+	PriorSigma float64 `json:"prior sigma" default:"0.5"`
 
 	// CSV dump with info about each stock's beta and R parameters. When set to
 	// "-", print the table to stdout.
@@ -600,10 +1381,29 @@ type Beta struct {
 	// When >0, sample this many random pairs to compute
 	// cross-correlation. Enumerate all the pairs when 0.
 	RCorrSamples int `json:"R correlations samples"`
+	// When >0, keep at most this many randomly chosen R series for the
+	// cross-correlations, which bounds the memory for large universes. All the
+	// series are kept when 0.
+	RCorrTickers int `json:"R correlations tickers"`
+	// The type of correlation used for R cross-correlations and for the
+	// correlation with the reference (and hence R^2). Rank correlations are
+	// more robust to outliers in fat-tailed R; "kendall" takes O(n^2) time in
+	// the length of the series.
+	CorrelationType string `json:"correlation type" choices:"pearson,spearman,kendall" default:"pearson"`
 	// Distribution of lengths of correlation log-profit sequences.
 	LengthsPlot *DistributionPlot `json:"lengths plot"`
 	// Histogram of beta[t-shift]/beta[t].
 	BetaRatios *StabilityPlot `json:"beta ratios"`
+	// Distribution of alphas, the intercepts of the P = alpha + beta*Ref + R
+	// regression.
+	AlphaPlot *DistributionPlot `json:"alpha plot"`
+	// Additionally split tickers into "active" (still listed at the end of the
+	// DB) and "delisted" ones, and generate all the plots and values for each
+	// group separately, to quantify survivorship bias. Requires DB data.
+	Survivorship bool `json:"survivorship"`
+	// Distribution of R^2 of the regression, the share of variance in P
+	// explained by the reference.
+	R2Plot *DistributionPlot `json:"R2 plot"`
 }
 
 var _ ExperimentConfig = &Beta{}
@@ -616,12 +1416,92 @@ func (e *Beta) InitMessage(js any) error {
 		return errors.Reason(`"R correlations samples"=%d must be >= 0`,
 			e.RCorrSamples)
 	}
+	if e.RCorrTickers < 0 {
+		return errors.Reason(`"R correlations tickers"=%d must be >= 0`,
+			e.RCorrTickers)
+	}
+	if e.PriorSigma <= 0 {
+		return errors.Reason(`"prior sigma"=%f must be > 0`, e.PriorSigma)
+	}
+	if e.Survivorship && e.Data.DB == nil {
+		return errors.Reason(`"survivorship" requires "DB" data`)
+	}
 	return nil
 }
 
 func (e *Beta) experiment()  {}
 func (e *Beta) Name() string { return "beta" }
 
+// Hedge experiment hedges each stock with beta units of the first reference
+// series, that is, the hedged daily log-profit is P - beta*Ref, and compares
+// the risk of the hedged and unhedged positions. The reference, data and the
+// beta estimator are configured the same way as in the Beta experiment; its
+// plots are ignored.
+type Hedge struct {
+	ID   string `json:"id"` // experiment ID, for multiple instances
+	Beta *Beta  `json:"beta" required:"true"`
+	// When > 0, hedge each day with beta estimated on this many preceding
+	// days, that is, out of sample. Otherwise, use beta of the entire series.
+	Window int `json:"window"`
+	// Distributions of daily log-profits and of per-ticker max. drawdowns, each
+	// plotted for both the unhedged and the hedged positions.
+	ReturnsPlot   *DistributionPlot `json:"returns plot"`
+	DrawdownsPlot *DistributionPlot `json:"drawdowns plot"`
+}
+
+var _ ExperimentConfig = &Hedge{}
+
+func (e *Hedge) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Hedge")
+	}
+	if e.Window < 0 {
+		return errors.Reason("window = %d must be >= 0", e.Window)
+	}
+	if e.ReturnsPlot == nil && e.DrawdownsPlot == nil {
+		return errors.Reason(`at least one of "returns plot" or "drawdowns plot" must be set`)
+	}
+	return nil
+}
+
+func (e *Hedge) experiment()  {}
+func (e *Hedge) Name() string { return "hedge" }
+
+// GapAnalysis studies overnight gaps, that is, log-profits of open relative to
+// the previous close, conditioned on the previous day's close-to-close
+// log-profit.
+type GapAnalysis struct {
+	// Plot the gap distribution for each range of the previous day's
+	// log-profit.
+	Plot *DistributionPlot `json:"plot"`
+	// Sorted previous day's log-profit boundaries splitting the gaps into
+	// len(Thresholds)+1 ranges. Default: [0], that is, by the sign.
+	Thresholds []float64 `json:"thresholds"`
+	// Scatter plot of the gap vs. the same day's close/open log-profit.
+	Scatter *ScatterPlot `json:"scatter"`
+}
+
+var _ message.Message = &GapAnalysis{}
+
+func (g *GapAnalysis) InitMessage(js any) error {
+	if err := message.Init(g, js); err != nil {
+		return errors.Annotate(err, "failed to init GapAnalysis")
+	}
+	if g.Plot == nil && g.Scatter == nil {
+		return errors.Reason(`at least one of "plot" or "scatter" must be set`)
+	}
+	if len(g.Thresholds) == 0 {
+		g.Thresholds = []float64{0}
+	}
+	for i := 1; i < len(g.Thresholds); i++ {
+		if g.Thresholds[i-1] >= g.Thresholds[i] {
+			return errors.Reason("thresholds must be strictly increasing: %v",
+				g.Thresholds)
+		}
+	}
+	return nil
+}
+
 // Trading experiment studies possibilities of exploiting volatility without the
 // need to predict the future.
 type Trading struct {
@@ -637,6 +1517,7 @@ type Trading struct {
 	HighPlot  *DistributionPlot `json:"high plot"`
 	LowPlot   *DistributionPlot `json:"low plot"`
 	ClosePlot *DistributionPlot `json:"close plot"` // classical daily log-profits
+	Gaps      *GapAnalysis      `json:"gaps"`
 }
 
 var _ ExperimentConfig = &Trading{}
@@ -651,27 +1532,627 @@ func (e *Trading) InitMessage(js any) error {
 func (e *Trading) experiment()  {}
 func (e *Trading) Name() string { return "trading" }
 
-// StrategyConfig is a custom configuration for a strategy.
-type StrategyConfig interface {
-	message.Message
-	strategy() // no-op method to prevent instances outside this package
-	Name() string
+// Extremes experiment studies waiting times between extreme events, that is,
+// the number of samples between consecutive log-profits with |log-profit| >
+// k*MAD. If the events were independent (Poisson), the waiting times would be
+// distributed exponentially.
+type Extremes struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// The value of k in |log-profit| > k*MAD; must be > 0.
+	Threshold float64 `json:"threshold" default:"3"`
+	// When > 0, use MAD of this many preceding samples rather than the MAD of
+	// the entire series. This separates clustering of extremes from volatility
+	// clustering.
+	VolatilityWindow int `json:"volatility window"`
+	// Skip tickers with fewer events.
+	MinEvents int `json:"min events" default:"3"`
+	// Divide each ticker's waiting times by their mean, so the waiting times of
+	// tickers with different event rates can be pooled together.
+	NormalizeWaits bool `json:"normalize waits" default:"true"`
+	// Pooled distribution of waiting times. For comparison with the Poisson
+	// model, use an exponential reference distribution.
+	WaitsPlot *DistributionPlot `json:"waiting times"`
+	// Distribution of per-ticker coefficients of variation sigma/mean of the
+	// waiting times, which is 1 for the exponential distribution. Values above 1
+	// indicate clustering.
+	VariationPlot *DistributionPlot `json:"variation plot"`
 }
 
-// IntradaySell condition. Exactly one condition must be specified.
-type IntradaySell struct {
-	// Sell at market on or after this time.
-	Time *db.TimeOfDay `json:"time"`
-	// When > 1, sell at or above price*target.
-	Target    float64 `json:"target"`
-	logTarget float64
-	// When > 0 (and must be < 1), sell at market when the price drops <=price*X.
-	StopLoss    float64 `json:"stop loss"`
-	logStopLoss float64
-	// When > 0 (and must be < 1), sell at market when the price drops
-	// <=maxPrice*X where maxPrice is observed while holding the position.
-	StopLossTrailing    float64 `json:"stop loss trailing"`
-	logStopLossTrailing float64
+var _ ExperimentConfig = &Extremes{}
+
+func (e *Extremes) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Extremes")
+	}
+	if e.Threshold <= 0 {
+		return errors.Reason("threshold=%g must be > 0", e.Threshold)
+	}
+	if e.VolatilityWindow < 0 {
+		return errors.Reason("volatility window=%d must be >= 0", e.VolatilityWindow)
+	}
+	if e.MinEvents < 2 {
+		return errors.Reason("min events=%d must be >= 2", e.MinEvents)
+	}
+	return nil
+}
+
+func (e *Extremes) experiment()  {}
+func (e *Extremes) Name() string { return "extremes" }
+
+// Crash experiment studies cumulative log-profits over several horizons
+// following a large single-day drop, compared to the unconditional
+// cumulative log-profits over the same horizons.
+type Crash struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// The drop is a log-profit <= -threshold; must be > 0.
+	Threshold float64 `json:"threshold" default:"0.1"`
+	// Threshold is in units of the ticker's MAD rather than a log-profit.
+	MADThreshold bool `json:"MAD threshold"`
+	// Number of days after the drop; default: [1, 5, 20].
+	Horizons []int `json:"horizons"`
+	// Distributions of cumulative log-profits for each horizon, after the drop
+	// and over all days, respectively.
+	ConditionalPlot   *DistributionPlot `json:"conditional plot"`
+	UnconditionalPlot *DistributionPlot `json:"unconditional plot"`
+	// Plot conditional mean cumulative log-profits vs. horizon, with bootstrap
+	// confidence bounds, and the unconditional means.
+	MeansGraph       string  `json:"means graph"`
+	BootstrapSamples int     `json:"bootstrap samples" default:"1000"`
+	Confidence       float64 `json:"confidence" default:"95"` // in (0..100)
+}
+
+var _ ExperimentConfig = &Crash{}
+
+func (e *Crash) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Crash")
+	}
+	if e.Threshold <= 0 {
+		return errors.Reason("threshold=%g must be > 0", e.Threshold)
+	}
+	if len(e.Horizons) == 0 {
+		e.Horizons = []int{1, 5, 20}
+	}
+	for _, h := range e.Horizons {
+		if h < 1 {
+			return errors.Reason("horizon=%d must be >= 1", h)
+		}
+	}
+	if e.BootstrapSamples < 1 {
+		return errors.Reason("bootstrap samples=%d must be >= 1", e.BootstrapSamples)
+	}
+	if e.Confidence <= 0 || e.Confidence >= 100 {
+		return errors.Reason("confidence=%g must be in (0..100)", e.Confidence)
+	}
+	return nil
+}
+
+func (e *Crash) experiment()  {}
+func (e *Crash) Name() string { return "crash" }
+
+// Deciles experiment ranks tickers at the start of each month by a trailing
+// per-ticker statistic, splits them into equal groups (deciles by default), and
+// studies the next month's log-profits of each group.
+type Deciles struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Required for "beta" and "alpha" statistics; must yield exactly one series.
+	Reference *Source `json:"reference"`
+	// Trailing statistic: MAD, momentum (sum of log-profits), beta or alpha (mean
+	// daily residual log-profit) relative to the reference.
+	Statistic string `json:"statistic" default:"momentum" choices:"MAD,momentum,beta,alpha"`
+	Window    int    `json:"window" default:"250"` // trailing days, >= 2
+	Groups    int    `json:"groups" default:"10"`  // number of portfolios, >= 2
+	// Skip the month when fewer tickers are available; must be >= groups.
+	MinTickers int `json:"min tickers" default:"10"`
+	// Plot mean monthly log-profit of each group with bootstrap confidence
+	// bounds.
+	DecilesGraph string `json:"deciles graph"`
+	// Plot cumulative log-profit of the top minus the bottom group.
+	LongShortGraph   string  `json:"long-short graph"`
+	BootstrapSamples int     `json:"bootstrap samples" default:"1000"`
+	Confidence       float64 `json:"confidence" default:"95"` // in (0..100)
+	// Realism metrics of the long-short holdings. Dollar volume and capacity are
+	// only available with "DB" data.
+	VolumeWindow  int     `json:"volume window" default:"21"`   // days to average dollar volume
+	Participation float64 `json:"participation" default:"0.01"` // max fraction of daily volume
+	// Monthly fraction of holdings replaced in the top and bottom groups.
+	TurnoverPlot *DistributionPlot `json:"turnover plot"`
+	// Average daily dollar volume of the held tickers.
+	VolumePlot *DistributionPlot `json:"volume plot"`
+	// Monthly capacity: the portfolio size which can be entered in a single day
+	// without exceeding the participation limit in any holding.
+	CapacityPlot *DistributionPlot `json:"capacity plot"`
+}
+
+var _ ExperimentConfig = &Deciles{}
+
+func (e *Deciles) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Deciles")
+	}
+	if (e.Statistic == "beta" || e.Statistic == "alpha") && e.Reference == nil {
+		return errors.Reason(`statistic "%s" requires "reference"`, e.Statistic)
+	}
+	if e.Window < 2 {
+		return errors.Reason("window=%d must be >= 2", e.Window)
+	}
+	if e.Groups < 2 {
+		return errors.Reason("groups=%d must be >= 2", e.Groups)
+	}
+	if e.MinTickers < e.Groups {
+		return errors.Reason("min tickers=%d must be >= groups=%d",
+			e.MinTickers, e.Groups)
+	}
+	if e.VolumeWindow < 1 {
+		return errors.Reason("volume window=%d must be >= 1", e.VolumeWindow)
+	}
+	if e.Participation <= 0 || e.Participation > 1 {
+		return errors.Reason("participation=%g must be in (0..1]", e.Participation)
+	}
+	if e.BootstrapSamples < 1 {
+		return errors.Reason("bootstrap samples=%d must be >= 1", e.BootstrapSamples)
+	}
+	if e.Confidence <= 0 || e.Confidence >= 100 {
+		return errors.Reason("confidence=%g must be in (0..100)", e.Confidence)
+	}
+	return nil
+}
+
+func (e *Deciles) experiment()  {}
+func (e *Deciles) Name() string { return "deciles" }
+
+// Compounding experiment compares realized overlapping n-day log-profits with
+// the reference daily distribution compounded n times, for several horizons n.
+type Compounding struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Daily reference distribution; it is compounded N*horizon times. Note, that
+	// the compounding parameters must accommodate the longest horizon.
+	Reference *CompoundDistribution `json:"reference distribution" required:"true"`
+	Horizons  []int                 `json:"horizons"` // default: [1, 5, 20, 60]
+	// Buckets for the realized distributions, also used in the plots.
+	Buckets stats.Buckets `json:"buckets"`
+	// Realized distributions; the reference distribution is set automatically,
+	// and normalization is not supported.
+	Plot    *DistributionPlot `json:"plot"`
+	KSGraph string            `json:"KS graph"` // KS distance vs. horizon
+}
+
+var _ ExperimentConfig = &Compounding{}
+
+func (e *Compounding) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Compounding")
+	}
+	if len(e.Horizons) == 0 {
+		e.Horizons = []int{1, 5, 20, 60}
+	}
+	for _, h := range e.Horizons {
+		if h < 1 {
+			return errors.Reason("horizon=%d must be >= 1", h)
+		}
+	}
+	if e.Plot != nil && e.Plot.Normalize {
+		return errors.Reason(`"normalize" is not supported in "plot"`)
+	}
+	return nil
+}
+
+func (e *Compounding) experiment()  {}
+func (e *Compounding) Name() string { return "compounding" }
+
+// Pair experiment studies rolling correlation and beta of Y relative to X,
+// where each source is expected to produce exactly one price series.
+type Pair struct {
+	ID     string  `json:"id"` // experiment ID, for multiple instances
+	X      *Source `json:"x" required:"true"`
+	Y      *Source `json:"y" required:"true"`
+	Window int     `json:"window" default:"60"` // rolling window in days, >= 3
+	// Rolling correlation and beta as timeseries.
+	CorrelationGraph string `json:"correlation graph"`
+	BetaGraph        string `json:"beta graph"`
+	// Distributions of the rolling values.
+	CorrelationPlot *DistributionPlot `json:"correlation plot"`
+	BetaPlot        *DistributionPlot `json:"beta plot"`
+}
+
+var _ ExperimentConfig = &Pair{}
+
+func (e *Pair) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Pair")
+	}
+	if e.Window < 3 {
+		return errors.Reason("window=%d must be >= 3", e.Window)
+	}
+	return nil
+}
+
+func (e *Pair) experiment()  {}
+func (e *Pair) Name() string { return "pair" }
+
+// CrossCorrelation experiment plots the correlation of the follower
+// log-profits with the leader's as a function of the lead / lag shift. A
+// positive shift k correlates the follower's P(t) with the leader's P(t-k),
+// that is, the leader leads.
+type CrossCorrelation struct {
+	ID string `json:"id"` // experiment ID, for multiple instances
+	// Leader is expected to produce exactly one series, e.g. an index.
+	Leader   *Source `json:"leader" required:"true"`
+	Follower *Source `json:"follower" required:"true"`
+	Graph    string  `json:"graph" required:"true"` // plot correlation vs. shift
+	MaxShift int     `json:"max shift" default:"5"` // shift range [-max..max]
+	// Pool all the follower tickers into a single correlation per shift, or
+	// plot a separate correlation for each ticker.
+	Mode string `json:"mode" default:"pooled" choices:"pooled,per ticker"`
+}
+
+var _ ExperimentConfig = &CrossCorrelation{}
+
+func (e *CrossCorrelation) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init CrossCorrelation")
+	}
+	if e.MaxShift < 0 {
+		return errors.Reason("max shift = %d must be >= 0", e.MaxShift)
+	}
+	return nil
+}
+
+func (e *CrossCorrelation) experiment()  {}
+func (e *CrossCorrelation) Name() string { return "cross-correlation" }
+
+// EventRule defines events as large single-day log-profits.
+type EventRule struct {
+	// A drop is a log-profit <= -threshold, a jump is a log-profit >= threshold.
+	Kind      string  `json:"kind" default:"drop" choices:"drop,jump"`
+	Threshold float64 `json:"threshold" default:"0.1"` // must be > 0
+	// Threshold is in units of the ticker's MAD rather than a log-profit.
+	MADThreshold bool `json:"MAD threshold"`
+}
+
+var _ message.Message = &EventRule{}
+
+func (e *EventRule) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init EventRule")
+	}
+	if e.Threshold <= 0 {
+		return errors.Reason("threshold=%g must be > 0", e.Threshold)
+	}
+	return nil
+}
+
+// EventStudy experiment aligns log-profits in a window around each event and
+// plots the mean cumulative abnormal return (CAR), that is, the cumulative
+// log-profit in excess of the reference, with bootstrap confidence bounds.
+// Exactly one of EventsFile or Rule must be present.
+type EventStudy struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Reference is expected to produce exactly one series, e.g. an index. When
+	// absent, abnormal returns are the log-profits themselves.
+	Reference *Source `json:"reference"`
+	// CSV file with "ticker" and "date" (YYYY-MM-DD) columns and a header row.
+	// An event on a non-trading day is aligned to the next trading day.
+	EventsFile string     `json:"events file"`
+	Rule       *EventRule `json:"rule"`
+	// The window of trading days around the event day, [-before..after].
+	Before int `json:"before" default:"5"`
+	After  int `json:"after" default:"20"`
+	// Plot mean CAR vs. the day relative to the event.
+	Graph            string  `json:"graph" required:"true"`
+	BootstrapSamples int     `json:"bootstrap samples" default:"1000"`
+	Confidence       float64 `json:"confidence" default:"95"` // in (0..100)
+}
+
+var _ ExperimentConfig = &EventStudy{}
+
+func (e *EventStudy) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init EventStudy")
+	}
+	if (e.EventsFile == "") == (e.Rule == nil) {
+		return errors.Reason(`exactly one of "events file" or "rule" must be set`)
+	}
+	if e.Before < 0 {
+		return errors.Reason("before=%d must be >= 0", e.Before)
+	}
+	if e.After < 0 {
+		return errors.Reason("after=%d must be >= 0", e.After)
+	}
+	if e.BootstrapSamples < 1 {
+		return errors.Reason("bootstrap samples=%d must be >= 1", e.BootstrapSamples)
+	}
+	if e.Confidence <= 0 || e.Confidence >= 100 {
+		return errors.Reason("confidence=%g must be in (0..100)", e.Confidence)
+	}
+	return nil
+}
+
+func (e *EventStudy) experiment()  {}
+func (e *EventStudy) Name() string { return "event study" }
+
+// Seasonality experiment buckets log-profits by a calendar unit of their date
+// and plots the mean and MAD of each bucket, with the mean's standard error
+// bounds, and optionally the distribution of each bucket.
+type Seasonality struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Calendar unit: weekday (Mon..Fri), month (1..12), or day of month (1..31).
+	By string `json:"by" default:"day of week" choices:"day of week,month,day of month"`
+	// Mean per bucket, with the dashed +/- standard error bounds.
+	MeanGraph string `json:"mean graph"`
+	MADGraph  string `json:"MAD graph"` // MAD per bucket
+	// Buckets of the per-bucket histograms, used for estimating MAD and for
+	// plotting Distribution. Note, that the buckets of Distribution are ignored.
+	Buckets      stats.Buckets     `json:"buckets"`
+	Distribution *DistributionPlot `json:"distribution"` // per bucket
+}
+
+var _ ExperimentConfig = &Seasonality{}
+
+func (e *Seasonality) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Seasonality")
+	}
+	if e.MeanGraph == "" && e.MADGraph == "" && e.Distribution == nil {
+		return errors.Reason(
+			`at least one of "mean graph", "MAD graph" or "distribution" must be set`)
+	}
+	return nil
+}
+
+func (e *Seasonality) experiment()  {}
+func (e *Seasonality) Name() string { return "seasonality" }
+
+// Copula experiment studies the tail dependence between pairs of tickers. The
+// log-profits of each pair are transformed to uniform ranks U and V, and the
+// lower and upper tail dependence coefficients are estimated at the quantile q
+// as P[V<=q | U<=q] and P[V>1-q | U>1-q]. For independent tickers both are
+// close to q, and for perfectly comonotonic tickers they are close to 1.
+type Copula struct {
+	ID       string  `json:"id"` // experiment ID, for multiple instances
+	Data     *Source `json:"data" required:"true"`
+	Quantile float64 `json:"quantile" default:"0.05"` // in (0..0.5]
+	// When >0, sample this many random pairs. Enumerate all the pairs when 0.
+	Samples int `json:"samples"`
+	// Skip pairs with fewer common log-profit samples.
+	MinSamples int               `json:"min samples" default:"100"`
+	LowerPlot  *DistributionPlot `json:"lower plot"` // lower tail dependence
+	UpperPlot  *DistributionPlot `json:"upper plot"` // upper tail dependence
+}
+
+var _ ExperimentConfig = &Copula{}
+
+func (e *Copula) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Copula")
+	}
+	if e.Quantile <= 0 || e.Quantile > 0.5 {
+		return errors.Reason("quantile = %f must be in (0..0.5]", e.Quantile)
+	}
+	if e.Samples < 0 {
+		return errors.Reason("samples = %d must be >= 0", e.Samples)
+	}
+	if e.MinSamples < 2 {
+		return errors.Reason("min samples = %d must be >= 2", e.MinSamples)
+	}
+	if e.LowerPlot == nil && e.UpperPlot == nil {
+		return errors.Reason(`at least one of "lower plot" or "upper plot" must be set`)
+	}
+	return nil
+}
+
+func (e *Copula) experiment()  {}
+func (e *Copula) Name() string { return "copula" }
+
+// Options experiment applies a simple option overlay to the price paths of the
+// Data source. The paths are split into consecutive periods of Period days; at
+// the start of each period, a "covered call" sells a call and a "protective
+// put" buys a put with the strike at Moneyness times the current price, priced
+// by Black-Scholes with the annualized standard deviation of the ticker's
+// log-profits (unless Volatility is set). The distribution of the resulting
+// per-period log-profits is plotted against buy-and-hold.
+type Options struct {
+	ID        string  `json:"id"` // experiment ID, for multiple instances
+	Data      *Source `json:"data" required:"true"`
+	Strategy  string  `json:"strategy" choices:"covered call,protective put" default:"covered call"`
+	Moneyness float64 `json:"moneyness" default:"1.0"` // strike / price, > 0
+	Period    int     `json:"period" default:"21"`     // trading days till expiration
+	// Annual risk-free rate, continuously compounded.
+	Rate float64 `json:"rate"`
+	// Annualized volatility for pricing options; 0 = estimate per ticker.
+	Volatility float64           `json:"volatility"`
+	Plot       *DistributionPlot `json:"plot" required:"true"` // per-period log-profits
+}
+
+var _ ExperimentConfig = &Options{}
+
+func (e *Options) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Options")
+	}
+	if e.Moneyness <= 0 {
+		return errors.Reason("moneyness = %f must be > 0", e.Moneyness)
+	}
+	if e.Period < 1 {
+		return errors.Reason("period = %d must be >= 1", e.Period)
+	}
+	if e.Volatility < 0 {
+		return errors.Reason("volatility = %f must be >= 0", e.Volatility)
+	}
+	return nil
+}
+
+func (e *Options) experiment()  {}
+func (e *Options) Name() string { return "options" }
+
+// DataQuality experiment screens the price series of the Data source for
+// suspicious patterns, and lists the flagged tickers with the counts of each
+// pattern in a CSV table. The flagged tickers can then be excluded from other
+// experiments by the DB "exclude tickers" filter.
+type DataQuality struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Minimum length of a run of consecutive days with zero cash volume.
+	ZeroVolumeDays int `json:"zero volume days" default:"5"`
+	// Minimum length of a run of consecutive days with the same closing price.
+	RepeatedDays int `json:"repeated price days" default:"5"`
+	// A single-day move by at least this fraction, down (close/prev <= 1-move)
+	// or equivalently up in log scale (close/prev >= 1/(1-move)), followed by a
+	// reversal of at least half of the move on the next day. In (0..1).
+	Move float64 `json:"move" default:"0.9"`
+	// Minimum number of calendar days between consecutive samples to flag as a
+	// gap in the dates.
+	GapDays int `json:"gap days" default:"10"`
+	// CSV output file; empty string == text on stdout.
+	File string `json:"file"`
+}
+
+var _ ExperimentConfig = &DataQuality{}
+
+func (e *DataQuality) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init DataQuality")
+	}
+	if e.ZeroVolumeDays < 1 {
+		return errors.Reason("zero volume days=%d must be >= 1", e.ZeroVolumeDays)
+	}
+	if e.RepeatedDays < 2 {
+		return errors.Reason("repeated price days=%d must be >= 2", e.RepeatedDays)
+	}
+	if e.Move <= 0 || e.Move >= 1 {
+		return errors.Reason("move=%g must be in (0..1)", e.Move)
+	}
+	if e.GapDays < 1 {
+		return errors.Reason("gap days=%d must be >= 1", e.GapDays)
+	}
+	return nil
+}
+
+func (e *DataQuality) experiment()  {}
+func (e *DataQuality) Name() string { return "data quality" }
+
+// Generate experiment saves the synthetic price series of the Data source into
+// a DB, so that other experiments and apps can read them the same way as real
+// prices. With "intraday distribution", OHLC prices are saved; otherwise, daily
+// closing prices are reconstructed from the log-profits.
+type Generate struct {
+	ID   string  `json:"id"`                   // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"` // must be synthetic
+	// Destination DB; existing price files of the same tickers are overwritten.
+	DBPath string `json:"DB path"` // default: ~/.stockparfait
+	DB     string `json:"DB" required:"true"`
+	// Synthetic tickers are named <prefix>1, <prefix>2, etc.
+	TickerPrefix string `json:"ticker prefix" default:"SYN"`
+}
+
+var _ ExperimentConfig = &Generate{}
+
+func (e *Generate) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Generate")
+	}
+	if e.Data.DB != nil {
+		return errors.Reason(`"data" must be synthetic`)
+	}
+	if e.TickerPrefix == "" {
+		return errors.Reason(`"ticker prefix" must not be empty`)
+	}
+	if e.DBPath == "" {
+		e.DBPath = filepath.Join(os.Getenv("HOME"), ".stockparfait")
+	}
+	return nil
+}
+
+func (e *Generate) experiment()  {}
+func (e *Generate) Name() string { return "generate" }
+
+// Export experiment writes all the log-profit series of the source into
+// Parquet files for external tools, e.g. Python notebooks with pandas or Arrow.
+type Export struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Output Parquet file with "ticker", "date" and "log_profit" columns, or a
+	// directory when partitioned by ticker.
+	Path string `json:"path" required:"true"`
+	// Write a separate <path>/ticker=<ticker>/data.parquet file for each ticker
+	// without the "ticker" column, the Hive partitioning layout understood by
+	// Arrow datasets and pandas.
+	PartitionByTicker bool `json:"partition by ticker"`
+}
+
+var _ ExperimentConfig = &Export{}
+
+func (e *Export) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Export")
+	}
+	if e.Path == "" {
+		return errors.Reason(`"path" must not be empty`)
+	}
+	return nil
+}
+
+func (e *Export) experiment()  {}
+func (e *Export) Name() string { return "log-profits export" }
+
+// Liquidity experiment plots the intraday liquidity curve: the average
+// absolute log-profit of intraday bars and the average share of the daily
+// volume by the time of day. Volume is only available from the DB.
+type Liquidity struct {
+	ID   string  `json:"id"` // experiment ID, for multiple instances
+	Data *Source `json:"data" required:"true"`
+	// Width of the time-of-day buckets in minutes; must be >= 1.
+	Resolution int `json:"resolution" default:"30"`
+	// Include the first log-profit of each day relative to the previous close.
+	IncludeOpen  bool   `json:"include open"`
+	ReturnsGraph string `json:"returns graph"` // mean |log-profit| by bucket
+	VolumeGraph  string `json:"volume graph"`  // mean volume share by bucket
+	// Mean |log-profit| by bucket for each ticker separately.
+	TickersGraph string `json:"tickers graph"`
+}
+
+var _ ExperimentConfig = &Liquidity{}
+
+func (e *Liquidity) InitMessage(js any) error {
+	if err := message.Init(e, js); err != nil {
+		return errors.Annotate(err, "failed to init Liquidity")
+	}
+	if e.Resolution < 1 {
+		return errors.Reason("resolution=%d must be >= 1", e.Resolution)
+	}
+	return nil
+}
+
+func (e *Liquidity) experiment()  {}
+func (e *Liquidity) Name() string { return "liquidity" }
+
+// StrategyConfig is a custom configuration for a strategy.
+type StrategyConfig interface {
+	message.Message
+	strategy() // no-op method to prevent instances outside this package
+	Name() string
+}
+
+// IntradaySell condition. Exactly one condition must be specified.
+type IntradaySell struct {
+	// Sell at market on or after this time.
+	Time *db.TimeOfDay `json:"time"`
+	// When > 1, sell at or above price*target.
+	Target    float64 `json:"target"`
+	logTarget float64
+	// When > 0 (and must be < 1), sell at market when the price drops <=price*X.
+	StopLoss    float64 `json:"stop loss"`
+	logStopLoss float64
+	// When > 0 (and must be < 1), sell at market when the price drops
+	// <=maxPrice*X where maxPrice is observed while holding the position.
+	StopLossTrailing    float64 `json:"stop loss trailing"`
+	logStopLossTrailing float64
 }
 
 func (s *IntradaySell) LogTarget() float64           { return s.logTarget }
@@ -734,6 +2215,38 @@ func (s *BuySellIntradayStrategy) InitMessage(js any) error {
 	return nil
 }
 
+// BuySellOHLCStrategy trades on daily OHLC bars: it buys at the open or the
+// close of a bar and sells when the low touches the stop loss, the high touches
+// the target (checked in this order), or at the close after the maximum number
+// of days. The next buy happens on the bar following the sale.
+type BuySellOHLCStrategy struct {
+	Buy      string  `json:"buy" choices:"open,close" default:"open"`
+	Target   float64 `json:"target"`    // factor > 1; 0 = no target
+	StopLoss float64 `json:"stop loss"` // factor in (0..1); 0 = no stop loss
+	MaxDays  int     `json:"max days" default:"1"`
+}
+
+var _ StrategyConfig = &BuySellOHLCStrategy{}
+
+func (*BuySellOHLCStrategy) strategy()    {}
+func (*BuySellOHLCStrategy) Name() string { return "buy-sell OHLC" }
+
+func (s *BuySellOHLCStrategy) InitMessage(js any) error {
+	if err := message.Init(s, js); err != nil {
+		return errors.Annotate(err, "failed to init BuySellOHLCStrategy")
+	}
+	if s.Target != 0 && s.Target <= 1 {
+		return errors.Reason("target factor = %f must be > 1", s.Target)
+	}
+	if s.StopLoss < 0 || s.StopLoss >= 1 {
+		return errors.Reason("stop loss = %f must be in [0..1)", s.StopLoss)
+	}
+	if s.MaxDays < 1 {
+		return errors.Reason("max days = %d must be >= 1", s.MaxDays)
+	}
+	return nil
+}
+
 // Strategy is a union of all strategy configurations. A specific strategy is
 // specified as a single-element map {"<strategy name>": {<strategy config>}}.
 type Strategy struct {
@@ -751,6 +2264,14 @@ func (s *Strategy) InitMessage(js any) error {
 		switch name { // add specific experiment implementations here
 		case new(BuySellIntradayStrategy).Name():
 			s.Config = new(BuySellIntradayStrategy)
+		case new(BuySellOHLCStrategy).Name():
+			s.Config = new(BuySellOHLCStrategy)
+		case new(PairsStrategy).Name():
+			s.Config = new(PairsStrategy)
+		case new(CrossSectionalMomentumStrategy).Name():
+			s.Config = new(CrossSectionalMomentumStrategy)
+		case new(VolatilityTargetStrategy).Name():
+			s.Config = new(VolatilityTargetStrategy)
 		default:
 			return errors.Reason("unknown strategy %s", name)
 		}
@@ -762,17 +2283,188 @@ func (s *Strategy) InitMessage(js any) error {
 
 func (s *Strategy) Name() string { return s.Config.Name() }
 
+// PairsStrategy trades the spread between two tickers, the difference of their
+// cumulative log-profits, with half of the value in each leg. The spread is
+// normalized to a z-score by its mean and standard deviation over the last
+// Window days. When z rises above Entry, the strategy goes short the first
+// ticker and long the second (and vice versa when z falls below -Entry), and
+// closes the position when |z| drops below Exit.
+type PairsStrategy struct {
+	// Explicit ticker pairs, each a list of exactly 2 tickers. When empty, all
+	// the pairs with the log-profit correlation of at least MinCorrelation are
+	// traded.
+	Pairs          [][]string `json:"pairs"`
+	MinCorrelation float64    `json:"min correlation" default:"0.8"`
+	Window         int        `json:"window" default:"20"` // >= 2
+	Entry          float64    `json:"entry" default:"2.0"` // z-score > Exit
+	Exit           float64    `json:"exit" default:"0.5"`  // z-score >= 0
+	// Distribution of trade log-profits plotted separately for each pair.
+	PairPlot *DistributionPlot `json:"pair plot"`
+}
+
+var _ StrategyConfig = &PairsStrategy{}
+
+func (*PairsStrategy) strategy()    {}
+func (*PairsStrategy) Name() string { return "pairs" }
+
+func (s *PairsStrategy) InitMessage(js any) error {
+	if err := message.Init(s, js); err != nil {
+		return errors.Annotate(err, "failed to init PairsStrategy")
+	}
+	for _, p := range s.Pairs {
+		if len(p) != 2 || p[0] == p[1] {
+			return errors.Reason("pair %v must have 2 distinct tickers", p)
+		}
+	}
+	if s.Window < 2 {
+		return errors.Reason("window = %d must be >= 2", s.Window)
+	}
+	if s.Exit < 0 || s.Entry <= s.Exit {
+		return errors.Reason("must be 0 <= exit < entry: exit=%f, entry=%f",
+			s.Exit, s.Entry)
+	}
+	return nil
+}
+
+// CrossSectionalMomentumStrategy ranks the tickers by their trailing log-profit
+// over Lookback days every Rebalance days, and holds an equally weighted long
+// position in the top Quantile of the tickers till the next rebalance. With
+// Short, it also shorts the bottom Quantile, with half of the value in each leg.
+// All the tickers are traded as a single portfolio.
+type CrossSectionalMomentumStrategy struct {
+	Lookback  int     `json:"lookback" default:"252"` // days, >= 1
+	Rebalance int     `json:"rebalance" default:"21"` // days, >= 1
+	Quantile  float64 `json:"quantile" default:"0.1"` // in (0..0.5]
+	Short     bool    `json:"short"`
+}
+
+var _ StrategyConfig = &CrossSectionalMomentumStrategy{}
+
+func (*CrossSectionalMomentumStrategy) strategy()    {}
+func (*CrossSectionalMomentumStrategy) Name() string { return "cross-sectional momentum" }
+
+func (s *CrossSectionalMomentumStrategy) InitMessage(js any) error {
+	if err := message.Init(s, js); err != nil {
+		return errors.Annotate(err, "failed to init CrossSectionalMomentumStrategy")
+	}
+	if s.Lookback < 1 {
+		return errors.Reason("lookback = %d must be >= 1", s.Lookback)
+	}
+	if s.Rebalance < 1 {
+		return errors.Reason("rebalance = %d must be >= 1", s.Rebalance)
+	}
+	if s.Quantile <= 0 || s.Quantile > 0.5 {
+		return errors.Reason("quantile = %f must be in (0..0.5]", s.Quantile)
+	}
+	return nil
+}
+
+// VolatilityTargetStrategy scales the daily position of the inner Strategy to
+// target the constant annualized volatility. The scale on each day is
+// Target divided by the annualized volatility of the inner strategy's daily
+// log-profits over the preceding Window days, capped at MaxLeverage. Intraday
+// and overnight attribution is not available for the scaled results.
+type VolatilityTargetStrategy struct {
+	Strategy    *Strategy `json:"strategy" required:"true"`
+	Target      float64   `json:"target" default:"0.15"`      // > 0
+	Window      int       `json:"window" default:"20"`        // days, >= 2
+	MaxLeverage float64   `json:"max leverage" default:"1.0"` // > 0
+}
+
+var _ StrategyConfig = &VolatilityTargetStrategy{}
+
+func (*VolatilityTargetStrategy) strategy()    {}
+func (*VolatilityTargetStrategy) Name() string { return "volatility target" }
+
+func (s *VolatilityTargetStrategy) InitMessage(js any) error {
+	if err := message.Init(s, js); err != nil {
+		return errors.Annotate(err, "failed to init VolatilityTargetStrategy")
+	}
+	if s.Target <= 0 {
+		return errors.Reason("target = %f must be > 0", s.Target)
+	}
+	if s.Window < 2 {
+		return errors.Reason("window = %d must be >= 2", s.Window)
+	}
+	if s.MaxLeverage <= 0 {
+		return errors.Reason("max leverage = %f must be > 0", s.MaxLeverage)
+	}
+	return nil
+}
+
+// StrategyGrid sweeps the target and the stop loss of the strategy over all
+// the combinations of the given values. Applies to "buy-sell intraday", where
+// the grid values replace any target and stop loss sell conditions, and to
+// "buy-sell OHLC".
+type StrategyGrid struct {
+	Targets    []float64 `json:"targets" required:"true"`     // each > 1
+	StopLosses []float64 `json:"stop losses" required:"true"` // each in (0..1)
+	// CSV output file for the matrix of mean annualized profits; empty string
+	// == text on stdout.
+	File string `json:"file"`
+}
+
+var _ message.Message = &StrategyGrid{}
+
+func (g *StrategyGrid) InitMessage(js any) error {
+	if err := message.Init(g, js); err != nil {
+		return errors.Annotate(err, "failed to init StrategyGrid")
+	}
+	if len(g.Targets) == 0 || len(g.StopLosses) == 0 {
+		return errors.Reason("targets and stop losses must not be empty")
+	}
+	for _, t := range g.Targets {
+		if t <= 1 {
+			return errors.Reason("target factor = %f must be > 1", t)
+		}
+	}
+	for _, s := range g.StopLosses {
+		if s <= 0 || s >= 1 {
+			return errors.Reason("stop loss = %f must be in (0..1)", s)
+		}
+	}
+	return nil
+}
+
 // Simulator experiment implements a strategy simulator with statistical
 // analysis of the results.
+//
+// With Runs > 1, the strategy is executed that many times over freshly
+// generated synthetic data, and the Percentiles of the annualized return and
+// the max. drawdown across the runs are reported. The profit plot then
+// aggregates the profits of all the runs.
+//
+// With Grid, the strategy is executed for each grid cell instead, and only the
+// matrix of mean annualized profits and the best cell are reported.
 type Simulator struct {
 	ID         string            `json:"id"`
 	Data       *Source           `json:"data"`
 	StartValue float64           `json:"start value" default:"1000"` // cost basis
 	Strategy   *Strategy         `json:"strategy" required:"true"`
 	ProfitPlot *DistributionPlot `json:"profit plot"` // profit factor distribution
+	// Distributions of per-ticker run statistics; their means are always
+	// reported as values.
+	DrawdownPlot   *DistributionPlot `json:"drawdown plot"` // max. drawdown
+	VolatilityPlot *DistributionPlot `json:"volatility plot"`
+	SharpePlot     *DistributionPlot `json:"Sharpe plot"`
+	SortinoPlot    *DistributionPlot `json:"Sortino plot"`
+	ExposurePlot   *DistributionPlot `json:"exposure plot"` // fraction of time in market
+	// Attribution of log-profits to intraday and overnight price moves.
+	IntradayPlot  *DistributionPlot `json:"intraday plot"`
+	OvernightPlot *DistributionPlot `json:"overnight plot"`
 	// Plot profit as annualized factor.
 	Annualize bool `json:"annualize" default:"true"`
-	LogProfit bool `json:"log-profit"` // plot as log-profit
+	LogProfit bool `json:"log-profit"`       // plot as log-profit
+	Runs      int  `json:"runs" default:"1"` // >= 1
+	// Percentiles of the run outcomes, in [0..100]; default: [5, 50, 95].
+	Percentiles []float64     `json:"percentiles"`
+	Grid        *StrategyGrid `json:"grid"`
+	// Plot the equity curves of the strategies trading a whole portfolio, such
+	// as "cross-sectional momentum".
+	EquityGraph string `json:"equity graph"`
+	// CSV dump of each ticker's run statistics. When set to "-", print the
+	// table to stdout.
+	File string `json:"file"`
 }
 
 var _ ExperimentConfig = &Simulator{}
@@ -781,6 +2473,30 @@ func (e *Simulator) InitMessage(js any) error {
 	if err := message.Init(e, js); err != nil {
 		return errors.Annotate(err, "failed to init Simulator")
 	}
+	if e.Runs < 1 {
+		return errors.Reason("runs=%d must be >= 1", e.Runs)
+	}
+	if e.Runs > 1 && e.Data != nil && e.Data.DB != nil {
+		return errors.Reason("runs > 1 requires a synthetic data source")
+	}
+	for _, p := range e.Percentiles {
+		if p < 0.0 || 100.0 < p {
+			return errors.Reason("percentile=%g must be in [0..100]", p)
+		}
+	}
+	if e.Grid != nil {
+		if e.Runs > 1 {
+			return errors.Reason("grid is not supported with runs > 1")
+		}
+		switch e.Strategy.Config.(type) {
+		case *BuySellIntradayStrategy, *BuySellOHLCStrategy:
+		default:
+			return errors.Reason(`grid is not supported for "%s"`, e.Strategy.Name())
+		}
+	}
+	if e.Runs > 1 && len(e.Percentiles) == 0 {
+		e.Percentiles = []float64{5, 50, 95}
+	}
 	return nil
 }
 
@@ -790,39 +2506,110 @@ func (e *Simulator) Name() string { return "simulator" }
 // ExpMap represents a Message which reads a single-element map {name:
 // Experiment} and knows how to populate specific implementations of the
 // Experiment interface.
+//
+// Any experiment config may also contain "graph prefix", which is removed from
+// the config and prepended to all the graph IDs the experiment plots to. This
+// allows running the same experiment several times without mixing up the
+// plots.
+//
+// Similarly, "output subdir" is a relative directory for the experiment's
+// output files (CSV tables, histogram and lengths files, etc.) given as
+// relative paths. It is itself relative to the app's output directory.
 type ExpMap struct {
-	Config ExperimentConfig `json:"-"` // populated directly in Init
+	Config       ExperimentConfig `json:"-"` // populated directly in Init
+	GraphPrefix  string           `json:"-"`
+	OutputSubdir string           `json:"-"`
 }
 
 var _ message.Message = &ExpMap{}
 
+// experimentConfigs creates empty configs of all the supported experiments.
+// Add specific experiment implementations here.
+func experimentConfigs() []ExperimentConfig {
+	return []ExperimentConfig{
+		new(TestExperimentConfig),
+		new(Hold),
+		new(Distribution),
+		new(PowerDist),
+		new(Portfolio),
+		new(AutoCorrelation),
+		new(Beta),
+		new(Hedge),
+		new(Trading),
+		new(Simulator),
+		new(Extremes),
+		new(Crash),
+		new(Deciles),
+		new(Liquidity),
+		new(Compounding),
+		new(Pair),
+		new(CrossCorrelation),
+		new(EventStudy),
+		new(Seasonality),
+		new(Copula),
+		new(Options),
+		new(DataQuality),
+		new(Generate),
+		new(Export),
+	}
+}
+
+// ExperimentNames lists the names of all the supported experiments, as used in
+// the config.
+func ExperimentNames() []string {
+	var names []string
+	for _, c := range experimentConfigs() {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// NewExperimentConfig creates an uninitialized config of the named experiment.
+func NewExperimentConfig(name string) (ExperimentConfig, error) {
+	for _, c := range experimentConfigs() {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, errors.Reason("unknown experiment %s", name)
+}
+
 func (e *ExpMap) InitMessage(js any) error {
 	m, ok := js.(map[string]any)
 	if !ok || len(m) != 1 {
 		return errors.Reason("experiment must be a single-element map: %v", js)
 	}
 	for name, jsConfig := range m {
-		switch name { // add specific experiment implementations here
-		case new(TestExperimentConfig).Name():
-			e.Config = new(TestExperimentConfig)
-		case new(Hold).Name():
-			e.Config = new(Hold)
-		case new(Distribution).Name():
-			e.Config = new(Distribution)
-		case new(PowerDist).Name():
-			e.Config = new(PowerDist)
-		case new(Portfolio).Name():
-			e.Config = new(Portfolio)
-		case new(AutoCorrelation).Name():
-			e.Config = new(AutoCorrelation)
-		case new(Beta).Name():
-			e.Config = new(Beta)
-		case new(Trading).Name():
-			e.Config = new(Trading)
-		case new(Simulator).Name():
-			e.Config = new(Simulator)
-		default:
-			return errors.Reason("unknown experiment %s", name)
+		c, err := NewExperimentConfig(name)
+		if err != nil {
+			return errors.Annotate(err, "failed to create experiment config")
+		}
+		e.Config = c
+		if m, ok := jsConfig.(map[string]any); ok {
+			// Copy the map to keep the original intact.
+			m2 := make(map[string]any, len(m))
+			for k, v := range m {
+				m2[k] = v
+			}
+			fields := map[string]*string{
+				"graph prefix":  &e.GraphPrefix,
+				"output subdir": &e.OutputSubdir,
+			}
+			for k, f := range fields {
+				p, ok := m2[k]
+				if !ok {
+					continue
+				}
+				if *f, ok = p.(string); !ok {
+					return errors.Reason(`"%s" must be a string: %v`, k, p)
+				}
+				delete(m2, k)
+			}
+			if filepath.IsAbs(e.OutputSubdir) {
+				return errors.Reason(`"output subdir" must be relative: %s`,
+					e.OutputSubdir)
+			}
+			jsConfig = m2
 		}
 		return errors.Annotate(e.Config.InitMessage(jsConfig),
 			"failed to parse experiment config")
@@ -830,18 +2617,114 @@ func (e *ExpMap) InitMessage(js any) error {
 	return nil
 }
 
+// MarshalJSON writes the experiment back as a single-element map, including
+// its "graph prefix" and "output subdir" if any. Since InitMessage fills in the
+// defaults, this is the fully resolved experiment config.
+func (e *ExpMap) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(e.Config)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to marshal %s", e.Config.Name())
+	}
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber() // keep large integers such as seeds intact
+	if err := dec.Decode(&m); err != nil {
+		return nil, errors.Annotate(err, "failed to decode %s", e.Config.Name())
+	}
+	if e.GraphPrefix != "" {
+		m["graph prefix"] = e.GraphPrefix
+	}
+	if e.OutputSubdir != "" {
+		m["output subdir"] = e.OutputSubdir
+	}
+	return json.Marshal(map[string]any{e.Config.Name(): m})
+}
+
 // Config is the top-level configuration of the app.
+//
+// In addition to the plot.GroupConfig fields, a group may specify "shared
+// buckets". All the distribution plots in the group's graphs then use these
+// buckets instead of their own, so that side-by-side histograms are directly
+// comparable. This includes the graphs cloned for a "graph prefix" and, for
+// the "auto" group, the graphs created by "auto create graphs". Shared buckets
+// with "auto bounds" are fitted once to the pooled samples of all the plots in
+// the group, and therefore apply only to the distributions plotted from
+// samples rather than from incrementally accumulated histograms.
 type Config struct {
 	Groups      []*plot.GroupConfig `json:"groups"`
 	Experiments []*ExpMap           `json:"experiments"`
+	// Create graphs referenced by experiments but missing from groups, in the
+	// default "auto" group, or "auto timeseries" for timeseries plots.
+	AutoCreateGraphs bool `json:"auto create graphs"`
+	// Subsample every timeseries and scatter plot to at most this many points,
+	// when > 0.
+	MaxPoints int `json:"max points"`
+	// Shared buckets by group ID, extracted from the groups' configs.
+	SharedBuckets map[string]*stats.Buckets `json:"-"`
 }
 
 var _ message.Message = &Config{}
 
+// extractSharedBuckets removes "shared buckets" from the group configs in js
+// without modifying the original, and returns the parsed buckets by group ID.
+func extractSharedBuckets(js any) (any, map[string]*stats.Buckets, error) {
+	m, ok := js.(map[string]any)
+	if !ok {
+		return js, nil, nil
+	}
+	groups, ok := m["groups"].([]any)
+	if !ok {
+		return js, nil, nil
+	}
+	shared := make(map[string]*stats.Buckets)
+	newGroups := make([]any, len(groups))
+	for i, g := range groups {
+		newGroups[i] = g
+		gm, ok := g.(map[string]any)
+		if !ok {
+			continue
+		}
+		bjs, ok := gm["shared buckets"]
+		if !ok {
+			continue
+		}
+		id, _ := gm["id"].(string)
+		var b stats.Buckets
+		if err := b.InitMessage(bjs); err != nil {
+			return nil, nil, errors.Annotate(err,
+				"failed to parse shared buckets in group '%s'", id)
+		}
+		shared[id] = &b
+		ng := make(map[string]any, len(gm))
+		for k, v := range gm {
+			if k != "shared buckets" {
+				ng[k] = v
+			}
+		}
+		newGroups[i] = ng
+	}
+	newM := make(map[string]any, len(m))
+	for k, v := range m {
+		newM[k] = v
+	}
+	newM["groups"] = newGroups
+	return newM, shared, nil
+}
+
 func (c *Config) InitMessage(js any) error {
+	js, shared, err := extractSharedBuckets(js)
+	if err != nil {
+		return errors.Annotate(err, "failed to parse top-level config")
+	}
 	if err := message.Init(c, js); err != nil {
 		return errors.Annotate(err, "failed to parse top-level config")
 	}
+	if c.MaxPoints < 0 {
+		return errors.Reason("max points=%d must be >= 0", c.MaxPoints)
+	}
+	if len(shared) > 0 {
+		c.SharedBuckets = shared
+	}
 	groups := make(map[string]struct{})
 	graphs := make(map[string]struct{})
 	for i, g := range c.Groups {
@@ -861,9 +2744,241 @@ func (c *Config) InitMessage(js any) error {
 	return nil
 }
 
+// Calibrate is the config of the "calibrate" command, which fits a
+// t-distribution to the log-profits of the data source.
+type Calibrate struct {
+	Data  *Source      `json:"data" required:"true"`
+	Alpha *DeriveAlpha `json:"alpha"` // default: search in [1.01..100]
+	// Buckets of the histogram for deriving alpha. Use "auto bounds" to fit to
+	// the data.
+	Buckets stats.Buckets `json:"buckets"`
+}
+
+var _ message.Message = &Calibrate{}
+
+func (c *Calibrate) InitMessage(js any) error {
+	if err := message.Init(c, js); err != nil {
+		return errors.Annotate(err, "failed to init Calibrate")
+	}
+	if c.Alpha == nil {
+		c.Alpha = &DeriveAlpha{
+			MinX:          1.01,
+			MaxX:          100.0,
+			Epsilon:       0.01,
+			MaxIterations: 1000,
+			IgnoreCounts:  10,
+			FitMethod:     "distance",
+			ScanPoints:    100,
+		}
+	}
+	return nil
+}
+
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandVars substitutes ${VAR} placeholders in all the strings in the JSON
+// value js, returning a new value. A variable is looked up in vars first, then
+// in the environment; an undefined variable is an error.
+func ExpandVars(js any, vars map[string]string) (any, error) {
+	switch v := js.(type) {
+	case string:
+		var err error
+		res := varPattern.ReplaceAllStringFunc(v, func(m string) string {
+			name := varPattern.FindStringSubmatch(m)[1]
+			if val, ok := vars[name]; ok {
+				return val
+			}
+			if val, ok := os.LookupEnv(name); ok {
+				return val
+			}
+			if err == nil {
+				err = errors.Reason("undefined variable '%s'", name)
+			}
+			return m
+		})
+		return res, err
+	case []any:
+		res := make([]any, len(v))
+		for i, x := range v {
+			var err error
+			if res[i], err = ExpandVars(x, vars); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, x := range v {
+			var err error
+			if res[k], err = ExpandVars(x, vars); err != nil {
+				return nil, errors.Annotate(err, "in '%s'", k)
+			}
+		}
+		return res, nil
+	}
+	return js, nil
+}
+
+// stripJSON5 converts the supported subset of JSON5, namely // and /* */
+// comments and trailing commas in objects and arrays, to strict JSON.
+func stripJSON5(data []byte) ([]byte, error) {
+	var res []byte
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			res = append(res, c)
+			switch c {
+			case '\\':
+				if i+1 < len(data) {
+					i++
+					res = append(res, data[i])
+				}
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+			res = append(res, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i-- // keep the newline
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.Reason("unterminated comment")
+			}
+			i += end + 3
+			res = append(res, ' ')
+		case c == ']' || c == '}':
+			// Drop the trailing comma, if any, ignoring whitespace.
+			j := len(res) - 1
+			for j >= 0 && unicode.IsSpace(rune(res[j])) {
+				j--
+			}
+			if j >= 0 && res[j] == ',' {
+				res = append(res[:j], res[j+1:]...)
+			}
+			res = append(res, c)
+		default:
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// normalizeYAML converts the values decoded from YAML to the types produced by
+// the JSON decoder, as expected by message.Message.
+func normalizeYAML(v any) (any, error) {
+	switch x := v.(type) {
+	case int:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	case time.Time:
+		// Unquoted dates are decoded as timestamps, but db.Date expects a string.
+		if x.Equal(x.Truncate(24 * time.Hour)) {
+			return x.Format("2006-01-02"), nil
+		}
+		return x.Format(time.RFC3339Nano), nil
+	case []any:
+		res := make([]any, len(x))
+		for i, e := range x {
+			var err error
+			if res[i], err = normalizeYAML(e); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[string]any:
+		res := make(map[string]any, len(x))
+		for k, e := range x {
+			var err error
+			if res[k], err = normalizeYAML(e); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[any]any:
+		res := make(map[string]any, len(x))
+		for k, e := range x {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errors.Reason("non-string key %v", k)
+			}
+			var err error
+			if res[ks], err = normalizeYAML(e); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	return v, nil
+}
+
+// decodeFile reads a JSON value from a file in the format determined by its
+// extension: YAML for .yaml and .yml, JSON5 for .json5, and strict JSON
+// otherwise.
+func decodeFile(filePath string) (any, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot open file '%s'", filePath)
+	}
+	var js any
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &js); err != nil {
+			return nil, errors.Annotate(err, "failed to decode YAML")
+		}
+		return normalizeYAML(js)
+	case ".json5":
+		if data, err = stripJSON5(data); err != nil {
+			return nil, errors.Annotate(err, "failed to decode JSON5")
+		}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, errors.Annotate(err, "failed to decode JSON")
+	}
+	return js, nil
+}
+
+// ReadFile initializes m from a JSON, JSON5 or YAML file (see decodeFile),
+// expanding ${VAR} placeholders as in ExpandVars.
+func ReadFile(m message.Message, filePath string, vars map[string]string) error {
+	js, err := decodeFile(filePath)
+	if err != nil {
+		return errors.Annotate(err, "failed to read '%s'", filePath)
+	}
+	if js, err = ExpandVars(js, vars); err != nil {
+		return errors.Annotate(err, "failed to expand variables")
+	}
+	if err := m.InitMessage(js); err != nil {
+		return errors.Annotate(err, "cannot interpret JSON as %T", m)
+	}
+	return nil
+}
+
+// Load the top-level config from configPath, expanding ${VAR} placeholders from
+// the environment.
 func Load(configPath string) (*Config, error) {
+	return LoadWithVars(configPath, nil)
+}
+
+// LoadWithVars loads the top-level config from configPath, expanding ${VAR}
+// placeholders as in ExpandVars.
+func LoadWithVars(configPath string, vars map[string]string) (*Config, error) {
 	var c Config
-	if err := message.FromFile(&c, configPath); err != nil {
+	if err := ReadFile(&c, configPath, vars); err != nil {
 		return nil, errors.Annotate(err, "cannot read config '%s'", configPath)
 	}
 	return &c, nil
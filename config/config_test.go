@@ -16,6 +16,7 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -140,6 +141,225 @@ func TestConfig(t *testing.T) {
 			})
 		})
 
+		Convey("shared buckets are extracted from the groups", func() {
+			c, err := conf(`
+{
+  "groups": [
+    {
+      "id": "g", "graphs": [{"id": "a"}, {"id": "b"}],
+      "shared buckets": {"n": 5, "min": -1, "max": 1, "auto bounds": false}
+    },
+    {"id": "other", "graphs": [{"id": "c"}]}
+  ],
+  "experiments": [
+    {"distribution": {
+      "data": {"DB": {"DB": "test"}},
+      "log-profits": {"graph": "a", "buckets": {"n": 10}},
+      "means": {"counts graph": "b"},
+      "MADs": {"graph": "c"}
+    }}
+  ]
+}`)
+			So(err, ShouldBeNil)
+			shared, err := stats.NewBuckets(5, -1, 1, stats.LinearSpacing)
+			So(err, ShouldBeNil)
+			So(c.Groups[0].ID, ShouldEqual, "g")
+			So(c.SharedBuckets["g"].SameAs(shared), ShouldBeTrue)
+			So(c.SharedBuckets["other"], ShouldBeNil)
+			// The plots' own buckets are substituted only when plotting.
+			d := c.Experiments[0].Config.(*Distribution)
+			So(d.LogProfits.Buckets.N, ShouldEqual, 10)
+			So(d.MADs.Buckets, ShouldResemble, defaultBuckets)
+		})
+
+		Convey("shared buckets may have auto bounds", func() {
+			c, err := conf(`
+{
+  "groups": [
+    {"id": "g", "graphs": [{"id": "a"}], "shared buckets": {"n": 5}}
+  ]
+}`)
+			So(err, ShouldBeNil)
+			So(c.SharedBuckets["g"].N, ShouldEqual, 5)
+			So(c.SharedBuckets["g"].Auto, ShouldBeTrue)
+		})
+
+		Convey("negative max points is an error", func() {
+			_, err := conf(`{"max points": -1}`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "max points=-1 must be >= 0")
+
+			var p ScatterPlot
+			err = p.InitMessage(testutil.JSON(`{"graph": "g", "max points": -1}`))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "max points=-1 must be >= 0")
+		})
+
+		Convey("variables are expanded", func() {
+			os.Setenv("TEST_EXPERIMENTS_GRAPH", "env")
+			defer os.Unsetenv("TEST_EXPERIMENTS_GRAPH")
+			js := testutil.JSON(`
+{
+  "a": "${A}/x ${TEST_EXPERIMENTS_GRAPH}",
+  "list": ["$A", "${A}"],
+  "n": 5
+}`)
+			res, err := ExpandVars(js, map[string]string{"A": "1"})
+			So(err, ShouldBeNil)
+			So(res, ShouldResemble, map[string]any{
+				"a":    "1/x env",
+				"list": []any{"$A", "1"},
+				"n":    5.0,
+			})
+
+			_, err = ExpandVars(js, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "undefined variable 'A'")
+
+			confPath := filepath.Join(tmpdir, "vars.json")
+			So(testutil.WriteFile(confPath, `
+{
+  "groups": [{"id": "g", "graphs": [{"id": "${GRAPH}"}]}],
+  "experiments": [{"test": {"graph": "${GRAPH}"}}]
+}`), ShouldBeNil)
+			c, err := LoadWithVars(confPath, map[string]string{"GRAPH": "r1"})
+			So(err, ShouldBeNil)
+			So(c.Groups[0].Graphs[0].ID, ShouldEqual, "r1")
+			So(c.Experiments[0].Config.(*TestExperimentConfig).Graph, ShouldEqual, "r1")
+		})
+
+		Convey("graph prefix", func() {
+			var c Config
+			So(c.InitMessage(testutil.JSON(`
+{
+  "experiments": [
+    {"test": {"graph": "g", "graph prefix": "run1 "}},
+    {"test": {"graph": "g"}}
+  ]
+}`)), ShouldBeNil)
+			So(c.Experiments[0].GraphPrefix, ShouldEqual, "run1 ")
+			So(c.Experiments[0].Config.(*TestExperimentConfig).Graph, ShouldEqual, "g")
+			So(c.Experiments[1].GraphPrefix, ShouldEqual, "")
+
+			So(c.InitMessage(testutil.JSON(`
+{"experiments": [{"test": {"graph": "g", "graph prefix": 1}}]}`)), ShouldNotBeNil)
+		})
+
+		Convey("output subdir", func() {
+			var c Config
+			So(c.InitMessage(testutil.JSON(`
+{
+  "experiments": [
+    {"test": {"graph": "g", "graph prefix": "a ", "output subdir": "a/tables"}},
+    {"test": {"graph": "g"}}
+  ]
+}`)), ShouldBeNil)
+			So(c.Experiments[0].OutputSubdir, ShouldEqual, "a/tables")
+			So(c.Experiments[0].GraphPrefix, ShouldEqual, "a ")
+			So(c.Experiments[1].OutputSubdir, ShouldEqual, "")
+
+			So(c.InitMessage(testutil.JSON(`
+{"experiments": [{"test": {"graph": "g", "output subdir": "/tmp"}}]}`)), ShouldNotBeNil)
+		})
+
+		Convey("marshals back as the resolved config", func() {
+			var c Config
+			So(c.InitMessage(testutil.JSON(`
+{
+  "experiments": [
+    {"test": {"graph": "g", "graph prefix": "a ", "output subdir": "a"}}
+  ]
+}`)), ShouldBeNil)
+			b, err := json.Marshal(&c)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldContainSubstring, `"experiments":[{"test":{"grade":2,"graph":"g","graph prefix":"a ","id":"","output subdir":"a","passed":false}}]`)
+
+			var c2 Config
+			So(c2.InitMessage(testutil.JSON(string(b))), ShouldBeNil)
+			So(c2.Experiments, ShouldResemble, c.Experiments)
+		})
+
+		Convey("YAML and JSON5 configs", func() {
+			expected := &Config{
+				Groups: []*plot.GroupConfig{{
+					ID:     "g",
+					Title:  "g",
+					Graphs: []*plot.GraphConfig{{ID: "r1"}},
+				}},
+				Experiments: []*ExpMap{
+					{Config: &TestExperimentConfig{Grade: 3, Graph: "r1"}},
+				},
+			}
+
+			Convey("YAML", func() {
+				confPath := filepath.Join(tmpdir, "config.yaml")
+				So(testutil.WriteFile(confPath, `
+# A comment.
+groups:
+  - id: g
+    graphs:
+      - id: r1
+experiments:
+  - test:
+      grade: 3
+      graph: r1
+`), ShouldBeNil)
+				c, err := Load(confPath)
+				So(err, ShouldBeNil)
+				So(c, ShouldResemble, expected)
+			})
+
+			Convey("YAML with unquoted dates", func() {
+				confPath := filepath.Join(tmpdir, "config_dates.yaml")
+				So(testutil.WriteFile(confPath, `
+experiments:
+  - distribution:
+      data:
+        daily distribution: {name: t, alpha: 3}
+        start date: 2020-01-02
+`), ShouldBeNil)
+				c, err := Load(confPath)
+				So(err, ShouldBeNil)
+				d, ok := c.Experiments[0].Config.(*Distribution)
+				So(ok, ShouldBeTrue)
+				So(d.Data.StartDate, ShouldResemble, db.NewDate(2020, 1, 2))
+			})
+
+			Convey("JSON5", func() {
+				confPath := filepath.Join(tmpdir, "config.json5")
+				So(testutil.WriteFile(confPath, `
+// A comment.
+{
+  "groups": [{"id": "g", "graphs": [{"id": "r1"},]},], /* trailing commas */
+  "experiments": [
+    {"test": {"grade": 3, "graph": "r1", "id": "",}}, // "id": "// not a comment",
+  ],
+}`), ShouldBeNil)
+				c, err := Load(confPath)
+				So(err, ShouldBeNil)
+				So(c, ShouldResemble, expected)
+			})
+
+			Convey("JSON5 strings are preserved", func() {
+				data, err := stripJSON5([]byte(`{"a": "x, ] // \" /* y */",}`))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, `{"a": "x, ] // \" /* y */"}`)
+			})
+
+			Convey("strict JSON rejects comments", func() {
+				confPath := filepath.Join(tmpdir, "comments.json")
+				So(testutil.WriteFile(confPath, `{"groups": [], // comment
+}`), ShouldBeNil)
+				_, err := Load(confPath)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("ExperimentID works", func() {
+			So(ExperimentID(&Distribution{ID: "dist"}), ShouldEqual, "dist")
+			So(ExperimentID(&TestExperimentConfig{}), ShouldEqual, "")
+		})
+
 		Convey("x log-scale for timeseries is an error", func() {
 			var c Config
 			err := c.InitMessage(testutil.JSON(`
@@ -237,10 +457,11 @@ func TestConfig(t *testing.T) {
 									StartValue: 1000.0,
 								},
 							},
-							PositionsGraph: "positions",
-							PositionsAxis:  "right",
-							TotalGraph:     "total",
-							TotalAxis:      "left",
+							PositionsGraph:    "positions",
+							PositionsAxis:     "right",
+							TotalGraph:        "total",
+							TotalAxis:         "left",
+							ReinvestDividends: true,
 						}},
 					}})
 				})
@@ -275,10 +496,11 @@ func TestConfig(t *testing.T) {
 					{Config: &Distribution{
 						Data: &defaultSource,
 						LogProfits: &DistributionPlot{
-							Graph:     "dist",
-							Buckets:   defaultBuckets,
-							ChartType: "line",
-							Normalize: true,
+							Graph:       "dist",
+							Buckets:     defaultBuckets,
+							ChartType:   "line",
+							Normalize:   true,
+							NormalizeBy: "MAD",
 							RefDist: &CompoundDistribution{
 								AnalyticalSource: &AnalyticalDistribution{
 									Name:  "t",
@@ -288,6 +510,7 @@ func TestConfig(t *testing.T) {
 								},
 								N:            1,
 								CompoundType: "biased",
+								FFTGrid:      4096,
 								Params:       defaultParallelSampling,
 							},
 							DeriveAlpha: &DeriveAlpha{
@@ -296,8 +519,13 @@ func TestConfig(t *testing.T) {
 								Epsilon:       0.01,
 								MaxIterations: 1000,
 								IgnoreCounts:  10,
+								FitMethod:     "distance",
+								ScanPoints:    100,
 							},
 						},
+						SplitBy: "none",
+						GroupBy: "none",
+						Weight:  "none",
 					}},
 				}})
 			})
@@ -324,7 +552,8 @@ func TestConfig(t *testing.T) {
 							Shares:       10,
 							PurchaseDate: db.NewDate(2020, 1, 1),
 						}},
-						Columns: []PortfolioColumn{{Kind: "ticker"}},
+						Columns:     []PortfolioColumn{{Kind: "ticker"}},
+						LotMatching: "FIFO",
 					}},
 				}})
 			})
@@ -349,6 +578,7 @@ func TestConfig(t *testing.T) {
 							},
 							N:            1,
 							CompoundType: "biased",
+							FFTGrid:      4096,
 							Params:       defaultParallelSampling,
 						},
 						CumulMean: &CumulativeStatistic{
@@ -356,6 +586,7 @@ func TestConfig(t *testing.T) {
 							Buckets: defaultBuckets,
 							Samples: 10000,
 							Points:  200,
+							Runs:    1,
 						},
 						AlphaParams: &DeriveAlpha{
 							MinX:          1.01,
@@ -363,6 +594,8 @@ func TestConfig(t *testing.T) {
 							Epsilon:       0.01,
 							MaxIterations: 1000,
 							IgnoreCounts:  10,
+							FitMethod:     "distance",
+							ScanPoints:    100,
 						},
 						CumulSamples: 10000,
 						StatSamples:  10000,
@@ -404,17 +637,21 @@ func TestConfig(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(c, ShouldResemble, &Config{Experiments: []*ExpMap{
 					{Config: &Beta{
-						Reference: &defaultSource,
-						Data:      &defaultSource,
-						Beta:      1,
+						Reference:       &defaultSource,
+						Data:            &defaultSource,
+						Beta:            1,
+						Estimator:       "ols",
+						PriorSigma:      0.5,
+						CorrelationType: "pearson",
 						BetaRatios: &StabilityPlot{
 							Step:      1,
 							Window:    1,
 							Normalize: true,
 							Plot: &DistributionPlot{
-								Graph:     "ratios",
-								Buckets:   defaultBuckets,
-								ChartType: "line",
+								Graph:       "ratios",
+								Buckets:     defaultBuckets,
+								ChartType:   "line",
+								NormalizeBy: "none",
 							},
 						},
 					}},
@@ -437,6 +674,55 @@ func TestConfig(t *testing.T) {
 				}})
 			})
 
+			Convey("Extremes", func() {
+				c, err := conf(`
+{
+  "experiments": [
+    {"extremes": {
+      "data": {"DB": {"DB": "test"}}
+    }}]
+}`)
+				So(err, ShouldBeNil)
+				So(c, ShouldResemble, &Config{Experiments: []*ExpMap{
+					{Config: &Extremes{
+						Data:           &defaultSource,
+						Threshold:      3,
+						MinEvents:      3,
+						NormalizeWaits: true,
+					}},
+				}})
+
+				_, err = conf(`
+{
+  "experiments": [
+    {"extremes": {
+      "data": {"DB": {"DB": "test"}},
+      "threshold": 0
+    }}]
+}`)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Crash", func() {
+				c, err := conf(`
+{
+  "experiments": [
+    {"crash": {
+      "data": {"DB": {"DB": "test"}}
+    }}]
+}`)
+				So(err, ShouldBeNil)
+				So(c, ShouldResemble, &Config{Experiments: []*ExpMap{
+					{Config: &Crash{
+						Data:             &defaultSource,
+						Threshold:        0.1,
+						Horizons:         []int{1, 5, 20},
+						BootstrapSamples: 1000,
+						Confidence:       95,
+					}},
+				}})
+			})
+
 			Convey("Simulator", func() {
 				c, err := conf(`
 {
@@ -457,6 +743,7 @@ func TestConfig(t *testing.T) {
 						Data:       &defaultSource,
 						StartValue: 1000,
 						Annualize:  true,
+						Runs:       1,
 						Strategy: &Strategy{Config: &BuySellIntradayStrategy{
 							Buy:  open,
 							Sell: []IntradaySell{{Time: &close}},
@@ -0,0 +1,215 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package copula is an experiment with the tail dependence between pairs of
+// stocks, that is, how likely they are to crash (or jump) together, regardless
+// of their marginal distributions.
+package copula
+
+import (
+	"context"
+	"runtime"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Copula struct {
+	config  *config.Copula
+	context context.Context
+}
+
+var _ experiments.Experiment = &Copula{}
+
+func (e *Copula) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Copula) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Copula) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Copula); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	it, err := experiments.Source(ctx, e.config.Data)
+	if err != nil {
+		return errors.Annotate(err, "failed to get data series")
+	}
+	lps := iterator.ToSlice[experiments.LogProfits](it)
+	it.Close()
+	// Sources may yield series in any order; keep the pairs stable.
+	sort.SliceStable(lps, func(i, j int) bool { return lps[i].Ticker < lps[j].Ticker })
+
+	total := e.processPairs(lps)
+	if err := e.processTotal(len(lps), total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+type jobResult struct {
+	lower    *stats.Histogram // nil when not plotted
+	upper    *stats.Histogram // nil when not plotted
+	sumLower float64
+	sumUpper float64
+	pairs    int
+}
+
+func (e *Copula) newJobResult() *jobResult {
+	var res jobResult
+	if c := e.config.LowerPlot; c != nil {
+		res.lower = stats.NewHistogram(experiments.PlotBuckets(e.context, c))
+	}
+	if c := e.config.UpperPlot; c != nil {
+		res.upper = stats.NewHistogram(experiments.PlotBuckets(e.context, c))
+	}
+	return &res
+}
+
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	if j.lower != nil {
+		j.lower.AddHistogram(j2.lower)
+	}
+	if j.upper != nil {
+		j.upper.AddHistogram(j2.upper)
+	}
+	j.sumLower += j2.sumLower
+	j.sumUpper += j2.sumUpper
+	j.pairs += j2.pairs
+	return j
+}
+
+// uniformRanks transforms xs into pseudo-observations rank/(n+1) in (0..1).
+func uniformRanks(xs []float64) []float64 {
+	idx := make([]int, len(xs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return xs[idx[i]] < xs[idx[j]] })
+	res := make([]float64, len(xs))
+	n := float64(len(xs) + 1)
+	for r, i := range idx {
+		res[i] = float64(r+1) / n
+	}
+	return res
+}
+
+// tailDependence estimates the lower and upper tail dependence coefficients of
+// the aligned samples xs and ys at the quantile q.
+func tailDependence(xs, ys []float64, q float64) (lower, upper float64) {
+	us := uniformRanks(xs)
+	vs := uniformRanks(ys)
+	var nLow, nHigh, jointLow, jointHigh int
+	for i := range us {
+		if us[i] <= q {
+			nLow++
+			if vs[i] <= q {
+				jointLow++
+			}
+		}
+		if us[i] > 1-q {
+			nHigh++
+			if vs[i] > 1-q {
+				jointHigh++
+			}
+		}
+	}
+	if nLow > 0 {
+		lower = float64(jointLow) / float64(nLow)
+	}
+	if nHigh > 0 {
+		upper = float64(jointHigh) / float64(nHigh)
+	}
+	return
+}
+
+func (e *Copula) processPairs(lps []experiments.LogProfits) *jobResult {
+	f := func(pairs []experiments.IntPair) *jobResult {
+		res := e.newJobResult()
+		for _, p := range pairs {
+			if e.context.Err() != nil {
+				break
+			}
+			tss := stats.TimeseriesIntersect(lps[p.X].Timeseries, lps[p.Y].Timeseries)
+			xs, ys := tss[0].Data(), tss[1].Data()
+			if len(xs) < e.config.MinSamples {
+				logging.Debugf(e.context, "skipping %s and %s: too few samples: %d",
+					lps[p.X].Ticker, lps[p.Y].Ticker, len(xs))
+				continue
+			}
+			lower, upper := tailDependence(xs, ys, e.config.Quantile)
+			if res.lower != nil {
+				res.lower.Add(lower)
+			}
+			if res.upper != nil {
+				res.upper.Add(upper)
+			}
+			res.sumLower += lower
+			res.sumUpper += upper
+			res.pairs++
+		}
+		return res
+	}
+	pairsIter := experiments.SamplePairs(len(lps), e.config.Samples, experiments.Seed(e.context, 0))
+	it := iterator.Batch(pairsIter, e.config.Data.BatchSize)
+	pm := iterator.ParallelMap(e.context, experiments.Workers(e.context, 2*runtime.NumCPU()), it, f)
+	defer pm.Close()
+	g := func(j1, j2 *jobResult) *jobResult { return j1.Merge(j2) }
+	return iterator.Reduce[*jobResult, *jobResult](pm, e.newJobResult(), g)
+}
+
+func (e *Copula) processTotal(tickers int, total *jobResult) error {
+	err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(tickers))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	err = experiments.AddTypedValue(e.context, e.config.ID, "pairs", experiments.IntValue(total.pairs))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of pairs")
+	}
+	if total.pairs == 0 {
+		logging.Warningf(e.context, "no pairs with at least %d samples",
+			e.config.MinSamples)
+		return nil
+	}
+	n := float64(total.pairs)
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "mean lower", experiments.FloatValue(total.sumLower/n)); err != nil {
+		return errors.Annotate(err, "failed to add mean lower tail dependence")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "mean upper", experiments.FloatValue(total.sumUpper/n)); err != nil {
+		return errors.Annotate(err, "failed to add mean upper tail dependence")
+	}
+	if c := e.config.LowerPlot; c != nil {
+		dist := stats.NewHistogramDistribution(total.lower)
+		if err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, "lower tail"); err != nil {
+			return errors.Annotate(err, "failed to plot lower tail dependence")
+		}
+	}
+	if c := e.config.UpperPlot; c != nil {
+		dist := stats.NewHistogramDistribution(total.upper)
+		if err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, "upper tail"); err != nil {
+			return errors.Annotate(err, "failed to plot upper tail dependence")
+		}
+	}
+	return nil
+}
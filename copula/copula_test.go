@@ -0,0 +1,134 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copula
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCopula(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_copula")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("uniformRanks works", t, func() {
+		So(uniformRanks([]float64{0.3, -0.1, 0.2}), ShouldResemble,
+			[]float64{0.75, 0.25, 0.5})
+	})
+
+	Convey("tailDependence works", t, func() {
+		xs := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+		ys := []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+		lower, upper := tailDependence(xs, xs, 0.2)
+		So(lower, ShouldEqual, 1)
+		So(upper, ShouldEqual, 1)
+		lower, upper = tailDependence(xs, ys, 0.2)
+		So(lower, ShouldEqual, 0)
+		So(upper, ShouldEqual, 0)
+	})
+
+	Convey("Copula experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		lowerGraph, err := canvas.EnsureGraph(plot.KindXY, "lower", "g")
+		So(err, ShouldBeNil)
+		upperGraph, err := canvas.EnsureGraph(plot.KindXY, "upper", "g")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"A": {}, "B": {}, "C": {}}
+		pricesA := []float32{100, 101, 103, 102, 106, 104, 109, 105, 112, 111, 115}
+		prices := make(map[string][]db.PriceRow)
+		for i, p := range pricesA {
+			d := db.NewDate(2020, 1, uint8(i+1))
+			// B moves together with A, and C moves opposite to A.
+			prices["A"] = append(prices["A"], db.TestPrice(d, p, p, p, 1000, true))
+			b := 2 * p
+			prices["B"] = append(prices["B"], db.TestPrice(d, b, b, b, 1000, true))
+			c := 10000 / p
+			prices["C"] = append(prices["C"], db.TestPrice(d, c, c, c, 1000, true))
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		Convey("all pairs", func() {
+			var cfg config.Copula
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "quantile": 0.2,
+  "min samples": 5,
+  "lower plot": {"graph": "lower", "buckets": {"n": 5, "min": 0, "max": 1}},
+  "upper plot": {"graph": "upper", "buckets": {"n": 5, "min": 0, "max": 1}}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e Copula
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "3")
+			So(values["test pairs"], ShouldEqual, "3")
+			So(values["test mean lower"], ShouldEqual, "0.3333")
+			So(values["test mean upper"], ShouldEqual, "0.3333")
+			So(len(lowerGraph.Plots), ShouldEqual, 1)
+			So(lowerGraph.Plots[0].Legend, ShouldEqual, "test lower tail p.d.f.")
+			So(len(upperGraph.Plots), ShouldEqual, 1)
+		})
+
+		Convey("too few samples", func() {
+			var cfg config.Copula
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "lower plot": {"graph": "lower"}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e Copula
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test pairs"], ShouldEqual, "0")
+			So(len(lowerGraph.Plots), ShouldEqual, 0)
+		})
+
+		Convey("config requires a plot", func() {
+			var cfg config.Copula
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "data": {"daily distribution": {"name": "t"}}
+}`)), ShouldNotBeNil)
+		})
+	})
+}
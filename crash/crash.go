@@ -0,0 +1,244 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crash is an experiment studying the aftermath of a crash, that is,
+// the returns following a large single-day drop in price.
+package crash
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Crash struct {
+	config  *config.Crash
+	context context.Context
+}
+
+var _ experiments.Experiment = &Crash{}
+
+func (e *Crash) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Crash) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Crash) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Crash); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	it, err := experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j2.Merge(j1) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, e.newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+// jobResult accumulates cumulative log-profits for each horizon. Conditional
+// log-profits are rare enough to be stored directly, while the unconditional
+// ones are accumulated in histograms, when required.
+type jobResult struct {
+	cond       [][]float64
+	uncond     []*stats.Histogram
+	uncondSums []float64
+	uncondNs   []int
+	numTickers int
+	samples    int
+	events     int
+}
+
+func (e *Crash) newJobResult() *jobResult {
+	n := len(e.config.Horizons)
+	res := &jobResult{
+		cond:       make([][]float64, n),
+		uncondSums: make([]float64, n),
+		uncondNs:   make([]int, n),
+	}
+	if c := e.config.UnconditionalPlot; c != nil {
+		res.uncond = make([]*stats.Histogram, n)
+		for i := range res.uncond {
+			res.uncond[i] = stats.NewHistogram(experiments.PlotBuckets(e.context, c))
+		}
+	}
+	return res
+}
+
+// Merge j2 into j and return j.
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	for i := range j.cond {
+		j.cond[i] = append(j.cond[i], j2.cond[i]...)
+		j.uncondSums[i] += j2.uncondSums[i]
+		j.uncondNs[i] += j2.uncondNs[i]
+	}
+	for i, h := range j.uncond {
+		if err := h.AddHistogram(j2.uncond[i]); err != nil {
+			panic(errors.Annotate(err, "failed to merge unconditional histograms"))
+		}
+	}
+	j.numTickers += j2.numTickers
+	j.samples += j2.samples
+	j.events += j2.events
+	return j
+}
+
+func (e *Crash) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := e.newJobResult()
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		data := lp.Timeseries.Data()
+		threshold := e.config.Threshold
+		if e.config.MADThreshold {
+			threshold *= stats.NewSample(data).MAD()
+		}
+		// sums[i] is the sum of data[0:i].
+		sums := make([]float64, len(data)+1)
+		for i, x := range data {
+			sums[i+1] = sums[i] + x
+		}
+		for i, x := range data {
+			drop := x <= -threshold
+			if drop {
+				res.events++
+			}
+			for k, h := range e.config.Horizons {
+				if i+h >= len(data) {
+					continue
+				}
+				cumul := sums[i+h+1] - sums[i+1]
+				if drop {
+					res.cond[k] = append(res.cond[k], cumul)
+				}
+				res.uncondSums[k] += cumul
+				res.uncondNs[k]++
+				if res.uncond != nil {
+					res.uncond[k].Add(cumul)
+				}
+			}
+		}
+		res.numTickers++
+		res.samples += len(data)
+	}
+	return res
+}
+
+func (e *Crash) processTotal(total *jobResult) error {
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(total.samples)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of samples")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "events", experiments.IntValue(total.events)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of events")
+	}
+	var xs, means, lows, highs, uncondMeans []float64
+	mean := func(d []float64) float64 { return stats.NewSample(d).Mean() }
+	for k, h := range e.config.Horizons {
+		name := fmt.Sprintf("%dd", h)
+		if c := e.config.UnconditionalPlot; c != nil && total.uncond[k].CountsTotal() > 0 {
+			dist := stats.NewHistogramDistribution(total.uncond[k])
+			err := experiments.PlotDistribution(e.context, dist, c, e.config.ID,
+				"unconditional "+name)
+			if err != nil {
+				return errors.Annotate(err, "failed to plot unconditional %s", name)
+			}
+		}
+		cond := total.cond[k]
+		if len(cond) == 0 {
+			continue
+		}
+		if c := e.config.ConditionalPlot; c != nil {
+			dist := experiments.NewSampleDistribution(cond, c)
+			err := experiments.PlotDistribution(e.context, dist, c, e.config.ID,
+				"conditional "+name)
+			if err != nil {
+				return errors.Annotate(err, "failed to plot conditional %s", name)
+			}
+		}
+		low, high := experiments.BootstrapInterval(cond, mean,
+			e.config.BootstrapSamples, e.config.Confidence, experiments.Seed(e.context, 0))
+		m := mean(cond)
+		var um float64
+		if total.uncondNs[k] > 0 {
+			um = total.uncondSums[k] / float64(total.uncondNs[k])
+		}
+		xs = append(xs, float64(h))
+		means = append(means, m)
+		lows = append(lows, low)
+		highs = append(highs, high)
+		uncondMeans = append(uncondMeans, um)
+		if err := experiments.AddInterval(e.context, e.config.ID, "conditional mean "+name, m, low, high); err != nil {
+			return errors.Annotate(err, "failed to add conditional mean %s", name)
+		}
+		err := experiments.AddTypedValue(e.context, e.config.ID, "unconditional mean "+name, experiments.FloatValue(um))
+		if err != nil {
+			return errors.Annotate(err, "failed to add unconditional mean %s", name)
+		}
+	}
+	if err := e.plotMeans(xs, means, lows, highs, uncondMeans); err != nil {
+		return errors.Annotate(err, "failed to plot means")
+	}
+	return nil
+}
+
+func (e *Crash) plotMeans(xs, means, lows, highs, uncondMeans []float64) error {
+	if e.config.MeansGraph == "" || len(xs) == 0 {
+		return nil
+	}
+	add := func(ys []float64, legend string, chartType plot.ChartType) error {
+		plt, err := plot.NewXYPlot(xs, ys)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", legend)
+		}
+		plt.SetLegend(e.Prefix(legend)).SetYLabel("log-profit").SetChartType(chartType)
+		if err := experiments.AddPlot(e.context, plt, e.config.MeansGraph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", legend)
+		}
+		return nil
+	}
+	if err := add(means, "conditional mean", plot.ChartLine); err != nil {
+		return err
+	}
+	confidence := fmt.Sprintf("%g%%", e.config.Confidence)
+	if err := add(lows, "conditional low "+confidence, plot.ChartDashed); err != nil {
+		return err
+	}
+	if err := add(highs, "conditional high "+confidence, plot.ChartDashed); err != nil {
+		return err
+	}
+	if err := add(uncondMeans, "unconditional mean", plot.ChartLine); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crash
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCrash(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_crash")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Crash experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		condGraph, err := canvas.EnsureGraph(plot.KindXY, "cond", "g")
+		So(err, ShouldBeNil)
+		uncondGraph, err := canvas.EnsureGraph(plot.KindXY, "uncond", "g")
+		So(err, ShouldBeNil)
+		meansGraph, err := canvas.EnsureGraph(plot.KindXY, "means", "g")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"A": {}}
+		pr := func(date string, p float32) db.PriceRow {
+			d, err := db.NewDateFromString(date)
+			if err != nil {
+				panic(err)
+			}
+			return db.TestPrice(d, p, p, p, 1000.0, true)
+		}
+		prices := map[string][]db.PriceRow{
+			"A": {
+				pr("2020-01-01", 100),
+				pr("2020-01-02", 80), // the crash
+				pr("2020-01-03", 88),
+				pr("2020-01-06", 90),
+				pr("2020-01-07", 85),
+				pr("2020-01-08", 86),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		var cfg config.Crash
+		So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "horizons": [1, 2],
+  "conditional plot": {"graph": "cond"},
+  "unconditional plot": {"graph": "uncond"},
+  "means graph": "means",
+  "bootstrap samples": 10
+}`, tmpdir, dbName))), ShouldBeNil)
+		var e Crash
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		So(values, ShouldResemble, experiments.Values{
+			"test tickers":                  "1",
+			"test samples":                  "5",
+			"test events":                   "1",
+			"test conditional mean 1d":      "0.09531",
+			"test conditional mean 1d low":  "0.09531",
+			"test conditional mean 1d high": "0.09531",
+			"test conditional mean 2d":      "0.1178",
+			"test conditional mean 2d low":  "0.1178",
+			"test conditional mean 2d high": "0.1178",
+			"test unconditional mean 1d":    "0.01808",
+			"test unconditional mean 2d":    "0.01255",
+		})
+		So(len(condGraph.Plots), ShouldEqual, 2)
+		So(len(uncondGraph.Plots), ShouldEqual, 2)
+		So(len(meansGraph.Plots), ShouldEqual, 4)
+		So(meansGraph.Plots[0].X, ShouldResemble, []float64{1, 2})
+	})
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crosscorr is an experiment with the lead-lag cross-correlation of
+// log-profit series relative to a leader series, such as an index.
+package crosscorr
+
+import (
+	"context"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type CrossCorrelation struct {
+	config  *config.CrossCorrelation
+	context context.Context
+	leader  *stats.Timeseries
+}
+
+var _ experiments.Experiment = &CrossCorrelation{}
+
+func (e *CrossCorrelation) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *CrossCorrelation) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *CrossCorrelation) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.CrossCorrelation); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	it, err := experiments.Source(ctx, e.config.Leader)
+	if err != nil {
+		return errors.Annotate(err, "failed to get leader series")
+	}
+	lps := iterator.ToSlice[experiments.LogProfits](it)
+	it.Close()
+	if len(lps) != 1 {
+		return errors.Reason("expected exactly one leader series, got %d", len(lps))
+	}
+	e.leader = lps[0].Timeseries
+
+	fit, err := experiments.SourceMap(ctx, e.config.Follower, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process follower data")
+	}
+	defer fit.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j1.Merge(j2) }
+	total := iterator.Reduce[*jobResult, *jobResult](fit, e.newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+// tickerCorr is the cross-correlation of a single follower ticker.
+type tickerCorr struct {
+	ticker string
+	corrs  []float64
+}
+
+type jobResult struct {
+	// Sums of normalized F(t) * L(t-shift) for shifts [-max..max], and the number
+	// of samples for each sum.
+	sums       []float64
+	ns         []int
+	numTickers int
+	tickers    []tickerCorr // only in "per ticker" mode
+}
+
+func (e *CrossCorrelation) newJobResult() *jobResult {
+	n := 2*e.config.MaxShift + 1
+	return &jobResult{
+		sums: make([]float64, n),
+		ns:   make([]int, n),
+	}
+}
+
+// Add the cross-correlation sums for the aligned follower and leader samples.
+func (j *jobResult) Add(follower, leader []float64, maxShift int) error {
+	fs := stats.NewSample(follower)
+	ls := stats.NewSample(leader)
+	norm := fs.Sigma() * ls.Sigma()
+	if norm == 0 {
+		return errors.Reason("log-profits have zero variance")
+	}
+	fMean, lMean := fs.Mean(), ls.Mean()
+	j.numTickers++
+	for k := range j.sums {
+		shift := k - maxShift
+		for i := 0; i < len(follower); i++ {
+			l := i - shift
+			if l < 0 || l >= len(leader) {
+				continue
+			}
+			j.sums[k] += (follower[i] - fMean) * (leader[l] - lMean) / norm
+			j.ns[k]++
+		}
+	}
+	return nil
+}
+
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	if len(j.sums) != len(j2.sums) {
+		panic(errors.Reason("jobResult: size=%d != size=%d",
+			len(j.sums), len(j2.sums)))
+	}
+	for i := 0; i < len(j.sums); i++ {
+		j.sums[i] += j2.sums[i]
+		j.ns[i] += j2.ns[i]
+	}
+	j.numTickers += j2.numTickers
+	j.tickers = append(j.tickers, j2.tickers...)
+	return j
+}
+
+// Correlations for each shift in [-max..max].
+func (j *jobResult) Correlations() []float64 {
+	res := make([]float64, len(j.sums))
+	for i := range j.sums {
+		if j.ns[i] != 0 {
+			res[i] = j.sums[i] / float64(j.ns[i])
+		}
+	}
+	return res
+}
+
+func (e *CrossCorrelation) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := e.newJobResult()
+	perTicker := e.config.Mode == "per ticker"
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		tss := stats.TimeseriesIntersect(lp.Timeseries, e.leader)
+		follower, leader := tss[0].Data(), tss[1].Data()
+		if len(follower) < e.config.MaxShift+2 {
+			logging.Warningf(e.context, "skipping %s, too few samples: %d",
+				lp.Ticker, len(follower))
+			continue
+		}
+		var j *jobResult
+		if perTicker {
+			j = e.newJobResult()
+		} else {
+			j = res
+		}
+		if err := j.Add(follower, leader, e.config.MaxShift); err != nil {
+			logging.Warningf(e.context, "skipping %s: %s", lp.Ticker, err.Error())
+			continue
+		}
+		if perTicker {
+			res.Merge(j)
+			res.tickers = append(res.tickers, tickerCorr{
+				ticker: lp.Ticker,
+				corrs:  j.Correlations(),
+			})
+		}
+	}
+	return res
+}
+
+func (e *CrossCorrelation) addPlot(corrs []float64, legend string) error {
+	xs := make([]float64, len(corrs))
+	for i := range xs {
+		xs[i] = float64(i - e.config.MaxShift)
+	}
+	plt, err := plot.NewXYPlot(xs, corrs)
+	if err != nil {
+		return errors.Annotate(err, "failed to create '%s' plot", legend)
+	}
+	legend = e.Prefix(legend)
+	plt.SetLegend(legend).SetYLabel("correlation")
+	if err := experiments.AddPlot(e.context, plt, e.config.Graph); err != nil {
+		return errors.Annotate(err, "failed to add '%s' plot", legend)
+	}
+	return nil
+}
+
+func (e *CrossCorrelation) processTotal(total *jobResult) error {
+	err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	err = experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(total.ns[e.config.MaxShift]))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of samples")
+	}
+	if e.config.Mode == "per ticker" {
+		sort.Slice(total.tickers, func(i, j int) bool {
+			return total.tickers[i].ticker < total.tickers[j].ticker
+		})
+		for _, t := range total.tickers {
+			if err := e.addPlot(t.corrs, t.ticker); err != nil {
+				return errors.Annotate(err, "failed to add correlation plot for %s", t.ticker)
+			}
+		}
+		return nil
+	}
+	if err := e.addPlot(total.Correlations(), "Cross-correlation"); err != nil {
+		return errors.Annotate(err, "failed to add correlation plot")
+	}
+	return nil
+}
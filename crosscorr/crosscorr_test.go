@@ -0,0 +1,131 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crosscorr
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCrossCorrelation(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_crosscorr")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("CrossCorrelation works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		g, err := canvas.EnsureGraph(plot.KindXY, "g", "corr")
+		So(err, ShouldBeNil)
+
+		// The followers A and B repeat the index log-profits with a 1 day lag.
+		r := rand.New(rand.NewSource(42))
+		var indexLPs []float64
+		for i := 0; i < 100; i++ {
+			indexLPs = append(indexLPs, 0.02*r.NormFloat64())
+		}
+		lagged := append([]float64{0.01}, indexLPs[:len(indexLPs)-1]...)
+		start := db.NewDate(2020, 1, 1).ToTime()
+		pricesFor := func(lps []float64) []db.PriceRow {
+			p := 100.0
+			rows := []db.PriceRow{db.TestPrice(db.NewDateFromTime(start), float32(p), float32(p), float32(p), 1000, true)}
+			for i, lp := range lps {
+				p *= math.Exp(lp)
+				d := db.NewDateFromTime(start.AddDate(0, 0, i+1))
+				rows = append(rows, db.TestPrice(d, float32(p), float32(p), float32(p), 1000, true))
+			}
+			return rows
+		}
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"INDEX": {}, "A": {}, "B": {}}
+		prices := map[string][]db.PriceRow{
+			"INDEX": pricesFor(indexLPs),
+			"A":     pricesFor(lagged),
+			"B":     pricesFor(lagged),
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+		confJSON := func(mode string) string {
+			return fmt.Sprintf(`
+{
+  "id": "test",
+  "leader": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["INDEX"]}},
+  "follower": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["A", "B"]}},
+  "graph": "g",
+  "max shift": 2,
+  "mode": "%[3]s"
+}`, tmpdir, dbName, mode)
+		}
+
+		Convey("pooled", func() {
+			var cfg config.CrossCorrelation
+			So(cfg.InitMessage(testutil.JSON(confJSON("pooled"))), ShouldBeNil)
+			var e CrossCorrelation
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values, ShouldResemble, experiments.Values{
+				"test tickers": "2",
+				"test samples": "200",
+			})
+			So(len(g.Plots), ShouldEqual, 1)
+			So(g.Plots[0].Legend, ShouldEqual, "test Cross-correlation")
+			So(g.Plots[0].X, ShouldResemble, []float64{-2, -1, 0, 1, 2})
+			ys := g.Plots[0].Y
+			So(ys[3], ShouldBeGreaterThan, 0.9) // the index leads by 1 day
+			for i, y := range ys {
+				if i != 3 {
+					So(math.Abs(y), ShouldBeLessThan, 0.3)
+				}
+			}
+		})
+
+		Convey("per ticker", func() {
+			var cfg config.CrossCorrelation
+			So(cfg.InitMessage(testutil.JSON(confJSON("per ticker"))), ShouldBeNil)
+			var e CrossCorrelation
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 2)
+			So(g.Plots[0].Legend, ShouldEqual, "test A")
+			So(g.Plots[1].Legend, ShouldEqual, "test B")
+			So(testutil.RoundSlice(g.Plots[0].Y, 5), ShouldResemble,
+				testutil.RoundSlice(g.Plots[1].Y, 5))
+			So(g.Plots[0].Y[3], ShouldBeGreaterThan, 0.9)
+		})
+	})
+}
@@ -0,0 +1,215 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dataquality is an experiment screening price series for suspicious
+// patterns which usually indicate data errors: streaks of zero volume or of
+// identical prices, large single-day moves which immediately reverse, and gaps
+// in the dates.
+package dataquality
+
+import (
+	"context"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/table"
+)
+
+type DataQuality struct {
+	config *config.DataQuality
+}
+
+var _ experiments.Experiment = &DataQuality{}
+
+func (e *DataQuality) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *DataQuality) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *DataQuality) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.DataQuality); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	it, err := experiments.SourceMapPrices(ctx, e.config.Data, e.processPrices)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j1.Merge(j2) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, &jobResult{}, f)
+	if err := e.processTotal(ctx, total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+// Row is the counts of the suspicious patterns in a ticker's series.
+type Row struct {
+	Ticker     string
+	ZeroVolume int // streaks of zero volume
+	Repeated   int // streaks of identical closing prices
+	Reversals  int // large single-day moves reversed the next day
+	Gaps       int // gaps in the dates
+	NumSamples int
+	StartDate  db.Date
+	EndDate    db.Date
+}
+
+var _ table.Row = Row{}
+
+// Header of the CSV table.
+func Header() []string {
+	return []string{"Ticker", "Zero Volume Streaks", "Repeated Price Streaks",
+		"Reversals", "Gaps", "Samples", "Start", "End"}
+}
+
+func (r Row) CSV() []string {
+	i := strconv.Itoa
+	return []string{r.Ticker, i(r.ZeroVolume), i(r.Repeated), i(r.Reversals),
+		i(r.Gaps), i(r.NumSamples), r.StartDate.String(), r.EndDate.String()}
+}
+
+// Flagged is true when the series has any of the suspicious patterns.
+func (r Row) Flagged() bool {
+	return r.ZeroVolume+r.Repeated+r.Reversals+r.Gaps > 0
+}
+
+type jobResult struct {
+	flagged    []Row
+	numTickers int
+}
+
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	j.flagged = append(j.flagged, j2.flagged...)
+	j.numTickers += j2.numTickers
+	return j
+}
+
+// streaks counts the runs of at least n consecutive indices in [0..length)
+// for which in(i) is true.
+func streaks(length, n int, in func(i int) bool) int {
+	var res, run int
+	for i := 0; i < length; i++ {
+		if !in(i) {
+			run = 0
+			continue
+		}
+		run++
+		if run == n {
+			res++
+		}
+	}
+	return res
+}
+
+// Screen the price rows of a single ticker, sorted by date.
+func Screen(ticker string, rows []db.PriceRow, c *config.DataQuality) Row {
+	r := Row{Ticker: ticker, NumSamples: len(rows)}
+	if len(rows) == 0 {
+		return r
+	}
+	r.StartDate = rows[0].Date
+	r.EndDate = rows[len(rows)-1].Date
+	r.ZeroVolume = streaks(len(rows), c.ZeroVolumeDays, func(i int) bool {
+		return rows[i].CashVolume == 0
+	})
+	// A run of n identical prices has n-1 consecutive repeats.
+	r.Repeated = streaks(len(rows), c.RepeatedDays-1, func(i int) bool {
+		return i > 0 && rows[i].CloseFullyAdjusted == rows[i-1].CloseFullyAdjusted
+	})
+	for i := 1; i < len(rows); i++ {
+		prev := rows[i-1].Date.Date().ToTime()
+		days := int(rows[i].Date.Date().ToTime().Sub(prev).Hours() / 24)
+		if days >= c.GapDays {
+			r.Gaps++
+		}
+	}
+	lp := func(i int) float64 {
+		p, prev := float64(rows[i].CloseFullyAdjusted), float64(rows[i-1].CloseFullyAdjusted)
+		if p <= 0 || prev <= 0 {
+			return 0
+		}
+		return math.Log(p / prev)
+	}
+	threshold := -math.Log(1 - c.Move)
+	for i := 1; i+1 < len(rows); i++ {
+		x, next := lp(i), lp(i+1)
+		if math.Abs(x) >= threshold && x*next < 0 && math.Abs(next) >= math.Abs(x)/2 {
+			r.Reversals++
+		}
+	}
+	return r
+}
+
+func (e *DataQuality) processPrices(prices []experiments.Prices) *jobResult {
+	res := &jobResult{}
+	for _, p := range prices {
+		if r := Screen(p.Ticker, p.Rows, e.config); r.Flagged() {
+			res.flagged = append(res.flagged, r)
+		}
+		res.numTickers++
+	}
+	return res
+}
+
+func (e *DataQuality) processTotal(ctx context.Context, j *jobResult) error {
+	sort.Slice(j.flagged, func(i, k int) bool {
+		return j.flagged[i].Ticker < j.flagged[k].Ticker
+	})
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "tickers", experiments.IntValue(j.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add tickers value")
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "flagged tickers", experiments.IntValue(len(j.flagged))); err != nil {
+		return errors.Annotate(err, "failed to add flagged tickers value")
+	}
+	t := table.NewTable(Header()...)
+	for _, r := range j.flagged {
+		t.AddRow(r)
+	}
+	if err := e.writeTable(ctx, t); err != nil {
+		return errors.Annotate(err, "failed to write the table")
+	}
+	return nil
+}
+
+func (e *DataQuality) writeTable(ctx context.Context, t *table.Table) error {
+	if e.config.File == "" {
+		if err := t.WriteText(os.Stdout, table.Params{}); err != nil {
+			return errors.Annotate(err, "failed to write table to stdout")
+		}
+		return nil
+	}
+	path := experiments.OutputPath(ctx, e.config.File)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "failed to open output CSV file '%s'", path)
+	}
+	defer f.Close()
+	if err = t.WriteCSV(f, table.Params{}); err != nil {
+		return errors.Annotate(err, "failed to write CSV file '%s'", path)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataquality
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDataQuality(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_dataquality")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	pr := func(date string, p, v float32) db.PriceRow {
+		d, err := db.NewDateFromString(date)
+		if err != nil {
+			panic(err)
+		}
+		return db.TestPrice(d, p, p, p, v, true)
+	}
+
+	var cfg config.DataQuality
+	initCfg := func(js string) {
+		So(cfg.InitMessage(testutil.JSON(js)), ShouldBeNil)
+	}
+
+	Convey("Screen works", t, func() {
+		initCfg(`{
+  "data": {"daily distribution": {"name": "t"}},
+  "zero volume days": 2,
+  "repeated price days": 3,
+  "move": 0.5
+}`)
+
+		Convey("clean series", func() {
+			r := Screen("A", []db.PriceRow{
+				pr("2020-01-02", 10, 100),
+				pr("2020-01-03", 11, 100),
+				pr("2020-01-06", 10, 100),
+			}, &cfg)
+			So(r.Flagged(), ShouldBeFalse)
+			So(r.NumSamples, ShouldEqual, 3)
+		})
+
+		Convey("all patterns", func() {
+			r := Screen("A", []db.PriceRow{
+				pr("2020-01-02", 10, 0),
+				pr("2020-01-03", 10, 0), // zero volume streak
+				pr("2020-01-06", 10, 0), // repeated price streak
+				pr("2020-01-07", 4, 100),
+				pr("2020-01-08", 9, 100),  // -0.92 reversed by +0.81
+				pr("2020-01-31", 10, 100), // gap
+				pr("2020-02-03", 20, 100), // +0.69 not reversed
+			}, &cfg)
+			So(r.Flagged(), ShouldBeTrue)
+			So(r.ZeroVolume, ShouldEqual, 1)
+			So(r.Repeated, ShouldEqual, 1)
+			So(r.Reversals, ShouldEqual, 1)
+			So(r.Gaps, ShouldEqual, 1)
+			So(r.CSV(), ShouldResemble, []string{
+				"A", "1", "1", "1", "1", "7", "2020-01-02", "2020-02-03"})
+		})
+
+		Convey("config validation", func() {
+			So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"daily distribution": {"name": "t"}},
+  "move": 1
+}`)), ShouldNotBeNil)
+			So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"daily distribution": {"name": "t"}},
+  "repeated price days": 1
+}`)), ShouldNotBeNil)
+		})
+	})
+
+	Convey("DataQuality experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		values := make(experiments.Values)
+		ctx = experiments.UseValues(ctx, values)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"A": {}, "B": {}}
+		prices := map[string][]db.PriceRow{
+			"A": {
+				pr("2020-01-02", 10, 100),
+				pr("2020-01-03", 11, 100),
+			},
+			"B": {
+				pr("2020-01-02", 10, 100),
+				pr("2020-02-03", 10, 100),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+		csvFile := filepath.Join(tmpdir, "flagged.csv")
+		initCfg(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "file": "%s"
+}`, tmpdir, dbName, csvFile))
+		var e DataQuality
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		So(values, ShouldResemble, experiments.Values{
+			"test tickers":         "2",
+			"test flagged tickers": "1",
+		})
+		csvData, err := os.ReadFile(csvFile)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(csvData)), "\n")
+		So(len(lines), ShouldEqual, 2)
+		So(lines[1], ShouldEqual, "B,0,0,0,1,2,2020-01-02,2020-02-03")
+	})
+}
@@ -0,0 +1,438 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deciles is a cross-sectional experiment with monthly rebalanced
+// portfolios.
+//
+// At the start of each month, tickers are ranked by a trailing statistic and
+// split into equal groups (deciles by default). The experiment then studies the
+// next month's log-profits of each group, and of the long-short portfolio
+// holding the top group and shorting the bottom one.
+package deciles
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Deciles struct {
+	config  *config.Deciles
+	context context.Context
+	refTS   *stats.Timeseries // reference log-profits for beta and alpha
+}
+
+var _ experiments.Experiment = &Deciles{}
+
+func (e *Deciles) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Deciles) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Deciles) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Deciles); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	if e.config.Reference != nil {
+		if err := e.processReference(); err != nil {
+			return errors.Annotate(err, "failed to process reference data")
+		}
+	}
+	var it iterator.IteratorCloser[*jobResult]
+	var err error
+	if e.config.Data.DB != nil {
+		it, err = experiments.SourceMapPrices(ctx, e.config.Data, e.processPrices)
+	} else {
+		it, err = experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	}
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j2.Merge(j1) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+func (e *Deciles) processReference() error {
+	it, err := experiments.Source(e.context, e.config.Reference)
+	if err != nil {
+		return errors.Annotate(err, "failed to get reference price series")
+	}
+	lps := iterator.ToSlice[experiments.LogProfits](it)
+	it.Close()
+	if len(lps) != 1 {
+		return errors.Reason(
+			"reference should yield exactly one series, got %d", len(lps))
+	}
+	e.refTS = lps[0].Timeseries
+	return nil
+}
+
+// sample is a ticker's trailing statistic at the start of a month and its
+// log-profit over that month.
+type sample struct {
+	ticker  string
+	stat    float64
+	forward float64
+	volume  float64 // average daily dollar volume, 0 when unknown
+}
+
+type jobResult struct {
+	months     map[db.Date][]sample // keyed by the first day of the month
+	numTickers int
+}
+
+func newJobResult() *jobResult {
+	return &jobResult{months: make(map[db.Date][]sample)}
+}
+
+// Merge j2 into j and return j.
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	for m, s := range j2.months {
+		j.months[m] = append(j.months[m], s...)
+	}
+	j.numTickers += j2.numTickers
+	return j
+}
+
+// statistic computes the configured statistic of the log-profits p, where ref
+// is the corresponding reference log-profits, if any.
+func (e *Deciles) statistic(p, ref []float64) float64 {
+	switch e.config.Statistic {
+	case "MAD":
+		return stats.NewSample(p).MAD()
+	case "beta", "alpha":
+		beta, alpha, err := experiments.LeastSquares(ref, p)
+		if err != nil {
+			panic(errors.Annotate(err, "failed to compute %s", e.config.Statistic))
+		}
+		if e.config.Statistic == "beta" {
+			return beta
+		}
+		return alpha
+	}
+	var sum float64 // momentum
+	for _, x := range p {
+		sum += x
+	}
+	return sum
+}
+
+func (e *Deciles) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := newJobResult()
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		e.processTicker(lp.Ticker, lp.Timeseries, nil, res)
+	}
+	return res
+}
+
+func (e *Deciles) processPrices(prices []experiments.Prices) *jobResult {
+	res := newJobResult()
+	for _, p := range prices {
+		if e.context.Err() != nil {
+			break
+		}
+		ts := experiments.PricesLogProfits(e.config.Data, p)
+		if len(ts.Data()) == 0 {
+			continue
+		}
+		vol := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceCashVolume)
+		e.processTicker(p.Ticker, ts, vol, res)
+	}
+	return res
+}
+
+// processTicker adds monthly samples for the ticker's log-profits ts and the
+// optional daily dollar volume vol.
+func (e *Deciles) processTicker(ticker string, ts, vol *stats.Timeseries, res *jobResult) {
+	tss := []*stats.Timeseries{ts}
+	if e.refTS != nil {
+		tss = append(tss, e.refTS)
+	}
+	if vol != nil {
+		tss = append(tss, vol)
+	}
+	tss = stats.TimeseriesIntersect(tss...)
+	ts = tss[0]
+	var ref, volumes []float64
+	if e.refTS != nil {
+		ref = tss[1].Data()
+	}
+	if vol != nil {
+		volumes = tss[len(tss)-1].Data()
+	}
+	dates := ts.Dates()
+	data := ts.Data()
+	// Indices of the first days of each month in the series.
+	var starts []int
+	for i := 1; i < len(dates); i++ {
+		if dates[i].MonthStart() != dates[i-1].MonthStart() {
+			starts = append(starts, i)
+		}
+	}
+	for k := 0; k+1 < len(starts); k++ {
+		i, next := starts[k], starts[k+1]
+		if i < e.config.Window {
+			continue
+		}
+		var r []float64
+		if ref != nil {
+			r = ref[i-e.config.Window : i]
+		}
+		s := sample{
+			ticker: ticker,
+			stat:   e.statistic(data[i-e.config.Window:i], r),
+		}
+		for _, x := range data[i:next] {
+			s.forward += x
+		}
+		if volumes != nil {
+			start := i - e.config.VolumeWindow
+			if start < 0 {
+				start = 0
+			}
+			s.volume = stats.NewSample(volumes[start:i]).Mean()
+		}
+		m := dates[i].MonthStart()
+		res.months[m] = append(res.months[m], s)
+	}
+	res.numTickers++
+}
+
+func (e *Deciles) processTotal(total *jobResult) error {
+	var months []db.Date
+	for m, s := range total.months {
+		if len(s) >= e.config.MinTickers {
+			months = append(months, m)
+		}
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+
+	groups := make([][]float64, e.config.Groups) // monthly mean log-profits
+	longShort := make([]float64, len(months))
+	var h holdings
+	for k, m := range months {
+		s := total.months[m]
+		sort.Slice(s, func(i, j int) bool { return s[i].stat < s[j].stat })
+		sums := make([]float64, e.config.Groups)
+		counts := make([]int, e.config.Groups)
+		var long, short []sample // the top and the bottom groups
+		for i, x := range s {
+			g := i * e.config.Groups / len(s)
+			sums[g] += x.forward
+			counts[g]++
+			switch g {
+			case 0:
+				short = append(short, x)
+			case e.config.Groups - 1:
+				long = append(long, x)
+			}
+		}
+		for g := range groups {
+			groups[g] = append(groups[g], sums[g]/float64(counts[g]))
+		}
+		longShort[k] = groups[e.config.Groups-1][k] - groups[0][k]
+		consecutive := k > 0 && months[k-1].MonthStart() ==
+			db.NewDateFromTime(m.ToTime().AddDate(0, -1, 0)).MonthStart()
+		h.add(long, short, consecutive, e.config.Participation)
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "months", experiments.IntValue(len(months))); err != nil {
+		return errors.Annotate(err, "failed to add value for number of months")
+	}
+	if len(months) == 0 {
+		return nil
+	}
+	mean := func(d []float64) float64 { return stats.NewSample(d).Mean() }
+	interval := func(d []float64) (m, low, high float64) {
+		low, high = experiments.BootstrapInterval(d, mean,
+			e.config.BootstrapSamples, e.config.Confidence, experiments.Seed(e.context, 0))
+		return mean(d), low, high
+	}
+	var xs, means, lows, highs []float64
+	for g, d := range groups {
+		m, low, high := interval(d)
+		xs = append(xs, float64(g+1))
+		means = append(means, m)
+		lows = append(lows, low)
+		highs = append(highs, high)
+		k := fmt.Sprintf("group %d mean", g+1)
+		if err := experiments.AddInterval(e.context, e.config.ID, k, m, low, high); err != nil {
+			return errors.Annotate(err, "failed to add value for %s", k)
+		}
+	}
+	m, low, high := interval(longShort)
+	if err := experiments.AddInterval(e.context, e.config.ID, "long-short mean", m, low, high); err != nil {
+		return errors.Annotate(err, "failed to add value for long-short mean")
+	}
+	if err := e.processHoldings(&h); err != nil {
+		return errors.Annotate(err, "failed to process holdings")
+	}
+	if err := e.plotGroups(xs, means, lows, highs); err != nil {
+		return errors.Annotate(err, "failed to plot group means")
+	}
+	if err := e.plotLongShort(months, longShort); err != nil {
+		return errors.Annotate(err, "failed to plot long-short series")
+	}
+	return nil
+}
+
+// position in the long-short portfolio.
+type position struct {
+	ticker string
+	long   bool
+}
+
+// holdings accumulates the realism metrics of the long-short portfolio.
+type holdings struct {
+	prev       map[position]bool // previous month's positions
+	turnovers  []float64
+	volumes    []float64
+	capacities []float64
+}
+
+// add the current month's long and short positions. Turnover is only computed
+// when the previous month's positions are for the immediately preceding month.
+func (h *holdings) add(long, short []sample, consecutive bool, participation float64) {
+	current := make(map[position]bool)
+	var changed int
+	minVolume := math.Inf(1)
+	add := func(x sample, isLong bool) {
+		p := position{ticker: x.ticker, long: isLong}
+		current[p] = true
+		if !h.prev[p] {
+			changed++
+		}
+		if x.volume > 0 {
+			h.volumes = append(h.volumes, x.volume)
+		}
+		minVolume = math.Min(minVolume, x.volume)
+	}
+	for _, x := range long {
+		add(x, true)
+	}
+	for _, x := range short {
+		add(x, false)
+	}
+	n := len(long) + len(short)
+	if consecutive && n > 0 {
+		h.turnovers = append(h.turnovers, float64(changed)/float64(n))
+	}
+	if n > 0 && minVolume > 0 {
+		h.capacities = append(h.capacities, float64(n)*participation*minVolume)
+	}
+	h.prev = current
+}
+
+func (e *Deciles) processHoldings(h *holdings) error {
+	metrics := []struct {
+		name string
+		data []float64
+		c    *config.DistributionPlot
+	}{
+		{"turnover", h.turnovers, e.config.TurnoverPlot},
+		{"dollar volume", h.volumes, e.config.VolumePlot},
+		{"capacity", h.capacities, e.config.CapacityPlot},
+	}
+	for _, m := range metrics {
+		if len(m.data) == 0 {
+			continue
+		}
+		v := experiments.FloatValue(stats.NewSample(m.data).Mean())
+		if err := experiments.AddTypedValue(e.context, e.config.ID, "mean "+m.name, v); err != nil {
+			return errors.Annotate(err, "failed to add value for mean %s", m.name)
+		}
+		if m.c == nil {
+			continue
+		}
+		dist := experiments.NewSampleDistribution(m.data, m.c)
+		if err := experiments.PlotDistribution(e.context, dist, m.c, e.config.ID, m.name); err != nil {
+			return errors.Annotate(err, "failed to plot %s", m.name)
+		}
+	}
+	return nil
+}
+
+func (e *Deciles) plotGroups(xs, means, lows, highs []float64) error {
+	if e.config.DecilesGraph == "" {
+		return nil
+	}
+	add := func(ys []float64, legend string, chartType plot.ChartType) error {
+		plt, err := plot.NewXYPlot(xs, ys)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", legend)
+		}
+		plt.SetLegend(e.Prefix(legend)).SetYLabel("log-profit").SetChartType(chartType)
+		if err := experiments.AddPlot(e.context, plt, e.config.DecilesGraph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", legend)
+		}
+		return nil
+	}
+	if err := add(means, e.config.Statistic+" group mean", plot.ChartLine); err != nil {
+		return err
+	}
+	confidence := fmt.Sprintf("%g%%", e.config.Confidence)
+	if err := add(lows, "low "+confidence, plot.ChartDashed); err != nil {
+		return err
+	}
+	if err := add(highs, "high "+confidence, plot.ChartDashed); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *Deciles) plotLongShort(months []db.Date, longShort []float64) error {
+	if e.config.LongShortGraph == "" {
+		return nil
+	}
+	cumul := make([]float64, len(longShort))
+	var sum float64
+	for i, x := range longShort {
+		sum += x
+		cumul[i] = sum
+	}
+	plt, err := plot.NewSeriesPlot(stats.NewTimeseries(months, cumul))
+	if err != nil {
+		return errors.Annotate(err, "failed to create long-short plot")
+	}
+	plt.SetLegend(e.Prefix(e.config.Statistic + " long-short")).SetYLabel("log-profit")
+	if err := experiments.AddPlot(e.context, plt, e.config.LongShortGraph); err != nil {
+		return errors.Annotate(err, "failed to add long-short plot")
+	}
+	return nil
+}
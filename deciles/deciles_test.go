@@ -0,0 +1,181 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deciles
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeciles(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_deciles")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Deciles experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		groupsGraph, err := canvas.EnsureGraph(plot.KindXY, "groups", "g")
+		So(err, ShouldBeNil)
+		lsGraph, err := canvas.EnsureGraph(plot.KindSeries, "ls", "s")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"A": {}, "B": {}}
+		pr := func(date string, p float32) db.PriceRow {
+			d, err := db.NewDateFromString(date)
+			if err != nil {
+				panic(err)
+			}
+			return db.TestPrice(d, p, p, p, 1000.0, true)
+		}
+		prices := map[string][]db.PriceRow{
+			"A": {
+				pr("2020-01-29", 100),
+				pr("2020-01-30", 100),
+				pr("2020-01-31", 110),
+				pr("2020-02-03", 121),
+				pr("2020-02-04", 121),
+				pr("2020-03-02", 100),
+			},
+			"B": {
+				pr("2020-01-29", 100),
+				pr("2020-01-30", 100),
+				pr("2020-01-31", 90),
+				pr("2020-02-03", 81),
+				pr("2020-02-04", 90),
+				pr("2020-03-02", 90),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		var cfg config.Deciles
+		So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "window": 2,
+  "groups": 2,
+  "min tickers": 2,
+  "deciles graph": "groups",
+  "long-short graph": "ls",
+  "bootstrap samples": 10
+}`, tmpdir, dbName))), ShouldBeNil)
+		var e Deciles
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		So(values, ShouldResemble, experiments.Values{
+			"test tickers":              "2",
+			"test months":               "1",
+			"test group 1 mean":         "0",
+			"test group 1 mean low":     "0",
+			"test group 1 mean high":    "0",
+			"test group 2 mean":         "0.09531",
+			"test group 2 mean low":     "0.09531",
+			"test group 2 mean high":    "0.09531",
+			"test long-short mean":      "0.09531",
+			"test long-short mean low":  "0.09531",
+			"test long-short mean high": "0.09531",
+			"test mean dollar volume":   "1000",
+			"test mean capacity":        "20",
+		})
+		So(len(groupsGraph.Plots), ShouldEqual, 3)
+		So(groupsGraph.Plots[0].X, ShouldResemble, []float64{1, 2})
+		So(len(lsGraph.Plots), ShouldEqual, 1)
+	})
+
+	Convey("Deciles turnover works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		values := make(experiments.Values)
+		ctx = experiments.UseValues(ctx, values)
+
+		dbName := "turnover"
+		tickers := map[string]db.TickerRow{"A": {}, "B": {}}
+		pr := func(date string, p float32) db.PriceRow {
+			d, err := db.NewDateFromString(date)
+			if err != nil {
+				panic(err)
+			}
+			return db.TestPrice(d, p, p, p, 1000.0, true)
+		}
+		// A is in the top group in February, and B is in March.
+		prices := map[string][]db.PriceRow{
+			"A": {
+				pr("2020-01-29", 100),
+				pr("2020-01-30", 100),
+				pr("2020-01-31", 110),
+				pr("2020-02-03", 121),
+				pr("2020-02-04", 121),
+				pr("2020-03-02", 100),
+				pr("2020-03-03", 100),
+				pr("2020-04-01", 100),
+			},
+			"B": {
+				pr("2020-01-29", 100),
+				pr("2020-01-30", 100),
+				pr("2020-01-31", 90),
+				pr("2020-02-03", 81),
+				pr("2020-02-04", 100),
+				pr("2020-03-02", 90),
+				pr("2020-03-03", 90),
+				pr("2020-04-01", 90),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		var cfg config.Deciles
+		So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "window": 2,
+  "groups": 2,
+  "min tickers": 2,
+  "bootstrap samples": 10
+}`, tmpdir, dbName))), ShouldBeNil)
+		var e Deciles
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		So(values["test months"], ShouldEqual, "2")
+		So(values["test mean turnover"], ShouldEqual, "1")
+	})
+}
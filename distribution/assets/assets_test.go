@@ -36,6 +36,7 @@ func TestConfigs(t *testing.T) {
 		"by-sectors.json",
 		"by-volume.json",
 		"by-years.json",
+		"volume-deciles.json",
 	}
 
 	Convey("Configs parse successfully", t, func() {
@@ -18,12 +18,18 @@ package distribution
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/experiments"
 	"github.com/stockparfait/experiments/config"
 	"github.com/stockparfait/iterator"
 	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/stockparfait/stats"
 )
 
@@ -32,6 +38,9 @@ import (
 type Distribution struct {
 	context context.Context
 	config  *config.Distribution
+	groups  map[string]string // ticker -> group, in "group by" mode
+	// Average daily cash volume by ticker, for "weight" and "min volume".
+	volumes map[string]float64
 }
 
 var _ experiments.Experiment = &Distribution{}
@@ -44,6 +53,17 @@ func (d *Distribution) AddValue(ctx context.Context, k, v string) error {
 	return experiments.AddValue(ctx, d.config.ID, k, v)
 }
 
+// bucketSamples is the minimum number of the first (normalized) log-profits to
+// fit the "log-profits" buckets with "auto bounds" to. The log-profits are
+// buffered until then, and the later ones are added to the fitted histograms
+// directly, all in a single pass over the data.
+const bucketSamples = 100000
+
+// fitSamples is the size of the random sample of the (normalized) log-profits
+// retained for the maximum likelihood fit of "log-profits", and of each of its
+// groups, with the "mle" method of "derive alpha".
+const fitSamples = 100000
+
 func (d *Distribution) Run(ctx context.Context, cfg config.ExperimentConfig) error {
 	var ok bool
 	d.context = ctx
@@ -51,6 +71,25 @@ func (d *Distribution) Run(ctx context.Context, cfg config.ExperimentConfig) err
 		return errors.Reason("unexpected config type: %T", cfg)
 	}
 	id := d.config.ID
+	var err error
+	if d.config.Weight == "volume" || d.config.MinVolume > 0 {
+		if d.volumes, err = d.averageVolumes(); err != nil {
+			return errors.Annotate(err, "failed to get '%s' volumes", id)
+		}
+	}
+	if err := d.initGroups(); err != nil {
+		return errors.Annotate(err, "failed to group '%s' tickers", id)
+	}
+	if c := d.config.LogProfits; c != nil {
+		if b := experiments.LookupSharedBuckets(ctx, c); b != nil {
+			lp := *c
+			lp.Buckets = *b
+			lp.BucketRule = ""
+			cfg := *d.config // copy, to keep the original config intact
+			cfg.LogProfits = &lp
+			d.config = &cfg
+		}
+	}
 	it, err := experiments.SourceMap(ctx, d.config.Data, d.processLogProfits)
 	if err != nil {
 		return errors.Annotate(err, "failed to read data source")
@@ -58,111 +97,688 @@ func (d *Distribution) Run(ctx context.Context, cfg config.ExperimentConfig) err
 	defer it.Close()
 
 	sts := iterator.Reduce[*jobResult, *jobResult](
-		it, d.newJobResult(), reduceJobResult)
+		it, d.newJobResult(), d.reduceJobResult)
+	d.fitPending(sts, true)
+	if sts.err != nil {
+		return errors.Annotate(sts.err, "failed to fit '%s' log-profit buckets", id)
+	}
+	if sts.logProfits != nil && sts.logProfits != d.config.LogProfits {
+		cfg := *d.config // copy, to keep the original config intact
+		cfg.LogProfits = sts.logProfits
+		d.config = &cfg
+	}
 
-	if err := d.AddValue(ctx, "tickers", fmt.Sprintf("%d", sts.NumTickers)); err != nil {
+	if err := experiments.AddTypedValue(ctx, d.config.ID, "tickers", experiments.IntValue(sts.NumTickers)); err != nil {
 		return errors.Annotate(err, "failed to add '%s' tickers value", id)
 	}
 	if sts.Histogram != nil {
-		if err := d.AddValue(ctx, "samples", fmt.Sprintf("%d", sts.Histogram.CountsTotal())); err != nil {
+		if err := experiments.AddTypedValue(ctx, d.config.ID, "samples", experiments.IntValue(int(sts.Histogram.CountsTotal()))); err != nil {
 			return errors.Annotate(err, "failed to add '%s' samples value", id)
 		}
 	}
-	if sts.Histogram.CountsTotal() == 0 {
+	if d.config.Data.Winsorize != nil {
+		if err := experiments.AddTypedValue(ctx, d.config.ID, "clipped samples", experiments.IntValue(sts.Clipped)); err != nil {
+			return errors.Annotate(err, "failed to add '%s' clipped samples value", id)
+		}
+	}
+	if c := d.config.Tails; c != nil {
+		if err := d.processTail(sts.RightTail, sts.RightTailN, "right tail"); err != nil {
+			return errors.Annotate(err, "failed to process '%s' right tail", id)
+		}
+		if err := d.processTail(sts.LeftTail, sts.LeftTailN, "left tail"); err != nil {
+			return errors.Annotate(err, "failed to process '%s' left tail", id)
+		}
+	}
+	if sts.Histogram == nil || sts.Histogram.CountsTotal() == 0 {
 		return nil
 	}
-	if c := d.config.LogProfits; c != nil {
-		lpDist := stats.NewHistogramDistribution(sts.Histogram)
+	if c := d.config.LogProfits; c != nil && sts.Groups != nil {
+		if err := d.processGroups(sts.Groups, sts.GroupSamples); err != nil {
+			return errors.Annotate(err, "failed to process '%s' groups", id)
+		}
+	} else if c != nil {
+		lpDist := histogramDistribution(sts.Histogram, sts.Sample)
 		err := experiments.PlotDistribution(ctx, lpDist, c, id, "log-profit")
 		if err != nil {
 			return errors.Annotate(err, "failed to plot '%s' sample distribution", id)
 		}
 	}
 	if c := d.config.Means; c != nil {
-		meansDist := stats.NewSampleDistribution(sts.Means, &c.Buckets)
+		meansDist := experiments.NewSampleDistribution(sts.Means, c)
 		err := experiments.PlotDistribution(ctx, meansDist, c, id, "means")
 		if err != nil {
 			return errors.Annotate(err, "failed to plot '%s' means", id)
 		}
-		err = d.AddValue(ctx, "average mean", fmt.Sprintf("%.4g", meansDist.Mean()))
+		err = experiments.AddTypedValue(ctx, d.config.ID, "average mean", experiments.FloatValue(meansDist.Mean()))
 		if err != nil {
 			return errors.Annotate(err, "failed to add '%s' avg. mean", id)
 		}
 	}
-	if c := d.config.MeanStability; c != nil && len(sts.MeanStability) > 1 {
-		dist := stats.NewSampleDistribution(sts.MeanStability, &c.Plot.Buckets)
+	if c := d.config.MeanStability; c != nil && c.Plot != nil && len(sts.MeanStability) > 1 {
+		dist := experiments.NewSampleDistribution(sts.MeanStability, c.Plot)
 		err := experiments.PlotDistribution(ctx, dist, c.Plot, id, "mean stability")
 		if err != nil {
 			return errors.Annotate(err, "failed to plot '%s' mean stability", id)
 		}
 	}
-	if c := d.config.MADs; c != nil {
-		dist := stats.NewSampleDistribution(sts.MADs, &c.Buckets)
-		err := experiments.PlotDistribution(ctx, dist, c, id, "MADs")
+	if err := sts.MeanStabilityPoints.Plot(ctx, d.config.MeanStability, id, "mean stability scatter"); err != nil {
+		return errors.Annotate(err, "failed to plot '%s' mean stability scatter", id)
+	}
+	if err := sts.MeanStabilitySeries.Plot(ctx, d.config.MeanStability, id, "mean stability series"); err != nil {
+		return errors.Annotate(err, "failed to plot '%s' mean stability series", id)
+	}
+	for _, s := range []struct {
+		name      string
+		plot      *config.DistributionPlot
+		stability *config.StabilityPlot
+		stats     *scaleStats
+	}{
+		{"MAD", d.config.MADs, d.config.MADStability, &sts.MAD},
+		{"IQR", d.config.IQRs, d.config.IQRStability, &sts.IQR},
+		{"Qn", d.config.Qns, d.config.QnStability, &sts.Qn},
+	} {
+		if err := d.plotScale(ctx, s.name, s.plot, s.stability, s.stats); err != nil {
+			return errors.Annotate(err, "failed to plot '%s' %s statistics", id, s.name)
+		}
+	}
+	return nil
+}
+
+// plotScale plots the distribution of the per-ticker values of the scale
+// estimator, adds their average as a value, and plots its stability.
+func (d *Distribution) plotScale(ctx context.Context, name string, c *config.DistributionPlot, sc *config.StabilityPlot, s *scaleStats) error {
+	id := d.config.ID
+	if c != nil {
+		dist := experiments.NewSampleDistribution(s.Values, c)
+		err := experiments.PlotDistribution(ctx, dist, c, id, name+"s")
 		if err != nil {
-			return errors.Annotate(err, "failed to plot '%s' MADs distribution", id)
+			return errors.Annotate(err, "failed to plot '%s' %ss distribution", id, name)
 		}
-		err = d.AddValue(ctx, "average MAD", fmt.Sprintf("%.4g", dist.Mean()))
+		err = experiments.AddTypedValue(ctx, id, "average "+name, experiments.FloatValue(dist.Mean()))
 		if err != nil {
-			return errors.Annotate(err, "failed to add '%s' average MAD value", id)
+			return errors.Annotate(err, "failed to add '%s' average %s value", id, name)
 		}
 	}
-	if c := d.config.MADStability; c != nil && len(sts.MADStability) > 1 {
-		dist := stats.NewSampleDistribution(sts.MADStability, &c.Plot.Buckets)
-		err := experiments.PlotDistribution(ctx, dist, c.Plot, id, "MAD stability")
+	if sc != nil && sc.Plot != nil && len(s.Stability) > 1 {
+		dist := experiments.NewSampleDistribution(s.Stability, sc.Plot)
+		err := experiments.PlotDistribution(ctx, dist, sc.Plot, id, name+" stability")
 		if err != nil {
-			return errors.Annotate(err, "failed to plot '%s' MAD stability", id)
+			return errors.Annotate(err, "failed to plot '%s' %s stability", id, name)
 		}
 	}
+	if err := s.StabilityPoints.Plot(ctx, sc, id, name+" stability scatter"); err != nil {
+		return errors.Annotate(err, "failed to plot '%s' %s stability scatter", id, name)
+	}
+	if err := s.StabilitySeries.Plot(ctx, sc, id, name+" stability series"); err != nil {
+		return errors.Annotate(err, "failed to plot '%s' %s stability series", id, name)
+	}
 	return nil
 }
 
+// initGroups assigns tickers to groups in the "group by" mode.
+func (d *Distribution) initGroups() error {
+	r := d.config.Data.DB
+	switch d.config.GroupBy {
+	case "none":
+		return nil
+	case "volume decile":
+		return d.initVolumeGroups()
+	}
+	rows, err := r.AllTickerRows()
+	if err != nil {
+		return errors.Annotate(err, "failed to load ticker rows")
+	}
+	d.groups = make(map[string]string)
+	for t, row := range rows {
+		var g string
+		switch d.config.GroupBy {
+		case "sector":
+			g = row.Sector
+		case "industry":
+			g = row.Industry
+		case "exchange":
+			g = row.Exchange
+		case "activity":
+			g = activity(row)
+		}
+		if g != "" {
+			d.groups[t] = g
+		}
+	}
+	return nil
+}
+
+// activity is the survivorship group of the ticker: "active" if it is listed
+// at the last price date in the DB, and "delisted" otherwise.
+func activity(row db.TickerRow) string {
+	if row.Active {
+		return "active"
+	}
+	return "delisted"
+}
+
+// averageVolumes computes the average daily cash volume of each ticker from
+// the monthly data in the DB within the data's date range. Tickers without
+// monthly data are omitted.
+func (d *Distribution) averageVolumes() (map[string]float64, error) {
+	r := d.config.Data.DB
+	tickers, err := r.Tickers(d.context)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to list tickers")
+	}
+	res := make(map[string]float64)
+	for _, t := range tickers {
+		if d.context.Err() != nil {
+			break
+		}
+		monthly, err := r.Monthly(t, r.Start, r.End)
+		if err != nil {
+			logging.Warningf(d.context, "'%s': no volume for %s: %s",
+				d.config.ID, t, err.Error())
+			continue
+		}
+		var total float64
+		var samples int
+		for _, m := range monthly {
+			total += float64(m.CashVolume)
+			samples += int(m.NumSamples)
+		}
+		if samples == 0 {
+			continue
+		}
+		res[t] = total / float64(samples)
+	}
+	return res, nil
+}
+
+// initVolumeGroups assigns tickers to the deciles of their average daily cash
+// volume, from "volume decile 1" (the lowest) to "volume decile 10".
+func (d *Distribution) initVolumeGroups() error {
+	volumes := d.volumes
+	if volumes == nil {
+		var err error
+		if volumes, err = d.averageVolumes(); err != nil {
+			return errors.Annotate(err, "failed to get volumes")
+		}
+	}
+	type tickerVolume struct {
+		ticker string
+		volume float64
+	}
+	var tvs []tickerVolume
+	for t, v := range volumes {
+		tvs = append(tvs, tickerVolume{ticker: t, volume: v})
+	}
+	sort.Slice(tvs, func(i, j int) bool { return tvs[i].volume < tvs[j].volume })
+	d.groups = make(map[string]string)
+	for i, tv := range tvs {
+		d.groups[tv.ticker] = fmt.Sprintf("volume decile %d", i*10/len(tvs)+1)
+	}
+	return nil
+}
+
+// group is the key of the histogram for the ticker's sample at the given date
+// in the "group by" and / or "split by" modes.
+func (d *Distribution) group(ticker string, date db.Date) string {
+	var res string
+	if d.groups != nil {
+		g, ok := d.groups[ticker]
+		if !ok {
+			g = "unknown"
+		}
+		res = g
+	}
+	if d.config.SplitBy != "none" {
+		if res != "" {
+			res += " "
+		}
+		res += d.period(date)
+	}
+	return res
+}
+
+// naturalLess compares strings with the embedded decimal numbers ordered by
+// their value, so that "volume decile 2" < "volume decile 10".
+func naturalLess(a, b string) bool {
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+	for len(a) > 0 && len(b) > 0 {
+		if !isDigit(a[0]) || !isDigit(b[0]) {
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		var i, j int
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		na, nb := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+		a, b = a[i:], b[j:]
+	}
+	return len(a) < len(b)
+}
+
+// processGroups plots the log-profit distribution for each group, in the
+// natural order of their keys. The random samples of the groups' log-profits
+// are used for the maximum likelihood fits, when retained.
+func (d *Distribution) processGroups(groups map[string]*stats.Histogram, samples map[string]*experiments.Reservoir) error {
+	var keys []string
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return naturalLess(keys[i], keys[j]) })
+	for _, k := range keys {
+		h := groups[k]
+		if h.CountsTotal() == 0 {
+			continue
+		}
+		dist := histogramDistribution(h, samples[k])
+		err := experiments.AddTypedValue(d.context, d.config.ID, k+" samples", experiments.IntValue(int(h.CountsTotal())))
+		if err != nil {
+			return errors.Annotate(err, "failed to add value for %s samples", k)
+		}
+		err = experiments.AddTypedValue(d.context, d.config.ID, k+" mean", experiments.FloatValue(dist.Mean()))
+		if err != nil {
+			return errors.Annotate(err, "failed to add value for %s mean", k)
+		}
+		err = experiments.AddTypedValue(d.context, d.config.ID, k+" MAD", experiments.FloatValue(dist.MAD()))
+		if err != nil {
+			return errors.Annotate(err, "failed to add value for %s MAD", k)
+		}
+		err = experiments.PlotDistribution(d.context, dist, d.config.LogProfits, d.config.ID, "log-profit "+k)
+		if err != nil {
+			return errors.Annotate(err, "failed to plot %s distribution", k)
+		}
+	}
+	return nil
+}
+
+// processTail estimates the tail index from the largest order statistics xs
+// out of n samples in the tail.
+func (d *Distribution) processTail(xs []float64, n int, name string) error {
+	c := d.config.Tails
+	alphas := experiments.Hill(xs)
+	if len(alphas) == 0 {
+		logging.Warningf(d.context, "'%s': too few samples in the %s",
+			d.config.ID, name)
+		return nil
+	}
+	k := c.K
+	if k == 0 {
+		k = int(math.Sqrt(float64(n)))
+	}
+	if k < 1 {
+		k = 1
+	}
+	if k > len(alphas) {
+		k = len(alphas)
+	}
+	err := experiments.AddTypedValue(d.context, d.config.ID, name+" k", experiments.IntValue(k))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for %s k", name)
+	}
+	err = experiments.AddTypedValue(d.context, d.config.ID, name+" alpha", experiments.FloatValue(alphas[k-1]))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for %s alpha", name)
+	}
+	if c.Graph == "" {
+		return nil
+	}
+	var ks, ys []float64
+	for i, a := range alphas {
+		if math.IsInf(a, 0) {
+			continue
+		}
+		ks = append(ks, float64(i+1))
+		ys = append(ys, a)
+	}
+	plt, err := plot.NewXYPlot(ks, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create Hill plot for %s", name)
+	}
+	plt.SetLegend(d.Prefix(name + " Hill")).SetYLabel("alpha")
+	if err := experiments.AddPlot(d.context, plt, c.Graph); err != nil {
+		return errors.Annotate(err, "failed to add Hill plot for %s", name)
+	}
+	return nil
+}
+
+// scaleStats are the per-ticker values and the stability statistics of a scale
+// estimator.
+type scaleStats struct {
+	Values          []float64
+	Stability       []float64
+	StabilityPoints experiments.StabilityPoints
+	StabilitySeries experiments.StabilitySeries
+}
+
+// add the statistics of the scale estimator f of the ticker's samples data.
+func (s *scaleStats) add(dates []db.Date, data []float64, f func(l, h int) float64, c *config.StabilityPlot) {
+	s.Values = append(s.Values, f(0, len(data)))
+	s.Stability = append(s.Stability, experiments.Stability(len(data), f, c)...)
+	s.StabilityPoints.Add(len(data), f, c)
+	s.StabilitySeries.Add(dates, f, c)
+}
+
+func (s *scaleStats) merge(s2 *scaleStats) {
+	s.Values = append(s.Values, s2.Values...)
+	s.Stability = append(s.Stability, s2.Stability...)
+	s.StabilityPoints.Merge(&s2.StabilityPoints)
+	s.StabilitySeries.Merge(&s2.StabilitySeries)
+}
+
 type jobResult struct {
 	Histogram     *stats.Histogram
 	Means         []float64
-	MADs          []float64
 	MeanStability []float64
-	MADStability  []float64
-	NumTickers    int
+	// Subrange vs. total range statistics for the stability scatter plots.
+	MeanStabilityPoints experiments.StabilityPoints
+	MeanStabilitySeries experiments.StabilitySeries
+	MAD                 scaleStats
+	IQR                 scaleStats // computed only when configured
+	Qn                  scaleStats // computed only when configured
+	NumTickers          int
+	Clipped             int // number of winsorized samples
+	// The largest order statistics of the tails, in the descending order, and
+	// the total number of samples in each tail.
+	RightTail  []float64
+	LeftTail   []float64
+	RightTailN int
+	LeftTailN  int
+	maxTail    int // the number of order statistics to keep
+	// Log-profit histograms by group and / or calendar period, in "group by" and
+	// "split by" modes.
+	Groups map[string]*stats.Histogram
+	// The "log-profits" config with the fitted buckets, and nil while the
+	// buckets with "auto bounds" are not fitted yet. Until then, the histograms
+	// are nil, and the log-profits are pending.
+	logProfits *config.DistributionPlot
+	pending    []logProfit
+	err        error // failure to fit the buckets
+	// Random samples of the log-profits in the histograms for the maximum
+	// likelihood fit, overall and by group. Nil when not needed.
+	Sample       *experiments.Reservoir
+	GroupSamples map[string]*experiments.Reservoir
+}
+
+// logProfit is a normalized log-profit pending to be added to the histograms.
+type logProfit struct {
+	x      float64
+	weight float64
+	key    uint64 // random key for the Reservoir
+	group  string // in "group by" and "split by" modes
+}
+
+// add the log-profit x with the given weight and the random key to the
+// histograms of j and its group, or to the pending log-profits while the
+// buckets are not fitted.
+func (j *jobResult) add(x, weight float64, key uint64, group string) {
+	if j.Histogram == nil {
+		j.pending = append(j.pending, logProfit{x: x, weight: weight, key: key, group: group})
+		return
+	}
+	j.Histogram.AddWithWeight(x, weight)
+	if j.Sample != nil {
+		j.Sample.Add(x, weight, key)
+	}
+	if j.Groups == nil {
+		return
+	}
+	h, ok := j.Groups[group]
+	if !ok {
+		h = stats.NewHistogram(&j.logProfits.Buckets)
+		j.Groups[group] = h
+	}
+	h.AddWithWeight(x, weight)
+	if j.GroupSamples != nil {
+		r, ok := j.GroupSamples[group]
+		if !ok {
+			r = experiments.NewReservoir(fitSamples)
+			j.GroupSamples[group] = r
+		}
+		r.Add(x, weight, key)
+	}
+}
+
+// sampleKey is a pseudo-random key of the i-th log-profit of the ticker with
+// the given hash, independent of how the tickers are batched.
+func sampleKey(tickerHash uint64, i int) uint64 {
+	// The splitmix64 finalizer.
+	x := tickerHash + uint64(i+1)*0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// largest keeps n largest values of xs in the descending order.
+func largest(xs []float64, n int) []float64 {
+	sort.Sort(sort.Reverse(sort.Float64Slice(xs)))
+	if len(xs) > n {
+		xs = xs[:n]
+	}
+	return xs
+}
+
+// addTails adds the tails of the log-profits.
+func (j *jobResult) addTails(data []float64) {
+	for _, x := range data {
+		switch {
+		case x > 0:
+			j.RightTail = append(j.RightTail, x)
+			j.RightTailN++
+		case x < 0:
+			j.LeftTail = append(j.LeftTail, -x)
+			j.LeftTailN++
+		}
+	}
+	j.RightTail = largest(j.RightTail, j.maxTail)
+	j.LeftTail = largest(j.LeftTail, j.maxTail)
 }
 
 func reduceJobResult(j, j2 *jobResult) *jobResult {
-	if j.Histogram != nil {
+	if j.Histogram == nil && j2.Histogram != nil {
+		j, j2 = j2, j // keep the fitted histograms
+	}
+	if j.Histogram != nil && j2.Histogram != nil {
 		j.Histogram.AddHistogram(j2.Histogram)
 	}
+	j.pending = append(j.pending, j2.pending...)
+	if j.err == nil {
+		j.err = j2.err
+	}
+	if j.Sample != nil {
+		j.Sample.Merge(j2.Sample)
+	}
+	for k, r := range j2.GroupSamples {
+		if jr, ok := j.GroupSamples[k]; ok {
+			jr.Merge(r)
+		} else {
+			j.GroupSamples[k] = r
+		}
+	}
+	if j.maxTail > 0 {
+		j.RightTail = largest(append(j.RightTail, j2.RightTail...), j.maxTail)
+		j.LeftTail = largest(append(j.LeftTail, j2.LeftTail...), j.maxTail)
+		j.RightTailN += j2.RightTailN
+		j.LeftTailN += j2.LeftTailN
+	}
+	for k, h := range j2.Groups {
+		if jh, ok := j.Groups[k]; ok {
+			jh.AddHistogram(h)
+		} else {
+			j.Groups[k] = h
+		}
+	}
 	j.Means = append(j.Means, j2.Means...)
-	j.MADs = append(j.MADs, j2.MADs...)
 	j.MeanStability = append(j.MeanStability, j2.MeanStability...)
-	j.MADStability = append(j.MADStability, j2.MADStability...)
+	j.MeanStabilityPoints.Merge(&j2.MeanStabilityPoints)
+	j.MeanStabilitySeries.Merge(&j2.MeanStabilitySeries)
+	j.MAD.merge(&j2.MAD)
+	j.IQR.merge(&j2.IQR)
+	j.Qn.merge(&j2.Qn)
 	j.NumTickers += j2.NumTickers
+	j.Clipped += j2.Clipped
 	return j
 }
 
+// reduceJobResult merges the job results, and fits the buckets with "auto
+// bounds" once there are enough pending log-profits.
+func (d *Distribution) reduceJobResult(j, j2 *jobResult) *jobResult {
+	res := reduceJobResult(j, j2)
+	d.fitPending(res, false)
+	return res
+}
+
+// fitPending fits the "log-profits" buckets with "auto bounds" to the pending
+// log-profits of j, when there are at least bucketSamples of them or when
+// final, and adds them to the newly created histograms. Once the buckets are
+// fitted, it adds any pending log-profits to the histograms.
+func (d *Distribution) fitPending(j *jobResult, final bool) {
+	if j.err != nil {
+		j.pending = nil
+		return
+	}
+	if j.Histogram == nil {
+		if len(j.pending) == 0 || !final && len(j.pending) < bucketSamples {
+			return
+		}
+		xs := make([]float64, len(j.pending))
+		for i, p := range j.pending {
+			xs[i] = p.x
+		}
+		c, err := experiments.FitPlotBuckets(d.config.LogProfits, xs)
+		if err != nil {
+			j.err = err
+			j.pending = nil
+			return
+		}
+		j.logProfits = c
+		j.Histogram = stats.NewHistogram(&c.Buckets)
+	}
+	pending := j.pending
+	j.pending = nil
+	for _, p := range pending {
+		j.add(p.x, p.weight, p.key, p.group)
+	}
+}
+
 func (d *Distribution) newJobResult() *jobResult {
 	res := &jobResult{}
-	if d.config.LogProfits != nil {
-		res.Histogram = stats.NewHistogram(&d.config.LogProfits.Buckets)
+	if c := d.config.LogProfits; c != nil && !c.Buckets.Auto {
+		res.logProfits = c
+		res.Histogram = stats.NewHistogram(&c.Buckets)
+	}
+	if d.config.Tails != nil {
+		res.maxTail = d.config.Tails.MaxK + 1
+	}
+	if d.config.SplitBy != "none" || d.config.GroupBy != "none" {
+		res.Groups = make(map[string]*stats.Histogram)
+	}
+	if c := d.config.LogProfits; c != nil && c.DeriveAlpha != nil && c.DeriveAlpha.FitMethod == "mle" {
+		res.Sample = experiments.NewReservoir(fitSamples)
+		if res.Groups != nil {
+			res.GroupSamples = make(map[string]*experiments.Reservoir)
+		}
 	}
 	return res
 }
 
+// histogramDistribution of h, with the random sample of its log-profits when
+// retained.
+func histogramDistribution(h *stats.Histogram, sample *experiments.Reservoir) stats.DistributionWithHistogram {
+	if sample == nil {
+		return stats.NewHistogramDistribution(h)
+	}
+	return experiments.NewSampledHistogram(h, sample)
+}
+
+// period is the calendar period of the date in the "split by" mode.
+func (d *Distribution) period(date db.Date) string {
+	if d.config.SplitBy == "month" {
+		return fmt.Sprintf("%04d-%02d", date.Year(), date.Month())
+	}
+	return fmt.Sprintf("%04d", date.Year())
+}
+
+// tickerWeight is the weight of the ticker's samples in the "log-profits"
+// histograms. It returns false if the ticker must be skipped.
+func (d *Distribution) tickerWeight(ticker string) (float64, bool) {
+	if d.volumes == nil {
+		return 1, true
+	}
+	v, ok := d.volumes[ticker]
+	if !ok || v < d.config.MinVolume {
+		return 0, false
+	}
+	if d.config.Weight == "volume" {
+		return v, true
+	}
+	return 1, true
+}
+
 func (d *Distribution) processLogProfits(lps []experiments.LogProfits) *jobResult {
 	res := d.newJobResult()
 	for _, lp := range lps {
+		if d.context.Err() != nil {
+			break
+		}
+		weight, ok := d.tickerWeight(lp.Ticker)
+		if !ok {
+			continue
+		}
+		res.Clipped += lp.Clipped
 		data := lp.Timeseries.Data()
+		dates := lp.Timeseries.Dates()
+		if n := d.config.MaxSamples; n > 0 && len(data) > n {
+			data = data[len(data)-n:]
+			dates = dates[len(dates)-n:]
+		}
 		sample := stats.NewSample(data)
 		res.Means = append(res.Means, sample.Mean())
-		res.MADs = append(res.MADs, sample.MAD())
 		meanF := func(l, h int) float64 { return stats.NewSample(data[l:h]).Mean() }
 		MADF := func(l, h int) float64 { return stats.NewSample(data[l:h]).MAD() }
 		res.MeanStability = append(res.MeanStability, experiments.Stability(
 			len(data), meanF, d.config.MeanStability)...)
-		res.MADStability = append(res.MADStability, experiments.Stability(
-			len(data), MADF, d.config.MADStability)...)
-		if res.Histogram != nil {
+		res.MeanStabilityPoints.Add(len(data), meanF, d.config.MeanStability)
+		res.MeanStabilitySeries.Add(dates, meanF, d.config.MeanStability)
+		res.MAD.add(dates, data, MADF, d.config.MADStability)
+		if d.config.IQRs != nil || d.config.IQRStability != nil {
+			f := func(l, h int) float64 { return experiments.IQR(data[l:h]) }
+			res.IQR.add(dates, data, f, d.config.IQRStability)
+		}
+		if d.config.Qns != nil || d.config.QnStability != nil {
+			f := func(l, h int) float64 { return experiments.Qn(data[l:h]) }
+			res.Qn.add(dates, data, f, d.config.QnStability)
+		}
+		if c := d.config.Tails; c != nil {
+			tail := sample
+			if c.Normalize && sample.MAD() != 0.0 {
+				var err error
+				if tail, err = experiments.Normalize(sample, c.NormalizeBy); err != nil {
+					logging.Warningf(d.context,
+						"'%s': skipping tails of %s, failed to normalize log-profits: %s",
+						d.config.ID, lp.Ticker, err.Error())
+					tail = nil
+				}
+			}
+			if tail != nil {
+				res.addTails(tail.Data())
+			}
+		}
+		if d.config.LogProfits != nil {
 			if d.config.LogProfits.Normalize && sample.MAD() != 0.0 {
 				var err error
-				sample, err = sample.Normalize()
+				sample, err = experiments.Normalize(sample, d.config.LogProfits.NormalizeBy)
 				if err != nil {
 					logging.Warningf(d.context,
 						"'%s': skipping %s, failed to normalize log-profits: %s",
@@ -170,7 +786,16 @@ func (d *Distribution) processLogProfits(lps []experiments.LogProfits) *jobResul
 					continue
 				}
 			}
-			res.Histogram.Add(sample.Data()...)
+			hash := fnv.New64a()
+			hash.Write([]byte(lp.Ticker))
+			tickerHash := hash.Sum64()
+			for i, x := range sample.Data() {
+				var group string
+				if res.Groups != nil {
+					group = d.group(lp.Ticker, dates[i])
+				}
+				res.add(x, weight, sampleKey(tickerHash, i), group)
+			}
 		}
 		res.NumTickers++
 	}
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/stockparfait/experiments"
@@ -41,6 +43,18 @@ func TestDistribution(t *testing.T) {
 		So(tmpdirErr, ShouldBeNil)
 	})
 
+	Convey("naturalLess orders numbers by value", t, func() {
+		keys := []string{
+			"volume decile 10", "volume decile 2", "volume decile 1",
+			"Tech 2020", "Energy", "volume decile 02x",
+		}
+		sort.Slice(keys, func(i, j int) bool { return naturalLess(keys[i], keys[j]) })
+		So(keys, ShouldResemble, []string{
+			"Energy", "Tech 2020", "volume decile 1", "volume decile 2",
+			"volume decile 02x", "volume decile 10",
+		})
+	})
+
 	Convey("Distribution experiment works", t, func() {
 		ctx := context.Background()
 		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
@@ -93,6 +107,10 @@ func TestDistribution(t *testing.T) {
 		So(err, ShouldBeNil)
 		madsStabGraph, err := canvas.EnsureGraph(plot.KindXY, "mads stab", "gr")
 		So(err, ShouldBeNil)
+		meansScatterGraph, err := canvas.EnsureGraph(plot.KindXY, "means scatter", "gr")
+		So(err, ShouldBeNil)
+		madsSeriesGraph, err := canvas.EnsureGraph(plot.KindSeries, "mads series", "ts")
+		So(err, ShouldBeNil)
 
 		Convey("DB with default parameters", func() {
 			var cfg config.Distribution
@@ -129,8 +147,14 @@ func TestDistribution(t *testing.T) {
   },
   "means": {"graph": "means"},
   "MADs": {"graph": "mads"},
-  "mean stability": {"plot": {"graph": "means stab"}},
-  "MAD stability": {"plot": {"graph": "mads stab"}}
+  "mean stability": {
+    "plot": {"graph": "means stab"},
+    "scatter": {"graph": "means scatter"}
+  },
+  "MAD stability": {
+    "plot": {"graph": "mads stab"},
+    "timeseries graph": "mads series"
+  }
 }`, tmpdir, dbName))), ShouldBeNil)
 			var dist Distribution
 			So(dist.Run(ctx, &cfg), ShouldBeNil)
@@ -152,6 +176,296 @@ func TestDistribution(t *testing.T) {
 			So(len(madsGraph.Plots), ShouldEqual, 1)
 			So(len(meansStabGraph.Plots), ShouldEqual, 1)
 			So(len(madsStabGraph.Plots), ShouldEqual, 1)
+			So(len(meansScatterGraph.Plots), ShouldEqual, 1)
+			So(meansScatterGraph.Plots[0].Legend, ShouldEqual, "test mean stability scatter")
+			// 2 subranges of 2 log-profits for each of the 2 tickers.
+			So(len(meansScatterGraph.Plots[0].X), ShouldEqual, 4)
+			So(len(madsSeriesGraph.Plots), ShouldEqual, 1)
+			So(madsSeriesGraph.Plots[0].Legend, ShouldEqual, "test MAD stability series")
+			// Window=1 ends on each of the 2 log-profit dates.
+			So(len(madsSeriesGraph.Plots[0].Dates), ShouldEqual, 2)
+		})
+
+		Convey("winsorized DB", func() {
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {
+    "DB": {"DB path": "%s", "DB": "%s"},
+    "winsorize": {"quantile": 0.25}
+  },
+  "log-profits": {"graph": "dist"}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			// Both log-profits of each ticker are beyond its quartiles.
+			So(values["test clipped samples"], ShouldEqual, "4")
+			So(values["test samples"], ShouldEqual, "4")
+		})
+
+		Convey("robust scale estimators", func() {
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "log-profits": {"graph": "dist"},
+  "IQRs": {"graph": "mads"},
+  "Qns": {"graph": "mads"},
+  "Qn stability": {"plot": {"graph": "mads stab"}}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			// Both tickers have log-profits 0.15 apart.
+			So(values["test average IQR"], ShouldEqual, "0.075")
+			So(values["test average Qn"], ShouldEqual, "0.3333") // 2.2219*0.15
+			So(values, ShouldNotContainKey, "test average MAD")
+			So(len(madsGraph.Plots), ShouldEqual, 2)
+			So(madsGraph.Plots[0].Legend, ShouldStartWith, "test IQRs")
+			So(madsGraph.Plots[1].Legend, ShouldStartWith, "test Qns")
+			So(len(madsStabGraph.Plots), ShouldEqual, 1)
+			So(madsStabGraph.Plots[0].Legend, ShouldStartWith, "test Qn stability")
+		})
+
+		Convey("split by year", func() {
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "normal", "MAD": 0.01},
+    "tickers": 2,
+    "days": 600,
+    "start date": "2019-06-03",
+    "seed": 42
+  },
+  "log-profits": {"graph": "dist", "buckets": {"min": -0.1, "max": 0.1}},
+  "split by": "year"
+}`)), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "2")
+			So(values, ShouldContainKey, "test 2019 mean")
+			So(values, ShouldContainKey, "test 2020 MAD")
+			So(values, ShouldContainKey, "test 2021 samples")
+			So(values, ShouldNotContainKey, "test 2022 samples")
+			So(len(distGraph.Plots), ShouldEqual, 3)
+			So(distGraph.Plots[0].Legend, ShouldEqual, "test log-profit 2019 p.d.f.")
+			So(distGraph.Plots[2].Legend, ShouldEqual, "test log-profit 2021 p.d.f.")
+
+			So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"daily distribution": {"name": "normal"}},
+  "split by": "month"
+}`)), ShouldNotBeNil)
+		})
+
+		Convey("group by sector and volume", func() {
+			dbName := "groups"
+			tickers := map[string]db.TickerRow{
+				"A": {Sector: "Tech", Active: true},
+				"B": {Sector: "Energy"},
+				"C": {Sector: "Tech"},
+			}
+			prices["C"] = prices["A"]
+			monthly := make(map[string][]db.ResampledRow)
+			for i, t := range []string{"A", "B", "C"} {
+				monthly[t] = []db.ResampledRow{{
+					CashVolume: float32(1000 * (i + 1)),
+					DateOpen:   db.NewDate(2019, 1, 1),
+					DateClose:  db.NewDate(2019, 1, 3),
+					NumSamples: 3,
+				}}
+			}
+			w := db.NewWriter(tmpdir, dbName)
+			So(w.WriteTickers(tickers), ShouldBeNil)
+			for t, p := range prices {
+				So(w.WritePrices(t, p), ShouldBeNil)
+			}
+			So(w.WriteMonthly(monthly), ShouldBeNil)
+
+			conf := func(groupBy string) *config.Distribution {
+				var cfg config.Distribution
+				So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "log-profits": {"graph": "dist", "buckets": {"min": -0.2, "max": 0.2}},
+  "group by": "%s"
+}`, tmpdir, dbName, groupBy))), ShouldBeNil)
+				return &cfg
+			}
+
+			Convey("sector", func() {
+				var dist Distribution
+				So(dist.Run(ctx, conf("sector")), ShouldBeNil)
+				So(values["test tickers"], ShouldEqual, "3")
+				So(values["test Energy samples"], ShouldEqual, "2")
+				So(values["test Tech samples"], ShouldEqual, "4")
+				So(len(distGraph.Plots), ShouldEqual, 2)
+				So(distGraph.Plots[0].Legend, ShouldEqual, "test log-profit Energy p.d.f.")
+			})
+
+			Convey("activity", func() {
+				var dist Distribution
+				So(dist.Run(ctx, conf("activity")), ShouldBeNil)
+				So(values["test active samples"], ShouldEqual, "2")
+				So(values["test delisted samples"], ShouldEqual, "4")
+				So(len(distGraph.Plots), ShouldEqual, 2)
+				So(distGraph.Plots[0].Legend, ShouldEqual, "test log-profit active p.d.f.")
+			})
+
+			Convey("volume decile", func() {
+				var dist Distribution
+				So(dist.Run(ctx, conf("volume decile")), ShouldBeNil)
+				So(values["test volume decile 1 samples"], ShouldEqual, "2")
+				So(values["test volume decile 4 samples"], ShouldEqual, "2")
+				So(values["test volume decile 7 samples"], ShouldEqual, "2")
+				So(len(distGraph.Plots), ShouldEqual, 3)
+			})
+
+			Convey("weight and filter by volume", func() {
+				var cfg config.Distribution
+				So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "log-profits": {"graph": "dist", "buckets": {"min": -0.2, "max": 0.2}},
+  "weight": "volume",
+  "min volume": 500,
+  "max samples": 1
+}`, tmpdir, dbName))), ShouldBeNil)
+				var dist Distribution
+				So(dist.Run(ctx, &cfg), ShouldBeNil)
+				So(values["test tickers"], ShouldEqual, "2")
+				So(values["test samples"], ShouldEqual, "2")
+				So(len(distGraph.Plots), ShouldEqual, 1)
+			})
+
+			Convey("requires DB", func() {
+				var cfg config.Distribution
+				So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"daily distribution": {"name": "normal"}},
+  "log-profits": {"graph": "dist"},
+  "group by": "sector"
+}`)), ShouldNotBeNil)
+				So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"daily distribution": {"name": "normal"}},
+  "log-profits": {"graph": "dist"},
+  "weight": "volume"
+}`)), ShouldNotBeNil)
+			})
+		})
+
+		Convey("streamed log-profits with a bucket rule", func() {
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "normal", "MAD": 0.01},
+    "tickers": 5,
+    "days": 1000,
+    "seed": 42
+  },
+  "log-profits": {
+    "graph": "dist",
+    "buckets": {"n": 21, "auto bounds": true},
+    "bucket rule": "quantile",
+    "bucket quantile": 0.01
+  }
+}`)), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test samples"], ShouldEqual, "4995")
+			So(len(distGraph.Plots), ShouldEqual, 1)
+			xs := distGraph.Plots[0].X
+			So(len(xs), ShouldBeGreaterThan, 10)
+			// The 1% quantile of the normal distribution with MAD=0.01 is about
+			// -0.029; the extreme samples are in the edge buckets.
+			So(xs[0], ShouldBeBetween, -0.04, -0.02)
+			So(xs[len(xs)-1], ShouldBeBetween, 0.02, 0.04)
+			So(cfg.LogProfits.Buckets.Auto, ShouldBeTrue) // the original is intact
+		})
+
+		Convey("streamed log-profits are fitted by maximum likelihood", func() {
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "alpha": 3, "MAD": 0.01},
+    "tickers": 10,
+    "days": 2000,
+    "seed": 42
+  },
+  "log-profits": {
+    "graph": "dist",
+    "buckets": {"n": 5, "min": -0.05, "max": 0.05},
+    "reference distribution": {"analytical source": {"name": "t"}},
+    "derive alpha": {"min x": 1.5, "max x": 50, "fit method": "mle"}
+  }
+}`)), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			// The retained raw samples are fitted rather than the 5 bucket means.
+			alpha, err := strconv.ParseFloat(values["test log-profit alpha"], 64)
+			So(err, ShouldBeNil)
+			So(alpha, ShouldAlmostEqual, 3, 0.3)
+			So(values["test log-profit alpha stderr"], ShouldNotEqual, "NaN")
+		})
+
+		Convey("auto buckets are fitted to the normalized log-profits", func() {
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "normal", "MAD": 0.01},
+    "tickers": 50,
+    "days": 2500
+  },
+  "log-profits": {
+    "graph": "dist",
+    "normalize": true,
+    "buckets": {"n": 21, "auto bounds": true},
+    "bucket rule": "quantile",
+    "bucket quantile": 0.01
+  }
+}`)), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			// More than bucketSamples, so the later samples are added to the
+			// histogram fitted to the first ones.
+			So(values["test samples"], ShouldEqual, "124950")
+			So(len(distGraph.Plots), ShouldEqual, 1)
+			xs := distGraph.Plots[0].X
+			So(len(xs), ShouldBeGreaterThan, 10)
+			// The 1% quantile of the normalized samples is about -2.9.
+			So(xs[0], ShouldBeBetween, -4.0, -2.0)
+			So(xs[len(xs)-1], ShouldBeBetween, 2.0, 4.0)
+		})
+
+		Convey("synthetic tails", func() {
+			hillGraph, err := canvas.EnsureGraph(plot.KindXY, "hill", "gr")
+			So(err, ShouldBeNil)
+			var cfg config.Distribution
+			So(cfg.InitMessage(testutil.JSON(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "alpha": 3, "MAD": 0.01},
+    "tickers": 10,
+    "days": 5000,
+    "seed": 42
+  },
+  "tails": {"graph": "hill", "max k": 500, "normalize": true}
+}`)), ShouldBeNil)
+			var dist Distribution
+			So(dist.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "10")
+			So(values["test right tail k"], ShouldEqual, "157") // sqrt(~25K)
+			So(values["test left tail k"], ShouldEqual, "158")
+			right, err := strconv.ParseFloat(values["test right tail alpha"], 64)
+			So(err, ShouldBeNil)
+			So(right, ShouldBeBetween, 2, 4.5)
+			left, err := strconv.ParseFloat(values["test left tail alpha"], 64)
+			So(err, ShouldBeNil)
+			So(left, ShouldBeBetween, 2, 4.5)
+			So(len(hillGraph.Plots), ShouldEqual, 2)
+			So(hillGraph.Plots[0].Legend, ShouldEqual, "test right tail Hill")
+			So(len(hillGraph.Plots[0].X), ShouldEqual, 500)
 		})
 	})
 }
@@ -0,0 +1,265 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eventstudy is an experiment measuring the cumulative abnormal returns
+// around events, such as earnings announcements or large price drops.
+package eventstudy
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type EventStudy struct {
+	config    *config.EventStudy
+	context   context.Context
+	reference *stats.Timeseries
+	events    map[string][]db.Date // ticker -> sorted event dates
+}
+
+var _ experiments.Experiment = &EventStudy{}
+
+func (e *EventStudy) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *EventStudy) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *EventStudy) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.EventStudy); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	if e.config.Reference != nil {
+		it, err := experiments.Source(ctx, e.config.Reference)
+		if err != nil {
+			return errors.Annotate(err, "failed to get reference series")
+		}
+		lps := iterator.ToSlice[experiments.LogProfits](it)
+		it.Close()
+		if len(lps) != 1 {
+			return errors.Reason("expected exactly one reference series, got %d",
+				len(lps))
+		}
+		e.reference = lps[0].Timeseries
+	}
+	if e.config.EventsFile != "" {
+		f, err := os.Open(e.config.EventsFile)
+		if err != nil {
+			return errors.Annotate(err, "failed to open events file '%s'",
+				e.config.EventsFile)
+		}
+		defer f.Close()
+		if e.events, err = ReadEvents(f); err != nil {
+			return errors.Annotate(err, "failed to read events file '%s'",
+				e.config.EventsFile)
+		}
+	}
+	it, err := experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j2.Merge(j1) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, &jobResult{}, f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+// ReadEvents reads the CSV table of events with the "ticker" and "date"
+// columns, in any order, and returns the sorted event dates for each ticker.
+func ReadEvents(r io.Reader) (map[string][]db.Date, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to read the header")
+	}
+	tickerCol, dateCol := -1, -1
+	for i, h := range header {
+		switch h {
+		case "ticker":
+			tickerCol = i
+		case "date":
+			dateCol = i
+		}
+	}
+	if tickerCol < 0 || dateCol < 0 {
+		return nil, errors.Reason(`header must have "ticker" and "date" columns`)
+	}
+	res := make(map[string][]db.Date)
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to read line %d", line)
+		}
+		d, err := db.NewDateFromString(row[dateCol])
+		if err != nil {
+			return nil, errors.Annotate(err, "invalid date in line %d", line)
+		}
+		res[row[tickerCol]] = append(res[row[tickerCol]], d)
+	}
+	for _, dates := range res {
+		sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	}
+	return res, nil
+}
+
+// jobResult accumulates the cumulative abnormal returns over the window for
+// each event.
+type jobResult struct {
+	cars       [][]float64
+	numTickers int
+}
+
+// Merge j2 into j and return j.
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	j.cars = append(j.cars, j2.cars...)
+	j.numTickers += j2.numTickers
+	return j
+}
+
+// eventIndices returns the indices of the event days in the log-profit series.
+func (e *EventStudy) eventIndices(ticker string, dates []db.Date, data []float64) []int {
+	var res []int
+	if c := e.config.Rule; c != nil {
+		threshold := c.Threshold
+		if c.MADThreshold {
+			threshold *= stats.NewSample(data).MAD()
+		}
+		for i, x := range data {
+			if (c.Kind == "drop" && x <= -threshold) || (c.Kind == "jump" && x >= threshold) {
+				res = append(res, i)
+			}
+		}
+		return res
+	}
+	for _, d := range e.events[ticker] {
+		i := sort.Search(len(dates), func(i int) bool { return !dates[i].Before(d) })
+		if i < len(dates) && (len(res) == 0 || res[len(res)-1] != i) {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+func (e *EventStudy) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := &jobResult{}
+	before, after := e.config.Before, e.config.After
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		if e.events != nil && len(e.events[lp.Ticker]) == 0 {
+			continue
+		}
+		ts := lp.Timeseries
+		abnormal := ts.Data()
+		if e.reference != nil {
+			tss := stats.TimeseriesIntersect(ts, e.reference)
+			ts = tss[0]
+			abnormal = make([]float64, len(ts.Data()))
+			for i, x := range ts.Data() {
+				abnormal[i] = x - tss[1].Data()[i]
+			}
+		}
+		for _, i := range e.eventIndices(lp.Ticker, ts.Dates(), ts.Data()) {
+			if i < before || i+after >= len(abnormal) {
+				continue
+			}
+			car := make([]float64, before+after+1)
+			var sum float64
+			for k := range car {
+				sum += abnormal[i-before+k]
+				car[k] = sum
+			}
+			res.cars = append(res.cars, car)
+		}
+		res.numTickers++
+	}
+	return res
+}
+
+func (e *EventStudy) processTotal(total *jobResult) error {
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "events", experiments.IntValue(len(total.cars))); err != nil {
+		return errors.Annotate(err, "failed to add value for number of events")
+	}
+	if len(total.cars) == 0 {
+		return nil
+	}
+	n := e.config.Before + e.config.After + 1
+	xs := make([]float64, n)
+	means := make([]float64, n)
+	lows := make([]float64, n)
+	highs := make([]float64, n)
+	mean := func(d []float64) float64 { return stats.NewSample(d).Mean() }
+	samples := make([]float64, len(total.cars))
+	for k := 0; k < n; k++ {
+		for i, car := range total.cars {
+			samples[i] = car[k]
+		}
+		xs[k] = float64(k - e.config.Before)
+		means[k] = mean(samples)
+		lows[k], highs[k] = experiments.BootstrapInterval(samples, mean,
+			e.config.BootstrapSamples, e.config.Confidence, experiments.Seed(e.context, 0))
+	}
+	if err := experiments.AddInterval(e.context, e.config.ID, "CAR", means[n-1], lows[n-1], highs[n-1]); err != nil {
+		return errors.Annotate(err, "failed to add value for CAR")
+	}
+	add := func(ys []float64, legend string, chartType plot.ChartType) error {
+		plt, err := plot.NewXYPlot(xs, ys)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", legend)
+		}
+		plt.SetLegend(e.Prefix(legend)).SetYLabel("log-profit").SetChartType(chartType)
+		if err := experiments.AddPlot(e.context, plt, e.config.Graph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", legend)
+		}
+		return nil
+	}
+	if err := add(means, "mean CAR", plot.ChartLine); err != nil {
+		return err
+	}
+	confidence := fmt.Sprintf("%g%%", e.config.Confidence)
+	if err := add(lows, "CAR low "+confidence, plot.ChartDashed); err != nil {
+		return err
+	}
+	if err := add(highs, "CAR high "+confidence, plot.ChartDashed); err != nil {
+		return err
+	}
+	return nil
+}
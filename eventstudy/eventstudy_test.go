@@ -0,0 +1,167 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventstudy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEventStudy(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_eventstudy")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("ReadEvents works", t, func() {
+		events, err := ReadEvents(strings.NewReader(`name,date,ticker
+x,2020-01-03,A
+y,2020-01-01,A
+z,2020-01-02,B
+`))
+		So(err, ShouldBeNil)
+		So(events, ShouldResemble, map[string][]db.Date{
+			"A": {db.NewDate(2020, 1, 1), db.NewDate(2020, 1, 3)},
+			"B": {db.NewDate(2020, 1, 2)},
+		})
+
+		_, err = ReadEvents(strings.NewReader("ticker,day\nA,2020-01-01\n"))
+		So(err, ShouldNotBeNil)
+		_, err = ReadEvents(strings.NewReader("ticker,date\nA\n"))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("EventStudy experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		graph, err := canvas.EnsureGraph(plot.KindXY, "car", "g")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"INDEX": {}, "A": {}}
+		pr := func(date string, p float32) db.PriceRow {
+			d, err := db.NewDateFromString(date)
+			if err != nil {
+				panic(err)
+			}
+			return db.TestPrice(d, p, p, p, 1000.0, true)
+		}
+		prices := map[string][]db.PriceRow{
+			"A": {
+				pr("2020-01-01", 100),
+				pr("2020-01-02", 80), // the drop
+				pr("2020-01-03", 88),
+				pr("2020-01-06", 90),
+				pr("2020-01-07", 85),
+				pr("2020-01-08", 86),
+			},
+			"INDEX": {
+				pr("2020-01-01", 100),
+				pr("2020-01-02", 99),
+				pr("2020-01-03", 99),
+				pr("2020-01-06", 100),
+				pr("2020-01-07", 100),
+				pr("2020-01-08", 100),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		Convey("with a rule and a reference", func() {
+			var cfg config.EventStudy
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["A"]}},
+  "reference": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["INDEX"]}},
+  "rule": {"kind": "drop", "threshold": 0.1},
+  "before": 0,
+  "after": 2,
+  "graph": "car",
+  "bootstrap samples": 10
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e EventStudy
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values, ShouldResemble, experiments.Values{
+				"test tickers":  "1",
+				"test events":   "1",
+				"test CAR":      "-0.1054",
+				"test CAR low":  "-0.1054",
+				"test CAR high": "-0.1054",
+			})
+			So(len(graph.Plots), ShouldEqual, 3)
+			So(graph.Plots[0].Legend, ShouldEqual, "test mean CAR")
+			So(graph.Plots[0].X, ShouldResemble, []float64{0, 1, 2})
+			So(testutil.RoundSlice(graph.Plots[0].Y, 4), ShouldResemble,
+				[]float64{-0.213, -0.118, -0.105})
+		})
+
+		Convey("with an events file", func() {
+			eventsFile := filepath.Join(tmpdir, "events.csv")
+			So(testutil.WriteFile(eventsFile, "ticker,date\nA,2020-01-04\nB,2020-01-02\n"),
+				ShouldBeNil)
+			var cfg config.EventStudy
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "events file": "%s",
+  "before": 1,
+  "after": 1,
+  "graph": "car",
+  "bootstrap samples": 10
+}`, tmpdir, dbName, eventsFile))), ShouldBeNil)
+			var e EventStudy
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["tickers"], ShouldEqual, "1")
+			So(values["events"], ShouldEqual, "1")
+			So(graph.Plots[0].X, ShouldResemble, []float64{-1, 0, 1})
+			So(testutil.RoundSlice(graph.Plots[0].Y, 4), ShouldResemble,
+				[]float64{0.09531, 0.118, 0.06062})
+		})
+
+		Convey("config requires exactly one event source", func() {
+			var cfg config.EventStudy
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "data": {"daily distribution": {"name": "t"}},
+  "graph": "car"
+}`)), ShouldNotBeNil)
+		})
+	})
+}
@@ -15,11 +15,21 @@
 package experiments
 
 import (
+	"container/heap"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/stockparfait/errors"
@@ -29,6 +39,15 @@ import (
 	"github.com/stockparfait/stockparfait/db"
 	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/stockparfait/table"
+
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/dsp/fourier"
+	"gonum.org/v1/gonum/integrate/quad"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+	"gonum.org/v1/gonum/stat/distuv"
 )
 
 // Experiment is a generic interface for a single experiment.
@@ -50,6 +69,17 @@ type contextKey int
 
 const (
 	valuesContextKey contextKey = iota
+	valuesWriterContextKey
+	typedValuesContextKey
+	summaryTablesContextKey
+	autoCreateGraphsContextKey
+	maxPointsContextKey
+	graphPrefixContextKey
+	deterministicContextKey
+	outputDirContextKey
+	seedLogContextKey
+	instanceValuesContextKey
+	sharedBucketsContextKey
 )
 
 // Values is a key:value map populated by implementations of Experiment to be
@@ -71,14 +101,628 @@ func GetValues(ctx context.Context) Values {
 	return v
 }
 
-// AddValue adds (or overwrites) a <prefix key>:value pair to the Values in the
-// context.
+// ValueKind is the type of a Value.
+type ValueKind string
+
+const (
+	StringKind ValueKind = "string"
+	IntKind    ValueKind = "int"
+	FloatKind  ValueKind = "float"
+)
+
+// Value is a typed experiment result with an optional unit. Its String()
+// method is the view printed on the terminal and stored in Values.
+type Value struct {
+	Kind  ValueKind
+	Int   int
+	Float float64
+	Str   string
+	Unit  string
+}
+
+// StringValue creates a string Value.
+func StringValue(s string) Value { return Value{Kind: StringKind, Str: s} }
+
+// IntValue creates an integer Value.
+func IntValue(x int) Value { return Value{Kind: IntKind, Int: x} }
+
+// FloatValue creates a floating point Value.
+func FloatValue(x float64) Value { return Value{Kind: FloatKind, Float: x} }
+
+// WithUnit returns a copy of v with the given unit.
+func (v Value) WithUnit(unit string) Value {
+	v.Unit = unit
+	return v
+}
+
+// String formats v as it would be printed on the terminal.
+func (v Value) String() string {
+	var s string
+	switch v.Kind {
+	case IntKind:
+		s = fmt.Sprintf("%d", v.Int)
+	case FloatKind:
+		s = fmt.Sprintf("%.4g", v.Float)
+	default:
+		s = v.Str
+	}
+	if v.Unit != "" {
+		s += " " + v.Unit
+	}
+	return s
+}
+
+// Plain formats v without the unit, and numbers in full precision, e.g. for
+// CSV files.
+func (v Value) Plain() string {
+	switch v.Kind {
+	case IntKind:
+		return strconv.Itoa(v.Int)
+	case FloatKind:
+		return strconv.FormatFloat(v.Float, 'g', -1, 64)
+	default:
+		return v.Str
+	}
+}
+
+// MarshalJSON implements json.Marshaler, encoding v as
+// {"kind": <kind>, "value": <value>, "unit": <unit>}.
+func (v Value) MarshalJSON() ([]byte, error) {
+	type jsonValue struct {
+		Kind  ValueKind `json:"kind"`
+		Value any       `json:"value"`
+		Unit  string    `json:"unit,omitempty"`
+	}
+	jv := jsonValue{Kind: v.Kind, Unit: v.Unit}
+	switch v.Kind {
+	case IntKind:
+		jv.Value = v.Int
+	case FloatKind:
+		if math.IsNaN(v.Float) || math.IsInf(v.Float, 0) {
+			jv.Value = fmt.Sprintf("%g", v.Float) // not representable in JSON
+		} else {
+			jv.Value = v.Float
+		}
+	default:
+		jv.Value = v.Str
+	}
+	return json.Marshal(jv)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, the inverse of MarshalJSON.
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var jv struct {
+		Kind  ValueKind       `json:"kind"`
+		Value json.RawMessage `json:"value"`
+		Unit  string          `json:"unit"`
+	}
+	if err := json.Unmarshal(data, &jv); err != nil {
+		return errors.Annotate(err, "failed to decode value")
+	}
+	*v = Value{Kind: jv.Kind, Unit: jv.Unit}
+	var err error
+	switch jv.Kind {
+	case IntKind:
+		err = json.Unmarshal(jv.Value, &v.Int)
+	case FloatKind:
+		var s string
+		if json.Unmarshal(jv.Value, &s) == nil { // NaN or Inf
+			v.Float, err = strconv.ParseFloat(s, 64)
+		} else {
+			err = json.Unmarshal(jv.Value, &v.Float)
+		}
+	case StringKind:
+		err = json.Unmarshal(jv.Value, &v.Str)
+	default:
+		return errors.Reason("unsupported value kind: '%s'", jv.Kind)
+	}
+	if err != nil {
+		return errors.Annotate(err, "failed to decode %s value", jv.Kind)
+	}
+	return nil
+}
+
+// TypedValues is the typed counterpart of Values, for exporting the results
+// programmatically.
+type TypedValues = map[string]Value
+
+// UseTypedValues injects TypedValues into the context, to be populated by
+// AddValue and AddTypedValue alongside Values.
+func UseTypedValues(ctx context.Context, v TypedValues) context.Context {
+	return context.WithValue(ctx, typedValuesContextKey, v)
+}
+
+// GetTypedValues previously injected by UseTypedValues, or nil.
+func GetTypedValues(ctx context.Context) TypedValues {
+	v, ok := ctx.Value(typedValuesContextKey).(TypedValues)
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+// UseInstanceValues injects an additional TypedValues into the context which
+// records only the values added within this context, e.g. by a single
+// experiment instance. Unlike the main TypedValues, it is not affected by the
+// values of the other instances with the same keys.
+func UseInstanceValues(ctx context.Context, v TypedValues) context.Context {
+	return context.WithValue(ctx, instanceValuesContextKey, v)
+}
+
+// SummaryTables collects the summary statistics tables of distribution plots,
+// keyed by the CSV file name.
+type SummaryTables = map[string]*table.Table
+
+// UseSummaryTables injects SummaryTables into the context, to be populated by
+// PlotDistribution.
+func UseSummaryTables(ctx context.Context, t SummaryTables) context.Context {
+	return context.WithValue(ctx, summaryTablesContextKey, t)
+}
+
+// GetSummaryTables previously injected by UseSummaryTables, or nil.
+func GetSummaryTables(ctx context.Context) SummaryTables {
+	t, ok := ctx.Value(summaryTablesContextKey).(SummaryTables)
+	if !ok {
+		return nil
+	}
+	return t
+}
+
+// UseAutoCreateGraphs makes AddPlot create the graphs missing from the Canvas
+// in a default group.
+func UseAutoCreateGraphs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, autoCreateGraphsContextKey, true)
+}
+
+// UseMaxPoints makes AddPlot subsample the timeseries and scatter plots with
+// more than n points down to n points. Non-positive n disables subsampling.
+func UseMaxPoints(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxPointsContextKey, n)
+}
+
+// DeterministicSeed starts the sequence of seeds in the deterministic mode.
+const DeterministicSeed = 1
+
+// seedSequence generates seeds in the deterministic mode. Seeds are requested
+// in a fixed order, since all the parallel maps are serialized.
+type seedSequence struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// UseDeterministic enables the deterministic mode for regression testing of
+// configs: all parallel maps run on a single worker, and all the random
+// sources not explicitly seeded in the configs are seeded from a fixed
+// sequence. The results are then identical across runs.
+func UseDeterministic(ctx context.Context) context.Context {
+	s := &seedSequence{rand: rand.New(rand.NewSource(DeterministicSeed))}
+	return context.WithValue(ctx, deterministicContextKey, s)
+}
+
+// Deterministic checks if the deterministic mode is enabled by
+// UseDeterministic.
+func Deterministic(ctx context.Context) bool {
+	_, ok := ctx.Value(deterministicContextKey).(*seedSequence)
+	return ok
+}
+
+// Workers is the number of parallel workers: n normally, and 1 in the
+// deterministic mode.
+func Workers(ctx context.Context, n int) int {
+	if Deterministic(ctx) {
+		return 1
+	}
+	return n
+}
+
+// SeedLog records the seeds generated by Seed, e.g. for the run manifest.
+type SeedLog struct {
+	mu    sync.Mutex
+	seeds []uint64
+}
+
+// UseSeedLog makes Seed record all the seeds it generates in l.
+func UseSeedLog(ctx context.Context, l *SeedLog) context.Context {
+	return context.WithValue(ctx, seedLogContextKey, l)
+}
+
+// Seeds generated so far, in the order of generation.
+func (l *SeedLog) Seeds() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]uint64{}, l.seeds...)
+}
+
+// Seed returns a non-zero seed for a random source: the seed itself when it is
+// non-zero, the next seed in a fixed sequence in the deterministic mode, and a
+// time-based seed otherwise. Generated seeds are recorded in the SeedLog, if
+// any.
+func Seed(ctx context.Context, seed uint64) uint64 {
+	if seed != 0 {
+		return seed
+	}
+	if s, ok := ctx.Value(deterministicContextKey).(*seedSequence); ok {
+		s.mu.Lock()
+		// Keep the seed positive as an int, for the configs.
+		seed = s.rand.Uint64()>>1 | 1
+		s.mu.Unlock()
+	} else {
+		seed = uint64(time.Now().UnixNano()) | 1
+	}
+	if l, ok := ctx.Value(seedLogContextKey).(*SeedLog); ok {
+		l.mu.Lock()
+		l.seeds = append(l.seeds, seed)
+		l.mu.Unlock()
+	}
+	return seed
+}
+
+// UseGraphPrefix makes AddPlot prepend the prefix to all graph IDs. When the
+// prefixed graph does not exist but the original one does, the original graph
+// is cloned (without plots) into the same group under the prefixed ID.
+func UseGraphPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, graphPrefixContextKey, prefix)
+}
+
+// UseOutputDir makes OutputPath resolve relative paths against dir.
+func UseOutputDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, outputDirContextKey, dir)
+}
+
+// OutputPath resolves the path of an output file from an experiment config
+// against the directory set by UseOutputDir. Absolute paths, empty paths and
+// "-" (stdout) are returned as is.
+func OutputPath(ctx context.Context, path string) string {
+	dir, _ := ctx.Value(outputDirContextKey).(string)
+	if dir == "" || path == "" || path == "-" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// prefixGraph returns the graph ID prefixed according to UseGraphPrefix, and
+// ensures the prefixed graph exists if the original one does.
+func prefixGraph(ctx context.Context, graphID string) (string, error) {
+	prefix, _ := ctx.Value(graphPrefixContextKey).(string)
+	if prefix == "" {
+		return graphID, nil
+	}
+	id := prefix + graphID
+	c := plot.Get(ctx)
+	if c == nil || c.GetGraph(id) != nil {
+		return id, nil
+	}
+	orig := c.GetGraph(graphID)
+	if orig == nil {
+		return id, nil
+	}
+	g, err := c.EnsureGraph(orig.Kind, id, orig.GroupID)
+	if err != nil {
+		return "", errors.Annotate(err, "failed to clone graph '%s'", graphID)
+	}
+	title := orig.Title
+	if title == "" {
+		title = graphID
+	}
+	g.SetTitle(prefix + title).SetXLabel(orig.XLabel).SetYLogScale(orig.YLogScale)
+	return id, nil
+}
+
+// Subsample p to at most n uniformly spaced points, always keeping the first
+// and, for n > 1, the last one. Does nothing when n <= 0 or p already has at
+// most n points. The data slices of p are replaced rather than modified, as
+// they may be shared with the caller.
+func Subsample(p *plot.Plot, n int) {
+	l := len(p.Y)
+	if n <= 0 || l <= n {
+		return
+	}
+	ys := make([]float64, n)
+	var xs []float64
+	if p.X != nil {
+		xs = make([]float64, n)
+	}
+	var dates []db.Date
+	if p.Dates != nil {
+		dates = make([]db.Date, n)
+	}
+	for i := 0; i < n; i++ {
+		var j int
+		if n > 1 {
+			j = i * (l - 1) / (n - 1)
+		}
+		ys[i] = p.Y[j]
+		if xs != nil {
+			xs[i] = p.X[j]
+		}
+		if dates != nil {
+			dates[i] = p.Dates[j]
+		}
+	}
+	p.X, p.Y, p.Dates = xs, ys, dates
+}
+
+// Default groups for automatically created graphs.
+const (
+	AutoGroupID           = "auto"
+	AutoTimeseriesGroupID = "auto timeseries"
+)
+
+// AddPlot adds p to the graph by ID, like plot.Add. When enabled by
+// UseAutoCreateGraphs, a missing graph is first created in the default group
+// of the plot's kind. When limited by UseMaxPoints, timeseries and scatter
+// plots are subsampled in place; the other XY plots, such as p.d.f.s and
+// analytical curves, are sized by their configs and are added intact.
+// The graph ID is prefixed as configured by UseGraphPrefix.
+func AddPlot(ctx context.Context, p *plot.Plot, graphID string) error {
+	if n, ok := ctx.Value(maxPointsContextKey).(int); ok {
+		if p.Kind == plot.KindSeries || p.ChartType == plot.ChartScatter {
+			Subsample(p, n)
+		}
+	}
+	graphID, err := prefixGraph(ctx, graphID)
+	if err != nil {
+		return errors.Annotate(err, "failed to prefix graph ID")
+	}
+	if auto, _ := ctx.Value(autoCreateGraphsContextKey).(bool); auto {
+		c := plot.Get(ctx)
+		if c == nil {
+			return errors.Reason("no Canvas in context")
+		}
+		if c.GetGraph(graphID) == nil {
+			groupID := AutoGroupID
+			if p.Kind == plot.KindSeries {
+				groupID = AutoTimeseriesGroupID
+			}
+			if c.GetGroup(groupID) == nil {
+				if err := c.AddGroup(plot.NewGroup(p.Kind, groupID)); err != nil {
+					return errors.Annotate(err, "failed to create group '%s'", groupID)
+				}
+			}
+			g, err := c.EnsureGraph(p.Kind, graphID, groupID)
+			if err != nil {
+				return errors.Annotate(err, "failed to create graph '%s'", graphID)
+			}
+			g.SetTitle(graphID)
+		}
+	}
+	return plot.Add(ctx, p, graphID)
+}
+
+// SharedBuckets are the histogram buckets shared by all the distribution plots
+// in the graphs of a group, by group ID, see config.Config. Fixed buckets are
+// looked up when a histogram is built, see PlotBuckets, and when it is plotted.
+// Buckets with "auto bounds" are fitted once to the pooled samples of the
+// group's sample distributions, which are therefore plotted only by
+// PlotSharedDistributions.
+type SharedBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*stats.Buckets
+	groups  []string // groups with deferred plots, in the order of first use
+	pending map[string][]*pendingDistribution
+}
+
+// pendingDistribution is a sample distribution plot deferred until the shared
+// buckets of its group are fitted. It retains the context of its experiment,
+// which determines the graph prefix, the output directory and the values.
+type pendingDistribution struct {
+	ctx    context.Context
+	sample []float64
+	c      *config.DistributionPlot
+	prefix string
+	legend string
+}
+
+// NewSharedBuckets creates SharedBuckets from the buckets by group ID.
+func NewSharedBuckets(buckets map[string]*stats.Buckets) *SharedBuckets {
+	return &SharedBuckets{
+		buckets: buckets,
+		pending: make(map[string][]*pendingDistribution),
+	}
+}
+
+// UseSharedBuckets injects SharedBuckets into the context, to be used by
+// PlotBuckets and PlotDistribution.
+func UseSharedBuckets(ctx context.Context, s *SharedBuckets) context.Context {
+	return context.WithValue(ctx, sharedBucketsContextKey, s)
+}
+
+// graphGroup returns the ID of the group where AddPlot places graphID: the
+// group of the existing (prefixed) graph, of the graph it is cloned from when
+// prefixed, or the default group of automatically created graphs. It is empty
+// if the graph cannot be placed.
+func graphGroup(ctx context.Context, graphID string) string {
+	c := plot.Get(ctx)
+	if c == nil || graphID == "" {
+		return ""
+	}
+	prefix, _ := ctx.Value(graphPrefixContextKey).(string)
+	if g := c.GetGraph(prefix + graphID); g != nil {
+		return g.GroupID
+	}
+	if g := c.GetGraph(graphID); prefix != "" && g != nil {
+		return g.GroupID
+	}
+	if auto, _ := ctx.Value(autoCreateGraphsContextKey).(bool); auto {
+		return AutoGroupID
+	}
+	return ""
+}
+
+// lookup the group with shared buckets of the graphs of c, if any.
+func (s *SharedBuckets) lookup(ctx context.Context, c *config.DistributionPlot) (string, *stats.Buckets) {
+	for _, g := range []string{c.Graph, c.CountsGraph, c.ErrorsGraph} {
+		id := graphGroup(ctx, g)
+		if b, ok := s.buckets[id]; ok {
+			return id, b
+		}
+	}
+	return "", nil
+}
+
+func (s *SharedBuckets) addPending(groupID string, p *pendingDistribution) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[groupID]; !ok {
+		s.groups = append(s.groups, groupID)
+	}
+	s.pending[groupID] = append(s.pending[groupID], p)
+}
+
+// LookupSharedBuckets returns the fixed buckets shared by the group of c's
+// graphs when enabled by UseSharedBuckets, or nil.
+func LookupSharedBuckets(ctx context.Context, c *config.DistributionPlot) *stats.Buckets {
+	if s, ok := ctx.Value(sharedBucketsContextKey).(*SharedBuckets); ok {
+		if _, b := s.lookup(ctx, c); b != nil && !b.Auto {
+			return b
+		}
+	}
+	return nil
+}
+
+// PlotBuckets returns the buckets for accumulating a histogram incrementally,
+// to be plotted according to c: the fixed buckets shared by the group of c's
+// graphs, if any, or c.Buckets otherwise.
+func PlotBuckets(ctx context.Context, c *config.DistributionPlot) *stats.Buckets {
+	if b := LookupSharedBuckets(ctx, c); b != nil {
+		return b
+	}
+	return &c.Buckets
+}
+
+// PlotSharedDistributions fits the shared buckets with "auto bounds" to the
+// pooled samples of each group and plots the distributions deferred by
+// PlotDistribution. Does nothing unless enabled by UseSharedBuckets.
+func PlotSharedDistributions(ctx context.Context) error {
+	s, ok := ctx.Value(sharedBucketsContextKey).(*SharedBuckets)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	groups, pending := s.groups, s.pending
+	s.groups, s.pending = nil, make(map[string][]*pendingDistribution)
+	s.mu.Unlock()
+	for _, id := range groups {
+		var pooled []float64
+		for _, p := range pending[id] {
+			pooled = append(pooled, p.sample...)
+		}
+		b := *s.buckets[id] // copy, to fit locally
+		if err := FitBuckets(&b, pooled); err != nil {
+			return errors.Annotate(err, "failed to fit shared buckets of group '%s'", id)
+		}
+		b.Auto = false
+		for _, p := range pending[id] {
+			c := *p.c
+			c.Buckets = b
+			c.BucketRule = ""
+			dist := stats.NewSampleDistribution(p.sample, &c.Buckets)
+			if err := plotDistribution(p.ctx, dist, &c, p.prefix, p.legend); err != nil {
+				return errors.Annotate(err, "failed to plot '%s'", p.legend)
+			}
+		}
+	}
+	return nil
+}
+
+// UseValuesWriter injects an io.Writer into the context, to which AddValue
+// streams each value as it is added, in addition to storing it in Values.
+func UseValuesWriter(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, valuesWriterContextKey, w)
+}
+
+// AddValue adds (or overwrites) a <prefix key>:value string pair to the Values
+// in the context. See AddTypedValue for details.
 func AddValue(ctx context.Context, prefix, key, value string) error {
+	return AddTypedValue(ctx, prefix, key, StringValue(value))
+}
+
+// AddTypedValue adds (or overwrites) a <prefix key>:value pair to the Values in
+// the context as a string, to the TypedValues and instance values, if any, and
+// writes it to the values writer, if any.
+func AddTypedValue(ctx context.Context, prefix, key string, value Value) error {
 	v := GetValues(ctx)
 	if v == nil {
 		return errors.Reason("no values map in context")
 	}
-	v[Prefix(prefix, key)] = value
+	k := Prefix(prefix, key)
+	v[k] = value.String()
+	if tv := GetTypedValues(ctx); tv != nil {
+		tv[k] = value
+	}
+	if iv, ok := ctx.Value(instanceValuesContextKey).(TypedValues); ok {
+		iv[k] = value
+	}
+	if w, ok := ctx.Value(valuesWriterContextKey).(io.Writer); ok {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", k, v[k]); err != nil {
+			return errors.Annotate(err, "failed to write value for '%s'", k)
+		}
+	}
+	return nil
+}
+
+// AddInterval adds the estimate m of a statistic with its confidence interval
+// [low, high] as the float values <key>, "<key> low" and "<key> high".
+func AddInterval(ctx context.Context, prefix, key string, m, low, high float64) error {
+	for _, v := range []struct {
+		key string
+		x   float64
+	}{
+		{key, m},
+		{key + " low", low},
+		{key + " high", high},
+	} {
+		if err := AddTypedValue(ctx, prefix, v.key, FloatValue(v.x)); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", v.key)
+		}
+	}
+	return nil
+}
+
+// WriteValuesJSON writes TypedValues as a JSON object keyed by value names.
+func WriteValuesJSON(w io.Writer, values TypedValues) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(values); err != nil {
+		return errors.Annotate(err, "failed to encode values")
+	}
+	return nil
+}
+
+// ReadValuesJSON reads TypedValues previously written by WriteValuesJSON.
+func ReadValuesJSON(r io.Reader) (TypedValues, error) {
+	values := make(TypedValues)
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return nil, errors.Annotate(err, "failed to decode values")
+	}
+	return values, nil
+}
+
+type valueRow struct {
+	Key   string
+	Value Value
+}
+
+// CSV implements table.Row.
+func (r valueRow) CSV() []string {
+	return []string{r.Key, string(r.Value.Kind), r.Value.Plain(), r.Value.Unit}
+}
+
+// WriteValuesCSV writes TypedValues as a CSV table sorted by value names, with
+// the full precision of the numeric values.
+func WriteValuesCSV(w io.Writer, values TypedValues) error {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	t := table.NewTable("Name", "Kind", "Value", "Unit")
+	for _, k := range keys {
+		t.AddRow(valueRow{Key: k, Value: values[k]})
+	}
+	if err := t.WriteCSV(w, table.Params{}); err != nil {
+		return errors.Annotate(err, "failed to write values CSV")
+	}
 	return nil
 }
 
@@ -137,12 +781,124 @@ func minMax(ys []float64) (float64, float64) {
 	return min, max
 }
 
+// FitBuckets fits b to the data like Buckets.FitTo, except that the data does
+// not need to be sorted. In case of an error, b is preserved.
+func FitBuckets(b *stats.Buckets, data []float64) error {
+	if len(data) == 0 {
+		return errors.Reason("no data to fit buckets to")
+	}
+	if !sort.Float64sAreSorted(data) {
+		data = append([]float64{}, data...)
+		sort.Float64s(data)
+	}
+	return b.FitTo(data)
+}
+
+// NewSampleDistribution creates a SampleDistribution of the data with the
+// buckets of c automatically selected according to c.BucketRule when "auto
+// bounds" is set. Like stats.NewSampleDistribution, it sorts data in place.
+// Unlike it, c.Buckets are not modified.
+func NewSampleDistribution(data []float64, c *config.DistributionPlot) *stats.SampleDistribution {
+	sort.Float64s(data)
+	b := c.Buckets // copy, to fit locally
+	if b.Auto && len(data) >= 2 {
+		fitBucketRule(&b, data, c) // ignore the error, it preserves the value
+		b.Auto = false
+	}
+	return stats.NewSampleDistribution(data, &b)
+}
+
+// fitBucketRule fits b to the sorted data according to c.BucketRule.
+func fitBucketRule(b *stats.Buckets, data []float64, c *config.DistributionPlot) error {
+	switch c.BucketRule {
+	case "quantile":
+		lo := int(c.BucketQuantile * float64(len(data)))
+		if hi := len(data) - lo; hi-lo >= 2 {
+			data = data[lo:hi]
+		}
+	case "freedman-diaconis":
+		iqr := SortedQuantile(data, 0.75) - SortedQuantile(data, 0.25)
+		if iqr > 0 {
+			width := 2 * iqr * math.Pow(float64(len(data)), -1.0/3.0)
+			n := int(math.Ceil((data[len(data)-1] - data[0]) / width))
+			copy := *b
+			copy.N = int(math.Min(math.Max(float64(n), 3), 1000))
+			if err := copy.FitTo(data); err != nil {
+				return errors.Annotate(err, "failed to fit buckets")
+			}
+			*b = copy
+			return nil
+		}
+	}
+	return b.FitTo(data)
+}
+
+// FitPlotBuckets returns a copy of c with the buckets fitted to the sample
+// according to c.BucketRule when "auto bounds" is set, for a histogram
+// accumulated incrementally, e.g. from streamed log-profits. The rule is
+// cleared in the copy, as it is already applied. Sorts the sample in place.
+func FitPlotBuckets(c *config.DistributionPlot, sample []float64) (*config.DistributionPlot, error) {
+	res := *c
+	if !res.Buckets.Auto {
+		return &res, nil
+	}
+	if len(sample) < 2 {
+		return nil, errors.Reason("too few samples to fit buckets: %d", len(sample))
+	}
+	sort.Float64s(sample)
+	if err := fitBucketRule(&res.Buckets, sample, &res); err != nil {
+		return nil, errors.Annotate(err, "failed to fit buckets")
+	}
+	res.Buckets.Auto = false
+	res.BucketRule = ""
+	return &res, nil
+}
+
 // PlotDistribution dh, specifically its p.d.f. as approximated by
 // dh.Histogram(), and related plots according to the config c.
+//
+// When the group of c's graphs shares buckets, see UseSharedBuckets, a sample
+// distribution is rebucketed with the shared buckets, or deferred until
+// PlotSharedDistributions when they have "auto bounds". Any other histogram,
+// e.g. accumulated incrementally, must already use the shared fixed buckets,
+// see PlotBuckets.
 func PlotDistribution(ctx context.Context, dh stats.DistributionWithHistogram, c *config.DistributionPlot, prefix, legend string) error {
 	if c == nil {
 		return nil
 	}
+	if s, ok := ctx.Value(sharedBucketsContextKey).(*SharedBuckets); ok {
+		if id, b := s.lookup(ctx, c); b != nil {
+			sd, isSample := dh.(*stats.SampleDistribution)
+			if isSample && b.Auto {
+				s.addPending(id, &pendingDistribution{
+					ctx:    ctx,
+					sample: sd.Sample().Data(),
+					c:      c,
+					prefix: prefix,
+					legend: legend,
+				})
+				return nil
+			}
+			shared := *c
+			shared.Buckets = *b
+			shared.BucketRule = ""
+			c = &shared
+			switch {
+			case isSample:
+				dh = stats.NewSampleDistribution(sd.Sample().Data(), &c.Buckets)
+			case b.Auto || !dh.Histogram().Buckets().SameAs(b):
+				return errors.Reason("'%s' has a histogram with its own buckets and cannot use the shared buckets of group '%s'", legend, id)
+			}
+		}
+	}
+	return plotDistribution(ctx, dh, c, prefix, legend)
+}
+
+// plotDistribution implements PlotDistribution once the buckets are resolved.
+func plotDistribution(ctx context.Context, dh stats.DistributionWithHistogram, c *config.DistributionPlot, prefix, legend string) error {
+	if _, ok := dh.(*stats.SampleDistribution); !ok && c.BucketRule != "" {
+		return errors.Reason(`"bucket rule" is not supported for '%s': it is accumulated incrementally with the fixed buckets`, legend)
+	}
 	var xs0 []float64
 	var ys []float64
 
@@ -157,8 +913,13 @@ func PlotDistribution(ctx context.Context, dh stats.DistributionWithHistogram, c
 	xs, ys := filterXY(xs0, ys, c)
 	min, max := minMax(ys)
 	prefixedLegend := Prefix(prefix, legend)
-	if err := plotDist(ctx, h, xs, ys, c, prefixedLegend); err != nil {
-		return errors.Annotate(err, "failed to plot '%s'", legend)
+	if c.KDE == nil || !c.KDE.Replace {
+		if err := plotDist(ctx, h, xs, ys, c, prefixedLegend); err != nil {
+			return errors.Annotate(err, "failed to plot '%s'", legend)
+		}
+	}
+	if err := plotKDE(ctx, dh, xs0, c, prefixedLegend); err != nil {
+		return errors.Annotate(err, "failed to plot '%s KDE'", legend)
 	}
 	if err := plotCounts(ctx, h, xs0, c, prefixedLegend); err != nil {
 		return errors.Annotate(err, "failed to plot '%s counts'", legend)
@@ -166,6 +927,9 @@ func PlotDistribution(ctx context.Context, dh stats.DistributionWithHistogram, c
 	if err := plotErrors(ctx, h, xs0, c, prefixedLegend); err != nil {
 		return errors.Annotate(err, "failed to plot '%s errors'", legend)
 	}
+	if err := plotErrorBands(ctx, h, xs0, c, prefixedLegend); err != nil {
+		return errors.Annotate(err, "failed to plot '%s error bands'", legend)
+	}
 	if c.PlotMean {
 		if err := plotMean(ctx, dh, c.Graph, min, max, prefixedLegend); err != nil {
 			return errors.Annotate(err, "failed to plot '%s mean'", legend)
@@ -174,38 +938,210 @@ func PlotDistribution(ctx context.Context, dh stats.DistributionWithHistogram, c
 	if err := plotPercentiles(ctx, dh, c, min, max, prefixedLegend); err != nil {
 		return errors.Annotate(err, "failed to plot '%s percentiles'", legend)
 	}
+	if err := addVaR(ctx, dh, c, min, max, prefix, legend); err != nil {
+		return errors.Annotate(err, "failed to add '%s' VaR", legend)
+	}
 	if err := plotAnalytical(ctx, dh, c, prefix, legend); err != nil {
 		return errors.Annotate(err, "failed to plot '%s ref dist'", legend)
 	}
+	if err := plotGPD(ctx, h, c.GPD, prefix, legend); err != nil {
+		return errors.Annotate(err, "failed to plot '%s' GPD fit", legend)
+	}
+	if err := addSummary(ctx, dh, c, prefixedLegend); err != nil {
+		return errors.Annotate(err, "failed to add '%s' summary", legend)
+	}
+	if c.HistogramFile != "" {
+		if err := WriteHistogram(OutputPath(ctx, c.HistogramFile), h); err != nil {
+			return errors.Annotate(err, "failed to write '%s' histogram", legend)
+		}
+	}
 	return nil
 }
 
-func plotDist(ctx context.Context, h *stats.Histogram, xs, ys []float64, c *config.DistributionPlot, legend string) error {
-	if c.Graph == "" {
+// SummaryRow is a row of summary statistics of a distribution.
+type SummaryRow struct {
+	Legend   string
+	N        uint
+	Mean     float64
+	MAD      float64
+	Sigma    float64
+	Skew     float64
+	Kurtosis float64 // excess kurtosis, 0 for the normal distribution
+	Q1       float64 // 1% quantile
+	Q99      float64 // 99% quantile
+	Alpha    float64 // derived alpha of a T-distribution, when HasAlpha
+	HasAlpha bool
+}
+
+var _ table.Row = SummaryRow{}
+
+// SummaryHeader is the CSV header of the summary statistics table.
+func SummaryHeader() []string {
+	return []string{"Legend", "N", "Mean", "MAD", "Sigma", "Skew", "Kurtosis",
+		"1%", "99%", "Alpha"}
+}
+
+func (r SummaryRow) CSV() []string {
+	f := func(x float64) string { return strconv.FormatFloat(x, 'g', -1, 64) }
+	alpha := ""
+	if r.HasAlpha {
+		alpha = f(r.Alpha)
+	}
+	return []string{r.Legend, strconv.FormatUint(uint64(r.N), 10), f(r.Mean),
+		f(r.MAD), f(r.Sigma), f(r.Skew), f(r.Kurtosis), f(r.Q1), f(r.Q99), alpha}
+}
+
+// Summary computes summary statistics of dh. Skew and kurtosis are
+// approximated by the histogram's bucket means.
+func Summary(dh stats.DistributionWithHistogram, c *config.DistributionPlot, legend string) SummaryRow {
+	h := dh.Histogram()
+	r := SummaryRow{
+		Legend: legend,
+		N:      h.CountsTotal(),
+		Mean:   dh.Mean(),
+		MAD:    dh.MAD(),
+		Sigma:  math.Sqrt(dh.Variance()),
+		Q1:     dh.Quantile(0.01),
+		Q99:    dh.Quantile(0.99),
+	}
+	if r.N > 0 {
+		r.Skew = stat.Skew(h.Xs(), h.Weights())
+		r.Kurtosis = stat.ExKurtosis(h.Xs(), h.Weights())
+	}
+	if c.DeriveAlpha != nil {
+		r.Alpha = deriveAlpha(dh, r.Mean, r.MAD, c.DeriveAlpha)
+		r.HasAlpha = true
+	}
+	return r
+}
+
+func addSummary(ctx context.Context, dh stats.DistributionWithHistogram, c *config.DistributionPlot, legend string) error {
+	if c.SummaryCSV == "" {
 		return nil
 	}
-	plt, err := plot.NewXYPlot(xs, ys)
-	if err != nil {
-		return errors.Annotate(err, "failed to create plot '%s'", legend)
-	}
-	yLabel := "p.d.f."
-	plt.SetLegend(legend + " " + yLabel)
-	if c.LogY {
-		yLabel = "log10(" + yLabel + ")"
-	}
-	plt.SetYLabel(yLabel)
-	if c.ChartType == "bars" {
-		plt.SetChartType(plot.ChartBars)
+	tables := GetSummaryTables(ctx)
+	if tables == nil {
+		return errors.Reason("no summary tables in context")
 	}
-	plt.SetLeftAxis(c.LeftAxis)
-	if err := plot.Add(ctx, plt, c.Graph); err != nil {
-		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	path := OutputPath(ctx, c.SummaryCSV)
+	t, ok := tables[path]
+	if !ok {
+		t = table.NewTable(SummaryHeader()...)
+		tables[path] = t
 	}
+	t.AddRow(Summary(dh, c, legend))
 	return nil
 }
 
-func plotCounts(ctx context.Context, h *stats.Histogram, xs []float64, c *config.DistributionPlot, legend string) error {
-	if c.CountsGraph == "" {
+// KernelDensity estimates the p.d.f. at the points `at` from the samples xs
+// with the corresponding weights according to the config.
+func KernelDensity(xs, weights, at []float64, c *config.KDE) ([]float64, error) {
+	if len(xs) != len(weights) {
+		return nil, errors.Reason("len(xs)=%d != len(weights)=%d",
+			len(xs), len(weights))
+	}
+	var sumW, sumW2 float64
+	for _, w := range weights {
+		sumW += w
+		sumW2 += w * w
+	}
+	if sumW <= 0 {
+		return nil, errors.Reason("no samples")
+	}
+	bw := c.Bandwidth
+	if bw == 0 {
+		// Silverman's rule of thumb with the effective number of samples.
+		sorted := append([]float64{}, xs...)
+		ws := append([]float64{}, weights...)
+		stat.SortWeighted(sorted, ws)
+		iqr := stat.Quantile(0.75, stat.Empirical, sorted, ws) -
+			stat.Quantile(0.25, stat.Empirical, sorted, ws)
+		spread := stat.StdDev(xs, weights)
+		if iqr > 0 && iqr/1.34 < spread {
+			spread = iqr / 1.34
+		}
+		bw = 0.9 * spread * math.Pow(sumW*sumW/sumW2, -0.2)
+	}
+	if !(bw > 0) {
+		return nil, errors.Reason("bandwidth=%g must be > 0", bw)
+	}
+	kernel := func(u float64) float64 {
+		return math.Exp(-u*u/2) / math.Sqrt(2*math.Pi)
+	}
+	if c.Kernel == "epanechnikov" {
+		kernel = func(u float64) float64 {
+			if math.Abs(u) >= 1 {
+				return 0
+			}
+			return 0.75 * (1 - u*u)
+		}
+	}
+	res := make([]float64, len(at))
+	for i, a := range at {
+		var y float64
+		for j, x := range xs {
+			y += weights[j] * kernel((a-x)/bw)
+		}
+		res[i] = y / (sumW * bw)
+	}
+	return res, nil
+}
+
+func plotKDE(ctx context.Context, dh stats.DistributionWithHistogram, xs []float64, c *config.DistributionPlot, legend string) error {
+	if c.KDE == nil || c.Graph == "" {
+		return nil
+	}
+	samples, weights, _ := fitSamples(dh)
+	if len(samples) == 0 {
+		return nil
+	}
+	ys, err := KernelDensity(samples, weights, xs, c.KDE)
+	if err != nil {
+		return errors.Annotate(err, "failed to compute KDE")
+	}
+	xs, ys = filterXY(xs, ys, c)
+	legend += " KDE"
+	plt, err := plot.NewXYPlot(xs, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	yLabel := "p.d.f."
+	if c.LogY {
+		yLabel = "log10(" + yLabel + ")"
+	}
+	plt.SetLegend(legend).SetYLabel(yLabel).SetLeftAxis(c.LeftAxis)
+	if err := AddPlot(ctx, plt, c.Graph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	return nil
+}
+
+func plotDist(ctx context.Context, h *stats.Histogram, xs, ys []float64, c *config.DistributionPlot, legend string) error {
+	if c.Graph == "" {
+		return nil
+	}
+	plt, err := plot.NewXYPlot(xs, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	yLabel := "p.d.f."
+	plt.SetLegend(legend + " " + yLabel)
+	if c.LogY {
+		yLabel = "log10(" + yLabel + ")"
+	}
+	plt.SetYLabel(yLabel)
+	if c.ChartType == "bars" {
+		plt.SetChartType(plot.ChartBars)
+	}
+	plt.SetLeftAxis(c.LeftAxis)
+	if err := AddPlot(ctx, plt, c.Graph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	return nil
+}
+
+func plotCounts(ctx context.Context, h *stats.Histogram, xs []float64, c *config.DistributionPlot, legend string) error {
+	if c.CountsGraph == "" {
 		return nil
 	}
 	cs := make([]float64, len(h.Counts()))
@@ -222,12 +1158,63 @@ func plotCounts(ctx context.Context, h *stats.Histogram, xs []float64, c *config
 	if c.ChartType == "bars" {
 		plt.SetChartType(plot.ChartBars)
 	}
-	if err := plot.Add(ctx, plt, c.CountsGraph); err != nil {
+	if err := AddPlot(ctx, plt, c.CountsGraph); err != nil {
 		return errors.Annotate(err, "failed to add plot '%s counts'", legend)
 	}
 	return nil
 }
 
+// plotErrorBands plots the p.d.f. +- k standard errors around the p.d.f. in the
+// main graph. Buckets with zero p.d.f. are skipped, and so are the non-positive
+// lower band values in the log scale.
+func plotErrorBands(ctx context.Context, h *stats.Histogram, xs []float64, c *config.DistributionPlot, legend string) error {
+	if c.ErrorBands <= 0 || c.Graph == "" {
+		return nil
+	}
+	pdfs := h.PDFs()
+	errs := h.StdErrors()
+	var lowXs, lows, highXs, highs []float64
+	for i, p := range pdfs {
+		if p <= 0 {
+			continue
+		}
+		d := c.ErrorBands * errs[i]
+		highXs = append(highXs, xs[i])
+		highs = append(highs, p+d)
+		if low := p - d; low > 0 || !c.LogY {
+			lowXs = append(lowXs, xs[i])
+			lows = append(lows, math.Max(low, 0))
+		}
+	}
+	yLabel := "p.d.f."
+	if c.LogY {
+		yLabel = "log10(" + yLabel + ")"
+	}
+	k := fmt.Sprintf("%g", c.ErrorBands)
+	for _, b := range []struct {
+		xs, ys []float64
+		suffix string
+	}{
+		{highXs, highs, " p.d.f.+" + k + "*stderr"},
+		{lowXs, lows, " p.d.f.-" + k + "*stderr"},
+	} {
+		if len(b.xs) == 0 {
+			continue
+		}
+		lgd := legend + b.suffix
+		plt, err := plot.NewXYPlot(b.xs, maybeLog10(b.ys, c))
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", lgd)
+		}
+		plt.SetLegend(lgd).SetYLabel(yLabel).SetChartType(plot.ChartDashed)
+		plt.SetLeftAxis(c.LeftAxis)
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", lgd)
+		}
+	}
+	return nil
+}
+
 func plotErrors(ctx context.Context, h *stats.Histogram, xs []float64, c *config.DistributionPlot, legend string) error {
 	if c.ErrorsGraph == "" {
 		return nil
@@ -250,7 +1237,7 @@ func plotErrors(ctx context.Context, h *stats.Histogram, xs []float64, c *config
 	if c.ChartType == "bars" {
 		plt.SetChartType(plot.ChartBars)
 	}
-	if err := plot.Add(ctx, plt, c.ErrorsGraph); err != nil {
+	if err := AddPlot(ctx, plt, c.ErrorsGraph); err != nil {
 		return errors.Annotate(err, "failed to add plot '%s errors'", legend)
 	}
 	return nil
@@ -267,7 +1254,7 @@ func plotMean(ctx context.Context, dh stats.DistributionWithHistogram, graph str
 	}
 	plt.SetLegend(fmt.Sprintf("%s mean=%.4g", legend, x))
 	plt.SetYLabel("").SetChartType(plot.ChartDashed)
-	if err := plot.Add(ctx, plt, graph); err != nil {
+	if err := AddPlot(ctx, plt, graph); err != nil {
 		return errors.Annotate(err, "failed to add '%s mean' plot", legend)
 	}
 	return nil
@@ -286,25 +1273,104 @@ func plotPercentiles(ctx context.Context, dh stats.DistributionWithHistogram, c
 		}
 		plt.SetLegend(fmt.Sprintf("%s %gth %%-ile=%.3g", legend, p, x))
 		plt.SetYLabel("").SetChartType(plot.ChartDashed)
-		if err := plot.Add(ctx, plt, c.Graph); err != nil {
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
 			return errors.Annotate(err, "failed to add plot '%s %gth %%-ile'", legend, p)
 		}
 	}
 	return nil
 }
 
+// HistogramES is the Expected Shortfall of the sample distribution h at the
+// tail probability p in (0..1), that is, the mean of the lowest p fraction of
+// the samples. The samples in each bucket are approximated by their mean.
+func HistogramES(h *stats.Histogram, p float64) float64 {
+	need := p * h.WeightsTotal()
+	if need <= 0 {
+		return math.NaN()
+	}
+	var acc, sum float64
+	for i, w := range h.Weights() {
+		if acc >= need {
+			break
+		}
+		take := math.Min(w, need-acc)
+		sum += take * h.X(i)
+		acc += take
+	}
+	return sum / need
+}
+
+// ExpectedShortfall of the distribution d at the tail probability p in
+// (0..1), that is, the mean of d below its p-quantile, computed by integrating
+// the quantile function.
+func ExpectedShortfall(d stats.Distribution, p float64) float64 {
+	const n = 1000
+	var sum float64
+	for i := 0; i < n; i++ {
+		sum += d.Quantile(p * (float64(i) + 0.5) / n)
+	}
+	return sum / n
+}
+
+// addVaRValues adds the Value-at-Risk and Expected Shortfall values for each
+// of the confidence levels, computed by the functions of the tail probability.
+func addVaRValues(ctx context.Context, levels []float64, varF, esF func(float64) float64, prefix, legend string) error {
+	for _, l := range levels {
+		p := 1 - l/100
+		k := fmt.Sprintf("%s VaR %g%%", legend, l)
+		if err := AddTypedValue(ctx, prefix, k, FloatValue(varF(p))); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+		k = fmt.Sprintf("%s ES %g%%", legend, l)
+		if err := AddTypedValue(ctx, prefix, k, FloatValue(esF(p))); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+	}
+	return nil
+}
+
+func addVaR(ctx context.Context, dh stats.DistributionWithHistogram, c *config.DistributionPlot, min, max float64, prefix, legend string) error {
+	esF := func(p float64) float64 { return HistogramES(dh.Histogram(), p) }
+	if err := addVaRValues(ctx, c.VaRLevels, dh.Quantile, esF, prefix, legend); err != nil {
+		return errors.Annotate(err, "failed to add VaR values")
+	}
+	if !c.PlotVaR || c.Graph == "" {
+		return nil
+	}
+	prefixedLegend := Prefix(prefix, legend)
+	for _, l := range c.VaRLevels {
+		x := dh.Quantile(1 - l/100)
+		plt, err := plot.NewXYPlot([]float64{x, x}, []float64{min, max})
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s VaR %g%%'",
+				prefixedLegend, l)
+		}
+		plt.SetLegend(fmt.Sprintf("%s VaR %g%%=%.3g", prefixedLegend, l, x))
+		plt.SetYLabel("").SetChartType(plot.ChartDashed)
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s VaR %g%%'",
+				prefixedLegend, l)
+		}
+	}
+	return nil
+}
+
 // DistributionDistance computes a measure between the sample distribution given
 // by h and an analytical distribution d in xs points corresponding to h's
 // buckets, ignoring the buckets with less than ignoreCounts samples. The
 // leftmost and rightmost buckets are always ignored, as they are catch-all
 // buckets and may not accurately represent the p.d.f. value.
 func DistributionDistance(h *stats.Histogram, d stats.Distribution, ignoreCounts int) float64 {
+	return distanceInRange(h, d, ignoreCounts, 1, h.Buckets().N-1)
+}
+
+// distanceInRange is DistributionDistance restricted to the buckets [from..to).
+func distanceInRange(h *stats.Histogram, d stats.Distribution, ignoreCounts, from, to int) float64 {
 	var res float64
 	if ignoreCounts < 0 {
 		ignoreCounts = 0
 	}
-	n := h.Buckets().N
-	for i := 1; i < n-1; i++ {
+	for i := from; i < to; i++ {
 		if h.Count(i) <= uint(ignoreCounts) {
 			continue
 		}
@@ -316,6 +1382,26 @@ func DistributionDistance(h *stats.Histogram, d stats.Distribution, ignoreCounts
 	return res
 }
 
+// KSDistance computes the Kolmogorov-Smirnov distance between the sample
+// distribution given by h and the distribution d, that is, the maximum
+// absolute difference between their c.d.f.s evaluated at h's inner bucket
+// boundaries.
+func KSDistance(h *stats.Histogram, d stats.Distribution) float64 {
+	total := h.WeightsTotal()
+	if total == 0 {
+		return 0
+	}
+	var res, cumul float64
+	b := h.Buckets()
+	for i := 0; i < b.N-1; i++ {
+		cumul += h.Weight(i)
+		if m := math.Abs(cumul/total - d.CDF(b.X(i, 1))); m > res {
+			res = m
+		}
+	}
+	return res
+}
+
 // FindMin is a generic search for a function minimum within [min..max]
 // interval. Stop when the search interval is less than epsilon, or the number
 // of iterations exceeds maxIter.
@@ -336,13 +1422,134 @@ func FindMin(f func(float64) float64, min, max, epsilon float64, maxIter int) fl
 	return (max + min) / 2.0
 }
 
+// Optimize is a generic search for a minimum of a multivariate function f
+// using the Nelder-Mead simplex method starting from init. Stop when both the
+// size of the simplex and the spread of f values over its vertices are at most
+// epsilon, or the number of iterations exceeds maxIter. Returns the best point
+// found so far.
+//
+// Constraints on the parameters are best expressed by the choice of variables,
+// e.g. optimizing log(scale) to keep the scale positive. NaN values of f are
+// treated as +Inf.
+func Optimize(f func([]float64) float64, init []float64, epsilon float64, maxIter int) []float64 {
+	n := len(init)
+	if n == 0 {
+		return nil
+	}
+	eval := func(x []float64) float64 {
+		if y := f(x); !math.IsNaN(y) {
+			return y
+		}
+		return math.Inf(1)
+	}
+	// The initial simplex perturbs each coordinate by 5%, or by a small
+	// absolute step at zero.
+	xs := make([][]float64, n+1)
+	ys := make([]float64, n+1)
+	for i := range xs {
+		xs[i] = append([]float64{}, init...)
+		if i > 0 {
+			if d := 0.05 * xs[i][i-1]; d != 0 {
+				xs[i][i-1] += d
+			} else {
+				xs[i][i-1] = 0.00025
+			}
+		}
+		ys[i] = eval(xs[i])
+	}
+	// point returns x0 + t*(x1 - x0).
+	point := func(x0, x1 []float64, t float64) []float64 {
+		res := make([]float64, n)
+		for i := range res {
+			res[i] = x0[i] + t*(x1[i]-x0[i])
+		}
+		return res
+	}
+	order := func() {
+		sort.Sort(simplex{xs: xs, ys: ys})
+	}
+	converged := func() bool {
+		for i := 1; i <= n; i++ {
+			if math.Abs(ys[i]-ys[0]) > epsilon {
+				return false
+			}
+			for j := range xs[i] {
+				if math.Abs(xs[i][j]-xs[0][j]) > epsilon {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	order()
+	for iter := 0; iter < maxIter && !converged(); iter++ {
+		centroid := make([]float64, n)
+		for _, x := range xs[:n] {
+			for j := range x {
+				centroid[j] += x[j] / float64(n)
+			}
+		}
+		xr := point(centroid, xs[n], -1)
+		yr := eval(xr)
+		switch {
+		case yr < ys[0]:
+			xe := point(centroid, xs[n], -2)
+			if ye := eval(xe); ye < yr {
+				xs[n], ys[n] = xe, ye
+			} else {
+				xs[n], ys[n] = xr, yr
+			}
+		case yr < ys[n-1]:
+			xs[n], ys[n] = xr, yr
+		default:
+			var xc []float64
+			if yr < ys[n] {
+				xc = point(centroid, xr, 0.5) // outside contraction
+			} else {
+				xc = point(centroid, xs[n], 0.5) // inside contraction
+			}
+			if yc := eval(xc); yc < math.Min(yr, ys[n]) {
+				xs[n], ys[n] = xc, yc
+			} else {
+				for i := 1; i <= n; i++ {
+					xs[i] = point(xs[0], xs[i], 0.5)
+					ys[i] = eval(xs[i])
+				}
+			}
+		}
+		order()
+	}
+	return xs[0]
+}
+
+// simplex sorts the vertices of a Nelder-Mead simplex by their function values.
+type simplex struct {
+	xs [][]float64
+	ys []float64
+}
+
+func (s simplex) Len() int           { return len(s.ys) }
+func (s simplex) Less(i, j int) bool { return s.ys[i] < s.ys[j] }
+func (s simplex) Swap(i, j int) {
+	s.xs[i], s.xs[j] = s.xs[j], s.xs[i]
+	s.ys[i], s.ys[j] = s.ys[j], s.ys[i]
+}
+
 // Compound the distribution d; that is, return the distribution of the sum of n
-// samples of d. The compounding is performed according to compType: "direct" (n
-// samples per 1 compounded sample), "fast" (sliding window sum) or "biased"
-// (based on Monte Carlo integration with an appropriate variable substitution),
-// and the configuration of parallel sampling.
-func Compound(ctx context.Context, d stats.Distribution, n int, compType string, c *stats.ParallelSamplingConfig) (dist stats.DistributionWithHistogram, err error) {
-	switch compType {
+// samples of d. The compounding is performed according to cfg.CompoundType:
+// "direct" (n samples per 1 compounded sample), "fast" (sliding window sum),
+// "biased" (based on Monte Carlo integration with an appropriate variable
+// substitution), "exact" (analytical) or "fft" (numerical convolution), and the
+// configuration of parallel sampling. Other fields of cfg are ignored.
+func Compound(ctx context.Context, d stats.Distribution, n int, cfg *config.CompoundDistribution) (dist stats.DistributionWithHistogram, err error) {
+	c := &cfg.Params
+	if Deterministic(ctx) {
+		params := *c
+		params.Workers = 1
+		params.Seed = int(Seed(ctx, uint64(params.Seed)))
+		c = &params
+	}
+	switch compType := cfg.CompoundType; compType {
 	case "direct":
 		dist = stats.CompoundRandDistribution(ctx, d, n, c)
 	case "fast":
@@ -350,6 +1557,14 @@ func Compound(ctx context.Context, d stats.Distribution, n int, compType string,
 	case "biased":
 		h := stats.CompoundHistogram(ctx, d, n, c)
 		dist = stats.NewHistogramDistribution(h)
+	case "exact":
+		dist, err = exactCompound(d, n, &c.Buckets)
+	case "fft":
+		var h *stats.Histogram
+		h, err = fftCompound(d, n, cfg.FFTGrid, &c.Buckets)
+		if err == nil {
+			dist = stats.NewHistogramDistribution(h)
+		}
 	default:
 		err = errors.Reason("unsupported compound type: %s", compType)
 		return
@@ -357,134 +1572,599 @@ func Compound(ctx context.Context, d stats.Distribution, n int, compType string,
 	return
 }
 
-// AnalyticalDistribution instantiates a distribution from config.
-func AnalyticalDistribution(ctx context.Context, c *config.AnalyticalDistribution) (dist stats.Distribution, distName string, err error) {
-	if c == nil {
-		err = errors.Reason("config is nil")
-		return
+// exactDistribution is an analytical distribution whose histogram is computed
+// from its c.d.f., and is therefore free of the sampling noise.
+type exactDistribution struct {
+	stats.Distribution
+	buckets *stats.Buckets
+	h       *stats.Histogram
+}
+
+var _ stats.DistributionWithHistogram = &exactDistribution{}
+
+func (d *exactDistribution) Histogram() *stats.Histogram {
+	if d.h != nil {
+		return d.h
 	}
-	switch c.Name {
-	case "t":
-		dist = stats.NewStudentsTDistribution(c.Alpha, c.Mean, c.MAD)
-		distName = fmt.Sprintf("T(a=%.2f)", c.Alpha)
-	case "normal":
-		dist = stats.NewNormalDistribution(c.Mean, c.MAD)
-		distName = "Gauss"
+	d.h = stats.NewHistogram(d.buckets)
+	weights := make([]float64, d.buckets.N)
+	for i := range weights {
+		weights[i] = d.CDF(d.buckets.Bounds[i+1]) - d.CDF(d.buckets.Bounds[i])
+	}
+	d.h.AddWeights(weights) // the length always matches
+	return d.h
+}
+
+func (d *exactDistribution) Copy() stats.Distribution {
+	return &exactDistribution{
+		Distribution: d.Distribution.Copy(),
+		buckets:      d.buckets,
+		h:            d.h,
+	}
+}
+
+// exactCompound is the analytical distribution of the sum of n samples of d.
+// For n > 1, the source must be normal or stable: the sum of n such samples
+// has the same distribution with the mean multiplied by n, and the scale by
+// sqrt(n) or n^(1/alpha), respectively.
+func exactCompound(d stats.Distribution, n int, buckets *stats.Buckets) (*exactDistribution, error) {
+	if n == 1 {
+		return &exactDistribution{Distribution: d, buckets: buckets}, nil
+	}
+	mean := d.Mean() * float64(n)
+	var dist stats.Distribution
+	switch s := d.(type) {
+	case *stats.Normal:
+		dist = stats.NewNormalDistribution(mean, s.MAD()*math.Sqrt(float64(n)))
+	case *Stable:
+		mad := s.MAD() * math.Pow(float64(n), 1/s.Alpha())
+		dist = NewStableDistribution(s.Alpha(), mean, mad)
 	default:
-		err = errors.Reason("unsuppoted distribution type: '%s'", c.Name)
-		return
+		return nil, errors.Reason("exact compounding is not supported for %T", d)
 	}
-	return
+	return &exactDistribution{Distribution: dist, buckets: buckets}, nil
 }
 
-// CompoundDistribution instantiates a compounded distribution from config.
-// When c.N=1, the source distribution is passed through as is.
-func CompoundDistribution(ctx context.Context, c *config.CompoundDistribution) (dist stats.Distribution, distName string, err error) {
-	switch {
-	case c.AnalyticalSource != nil:
-		dist, distName, err = AnalyticalDistribution(ctx, c.AnalyticalSource)
-		if err != nil {
-			err = errors.Annotate(err, "failed to create analytical distribution")
-			return
+// fftCompound computes the histogram of the sum of n samples of d as the n-fold
+// convolution of d's p.d.f. discretized on the grid of the given size at the
+// points k*dx. The grid spans the widest bound of the buckets symmetrically
+// around 0, and the probability mass of the sum beyond it wraps around and
+// pollutes the opposite tail, so the buckets must cover the bulk of the sum.
+func fftCompound(d stats.Distribution, n, grid int, buckets *stats.Buckets) (*stats.Histogram, error) {
+	lo, hi := buckets.Bounds[0], buckets.Bounds[buckets.N]
+	half := math.Max(math.Abs(lo), math.Abs(hi))
+	if half == 0 {
+		return nil, errors.Reason("buckets must span a non-zero range")
+	}
+	dx := 2 * half / float64(grid)
+	// index j of the grid corresponds to x = k*dx where k = j for j < grid/2
+	// and k = j - grid otherwise.
+	offset := func(j int) float64 {
+		if j >= grid/2 {
+			j -= grid
 		}
-	case c.CompoundSource != nil:
-		dist, distName, err = CompoundDistribution(ctx, c.CompoundSource)
-		if err != nil {
-			err = errors.Annotate(err, "failed to create inner compound distribution")
-			return
+		return float64(j) * dx
+	}
+	p := make([]float64, grid)
+	for j := range p {
+		x := offset(j)
+		p[j] = d.CDF(x+dx/2) - d.CDF(x-dx/2)
+	}
+	fft := fourier.NewFFT(grid)
+	coeffs := fft.Coefficients(nil, p)
+	for i, z := range coeffs {
+		res := complex(1, 0)
+		for k := n; k > 0; k >>= 1 { // z^n by squaring
+			if k&1 == 1 {
+				res *= z
+			}
+			z *= z
 		}
-	default:
-		err = errors.Reason("both analytical and compound sources are nil")
-		return
-	}
-	if c.SourceSamples > 0 {
-		if c.SeedSamples > 0 {
-			dist.Seed(uint64(c.SeedSamples))
+		coeffs[i] = res
+	}
+	q := fft.Sequence(nil, coeffs)
+	h := stats.NewHistogram(buckets)
+	for j, w := range q {
+		w /= float64(grid) // the inverse transform is not normalized
+		x := offset(j)
+		if w <= 0 || x < lo || x > hi {
+			continue
 		}
-		dist = stats.NewSampleDistributionFromRand(
-			dist, c.SourceSamples, &c.Params.Buckets)
-		distName += fmt.Sprintf("[samples=%d]", c.SourceSamples)
-	}
-	if c.N == 1 {
-		return
+		h.AddWithWeight(x, w)
 	}
-	dist, err = Compound(ctx, dist, c.N, c.CompoundType, &c.Params)
-	if err != nil {
-		err = errors.Annotate(err, "failed to compound the distribution")
-		return
+	if h.WeightsTotal() <= 0 {
+		return nil, errors.Reason("no probability mass within the buckets")
 	}
-	distName += fmt.Sprintf(" x %d", c.N)
-	return
+	return h, nil
 }
 
-// synthConfig stores parameters for a single synthetic ticker sequence.
-type synthConfig struct {
-	Start db.Date
-	Days  int
+// Exponential distribution. It is primarily used as a reference for waiting
+// times between independent (Poisson) events.
+type Exponential struct {
+	distuv.Exponential
 }
 
-func saveLengths(lengths []synthConfig, fileName string) error {
-	if fileName == "" {
-		return nil
-	}
-	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return errors.Annotate(err, "failed to open lengths file '%s'", fileName)
-	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	if err := enc.Encode(lengths); err != nil {
-		return errors.Annotate(err, "failed to write JSON to '%s'", fileName)
-	}
-	return nil
+var _ stats.Distribution = &Exponential{}
+
+func (d *Exponential) MAD() float64 {
+	return 2.0 / (math.E * d.Rate)
 }
 
-func readLengths(fileName string) ([]synthConfig, error) {
-	if fileName == "" {
-		return nil, nil
-	}
-	f, err := os.Open(fileName)
-	if err != nil {
-		return nil, errors.Annotate(err, "failed to open lengths file '%s'", fileName)
-	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
-	var lengths []synthConfig
-	if err := dec.Decode(&lengths); err != nil {
-		return nil, errors.Annotate(err, "failed to decode lengths file '%s'", fileName)
-	}
-	return lengths, nil
+func (d *Exponential) Copy() stats.Distribution {
+	return &Exponential{distuv.Exponential{
+		Rate: d.Rate,
+		Src:  rand.NewSource(d.Src.Uint64()),
+	}}
 }
 
-type Prices struct {
-	Ticker string
-	Rows   []db.PriceRow
+func (d *Exponential) Seed(seed uint64) {
+	d.Exponential.Src = rand.NewSource(seed)
 }
 
-type LogProfits struct {
-	Ticker     string
-	Timeseries *stats.Timeseries
+// NewExponentialDistribution creates an instance of an exponential distribution
+// with the given mean, which must be positive.
+func NewExponentialDistribution(mean float64) *Exponential {
+	return &Exponential{distuv.Exponential{
+		Rate: 1.0 / mean,
+		Src:  rand.NewSource(uint64(time.Now().UnixNano())),
+	}}
 }
 
-type withConf[T any] struct {
-	v  T
-	cs []synthConfig
+// Stable is the symmetric alpha-stable distribution with 1 < alpha <= 2, whose
+// tails decay as |x|^-(alpha+1). The sum of n samples is stable with the same
+// alpha and the scale multiplied by n^(1/alpha). Alpha = 2 is the normal
+// distribution.
+type Stable struct {
+	alpha float64
+	mean  float64
+	scale float64 // c in the characteristic function exp(-|c*t|^alpha)
+	rand  *rand.Rand
 }
 
-func sourceDBPrices[T any](ctx context.Context, c *config.Source, f func([]Prices) T) (iterator.IteratorCloser[T], error) {
-	if c.DB == nil {
-		return nil, errors.Reason("DB must not be nil")
+var _ stats.Distribution = &Stable{}
+
+// stableQuadPoints is the number of Gauss-Legendre points for integrating the
+// stable p.d.f. and c.d.f. near the center.
+const stableQuadPoints = 200
+
+// zolotarevIntegral of f over (0..pi/2) in segments halving the distance to
+// pi/2, where the integrands of the far tails are concentrated.
+func zolotarevIntegral(f func(float64) float64) float64 {
+	var res float64
+	lo, width := 0.0, math.Pi/4
+	for i := 0; i < 40; i++ {
+		res += quad.Fixed(f, lo, lo+width, 20, quad.Legendre{}, 0)
+		lo += width
+		width /= 2
 	}
-	mapF := func(tickers []string) withConf[T] {
-		var cs []synthConfig
-		var prices []Prices
-		for _, ticker := range tickers {
-			rows, err := c.DB.Prices(ticker)
-			if err != nil {
-				logging.Warningf(ctx, "failed to read prices for %s: %s",
-					ticker, err.Error())
+	return res
+}
+
+// stableMAD is the mean absolute deviation of the standard stable
+// distribution with the scale c = 1.
+func stableMAD(alpha float64) float64 {
+	return 2 / math.Pi * math.Gamma(1-1/alpha)
+}
+
+// NewStableDistribution creates an instance of the symmetric stable
+// distribution with alpha in (1..2] and the given mean and MAD.
+func NewStableDistribution(alpha, mean, mad float64) *Stable {
+	return &Stable{
+		alpha: alpha,
+		mean:  mean,
+		scale: mad / stableMAD(alpha),
+		rand:  rand.New(rand.NewSource(uint64(time.Now().UnixNano()))),
+	}
+}
+
+// Alpha parameter of the distribution.
+func (d *Stable) Alpha() float64 { return d.alpha }
+
+// Rand samples the distribution by the Chambers-Mallows-Stuck method.
+func (d *Stable) Rand() float64 {
+	a := d.alpha
+	u := math.Pi * (d.rand.Float64() - 0.5)
+	w := d.rand.ExpFloat64()
+	x := math.Sin(a*u) / math.Pow(math.Cos(u), 1/a) *
+		math.Pow(math.Cos((1-a)*u)/w, (1-a)/a)
+	return d.mean + d.scale*x
+}
+
+// v is the V(theta) function of Zolotarev's integral representation of the
+// standard stable distribution, specialized to the symmetric case.
+func (d *Stable) v(theta float64) float64 {
+	a := d.alpha
+	return math.Pow(math.Cos(theta)/math.Sin(a*theta), a/(a-1)) *
+		math.Cos((a-1)*theta) / math.Cos(theta)
+}
+
+// fourierLimit is where the integrands of the inverse Fourier transform of the
+// standard characteristic function exp(-t^alpha) become negligible.
+func (d *Stable) fourierLimit() float64 {
+	return math.Pow(40, 1/d.alpha)
+}
+
+// standardProb is the p.d.f. of the standard distribution at z >= 0. Near the
+// center, the inverse Fourier transform is well-behaved, and Zolotarev's
+// integral is more precise in the tails.
+func (d *Stable) standardProb(z float64) float64 {
+	if z <= 1 {
+		f := func(t float64) float64 {
+			return math.Cos(t*z) * math.Exp(-math.Pow(t, d.alpha))
+		}
+		return quad.Fixed(f, 0, d.fourierLimit(), stableQuadPoints, quad.Legendre{}, 0) / math.Pi
+	}
+	a := d.alpha
+	p := math.Pow(z, a/(a-1))
+	f := func(theta float64) float64 {
+		v := d.v(theta)
+		return v * math.Exp(-p*v)
+	}
+	return a * math.Pow(z, 1/(a-1)) / (math.Pi * (a - 1)) * zolotarevIntegral(f)
+}
+
+// standardTail is P(Z > z) of the standard distribution for z >= 0.
+func (d *Stable) standardTail(z float64) float64 {
+	if z <= 1 {
+		f := func(t float64) float64 {
+			return math.Sin(t*z) / t * math.Exp(-math.Pow(t, d.alpha))
+		}
+		return 0.5 - quad.Fixed(f, 0, d.fourierLimit(), stableQuadPoints, quad.Legendre{}, 0)/math.Pi
+	}
+	p := math.Pow(z, d.alpha/(d.alpha-1))
+	f := func(theta float64) float64 { return math.Exp(-p * d.v(theta)) }
+	return zolotarevIntegral(f) / math.Pi
+}
+
+func (d *Stable) Prob(x float64) float64 {
+	return d.standardProb(math.Abs(x-d.mean)/d.scale) / d.scale
+}
+
+func (d *Stable) CDF(x float64) float64 {
+	z := (x - d.mean) / d.scale
+	if z < 0 {
+		return d.standardTail(-z)
+	}
+	return 1 - d.standardTail(z)
+}
+
+// Quantile inverts the c.d.f. by bisection.
+func (d *Stable) Quantile(p float64) float64 {
+	switch {
+	case p <= 0:
+		return math.Inf(-1)
+	case p >= 1:
+		return math.Inf(1)
+	case p == 0.5:
+		return d.mean
+	}
+	tail := math.Min(p, 1-p)
+	hi := 1.0
+	for d.standardTail(hi) > tail && hi < 1e300 {
+		hi *= 2
+	}
+	lo := 0.0
+	for i := 0; i < 100 && hi-lo > 1e-12*hi; i++ {
+		mid := (lo + hi) / 2
+		if d.standardTail(mid) > tail {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	z := (lo + hi) / 2
+	if p < 0.5 {
+		z = -z
+	}
+	return d.mean + d.scale*z
+}
+
+func (d *Stable) Mean() float64 { return d.mean }
+
+func (d *Stable) MAD() float64 { return d.scale * stableMAD(d.alpha) }
+
+// Variance is infinite for alpha < 2.
+func (d *Stable) Variance() float64 {
+	if d.alpha < 2 {
+		return math.Inf(1)
+	}
+	return 2 * d.scale * d.scale
+}
+
+func (d *Stable) Copy() stats.Distribution {
+	c := *d
+	c.rand = rand.New(rand.NewSource(d.rand.Uint64()))
+	return &c
+}
+
+func (d *Stable) Seed(seed uint64) {
+	d.rand = rand.New(rand.NewSource(seed))
+}
+
+// AnalyticalDistribution instantiates a distribution from config.
+func AnalyticalDistribution(ctx context.Context, c *config.AnalyticalDistribution) (dist stats.Distribution, distName string, err error) {
+	if c == nil {
+		err = errors.Reason("config is nil")
+		return
+	}
+	switch c.Name {
+	case "t":
+		dist = stats.NewStudentsTDistribution(c.Alpha, c.Mean, c.MAD)
+		distName = fmt.Sprintf("T(a=%.2f)", c.Alpha)
+	case "normal":
+		dist = stats.NewNormalDistribution(c.Mean, c.MAD)
+		distName = "Gauss"
+	case "exponential":
+		dist = NewExponentialDistribution(c.Mean)
+		distName = "Exp"
+	case "stable":
+		dist = NewStableDistribution(c.Alpha, c.Mean, c.MAD)
+		distName = fmt.Sprintf("Stable(a=%.2f)", c.Alpha)
+	default:
+		err = errors.Reason("unsuppoted distribution type: '%s'", c.Name)
+		return
+	}
+	if Deterministic(ctx) {
+		dist.Seed(Seed(ctx, 0))
+	}
+	return
+}
+
+// WriteHistogram saves h to a file in the config.HistogramData JSON format.
+func WriteHistogram(fileName string, h *stats.Histogram) error {
+	b := h.Buckets()
+	data := map[string]any{
+		"buckets": map[string]any{
+			"n":           b.N,
+			"spacing":     b.Spacing.String(),
+			"min":         b.Min,
+			"max":         b.Max,
+			"auto bounds": false,
+		},
+		"counts": h.Weights(),
+	}
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "failed to open histogram file '%s'", fileName)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(data); err != nil {
+		return errors.Annotate(err, "failed to write JSON to '%s'", fileName)
+	}
+	return nil
+}
+
+// ReadHistogram reads an empirical distribution from a "histogram file" (see
+// config.CompoundDistribution). The buckets are used only for CSV files and
+// must not be nil for them.
+func ReadHistogram(fileName string, buckets *stats.Buckets) (*stats.Histogram, error) {
+	if strings.ToLower(filepath.Ext(fileName)) != ".csv" {
+		var data config.HistogramData
+		if err := config.ReadFile(&data, fileName, nil); err != nil {
+			return nil, errors.Annotate(err, "failed to read histogram")
+		}
+		h := stats.NewHistogram(&data.Buckets)
+		if err := h.AddWeights(data.Counts); err != nil {
+			return nil, errors.Annotate(err, "failed to add counts")
+		}
+		return h, nil
+	}
+	if buckets == nil {
+		return nil, errors.Reason("CSV histogram '%s' requires buckets", fileName)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to open '%s'", fileName)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to read CSV from '%s'", fileName)
+	}
+	h := stats.NewHistogram(buckets)
+	for i, row := range rows {
+		if len(row) != 2 {
+			return nil, errors.Reason("row %d: expected 2 columns, got %d", i+1, len(row))
+		}
+		x, err := strconv.ParseFloat(strings.TrimSpace(row[0]), 64)
+		if err != nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, errors.Annotate(err, "row %d: invalid value", i+1)
+		}
+		c, err := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if err != nil {
+			return nil, errors.Annotate(err, "row %d: invalid count", i+1)
+		}
+		if c < 0 {
+			return nil, errors.Reason("row %d: count=%g must be >= 0", i+1, c)
+		}
+		h.AddWithWeight(x, c)
+	}
+	if h.WeightsTotal() <= 0 {
+		return nil, errors.Reason("no samples in '%s'", fileName)
+	}
+	return h, nil
+}
+
+// CompoundDistribution instantiates a compounded distribution from config.
+// When c.N=1, the source distribution is passed through as is.
+func CompoundDistribution(ctx context.Context, c *config.CompoundDistribution) (dist stats.Distribution, distName string, err error) {
+	switch {
+	case c.AnalyticalSource != nil:
+		dist, distName, err = AnalyticalDistribution(ctx, c.AnalyticalSource)
+		if err != nil {
+			err = errors.Annotate(err, "failed to create analytical distribution")
+			return
+		}
+	case c.CompoundSource != nil:
+		dist, distName, err = CompoundDistribution(ctx, c.CompoundSource)
+		if err != nil {
+			err = errors.Annotate(err, "failed to create inner compound distribution")
+			return
+		}
+	case c.HistogramFile != "":
+		var h *stats.Histogram
+		h, err = ReadHistogram(c.HistogramFile, &c.Params.Buckets)
+		if err != nil {
+			err = errors.Annotate(err, "failed to create histogram distribution")
+			return
+		}
+		dist = stats.NewHistogramDistribution(h)
+		distName = fmt.Sprintf("Hist(%s)", filepath.Base(c.HistogramFile))
+		if Deterministic(ctx) {
+			dist.Seed(Seed(ctx, 0))
+		}
+	default:
+		err = errors.Reason("no source distribution")
+		return
+	}
+	if c.SourceSamples > 0 {
+		if c.SeedSamples > 0 {
+			dist.Seed(uint64(c.SeedSamples))
+		}
+		dist = stats.NewSampleDistributionFromRand(
+			dist, c.SourceSamples, &c.Params.Buckets)
+		distName += fmt.Sprintf("[samples=%d]", c.SourceSamples)
+	}
+	if c.N == 1 {
+		return
+	}
+	dist, err = Compound(ctx, dist, c.N, c)
+	if err != nil {
+		err = errors.Annotate(err, "failed to compound the distribution")
+		return
+	}
+	distName += fmt.Sprintf(" x %d", c.N)
+	return
+}
+
+// synthConfig stores parameters for a single synthetic ticker sequence.
+type synthConfig struct {
+	Start db.Date
+	Days  int
+}
+
+func saveLengths(lengths []synthConfig, fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "failed to open lengths file '%s'", fileName)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	if err := enc.Encode(lengths); err != nil {
+		return errors.Annotate(err, "failed to write JSON to '%s'", fileName)
+	}
+	return nil
+}
+
+func readLengths(fileName string) ([]synthConfig, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to open lengths file '%s'", fileName)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var lengths []synthConfig
+	if err := dec.Decode(&lengths); err != nil {
+		return nil, errors.Annotate(err, "failed to decode lengths file '%s'", fileName)
+	}
+	return lengths, nil
+}
+
+type Prices struct {
+	Ticker string
+	Rows   []db.PriceRow
+}
+
+type LogProfits struct {
+	Ticker     string
+	Timeseries *stats.Timeseries
+	Clipped    int // number of winsorized samples
+}
+
+type withConf[T any] struct {
+	v  T
+	cs []synthConfig
+}
+
+// resampleIntraday restricts intraday price bars to the intraday range and
+// aggregates them into bars of res minutes, the same way as the synthetic
+// intraday series are generated: the bar at the start of the range is the
+// open, and each subsequent bar is timestamped at the end of its interval.
+// Daily price rows (all at midnight) are returned as is.
+func resampleIntraday(rows []db.PriceRow, r *db.IntradayRange, res int) []db.PriceRow {
+	intraday := false
+	for _, row := range rows {
+		if row.Date.Time != 0 {
+			intraday = true
+			break
+		}
+	}
+	if !intraday {
+		return rows
+	}
+	var start db.TimeOfDay
+	if r != nil && r.Start != nil {
+		start = *r.Start
+	}
+	period := db.TimeOfDay(res * 60_000)
+	// Time of day of the bar's end on the resolution grid.
+	barEnd := func(t db.TimeOfDay) db.TimeOfDay {
+		return start + (t-start+period-1)/period*period
+	}
+	var out []db.PriceRow
+	for _, row := range rows {
+		if r != nil && !r.InRange(row.Date.Time) {
+			continue
+		}
+		d := row.Date
+		d.Time = barEnd(d.Time)
+		if n := len(out); n > 0 && out[n-1].Date == d {
+			prev := out[n-1]
+			row.Open = prev.Open
+			if row.High < prev.High {
+				row.High = prev.High
+			}
+			if row.Low > prev.Low {
+				row.Low = prev.Low
+			}
+			row.CashVolume += prev.CashVolume
+			row.Date = d
+			out[n-1] = row
+			continue
+		}
+		row.Date = d
+		out = append(out, row)
+	}
+	return out
+}
+
+func sourceDBPrices[T any](ctx context.Context, c *config.Source, f func([]Prices) T) (iterator.IteratorCloser[T], error) {
+	if c.DB == nil {
+		return nil, errors.Reason("DB must not be nil")
+	}
+	mapF := func(tickers []string) withConf[T] {
+		var cs []synthConfig
+		var prices []Prices
+		for _, ticker := range tickers {
+			if ctx.Err() != nil {
+				break
+			}
+			rows, err := c.DB.Prices(ticker)
+			if err != nil {
+				logging.Warningf(ctx, "failed to read prices for %s: %s",
+					ticker, err.Error())
 				continue
 			}
+			rows = resampleIntraday(rows, c.IntradayRange, c.IntradayRes)
 			if len(rows) == 0 {
 				logging.Warningf(ctx, "%s has no prices, skipping", ticker)
 				continue
@@ -514,8 +2194,7 @@ func sourceDBPrices[T any](ctx context.Context, c *config.Source, f func([]Price
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to list tickers")
 	}
-	batchIt := iterator.Batch[string](iterator.FromSlice(tickers), c.BatchSize)
-	pm := iterator.ParallelMap(ctx, c.Workers, batchIt, mapF)
+	pm := batchMap[string](ctx, c, iterator.FromSlice(tickers), mapF)
 	var cs []synthConfig
 	addLength := func(vc withConf[T]) T {
 		cs = append(cs, vc.cs...)
@@ -523,7 +2202,7 @@ func sourceDBPrices[T any](ctx context.Context, c *config.Source, f func([]Price
 	}
 	it := iterator.WithClose(iterator.Map[withConf[T], T](pm, addLength), func() {
 		pm.Close()
-		if err := saveLengths(cs, c.LengthsFile); err != nil {
+		if err := saveLengths(cs, OutputPath(ctx, c.LengthsFile)); err != nil {
 			logging.Warningf(ctx, "failed to save lengths file: %s", err.Error())
 		}
 	})
@@ -540,6 +2219,35 @@ type tsConfig struct {
 	days          int
 	intradayRes   int // resolution in minutes
 	intradayRange *db.IntradayRange
+	intradayScale []*config.IntradayScale
+	// Optional distribution of log(cash volume), and its dependence on the
+	// daily |log-profit|.
+	volume       stats.Distribution
+	volumeFactor float64
+	// When not nil, the daily log-profit is mean + weight*(sample - mean) +
+	// factor[day], where factor is the ticker's correlated component.
+	factor []float64
+	weight float64
+	// Optional jumps added to the daily log-profit.
+	jump     stats.Distribution
+	jumpRate distuv.Poisson
+}
+
+// dailySample generates the log-profit from the previous close to the open
+// (or close, without intraday distribution) of the i'th day, including the
+// correlated component and the jumps, if any.
+func (cfg tsConfig) dailySample(open stats.Distribution, i int) float64 {
+	x := open.Rand()
+	if cfg.factor != nil {
+		m := open.Mean()
+		x = m + cfg.weight*(x-m) + cfg.factor[i]
+	}
+	if cfg.jump != nil {
+		for n := int(cfg.jumpRate.Rand()); n > 0; n-- {
+			x += cfg.jump.Rand()
+		}
+	}
+	return x
 }
 
 func generateDates(start db.Date, n int) []db.Date {
@@ -576,8 +2284,8 @@ func generateLogProfits(cfg tsConfig) LogProfits {
 	var dates []db.Date
 	var data []float64
 	open := openDist(cfg)
-	for _, day := range days {
-		ts := generateIntraday(open.Rand(), day, cfg)
+	for i, day := range days {
+		ts := generateIntraday(cfg.dailySample(open, i), day, cfg)
 		if cfg.intradayOnly {
 			ts = stats.NewTimeseries(ts.Dates()[1:], ts.Data()[1:])
 		}
@@ -590,6 +2298,19 @@ func generateLogProfits(cfg tsConfig) LogProfits {
 	}
 }
 
+// intradaySample generates an intraday log-profit for the time of day t,
+// scaled according to the intraday profile.
+func (cfg tsConfig) intradaySample(t db.TimeOfDay) float64 {
+	x := cfg.intraday.Rand()
+	for _, s := range cfg.intradayScale {
+		if s.Range.InRange(t) {
+			m := cfg.intraday.Mean()
+			return m + s.Scale*(x-m)
+		}
+	}
+	return x
+}
+
 // generateIntraday log-profit series for a single day, from open to close,
 // including the supplied "open" log-profit relative to the previous day's
 // close. It always returns at least one-element Timeseries with the open value.
@@ -619,12 +2340,12 @@ func generateIntraday(open float64, date db.Date, cfg tsConfig) *stats.Timeserie
 		return d
 	}
 	for i := 0; i <= samples; i++ {
+		dates[i] = t2d(openTime + 60_000*cfg.intradayRes*i)
 		if i == 0 {
 			data[i] = open
 		} else {
-			data[i] = cfg.intraday.Rand()
+			data[i] = cfg.intradaySample(dates[i].Time)
 		}
-		dates[i] = t2d(openTime + 60_000*cfg.intradayRes*i)
 	}
 	return stats.NewTimeseries(dates, data)
 }
@@ -676,7 +2397,7 @@ func generatePrices(cfg tsConfig) Prices {
 	// important.
 	prevClose := 100.0
 	for i, day := range days {
-		ts := generateIntraday(open.Rand(), day, cfg)
+		ts := generateIntraday(cfg.dailySample(open, i), day, cfg)
 		open := ts.Data()[0]
 		high, low, close := getHLC(ts.Data())
 		rows[i] = priceRow(day,
@@ -685,6 +2406,10 @@ func generatePrices(cfg tsConfig) Prices {
 			float32(prevClose*math.Exp(low)),
 			float32(prevClose*math.Exp(close)),
 		)
+		if cfg.volume != nil {
+			rows[i].CashVolume = float32(math.Exp(
+				cfg.volume.Rand() + cfg.volumeFactor*math.Abs(close)))
+		}
 		prevClose = float64(rows[i].Close)
 	}
 	return Prices{
@@ -701,7 +2426,16 @@ type distIter struct {
 	intradayOnly  bool
 	intradayRes   int // resolution in minutes
 	intradayRange *db.IntradayRange
+	intradayScale []*config.IntradayScale
+	volume        stats.Distribution
+	volumeFactor  float64
 	lengthsIter   iterator.Iterator[synthConfig]
+	factors       [][]float64 // per-ticker correlated components, cyclically
+	weight        float64
+	ticker        int
+	jump          stats.Distribution
+	jumpRate      float64
+	jumpSrc       *rand.Rand // seeds the per-ticker Poisson generators
 }
 
 var _ iterator.Iterator[tsConfig] = &distIter{}
@@ -725,11 +2459,79 @@ func (it *distIter) Next() (tsConfig, bool) {
 		intradayOnly:  it.intradayOnly,
 		intradayRes:   it.intradayRes,
 		intradayRange: it.intradayRange,
+		intradayScale: it.intradayScale,
+		volume:        cp(it.volume),
+		volumeFactor:  it.volumeFactor,
+	}
+	if it.jump != nil {
+		tsc.jump = it.jump.Copy()
+		tsc.jumpRate = distuv.Poisson{
+			Lambda: it.jumpRate,
+			Src:    rand.NewSource(it.jumpSrc.Uint64()),
+		}
 	}
+	if len(it.factors) > 0 {
+		tsc.factor = it.factors[it.ticker%len(it.factors)]
+		tsc.weight = it.weight
+	}
+	it.ticker++
 	return tsc, true
 }
 
-func sourceDistIter(ctx context.Context, c *config.Source) (iterator.Iterator[[]tsConfig], error) {
+// correlatedFactors generates the correlated components of the daily
+// log-profits for the synthetic tickers, and the weight of each ticker's own
+// independent sample. The single-factor model yields one component shared by
+// all tickers, while the full correlation matrix yields one component per
+// ticker, mixing the independent series by the Cholesky factor of the matrix.
+func correlatedFactors(daily stats.Distribution, c *config.Source) (factors [][]float64, weight float64, err error) {
+	d := daily.Copy()
+	m := d.Mean()
+	series := func() []float64 {
+		res := make([]float64, c.Days)
+		for i := range res {
+			res[i] = d.Rand() - m
+		}
+		return res
+	}
+	n := len(c.Correlation.Matrix)
+	if n == 0 {
+		rho := c.Correlation.Factor
+		f := series()
+		for i := range f {
+			f[i] *= math.Sqrt(rho)
+		}
+		return [][]float64{f}, math.Sqrt(1 - rho), nil
+	}
+	sym := mat.NewSymDense(n, nil)
+	for i, row := range c.Correlation.Matrix {
+		for j := i; j < n; j++ {
+			sym.SetSym(i, j, row[j])
+		}
+	}
+	var chol mat.Cholesky
+	if ok := chol.Factorize(sym); !ok {
+		return nil, 0, errors.Reason("correlation matrix is not positive definite")
+	}
+	var l mat.TriDense
+	chol.LTo(&l)
+	zs := make([][]float64, n)
+	for j := range zs {
+		zs[j] = series()
+	}
+	factors = make([][]float64, n)
+	for i := range factors {
+		factors[i] = make([]float64, c.Days)
+		for j := 0; j <= i; j++ {
+			lij := l.At(i, j)
+			for k, z := range zs[j] {
+				factors[i][k] += lij * z
+			}
+		}
+	}
+	return factors, 0, nil
+}
+
+func sourceDistIter(ctx context.Context, c *config.Source) (iterator.Iterator[tsConfig], error) {
 	var daily, intraday stats.Distribution
 	var err error
 	if c.DailyDist != nil {
@@ -738,33 +2540,92 @@ func sourceDistIter(ctx context.Context, c *config.Source) (iterator.Iterator[[]
 			return nil, errors.Annotate(err, "failed to create daily distribution")
 		}
 	}
+	if c.DailyHistogram != "" {
+		h, err := ReadHistogram(c.DailyHistogram, nil)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create daily distribution")
+		}
+		daily = stats.NewHistogramDistribution(h)
+	}
 	if c.IntradayDist != nil {
 		intraday, _, err = AnalyticalDistribution(ctx, c.IntradayDist)
 		if err != nil {
 			return nil, errors.Annotate(err, "failed to create intraday distribution")
 		}
 	}
-	var lengthsIter iterator.Iterator[synthConfig]
-	if c.LengthsFile != "" {
-		lengths, err := readLengths(c.LengthsFile)
+	var jump stats.Distribution
+	var jumpSrc *rand.Rand
+	if c.Jump != nil {
+		jump, _, err = AnalyticalDistribution(ctx, c.Jump.Dist)
 		if err != nil {
-			return nil, errors.Annotate(err, "failed to read lengths")
+			return nil, errors.Annotate(err, "failed to create jump distribution")
 		}
-		lengthsIter = iterator.FromSlice(lengths)
-	} else {
-		lengthsIter = iterator.Repeat(
+		jumpSrc = rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+	}
+	var volume stats.Distribution
+	if c.Volume != nil {
+		volume, _, err = AnalyticalDistribution(ctx, c.Volume.Dist)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to create volume distribution")
+		}
+	}
+	// Per-ticker distributions are copied sequentially from these, which makes
+	// them deterministic as well.
+	if c.Seed != 0 {
+		if daily != nil {
+			daily.Seed(uint64(c.Seed))
+		}
+		if intraday != nil {
+			intraday.Seed(uint64(c.Seed) + 1)
+		}
+		if jump != nil {
+			jump.Seed(uint64(c.Seed) + 2)
+			jumpSrc.Seed(uint64(c.Seed) + 3)
+		}
+		if volume != nil {
+			volume.Seed(uint64(c.Seed) + 4)
+		}
+	}
+	var lengthsIter iterator.Iterator[synthConfig]
+	if c.LengthsFile != "" {
+		lengths, err := readLengths(c.LengthsFile)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to read lengths")
+		}
+		lengthsIter = iterator.FromSlice(lengths)
+	} else {
+		lengthsIter = iterator.Repeat(
 			synthConfig{Start: c.StartDate, Days: c.Days}, c.Tickers)
 	}
+	var factors [][]float64
+	var weight float64
+	if c.Correlation != nil {
+		factors, weight, err = correlatedFactors(daily, c)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to generate correlated factors")
+		}
+	}
 	distIt := &distIter{
 		daily:         daily,
 		intraday:      intraday,
 		intradayOnly:  c.IntradayOnly,
 		intradayRes:   c.IntradayRes,
 		intradayRange: c.IntradayRange,
+		intradayScale: c.IntradayProfile,
 		lengthsIter:   lengthsIter,
+		factors:       factors,
+		weight:        weight,
+	}
+	if volume != nil {
+		distIt.volume = volume
+		distIt.volumeFactor = c.Volume.Factor
+	}
+	if jump != nil {
+		distIt.jump = jump
+		distIt.jumpRate = c.Jump.Rate
+		distIt.jumpSrc = jumpSrc
 	}
-	batchIt := iterator.Batch[tsConfig](distIt, c.BatchSize)
-	return batchIt, nil
+	return distIt, nil
 }
 
 // sourceSynthehtic directly generates LogProfits rather than using
@@ -772,15 +2633,19 @@ func sourceDistIter(ctx context.Context, c *config.Source) (iterator.Iterator[[]
 func sourceSynthetic[T any](ctx context.Context, c *config.Source, f func([]LogProfits) T) (iterator.IteratorCloser[T], error) {
 	if c.IntradayDist != nil {
 		if r := c.IntradayRange; r != nil && (r.Start != nil || r.End != nil) {
-			if c.DailyDist == nil {
+			if c.DailyDist == nil && c.DailyHistogram == "" {
 				return nil, errors.Reason(
 					`"daily distribution" required with non-trivial intraday range`)
 			}
 		}
 	}
+	resample := c.Resample
 	pf := func(cs []tsConfig) T {
 		var lps []LogProfits
 		for _, c := range cs {
+			if ctx.Err() != nil {
+				break
+			}
 			lp := generateLogProfits(c)
 			// Skip the first spurious log-profit, unless "intraday only" is true, in
 			// which case it is already skipped.
@@ -788,6 +2653,7 @@ func sourceSynthetic[T any](ctx context.Context, c *config.Source, f func([]LogP
 				ts := lp.Timeseries
 				lp.Timeseries = stats.NewTimeseries(ts.Dates()[1:], ts.Data()[1:])
 			}
+			lp.Timeseries = Resample(lp.Timeseries, resample)
 			lps = append(lps, lp)
 		}
 		return f(lps)
@@ -796,8 +2662,7 @@ func sourceSynthetic[T any](ctx context.Context, c *config.Source, f func([]LogP
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to create distribution iterator")
 	}
-	pm := iterator.ParallelMap[[]tsConfig, T](ctx, c.Workers, it, pf)
-	return pm, nil
+	return batchMap[tsConfig](ctx, c, it, pf), nil
 }
 
 func sourceSyntheticPrices[T any](ctx context.Context, c *config.Source, f func([]Prices) T) (iterator.IteratorCloser[T], error) {
@@ -807,6 +2672,9 @@ func sourceSyntheticPrices[T any](ctx context.Context, c *config.Source, f func(
 	pf := func(cs []tsConfig) T {
 		var prices []Prices
 		for _, c := range cs {
+			if ctx.Err() != nil {
+				break
+			}
 			if c.days < 1 {
 				continue
 			}
@@ -818,8 +2686,255 @@ func sourceSyntheticPrices[T any](ctx context.Context, c *config.Source, f func(
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to create distribution iterator")
 	}
-	pm := iterator.ParallelMap[[]tsConfig, T](ctx, c.Workers, it, pf)
-	return pm, nil
+	return batchMap[tsConfig](ctx, c, it, pf), nil
+}
+
+// batchMap splits it into batches and maps them with f in parallel, according
+// to the Source's parallel processing parameters.
+func batchMap[In, Out any](ctx context.Context, c *config.Source, it iterator.Iterator[In], f func([]In) Out) iterator.IteratorCloser[Out] {
+	t := newTuner(ctx, c)
+	if t == nil {
+		return iterator.ParallelMap(ctx, c.Workers, iterator.Batch(it, c.BatchSize), f)
+	}
+	var batches iterator.Iterator[[]In] = &tunedBatches[In]{it: it, t: t}
+	return iterator.ParallelMap(ctx, c.Workers, batches, tunedFunc(t, f))
+}
+
+// tuner adapts the batch size and the number of concurrently processed batches
+// to the observed batch processing time and memory, see config.Adaptive.
+type tuner struct {
+	context   context.Context
+	config    *config.Adaptive
+	workers   int // the maximum number of concurrent batches
+	mu        sync.Mutex
+	cond      *sync.Cond
+	batchSize int
+	perItem   float64 // smoothed processing time of a single item in seconds
+	limit     int     // the current maximum number of concurrent batches
+	running   int
+	heapMB    func() float64 // current heap size
+}
+
+// newTuner returns nil when c is not adaptive.
+func newTuner(ctx context.Context, c *config.Source) *tuner {
+	if c.Adaptive == nil {
+		return nil
+	}
+	t := &tuner{
+		context:   ctx,
+		config:    c.Adaptive,
+		workers:   c.Workers,
+		batchSize: c.BatchSize,
+		limit:     c.Workers,
+		heapMB:    heapMB,
+	}
+	if t.batchSize > c.Adaptive.MaxBatchSize {
+		t.batchSize = c.Adaptive.MaxBatchSize
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// heapMB is the size of the live and not yet swept heap objects in MB.
+func heapMB() float64 {
+	s := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return float64(s[0].Value.Uint64()) / (1 << 20)
+}
+
+func (t *tuner) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.batchSize
+}
+
+// acquire blocks until fewer than limit batches are being processed.
+func (t *tuner) acquire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.running >= t.limit {
+		t.cond.Wait()
+	}
+	t.running++
+}
+
+// release records the processing time d of a batch of n items, and updates
+// the batch size and the concurrency limit.
+func (t *tuner) release(n int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	if n > 0 {
+		x := d.Seconds() / float64(n)
+		if t.perItem == 0 {
+			t.perItem = x
+		} else {
+			t.perItem = 0.7*t.perItem + 0.3*x
+		}
+		size := t.config.MaxBatchSize
+		if t.perItem > 0 && t.config.BatchTime/t.perItem < float64(size) {
+			size = int(t.config.BatchTime / t.perItem)
+		}
+		if size < 1 {
+			size = 1
+		}
+		t.batchSize = size
+	}
+	if ceiling := t.config.MaxMemory; ceiling > 0 {
+		limit := t.limit
+		switch m := t.heapMB(); {
+		case m > ceiling && limit > 1:
+			limit /= 2
+		case m < ceiling/2 && limit < t.workers:
+			limit++
+		}
+		if limit != t.limit {
+			logging.Debugf(t.context, "adaptive source: %d concurrent batches of %d",
+				limit, t.batchSize)
+			t.limit = limit
+		}
+	}
+	t.cond.Broadcast()
+}
+
+// tunedFunc wraps f to run under the concurrency limit of t and to record its
+// processing time.
+func tunedFunc[In, Out any](t *tuner, f func([]In) Out) func([]In) Out {
+	return func(in []In) Out {
+		t.acquire()
+		start := time.Now()
+		defer func() { t.release(len(in), time.Since(start)) }()
+		return f(in)
+	}
+}
+
+// tunedBatches splits the iterator into batches of the current tuned size.
+type tunedBatches[T any] struct {
+	it iterator.Iterator[T]
+	t  *tuner
+}
+
+var _ iterator.Iterator[[]int] = &tunedBatches[int]{}
+
+func (b *tunedBatches[T]) Next() ([]T, bool) {
+	n := b.t.size()
+	var res []T
+	for len(res) < n {
+		v, ok := b.it.Next()
+		if !ok {
+			break
+		}
+		res = append(res, v)
+	}
+	return res, len(res) > 0
+}
+
+// BlockBootstrap returns a new Timeseries with the same dates as ts, and the
+// data composed of randomly chosen contiguous blocks of ts data of the given
+// length. Blocks wrap around the end of the series (circular block bootstrap).
+// Block length of 1 is the standard i.i.d. bootstrap.
+func BlockBootstrap(ts *stats.Timeseries, block int, r *rand.Rand) *stats.Timeseries {
+	data := ts.Data()
+	n := len(data)
+	if n == 0 {
+		return ts
+	}
+	res := make([]float64, 0, n)
+	for len(res) < n {
+		start := r.Intn(n)
+		for i := 0; i < block && len(res) < n; i++ {
+			res = append(res, data[(start+i)%n])
+		}
+	}
+	return stats.NewTimeseries(ts.Dates(), res)
+}
+
+// Winsorize clips the data of ts to the bounds configured by c, and returns the
+// new Timeseries and the number of clipped samples.
+func Winsorize(ts *stats.Timeseries, c *config.Winsorize) (*stats.Timeseries, int) {
+	data := ts.Data()
+	if len(data) == 0 {
+		return ts, 0
+	}
+	var lo, hi float64
+	if c.Quantile > 0 {
+		sorted := make([]float64, len(data))
+		copy(sorted, data)
+		sort.Float64s(sorted)
+		lo = SortedQuantile(sorted, c.Quantile)
+		hi = SortedQuantile(sorted, 1-c.Quantile)
+	} else {
+		s := stats.NewSample(data)
+		lo = s.Mean() - c.MADs*s.MAD()
+		hi = s.Mean() + c.MADs*s.MAD()
+	}
+	res := make([]float64, len(data))
+	var clipped int
+	for i, x := range data {
+		switch {
+		case x < lo:
+			res[i] = lo
+			clipped++
+		case x > hi:
+			res[i] = hi
+			clipped++
+		default:
+			res[i] = x
+		}
+	}
+	return stats.NewTimeseries(ts.Dates(), res), clipped
+}
+
+// Resample aggregates daily log-profits into weekly or monthly log-profits,
+// according to period ("daily", "weekly" or "monthly"). Each resulting sample
+// is dated by the last day of its period, and is equivalent to the log-profit
+// between the last closing prices of two consecutive periods. The first period
+// may be partial.
+func Resample(ts *stats.Timeseries, period string) *stats.Timeseries {
+	var key func(db.Date) db.Date
+	switch period {
+	case "weekly":
+		key = func(d db.Date) db.Date { return d.Monday() }
+	case "monthly":
+		key = func(d db.Date) db.Date { return d.MonthStart() }
+	default:
+		return ts
+	}
+	var dates []db.Date
+	var data []float64
+	for i, d := range ts.Dates() {
+		x := ts.Data()[i]
+		if len(dates) > 0 && key(dates[len(dates)-1]) == key(d) {
+			dates[len(dates)-1] = d
+			data[len(data)-1] += x
+			continue
+		}
+		dates = append(dates, d)
+		data = append(data, x)
+	}
+	return stats.NewTimeseries(dates, data)
+}
+
+// deterministicSource is c with a single worker and a fixed seed in the
+// deterministic mode. Otherwise, with a SeedLog, an unseeded c is seeded with
+// a logged seed, so the run can be reproduced; else it is c itself.
+func deterministicSource(ctx context.Context, c *config.Source) *config.Source {
+	if !Deterministic(ctx) {
+		if _, ok := ctx.Value(seedLogContextKey).(*SeedLog); !ok || c.Seed != 0 {
+			return c
+		}
+		res := *c
+		res.Seed = int(Seed(ctx, 0))
+		return &res
+	}
+	res := *c
+	res.Workers = 1
+	res.Seed = int(Seed(ctx, uint64(c.Seed)))
+	res.Adaptive = nil // batches depend on timing
+	return &res
 }
 
 // Source generates log-profit sequence according to the config. Please remember
@@ -841,15 +2956,25 @@ func Source(ctx context.Context, c *config.Source) (iterator.IteratorCloser[LogP
 //
 // Please remember to close the resulting iterator.
 func SourceMap[T any](ctx context.Context, c *config.Source, f func([]LogProfits) T) (iterator.IteratorCloser[T], error) {
+	c = deterministicSource(ctx, c)
+	if w := c.Winsorize; w != nil {
+		g := f
+		f = func(lps []LogProfits) T {
+			for i, lp := range lps {
+				lps[i].Timeseries, lps[i].Clipped = Winsorize(lp.Timeseries, w)
+				logging.Debugf(ctx, "%s: clipped %d of %d log-profits",
+					lp.Ticker, lps[i].Clipped, len(lp.Timeseries.Data()))
+			}
+			return g(lps)
+		}
+	}
 	if c.DB != nil {
 		rowF := func(prices []Prices) T {
 			var lps []LogProfits
 			for _, p := range prices {
-				ts := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceCloseFullyAdjusted)
-				ts = ts.LogProfits(c.Compound, c.IntradayOnly)
 				lp := LogProfits{
 					Ticker:     p.Ticker,
-					Timeseries: ts,
+					Timeseries: PricesLogProfits(c, p),
 				}
 				if len(lp.Timeseries.Data()) == 0 {
 					logging.Warningf(ctx, "%s has no log-profits, skipping", p.Ticker)
@@ -864,7 +2989,39 @@ func SourceMap[T any](ctx context.Context, c *config.Source, f func([]LogProfits
 	return sourceSynthetic[T](ctx, c, f)
 }
 
+// PricesLogProfits computes log-profits from the DB prices the same way as
+// SourceMap does, for experiments which need both.
+func PricesLogProfits(c *config.Source, p Prices) *stats.Timeseries {
+	lp := func(f stats.PriceField) *stats.Timeseries {
+		ts := stats.NewTimeseriesFromPrices(p.Rows, f)
+		return ts.LogProfits(c.Compound, c.IntradayOnly)
+	}
+	var ts *stats.Timeseries
+	switch {
+	case c.DividendsOnly:
+		ts = lp(stats.PriceCloseFullyAdjusted).Sub(lp(stats.PriceCloseSplitAdjusted))
+	case c.PriceAdjustment == "split adjusted":
+		ts = lp(stats.PriceCloseSplitAdjusted)
+	case c.PriceAdjustment == "raw":
+		ts = lp(stats.PriceCloseUnadjusted)
+	default:
+		ts = lp(stats.PriceCloseFullyAdjusted)
+	}
+	if c.Bootstrap != nil {
+		// Batches are processed in parallel, so seed per ticker.
+		h := fnv.New64a()
+		h.Write([]byte(p.Ticker))
+		seed := uint64(time.Now().UnixNano()) ^ h.Sum64()
+		if c.Seed != 0 {
+			seed = uint64(c.Seed) + h.Sum64()
+		}
+		ts = BlockBootstrap(ts, c.Bootstrap.Block, rand.New(rand.NewSource(seed)))
+	}
+	return Resample(ts, c.Resample)
+}
+
 func SourceMapPrices[T any](ctx context.Context, c *config.Source, f func([]Prices) T) (iterator.IteratorCloser[T], error) {
+	c = deterministicSource(ctx, c)
 	switch {
 	case c.DB != nil:
 		return sourceDBPrices[T](ctx, c, f)
@@ -875,7 +3032,20 @@ func SourceMapPrices[T any](ctx context.Context, c *config.Source, f func([]Pric
 // DeriveAlpha estimates the degrees of freedom parameter for a Student's T
 // distribution with the given mean and MAD that most closely corresponds to the
 // sample distribution given as a histogram h.
+//
+// With the "mle" fit method, the mean and MAD are estimated jointly with alpha
+// from the bucket means of h weighted by the bucket weights, and the given ones
+// are ignored. This is a binning approximation of the MLE over the raw
+// samples; see fitSamples. The result is NaN when the fit fails.
 func DeriveAlpha(h *stats.Histogram, mean, MAD float64, c *config.DeriveAlpha) float64 {
+	if c.FitMethod == "mle" {
+		xs, ws := histogramSamples(h)
+		fit, err := FitStudentsT(xs, ws, c)
+		if err != nil {
+			return math.NaN()
+		}
+		return fit.Alpha
+	}
 	f := func(alpha float64) float64 {
 		d := stats.NewStudentsTDistribution(alpha, mean, MAD)
 		return DistributionDistance(h, d, c.IgnoreCounts)
@@ -883,11 +3053,692 @@ func DeriveAlpha(h *stats.Histogram, mean, MAD float64, c *config.DeriveAlpha) f
 	return FindMin(f, c.MinX, c.MaxX, c.Epsilon, c.MaxIterations)
 }
 
+// TailAlphas derives the alpha parameters of Student's T distributions fitted
+// separately to the left and the right tails of dh, split at the mean. With
+// the "distance" method, the distance is measured only over the histogram
+// buckets of the corresponding tail. With "mle", each tail of the samples (see
+// fitSamples) is mirrored around the mean to form a symmetric sample. A tail
+// which cannot be fitted yields NaN.
+func TailAlphas(dh stats.DistributionWithHistogram, mean, MAD float64, c *config.DeriveAlpha) (left, right float64) {
+	if c.FitMethod == "mle" {
+		xs, ws, _ := fitSamples(dh)
+		var lxs, lws, rxs, rws []float64
+		for i, x := range xs {
+			if x < mean {
+				lxs = append(lxs, x, 2*mean-x)
+				lws = append(lws, ws[i], ws[i])
+			} else {
+				rxs = append(rxs, x, 2*mean-x)
+				rws = append(rws, ws[i], ws[i])
+			}
+		}
+		fitAlpha := func(xs, ws []float64) float64 {
+			fit, err := FitStudentsT(xs, ws, c)
+			if err != nil {
+				return math.NaN()
+			}
+			return fit.Alpha
+		}
+		return fitAlpha(lxs, lws), fitAlpha(rxs, rws)
+	}
+	h := dh.Histogram()
+	n := h.Buckets().N
+	k := h.Buckets().Bucket(mean)
+	fitAlpha := func(from, to int) float64 {
+		f := func(alpha float64) float64 {
+			d := stats.NewStudentsTDistribution(alpha, mean, MAD)
+			return distanceInRange(h, d, c.IgnoreCounts, from, to)
+		}
+		return FindMin(f, c.MinX, c.MaxX, c.Epsilon, c.MaxIterations)
+	}
+	// The bucket containing the mean belongs to both tails.
+	return fitAlpha(1, k+1), fitAlpha(k, n-1)
+}
+
+// plotTails adds the left and the right tail alphas of dh as values, and plots
+// the corresponding T distributions over their tails in c.Graph. The values
+// are named by valueLegend, and the plots by plotLegend.
+func plotTails(ctx context.Context, dh stats.DistributionWithHistogram, xs []float64, ac *config.AnalyticalDistribution, c *config.DistributionPlot, prefix, valueLegend, plotLegend string) error {
+	left, right := TailAlphas(dh, ac.Mean, ac.MAD, c.DeriveAlpha)
+	for _, t := range []struct {
+		name  string
+		alpha float64
+		in    func(x float64) bool
+	}{
+		{"left", left, func(x float64) bool { return x < ac.Mean }},
+		{"right", right, func(x float64) bool { return x >= ac.Mean }},
+	} {
+		k := valueLegend + " " + t.name + " alpha"
+		if err := AddTypedValue(ctx, prefix, k, FloatValue(t.alpha)); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+		if math.IsNaN(t.alpha) {
+			continue
+		}
+		d := stats.NewStudentsTDistribution(t.alpha, ac.Mean, ac.MAD)
+		var txs, tys []float64
+		for _, x := range xs {
+			if t.in(x) {
+				txs = append(txs, x)
+				tys = append(tys, d.Prob(x))
+			}
+		}
+		txs, tys = filterXY(txs, tys, c)
+		if len(txs) == 0 {
+			continue
+		}
+		plt, err := plot.NewXYPlot(txs, tys)
+		if err != nil {
+			return errors.Annotate(err, "failed to create '%s' %s tail plot", plotLegend, t.name)
+		}
+		plt.SetLegend(fmt.Sprintf("%s %s:t(a=%.2f)", plotLegend, t.name, t.alpha))
+		plt.SetChartType(plot.ChartDashed)
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
+			return errors.Annotate(err, "failed to add '%s' %s tail plot", plotLegend, t.name)
+		}
+	}
+	return nil
+}
+
+// AlphaScan evaluates the objective of DeriveAlpha for the T distribution with
+// the given mean and MAD at c.ScanPoints values of alpha evenly spaced over
+// [c.MinX..c.MaxX]. The objective is DistributionDistance for the "distance"
+// method, and the mean log-likelihood of the samples (see fitSamples) for
+// "mle".
+func AlphaScan(dh stats.DistributionWithHistogram, mean, MAD float64, c *config.DeriveAlpha) (alphas, ys []float64) {
+	h := dh.Histogram()
+	var xs, ws []float64
+	var total float64
+	if c.FitMethod == "mle" {
+		xs, ws, _ = fitSamples(dh)
+		for _, w := range ws {
+			total += w
+		}
+	}
+	for i := 0; i < c.ScanPoints; i++ {
+		alpha := c.MinX + (c.MaxX-c.MinX)*float64(i)/float64(c.ScanPoints-1)
+		var y float64
+		if c.FitMethod == "mle" {
+			sigma := MAD / studentsTMAD(alpha)
+			for j, x := range xs {
+				y += ws[j] * studentsTLogPDF(x, alpha, mean, sigma)
+			}
+			y /= total
+		} else {
+			d := stats.NewStudentsTDistribution(alpha, mean, MAD)
+			y = DistributionDistance(h, d, c.IgnoreCounts)
+		}
+		alphas = append(alphas, alpha)
+		ys = append(ys, y)
+	}
+	return
+}
+
+// plotAlphaScan plots AlphaScan in c.ScanGraph, if configured.
+func plotAlphaScan(ctx context.Context, dh stats.DistributionWithHistogram, mean, MAD float64, c *config.DeriveAlpha, legend string) error {
+	if c.ScanGraph == "" {
+		return nil
+	}
+	alphas, ys := AlphaScan(dh, mean, MAD, c)
+	plt, err := plot.NewXYPlot(alphas, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create '%s' alpha scan plot", legend)
+	}
+	if c.FitMethod == "mle" {
+		plt.SetLegend(legend + " log-likelihood")
+		plt.SetYLabel("mean log-likelihood")
+	} else {
+		plt.SetLegend(legend + " distance")
+		plt.SetYLabel("distance")
+	}
+	if err := AddPlot(ctx, plt, c.ScanGraph); err != nil {
+		return errors.Annotate(err, "failed to add '%s' alpha scan plot", legend)
+	}
+	return nil
+}
+
+// deriveAlpha is DeriveAlpha which fits the raw samples of dh with "mle", when
+// available.
+func deriveAlpha(dh stats.DistributionWithHistogram, mean, MAD float64, c *config.DeriveAlpha) float64 {
+	if c.FitMethod != "mle" {
+		return DeriveAlpha(dh.Histogram(), mean, MAD, c)
+	}
+	xs, ws, n := fitSamples(dh)
+	fit, err := FitWeightedStudentsT(xs, ws, n, c)
+	if err != nil {
+		return math.NaN()
+	}
+	return fit.Alpha
+}
+
+// fitSamples are the samples of dh for the maximum likelihood fits, their
+// weights, and the number of samples n they represent. These are the raw
+// samples of a sample distribution, or the retained random sample of a
+// SampledHistogram, e.g. of the streamed log-profits. Otherwise, the fit is a
+// binning approximation over the bucket means weighted by the bucket weights,
+// with n being the total count of the histogram. Note, that with weighted
+// histograms (e.g. by volume) the weights are not counts.
+func fitSamples(dh stats.DistributionWithHistogram) (xs, ws []float64, n float64) {
+	switch d := dh.(type) {
+	case *stats.SampleDistribution:
+		xs = d.Sample().Data()
+		ws = make([]float64, len(xs))
+		for i := range ws {
+			ws[i] = 1
+		}
+		return xs, ws, float64(len(xs))
+	case *SampledHistogram:
+		if d.sample.Len() > 0 {
+			xs, ws = d.sample.Data()
+			// The fit is only as precise as the retained sample.
+			return xs, ws, float64(len(xs))
+		}
+	}
+	h := dh.Histogram()
+	xs, ws = histogramSamples(h)
+	return xs, ws, float64(h.CountsTotal())
+}
+
+// reservoirItem is a weighted value retained in a Reservoir.
+type reservoirItem struct {
+	x, weight float64
+	key       uint64
+}
+
+// reservoirHeap is a max-heap of the items by key.
+type reservoirHeap []reservoirItem
+
+func (h reservoirHeap) Len() int           { return len(h) }
+func (h reservoirHeap) Less(i, j int) bool { return h[i].key > h[j].key }
+func (h reservoirHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *reservoirHeap) Push(x any)        { *h = append(*h, x.(reservoirItem)) }
+func (h *reservoirHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Reservoir is a uniform random sample of up to a fixed number of weighted
+// values from a stream. It retains the values with the smallest keys, which
+// the caller assigns uniformly at random, e.g. by hashing. Therefore, the
+// reservoirs of the parts of the stream processed in parallel can be merged
+// into a sample of the whole stream.
+type Reservoir struct {
+	size  int
+	items reservoirHeap
+}
+
+// NewReservoir retaining up to size values.
+func NewReservoir(size int) *Reservoir {
+	return &Reservoir{size: size}
+}
+
+// Add the value x with its weight and the random key.
+func (r *Reservoir) Add(x, weight float64, key uint64) {
+	if len(r.items) < r.size {
+		heap.Push(&r.items, reservoirItem{x: x, weight: weight, key: key})
+		return
+	}
+	if len(r.items) > 0 && key < r.items[0].key {
+		r.items[0] = reservoirItem{x: x, weight: weight, key: key}
+		heap.Fix(&r.items, 0)
+	}
+}
+
+// Merge r2 into r.
+func (r *Reservoir) Merge(r2 *Reservoir) {
+	for _, it := range r2.items {
+		r.Add(it.x, it.weight, it.key)
+	}
+}
+
+// Len is the number of the retained values.
+func (r *Reservoir) Len() int {
+	return len(r.items)
+}
+
+// Data are the retained values and their weights, in no particular order.
+func (r *Reservoir) Data() (xs, ws []float64) {
+	xs = make([]float64, len(r.items))
+	ws = make([]float64, len(r.items))
+	for i, it := range r.items {
+		xs[i] = it.x
+		ws[i] = it.weight
+	}
+	return
+}
+
+// SampledHistogram is a histogram distribution which also retains a bounded
+// random sample of the values accumulated in the histogram, so that the
+// maximum likelihood fits use the raw values rather than the bucket means.
+type SampledHistogram struct {
+	*stats.HistogramDistribution
+	sample *Reservoir
+}
+
+var _ stats.DistributionWithHistogram = &SampledHistogram{}
+
+// NewSampledHistogram of the histogram h and the random sample of its values.
+func NewSampledHistogram(h *stats.Histogram, sample *Reservoir) *SampledHistogram {
+	return &SampledHistogram{
+		HistogramDistribution: stats.NewHistogramDistribution(h),
+		sample:                sample,
+	}
+}
+
+// histogramSamples are the non-empty bucket means of h and their weights.
+func histogramSamples(h *stats.Histogram) (xs, ws []float64) {
+	for i := range h.Counts() {
+		if h.Count(i) == 0 || h.Weight(i) <= 0 {
+			continue
+		}
+		xs = append(xs, h.X(i))
+		ws = append(ws, h.Weight(i))
+	}
+	return
+}
+
+// TFit is a maximum likelihood fit of a Student's T distribution. The standard
+// errors of the parameters are NaN when they cannot be estimated, e.g. when
+// alpha is at the boundary of the search interval.
+type TFit struct {
+	Alpha    float64
+	Mean     float64
+	MAD      float64
+	AlphaErr float64
+	MeanErr  float64
+	MADErr   float64
+}
+
+// studentsTMAD is the MAD of the T distribution with sigma=1.
+func studentsTMAD(alpha float64) float64 {
+	return 1 / stats.NewStudentsTDistribution(alpha, 0, 1).Sigma
+}
+
+// studentsTLogPDF is the log of the p.d.f. of the T distribution with alpha
+// degrees of freedom, location mu and scale sigma.
+func studentsTLogPDF(x, alpha, mu, sigma float64) float64 {
+	lg1, _ := math.Lgamma((alpha + 1) / 2)
+	lg2, _ := math.Lgamma(alpha / 2)
+	z := (x - mu) / sigma
+	return lg1 - lg2 - 0.5*math.Log(alpha*math.Pi) - math.Log(sigma) -
+		(alpha+1)/2*math.Log1p(z*z/alpha)
+}
+
+// FitStudentsT fits a Student's T distribution to the samples xs with the
+// corresponding weights treated as counts. See FitWeightedStudentsT.
+func FitStudentsT(xs, weights []float64, c *config.DeriveAlpha) (TFit, error) {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	return FitWeightedStudentsT(xs, weights, total, c)
+}
+
+// FitWeightedStudentsT fits a Student's T distribution to the samples xs with
+// the corresponding weights by maximizing the weighted likelihood jointly over
+// alpha in [c.MinX..c.MaxX], the mean and the scale. The standard errors are
+// derived from the Hessian of the log-likelihood with the weights normalized
+// to n, the number of the actual samples, so that arbitrary weights (e.g. by
+// volume) do not inflate or shrink the errors.
+func FitWeightedStudentsT(xs, weights []float64, n float64, c *config.DeriveAlpha) (TFit, error) {
+	if len(xs) != len(weights) {
+		return TFit{}, errors.Reason("len(xs)=%d != len(weights)=%d",
+			len(xs), len(weights))
+	}
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	if len(xs) < 3 || total <= 0 || n <= 0 {
+		return TFit{}, errors.Reason("not enough samples")
+	}
+	mean := stat.Mean(xs, weights)
+	var mad float64
+	for i, x := range xs {
+		mad += weights[i] * math.Abs(x-mean)
+	}
+	mad /= total
+	if mad <= 0 {
+		return TFit{}, errors.Reason("degenerate samples: MAD=0")
+	}
+	// alpha = MinX + (MaxX-MinX)*sigmoid(u) keeps alpha within the bounds.
+	span := c.MaxX - c.MinX
+	alpha := func(u float64) float64 { return c.MinX + span/(1+math.Exp(-u)) }
+	alpha0 := math.Min(math.Max(3, c.MinX), c.MaxX)
+	u0 := 0.0
+	if span > 0 {
+		r := math.Min(math.Max((alpha0-c.MinX)/span, 0.01), 0.99)
+		u0 = math.Log(r / (1 - r))
+	}
+	nll := func(a, mu, sigma float64) float64 {
+		if !(a > 0 && sigma > 0) {
+			return math.Inf(1)
+		}
+		var res float64
+		for i, x := range xs {
+			res -= weights[i] * studentsTLogPDF(x, a, mu, sigma)
+		}
+		if math.IsNaN(res) {
+			return math.Inf(1)
+		}
+		return res
+	}
+	// Location and scale are optimized in the units of the sample MAD, so the
+	// tolerance does not depend on the scale of the data.
+	f := func(x []float64) float64 {
+		return nll(alpha(x[0]), mean+x[1]*mad, mad*math.Exp(x[2]))
+	}
+	init := []float64{u0, 0, -math.Log(studentsTMAD(alpha0))}
+	x := Optimize(f, init, 1e-6, c.MaxIterations)
+	if math.IsInf(f(x), 1) {
+		return TFit{}, errors.Reason("failed to maximize likelihood")
+	}
+	a, mu, sigma := alpha(x[0]), mean+x[1]*mad, mad*math.Exp(x[2])
+	fit := TFit{
+		Alpha:    a,
+		Mean:     mu,
+		MAD:      sigma * studentsTMAD(a),
+		AlphaErr: math.NaN(),
+		MeanErr:  math.NaN(),
+		MADErr:   math.NaN(),
+	}
+	// The covariance of (alpha, mean, sigma) is the inverse of the Hessian of
+	// the negative log-likelihood of n samples.
+	scale := n / total
+	var hess mat.SymDense
+	fd.Hessian(&hess, func(x []float64) float64 { return scale * nll(x[0], x[1], x[2]) },
+		[]float64{a, mu, sigma}, &fd.Settings{Formula: fd.Central})
+	var chol mat.Cholesky
+	if !chol.Factorize(&hess) {
+		return fit, nil
+	}
+	var cov mat.SymDense
+	if err := chol.InverseTo(&cov); err != nil {
+		return fit, nil
+	}
+	fit.AlphaErr = math.Sqrt(cov.At(0, 0))
+	fit.MeanErr = math.Sqrt(cov.At(1, 1))
+	// Delta method for MAD = sigma*studentsTMAD(alpha).
+	da := 1e-4 * a
+	g := []float64{
+		sigma * (studentsTMAD(a+da) - studentsTMAD(a-da)) / (2 * da),
+		0,
+		studentsTMAD(a),
+	}
+	var v float64
+	for i := range g {
+		for j := range g {
+			v += g[i] * cov.At(i, j) * g[j]
+		}
+	}
+	fit.MADErr = math.Sqrt(v)
+	return fit, nil
+}
+
+// Hill computes the Hill estimates of the tail index alpha, where the tail
+// probability P(X > x) ~ x^-alpha, from the largest order statistics xs, all
+// positive and sorted in the descending order. The k'th element of the result
+// (starting from 0) is the estimate using k+1 largest samples. When the
+// estimate is undefined due to ties, it is +Inf.
+func Hill(xs []float64) []float64 {
+	var res []float64
+	var sumLogs float64
+	for k := 1; k < len(xs); k++ {
+		sumLogs += math.Log(xs[k-1])
+		h := sumLogs/float64(k) - math.Log(xs[k])
+		if h <= 0 {
+			res = append(res, math.Inf(1))
+			continue
+		}
+		res = append(res, 1/h)
+	}
+	return res
+}
+
+// GPD is a Generalized Pareto distribution of exceedances y >= 0 over a
+// threshold, with the survival function P(Y > y) = (1 + Shape*y/Scale)^(-1/Shape),
+// or exp(-y/Scale) when Shape = 0. For a power tail P(X > x) ~ x^-alpha, the
+// shape is 1/alpha.
+type GPD struct {
+	Shape float64
+	Scale float64
+}
+
+// gpdZeroShape is the absolute shape below which it is considered 0.
+const gpdZeroShape = 1e-9
+
+// Survival function P(Y > y).
+func (g GPD) Survival(y float64) float64 {
+	if math.Abs(g.Shape) < gpdZeroShape {
+		return math.Exp(-y / g.Scale)
+	}
+	z := 1 + g.Shape*y/g.Scale
+	if z <= 0 {
+		return 0
+	}
+	return math.Pow(z, -1/g.Shape)
+}
+
+// logPDF is the log of the probability density at y, or -Inf outside of the
+// support.
+func (g GPD) logPDF(y float64) float64 {
+	if g.Scale <= 0 || y < 0 {
+		return math.Inf(-1)
+	}
+	if math.Abs(g.Shape) < gpdZeroShape {
+		return -math.Log(g.Scale) - y/g.Scale
+	}
+	z := 1 + g.Shape*y/g.Scale
+	if z <= 0 {
+		return math.Inf(-1)
+	}
+	return -math.Log(g.Scale) - (1+1/g.Shape)*math.Log(z)
+}
+
+// FitGPD fits a Generalized Pareto distribution to the exceedances ys >= 0
+// with the corresponding weights by maximizing the likelihood, starting from
+// the method of moments estimate.
+func FitGPD(ys, weights []float64) (GPD, error) {
+	if len(ys) != len(weights) {
+		return GPD{}, errors.Reason("len(ys)=%d != len(weights)=%d",
+			len(ys), len(weights))
+	}
+	mean := stat.Mean(ys, weights)
+	variance := stat.Variance(ys, weights)
+	if !(mean > 0 && variance > 0) {
+		return GPD{}, errors.Reason("degenerate exceedances: mean=%g, variance=%g",
+			mean, variance)
+	}
+	r := mean * mean / variance
+	init := GPD{Shape: 0.5 * (1 - r), Scale: 0.5 * mean * (r + 1)}
+	// Optimize log(scale) to keep the scale positive.
+	nll := func(x []float64) float64 {
+		g := GPD{Shape: x[0], Scale: math.Exp(x[1])}
+		var res float64
+		for i, y := range ys {
+			res -= weights[i] * g.logPDF(y)
+		}
+		if math.IsNaN(res) {
+			return math.Inf(1)
+		}
+		return res
+	}
+	x := Optimize(nll, []float64{init.Shape, math.Log(init.Scale)}, 1e-8, 10000)
+	if math.IsInf(nll(x), 1) {
+		return GPD{}, errors.Reason("failed to maximize likelihood")
+	}
+	return GPD{Shape: x[0], Scale: math.Exp(x[1])}, nil
+}
+
+// plotGPD fits a Generalized Pareto distribution to the tail of h and plots
+// the log10 survival functions of the data and the fit.
+func plotGPD(ctx context.Context, h *stats.Histogram, c *config.GPDFit, prefix, legend string) error {
+	if c == nil || h.WeightsTotal() == 0 {
+		return nil
+	}
+	// Collect the tail mirrored to positive values, in the ascending order.
+	q := c.Quantile
+	sign := 1.0
+	if c.Tail == "left" {
+		q = 1 - q
+		sign = -1
+	}
+	u := sign * h.Quantile(q)
+	var xs, ws []float64
+	var counts uint
+	for i := range h.Counts() {
+		if h.Count(i) == 0 {
+			continue
+		}
+		if x := sign * h.X(i); x > u {
+			xs = append(xs, x)
+			ws = append(ws, h.Weight(i))
+			counts += h.Count(i)
+		}
+	}
+	if sign < 0 {
+		for i, j := 0, len(xs)-1; i < j; i, j = i+1, j-1 {
+			xs[i], xs[j] = xs[j], xs[i]
+			ws[i], ws[j] = ws[j], ws[i]
+		}
+	}
+	tailLegend := fmt.Sprintf("%s %s tail", legend, c.Tail)
+	if len(xs) < 3 {
+		logging.Warningf(ctx, "'%s': too few buckets over the threshold to fit GPD",
+			Prefix(prefix, tailLegend))
+		return nil
+	}
+	ys := make([]float64, len(xs))
+	for i, x := range xs {
+		ys[i] = x - u
+	}
+	g, err := FitGPD(ys, ws)
+	if err != nil {
+		return errors.Annotate(err, "failed to fit GPD for '%s'", tailLegend)
+	}
+	for _, v := range []struct {
+		name  string
+		value Value
+	}{
+		{"GPD shape", FloatValue(g.Shape)},
+		{"GPD scale", FloatValue(g.Scale)},
+		{"GPD threshold", FloatValue(sign * u)},
+		{"GPD exceedances", IntValue(int(counts))},
+	} {
+		if err := AddTypedValue(ctx, prefix, tailLegend+" "+v.name, v.value); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s %s'",
+				tailLegend, v.name)
+		}
+	}
+	// Empirical survival P(X >= x_i) and the fitted zeta*P(Y > x_i - u), where
+	// zeta is the fraction of the samples above the threshold.
+	total := h.WeightsTotal()
+	var zeta float64
+	for _, w := range ws {
+		zeta += w
+	}
+	zeta /= total
+	emp := make([]float64, len(xs))
+	fit := make([]float64, len(xs))
+	tail := zeta * total
+	for i := range xs {
+		emp[i] = math.Log10(tail / total)
+		tail -= ws[i]
+		fit[i] = math.Log10(zeta * g.Survival(ys[i]))
+	}
+	for _, p := range []struct {
+		ys     []float64
+		legend string
+		chart  plot.ChartType
+	}{
+		{emp, tailLegend, plot.ChartLine},
+		{fit, fmt.Sprintf("%s GPD shape=%.3g", tailLegend, g.Shape), plot.ChartDashed},
+	} {
+		var px, py []float64
+		for i, y := range p.ys {
+			if math.IsInf(y, 0) || math.IsNaN(y) {
+				continue
+			}
+			px = append(px, xs[i])
+			py = append(py, y)
+		}
+		plt, err := plot.NewXYPlot(px, py)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", p.legend)
+		}
+		plt.SetLegend(Prefix(prefix, p.legend)).SetYLabel("log10 P(X>x)")
+		plt.SetChartType(p.chart)
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", p.legend)
+		}
+	}
+	return nil
+}
+
+// fitAnalytical sets the parameters of the Student's T reference distribution
+// ac by maximum likelihood, and adds their standard errors as values. See
+// fitSamples for which samples are fitted.
+func fitAnalytical(ctx context.Context, dh stats.DistributionWithHistogram, ac *config.AnalyticalDistribution, c *config.DeriveAlpha, prefix, legend string) error {
+	xs, ws, n := fitSamples(dh)
+	fit, err := FitWeightedStudentsT(xs, ws, n, c)
+	if err != nil {
+		return errors.Annotate(err, "failed to fit Student's T")
+	}
+	ac.Alpha = fit.Alpha
+	ac.Mean = fit.Mean
+	ac.MAD = fit.MAD
+	for _, v := range []struct {
+		name string
+		x    float64
+	}{
+		{"alpha stderr", fit.AlphaErr},
+		{"mean stderr", fit.MeanErr},
+		{"MAD stderr", fit.MADErr},
+	} {
+		if err := AddTypedValue(ctx, prefix, legend+" "+v.name, FloatValue(v.x)); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s %s'", legend, v.name)
+		}
+	}
+	return nil
+}
+
+// plotAnalytical plots all the reference distributions configured in c over
+// the distribution dh.
 func plotAnalytical(ctx context.Context, dh stats.DistributionWithHistogram, c *config.DistributionPlot, prefix, legend string) error {
-	if c.RefDist == nil || c.Graph == "" {
+	if (c.RefDist == nil && len(c.RefDists) == 0) || c.Graph == "" {
 		return nil
 	}
-	dc := *c.RefDist // semi-deep copy, to modify locally
+	if err := AddTypedValue(ctx, prefix, legend+" mean", FloatValue(dh.Mean())); err != nil {
+		return errors.Annotate(err, "failed to add value for '%s mean'", legend)
+	}
+	if err := AddTypedValue(ctx, prefix, legend+" MAD", FloatValue(dh.MAD())); err != nil {
+		return errors.Annotate(err, "failed to add value for '%s MAD'", legend)
+	}
+	if c.RefDist != nil {
+		if err := plotReference(ctx, dh, c, c.RefDist, prefix, legend, ""); err != nil {
+			return errors.Annotate(err, "failed to plot reference distribution")
+		}
+	}
+	for _, r := range c.RefDists {
+		if err := plotReference(ctx, dh, c, r.Dist, prefix, legend, r.Legend); err != nil {
+			return errors.Annotate(err, "failed to plot reference '%s'", r.Legend)
+		}
+	}
+	return nil
+}
+
+// plotReference plots a single reference distribution rc over dh. The
+// unnamed reference ("ref" in the legends) is the one in c.RefDist.
+func plotReference(ctx context.Context, dh stats.DistributionWithHistogram, c *config.DistributionPlot, rc *config.CompoundDistribution, prefix, legend, refLegend string) error {
+	valueLegend := legend // for the values of the reference parameters
+	if refLegend == "" {
+		refLegend = "ref"
+	} else {
+		valueLegend = legend + " " + refLegend
+	}
+	dc := *rc // semi-deep copy, to modify locally
 	var ac config.AnalyticalDistribution
 	if dc.AnalyticalSource != nil {
 		ac = *dc.AnalyticalSource
@@ -906,25 +3757,41 @@ func plotAnalytical(ctx context.Context, dh stats.DistributionWithHistogram, c *
 		xs = h.Buckets().Xs(0.5)
 	}
 	if c.DeriveAlpha != nil && dc.N == 1 && dc.AnalyticalSource != nil && ac.Name == "t" {
-		ac.Alpha = DeriveAlpha(h, ac.Mean, ac.MAD, c.DeriveAlpha)
+		if c.DeriveAlpha.FitMethod == "mle" {
+			if err := fitAnalytical(ctx, dh, &ac, c.DeriveAlpha, prefix, valueLegend); err != nil {
+				return errors.Annotate(err, "failed to fit reference distribution")
+			}
+		} else {
+			ac.Alpha = DeriveAlpha(h, ac.Mean, ac.MAD, c.DeriveAlpha)
+		}
+		err := plotAlphaScan(ctx, dh, ac.Mean, ac.MAD, c.DeriveAlpha, Prefix(prefix, valueLegend))
+		if err != nil {
+			return errors.Annotate(err, "failed to plot alpha scan")
+		}
+		if c.DeriveAlpha.SeparateTails {
+			plotLegend := Prefix(prefix, legend) + " " + refLegend
+			err := plotTails(ctx, dh, xs, &ac, c, prefix, valueLegend, plotLegend)
+			if err != nil {
+				return errors.Annotate(err, "failed to fit separate tails")
+			}
+		}
 	}
 
-	if err := AddValue(ctx, prefix, legend+" mean", fmt.Sprintf("%.4g", dh.Mean())); err != nil {
-		return errors.Annotate(err, "failed to add value for '%s mean'", legend)
-	}
-	if err := AddValue(ctx, prefix, legend+" MAD", fmt.Sprintf("%.4g", dh.MAD())); err != nil {
-		return errors.Annotate(err, "failed to add value for '%s MAD'", legend)
-	}
 	if dc.AnalyticalSource != nil && dc.AnalyticalSource.Name == "t" {
-		alpha := fmt.Sprintf("%.4g", dc.AnalyticalSource.Alpha)
-		if err := AddValue(ctx, prefix, legend+" alpha", alpha); err != nil {
-			return errors.Annotate(err, "failed to add value for '%s alpha'", legend)
+		alpha := FloatValue(dc.AnalyticalSource.Alpha)
+		if err := AddTypedValue(ctx, prefix, valueLegend+" alpha", alpha); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s alpha'", valueLegend)
 		}
 	}
 	dist, distName, err := CompoundDistribution(ctx, &dc)
 	if err != nil {
 		return errors.Annotate(err, "failed to instantiate reference distribution")
 	}
+	esF := func(p float64) float64 { return ExpectedShortfall(dist, p) }
+	err = addVaRValues(ctx, c.VaRLevels, dist.Quantile, esF, prefix, legend+" "+refLegend)
+	if err != nil {
+		return errors.Annotate(err, "failed to add reference VaR values")
+	}
 	ys := make([]float64, len(xs))
 	for i, x := range xs {
 		ys[i] = dist.Prob(x)
@@ -934,14 +3801,14 @@ func plotAnalytical(ctx context.Context, dh stats.DistributionWithHistogram, c *
 	if err != nil {
 		return errors.Annotate(err, "failed to create '%s' analytical plot", legend)
 	}
-	plt.SetLegend(Prefix(prefix, legend) + " ref:" + distName)
+	plt.SetLegend(Prefix(prefix, legend) + " " + refLegend + ":" + distName)
 	plt.SetChartType(plot.ChartDashed)
 	if c.LogY {
 		plt.SetYLabel("log10(p.d.f.)")
 	} else {
 		plt.SetYLabel("p.d.f.")
 	}
-	if err := plot.Add(ctx, plt, c.Graph); err != nil {
+	if err := AddPlot(ctx, plt, c.Graph); err != nil {
 		return errors.Annotate(err, "failed to add '%s' analytical plot", legend)
 	}
 	return nil
@@ -953,6 +3820,10 @@ func plotAnalytical(ctx context.Context, dh stats.DistributionWithHistogram, c *
 //
 // The idea is to evaluate visually the noisiness of the statistic as the number
 // of samples increase.
+//
+// When configured with multiple runs, the caller must call NextRun after each
+// independent sample stream, and the resulting Ys and Percentiles are the median
+// and the envelopes of the run trajectories.
 type CumulativeStatistic struct {
 	config      *config.CumulativeStatistic
 	h           *stats.Histogram
@@ -963,7 +3834,11 @@ type CumulativeStatistic struct {
 	Ys          []float64
 	Percentiles [][]float64
 	Expected    float64 // expected value of the statistic
+	hasExpected bool
 	nextPoint   int
+	runs        [][]float64 // trajectories of the completed runs
+	runXs       []float64   // Xs of the completed runs
+	aggregated  bool
 }
 
 // NewCumulativeStatistic initializes an empty CumulativeStatistic object.
@@ -985,7 +3860,7 @@ func (c *CumulativeStatistic) point(i int) int {
 // caller is responsible for computing the statistic from the current and all of
 // the preceding samples.
 func (c *CumulativeStatistic) AddDirect(y float64) {
-	if c == nil {
+	if c.Done() {
 		return
 	}
 	if c.i < c.config.Skip {
@@ -1008,7 +3883,7 @@ func (c *CumulativeStatistic) AddDirect(y float64) {
 // AddToAverage updates a statistic computed as the average of y(x) values. This
 // is useful e.g. for tracking a mean.
 func (c *CumulativeStatistic) AddToAverage(y float64) {
-	if c == nil {
+	if c.Done() {
 		return
 	}
 	c.sum += y
@@ -1026,12 +3901,166 @@ func (c *CumulativeStatistic) Skip() {
 	}
 }
 
+// Done indicates that all the configured runs are complete, and new samples are
+// ignored. It is always true for a nil statistic.
+func (c *CumulativeStatistic) Done() bool {
+	return c == nil || len(c.runs) >= c.config.Runs
+}
+
+// NextRun completes the current run and starts a new independent one. It is a
+// no-op for a single-run statistic.
+func (c *CumulativeStatistic) NextRun() {
+	if c == nil || c.config.Runs <= 1 || c.Done() {
+		return
+	}
+	c.runs = append(c.runs, c.Ys)
+	if len(c.Xs) > len(c.runXs) {
+		c.runXs = c.Xs
+	}
+	c.Xs = nil
+	c.Ys = nil
+	c.i = 0
+	c.sum = 0
+	c.numPoints = 0
+	c.nextPoint = 0
+	c.h = stats.NewHistogram(&c.config.Buckets)
+	for i := range c.Percentiles {
+		c.Percentiles[i] = nil
+	}
+}
+
+// SortedQuantile linearly interpolates the q-th quantile of the sorted non-empty
+// xs, such that q=0 and q=1 yield the min and the max.
+func SortedQuantile(xs []float64, q float64) float64 {
+	pos := q * float64(len(xs)-1)
+	i := int(math.Floor(pos))
+	if i >= len(xs)-1 {
+		return xs[len(xs)-1]
+	}
+	return xs[i] + (pos-float64(i))*(xs[i+1]-xs[i])
+}
+
+// aggregate the completed runs into the median trajectory and the percentile
+// envelopes. It is idempotent, and must be called after Map.
+func (c *CumulativeStatistic) aggregate() {
+	if c.config.Runs <= 1 || c.aggregated {
+		return
+	}
+	c.aggregated = true
+	if len(c.Ys) > 0 {
+		c.NextRun()
+	}
+	if len(c.runs) == 0 {
+		return
+	}
+	n := len(c.runXs)
+	for _, r := range c.runs {
+		if len(r) < n {
+			n = len(r)
+		}
+	}
+	c.Xs = c.runXs[:n]
+	c.Ys = make([]float64, n)
+	for i := range c.Percentiles {
+		c.Percentiles[i] = make([]float64, n)
+	}
+	vs := make([]float64, len(c.runs))
+	for j := 0; j < n; j++ {
+		for k, r := range c.runs {
+			vs[k] = r[j]
+		}
+		sort.Float64s(vs)
+		c.Ys[j] = SortedQuantile(vs, 0.5)
+		for i, p := range c.config.Percentiles {
+			c.Percentiles[i][j] = SortedQuantile(vs, p/100.0)
+		}
+	}
+}
+
 // SetExpected value of the statistic, for visual reference on the graph.
 func (c *CumulativeStatistic) SetExpected(y float64) {
 	if c == nil {
 		return
 	}
 	c.Expected = y
+	c.hasExpected = true
+}
+
+// convergencePoints are log10(n) and log10|error| for each point with a
+// non-zero error. The error is relative to the expected value when set, or to
+// the final value of the statistic otherwise.
+func (c *CumulativeStatistic) convergencePoints() (xs, ys []float64) {
+	c.aggregate()
+	if len(c.Ys) == 0 {
+		return
+	}
+	ref := c.Expected
+	if !c.hasExpected {
+		ref = c.Ys[len(c.Ys)-1]
+	}
+	for i, y := range c.Ys {
+		e := math.Abs(y - ref)
+		if e == 0 || math.IsNaN(e) || math.IsInf(e, 0) {
+			continue
+		}
+		xs = append(xs, math.Log10(c.Xs[i]))
+		ys = append(ys, math.Log10(e))
+	}
+	return
+}
+
+// ConvergenceRate fits log|error| = rate*log(n) + intercept to the accumulated
+// points (see convergencePoints). For a statistic obeying the central limit
+// theorem, the rate is close to -1/2, and it is slower (closer to 0) for
+// fat-tailed distributions.
+func (c *CumulativeStatistic) ConvergenceRate() (rate, intercept float64, err error) {
+	if c == nil {
+		err = errors.Reason("statistic is nil")
+		return
+	}
+	xs, ys := c.convergencePoints()
+	rate, intercept, err = LeastSquares(xs, ys)
+	if err != nil {
+		err = errors.Annotate(err, "failed to fit the convergence rate")
+		return
+	}
+	if math.IsInf(rate, 0) {
+		err = errors.Reason("not enough distinct points to fit the convergence rate")
+	}
+	return
+}
+
+// PlotConvergence plots log10|error| and its linear fit in the convergence
+// graph, when configured.
+func (c *CumulativeStatistic) PlotConvergence(ctx context.Context, legend string) error {
+	if c == nil || c.config.ConvergenceGraph == "" {
+		return nil
+	}
+	xs, ys := c.convergencePoints()
+	rate, intercept, err := c.ConvergenceRate()
+	if err != nil {
+		return errors.Annotate(err, "failed to plot '%s'", legend)
+	}
+	plt, err := plot.NewXYPlot(xs, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	plt.SetLegend(legend).SetYLabel("log10|error|")
+	if err := AddPlot(ctx, plt, c.config.ConvergenceGraph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	fitXs := []float64{xs[0], xs[len(xs)-1]}
+	fitYs := []float64{rate*fitXs[0] + intercept, rate*fitXs[1] + intercept}
+	fLegend := fmt.Sprintf("%s rate=%.3g", legend, rate)
+	plt, err = plot.NewXYPlot(fitXs, fitYs)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", fLegend)
+	}
+	plt.SetLegend(fLegend).SetYLabel("log10|error|").SetChartType(plot.ChartDashed)
+	if err := AddPlot(ctx, plt, c.config.ConvergenceGraph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", fLegend)
+	}
+	return nil
 }
 
 // Map applies f to all the resulting point values (the statistic and its
@@ -1049,6 +4078,11 @@ func (c *CumulativeStatistic) Map(f func(float64) float64) {
 			c.Percentiles[p][i] = f(c.Percentiles[p][i])
 		}
 	}
+	for _, r := range c.runs {
+		for i, v := range r {
+			r[i] = f(v)
+		}
+	}
 }
 
 // Plot the accumulated statistic values, percentiles and the expected value, as
@@ -1057,12 +4091,13 @@ func (c *CumulativeStatistic) Plot(ctx context.Context, yLabel, legend string) e
 	if c == nil {
 		return nil
 	}
+	c.aggregate()
 	plt, err := plot.NewXYPlot(c.Xs, c.Ys)
 	if err != nil {
 		return errors.Annotate(err, "failed to create plot '%s'", legend)
 	}
 	plt.SetLegend(legend).SetYLabel(yLabel)
-	if err := plot.Add(ctx, plt, c.config.Graph); err != nil {
+	if err := AddPlot(ctx, plt, c.config.Graph); err != nil {
 		return errors.Annotate(err, "failed to add plot '%s'", legend)
 	}
 	for i, p := range c.config.Percentiles {
@@ -1072,7 +4107,7 @@ func (c *CumulativeStatistic) Plot(ctx context.Context, yLabel, legend string) e
 			return errors.Annotate(err, "failed to create plot '%s'", pLegend)
 		}
 		plt.SetLegend(pLegend).SetYLabel(yLabel).SetChartType(plot.ChartDashed)
-		if err := plot.Add(ctx, plt, c.config.Graph); err != nil {
+		if err := AddPlot(ctx, plt, c.config.Graph); err != nil {
 			return errors.Annotate(err, "failed to add plot '%s'", pLegend)
 		}
 	}
@@ -1086,7 +4121,7 @@ func (c *CumulativeStatistic) Plot(ctx context.Context, yLabel, legend string) e
 		eLegend := fmt.Sprintf("%s expected=%.4g", legend, c.Expected)
 		plt.SetLegend(eLegend).SetYLabel(yLabel)
 		plt.SetChartType(plot.ChartDashed)
-		if err := plot.Add(ctx, plt, c.config.Graph); err != nil {
+		if err := AddPlot(ctx, plt, c.config.Graph); err != nil {
 			return errors.Annotate(err, "failed to add plot '%s expected'", legend)
 		}
 	}
@@ -1126,6 +4161,99 @@ func LeastSquares(xs, ys []float64) (incline float64, intercept float64, err err
 	return
 }
 
+// Regression is the result of a 1-D linear regression Y = Incline*X +
+// Intercept with the standard errors and t-statistics of the coefficients and
+// the coefficient of determination R2. The standard errors and t-statistics
+// are NaN when there are not enough points (at least 3) to estimate them.
+type Regression struct {
+	Incline      float64
+	Intercept    float64
+	InclineErr   float64
+	InterceptErr float64
+	InclineT     float64
+	InterceptT   float64
+	R2           float64
+	N            int
+}
+
+// LinearRegression computes the weighted least squares regression for Y =
+// incline*X + intercept. The weights are relative (inverse variances up to a
+// common factor), and nil weights are all 1. As in LeastSquares, the incline
+// is +Inf when all xs are the same, which is not an error.
+func LinearRegression(xs, ys, weights []float64) (r Regression, err error) {
+	if len(xs) != len(ys) {
+		err = errors.Reason("len(xs)=%d != len(ys)=%d", len(xs), len(ys))
+		return
+	}
+	if weights != nil && len(weights) != len(xs) {
+		err = errors.Reason("len(weights)=%d != len(xs)=%d", len(weights), len(xs))
+		return
+	}
+	if len(xs) < 2 {
+		err = errors.Reason("len(xs)=%d < 2: not enough points", len(xs))
+		return
+	}
+	w := func(i int) float64 {
+		if weights == nil {
+			return 1
+		}
+		return weights[i]
+	}
+	var sumW, meanX, meanY float64
+	for i, x := range xs {
+		sumW += w(i)
+		meanX += w(i) * x
+		meanY += w(i) * ys[i]
+	}
+	if sumW <= 0 {
+		err = errors.Reason("sum of weights=%g must be > 0", sumW)
+		return
+	}
+	meanX /= sumW
+	meanY /= sumW
+	var sxx, sxy, syy float64
+	for i, x := range xs {
+		dx, dy := x-meanX, ys[i]-meanY
+		sxx += w(i) * dx * dx
+		sxy += w(i) * dx * dy
+		syy += w(i) * dy * dy
+	}
+	nan := math.NaN()
+	r = Regression{
+		InclineErr:   nan,
+		InterceptErr: nan,
+		InclineT:     nan,
+		InterceptT:   nan,
+		R2:           nan,
+		N:            len(xs),
+	}
+	if sxx == 0 {
+		r.Incline = math.Inf(1)
+		return
+	}
+	r.Incline = sxy / sxx
+	r.Intercept = meanY - r.Incline*meanX
+	var ssRes float64
+	for i, x := range xs {
+		e := ys[i] - r.Incline*x - r.Intercept
+		ssRes += w(i) * e * e
+	}
+	if syy > 0 {
+		r.R2 = 1 - ssRes/syy
+	}
+	if r.N < 3 {
+		return
+	}
+	// Residual variance per unit weight; the errors do not depend on the
+	// overall scale of the weights.
+	s2 := ssRes / float64(r.N-2)
+	r.InclineErr = math.Sqrt(s2 / sxx)
+	r.InterceptErr = math.Sqrt(s2 * (1/sumW + meanX*meanX/sxx))
+	r.InclineT = r.Incline / r.InclineErr
+	r.InterceptT = r.Intercept / r.InterceptErr
+	return
+}
+
 // PlotScatter plots the unordered points given as xs and ys as a scatter plot,
 // according to the config.
 func PlotScatter(ctx context.Context, xs, ys []float64, c *config.ScatterPlot, prefix, legend, yLabel string) error {
@@ -1137,13 +4265,20 @@ func PlotScatter(ctx context.Context, xs, ys []float64, c *config.ScatterPlot, p
 	}
 	prefixedLegend := Prefix(prefix, legend)
 
-	plt, err := plot.NewXYPlot(xs, ys)
-	if err != nil {
-		return errors.Annotate(err, "failed to create plot '%s'", legend)
-	}
-	plt.SetChartType(plot.ChartScatter).SetYLabel(yLabel).SetLegend(prefixedLegend)
-	if err := plot.Add(ctx, plt, c.Graph); err != nil {
-		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	if c.Density != nil {
+		if err := plotScatterDensity(ctx, xs, ys, c.Density, c.Graph, prefixedLegend, yLabel); err != nil {
+			return err
+		}
+	} else {
+		plt, err := plot.NewXYPlot(xs, ys)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", legend)
+		}
+		plt.SetChartType(plot.ChartScatter).SetYLabel(yLabel).SetLegend(prefixedLegend)
+		Subsample(plt, c.MaxPoints)
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", legend)
+		}
 	}
 	minX, maxX := minMax(xs)
 	if c.PlotExpected {
@@ -1154,32 +4289,273 @@ func PlotScatter(ctx context.Context, xs, ys []float64, c *config.ScatterPlot, p
 			return errors.Annotate(err, "failed to create plot '%s'", lgd)
 		}
 		plt.SetChartType(plot.ChartDashed).SetYLabel(yLabel).SetLegend(lgd)
-		if err := plot.Add(ctx, plt, c.Graph); err != nil {
+		if err := AddPlot(ctx, plt, c.Graph); err != nil {
 			return errors.Annotate(err, "failed to add plot '%s'", lgd)
 		}
 	}
 	if c.DeriveLine {
-		a, b, err := LeastSquares(xs, ys)
-		lgd := prefixedLegend + " derived"
+		if err := plotDerivedLine(ctx, xs, ys, minX, maxX, c.Graph, prefixedLegend, yLabel); err != nil {
+			return err
+		}
+	}
+	if c.BinnedMeans != nil {
+		if err := plotBinnedMeans(ctx, xs, ys, c.BinnedMeans, c.Graph, prefixedLegend, yLabel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// plotScatterDensity plots the 2D histogram of the points as the centers of
+// the non-empty buckets, one scatter plot per density level. Level k out of n
+// contains the buckets with at least maxCount^(k/n) points.
+func plotScatterDensity(ctx context.Context, xs, ys []float64, c *config.ScatterDensity, graph, prefixedLegend, yLabel string) error {
+	if len(xs) == 0 {
+		return nil
+	}
+	bx, by := c.XBuckets, c.YBuckets // copy, to fit locally
+	if bx.Auto {
+		if err := FitBuckets(&bx, xs); err != nil {
+			return errors.Annotate(err, "failed to fit X buckets")
+		}
+	}
+	if by.Auto {
+		if err := FitBuckets(&by, ys); err != nil {
+			return errors.Annotate(err, "failed to fit Y buckets")
+		}
+	}
+	counts := make(map[IntPair]int)
+	maxCount := 0
+	for i, x := range xs {
+		k := IntPair{X: bx.Bucket(x), Y: by.Bucket(ys[i])}
+		counts[k]++
+		if counts[k] > maxCount {
+			maxCount = counts[k]
+		}
+	}
+	thresholds := make([]float64, c.Levels)
+	for k := range thresholds {
+		thresholds[k] = math.Pow(float64(maxCount), float64(k)/float64(c.Levels))
+	}
+	levelXs := make([][]float64, c.Levels)
+	levelYs := make([][]float64, c.Levels)
+	for k := 0; k < bx.N; k++ {
+		for l := 0; l < by.N; l++ {
+			n := float64(counts[IntPair{X: k, Y: l}])
+			if n == 0 {
+				continue
+			}
+			lvl := sort.Search(c.Levels, func(i int) bool { return thresholds[i] > n }) - 1
+			levelXs[lvl] = append(levelXs[lvl], bx.X(k, 0.5))
+			levelYs[lvl] = append(levelYs[lvl], by.X(l, 0.5))
+		}
+	}
+	for lvl := range levelXs {
+		if len(levelXs[lvl]) == 0 {
+			continue
+		}
+		lgd := fmt.Sprintf("%s density>=%.3g", prefixedLegend, math.Ceil(thresholds[lvl]))
+		plt, err := plot.NewXYPlot(levelXs[lvl], levelYs[lvl])
 		if err != nil {
-			logging.Warningf(ctx, "skipping %s: %s", lgd, err.Error())
+			return errors.Annotate(err, "failed to create plot '%s'", lgd)
 		}
-		if math.IsInf(a, 0) {
-			logging.Warningf(ctx, "skipping %s: incline is infinite", lgd)
+		plt.SetChartType(plot.ChartScatter).SetYLabel(yLabel).SetLegend(lgd)
+		if err := AddPlot(ctx, plt, graph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", lgd)
 		}
-		line := []float64{minX*a + b, maxX*a + b}
-		plt, err := plot.NewXYPlot([]float64{minX, maxX}, line)
+	}
+	return nil
+}
+
+// plotDerivedLine plots the regression line of the scatter plot in
+// [minX..maxX], annotated with its slope and the standard error.
+func plotDerivedLine(ctx context.Context, xs, ys []float64, minX, maxX float64, graph, prefixedLegend, yLabel string) error {
+	r, err := LinearRegression(xs, ys, nil)
+	lgd := prefixedLegend + " derived"
+	if err != nil {
+		logging.Warningf(ctx, "skipping %s: %s", lgd, err.Error())
+		return nil
+	}
+	if math.IsInf(r.Incline, 0) {
+		logging.Warningf(ctx, "skipping %s: incline is infinite", lgd)
+		return nil
+	}
+	lgd += fmt.Sprintf(" slope=%.3g", r.Incline)
+	if !math.IsNaN(r.InclineErr) {
+		lgd += fmt.Sprintf("±%.2g", r.InclineErr)
+	}
+	a, b := r.Incline, r.Intercept
+	line := []float64{minX*a + b, maxX*a + b}
+	plt, err := plot.NewXYPlot([]float64{minX, maxX}, line)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", lgd)
+	}
+	plt.SetYLabel(yLabel).SetLegend(lgd)
+	if err := AddPlot(ctx, plt, graph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", lgd)
+	}
+	return nil
+}
+
+// plotBinnedMeans plots the conditional means E[Y | X in bucket] of the
+// scatter plot and the mean+-stderr bands as dashed lines. The X coordinate of
+// each point is the mean of X in its bucket; empty buckets are skipped.
+func plotBinnedMeans(ctx context.Context, xs, ys []float64, buckets *stats.Buckets, graph, prefixedLegend, yLabel string) error {
+	b := *buckets // copy, to fit locally
+	if b.Auto {
+		if err := FitBuckets(&b, xs); err != nil {
+			return errors.Annotate(err, "failed to fit buckets for binned means")
+		}
+	}
+	ns := make([]int, b.N)
+	sumX := make([]float64, b.N)
+	sumY := make([]float64, b.N)
+	sumY2 := make([]float64, b.N)
+	for i, x := range xs {
+		k := b.Bucket(x)
+		ns[k]++
+		sumX[k] += x
+		sumY[k] += ys[i]
+		sumY2[k] += ys[i] * ys[i]
+	}
+	var bx, means, lows, highs []float64
+	for k, n := range ns {
+		if n == 0 {
+			continue
+		}
+		fn := float64(n)
+		mean := sumY[k] / fn
+		var stderr float64
+		if n > 1 {
+			if v := (sumY2[k] - fn*mean*mean) / (fn - 1); v > 0 {
+				stderr = math.Sqrt(v / fn)
+			}
+		}
+		bx = append(bx, sumX[k]/fn)
+		means = append(means, mean)
+		lows = append(lows, mean-stderr)
+		highs = append(highs, mean+stderr)
+	}
+	if len(bx) == 0 {
+		return nil
+	}
+	for _, p := range []struct {
+		ys        []float64
+		suffix    string
+		chartType plot.ChartType
+	}{
+		{means, " binned means", plot.ChartLine},
+		{lows, " binned means-stderr", plot.ChartDashed},
+		{highs, " binned means+stderr", plot.ChartDashed},
+	} {
+		lgd := prefixedLegend + p.suffix
+		plt, err := plot.NewXYPlot(bx, p.ys)
 		if err != nil {
 			return errors.Annotate(err, "failed to create plot '%s'", lgd)
 		}
-		plt.SetYLabel(yLabel).SetLegend(lgd)
-		if err := plot.Add(ctx, plt, c.Graph); err != nil {
+		plt.SetChartType(p.chartType).SetYLabel(yLabel).SetLegend(lgd)
+		if err := AddPlot(ctx, plt, graph); err != nil {
 			return errors.Annotate(err, "failed to add plot '%s'", lgd)
 		}
 	}
 	return nil
 }
 
+// Normalize the sample to mean=0 and the unit MAD or sigma, according to by:
+// "MAD", "sigma" or "none". The latter returns the sample as is.
+func Normalize(s *stats.Sample, by string) (*stats.Sample, error) {
+	switch by {
+	case "none":
+		return s, nil
+	case "MAD":
+		return s.Normalize()
+	}
+	scale, err := Scale(s, by)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to compute the scale")
+	}
+	if scale == 0.0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+		return nil, errors.Reason("%s=%g must be non-zero and finite", by, scale)
+	}
+	mean := s.Mean()
+	data := make([]float64, len(s.Data()))
+	for i, d := range s.Data() {
+		data[i] = (d - mean) / scale
+	}
+	return stats.NewSample(data), nil
+}
+
+// Scale of the sample s estimated by the given method: "MAD", "sigma", "IQR"
+// or "Qn".
+func Scale(s *stats.Sample, by string) (float64, error) {
+	switch by {
+	case "MAD":
+		return s.MAD(), nil
+	case "sigma":
+		return s.Sigma(), nil
+	case "IQR":
+		return IQR(s.Data()), nil
+	case "Qn":
+		return Qn(s.Data()), nil
+	}
+	return 0, errors.Reason("unsupported scale estimator: '%s'", by)
+}
+
+// IQR is the inter-quartile range of xs, that is, the difference between its
+// 75th and 25th percentiles. It is NaN for an empty xs.
+func IQR(xs []float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	sorted := make([]float64, len(xs))
+	copy(sorted, xs)
+	sort.Float64s(sorted)
+	return SortedQuantile(sorted, 0.75) - SortedQuantile(sorted, 0.25)
+}
+
+// Qn is the Rousseeuw-Croux scale estimator: the k'th smallest of the pairwise
+// distances |x_i - x_j|, i < j, where k = h*(h-1)/2 and h = n/2 + 1, scaled
+// by 2.2219 to estimate sigma for a normal distribution. The small sample
+// correction factors are not applied. It is NaN for fewer than 2 samples.
+//
+// The k'th distance is found by bisection over the distance values, counting
+// the pairs within a distance in linear time over the sorted samples.
+func Qn(xs []float64) float64 {
+	n := len(xs)
+	if n < 2 {
+		return math.NaN()
+	}
+	sorted := make([]float64, n)
+	copy(sorted, xs)
+	sort.Float64s(sorted)
+	h := n/2 + 1
+	k := h * (h - 1) / 2
+	// count is the number of pairs i < j with x_j - x_i <= d.
+	count := func(d float64) int {
+		var res, i int
+		for j := range sorted {
+			for sorted[j]-sorted[i] > d {
+				i++
+			}
+			res += j - i
+		}
+		return res
+	}
+	lo, hi := 0.0, sorted[n-1]-sorted[0]
+	if count(lo) >= k {
+		return 0
+	}
+	for i := 0; i < 100 && hi-lo > 1e-12*hi; i++ {
+		mid := (lo + hi) / 2
+		if count(mid) >= k {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return 2.2219 * hi
+}
+
 // Stability returns a series of deviations of the statistic f over a Timeseries
 // of size `length`, as specified by the config.
 //
@@ -1210,6 +4586,225 @@ func Stability(length int, f func(low, high int) float64, c *config.StabilityPlo
 	return res
 }
 
+// StabilityPoints accumulate the values of a statistic over the total range (X)
+// and the corresponding subranges (Y) for the scatter plot of StabilityPlot.
+type StabilityPoints struct {
+	X []float64
+	Y []float64
+}
+
+// Add the points for a Timeseries of size `length`, with the subranges as in
+// Stability. Does nothing when the scatter plot is not configured.
+func (p *StabilityPoints) Add(length int, f func(low, high int) float64, c *config.StabilityPlot) {
+	if c == nil || c.Scatter == nil || length < c.Step+c.Window {
+		return
+	}
+	total := f(0, length)
+	for h := length; h >= c.Window; h -= c.Step {
+		p.X = append(p.X, total)
+		p.Y = append(p.Y, f(h-c.Window, h))
+	}
+}
+
+// Merge p2 into p.
+func (p *StabilityPoints) Merge(p2 *StabilityPoints) {
+	p.X = append(p.X, p2.X...)
+	p.Y = append(p.Y, p2.Y...)
+}
+
+// Plot the accumulated points, if configured.
+func (p *StabilityPoints) Plot(ctx context.Context, c *config.StabilityPlot, prefix, legend string) error {
+	if c == nil || c.Scatter == nil || len(p.X) == 0 {
+		return nil
+	}
+	return PlotScatter(ctx, p.X, p.Y, c.Scatter, prefix, legend, "subrange")
+}
+
+// StabilitySeries accumulates the statistic over the subranges of multiple
+// Timeseries by the end date of the subrange, for the time series plot of
+// StabilityPlot.
+type StabilitySeries struct {
+	sums   map[db.Date]float64
+	counts map[db.Date]int
+}
+
+// Add the statistic over the subranges of a Timeseries with the given dates,
+// with the subranges as in Stability. Does nothing when the time series plot is
+// not configured.
+func (s *StabilitySeries) Add(dates []db.Date, f func(low, high int) float64, c *config.StabilityPlot) {
+	if c == nil || c.TimeseriesGraph == "" || len(dates) < c.Step+c.Window {
+		return
+	}
+	if s.sums == nil {
+		s.sums = make(map[db.Date]float64)
+		s.counts = make(map[db.Date]int)
+	}
+	for h := len(dates); h >= c.Window; h -= c.Step {
+		d := dates[h-1]
+		s.sums[d] += f(h-c.Window, h)
+		s.counts[d]++
+	}
+}
+
+// Merge s2 into s.
+func (s *StabilitySeries) Merge(s2 *StabilitySeries) {
+	if s2.sums == nil {
+		return
+	}
+	if s.sums == nil {
+		s.sums = make(map[db.Date]float64)
+		s.counts = make(map[db.Date]int)
+	}
+	for d, x := range s2.sums {
+		s.sums[d] += x
+		s.counts[d] += s2.counts[d]
+	}
+}
+
+// Timeseries of the statistic averaged across all the added series per date.
+func (s *StabilitySeries) Timeseries() *stats.Timeseries {
+	dates := make([]db.Date, 0, len(s.sums))
+	for d := range s.sums {
+		dates = append(dates, d)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	data := make([]float64, len(dates))
+	for i, d := range dates {
+		data[i] = s.sums[d] / float64(s.counts[d])
+	}
+	return stats.NewTimeseries(dates, data)
+}
+
+// Plot the averaged time series, if configured.
+func (s *StabilitySeries) Plot(ctx context.Context, c *config.StabilityPlot, prefix, legend string) error {
+	if c == nil || c.TimeseriesGraph == "" || len(s.sums) == 0 {
+		return nil
+	}
+	legend = Prefix(prefix, legend)
+	plt, err := plot.NewSeriesPlot(s.Timeseries())
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	plt.SetLegend(legend).SetYLabel("value")
+	if err := AddPlot(ctx, plt, c.TimeseriesGraph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	return nil
+}
+
+// BootstrapInterval estimates the confidence interval [low, high] of the
+// statistic f over data by resampling data with replacement the given number of
+// times. The confidence is in percents, within (0..100). Use seed=0 in
+// production (this creates a new random seed), and seed>=1 in tests for
+// deterministic behavior.
+func BootstrapInterval(data []float64, f func([]float64) float64, samples int, confidence float64, seed uint64) (low, high float64) {
+	if len(data) == 0 || samples < 1 {
+		return
+	}
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	r := rand.New(rand.NewSource(seed))
+	resample := make([]float64, len(data))
+	values := make([]float64, samples)
+	for i := range values {
+		for j := range resample {
+			resample[j] = data[r.Intn(len(data))]
+		}
+		values[i] = f(resample)
+	}
+	sort.Float64s(values)
+	q := func(p float64) float64 {
+		k := int(math.Round(p * float64(samples-1)))
+		return values[k]
+	}
+	tail := (1 - confidence/100) / 2
+	return q(tail), q(1 - tail)
+}
+
+// IntPair is a pair of indices, e.g. of two tickers in a slice.
+type IntPair struct {
+	X int
+	Y int
+}
+
+// allPairs produces all pairs (i, j) such that i in [0..n-1] and j in
+// [i+1..n-1]. Total of n*(n-1)/2 values.
+type allPairs struct {
+	i int
+	j int
+	n int
+}
+
+var _ iterator.Iterator[IntPair] = &allPairs{}
+
+// AllPairs iterates over all the pairs (i, j) such that i in [0..n-1] and j in
+// [i+1..n-1]. Total of n*(n-1)/2 values.
+func AllPairs(n int) iterator.Iterator[IntPair] {
+	return &allPairs{n: n}
+}
+
+func (it *allPairs) Next() (IntPair, bool) {
+	if it.i+1 >= it.n {
+		return IntPair{}, false
+	}
+	if it.j <= it.i {
+		it.j = it.i + 1
+	}
+	res := IntPair{it.i, it.j}
+	it.j++
+	if it.j >= it.n {
+		it.i++
+		it.j = it.i + 1
+	}
+	return res, true
+}
+
+// randomPairs returns k random pairs (i, j) such that i in [0..n-1] and j in
+// [i+1..n-1].
+type randomPairs struct {
+	rand *rand.Rand
+	i    int
+	n    int
+	k    int
+}
+
+var _ iterator.Iterator[IntPair] = &randomPairs{}
+
+// RandomPairs iterates over k random pairs (i, j) such that i in [0..n-1] and j
+// in [i+1..n-1]. Use seed=0 in production (this creates a new random seed), and
+// seed>=1 in tests for deterministic behavior.
+func RandomPairs(n, k int, seed uint64) iterator.Iterator[IntPair] {
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	return &randomPairs{
+		rand: rand.New(rand.NewSource(seed)),
+		n:    n,
+		k:    k,
+	}
+}
+
+func (it *randomPairs) Next() (IntPair, bool) {
+	if it.n < 2 || it.i >= it.k {
+		return IntPair{}, false
+	}
+	it.i++
+	i := it.rand.Intn(it.n - 1)
+	j := it.rand.Intn(it.n-i-1) + i + 1
+	return IntPair{i, j}, true
+}
+
+// SamplePairs iterates over all the pairs of n elements when samples <= 0 or
+// there are no more than samples pairs, and over the given number of random
+// pairs otherwise. See RandomPairs for the seed semantics.
+func SamplePairs(n, samples int, seed uint64) iterator.Iterator[IntPair] {
+	if samples <= 0 || n*(n-1)/2 <= samples {
+		return AllPairs(n)
+	}
+	return RandomPairs(n, samples, seed)
+}
+
 // TestExperiment is a fake experiment used in tests. Define actual experiments
 // in their own subpackages.
 type TestExperiment struct {
@@ -1232,7 +4827,7 @@ func (t *TestExperiment) Run(ctx context.Context, cfg config.ExperimentConfig) e
 	if !ok {
 		return errors.Reason("unexpected config type: %T", cfg)
 	}
-	if err := t.AddValue(ctx, "grade", fmt.Sprintf("%g", t.cfg.Grade)); err != nil {
+	if err := AddTypedValue(ctx, t.cfg.ID, "grade", FloatValue(t.cfg.Grade)); err != nil {
 		return errors.Annotate(err, "cannot add grade value")
 	}
 	passed := "failed"
@@ -1246,7 +4841,7 @@ func (t *TestExperiment) Run(ctx context.Context, cfg config.ExperimentConfig) e
 	if err != nil {
 		return errors.Annotate(err, "failed to create XY plot")
 	}
-	if err := plot.Add(ctx, p, t.cfg.Graph); err != nil {
+	if err := AddPlot(ctx, p, t.cfg.Graph); err != nil {
 		return errors.Annotate(err, "cannot add plot")
 	}
 	return nil
@@ -15,13 +15,16 @@
 package experiments
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stockparfait/experiments/config"
 	"github.com/stockparfait/iterator"
@@ -29,6 +32,8 @@ import (
 	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/stockparfait/stats"
 	"github.com/stockparfait/testutil"
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/stat"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -57,6 +62,157 @@ func TestExperiments(t *testing.T) {
 
 	})
 
+	Convey("Optimize", t, func() {
+		Convey("Rosenbrock function", func() {
+			f := func(x []float64) float64 {
+				a, b := 1-x[0], x[1]-x[0]*x[0]
+				return a*a + 100*b*b
+			}
+			res := Optimize(f, []float64{-1.2, 1}, 1e-9, 1000)
+			So(testutil.RoundSlice(res, 3), ShouldResemble, []float64{1, 1})
+		})
+
+		Convey("one dimension with NaN outside the domain", func() {
+			f := func(x []float64) float64 {
+				if x[0] < 0 {
+					return math.NaN()
+				}
+				return x[0] - math.Log(x[0])
+			}
+			res := Optimize(f, []float64{3}, 1e-9, 1000)
+			So(testutil.Round(res[0], 4), ShouldEqual, 1)
+		})
+
+		Convey("stop with max iterations", func() {
+			var calls int
+			f := func(x []float64) float64 { calls++; return x[0]*x[0] + x[1]*x[1] }
+			Optimize(f, []float64{1, 1}, 1e-9, 5)
+			// 3 initial vertices, at most n+2=4 evaluations per iteration.
+			So(calls, ShouldBeLessThanOrEqualTo, 3+4*5)
+		})
+
+		Convey("empty init", func() {
+			So(Optimize(func([]float64) float64 { return 0 }, nil, 0.1, 10), ShouldBeNil)
+		})
+	})
+
+	Convey("tuner works", t, func() {
+		ctx := context.Background()
+		c := config.Source{
+			Workers:   8,
+			BatchSize: 10,
+			Adaptive: &config.Adaptive{
+				BatchTime:    1,
+				MaxBatchSize: 100,
+				MaxMemory:    1000,
+			},
+		}
+		So(newTuner(ctx, &config.Source{}), ShouldBeNil)
+		tu := newTuner(ctx, &c)
+		heap := 100.0
+		tu.heapMB = func() float64 { return heap }
+		So(tu.size(), ShouldEqual, 10)
+
+		Convey("batch size", func() {
+			tu.acquire()
+			tu.release(10, 100*time.Millisecond)
+			So(tu.size(), ShouldEqual, 100) // capped by the max
+			tu.acquire()
+			tu.release(10, 10*time.Second)
+			So(tu.perItem, ShouldAlmostEqual, 0.7*0.01+0.3*1.0)
+			So(tu.size(), ShouldEqual, 3)
+			tu.acquire()
+			tu.release(1, time.Hour)
+			So(tu.size(), ShouldEqual, 1)
+		})
+
+		Convey("memory ceiling", func() {
+			heap = 2000
+			tu.acquire()
+			tu.release(1, time.Millisecond)
+			So(tu.limit, ShouldEqual, 4)
+			tu.acquire()
+			tu.release(1, time.Millisecond)
+			So(tu.limit, ShouldEqual, 2)
+			heap = 700 // between half and the ceiling
+			tu.acquire()
+			tu.release(1, time.Millisecond)
+			So(tu.limit, ShouldEqual, 2)
+			heap = 100
+			tu.acquire()
+			tu.release(1, time.Millisecond)
+			So(tu.limit, ShouldEqual, 3)
+			So(tu.running, ShouldEqual, 0)
+		})
+
+		Convey("batches", func() {
+			tu.batchSize = 3
+			var b iterator.Iterator[[]int] = &tunedBatches[int]{
+				it: iterator.FromSlice([]int{1, 2, 3, 4, 5}), t: tu}
+			v, ok := b.Next()
+			So(ok, ShouldBeTrue)
+			So(v, ShouldResemble, []int{1, 2, 3})
+			tu.batchSize = 1
+			v, ok = b.Next()
+			So(ok, ShouldBeTrue)
+			So(v, ShouldResemble, []int{4})
+			tu.batchSize = 5
+			v, ok = b.Next()
+			So(ok, ShouldBeTrue)
+			So(v, ShouldResemble, []int{5})
+			_, ok = b.Next()
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Deterministic mode works", t, func() {
+		ctx := context.Background()
+		So(Deterministic(ctx), ShouldBeFalse)
+		So(Workers(ctx, 8), ShouldEqual, 8)
+		So(Seed(ctx, 5), ShouldEqual, 5)
+		So(Seed(ctx, 0), ShouldNotEqual, 0)
+
+		seeds := func() []uint64 {
+			ctx := UseDeterministic(ctx)
+			So(Deterministic(ctx), ShouldBeTrue)
+			So(Workers(ctx, 8), ShouldEqual, 1)
+			So(Seed(ctx, 5), ShouldEqual, 5)
+			return []uint64{Seed(ctx, 0), Seed(ctx, 0)}
+		}
+		s := seeds()
+		So(s[0], ShouldNotEqual, s[1])
+		So(s[0], ShouldNotEqual, 0)
+		So(seeds(), ShouldResemble, s)
+
+		var l SeedLog
+		ctx = UseSeedLog(UseDeterministic(ctx), &l)
+		So(Seed(ctx, 5), ShouldEqual, 5)
+		So([]uint64{Seed(ctx, 0), Seed(ctx, 0)}, ShouldResemble, s)
+		So(l.Seeds(), ShouldResemble, s)
+
+		Convey("unseeded sources are logged when not deterministic", func() {
+			c := &config.Source{Seed: 3}
+			ctx := context.Background()
+			So(deterministicSource(ctx, &config.Source{}).Seed, ShouldEqual, 0)
+			var l SeedLog
+			ctx = UseSeedLog(ctx, &l)
+			So(deterministicSource(ctx, c), ShouldEqual, c)
+			seeded := deterministicSource(ctx, &config.Source{})
+			So(seeded.Seed, ShouldNotEqual, 0)
+			So(l.Seeds(), ShouldResemble, []uint64{uint64(seeded.Seed)})
+		})
+	})
+
+	Convey("OutputPath works", t, func() {
+		ctx := context.Background()
+		So(OutputPath(ctx, "a.csv"), ShouldEqual, "a.csv")
+		ctx = UseOutputDir(ctx, filepath.Join("out", "run1"))
+		So(OutputPath(ctx, "a.csv"), ShouldEqual, filepath.Join("out", "run1", "a.csv"))
+		So(OutputPath(ctx, "/tmp/a.csv"), ShouldEqual, "/tmp/a.csv")
+		So(OutputPath(ctx, "-"), ShouldEqual, "-")
+		So(OutputPath(ctx, ""), ShouldEqual, "")
+	})
+
 	Convey("Experiments API works", t, func() {
 		ctx := context.Background()
 		canvas := plot.NewCanvas()
@@ -71,6 +227,96 @@ func TestExperiments(t *testing.T) {
 		eg, err := plot.EnsureGraph(ctx, plot.KindXY, "errors", "top")
 		So(err, ShouldBeNil)
 
+		Convey("bucket rules for incremental histograms", func() {
+			var c config.DistributionPlot
+			So(c.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 5, "auto bounds": true},
+  "bucket rule": "quantile",
+  "bucket quantile": 0.1
+}`)), ShouldBeNil)
+			h := stats.NewHistogram(&c.Buckets)
+			h.Add(1, 2, 3)
+			err := PlotDistribution(ctx, stats.NewHistogramDistribution(h), &c, "", "test")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "bucket rule")
+
+			sample := []float64{10, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, -10}
+			fitted, err := FitPlotBuckets(&c, sample)
+			So(err, ShouldBeNil)
+			So(fitted.BucketRule, ShouldEqual, "")
+			So(fitted.Buckets.Auto, ShouldBeFalse)
+			So(fitted.Buckets.Min, ShouldEqual, 0)
+			So(fitted.Buckets.Max, ShouldEqual, 9)
+			So(c.Buckets.Auto, ShouldBeTrue)
+			So(PlotDistribution(ctx, stats.NewHistogramDistribution(
+				stats.NewHistogram(&fitted.Buckets)), fitted, "", "test"), ShouldBeNil)
+
+			_, err = FitPlotBuckets(&c, []float64{1})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("instance values record only their own context", func() {
+			tv := make(TypedValues)
+			iv := make(TypedValues)
+			ctx := UseTypedValues(ctx, tv)
+			So(AddTypedValue(ctx, "", "a", IntValue(1)), ShouldBeNil)
+			ictx := UseInstanceValues(ctx, iv)
+			So(AddTypedValue(ictx, "", "a", IntValue(1)), ShouldBeNil)
+			So(AddTypedValue(ictx, "", "b", IntValue(2)), ShouldBeNil)
+			So(tv, ShouldResemble, TypedValues{"a": IntValue(1), "b": IntValue(2)})
+			So(iv, ShouldResemble, TypedValues{"a": IntValue(1), "b": IntValue(2)})
+		})
+
+		Convey("typed values work", func() {
+			tv := make(TypedValues)
+			ctx := UseTypedValues(ctx, tv)
+			So(AddTypedValue(ctx, "x", "count", IntValue(3)), ShouldBeNil)
+			So(AddTypedValue(ctx, "x", "mean",
+				FloatValue(0.123456).WithUnit("%")), ShouldBeNil)
+			So(AddValue(ctx, "x", "name", "foo"), ShouldBeNil)
+
+			So(values, ShouldResemble, Values{
+				"x count": "3",
+				"x mean":  "0.1235 %",
+				"x name":  "foo",
+			})
+			So(tv["x mean"], ShouldResemble, Value{
+				Kind: FloatKind, Float: 0.123456, Unit: "%"})
+
+			var buf bytes.Buffer
+			So(WriteValuesCSV(&buf, tv), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `Name,Kind,Value,Unit
+x count,int,3,
+x mean,float,0.123456,%
+x name,string,foo,
+`)
+			buf.Reset()
+			So(WriteValuesJSON(&buf, TypedValues{
+				"a": IntValue(0), "b": FloatValue(math.Inf(1))}), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `{
+  "a": {
+    "kind": "int",
+    "value": 0
+  },
+  "b": {
+    "kind": "float",
+    "value": "+Inf"
+  }
+}
+`)
+			tv2, err := ReadValuesJSON(&buf)
+			So(err, ShouldBeNil)
+			So(tv2["a"], ShouldResemble, IntValue(0))
+			So(math.IsInf(tv2["b"].Float, 1), ShouldBeTrue)
+
+			So(AddInterval(ctx, "x", "m", 1, 0.5, 2), ShouldBeNil)
+			So(tv["x m"], ShouldResemble, FloatValue(1))
+			So(tv["x m low"], ShouldResemble, FloatValue(0.5))
+			So(tv["x m high"], ShouldResemble, FloatValue(2))
+		})
+
 		Convey("AnalyticalDistribution works", func() {
 			var cfg config.AnalyticalDistribution
 
@@ -100,6 +346,75 @@ func TestExperiments(t *testing.T) {
 				So(name, ShouldEqual, "T(a=2.00)")
 				So(d.Mean(), ShouldEqual, 1.0)
 			})
+
+			Convey("exponential distribution", func() {
+				js := testutil.JSON(`
+{
+  "name": "exponential",
+  "mean": 2.0
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				d, name, err := AnalyticalDistribution(ctx, &cfg)
+				So(err, ShouldBeNil)
+				So(name, ShouldEqual, "Exp")
+				So(d.Mean(), ShouldEqual, 2.0)
+				So(testutil.Round(d.MAD(), 4), ShouldEqual, 1.472)
+				So(testutil.Round(d.Prob(0), 4), ShouldEqual, 0.5)
+			})
+
+			Convey("stable distribution", func() {
+				js := testutil.JSON(`
+{
+  "name": "stable",
+  "mean": 1.0,
+  "MAD": 2.0,
+  "alpha": 1.5
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				d, name, err := AnalyticalDistribution(ctx, &cfg)
+				So(err, ShouldBeNil)
+				So(name, ShouldEqual, "Stable(a=1.50)")
+				So(d.Mean(), ShouldEqual, 1.0)
+				So(testutil.Round(d.MAD(), 6), ShouldEqual, 2.0)
+				So(math.IsInf(d.Variance(), 1), ShouldBeTrue)
+
+				s := d.(*Stable)
+				c := 2.0 / stableMAD(1.5)
+				So(testutil.Round(d.Prob(1), 6), ShouldEqual,
+					testutil.Round(math.Gamma(1+1/1.5)/math.Pi/c, 6))
+				So(d.CDF(1), ShouldEqual, 0.5)
+				for _, x := range []float64{0.5, 2, 5, 50} {
+					So(testutil.Round(d.CDF(1-x)+d.CDF(1+x), 6), ShouldEqual, 1.0)
+					So(testutil.Round(d.Quantile(d.CDF(1+x)), 6), ShouldEqual, 1+x)
+				}
+				// The tail asymptote: alpha*c^alpha*Gamma(alpha)*sin(pi*alpha/2)/pi
+				// * |x|^-(alpha+1).
+				tail := 1.5 * math.Pow(c, 1.5) * math.Gamma(1.5) *
+					math.Sin(math.Pi*0.75) / math.Pi * math.Pow(1000, -2.5)
+				So(testutil.Round(d.Prob(1001)/tail, 2), ShouldEqual, 1.0)
+
+				s.Seed(42)
+				var sum float64
+				n := 20000
+				for i := 0; i < n; i++ {
+					sum += math.Abs(d.Rand() - 1)
+				}
+				So(testutil.Round(sum/float64(n), 1), ShouldEqual, 2.0)
+
+				Convey("with alpha = 2 is normal", func() {
+					d := NewStableDistribution(2, 1, 2)
+					n := stats.NewNormalDistribution(1, 2)
+					for _, x := range []float64{-3, 0.5, 1, 2.5, 6} {
+						So(testutil.Round(d.Prob(x), 6), ShouldEqual, testutil.Round(n.Prob(x), 6))
+						So(testutil.Round(d.CDF(x), 6), ShouldEqual, testutil.Round(n.CDF(x), 6))
+					}
+				})
+
+				Convey("requires alpha in (1..2]", func() {
+					So(cfg.InitMessage(testutil.JSON(`{"name": "stable", "alpha": 2.5}`)), ShouldNotBeNil)
+					So(cfg.InitMessage(testutil.JSON(`{"name": "stable", "alpha": 1}`)), ShouldNotBeNil)
+				})
+			})
 		})
 
 		Convey("CompoundDistribution works", func() {
@@ -182,6 +497,101 @@ func TestExperiments(t *testing.T) {
 				So(name, ShouldEqual, "Gauss x 10")
 			})
 
+			Convey("Exact compounded normal distribution", func() {
+				js := testutil.JSON(`
+{
+  "analytical source": {
+    "name": "normal",
+    "mean": 1.0
+  },
+  "n": 4,
+  "compound type": "exact",
+  "parameters": {
+    "buckets": {"n": 11, "min": -6, "max": 14}
+  }
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				d, name, err := CompoundDistribution(ctx, &cfg)
+				So(err, ShouldBeNil)
+				So(name, ShouldEqual, "Gauss x 4")
+				So(d.Mean(), ShouldEqual, 4.0)
+				So(testutil.Round(d.MAD(), 6), ShouldEqual, 2.0)
+				dh, ok := d.(stats.DistributionWithHistogram)
+				So(ok, ShouldBeTrue)
+				h := dh.Histogram()
+				So(testutil.Round(h.WeightsTotal(), 3), ShouldEqual, 1.0)
+				So(testutil.Round(h.Mean(), 3), ShouldEqual, 4.0)
+			})
+
+			Convey("FFT compounded normal distribution", func() {
+				js := testutil.JSON(`
+{
+  "analytical source": {
+    "name": "normal",
+    "mean": 1.0
+  },
+  "n": 4,
+  "compound type": "fft",
+  "FFT grid": 1024,
+  "parameters": {
+    "buckets": {"n": 41, "min": -6, "max": 14}
+  }
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				d, name, err := CompoundDistribution(ctx, &cfg)
+				So(err, ShouldBeNil)
+				So(name, ShouldEqual, "Gauss x 4")
+				So(testutil.Round(d.Mean(), 3), ShouldEqual, 4.0)
+				So(testutil.Round(d.MAD(), 2), ShouldEqual, 2.0)
+			})
+
+			Convey("Exact compounded stable distribution matches direct sampling", func() {
+				conf := func(compType string) *config.CompoundDistribution {
+					var cfg config.CompoundDistribution
+					So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "analytical source": {"name": "stable", "alpha": 1.5, "mean": 0.5},
+  "n": 4,
+  "compound type": "%s",
+  "parameters": {
+    "buckets": {"n": 21, "min": -15, "max": 19},
+    "samples": 20000,
+    "workers": 1,
+    "seed": 42
+  }
+}`, compType))), ShouldBeNil)
+					return &cfg
+				}
+				exact, name, err := CompoundDistribution(ctx, conf("exact"))
+				So(err, ShouldBeNil)
+				So(name, ShouldEqual, "Stable(a=1.50) x 4")
+				So(exact.Mean(), ShouldEqual, 2.0)
+				So(testutil.Round(exact.MAD(), 6), ShouldEqual,
+					testutil.Round(math.Pow(4, 1/1.5), 6))
+
+				d, _, err := CompoundDistribution(ctx, conf("direct"))
+				So(err, ShouldBeNil)
+				direct, ok := d.(stats.DistributionWithHistogram)
+				So(ok, ShouldBeTrue)
+				So(KSDistance(direct.Histogram(), exact), ShouldBeLessThan, 0.01)
+				exactH := exact.(stats.DistributionWithHistogram).Histogram()
+				for i, p := range exactH.PDFs() {
+					So(direct.Histogram().PDFs()[i], ShouldAlmostEqual, p, 0.01)
+				}
+			})
+
+			Convey("Exact compounding requires a normal or stable source", func() {
+				js := testutil.JSON(`
+{
+  "analytical source": {"name": "t"},
+  "n": 4,
+  "compound type": "exact"
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				_, _, err := CompoundDistribution(ctx, &cfg)
+				So(err, ShouldNotBeNil)
+			})
+
 			Convey("Double compounded distribution", func() {
 				js := testutil.JSON(`
 {
@@ -228,6 +638,59 @@ func TestExperiments(t *testing.T) {
 				So(testutil.Round(d.Mean(), 1), ShouldEqual, 10.0)
 				So(name, ShouldEqual, "Gauss x 2 x 5")
 			})
+
+			Convey("Histogram file", func() {
+				tmpdir, tmpdirErr := os.MkdirTemp("", "test_histogram_file")
+				defer os.RemoveAll(tmpdir)
+				So(tmpdirErr, ShouldBeNil)
+
+				Convey("JSON", func() {
+					fileName := filepath.Join(tmpdir, "hist.json")
+					So(os.WriteFile(fileName, []byte(`
+{
+  "buckets": {"n": 3, "min": -3, "max": 3},
+  "counts": [1, 2, 1]
+}`), 0644), ShouldBeNil)
+					So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "histogram file": "%s",
+  "n": 10,
+  "compound type": "fast",
+  "parameters": {
+    "samples": 1000,
+    "workers": 1
+  }
+}`, fileName))), ShouldBeNil)
+					d, name, err := CompoundDistribution(ctx, &cfg)
+					So(err, ShouldBeNil)
+					So(name, ShouldEqual, "Hist(hist.json) x 10")
+					d.Seed(seed)
+					So(math.Abs(d.Mean()), ShouldBeLessThan, 0.5)
+				})
+
+				Convey("CSV", func() {
+					fileName := filepath.Join(tmpdir, "hist.csv")
+					So(os.WriteFile(fileName, []byte("value,count\n-1,1\n1,3\n"), 0644),
+						ShouldBeNil)
+					So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "histogram file": "%s",
+  "parameters": {"buckets": {"n": 2, "min": -2, "max": 2}}
+}`, fileName))), ShouldBeNil)
+					d, name, err := CompoundDistribution(ctx, &cfg)
+					So(err, ShouldBeNil)
+					So(name, ShouldEqual, "Hist(hist.csv)")
+					So(d.Mean(), ShouldEqual, 0.5)
+				})
+
+				Convey("requires exactly one source", func() {
+					So(cfg.InitMessage(testutil.JSON(`
+{
+  "histogram file": "hist.json",
+  "analytical source": {"name": "normal"}
+}`)), ShouldNotBeNil)
+				})
+			})
 		})
 
 		Convey("Source works", func() {
@@ -266,56 +729,375 @@ func TestExperiments(t *testing.T) {
 				So(lps[1].Timeseries.Dates()[0], ShouldResemble, d("2020-01-03"))
 			})
 
-			Convey("using synthetic intraday", func() {
+			Convey("canceled midway stops generating tickers", func() {
 				var cfg config.Source
-				// Keep the number of intraday samples small for efficiency.
 				js := testutil.JSON(`
 {
   "daily distribution": {"name": "t"},
-  "intraday distribution": {"name": "t"},
+  "tickers": 100,
+  "days": 11,
+  "batch size": 10
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				ctx, cancel := context.WithCancel(iterator.TestSerialize(ctx))
+				defer cancel()
+				f := func(lps []LogProfits) int {
+					cancel() // after the first batch
+					return len(lps)
+				}
+				it, err := SourceMap(ctx, &cfg, f)
+				So(err, ShouldBeNil)
+				var tickers int
+				for n, ok := it.Next(); ok; n, ok = it.Next() {
+					tickers += n
+				}
+				it.Close()
+				So(tickers, ShouldBeGreaterThan, 0)
+				So(tickers, ShouldBeLessThan, 100)
+			})
+
+			Convey("using seeded synthetic daily", func() {
+				var cfg config.Source
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "t"},
+  "tickers": 3,
+  "days": 11,
+  "seed": 42
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+
+				generate := func() []LogProfits {
+					it, err := Source(ctx, &cfg)
+					So(err, ShouldBeNil)
+					defer it.Close()
+					return iterator.ToSlice[LogProfits](it)
+				}
+				lps := generate()
+				So(len(lps), ShouldEqual, 3)
+				So(generate(), ShouldResemble, lps)
+				So(lps[1].Timeseries.Data(), ShouldNotResemble, lps[0].Timeseries.Data())
+			})
+
+			Convey("using adaptive synthetic daily", func() {
+				var cfg config.Source
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "t"},
+  "tickers": 25,
+  "days": 11,
+  "batch size": 2,
+  "seed": 42,
+  "adaptive": {"batch seconds": 0.01, "max batch size": 7, "max memory MB": 1e6}
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+
+				it, err := Source(ctx, &cfg)
+				So(err, ShouldBeNil)
+				lps := iterator.ToSlice[LogProfits](it)
+				it.Close()
+				So(len(lps), ShouldEqual, 25)
+				for _, lp := range lps {
+					So(len(lp.Timeseries.Data()), ShouldEqual, 10)
+				}
+			})
+
+			Convey("using unseeded synthetic daily in deterministic mode", func() {
+				var cfg config.Source
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "t"},
+  "intraday distribution": {"name": "normal"},
   "intraday resolution": 30,
-  "intraday range": {"start": "12:00", "end": "13:00"},
-  "tickers": 2,
+  "jump": {"distribution": {"name": "normal"}, "rate": 0.1},
+  "tickers": 3,
+  "days": 5,
+  "batch size": 1
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+
+				generate := func() []LogProfits {
+					ctx := UseDeterministic(ctx)
+					it, err := Source(ctx, &cfg)
+					So(err, ShouldBeNil)
+					defer it.Close()
+					return iterator.ToSlice[LogProfits](it)
+				}
+				lps := generate()
+				So(len(lps), ShouldEqual, 3)
+				So(generate(), ShouldResemble, lps)
+				So(cfg.Seed, ShouldEqual, 0) // the config is not modified
+			})
+
+			Convey("using synthetic daily with jumps", func() {
+				var cfg config.Source
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "normal", "MAD": 0.001},
+  "jump": {
+    "rate": 0.5,
+    "distribution": {"name": "normal", "mean": -1, "MAD": 0.001}
+  },
+  "days": 1001,
+  "seed": 42
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+
+				it, err := Source(ctx, &cfg)
+				So(err, ShouldBeNil)
+				lps := iterator.ToSlice[LogProfits](it)
+				it.Close()
+				So(len(lps), ShouldEqual, 1)
+				var jumpDays int
+				for _, x := range lps[0].Timeseries.Data() {
+					if x < -0.5 {
+						jumpDays++
+					}
+				}
+				// Expected: 1000*(1-exp(-0.5)) = 393.
+				So(jumpDays, ShouldBeBetween, 300, 500)
+			})
+
+			Convey("using synthetic daily resampled weekly", func() {
+				var cfg config.Source
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "t"},
+  "resample": "weekly",
   "days": 11,
-  "batch size": 1,
   "start date": "2020-01-02"
 }`)
 				So(cfg.InitMessage(js), ShouldBeNil)
 
-				Convey("All LogProfits", func() {
+				it, err := Source(ctx, &cfg)
+				So(err, ShouldBeNil)
+				lps := iterator.ToSlice[LogProfits](it)
+				it.Close()
+				So(len(lps), ShouldEqual, 1)
+				So(lps[0].Timeseries.Dates(), ShouldResemble, []db.Date{
+					d("2020-01-03"), d("2020-01-10"), d("2020-01-16")})
+			})
+
+			Convey("using correlated synthetic daily", func() {
+				var cfg config.Source
+				corr := func(js string) float64 {
+					So(cfg.InitMessage(testutil.JSON(js)), ShouldBeNil)
 					it, err := Source(ctx, &cfg)
 					So(err, ShouldBeNil)
 					lps := iterator.ToSlice[LogProfits](it)
 					it.Close()
 					So(len(lps), ShouldEqual, 2)
-					// 2 intraday samples + 1 inter-day per day, minus spurious one at the
-					// start, total = 11*3 - 1 = 32.
-					So(len(lps[0].Timeseries.Data()), ShouldEqual, 32)
-					So(len(lps[1].Timeseries.Data()), ShouldEqual, 32)
-					So(lps[0].Timeseries.Dates()[0], ShouldResemble,
-						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
-					So(lps[1].Timeseries.Dates()[0], ShouldResemble,
-						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
+					return stat.Correlation(
+						lps[0].Timeseries.Data(), lps[1].Timeseries.Data(), nil)
+				}
+
+				Convey("single factor", func() {
+					c := corr(`
+{
+  "daily distribution": {"name": "normal", "mean": 1},
+  "correlation": {"factor": 0.5},
+  "tickers": 2,
+  "days": 5000
+}`)
+					So(c, ShouldAlmostEqual, 0.5, 0.1)
 				})
 
-				Convey("Intraday LogProfits only", func() {
-					c := cfg // local copy
-					c.IntradayOnly = true
-					it, err := Source(ctx, &c)
-					So(err, ShouldBeNil)
-					lps := iterator.ToSlice[LogProfits](it)
-					it.Close()
-					So(len(lps), ShouldEqual, 2)
-					// 2 intraday samples per day.
-					So(len(lps[0].Timeseries.Data()), ShouldEqual, 22)
-					So(len(lps[1].Timeseries.Data()), ShouldEqual, 22)
-					So(lps[0].Timeseries.Dates()[0], ShouldResemble,
-						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
-					So(lps[1].Timeseries.Dates()[0], ShouldResemble,
-						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
+				Convey("full matrix", func() {
+					c := corr(`
+{
+  "daily distribution": {"name": "normal", "mean": 1},
+  "correlation": {"matrix": [[1, -0.8], [-0.8, 1]]},
+  "tickers": 2,
+  "days": 5000
+}`)
+					So(c, ShouldAlmostEqual, -0.8, 0.1)
 				})
 
-				Convey("Intraday 24/7, daily distribution not used", func() {
+				Convey("matrix size mismatch", func() {
+					So(cfg.InitMessage(testutil.JSON(`
+{
+  "daily distribution": {"name": "normal"},
+  "correlation": {"matrix": [[1, 0.5], [0.5, 1]]},
+  "tickers": 3
+}`)), ShouldNotBeNil)
+				})
+			})
+
+			Convey("Resample works", func() {
+				ts := stats.NewTimeseries(
+					[]db.Date{d("2020-01-30"), d("2020-01-31"), d("2020-02-03"), d("2020-02-04")},
+					[]float64{1, 2, 3, 4})
+				So(Resample(ts, "daily"), ShouldResemble, ts)
+				So(Resample(ts, "weekly"), ShouldResemble, stats.NewTimeseries(
+					[]db.Date{d("2020-01-31"), d("2020-02-04")}, []float64{3, 7}))
+				So(Resample(ts, "monthly"), ShouldResemble, stats.NewTimeseries(
+					[]db.Date{d("2020-01-31"), d("2020-02-04")}, []float64{3, 7}))
+				ts = stats.NewTimeseries(
+					[]db.Date{d("2020-01-31"), d("2020-02-03"), d("2020-02-07"), d("2020-02-10")},
+					[]float64{1, 2, 3, 4})
+				So(Resample(ts, "weekly"), ShouldResemble, stats.NewTimeseries(
+					[]db.Date{d("2020-01-31"), d("2020-02-07"), d("2020-02-10")}, []float64{1, 5, 4}))
+				So(Resample(ts, "monthly"), ShouldResemble, stats.NewTimeseries(
+					[]db.Date{d("2020-01-31"), d("2020-02-10")}, []float64{1, 9}))
+			})
+
+			Convey("Winsorize works", func() {
+				dates := []db.Date{
+					d("2020-01-01"), d("2020-01-02"), d("2020-01-03"), d("2020-01-06"),
+					d("2020-01-07")}
+				ts := stats.NewTimeseries(dates, []float64{-10, 1, 2, 3, 20})
+
+				Convey("by quantile", func() {
+					res, clipped := Winsorize(ts, &config.Winsorize{Quantile: 0.25})
+					So(clipped, ShouldEqual, 2)
+					So(res.Dates(), ShouldResemble, dates)
+					So(res.Data(), ShouldResemble, []float64{1, 1, 2, 3, 3})
+				})
+
+				Convey("by MADs", func() {
+					// Mean=3.2, MAD=6.72.
+					res, clipped := Winsorize(ts, &config.Winsorize{MADs: 1})
+					So(clipped, ShouldEqual, 2)
+					So(testutil.RoundSlice(res.Data(), 5), ShouldResemble,
+						[]float64{-3.52, 1, 2, 3, 9.92})
+				})
+
+				Convey("in Source", func() {
+					var cfg config.Source
+					So(cfg.InitMessage(testutil.JSON(`
+{
+  "daily distribution": {"name": "t", "alpha": 2.5, "MAD": 0.01},
+  "winsorize": {"MADs": 3},
+  "days": 1001,
+  "seed": 42
+}`)), ShouldBeNil)
+					it, err := Source(ctx, &cfg)
+					So(err, ShouldBeNil)
+					lps := iterator.ToSlice[LogProfits](it)
+					it.Close()
+					So(len(lps), ShouldEqual, 1)
+					// Fat tails have a few percent of samples beyond 3 MADs.
+					So(lps[0].Clipped, ShouldBeBetween, 5, 100)
+				})
+
+				Convey("config validation", func() {
+					var cfg config.Winsorize
+					So(cfg.InitMessage(testutil.JSON(`{}`)), ShouldNotBeNil)
+					So(cfg.InitMessage(testutil.JSON(`{"quantile": 0.1, "MADs": 3}`)), ShouldNotBeNil)
+					So(cfg.InitMessage(testutil.JSON(`{"quantile": 0.5}`)), ShouldNotBeNil)
+					So(cfg.InitMessage(testutil.JSON(`{"MADs": -1}`)), ShouldNotBeNil)
+				})
+			})
+
+			Convey("BlockBootstrap works", func() {
+				dates := []db.Date{
+					d("2020-01-01"), d("2020-01-02"), d("2020-01-03"), d("2020-01-06")}
+				ts := stats.NewTimeseries(dates, []float64{1, 2, 3, 4})
+				r := rand.New(rand.NewSource(42))
+
+				Convey("i.i.d.", func() {
+					res := BlockBootstrap(ts, 1, r)
+					So(res.Dates(), ShouldResemble, dates)
+					for _, x := range res.Data() {
+						So(x, ShouldBeIn, []float64{1, 2, 3, 4})
+					}
+				})
+
+				Convey("full length blocks are rotations", func() {
+					res := BlockBootstrap(ts, 4, r)
+					data := res.Data()
+					So(len(data), ShouldEqual, 4)
+					for i := 1; i < 4; i++ {
+						So(data[i], ShouldEqual, float64(int(data[i-1])%4+1))
+					}
+				})
+			})
+
+			Convey("using synthetic intraday with a profile", func() {
+				var cfg config.Source
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "normal"},
+  "intraday distribution": {"name": "normal", "MAD": 0.01},
+  "intraday resolution": 30,
+  "intraday range": {"start": "12:00", "end": "13:00"},
+  "intraday profile": [
+    {"range": {"start": "12:30", "end": "12:30"}, "scale": 10}
+  ],
+  "intraday only": true,
+  "days": 100,
+  "seed": 42
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+				it, err := Source(ctx, &cfg)
+				So(err, ShouldBeNil)
+				lps := iterator.ToSlice[LogProfits](it)
+				it.Close()
+				So(len(lps), ShouldEqual, 1)
+				var scaled, unscaled []float64
+				for i, x := range lps[0].Timeseries.Data() {
+					if lps[0].Timeseries.Dates()[i].Hour() == 12 {
+						scaled = append(scaled, x)
+					} else {
+						unscaled = append(unscaled, x)
+					}
+				}
+				So(len(scaled), ShouldEqual, 100)
+				So(len(unscaled), ShouldEqual, 100)
+				So(stats.NewSample(scaled).MAD(), ShouldBeGreaterThan, 0.05)
+				So(stats.NewSample(unscaled).MAD(), ShouldBeLessThan, 0.02)
+			})
+
+			Convey("using synthetic intraday", func() {
+				var cfg config.Source
+				// Keep the number of intraday samples small for efficiency.
+				js := testutil.JSON(`
+{
+  "daily distribution": {"name": "t"},
+  "intraday distribution": {"name": "t"},
+  "intraday resolution": 30,
+  "intraday range": {"start": "12:00", "end": "13:00"},
+  "tickers": 2,
+  "days": 11,
+  "batch size": 1,
+  "start date": "2020-01-02"
+}`)
+				So(cfg.InitMessage(js), ShouldBeNil)
+
+				Convey("All LogProfits", func() {
+					it, err := Source(ctx, &cfg)
+					So(err, ShouldBeNil)
+					lps := iterator.ToSlice[LogProfits](it)
+					it.Close()
+					So(len(lps), ShouldEqual, 2)
+					// 2 intraday samples + 1 inter-day per day, minus spurious one at the
+					// start, total = 11*3 - 1 = 32.
+					So(len(lps[0].Timeseries.Data()), ShouldEqual, 32)
+					So(len(lps[1].Timeseries.Data()), ShouldEqual, 32)
+					So(lps[0].Timeseries.Dates()[0], ShouldResemble,
+						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
+					So(lps[1].Timeseries.Dates()[0], ShouldResemble,
+						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
+				})
+
+				Convey("Intraday LogProfits only", func() {
+					c := cfg // local copy
+					c.IntradayOnly = true
+					it, err := Source(ctx, &c)
+					So(err, ShouldBeNil)
+					lps := iterator.ToSlice[LogProfits](it)
+					it.Close()
+					So(len(lps), ShouldEqual, 2)
+					// 2 intraday samples per day.
+					So(len(lps[0].Timeseries.Data()), ShouldEqual, 22)
+					So(len(lps[1].Timeseries.Data()), ShouldEqual, 22)
+					So(lps[0].Timeseries.Dates()[0], ShouldResemble,
+						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
+					So(lps[1].Timeseries.Dates()[0], ShouldResemble,
+						db.NewDatetime(2020, 1, 2, 12, 30, 0, 0))
+				})
+
+				Convey("Intraday 24/7, daily distribution not used", func() {
 					c := cfg // local copy
 					c.DailyDist = nil
 					// DailyDist required with non-trival intraday range.
@@ -352,6 +1134,141 @@ func TestExperiments(t *testing.T) {
 					So(len(ps[1].Rows), ShouldEqual, 11)
 					So(ps[0].Rows[0].Date, ShouldResemble, d("2020-01-02"))
 					So(ps[1].Rows[0].Date, ShouldResemble, d("2020-01-02"))
+					So(ps[0].Rows[0].CashVolume, ShouldEqual, 1000)
+				})
+
+				Convey("OHLC prices with volume", func() {
+					c := cfg // local copy
+					So(c.InitMessage(testutil.JSON(`
+{
+  "daily distribution": {"name": "normal", "MAD": 0.01},
+  "intraday distribution": {"name": "normal", "MAD": 0.01},
+  "intraday resolution": 30,
+  "volume": {
+    "distribution": {"name": "normal", "mean": 10, "MAD": 0.0001},
+    "factor": 100
+  },
+  "days": 11,
+  "seed": 42
+}`)), ShouldBeNil)
+					it, err := SourceMapPrices(ctx, &c, func(ps []Prices) []Prices { return ps })
+					So(err, ShouldBeNil)
+					ps := iterator.ToSlice[[]Prices](it)
+					it.Close()
+					So(len(ps), ShouldEqual, 1)
+					rows := ps[0][0].Rows
+					So(len(rows), ShouldEqual, 11)
+					for i := 1; i < len(rows); i++ {
+						lp := math.Abs(math.Log(float64(rows[i].Close / rows[i-1].Close)))
+						v := math.Log(float64(rows[i].CashVolume))
+						So(v, ShouldAlmostEqual, 10+100*lp, 0.01)
+					}
+				})
+			})
+
+			Convey("using DB with price adjustments", func() {
+				tmpdir, tmpdirErr := os.MkdirTemp("", "test_source_adj")
+				defer os.RemoveAll(tmpdir)
+				So(tmpdirErr, ShouldBeNil)
+
+				dbName := "db"
+				tickers := map[string]db.TickerRow{"A": {}}
+				pr := func(date string, c, split, full float32) db.PriceRow {
+					return db.TestPrice(d(date), c, split, full, 1000.0, true)
+				}
+				// 2:1 split on the second day, and a dividend on the third.
+				prices := map[string][]db.PriceRow{"A": {
+					pr("2020-01-01", 100, 50, 40),
+					pr("2020-01-02", 50, 50, 40),
+					pr("2020-01-03", 50, 50, 44),
+				}}
+				w := db.NewWriter(tmpdir, dbName)
+				So(w.WriteTickers(tickers), ShouldBeNil)
+				for t, p := range prices {
+					So(w.WritePrices(t, p), ShouldBeNil)
+				}
+				data := func(extra string) []float64 {
+					var cfg config.Source
+					So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "DB": {"DB path": "%s", "DB": "%s"}%s
+}`, tmpdir, dbName, extra))), ShouldBeNil)
+					it, err := Source(ctx, &cfg)
+					So(err, ShouldBeNil)
+					defer it.Close()
+					lps := iterator.ToSlice[LogProfits](it)
+					So(len(lps), ShouldEqual, 1)
+					return testutil.RoundSlice(lps[0].Timeseries.Data(), 4)
+				}
+				So(data(""), ShouldResemble, []float64{0, 0.09531})
+				So(data(`, "price adjustment": "split adjusted"`), ShouldResemble,
+					[]float64{0, 0})
+				So(data(`, "price adjustment": "raw"`), ShouldResemble,
+					[]float64{-0.693, 0})
+				So(data(`, "dividends only": true`), ShouldResemble,
+					[]float64{0, 0.09531})
+			})
+
+			Convey("using DB with intraday bars", func() {
+				tmpdir, tmpdirErr := os.MkdirTemp("", "test_source_intraday")
+				defer os.RemoveAll(tmpdir)
+				So(tmpdirErr, ShouldBeNil)
+
+				dbName := "db"
+				tickers := map[string]db.TickerRow{"A": {}}
+				pr := func(date string, p, v float32) db.PriceRow {
+					return db.TestPrice(d(date), p, p, p, v, true)
+				}
+				prices := map[string][]db.PriceRow{"A": {
+					pr("2020-01-02 09:00:00", 90, 100), // pre-market
+					pr("2020-01-02 09:30:00", 100, 100),
+					pr("2020-01-02 09:35:00", 101, 100),
+					pr("2020-01-02 09:40:00", 102, 100),
+					pr("2020-01-02 09:45:00", 103, 100),
+					pr("2020-01-02 10:00:00", 104, 100),
+					pr("2020-01-03 09:30:00", 105, 100),
+					pr("2020-01-03 16:05:00", 110, 100), // after hours
+				}}
+				w := db.NewWriter(tmpdir, dbName)
+				So(w.WriteTickers(tickers), ShouldBeNil)
+				for t, p := range prices {
+					So(w.WritePrices(t, p), ShouldBeNil)
+				}
+				var cfg config.Source
+				So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "DB": {"DB path": "%s", "DB": "%s"},
+  "intraday resolution": 15
+}`, tmpdir, dbName))), ShouldBeNil)
+
+				Convey("prices", func() {
+					it, err := SourceMapPrices(ctx, &cfg, func(p []Prices) []Prices { return p })
+					So(err, ShouldBeNil)
+					defer it.Close()
+					ps := iterator.ToSlice[[]Prices](it)
+					So(len(ps), ShouldEqual, 1)
+					So(len(ps[0]), ShouldEqual, 1)
+					rows := ps[0][0].Rows
+					So(len(rows), ShouldEqual, 4)
+					So(rows[1].Date, ShouldResemble, d("2020-01-02 09:45:00"))
+					So(rows[1].Open, ShouldEqual, 101)
+					So(rows[1].High, ShouldEqual, 103)
+					So(rows[1].Low, ShouldEqual, 101)
+					So(rows[1].Close, ShouldEqual, 103)
+					So(rows[1].CashVolume, ShouldEqual, 300)
+				})
+
+				Convey("log-profits", func() {
+					it, err := Source(ctx, &cfg)
+					So(err, ShouldBeNil)
+					defer it.Close()
+					lps := iterator.ToSlice[LogProfits](it)
+					So(len(lps), ShouldEqual, 1)
+					So(lps[0].Timeseries.Dates(), ShouldResemble, []db.Date{
+						d("2020-01-02 09:45:00"),
+						d("2020-01-02 10:00:00"),
+						d("2020-01-03 09:30:00"),
+					})
 				})
 			})
 
@@ -474,6 +1391,480 @@ func TestExperiments(t *testing.T) {
 			So(len(eg.Plots), ShouldEqual, 1)
 			So(eg.Plots[0].Legend, ShouldEqual, "test errors")
 			So(cg.Plots[0].YLabel, ShouldEqual, "counts")
+
+			Convey("with histogram file", func() {
+				tmpdir, tmpdirErr := os.MkdirTemp("", "test_plot_histogram")
+				defer os.RemoveAll(tmpdir)
+				So(tmpdirErr, ShouldBeNil)
+				fileName := filepath.Join(tmpdir, "hist.json")
+				cfg.HistogramFile = fileName
+				So(PlotDistribution(ctx, d, &cfg, "", "test"), ShouldBeNil)
+
+				h, err := ReadHistogram(fileName, nil)
+				So(err, ShouldBeNil)
+				So(h.Buckets().SameAs(&cfg.Buckets), ShouldBeTrue)
+				So(h.Weights(), ShouldResemble, d.Histogram().Weights())
+
+				var src config.Source
+				So(src.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "daily histogram file": "%s",
+  "days": 11,
+  "seed": 42
+}`, fileName))), ShouldBeNil)
+				it, err := Source(ctx, &src)
+				So(err, ShouldBeNil)
+				lps := iterator.ToSlice[LogProfits](it)
+				it.Close()
+				So(len(lps), ShouldEqual, 1)
+				So(len(lps[0].Timeseries.Data()), ShouldEqual, 10)
+				for _, x := range lps[0].Timeseries.Data() {
+					So(math.Abs(x), ShouldBeLessThanOrEqualTo, 5)
+				}
+			})
+
+			Convey("with summary table", func() {
+				tables := make(SummaryTables)
+				ctx := UseSummaryTables(ctx, tables)
+				cfg.SummaryCSV = "summary.csv"
+				So(PlotDistribution(ctx, d, &cfg, "pre", "test"), ShouldBeNil)
+				So(PlotDistribution(ctx, d, &cfg, "pre", "test2"), ShouldBeNil)
+				So(len(tables), ShouldEqual, 1)
+				t := tables["summary.csv"]
+				So(t, ShouldNotBeNil)
+				So(len(t.Rows), ShouldEqual, 2)
+
+				r := Summary(d, &cfg, "test")
+				So(r.N, ShouldEqual, 4)
+				So(r.Mean, ShouldEqual, 0)
+				So(testutil.Round(r.MAD, 5), ShouldEqual, 1.25)
+				So(r.Skew, ShouldEqual, 0)
+				So(testutil.Round(r.Kurtosis, 5), ShouldEqual, 1.5) // sample-corrected
+				So(r.HasAlpha, ShouldBeTrue)
+				So(r.CSV()[0], ShouldEqual, "test")
+				So(r.CSV()[1], ShouldEqual, "4")
+				So(len(r.CSV()), ShouldEqual, len(SummaryHeader()))
+			})
+		})
+
+		Convey("Reservoir works", func() {
+			r := NewReservoir(3)
+			So(r.Len(), ShouldEqual, 0)
+			for i, k := range []uint64{5, 1, 7, 3, 9} {
+				r.Add(float64(i), 1, k)
+			}
+			r2 := NewReservoir(3)
+			r2.Add(10, 2, 2)
+			r2.Add(11, 2, 8)
+			r.Merge(r2)
+			So(r.Len(), ShouldEqual, 3)
+			xs, ws := r.Data()
+			sort.Float64s(xs)
+			// The values with the smallest keys 1, 2 and 3.
+			So(xs, ShouldResemble, []float64{1, 3, 10})
+			So(len(ws), ShouldEqual, 3)
+		})
+
+		Convey("Student's T MLE fit works", func() {
+			d := stats.NewStudentsTDistribution(3, 0.1, 2)
+			d.Seed(42)
+			var xs, ws []float64
+			for i := 0; i < 10000; i++ {
+				xs = append(xs, d.Rand())
+				ws = append(ws, 1)
+			}
+			var c config.DeriveAlpha
+			So(c.InitMessage(testutil.JSON(`{"min x": 1.5, "max x": 50, "fit method": "mle"}`)), ShouldBeNil)
+			fit, err := FitStudentsT(xs, ws, &c)
+			So(err, ShouldBeNil)
+			So(fit.Alpha, ShouldAlmostEqual, 3, 0.3)
+			So(fit.Mean, ShouldAlmostEqual, 0.1, 0.05)
+			So(fit.MAD, ShouldAlmostEqual, 2, 0.1)
+			So(fit.AlphaErr, ShouldBeBetween, 0, 0.3)
+			So(fit.MeanErr, ShouldBeBetween, 0, 0.05)
+			So(fit.MADErr, ShouldBeBetween, 0, 0.1)
+
+			_, err = FitStudentsT([]float64{1, 1, 1}, []float64{1, 1, 1}, &c)
+			So(err, ShouldNotBeNil)
+
+			Convey("standard errors are for the number of samples", func() {
+				ws5 := make([]float64, len(ws))
+				for i := range ws5 {
+					ws5[i] = 5
+				}
+				fit5, err := FitWeightedStudentsT(xs, ws5, float64(len(xs)), &c)
+				So(err, ShouldBeNil)
+				So(fit5.Alpha, ShouldAlmostEqual, fit.Alpha, 1e-3)
+				So(fit5.AlphaErr, ShouldAlmostEqual, fit.AlphaErr, 1e-3)
+				So(fit5.MADErr, ShouldAlmostEqual, fit.MADErr, 1e-3)
+			})
+
+			Convey("raw samples are fitted when available", func() {
+				buckets, err := stats.NewBuckets(3, -1, 1, stats.LinearSpacing)
+				So(err, ShouldBeNil)
+				sorted := append([]float64{}, xs...)
+				dh := stats.NewSampleDistribution(sorted, buckets)
+				fxs, fws, n := fitSamples(dh)
+				So(fxs, ShouldResemble, sorted)
+				So(fws, ShouldResemble, ws)
+				So(n, ShouldEqual, 10000)
+				So(deriveAlpha(dh, 0, 0, &c), ShouldAlmostEqual, fit.Alpha, 1e-3)
+			})
+
+			Convey("the retained sample of a histogram is fitted", func() {
+				buckets, err := stats.NewBuckets(3, -1, 1, stats.LinearSpacing)
+				So(err, ShouldBeNil)
+				h := stats.NewHistogram(buckets)
+				r := NewReservoir(len(xs))
+				for i, x := range xs {
+					h.Add(x)
+					r.Add(x, 1, uint64(i))
+				}
+				dh := NewSampledHistogram(h, r)
+				fxs, fws, n := fitSamples(dh)
+				So(len(fxs), ShouldEqual, len(xs))
+				So(len(fws), ShouldEqual, len(xs))
+				So(n, ShouldEqual, 10000)
+				So(deriveAlpha(dh, 0, 0, &c), ShouldAlmostEqual, fit.Alpha, 1e-3)
+			})
+		})
+
+		Convey("separate tails work", func() {
+			// Fatter left tail: t(2.5) below the mean, t(8) above.
+			dl := stats.NewStudentsTDistribution(2.5, 0, 1)
+			dl.Seed(42)
+			dr := stats.NewStudentsTDistribution(8, 0, 1)
+			dr.Seed(43)
+			buckets, err := stats.NewBuckets(201, -20, 20, stats.LinearSpacing)
+			So(err, ShouldBeNil)
+			h := stats.NewHistogram(buckets)
+			for i := 0; i < 20000; i++ {
+				h.Add(-math.Abs(dl.Rand()), math.Abs(dr.Rand()))
+			}
+			var c config.DeriveAlpha
+			So(c.InitMessage(testutil.JSON(`
+{"min x": 1.5, "max x": 50, "separate tails": true}`)), ShouldBeNil)
+
+			Convey("TailAlphas with distance", func() {
+				left, right := TailAlphas(stats.NewHistogramDistribution(h), 0, h.MAD(), &c)
+				So(left, ShouldBeLessThan, right)
+			})
+
+			Convey("TailAlphas with mle", func() {
+				c.FitMethod = "mle"
+				left, right := TailAlphas(stats.NewHistogramDistribution(h), 0, h.MAD(), &c)
+				So(left, ShouldAlmostEqual, 2.5, 0.5)
+				So(right, ShouldBeGreaterThan, 5)
+			})
+
+			Convey("in PlotDistribution", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 201, "min": -20, "max": 20},
+  "reference distribution": {"analytical source": {"name": "t"}},
+  "adjust reference distribution": true,
+  "derive alpha": {"min x": 1.5, "max x": 50, "separate tails": true}
+}`)), ShouldBeNil)
+				dh := stats.NewHistogramDistribution(h)
+				So(PlotDistribution(ctx, dh, &cfg, "pre", "t"), ShouldBeNil)
+				So(values, ShouldContainKey, "pre t left alpha")
+				So(values, ShouldContainKey, "pre t right alpha")
+				// Sample p.d.f., the left and the right tails, then the reference.
+				So(len(g.Plots), ShouldEqual, 4)
+				So(g.Plots[1].Legend, ShouldStartWith, "pre t ref left:t(a=")
+				So(g.Plots[2].Legend, ShouldStartWith, "pre t ref right:t(a=")
+			})
+		})
+
+		Convey("alpha scan works", func() {
+			d := stats.NewStudentsTDistribution(3, 0, 1)
+			d.Seed(42)
+			buckets, err := stats.NewBuckets(101, -10, 10, stats.LinearSpacing)
+			So(err, ShouldBeNil)
+			h := stats.NewHistogram(buckets)
+			for i := 0; i < 20000; i++ {
+				h.Add(d.Rand())
+			}
+			argBest := func(alphas, ys []float64, less func(a, b float64) bool) float64 {
+				best := 0
+				for i := range ys {
+					if less(ys[i], ys[best]) {
+						best = i
+					}
+				}
+				return alphas[best]
+			}
+			var c config.DeriveAlpha
+			So(c.InitMessage(testutil.JSON(`
+{"min x": 1.5, "max x": 10, "scan graph": "scan", "scan points": 18}`)), ShouldBeNil)
+
+			Convey("distance", func() {
+				alphas, ys := AlphaScan(stats.NewHistogramDistribution(h), 0, 1, &c)
+				So(len(alphas), ShouldEqual, 18)
+				So(alphas[0], ShouldEqual, 1.5)
+				So(alphas[17], ShouldEqual, 10)
+				lt := func(a, b float64) bool { return a < b }
+				So(argBest(alphas, ys, lt), ShouldAlmostEqual, 3, 0.6)
+			})
+
+			Convey("mle", func() {
+				c.FitMethod = "mle"
+				alphas, ys := AlphaScan(stats.NewHistogramDistribution(h), 0, 1, &c)
+				gt := func(a, b float64) bool { return a > b }
+				So(argBest(alphas, ys, gt), ShouldAlmostEqual, 3, 0.6)
+			})
+
+			Convey("in PlotDistribution", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 101, "min": -10, "max": 10},
+  "reference distribution": {"analytical source": {"name": "t"}},
+  "adjust reference distribution": true,
+  "derive alpha": {"min x": 1.5, "max x": 10, "scan graph": "scan"}
+}`)), ShouldBeNil)
+				scan, err := plot.EnsureGraph(ctx, plot.KindXY, "scan", "top")
+				So(err, ShouldBeNil)
+				dh := stats.NewHistogramDistribution(h)
+				So(PlotDistribution(ctx, dh, &cfg, "pre", "t"), ShouldBeNil)
+				So(len(scan.Plots), ShouldEqual, 1)
+				So(scan.Plots[0].Legend, ShouldEqual, "pre t distance")
+				So(len(scan.Plots[0].X), ShouldEqual, 100)
+
+				So(cfg.InitMessage(testutil.JSON(`
+{"graph": "main", "derive alpha": {"min x": 1.5, "max x": 10, "scan points": 1}}`)), ShouldNotBeNil)
+			})
+		})
+
+		Convey("GPD fit works", func() {
+			Convey("FitGPD", func() {
+				g := GPD{Shape: 0.3, Scale: 2}
+				r := rand.New(rand.NewSource(42))
+				var ys, ws []float64
+				for i := 0; i < 20000; i++ {
+					// Inverse of the survival function.
+					u := r.Float64()
+					ys = append(ys, g.Scale/g.Shape*(math.Pow(u, -g.Shape)-1))
+					ws = append(ws, 1)
+				}
+				fit, err := FitGPD(ys, ws)
+				So(err, ShouldBeNil)
+				So(fit.Shape, ShouldAlmostEqual, 0.3, 0.03)
+				So(fit.Scale, ShouldAlmostEqual, 2, 0.1)
+				So(GPD{Shape: 0, Scale: 2}.Survival(2), ShouldAlmostEqual, math.Exp(-1))
+				So(GPD{Shape: -1, Scale: 1}.Survival(2), ShouldEqual, 0)
+
+				_, err = FitGPD([]float64{1, 1}, []float64{1, 1})
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("in PlotDistribution", func() {
+				tg, err := plot.EnsureGraph(ctx, plot.KindXY, "tail", "tails")
+				So(err, ShouldBeNil)
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 401, "min": -0.2, "max": 0.2, "auto bounds": false},
+  "GPD": {"graph": "tail", "tail": "left", "threshold quantile": 0.9}
+}`)), ShouldBeNil)
+				dist := stats.NewStudentsTDistribution(3, 0, 0.01)
+				dist.Seed(42)
+				var xs []float64
+				for i := 0; i < 50000; i++ {
+					xs = append(xs, dist.Rand())
+				}
+				d := stats.NewSampleDistribution(xs, &cfg.Buckets)
+				So(PlotDistribution(ctx, d, &cfg, "pre", "t"), ShouldBeNil)
+				So(values, ShouldContainKey, "pre t left tail GPD shape")
+				So(values, ShouldContainKey, "pre t left tail GPD scale")
+				So(values, ShouldContainKey, "pre t left tail GPD exceedances")
+				threshold, err := strconv.ParseFloat(values["pre t left tail GPD threshold"], 64)
+				So(err, ShouldBeNil)
+				So(threshold, ShouldBeLessThan, 0)
+				shape, err := strconv.ParseFloat(values["pre t left tail GPD shape"], 64)
+				So(err, ShouldBeNil)
+				So(shape, ShouldBeBetween, 0.15, 0.5) // 1/alpha
+				So(len(tg.Plots), ShouldEqual, 2)
+				So(tg.Plots[0].Legend, ShouldEqual, "pre t left tail")
+				So(tg.Plots[1].ChartType, ShouldEqual, plot.ChartDashed)
+				So(tg.Plots[0].Y[0], ShouldAlmostEqual, -1, 0.05) // about log10(0.1)
+			})
+		})
+
+		Convey("VaR and ES work", func() {
+			Convey("HistogramES", func() {
+				buckets, err := stats.NewBuckets(4, 0, 4, stats.LinearSpacing)
+				So(err, ShouldBeNil)
+				h := stats.NewHistogram(buckets)
+				h.Add(0.5, 1.5, 2.5, 3.5)
+				So(HistogramES(h, 0.25), ShouldAlmostEqual, 0.5)
+				So(HistogramES(h, 0.5), ShouldAlmostEqual, 1.0)
+				So(HistogramES(h, 0.375), ShouldAlmostEqual, (0.5+0.5*1.5)/1.5)
+			})
+
+			Convey("ExpectedShortfall", func() {
+				// Standard normal: ES(p) = -pdf(Quantile(p)) / p.
+				d := stats.NewNormalDistribution(0, math.Sqrt(2/math.Pi))
+				So(ExpectedShortfall(d, 0.05), ShouldAlmostEqual, -2.063, 0.005)
+			})
+
+			Convey("in PlotDistribution", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 401, "min": -0.2, "max": 0.2, "auto bounds": false},
+  "reference distribution": {"analytical source": {"name": "t"}},
+  "adjust reference distribution": true,
+  "VaR levels": [95, 99],
+  "plot VaR": true
+}`)), ShouldBeNil)
+				dist := stats.NewStudentsTDistribution(3, 0, 0.01)
+				dist.Seed(42)
+				var xs []float64
+				for i := 0; i < 20000; i++ {
+					xs = append(xs, dist.Rand())
+				}
+				d := stats.NewSampleDistribution(xs, &cfg.Buckets)
+				So(PlotDistribution(ctx, d, &cfg, "pre", "t"), ShouldBeNil)
+				val := func(k string) float64 {
+					So(values, ShouldContainKey, k)
+					v, err := strconv.ParseFloat(values[k], 64)
+					So(err, ShouldBeNil)
+					return v
+				}
+				v95, v99 := val("pre t VaR 95%"), val("pre t VaR 99%")
+				es95, es99 := val("pre t ES 95%"), val("pre t ES 99%")
+				So(v95, ShouldBeLessThan, 0)
+				So(v99, ShouldBeLessThan, v95)
+				So(es95, ShouldBeLessThan, v95)
+				So(es99, ShouldBeLessThan, v99)
+				So(val("pre t ref VaR 95%"), ShouldAlmostEqual, v95, 0.005)
+				So(val("pre t ref ES 95%"), ShouldAlmostEqual, es95, 0.005)
+				// Sample p.d.f., two VaR verticals, then the reference p.d.f.
+				So(len(g.Plots), ShouldEqual, 4)
+				So(g.Plots[2].Legend, ShouldStartWith, "pre t VaR 99%=")
+				So(g.Plots[2].ChartType, ShouldEqual, plot.ChartDashed)
+
+				So(cfg.InitMessage(testutil.JSON(`{"VaR levels": [100]}`)), ShouldNotBeNil)
+			})
+		})
+
+		Convey("multiple reference distributions", func() {
+			var cfg config.DistributionPlot
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 101, "min": -0.1, "max": 0.1, "auto bounds": false},
+  "reference distribution": {"analytical source": {"name": "t"}},
+  "reference distributions": [
+    {"legend": "normal", "distribution": {"analytical source": {"name": "normal"}}},
+    {"legend": "t3", "distribution": {"analytical source": {"name": "t", "alpha": 3}}}
+  ],
+  "adjust reference distribution": true
+}`)), ShouldBeNil)
+			dist := stats.NewStudentsTDistribution(3, 0, 0.01)
+			dist.Seed(42)
+			var xs []float64
+			for i := 0; i < 10000; i++ {
+				xs = append(xs, dist.Rand())
+			}
+			d := stats.NewSampleDistribution(xs, &cfg.Buckets)
+			So(PlotDistribution(ctx, d, &cfg, "pre", "t"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 4)
+			So(g.Plots[1].Legend, ShouldStartWith, "pre t ref:")
+			So(g.Plots[2].Legend, ShouldStartWith, "pre t normal:")
+			So(g.Plots[3].Legend, ShouldStartWith, "pre t t3:")
+			So(values, ShouldContainKey, "pre t alpha")
+			So(values, ShouldContainKey, "pre t t3 alpha")
+			So(values, ShouldNotContainKey, "pre t normal alpha")
+
+			Convey("legends must be unique and not 'ref'", func() {
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "reference distributions": [
+    {"legend": "a", "distribution": {"analytical source": {"name": "t"}}},
+    {"legend": "a", "distribution": {"analytical source": {"name": "normal"}}}
+  ]
+}`)), ShouldNotBeNil)
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "reference distributions": [
+    {"legend": "ref", "distribution": {"analytical source": {"name": "t"}}}
+  ]
+}`)), ShouldNotBeNil)
+			})
+		})
+
+		Convey("robust scale estimators work", func() {
+			So(IQR([]float64{4, 1, 3, 2, 5}), ShouldEqual, 2)
+			So(math.IsNaN(IQR(nil)), ShouldBeTrue)
+			// Pairwise distances: 1, 2, 4, 1, 3, 2; h=3, k=3.
+			So(Qn([]float64{3, 1, 2, 5}), ShouldAlmostEqual, 2.2219*2)
+			So(Qn([]float64{1, 1, 1, 2}), ShouldEqual, 0)
+			So(math.IsNaN(Qn([]float64{1})), ShouldBeTrue)
+
+			d := stats.NewNormalDistribution(0, 1)
+			d.Seed(42)
+			var xs []float64
+			for i := 0; i < 10000; i++ {
+				xs = append(xs, d.Rand())
+			}
+			sigma := stats.NewSample(xs).Sigma()
+			So(Qn(xs), ShouldAlmostEqual, sigma, 0.05*sigma)
+			So(IQR(xs), ShouldAlmostEqual, 1.349*sigma, 0.05*sigma)
+		})
+
+		Convey("Normalize works", func() {
+			s := stats.NewSample([]float64{1, 2, 3, 6})
+			n, err := Normalize(s, "none")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, s)
+
+			n, err = Normalize(s, "MAD")
+			So(err, ShouldBeNil)
+			So(n.Mean(), ShouldAlmostEqual, 0)
+			So(n.MAD(), ShouldAlmostEqual, 1)
+
+			n, err = Normalize(s, "sigma")
+			So(err, ShouldBeNil)
+			So(n.Mean(), ShouldAlmostEqual, 0)
+			So(n.Sigma(), ShouldAlmostEqual, 1)
+
+			_, err = Normalize(stats.NewSample([]float64{1, 1}), "sigma")
+			So(err, ShouldNotBeNil)
+
+			n, err = Normalize(s, "IQR")
+			So(err, ShouldBeNil)
+			So(n.Mean(), ShouldAlmostEqual, 0)
+			So(IQR(n.Data()), ShouldAlmostEqual, 1)
+
+			n, err = Normalize(s, "Qn")
+			So(err, ShouldBeNil)
+			So(n.Mean(), ShouldAlmostEqual, 0)
+			So(Qn(n.Data()), ShouldAlmostEqual, 1)
+
+			_, err = Normalize(stats.NewSample([]float64{1, 1}), "Qn")
+			So(err, ShouldNotBeNil)
+
+			var cfg config.DistributionPlot
+			So(cfg.InitMessage(testutil.JSON(`{"graph": "g"}`)), ShouldBeNil)
+			So(cfg.Normalize, ShouldBeFalse)
+			So(cfg.NormalizeBy, ShouldEqual, "none")
+			So(cfg.InitMessage(testutil.JSON(`{"graph": "g", "normalize": true}`)), ShouldBeNil)
+			So(cfg.NormalizeBy, ShouldEqual, "MAD")
+			So(cfg.InitMessage(testutil.JSON(`{"graph": "g", "normalize by": "sigma"}`)), ShouldBeNil)
+			So(cfg.Normalize, ShouldBeTrue)
+			So(cfg.InitMessage(testutil.JSON(
+				`{"graph": "g", "normalize": true, "normalize by": "none"}`)), ShouldBeNil)
+			So(cfg.Normalize, ShouldBeFalse)
+			So(cfg.InitMessage(testutil.JSON(`{"graph": "g", "normalize by": "foo"}`)), ShouldNotBeNil)
 		})
 
 		Convey("CumulativeStatistic works", func() {
@@ -496,6 +1887,338 @@ func TestExperiments(t *testing.T) {
 			So(len(g.Plots), ShouldEqual, 4) // avg + 2 percentiles + expected
 		})
 
+		Convey("CumulativeStatistic with multiple runs works", func() {
+			var cfg config.CumulativeStatistic
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "samples": 10,
+  "points": 5,
+  "percentiles": [0, 100],
+  "runs": 3
+}`)), ShouldBeNil)
+			cs := NewCumulativeStatistic(&cfg)
+			for r := 0; r < 3; r++ {
+				So(cs.Done(), ShouldBeFalse)
+				for i := 0; i < 10; i++ {
+					cs.AddDirect(float64(r))
+				}
+				cs.NextRun()
+			}
+			So(cs.Done(), ShouldBeTrue)
+			cs.AddDirect(100) // ignored
+			cs.Map(func(x float64) float64 { return 2 * x })
+			So(cs.Plot(ctx, "numbers", "runs"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 3) // median + 2 envelopes
+			So(cs.Xs, ShouldResemble, []float64{1, 2, 3, 6, 10})
+			So(cs.Ys, ShouldResemble, []float64{2, 2, 2, 2, 2})
+			So(cs.Percentiles[0], ShouldResemble, []float64{0, 0, 0, 0, 0})
+			So(cs.Percentiles[1], ShouldResemble, []float64{4, 4, 4, 4, 4})
+		})
+
+		Convey("CumulativeStatistic convergence rate works", func() {
+			var cfg config.CumulativeStatistic
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "samples": 1000,
+  "points": 20,
+  "convergence graph": "main"
+}`)), ShouldBeNil)
+			cs := NewCumulativeStatistic(&cfg)
+			cs.SetExpected(1.0)
+			for n := 1; n <= 1000; n++ {
+				cs.AddDirect(1.0 + 1/math.Sqrt(float64(n)))
+			}
+			rate, intercept, err := cs.ConvergenceRate()
+			So(err, ShouldBeNil)
+			So(rate, ShouldAlmostEqual, -0.5, 1e-9)
+			So(intercept, ShouldAlmostEqual, 0, 1e-9)
+			So(cs.PlotConvergence(ctx, "conv"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 2)
+			So(g.Plots[1].Legend, ShouldEqual, "conv rate=-0.5")
+
+			Convey("without expected value", func() {
+				cs := NewCumulativeStatistic(&cfg)
+				cs.AddDirect(1.0)
+				_, _, err := cs.ConvergenceRate()
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("shared buckets work", func() {
+			var cfg config.DistributionPlot
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "counts graph": "counts",
+  "buckets": {"n": 3},
+  "keep zeros": true
+}`)), ShouldBeNil)
+			newDist := func(xs ...float64) stats.DistributionWithHistogram {
+				return NewSampleDistribution(xs, &cfg)
+			}
+
+			Convey("fixed buckets", func() {
+				b, err := stats.NewBuckets(4, -2, 2, stats.LinearSpacing)
+				So(err, ShouldBeNil)
+				ctx := UseSharedBuckets(ctx, NewSharedBuckets(map[string]*stats.Buckets{
+					"top":       b,
+					AutoGroupID: b,
+				}))
+				So(PlotDistribution(ctx, newDist(-1.5, 1, 1.5), &cfg, "", "a"), ShouldBeNil)
+				So(len(cg.Plots), ShouldEqual, 1)
+				So(cg.Plots[0].X, ShouldResemble, []float64{-1.5, -0.5, 0.5, 1.5})
+				So(cg.Plots[0].Y, ShouldResemble, []float64{1, 0, 0, 2})
+
+				So(PlotBuckets(ctx, &cfg), ShouldEqual, b)
+				So(PlotBuckets(UseGraphPrefix(ctx, "p "), &cfg), ShouldEqual, b)
+				newCfg := cfg
+				newCfg.CountsGraph = "new"
+				So(PlotBuckets(ctx, &newCfg), ShouldEqual, &newCfg.Buckets)
+				So(PlotBuckets(UseAutoCreateGraphs(ctx), &newCfg), ShouldEqual, b)
+
+				h := stats.NewHistogram(&cfg.Buckets)
+				h.Add(1)
+				err = PlotDistribution(ctx, stats.NewHistogramDistribution(h), &cfg, "", "h")
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "cannot use the shared buckets of group 'top'")
+
+				h = stats.NewHistogram(PlotBuckets(ctx, &cfg))
+				h.Add(1)
+				So(PlotDistribution(ctx, stats.NewHistogramDistribution(h), &cfg, "", "h"), ShouldBeNil)
+				So(len(cg.Plots), ShouldEqual, 2)
+			})
+
+			Convey("auto buckets are fitted to the pooled samples", func() {
+				var b stats.Buckets
+				So(b.InitMessage(testutil.JSON(`{"n": 4}`)), ShouldBeNil)
+				ctx := UseSharedBuckets(ctx, NewSharedBuckets(map[string]*stats.Buckets{
+					"top": &b,
+				}))
+				So(PlotDistribution(ctx, newDist(-1, 0), &cfg, "", "a"), ShouldBeNil)
+				pctx := UseGraphPrefix(ctx, "p ")
+				So(PlotDistribution(pctx, newDist(2, 3), &cfg, "", "b"), ShouldBeNil)
+				So(len(cg.Plots), ShouldEqual, 0)
+				So(PlotBuckets(ctx, &cfg), ShouldEqual, &cfg.Buckets)
+
+				So(PlotSharedDistributions(ctx), ShouldBeNil)
+				So(b.Auto, ShouldBeTrue) // the original is not modified
+				So(len(cg.Plots), ShouldEqual, 1)
+				So(cg.Plots[0].X, ShouldResemble, []float64{-0.5, 0.5, 1.5, 2.5})
+				So(cg.Plots[0].Y, ShouldResemble, []float64{1, 1, 0, 0})
+				pg := canvas.GetGraph("p counts")
+				So(pg, ShouldNotBeNil)
+				So(len(pg.Plots), ShouldEqual, 1)
+				So(pg.Plots[0].X, ShouldResemble, cg.Plots[0].X)
+				So(pg.Plots[0].Y, ShouldResemble, []float64{0, 0, 0, 2})
+
+				// Nothing is left to plot.
+				So(PlotSharedDistributions(ctx), ShouldBeNil)
+				So(len(cg.Plots), ShouldEqual, 1)
+			})
+		})
+
+		Convey("AddPlot works", func() {
+			plt, err := plot.NewXYPlot([]float64{1, 2}, []float64{3, 4})
+			So(err, ShouldBeNil)
+			So(AddPlot(ctx, plt, "main"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 1)
+
+			Convey("missing graph is an error by default", func() {
+				So(AddPlot(ctx, plt, "new"), ShouldNotBeNil)
+			})
+
+			Convey("missing graphs are auto-created", func() {
+				ctx := UseAutoCreateGraphs(ctx)
+				So(AddPlot(ctx, plt, "new"), ShouldBeNil)
+				ts := stats.NewTimeseries(
+					[]db.Date{db.NewDate(2020, 1, 2)}, []float64{1})
+				splt, err := plot.NewSeriesPlot(ts)
+				So(err, ShouldBeNil)
+				So(AddPlot(ctx, splt, "new series"), ShouldBeNil)
+
+				graph := canvas.GetGraph("new")
+				So(graph, ShouldNotBeNil)
+				So(graph.GroupID, ShouldEqual, AutoGroupID)
+				So(graph.Title, ShouldEqual, "new")
+				So(len(graph.Plots), ShouldEqual, 1)
+				So(canvas.GetGraph("new series").GroupID, ShouldEqual,
+					AutoTimeseriesGroupID)
+			})
+
+			Convey("graph prefix clones the graph", func() {
+				g.SetXLabel("x")
+				ctx := UseGraphPrefix(ctx, "run1 ")
+				So(AddPlot(ctx, plt, "main"), ShouldBeNil)
+				So(len(g.Plots), ShouldEqual, 1)
+				graph := canvas.GetGraph("run1 main")
+				So(graph, ShouldNotBeNil)
+				So(graph.GroupID, ShouldEqual, g.GroupID)
+				So(graph.Title, ShouldEqual, "run1 main")
+				So(graph.XLabel, ShouldEqual, "x")
+				So(len(graph.Plots), ShouldEqual, 1)
+
+				So(AddPlot(ctx, plt, "missing"), ShouldNotBeNil)
+			})
+
+			Convey("plots are subsampled to max points", func() {
+				ctx := UseMaxPoints(ctx, 2)
+				plt, err := plot.NewXYPlot([]float64{1, 2, 3, 4, 5}, []float64{10, 20, 30, 40, 50})
+				So(err, ShouldBeNil)
+				plt.SetChartType(plot.ChartScatter)
+				So(AddPlot(ctx, plt, "main"), ShouldBeNil)
+				So(g.Plots[1].X, ShouldResemble, []float64{1, 5})
+				So(g.Plots[1].Y, ShouldResemble, []float64{10, 50})
+
+				// Line plots, e.g. p.d.f.s, are not subsampled.
+				line, err := plot.NewXYPlot([]float64{1, 2, 3}, []float64{10, 20, 30})
+				So(err, ShouldBeNil)
+				So(AddPlot(ctx, line, "main"), ShouldBeNil)
+				So(g.Plots[2].X, ShouldResemble, []float64{1, 2, 3})
+
+				plt, err = plot.NewXYPlot([]float64{1, 2, 3, 4, 5}, []float64{10, 20, 30, 40, 50})
+				So(err, ShouldBeNil)
+				Subsample(plt, 3)
+				So(plt.X, ShouldResemble, []float64{1, 3, 5})
+				Subsample(plt, 1)
+				So(plt.X, ShouldResemble, []float64{1})
+
+				ts := stats.NewTimeseries([]db.Date{
+					db.NewDate(2020, 1, 2), db.NewDate(2020, 1, 3), db.NewDate(2020, 1, 6),
+				}, []float64{1, 2, 3})
+				splt, err := plot.NewSeriesPlot(ts)
+				So(err, ShouldBeNil)
+				Subsample(splt, 2)
+				So(splt.Dates, ShouldResemble, []db.Date{
+					db.NewDate(2020, 1, 2), db.NewDate(2020, 1, 6)})
+				So(splt.Y, ShouldResemble, []float64{1, 3})
+				Subsample(splt, 0)
+				So(len(splt.Y), ShouldEqual, 2)
+			})
+		})
+
+		Convey("KDE works", func() {
+			Convey("KernelDensity", func() {
+				var c config.KDE
+				So(c.InitMessage(testutil.JSON(`{"bandwidth": 2}`)), ShouldBeNil)
+				ys, err := KernelDensity([]float64{0, 2}, []float64{3, 1}, []float64{0, 2}, &c)
+				So(err, ShouldBeNil)
+				g0 := 1 / math.Sqrt(2*math.Pi)
+				g1 := math.Exp(-0.5) / math.Sqrt(2*math.Pi)
+				So(testutil.RoundSlice(ys, 6), ShouldResemble, testutil.RoundSlice(
+					[]float64{(3*g0 + g1) / 8, (3*g1 + g0) / 8}, 6))
+
+				So(c.InitMessage(testutil.JSON(`{"bandwidth": 2, "kernel": "epanechnikov"}`)), ShouldBeNil)
+				ys, err = KernelDensity([]float64{0, 2}, []float64{1, 1}, []float64{0, 5}, &c)
+				So(err, ShouldBeNil)
+				So(ys, ShouldResemble, []float64{(0.75 + 0) / 4, 0})
+
+				_, err = KernelDensity(nil, nil, []float64{0}, &c)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("in PlotDistribution", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 5, "min": -2, "max": 2, "auto bounds": false},
+  "KDE": {"replace p.d.f.": true}
+}`)), ShouldBeNil)
+				d := stats.NewNormalDistribution(0, 1)
+				d.Seed(42)
+				dh := stats.NewSampleDistributionFromRand(d, 1000, &cfg.Buckets)
+				So(PlotDistribution(ctx, dh, &cfg, "test", "normal"), ShouldBeNil)
+				So(len(g.Plots), ShouldEqual, 1)
+				So(g.Plots[0].Legend, ShouldEqual, "test normal KDE")
+				// The normal p.d.f. with MAD=1 at 0 is 1/pi.
+				So(g.Plots[0].Y[2], ShouldAlmostEqual, 1/math.Pi, 0.02)
+			})
+		})
+
+		Convey("error bands work", func() {
+			var cfg config.DistributionPlot
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "graph": "main",
+  "buckets": {"n": 3, "min": -3, "max": 3, "auto bounds": false},
+  "error bands": 2
+}`)), ShouldBeNil)
+			d := stats.NewNormalDistribution(0, 1)
+			d.Seed(42)
+			h := stats.NewHistogram(&cfg.Buckets)
+			for i := 0; i < 10000; i++ {
+				h.Add(d.Rand())
+			}
+			dh := stats.NewHistogramDistribution(h)
+			So(PlotDistribution(ctx, dh, &cfg, "test", "normal"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 3)
+			So(g.Plots[1].Legend, ShouldEqual, "test normal p.d.f.+2*stderr")
+			So(g.Plots[2].Legend, ShouldEqual, "test normal p.d.f.-2*stderr")
+			So(g.Plots[1].Y[1], ShouldEqual, h.PDF(1)+2*h.StdError(1))
+			So(g.Plots[2].Y[1], ShouldEqual, h.PDF(1)-2*h.StdError(1))
+			So(h.StdError(1), ShouldBeGreaterThan, 0)
+
+			var bad config.DistributionPlot
+			So(bad.InitMessage(testutil.JSON(`{"graph": "main", "error bands": -1}`)),
+				ShouldNotBeNil)
+		})
+
+		Convey("bucket rules work", func() {
+			data := func() []float64 {
+				var res []float64
+				for i := 0; i < 1000; i++ {
+					res = append(res, float64(i%100)/100)
+				}
+				return append(res, -100, 100)
+			}
+
+			Convey("FitBuckets on unsorted data", func() {
+				b, err := stats.NewBuckets(3, 0, 1, stats.LinearSpacing)
+				So(err, ShouldBeNil)
+				So(FitBuckets(b, []float64{2, -1, 0}), ShouldBeNil)
+				So(b.Min, ShouldEqual, -1)
+				So(b.Max, ShouldEqual, 2)
+				So(FitBuckets(b, nil), ShouldNotBeNil)
+			})
+
+			Convey("default", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`{"graph": "main"}`)), ShouldBeNil)
+				dh := NewSampleDistribution(data(), &cfg)
+				So(dh.Histogram().Buckets().Min, ShouldEqual, -100)
+				So(dh.Histogram().Buckets().Max, ShouldEqual, 100)
+				So(cfg.Buckets.Min, ShouldEqual, -50) // config is not modified
+			})
+
+			Convey("quantile", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{"graph": "main", "bucket rule": "quantile", "bucket quantile": 0.01}`)), ShouldBeNil)
+				dh := NewSampleDistribution(data(), &cfg)
+				So(dh.Histogram().Buckets().Min, ShouldEqual, 0)
+				So(dh.Histogram().Buckets().Max, ShouldEqual, 0.99)
+				So(dh.Histogram().CountsTotal(), ShouldEqual, 1002)
+			})
+
+			Convey("freedman-diaconis", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{"graph": "main", "bucket rule": "freedman-diaconis"}`)), ShouldBeNil)
+				dh := NewSampleDistribution(data(), &cfg)
+				// IQR ~= 0.5, width = 2*0.5/1002^(1/3) ~= 0.1, range=200.
+				So(dh.Histogram().Buckets().N, ShouldEqual, 1000)
+				So(NewSampleDistribution([]float64{0, 0, 0, 0, 1, 1, 1, 1}, &cfg).
+					Histogram().Buckets().N, ShouldEqual, 3)
+			})
+
+			Convey("invalid quantile", func() {
+				var cfg config.DistributionPlot
+				So(cfg.InitMessage(testutil.JSON(`
+{"graph": "main", "bucket rule": "quantile"}`)), ShouldNotBeNil)
+			})
+		})
+
 		Convey("PlotScatter works", func() {
 			var cfg config.ScatterPlot
 			js := testutil.JSON(`
@@ -521,6 +2244,123 @@ func TestExperiments(t *testing.T) {
 			So(g.Plots[1].Y, ShouldResemble, []float64{3, 9})
 			So(g.Plots[2].X, ShouldResemble, []float64{1, 4})
 			So(g.Plots[2].Y, ShouldResemble, []float64{3, 9})
+			So(g.Plots[2].Legend, ShouldEqual, "scatter derived slope=2±0")
+		})
+
+		Convey("PlotScatter with max points works", func() {
+			var cfg config.ScatterPlot
+			js := testutil.JSON(`
+{
+  "graph": "main",
+  "plot derived": true,
+  "max points": 2
+}`)
+			So(cfg.InitMessage(js), ShouldBeNil)
+			xs := []float64{1, 2, 3, 4}
+			ys := []float64{3, 5, 7, 9}
+			So(PlotScatter(ctx, xs, ys, &cfg, "", "scatter", "values"), ShouldBeNil)
+			So(xs, ShouldResemble, []float64{1, 2, 3, 4}) // not modified
+			So(len(g.Plots), ShouldEqual, 2)
+			So(g.Plots[0].X, ShouldResemble, []float64{1, 4})
+			So(g.Plots[1].X, ShouldResemble, []float64{1, 4})
+			So(g.Plots[1].Y, ShouldResemble, []float64{3, 9})
+		})
+
+		Convey("PlotScatter with density works", func() {
+			var cfg config.ScatterPlot
+			js := testutil.JSON(`
+{
+  "graph": "main",
+  "density": {
+    "x buckets": {"n": 2, "min": 0, "max": 2, "auto bounds": false},
+    "y buckets": {"n": 2, "min": 0, "max": 2, "auto bounds": false},
+    "levels": 2
+  }
+}`)
+			So(cfg.InitMessage(js), ShouldBeNil)
+			// 4 points in (0, 0), 2 in (1, 1) and 1 in (0, 1).
+			xs := []float64{0.1, 0.2, 0.3, 0.4, 1.5, 1.6, 0.5}
+			ys := []float64{0.1, 0.2, 0.3, 0.4, 1.5, 1.6, 1.5}
+			So(PlotScatter(ctx, xs, ys, &cfg, "", "scatter", "values"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 2)
+			So(g.Plots[0].Legend, ShouldEqual, "scatter density>=1")
+			So(g.Plots[0].X, ShouldResemble, []float64{0.5})
+			So(g.Plots[0].Y, ShouldResemble, []float64{1.5})
+			So(g.Plots[1].Legend, ShouldEqual, "scatter density>=2")
+			So(g.Plots[1].X, ShouldResemble, []float64{0.5, 1.5})
+			So(g.Plots[1].Y, ShouldResemble, []float64{0.5, 1.5})
+		})
+
+		Convey("PlotScatter with binned means works", func() {
+			var cfg config.ScatterPlot
+			js := testutil.JSON(`
+{
+  "graph": "main",
+  "binned means": {"n": 3, "min": 0, "max": 3}
+}`)
+			So(cfg.InitMessage(js), ShouldBeNil)
+			xs := []float64{0.2, 0.4, 1.5, 2.5, 2.5, 2.9}
+			ys := []float64{1, 3, 5, 2, 4, 6}
+			So(PlotScatter(ctx, xs, ys, &cfg, "", "scatter", "values"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 4)
+			So(g.Plots[1].Legend, ShouldEqual, "scatter binned means")
+			So(testutil.RoundSlice(g.Plots[1].X, 5), ShouldResemble,
+				[]float64{0.3, 1.5, 2.6333})
+			So(g.Plots[1].Y, ShouldResemble, []float64{2, 5, 4})
+			So(g.Plots[2].Legend, ShouldEqual, "scatter binned means-stderr")
+			So(g.Plots[2].Y, ShouldResemble, []float64{1, 5, 4 - 2/math.Sqrt(3)})
+			So(g.Plots[3].Y, ShouldResemble, []float64{3, 5, 4 + 2/math.Sqrt(3)})
+		})
+
+		Convey("LinearRegression works", func() {
+			xs := []float64{0, 1, 2, 3}
+			ys := []float64{1, 2, 4, 4}
+
+			Convey("unweighted", func() {
+				r, err := LinearRegression(xs, ys, nil)
+				So(err, ShouldBeNil)
+				So(r.N, ShouldEqual, 4)
+				So(testutil.Round(r.Incline, 5), ShouldEqual, 1.1)
+				So(testutil.Round(r.Intercept, 5), ShouldEqual, 1.1)
+				// Residuals: -0.1, -0.2, 0.7, -0.4; s2 = 0.7/2.
+				So(testutil.Round(r.InclineErr, 5), ShouldEqual,
+					testutil.Round(math.Sqrt(0.35/5), 5))
+				So(testutil.Round(r.InterceptErr, 5), ShouldEqual,
+					testutil.Round(math.Sqrt(0.35*(0.25+2.25/5)), 5))
+				So(testutil.Round(r.InclineT, 5), ShouldEqual,
+					testutil.Round(1.1/math.Sqrt(0.35/5), 5))
+				So(testutil.Round(r.R2, 5), ShouldEqual, testutil.Round(1-0.7/6.75, 5))
+			})
+
+			Convey("weights are relative", func() {
+				ws := []float64{1, 2, 1, 2}
+				r1, err := LinearRegression(xs, ys, ws)
+				So(err, ShouldBeNil)
+				ws2 := []float64{10, 20, 10, 20}
+				r2, err := LinearRegression(xs, ys, ws2)
+				So(err, ShouldBeNil)
+				So(testutil.Round(r2.Incline, 8), ShouldEqual, testutil.Round(r1.Incline, 8))
+				So(testutil.Round(r2.InclineErr, 8), ShouldEqual, testutil.Round(r1.InclineErr, 8))
+				So(testutil.Round(r2.InterceptErr, 8), ShouldEqual, testutil.Round(r1.InterceptErr, 8))
+			})
+
+			Convey("two points", func() {
+				r, err := LinearRegression([]float64{0, 1}, []float64{1, 3}, nil)
+				So(err, ShouldBeNil)
+				So(r.Incline, ShouldEqual, 2)
+				So(r.R2, ShouldEqual, 1)
+				So(math.IsNaN(r.InclineErr), ShouldBeTrue)
+			})
+
+			Convey("degenerate and invalid", func() {
+				r, err := LinearRegression([]float64{1, 1}, []float64{1, 3}, nil)
+				So(err, ShouldBeNil)
+				So(math.IsInf(r.Incline, 1), ShouldBeTrue)
+				_, err = LinearRegression(xs, ys, []float64{1})
+				So(err, ShouldNotBeNil)
+				_, err = LinearRegression([]float64{1}, []float64{1}, nil)
+				So(err, ShouldNotBeNil)
+			})
 		})
 
 		Convey("Stability works", func() {
@@ -537,6 +2377,98 @@ func TestExperiments(t *testing.T) {
 				return float64(h*(h-1)/2 - l*(l-1)/2)
 			}
 			So(Stability(5, f, &cfg), ShouldResemble, []float64{0.9, 0.3})
+
+			var p StabilityPoints
+			p.Add(5, f, &cfg)
+			So(p.X, ShouldBeNil) // no scatter configured
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "step": 2,
+  "window": 3,
+  "plot": {"graph": "g"},
+  "scatter": {"graph": "main"}
+}`)), ShouldBeNil)
+			p.Add(5, f, &cfg)
+			So(p.X, ShouldResemble, []float64{10, 10})
+			So(p.Y, ShouldResemble, []float64{9, 3})
+			So(p.Plot(ctx, &cfg, "", "stability"), ShouldBeNil)
+			So(len(g.Plots), ShouldEqual, 1)
+			So(g.Plots[0].Legend, ShouldEqual, "stability")
+		})
+
+		Convey("StabilitySeries works", func() {
+			var cfg config.StabilityPlot
+			So(cfg.InitMessage(testutil.JSON(`{"window": 2}`)), ShouldNotBeNil)
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "window": 2,
+  "timeseries graph": "series"
+}`)), ShouldBeNil)
+			d := func(day uint8) db.Date { return db.NewDate(2020, 1, day) }
+			f1 := func(l, h int) float64 { return float64(l + h) }
+			f2 := func(l, h int) float64 { return 10 }
+			var s, s2 StabilitySeries
+			s.Add([]db.Date{d(1), d(2), d(3)}, f1, &cfg)
+			s2.Add([]db.Date{d(2), d(3), d(6)}, f2, &cfg)
+			s.Merge(&s2)
+			ts := s.Timeseries()
+			So(ts.Dates(), ShouldResemble, []db.Date{d(2), d(3), d(6)})
+			// Subranges [0..2) and [1..3) of s, averaged with 10 from s2.
+			So(ts.Data(), ShouldResemble, []float64{2, 7, 10})
+
+			sg, err := plot.EnsureGraph(ctx, plot.KindSeries, "series", "ts")
+			So(err, ShouldBeNil)
+			So(s.Plot(ctx, &cfg, "test", "stability"), ShouldBeNil)
+			So(len(sg.Plots), ShouldEqual, 1)
+			So(sg.Plots[0].Legend, ShouldEqual, "test stability")
+		})
+
+		Convey("Hill works", func() {
+			So(testutil.RoundSlice(Hill([]float64{8, 4, 2, 1}), 5), ShouldResemble,
+				[]float64{1.4427, 0.9618, 0.7213})
+			So(Hill([]float64{2, 2}), ShouldResemble, []float64{math.Inf(1)})
+			So(Hill([]float64{1}), ShouldBeEmpty)
+		})
+
+		Convey("BootstrapInterval works", func() {
+			data := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+			mean := func(d []float64) float64 { return stats.NewSample(d).Mean() }
+			low, high := BootstrapInterval(data, mean, 1000, 90, 42)
+			So(low, ShouldBeLessThan, 5.5)
+			So(high, ShouldBeGreaterThan, 5.5)
+			So(low, ShouldBeGreaterThan, 3.0)
+			So(high, ShouldBeLessThan, 8.0)
+
+			low, high = BootstrapInterval([]float64{2, 2}, mean, 10, 95, 42)
+			So(low, ShouldEqual, 2)
+			So(high, ShouldEqual, 2)
+		})
+
+		Convey("AllPairs works", func() {
+			So(iterator.ToSlice(AllPairs(4)), ShouldResemble, []IntPair{
+				{0, 1},
+				{0, 2},
+				{0, 3},
+				{1, 2},
+				{1, 3},
+				{2, 3},
+			})
+		})
+
+		Convey("RandomPairs works", func() {
+			n, k := 10, 5
+			pairs := iterator.ToSlice(RandomPairs(n, k, 42))
+			So(len(pairs), ShouldEqual, k)
+			for _, p := range pairs {
+				So(p.X, ShouldBeLessThan, p.Y)
+				So(p.Y, ShouldBeLessThan, n)
+			}
+		})
+
+		Convey("SamplePairs works", func() {
+			So(len(iterator.ToSlice(SamplePairs(4, 0, 42))), ShouldEqual, 6)
+			So(len(iterator.ToSlice(SamplePairs(4, 10, 42))), ShouldEqual, 6)
+			So(len(iterator.ToSlice(SamplePairs(4, 3, 42))), ShouldEqual, 3)
 		})
 
 		Convey("for TestExperiment", func() {
@@ -0,0 +1,197 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export is an experiment writing log-profit series into Parquet
+// files, so that external tools such as Python notebooks can reuse the
+// parallel loading and preprocessing of the Source without recomputing the
+// log-profits. The files load directly as Arrow tables, e.g. by
+// pyarrow.parquet.read_table().
+package export
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+)
+
+type Export struct {
+	config  *config.Export
+	tickers int
+	samples int
+}
+
+var _ experiments.Experiment = &Export{}
+
+func (e *Export) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Export) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Export) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Export); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	f := func(lps []experiments.LogProfits) []experiments.LogProfits { return lps }
+	it, err := experiments.SourceMap(ctx, e.config.Data, f)
+	if err != nil {
+		return errors.Annotate(err, "failed to create log-profits iterator")
+	}
+	defer it.Close()
+
+	path := experiments.OutputPath(ctx, e.config.Path)
+	if e.config.PartitionByTicker {
+		err = e.writePartitioned(it, path)
+	} else {
+		err = e.writeFile(it, path)
+	}
+	if err != nil {
+		return errors.Annotate(err, "failed to export log-profits")
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "tickers", experiments.IntValue(e.tickers)); err != nil {
+		return errors.Annotate(err, "failed to add %s value", e.Prefix("tickers"))
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "samples", experiments.IntValue(e.samples)); err != nil {
+		return errors.Annotate(err, "failed to add %s value", e.Prefix("samples"))
+	}
+	return nil
+}
+
+// row of the single file export.
+type row struct {
+	Ticker    string  `parquet:"ticker,dict"`
+	Date      int64   `parquet:"date,timestamp(millisecond)"`
+	LogProfit float64 `parquet:"log_profit"`
+}
+
+// partitionRow is a row of a ticker's file in the partitioned export.
+type partitionRow struct {
+	Date      int64   `parquet:"date,timestamp(millisecond)"`
+	LogProfit float64 `parquet:"log_profit"`
+}
+
+// ticker returns a unique name of the next exported ticker. All synthetic
+// series are named the same, so they are numbered in the order of export.
+func (e *Export) ticker(lp experiments.LogProfits) string {
+	e.tickers++
+	if e.config.Data.DB != nil {
+		return lp.Ticker
+	}
+	return fmt.Sprintf("%s%d", lp.Ticker, e.tickers)
+}
+
+// rows of the ticker's log-profits, created by f from the date in
+// milliseconds since the Unix epoch and the log-profit.
+func rows[T any](lp experiments.LogProfits, f func(date int64, logProfit float64) T) []T {
+	data := lp.Timeseries.Data()
+	res := make([]T, len(data))
+	for i, d := range lp.Timeseries.Dates() {
+		res[i] = f(d.ToTime().UnixMilli(), data[i])
+	}
+	return res
+}
+
+// writeParquet creates (or truncates) a Parquet file, and writes its rows by
+// f. Each flush of the writer by f starts a new row group.
+func writeParquet[T any](path string, f func(w *parquet.GenericWriter[T]) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Annotate(err, "failed to create '%s'", path)
+	}
+	w := parquet.NewGenericWriter[T](file, parquet.CreatedBy("stockparfait experiments", "", ""))
+	err = f(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Annotate(err, "failed to write '%s'", path)
+	}
+	return nil
+}
+
+// writeFile writes all the log-profits into a single file, one row group per
+// batch of tickers.
+func (e *Export) writeFile(it iterator.Iterator[[]experiments.LogProfits], path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return errors.Annotate(err, "failed to create directory for '%s'", path)
+	}
+	return writeParquet(path, func(w *parquet.GenericWriter[row]) error {
+		for lps, ok := it.Next(); ok; lps, ok = it.Next() {
+			var batch []row
+			for _, lp := range lps {
+				if len(lp.Timeseries.Data()) == 0 {
+					continue
+				}
+				ticker := e.ticker(lp)
+				batch = append(batch, rows(lp, func(date int64, logProfit float64) row {
+					return row{Ticker: ticker, Date: date, LogProfit: logProfit}
+				})...)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			e.samples += len(batch)
+			if _, err := w.Write(batch); err != nil {
+				return errors.Annotate(err, "failed to write rows")
+			}
+			if err := w.Flush(); err != nil {
+				return errors.Annotate(err, "failed to write row group")
+			}
+		}
+		return nil
+	})
+}
+
+// writePartitioned writes each ticker into its own
+// <path>/ticker=<ticker>/data.parquet file.
+func (e *Export) writePartitioned(it iterator.Iterator[[]experiments.LogProfits], path string) error {
+	for lps, ok := it.Next(); ok; lps, ok = it.Next() {
+		for _, lp := range lps {
+			if len(lp.Timeseries.Data()) == 0 {
+				continue
+			}
+			ticker := e.ticker(lp)
+			dir := filepath.Join(path, "ticker="+ticker)
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return errors.Annotate(err, "failed to create directory '%s'", dir)
+			}
+			rs := rows(lp, func(date int64, logProfit float64) partitionRow {
+				return partitionRow{Date: date, LogProfit: logProfit}
+			})
+			e.samples += len(rs)
+			err := writeParquet(filepath.Join(dir, "data.parquet"), func(w *parquet.GenericWriter[partitionRow]) error {
+				_, err := w.Write(rs)
+				return err
+			})
+			if err != nil {
+				return errors.Annotate(err, "failed to write %s", ticker)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_export")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Export experiment works", t, func() {
+		ctx := context.Background()
+		values := make(experiments.Values)
+		ctx = experiments.UseValues(ctx, values)
+
+		conf := func(path string, partition bool) *config.Export {
+			var cfg config.Export
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "alpha": 3},
+    "tickers": 3,
+    "days": 40,
+    "start date": "2020-01-01",
+    "seed": 42
+  },
+  "path": "%s",
+  "partition by ticker": %v
+}`, path, partition))), ShouldBeNil)
+			return &cfg
+		}
+
+		// expected rows of the exported log-profits, read from the same source.
+		expected := func(cfg *config.Export) []row {
+			it, err := experiments.Source(ctx, cfg.Data)
+			So(err, ShouldBeNil)
+			defer it.Close()
+			var res []row
+			var n int
+			for lp, ok := it.Next(); ok; lp, ok = it.Next() {
+				n++
+				ticker := fmt.Sprintf("%s%d", lp.Ticker, n)
+				res = append(res, rows(lp, func(date int64, logProfit float64) row {
+					return row{Ticker: ticker, Date: date, LogProfit: logProfit}
+				})...)
+			}
+			return res
+		}
+
+		Convey("single file", func() {
+			path := filepath.Join(tmpdir, "single", "lp.parquet")
+			cfg := conf(path, false)
+			var e Export
+			So(e.Run(ctx, cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "3")
+			// Source drops the first spurious log-profit of each ticker.
+			So(values["test samples"], ShouldEqual, "117")
+			rs, err := parquet.ReadFile[row](path)
+			So(err, ShouldBeNil)
+			So(rs, ShouldResemble, expected(cfg))
+			So(rs[0].Date, ShouldEqual, db.NewDate(2020, 1, 2).ToTime().UnixMilli())
+
+			f, err := os.Open(path)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			st, err := f.Stat()
+			So(err, ShouldBeNil)
+			pf, err := parquet.OpenFile(f, st.Size())
+			So(err, ShouldBeNil)
+			So(pf.NumRows(), ShouldEqual, 117)
+			schema := pf.Schema()
+			So(len(schema.Fields()), ShouldEqual, 3)
+			So(schema.Fields()[1].Type().LogicalType().Timestamp, ShouldNotBeNil)
+		})
+
+		Convey("partitioned by ticker", func() {
+			path := filepath.Join(tmpdir, "partitioned")
+			cfg := conf(path, true)
+			var e Export
+			So(e.Run(ctx, cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "3")
+			So(values["test samples"], ShouldEqual, "117")
+			var rs []row
+			for _, t := range []string{"synthetic1", "synthetic2", "synthetic3"} {
+				prs, err := parquet.ReadFile[partitionRow](
+					filepath.Join(path, "ticker="+t, "data.parquet"))
+				So(err, ShouldBeNil)
+				So(len(prs), ShouldEqual, 39)
+				for _, r := range prs {
+					rs = append(rs, row{Ticker: t, Date: r.Date, LogProfit: r.LogProfit})
+				}
+			}
+			So(rs, ShouldResemble, expected(cfg))
+		})
+
+		Convey("path is required", func() {
+			var cfg config.Export
+			So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"DB": {"DB": "real"}}
+}`)), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package extremes is an experiment with waiting times between extreme
+// log-profits.
+//
+// If extreme events were independent, they would form a Poisson process, and
+// the waiting times between them would be distributed exponentially. Any
+// significant deviation from the exponential distribution indicates clustering
+// of extreme events.
+package extremes
+
+import (
+	"context"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Extremes struct {
+	config  *config.Extremes
+	context context.Context
+}
+
+var _ experiments.Experiment = &Extremes{}
+
+func (e *Extremes) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Extremes) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Extremes) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Extremes); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	it, err := experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j2.Merge(j1) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, &jobResult{}, f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+type jobResult struct {
+	waits      []float64 // pooled waiting times
+	variations []float64 // per-ticker sigma/mean of waiting times
+	numTickers int
+	samples    int
+	events     int
+}
+
+// Merge j2 into j and return j.
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	j.waits = append(j.waits, j2.waits...)
+	j.variations = append(j.variations, j2.variations...)
+	j.numTickers += j2.numTickers
+	j.samples += j2.samples
+	j.events += j2.events
+	return j
+}
+
+// waitingTimes returns the number of samples between consecutive events
+// |data[i]| > threshold*MAD. When window > 0, MAD is computed over the window
+// of preceding samples, and the first window samples are never events.
+func waitingTimes(data []float64, threshold float64, window int) []float64 {
+	var mad float64
+	if window <= 0 {
+		mad = stats.NewSample(data).MAD()
+	}
+	var waits []float64
+	prev := -1
+	for i, x := range data {
+		if window > 0 {
+			if i < window {
+				continue
+			}
+			mad = stats.NewSample(data[i-window : i]).MAD()
+		}
+		if mad == 0 || math.Abs(x) <= threshold*mad {
+			continue
+		}
+		if prev >= 0 {
+			waits = append(waits, float64(i-prev))
+		}
+		prev = i
+	}
+	return waits
+}
+
+func (e *Extremes) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := &jobResult{}
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		data := lp.Timeseries.Data()
+		waits := waitingTimes(data, e.config.Threshold, e.config.VolatilityWindow)
+		if len(waits)+1 < e.config.MinEvents {
+			logging.Debugf(e.context, "skipping %s: too few events (%d)",
+				lp.Ticker, len(waits)+1)
+			continue
+		}
+		sample := stats.NewSample(waits)
+		mean := sample.Mean()
+		res.variations = append(res.variations, sample.Sigma()/mean)
+		if e.config.NormalizeWaits {
+			for i := range waits {
+				waits[i] /= mean
+			}
+		}
+		res.waits = append(res.waits, waits...)
+		res.numTickers++
+		res.samples += len(data)
+		res.events += len(waits) + 1
+	}
+	return res
+}
+
+func (e *Extremes) processTotal(total *jobResult) error {
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(total.samples)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of samples")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "events", experiments.IntValue(total.events)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of events")
+	}
+	if len(total.waits) == 0 {
+		logging.Warningf(e.context, "%s: no waiting times to plot",
+			e.Prefix("extremes"))
+		return nil
+	}
+	sample := stats.NewSample(total.waits)
+	variation := experiments.FloatValue(sample.Sigma() / sample.Mean())
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "pooled variation", variation); err != nil {
+		return errors.Annotate(err, "failed to add value for pooled variation")
+	}
+	if c := e.config.WaitsPlot; c != nil {
+		dist := experiments.NewSampleDistribution(total.waits, c)
+		err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, "waiting times")
+		if err != nil {
+			return errors.Annotate(err, "failed to plot waiting times")
+		}
+	}
+	if c := e.config.VariationPlot; c != nil {
+		dist := experiments.NewSampleDistribution(total.variations, c)
+		err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, "variations")
+		if err != nil {
+			return errors.Annotate(err, "failed to plot variations")
+		}
+	}
+	return nil
+}
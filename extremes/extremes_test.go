@@ -0,0 +1,85 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extremes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExtremes(t *testing.T) {
+	t.Parallel()
+
+	Convey("waitingTimes works", t, func() {
+		data := []float64{0.1, -2, 0.1, 0.1, 2, -0.1, 2, 0.1}
+
+		Convey("with the total MAD", func() {
+			// MAD=0.85625, events at 1, 4, 6.
+			So(waitingTimes(data, 1.5, 0), ShouldResemble, []float64{3, 2})
+		})
+
+		Convey("with a volatility window", func() {
+			// Events at 4 and 6; the event at 1 is within the first window.
+			So(waitingTimes(data, 1.5, 3), ShouldResemble, []float64{2})
+		})
+	})
+
+	Convey("Extremes experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		waitsGraph, err := canvas.EnsureGraph(plot.KindXY, "waits", "g")
+		So(err, ShouldBeNil)
+		varGraph, err := canvas.EnsureGraph(plot.KindXY, "var", "g")
+		So(err, ShouldBeNil)
+
+		var cfg config.Extremes
+		So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t"},
+    "tickers": 3,
+    "days": 1000
+  },
+  "threshold": 2,
+  "waiting times": {
+    "graph": "waits",
+    "reference distribution": {
+      "analytical source": {"name": "exponential", "mean": 1}
+    }
+  },
+  "variation plot": {"graph": "var"}
+}`)), ShouldBeNil)
+		var e Extremes
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		So(values["test tickers"], ShouldEqual, "3")
+		So(values["test samples"], ShouldEqual, "2997")
+		So(len(waitsGraph.Plots), ShouldEqual, 2) // p.d.f. and reference
+		So(waitsGraph.Plots[1].Legend, ShouldEqual, "test waiting times ref:Exp")
+		So(len(varGraph.Plots), ShouldEqual, 1)
+	})
+}
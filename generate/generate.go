@@ -0,0 +1,147 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package generate is an experiment saving synthetic price series into a DB,
+// so that the other experiments and the apps can consume synthetic universes
+// the same way as the real ones.
+package generate
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+)
+
+type Generate struct {
+	config *config.Generate
+}
+
+var _ experiments.Experiment = &Generate{}
+
+func (e *Generate) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Generate) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Generate) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Generate); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	it, err := e.source(ctx)
+	if err != nil {
+		return errors.Annotate(err, "failed to generate prices")
+	}
+	defer it.Close()
+
+	if err := e.write(ctx, it); err != nil {
+		return errors.Annotate(err, "failed to write DB '%s'", e.config.DB)
+	}
+	return nil
+}
+
+// source generates batches of synthetic price series.
+func (e *Generate) source(ctx context.Context) (iterator.IteratorCloser[[]experiments.Prices], error) {
+	c := e.config.Data
+	if c.IntradayDist != nil {
+		f := func(ps []experiments.Prices) []experiments.Prices { return ps }
+		return experiments.SourceMapPrices(ctx, c, f)
+	}
+	f := func(lps []experiments.LogProfits) []experiments.Prices {
+		res := make([]experiments.Prices, len(lps))
+		for i, lp := range lps {
+			res[i] = LogProfitPrices(lp)
+		}
+		return res
+	}
+	return experiments.SourceMap(ctx, c, f)
+}
+
+// LogProfitPrices reconstructs daily prices from log-profits, starting from an
+// arbitrary close of $100 prior to the first sample. Open, high and low are
+// set to the close, and the daily cash volume is a constant $1000, the same as
+// the default for the synthetic OHLC prices.
+func LogProfitPrices(lp experiments.LogProfits) experiments.Prices {
+	dates := lp.Timeseries.Dates()
+	data := lp.Timeseries.Data()
+	rows := make([]db.PriceRow, len(dates))
+	p := 100.0
+	for i, d := range dates {
+		p *= math.Exp(data[i])
+		rows[i] = db.PriceRow{
+			Date:               d,
+			Close:              float32(p),
+			CloseSplitAdjusted: float32(p),
+			CloseFullyAdjusted: float32(p),
+			Open:               float32(p),
+			High:               float32(p),
+			Low:                float32(p),
+			CashVolume:         1000,
+		}
+		rows[i].SetActive(true)
+	}
+	return experiments.Prices{Ticker: lp.Ticker, Rows: rows}
+}
+
+// write saves the generated prices into the DB, naming the tickers
+// sequentially in the order of generation.
+func (e *Generate) write(ctx context.Context, it iterator.Iterator[[]experiments.Prices]) error {
+	w := db.NewWriter(e.config.DBPath, e.config.DB)
+	tickers := make(map[string]db.TickerRow)
+	monthly := make(map[string][]db.ResampledRow)
+	var samples int
+	for ps, ok := it.Next(); ok; ps, ok = it.Next() {
+		for _, p := range ps {
+			if len(p.Rows) == 0 {
+				continue
+			}
+			t := fmt.Sprintf("%s%d", e.config.TickerPrefix, len(tickers)+1)
+			if err := w.WritePrices(t, p.Rows); err != nil {
+				return errors.Annotate(err, "failed to write prices for %s", t)
+			}
+			tickers[t] = db.TickerRow{
+				Source: "synthetic",
+				Name:   p.Ticker,
+				Active: true,
+			}
+			monthly[t] = db.ComputeMonthly(p.Rows)
+			samples += len(p.Rows)
+		}
+	}
+	if err := w.WriteTickers(tickers); err != nil {
+		return errors.Annotate(err, "failed to write tickers")
+	}
+	if err := w.WriteMonthly(monthly); err != nil {
+		return errors.Annotate(err, "failed to write monthly data")
+	}
+	if err := w.WriteMetadata(w.Metadata); err != nil {
+		return errors.Annotate(err, "failed to write metadata")
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "tickers", experiments.IntValue(len(tickers))); err != nil {
+		return errors.Annotate(err, "failed to add %s value", e.Prefix("tickers"))
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "samples", experiments.IntValue(samples)); err != nil {
+		return errors.Annotate(err, "failed to add %s value", e.Prefix("samples"))
+	}
+	return nil
+}
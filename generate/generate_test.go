@@ -0,0 +1,131 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_generate")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("LogProfitPrices works", t, func() {
+		dates := []db.Date{db.NewDate(2020, 1, 1), db.NewDate(2020, 1, 2)}
+		lp := experiments.LogProfits{
+			Ticker:     "synthetic",
+			Timeseries: stats.NewTimeseries(dates, []float64{0.1, -0.2}),
+		}
+		p := LogProfitPrices(lp)
+		So(p.Ticker, ShouldEqual, "synthetic")
+		So(len(p.Rows), ShouldEqual, 2)
+		So(p.Rows[0].Date, ShouldResemble, dates[0])
+		So(p.Rows[0].Close, ShouldAlmostEqual, 110.517, 0.001)
+		So(p.Rows[1].CloseFullyAdjusted, ShouldAlmostEqual, 90.484, 0.001)
+		So(p.Rows[1].Open, ShouldEqual, p.Rows[1].Close)
+		So(p.Rows[1].Active(), ShouldBeTrue)
+	})
+
+	Convey("Generate experiment works", t, func() {
+		ctx := context.Background()
+		values := make(experiments.Values)
+		ctx = experiments.UseValues(ctx, values)
+
+		conf := func(dbName, intraday string) *config.Generate {
+			var cfg config.Generate
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "alpha": 3},%s
+    "tickers": 3,
+    "days": 40,
+    "start date": "2020-01-01",
+    "seed": 42
+  },
+  "DB path": "%s",
+  "DB": "%s"
+}`, intraday, tmpdir, dbName))), ShouldBeNil)
+			return &cfg
+		}
+
+		Convey("daily prices", func() {
+			var e Generate
+			So(e.Run(ctx, conf("daily", "")), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "3")
+			// Source drops the first spurious log-profit of each ticker.
+			So(values["test samples"], ShouldEqual, "117")
+
+			r := db.NewReader(tmpdir, "daily")
+			tickers, err := r.Tickers(ctx)
+			So(err, ShouldBeNil)
+			sort.Strings(tickers)
+			So(tickers, ShouldResemble, []string{"SYN1", "SYN2", "SYN3"})
+			row, err := r.TickerRow("SYN2")
+			So(err, ShouldBeNil)
+			So(row.Active, ShouldBeTrue)
+			prices, err := r.Prices("SYN1")
+			So(err, ShouldBeNil)
+			So(len(prices), ShouldEqual, 39)
+			So(prices[0].Date, ShouldResemble, db.NewDate(2020, 1, 2))
+			monthly, err := r.Monthly("SYN3", db.Date{}, db.Date{})
+			So(err, ShouldBeNil)
+			So(len(monthly), ShouldEqual, 2)
+			m, err := r.Metadata()
+			So(err, ShouldBeNil)
+			So(m.NumTickers, ShouldEqual, 3)
+			So(m.NumPrices, ShouldEqual, 117)
+		})
+
+		Convey("OHLC prices", func() {
+			var e Generate
+			So(e.Run(ctx, conf("ohlc", `
+    "intraday distribution": {"name": "normal", "MAD": 0.001},
+    "intraday resolution": 30,`)), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "3")
+
+			r := db.NewReader(tmpdir, "ohlc")
+			prices, err := r.Prices("SYN1")
+			So(err, ShouldBeNil)
+			So(len(prices), ShouldEqual, 40)
+			So(prices[0].High, ShouldBeGreaterThanOrEqualTo, prices[0].Low)
+		})
+
+		Convey("synthetic data is required", func() {
+			var cfg config.Generate
+			So(cfg.InitMessage(testutil.JSON(`{
+  "data": {"DB": {"DB": "real"}},
+  "DB": "synthetic"
+}`)), ShouldNotBeNil)
+		})
+	})
+}
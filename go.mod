@@ -1,20 +1,34 @@
 module github.com/stockparfait/experiments
 
-go 1.18
+go 1.21
 
 require (
+	github.com/fogleman/gg v1.3.0
+	github.com/parquet-go/parquet-go v0.23.0
 	github.com/smartystreets/goconvey v1.7.2
 	github.com/stockparfait/errors v0.2.0
 	github.com/stockparfait/iterator v0.1.8
 	github.com/stockparfait/logging v0.2.0
 	github.com/stockparfait/stockparfait v0.4.0
 	github.com/stockparfait/testutil v0.2.0
+	golang.org/x/exp v0.0.0-20220602145555-4a0574d9293f
+	gonum.org/v1/gonum v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/gopherjs/gopherjs v0.0.0-20181017120253-0766667cb4d1 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/segmentio/encoding v0.4.0 // indirect
 	github.com/smartystreets/assertions v1.2.0 // indirect
-	golang.org/x/exp v0.0.0-20220602145555-4a0574d9293f // indirect
-	gonum.org/v1/gonum v0.11.0 // indirect
+	golang.org/x/image v0.18.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
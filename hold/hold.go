@@ -21,6 +21,7 @@ package hold
 import (
 	"context"
 	"fmt"
+	"math"
 	"sort"
 
 	"github.com/stockparfait/errors"
@@ -37,6 +38,8 @@ type Hold struct {
 	config    *config.Hold
 	positions []*stats.Timeseries
 	total     *stats.Timeseries
+	weightSum float64             // sum of the contribution weights
+	flows     map[db.Date]float64 // money invested on each date
 }
 
 var _ experiments.Experiment = &Hold{}
@@ -55,21 +58,89 @@ func (h *Hold) Run(ctx context.Context, cfg config.ExperimentConfig) error {
 	if h.config, ok = cfg.(*config.Hold); !ok {
 		return errors.Reason("unexpected config type: %T", cfg)
 	}
-	if h.config.PositionsGraph != "" {
+	h.flows = make(map[db.Date]float64)
+	for _, p := range h.config.Positions {
+		h.weightSum += p.Weight
+	}
+	needTotal := h.config.TotalGraph != "" || h.config.Benchmark != "" ||
+		h.config.Contributions != nil
+	if h.config.PositionsGraph != "" || needTotal {
 		for _, p := range h.config.Positions {
+			if ctx.Err() != nil {
+				break
+			}
 			if err := h.AddPosition(ctx, p); err != nil {
 				return errors.Annotate(err, "failed to add position for '%s'", p.Ticker)
 			}
 		}
 	}
-	if h.config.TotalGraph != "" {
+	if needTotal {
 		if err := h.AddTotal(ctx); err != nil {
 			return errors.Annotate(err, "failed to add total")
 		}
 	}
+	if h.config.Benchmark != "" {
+		if err := h.AddBenchmark(ctx); err != nil {
+			return errors.Annotate(err, "failed to add benchmark")
+		}
+	}
+	if h.config.Contributions != nil {
+		if err := h.addReturns(ctx); err != nil {
+			return errors.Annotate(err, "failed to add returns")
+		}
+	}
 	return nil
 }
 
+// period is the start of the contribution period containing the date.
+func (h *Hold) period(d db.Date) db.Date {
+	switch h.config.Contributions.Frequency {
+	case "weekly":
+		return d.Monday()
+	case "quarterly":
+		return d.QuarterStart()
+	case "yearly":
+		return db.NewDate(d.Year(), 1, 1)
+	}
+	return d.MonthStart()
+}
+
+// contribution allocated to the position from each periodic contribution.
+func (h *Hold) contribution(p config.HoldPosition) float64 {
+	c := h.config.Contributions
+	if c == nil {
+		return 0
+	}
+	if h.weightSum == 0 {
+		return c.Amount / float64(len(h.config.Positions))
+	}
+	return c.Amount * p.Weight / h.weightSum
+}
+
+// price of the position according to the dividend settings.
+func (h *Hold) price(r db.PriceRow) float64 {
+	if h.config.RawPrices || !h.config.ReinvestDividends {
+		return float64(r.CloseSplitAdjusted)
+	}
+	return float64(r.CloseFullyAdjusted)
+}
+
+// dividend per split-adjusted share paid out on the date of r, as implied by
+// the change in the ratio of fully adjusted to split-adjusted prices since the
+// previous row.
+func dividend(prev, r db.PriceRow) float64 {
+	if prev.CloseSplitAdjusted == 0 || r.CloseSplitAdjusted == 0 || r.CloseFullyAdjusted == 0 {
+		return 0
+	}
+	f0 := float64(prev.CloseFullyAdjusted) / float64(prev.CloseSplitAdjusted)
+	f1 := float64(r.CloseFullyAdjusted) / float64(r.CloseSplitAdjusted)
+	// Ignore float32 rounding noise in the adjustment factors.
+	if f1 <= f0*(1+1e-6) {
+		return 0
+	}
+	return float64(prev.CloseSplitAdjusted) * (1 - f0/f1)
+}
+
 func (h *Hold) AddPosition(ctx context.Context, p config.HoldPosition) error {
 	rows, err := h.config.Reader.Prices(p.Ticker)
 	if err != nil {
@@ -80,16 +151,33 @@ func (h *Hold) AddPosition(ctx context.Context, p config.HoldPosition) error {
 	}
 	factor := p.Shares
 	if factor == 0.0 {
-		factor = p.StartValue / float64(rows[0].CloseFullyAdjusted)
+		factor = p.StartValue / h.price(rows[0])
 	}
+	cashDividends := !h.config.ReinvestDividends && !h.config.RawPrices
 	dates := make([]db.Date, len(rows))
 	data := make([]float64, len(rows))
+	shares := factor
+	var cash float64 // accrued cash dividends
+	h.flows[rows[0].Date] += factor * h.price(rows[0])
+	contribution := h.contribution(p)
 	for i, r := range rows {
 		dates[i] = r.Date
-		data[i] = factor * float64(r.CloseFullyAdjusted)
+		price := h.price(r)
+		if cashDividends && i > 0 {
+			cash += shares * dividend(rows[i-1], r)
+		}
+		if contribution > 0 && i > 0 && price > 0 &&
+			h.period(r.Date) != h.period(rows[i-1].Date) {
+			shares += contribution / price
+			h.flows[r.Date] += contribution
+		}
+		data[i] = shares*price + cash
 	}
 	ts := stats.NewTimeseries(dates, data)
 	h.positions = append(h.positions, ts)
+	if h.config.PositionsGraph == "" {
+		return nil
+	}
 
 	legend := fmt.Sprintf("%.6g*%s", factor, p.Ticker)
 	plt, err := plot.NewSeriesPlot(ts)
@@ -100,7 +188,7 @@ func (h *Hold) AddPosition(ctx context.Context, p config.HoldPosition) error {
 	if h.config.PositionsAxis == "left" {
 		plt.SetLeftAxis(true)
 	}
-	err = plot.Add(ctx, plt, h.config.PositionsGraph)
+	err = experiments.AddPlot(ctx, plt, h.config.PositionsGraph)
 	if err != nil {
 		return errors.Annotate(err, "failed to add a position plot for '%s'",
 			p.Ticker)
@@ -130,6 +218,9 @@ func (h *Hold) AddTotal(ctx context.Context) error {
 		data[i] = totalMap[k]
 	}
 	h.total = stats.NewTimeseries(dates, data)
+	if h.config.TotalGraph == "" {
+		return nil
+	}
 	p, err := plot.NewSeriesPlot(h.total)
 	if err != nil {
 		return errors.Annotate(err, "failed to create plot 'Porftolio'")
@@ -138,8 +229,215 @@ func (h *Hold) AddTotal(ctx context.Context) error {
 	if h.config.TotalAxis == "left" {
 		p.SetLeftAxis(true)
 	}
-	if err := plot.Add(ctx, p, h.config.TotalGraph); err != nil {
+	if err := experiments.AddPlot(ctx, p, h.config.TotalGraph); err != nil {
 		return errors.Annotate(err, "failed to add a plot for portfolio total")
 	}
 	return nil
 }
+
+// AddBenchmark plots the benchmark scaled to the initial portfolio value and
+// the relative portfolio performance, and adds the performance values for both
+// the portfolio and the benchmark over their common dates.
+func (h *Hold) AddBenchmark(ctx context.Context) error {
+	rows, err := h.config.Reader.Prices(h.config.Benchmark)
+	if err != nil {
+		return errors.Annotate(err, "cannot load prices for benchmark '%s'",
+			h.config.Benchmark)
+	}
+	bench := stats.NewTimeseriesFromPrices(rows, stats.PriceCloseFullyAdjusted)
+	tss := stats.TimeseriesIntersect(h.total, bench)
+	total, bench := tss[0], tss[1]
+	if len(total.Data()) == 0 {
+		return errors.Reason("no common dates for the portfolio and benchmark '%s'",
+			h.config.Benchmark)
+	}
+	if bench.Data()[0] == 0 {
+		return errors.Reason("benchmark '%s' starts at 0", h.config.Benchmark)
+	}
+	bench = bench.MultC(total.Data()[0] / bench.Data()[0])
+
+	if h.config.TotalGraph != "" {
+		p, err := plot.NewSeriesPlot(bench)
+		if err != nil {
+			return errors.Annotate(err, "failed to create benchmark plot")
+		}
+		p.SetYLabel("price").SetLegend(h.config.Benchmark)
+		if h.config.TotalAxis == "left" {
+			p.SetLeftAxis(true)
+		}
+		if err := experiments.AddPlot(ctx, p, h.config.TotalGraph); err != nil {
+			return errors.Annotate(err, "failed to add a plot for benchmark")
+		}
+	}
+	if h.config.RelativeGraph != "" {
+		relative := make([]float64, len(total.Data()))
+		for i, v := range total.Data() {
+			relative[i] = v / bench.Data()[i]
+		}
+		ts := stats.NewTimeseries(total.Dates(), relative)
+		legend := "Portfolio / " + h.config.Benchmark
+		p, err := plot.NewSeriesPlot(ts)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", legend)
+		}
+		p.SetYLabel("relative").SetLegend(legend)
+		if err := experiments.AddPlot(ctx, p, h.config.RelativeGraph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", legend)
+		}
+	}
+	if err := h.addPerformance(ctx, "portfolio", total); err != nil {
+		return errors.Annotate(err, "failed to add portfolio performance")
+	}
+	if err := h.addPerformance(ctx, h.config.Benchmark, bench); err != nil {
+		return errors.Annotate(err, "failed to add benchmark performance")
+	}
+	return nil
+}
+
+// performance of a value series.
+type performance struct {
+	totalReturn float64 // last/first - 1
+	cagr        float64 // compounded annual growth rate
+	maxDrawdown float64 // the largest relative drop from a previous maximum
+	sharpe      float64 // annualized, assuming 252 trading days and 0 risk-free rate
+}
+
+func computePerformance(ts *stats.Timeseries) performance {
+	var res performance
+	data := ts.Data()
+	dates := ts.Dates()
+	if len(data) < 2 || data[0] == 0 {
+		return res
+	}
+	n := len(data)
+	res.totalReturn = data[n-1]/data[0] - 1
+	days := dates[n-1].ToTime().Sub(dates[0].ToTime()).Hours() / 24
+	if days > 0 && data[n-1] > 0 {
+		res.cagr = math.Pow(data[n-1]/data[0], 365.25/days) - 1
+	}
+	peak := data[0]
+	returns := make([]float64, 0, n-1)
+	for i, v := range data {
+		if v > peak {
+			peak = v
+		}
+		if peak > 0 && 1-v/peak > res.maxDrawdown {
+			res.maxDrawdown = 1 - v/peak
+		}
+		if i > 0 && data[i-1] != 0 {
+			returns = append(returns, v/data[i-1]-1)
+		}
+	}
+	sample := stats.NewSample(returns)
+	if sigma := sample.Sigma(); sigma > 0 {
+		res.sharpe = sample.Mean() / sigma * math.Sqrt(252)
+	}
+	return res
+}
+
+func (h *Hold) addPerformance(ctx context.Context, name string, ts *stats.Timeseries) error {
+	p := computePerformance(ts)
+	values := []struct {
+		key   string
+		value experiments.Value
+	}{
+		{"total return", experiments.FloatValue(100 * p.totalReturn).WithUnit("%")},
+		{"CAGR", experiments.FloatValue(100 * p.cagr).WithUnit("%")},
+		{"max drawdown", experiments.FloatValue(100 * p.maxDrawdown).WithUnit("%")},
+		{"Sharpe", experiments.FloatValue(p.sharpe)},
+	}
+	for _, v := range values {
+		k := name + " " + v.key
+		if err := experiments.AddTypedValue(ctx, h.config.ID, k, v.value); err != nil {
+			return errors.Annotate(err, "failed to add value '%s'", k)
+		}
+	}
+	return nil
+}
+
+// irr is the annualized money-weighted return: the rate r at which the flows
+// compounded till the end date grow to the final value. Assumes positive flows.
+func irr(flows map[db.Date]float64, end db.Date, final float64) (float64, bool) {
+	f := func(r float64) float64 {
+		var v float64
+		for d, x := range flows {
+			v += x * math.Pow(1+r, d.YearsTill(end))
+		}
+		return v - final
+	}
+	low, high := -0.9999, 100.0
+	if f(low) > 0 || f(high) < 0 {
+		return 0, false
+	}
+	for i := 0; i < 200 && high-low > 1e-12; i++ {
+		mid := (low + high) / 2
+		if f(mid) > 0 {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+	return (low + high) / 2, true
+}
+
+// twr is the annualized time-weighted return of the value series, excluding
+// the effect of the flows, which are assumed to be invested at the close of
+// their dates.
+func twr(ts *stats.Timeseries, flows map[db.Date]float64) (float64, bool) {
+	data := ts.Data()
+	dates := ts.Dates()
+	if len(data) < 2 {
+		return 0, false
+	}
+	growth := 1.0
+	for i := 1; i < len(data); i++ {
+		if data[i-1] == 0 {
+			return 0, false
+		}
+		growth *= (data[i] - flows[dates[i]]) / data[i-1]
+	}
+	years := dates[0].YearsTill(dates[len(dates)-1])
+	if years <= 0 || growth <= 0 {
+		return 0, false
+	}
+	return math.Pow(growth, 1/years) - 1, true
+}
+
+// addReturns adds the values for the invested amount, the final value, and the
+// money-weighted and time-weighted returns of the portfolio.
+func (h *Hold) addReturns(ctx context.Context) error {
+	data := h.total.Data()
+	if len(data) == 0 {
+		return errors.Reason("no portfolio data")
+	}
+	end := h.total.Dates()[len(data)-1]
+	final := data[len(data)-1]
+	var invested float64
+	for _, x := range h.flows {
+		invested += x
+	}
+	// A return which cannot be computed is NaN.
+	percent := func(x float64, ok bool) experiments.Value {
+		if !ok {
+			x = math.NaN()
+		}
+		return experiments.FloatValue(100 * x).WithUnit("%")
+	}
+	mwr, mwrOK := irr(h.flows, end, final)
+	tw, twOK := twr(h.total, h.flows)
+	values := []struct {
+		key   string
+		value experiments.Value
+	}{
+		{"invested", experiments.FloatValue(invested)},
+		{"final value", experiments.FloatValue(final)},
+		{"money-weighted return", percent(mwr, mwrOK)},
+		{"time-weighted return", percent(tw, twOK)},
+	}
+	for _, v := range values {
+		if err := experiments.AddTypedValue(ctx, h.config.ID, v.key, v.value); err != nil {
+			return errors.Annotate(err, "failed to add value '%s'", v.key)
+		}
+	}
+	return nil
+}
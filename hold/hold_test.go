@@ -24,6 +24,8 @@ import (
 	"github.com/stockparfait/logging"
 	"github.com/stockparfait/stockparfait/db"
 	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/testutil"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -49,6 +51,9 @@ func TestHold(t *testing.T) {
 		tickers := map[string]db.TickerRow{
 			"A": {},
 			"B": {},
+			"C": {},
+			"D": {},
+			"E": {},
 		}
 		prices := map[string][]db.PriceRow{
 			"A": {
@@ -61,6 +66,22 @@ func TestHold(t *testing.T) {
 				db.TestPrice(db.NewDate(2019, 1, 2), 110.0, 110.0, 110.0, 110.0, true),
 				db.TestPrice(db.NewDate(2019, 1, 3), 120.0, 120.0, 120.0, 120.0, true),
 			},
+			"C": {
+				db.TestPrice(db.NewDate(2019, 1, 1), 50.0, 50.0, 50.0, 100.0, true),
+				db.TestPrice(db.NewDate(2019, 1, 2), 45.0, 45.0, 45.0, 100.0, true),
+				db.TestPrice(db.NewDate(2019, 1, 3), 55.0, 55.0, 55.0, 100.0, true),
+			},
+			"D": {
+				db.TestPrice(db.NewDate(2019, 1, 31), 10.0, 10.0, 10.0, 100.0, true),
+				db.TestPrice(db.NewDate(2019, 2, 1), 10.0, 10.0, 10.0, 100.0, true),
+				db.TestPrice(db.NewDate(2019, 3, 1), 20.0, 20.0, 20.0, 100.0, true),
+			},
+			// Dividend of 2.0 on 2019-01-03.
+			"E": {
+				db.TestPrice(db.NewDate(2019, 1, 2), 100.0, 100.0, 98.0, 100.0, true),
+				db.TestPrice(db.NewDate(2019, 1, 3), 98.0, 98.0, 98.0, 100.0, true),
+				db.TestPrice(db.NewDate(2019, 1, 4), 99.0, 99.0, 99.0, 100.0, true),
+			},
 		}
 
 		w := db.NewWriter(tmpdir, dbName)
@@ -115,5 +136,116 @@ func TestHold(t *testing.T) {
 				ChartType: plot.ChartLine,
 			},
 		})
+
+		Convey("with benchmark", func() {
+			bg, err := canvas.EnsureGraph(plot.KindSeries, "bg", "plots")
+			So(err, ShouldBeNil)
+			rg, err := canvas.EnsureGraph(plot.KindSeries, "rg", "plots")
+			So(err, ShouldBeNil)
+			cfg := &config.Hold{
+				ID:            "h",
+				Reader:        db.NewReader(tmpdir, dbName),
+				Positions:     []config.HoldPosition{{Ticker: "A", Shares: 2.0}},
+				TotalGraph:    "bg",
+				Benchmark:     "C",
+				RelativeGraph: "rg",
+			}
+			var h Hold
+			So(h.Run(ctx, cfg), ShouldBeNil)
+			So(len(bg.Plots), ShouldEqual, 2)
+			So(bg.Plots[1].Legend, ShouldEqual, "C")
+			So(testutil.RoundSlice(bg.Plots[1].Y, 5), ShouldResemble,
+				[]float64{20, 18, 22})
+			So(len(rg.Plots), ShouldEqual, 1)
+			So(rg.Plots[0].Legend, ShouldEqual, "Portfolio / C")
+			So(testutil.RoundSlice(rg.Plots[0].Y, 5), ShouldResemble,
+				[]float64{1, 1.2222, 1.0909})
+			So(values["h portfolio total return"], ShouldEqual, "20 %")
+			So(values["h portfolio max drawdown"], ShouldEqual, "0 %")
+			So(values["h C total return"], ShouldEqual, "10 %")
+			So(values["h C max drawdown"], ShouldEqual, "10 %")
+			So(values["h C Sharpe"], ShouldEqual, "6.021")
+		})
+
+		Convey("with dividends", func() {
+			tg, err := canvas.EnsureGraph(plot.KindSeries, "div", "plots")
+			So(err, ShouldBeNil)
+			cfg := &config.Hold{
+				ID:                "h",
+				Reader:            db.NewReader(tmpdir, dbName),
+				Positions:         []config.HoldPosition{{Ticker: "E", Shares: 1.0}},
+				TotalGraph:        "div",
+				ReinvestDividends: true,
+			}
+
+			Convey("reinvested", func() {
+				var h Hold
+				So(h.Run(ctx, cfg), ShouldBeNil)
+				So(tg.Plots[0].Y, ShouldResemble, []float64{98, 98, 99})
+			})
+
+			Convey("in cash", func() {
+				cfg.ReinvestDividends = false
+				var h Hold
+				So(h.Run(ctx, cfg), ShouldBeNil)
+				So(testutil.RoundSlice(tg.Plots[0].Y, 5), ShouldResemble,
+					[]float64{100, 100, 101})
+			})
+
+			Convey("raw prices", func() {
+				cfg.RawPrices = true
+				var h Hold
+				So(h.Run(ctx, cfg), ShouldBeNil)
+				So(tg.Plots[0].Y, ShouldResemble, []float64{100, 98, 99})
+			})
+		})
+
+		Convey("with contributions", func() {
+			tg, err := canvas.EnsureGraph(plot.KindSeries, "dca", "plots")
+			So(err, ShouldBeNil)
+			cfg := &config.Hold{
+				ID:            "h",
+				Reader:        db.NewReader(tmpdir, dbName),
+				Positions:     []config.HoldPosition{{Ticker: "D", Shares: 1.0}},
+				TotalGraph:    "dca",
+				Contributions: &config.HoldContributions{Amount: 10, Frequency: "monthly"},
+			}
+			var h Hold
+			So(h.Run(ctx, cfg), ShouldBeNil)
+			So(len(tg.Plots), ShouldEqual, 1)
+			So(tg.Plots[0].Y, ShouldResemble, []float64{10, 20, 50})
+			So(values["h invested"], ShouldEqual, "30")
+			So(values["h final value"], ShouldEqual, "50")
+		})
+	})
+}
+
+func TestReturns(t *testing.T) {
+	t.Parallel()
+
+	Convey("irr works", t, func() {
+		r, ok := irr(map[db.Date]float64{db.NewDate(2019, 1, 1): 100},
+			db.NewDate(2020, 1, 1), 110)
+		So(ok, ShouldBeTrue)
+		So(r, ShouldAlmostEqual, 0.1, 1e-9)
+
+		r, ok = irr(map[db.Date]float64{
+			db.NewDate(2019, 1, 1): 100,
+			db.NewDate(2020, 1, 1): 100,
+		}, db.NewDate(2021, 1, 1), 231)
+		So(ok, ShouldBeTrue)
+		So(r, ShouldAlmostEqual, 0.1, 1e-9)
+	})
+
+	Convey("twr works", t, func() {
+		ts := stats.NewTimeseries(
+			[]db.Date{db.NewDate(2019, 1, 1), db.NewDate(2020, 1, 1), db.NewDate(2021, 1, 1)},
+			[]float64{100, 210, 231})
+		r, ok := twr(ts, map[db.Date]float64{
+			db.NewDate(2019, 1, 1): 100,
+			db.NewDate(2020, 1, 1): 100,
+		})
+		So(ok, ShouldBeTrue)
+		So(r, ShouldAlmostEqual, 0.1, 1e-9)
 	})
 }
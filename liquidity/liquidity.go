@@ -0,0 +1,277 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package liquidity is an experiment with the intraday liquidity curve.
+//
+// It computes the average absolute log-profit of intraday bars and the average
+// share of the daily volume for each time-of-day bucket. Running it on both
+// real intraday data and the synthetic intraday generator helps calibrate the
+// generator's time-of-day behavior.
+package liquidity
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Liquidity struct {
+	config  *config.Liquidity
+	context context.Context
+}
+
+var _ experiments.Experiment = &Liquidity{}
+
+func (e *Liquidity) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Liquidity) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Liquidity) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Liquidity); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	var it iterator.IteratorCloser[*jobResult]
+	var err error
+	if e.config.Data.DB != nil {
+		it, err = experiments.SourceMapPrices(ctx, e.config.Data, e.processPrices)
+	} else {
+		it, err = experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	}
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j2.Merge(j1) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, e.newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+type jobResult struct {
+	absSums    []float64 // sums of |log-profit| by bucket
+	counts     []int     // number of log-profits by bucket
+	volShares  []float64 // sums of daily volume shares by bucket
+	volDays    int       // number of ticker-days with non-zero volume
+	numTickers int
+	samples    int
+	tickers    []tickerCurve // only with "tickers graph"
+}
+
+// tickerCurve is the mean |log-profit| curve of a single ticker.
+type tickerCurve struct {
+	ticker  string
+	absSums []float64
+	counts  []int
+}
+
+func (e *Liquidity) buckets() int {
+	return int(math.Ceil(24 * 60 / float64(e.config.Resolution)))
+}
+
+func (e *Liquidity) bucket(d db.Date) int {
+	return int(d.Time) / (e.config.Resolution * 60_000)
+}
+
+func (e *Liquidity) newJobResult() *jobResult {
+	n := e.buckets()
+	return &jobResult{
+		absSums:   make([]float64, n),
+		counts:    make([]int, n),
+		volShares: make([]float64, n),
+	}
+}
+
+// Merge j2 into j and return j.
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	for i := range j.absSums {
+		j.absSums[i] += j2.absSums[i]
+		j.counts[i] += j2.counts[i]
+		j.volShares[i] += j2.volShares[i]
+	}
+	j.volDays += j2.volDays
+	j.numTickers += j2.numTickers
+	j.samples += j2.samples
+	j.tickers = append(j.tickers, j2.tickers...)
+	return j
+}
+
+// addLogProfits accumulates |log-profit| by bucket. The first log-profit of
+// each day except the very first one is relative to the previous close, and
+// is skipped unless configured otherwise.
+func (e *Liquidity) addLogProfits(ts *stats.Timeseries, res *jobResult) {
+	dates := ts.Dates()
+	for i, x := range ts.Data() {
+		open := i > 0 && dates[i].Date() != dates[i-1].Date()
+		if open && !e.config.IncludeOpen {
+			continue
+		}
+		b := e.bucket(dates[i])
+		res.absSums[b] += math.Abs(x)
+		res.counts[b]++
+		res.samples++
+	}
+}
+
+// addVolumes accumulates the share of each bar's volume in its day's total.
+func (e *Liquidity) addVolumes(rows []db.PriceRow, res *jobResult) {
+	for start := 0; start < len(rows); {
+		end := start + 1
+		for end < len(rows) && rows[end].Date.Date() == rows[start].Date.Date() {
+			end++
+		}
+		var total float64
+		for _, r := range rows[start:end] {
+			total += float64(r.CashVolume)
+		}
+		if total > 0 {
+			for _, r := range rows[start:end] {
+				res.volShares[e.bucket(r.Date)] += float64(r.CashVolume) / total
+			}
+			res.volDays++
+		}
+		start = end
+	}
+}
+
+// addTicker accumulates the ticker's log-profits into res, and also keeps its
+// own curve when per-ticker curves are requested.
+func (e *Liquidity) addTicker(ticker string, ts *stats.Timeseries, res *jobResult) {
+	if e.config.TickersGraph == "" {
+		e.addLogProfits(ts, res)
+		return
+	}
+	j := e.newJobResult()
+	e.addLogProfits(ts, j)
+	res.Merge(j)
+	res.tickers = append(res.tickers, tickerCurve{
+		ticker:  ticker,
+		absSums: j.absSums,
+		counts:  j.counts,
+	})
+}
+
+func (e *Liquidity) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := e.newJobResult()
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		e.addTicker(lp.Ticker, lp.Timeseries, res)
+		res.numTickers++
+	}
+	return res
+}
+
+func (e *Liquidity) processPrices(prices []experiments.Prices) *jobResult {
+	res := e.newJobResult()
+	for _, p := range prices {
+		if e.context.Err() != nil {
+			break
+		}
+		ts := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceCloseFullyAdjusted)
+		e.addTicker(p.Ticker, ts.LogProfits(1, false), res)
+		e.addVolumes(p.Rows, res)
+		res.numTickers++
+	}
+	return res
+}
+
+// meanAbs returns the time of day in hours and the mean |log-profit| for the
+// non-empty buckets.
+func (e *Liquidity) meanAbs(absSums []float64, counts []int) (xs, ys []float64) {
+	for b, c := range counts {
+		if c > 0 {
+			xs = append(xs, float64(b*e.config.Resolution)/60)
+			ys = append(ys, absSums[b]/float64(c))
+		}
+	}
+	return
+}
+
+func (e *Liquidity) processTotal(total *jobResult) error {
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(total.samples)); err != nil {
+		return errors.Annotate(err, "failed to add value for number of samples")
+	}
+	hours := func(b int) float64 { return float64(b*e.config.Resolution) / 60 }
+	xs, ys := e.meanAbs(total.absSums, total.counts)
+	if err := e.plot(xs, ys, "mean |log-profit|", e.config.ReturnsGraph); err != nil {
+		return errors.Annotate(err, "failed to plot returns")
+	}
+	sort.Slice(total.tickers, func(i, j int) bool {
+		return total.tickers[i].ticker < total.tickers[j].ticker
+	})
+	for _, t := range total.tickers {
+		xs, ys := e.meanAbs(t.absSums, t.counts)
+		if err := e.plotTicker(xs, ys, t.ticker); err != nil {
+			return errors.Annotate(err, "failed to plot returns for %s", t.ticker)
+		}
+	}
+	xs, ys = nil, nil
+	if total.volDays > 0 {
+		for b, s := range total.volShares {
+			if s > 0 {
+				xs = append(xs, hours(b))
+				ys = append(ys, s/float64(total.volDays))
+			}
+		}
+	}
+	if err := e.plot(xs, ys, "volume share", e.config.VolumeGraph); err != nil {
+		return errors.Annotate(err, "failed to plot volume")
+	}
+	return nil
+}
+
+func (e *Liquidity) plot(xs, ys []float64, legend, graph string) error {
+	return e.plotWithLabel(xs, ys, legend, legend, graph)
+}
+
+// plotTicker plots the mean |log-profit| curve of a single ticker.
+func (e *Liquidity) plotTicker(xs, ys []float64, ticker string) error {
+	return e.plotWithLabel(xs, ys, ticker, "mean |log-profit|", e.config.TickersGraph)
+}
+
+func (e *Liquidity) plotWithLabel(xs, ys []float64, legend, yLabel, graph string) error {
+	if graph == "" || len(xs) == 0 {
+		return nil
+	}
+	plt, err := plot.NewXYPlot(xs, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	plt.SetLegend(e.Prefix(legend)).SetYLabel(yLabel)
+	if err := experiments.AddPlot(e.context, plt, graph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	return nil
+}
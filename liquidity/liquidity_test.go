@@ -0,0 +1,158 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package liquidity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLiquidity(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_liquidity")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Liquidity experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		returnsGraph, err := canvas.EnsureGraph(plot.KindXY, "returns", "g")
+		So(err, ShouldBeNil)
+		volumeGraph, err := canvas.EnsureGraph(plot.KindXY, "volume", "g")
+		So(err, ShouldBeNil)
+
+		Convey("with synthetic data", func() {
+			var cfg config.Liquidity
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t"},
+    "intraday distribution": {"name": "t"},
+    "intraday resolution": 30,
+    "intraday range": {"start": "12:00", "end": "13:00"},
+    "days": 2
+  },
+  "returns graph": "returns",
+  "volume graph": "volume"
+}`)), ShouldBeNil)
+			var e Liquidity
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values, ShouldResemble, experiments.Values{
+				"test tickers": "1",
+				"test samples": "4",
+			})
+			So(len(returnsGraph.Plots), ShouldEqual, 1)
+			So(returnsGraph.Plots[0].X, ShouldResemble, []float64{12.5, 13})
+			So(len(volumeGraph.Plots), ShouldEqual, 0)
+		})
+
+		Convey("with per ticker curves", func() {
+			tickersGraph, err := canvas.EnsureGraph(plot.KindXY, "tickers", "g")
+			So(err, ShouldBeNil)
+			var cfg config.Liquidity
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t"},
+    "intraday distribution": {"name": "t"},
+    "intraday resolution": 30,
+    "intraday range": {"start": "12:00", "end": "13:00"},
+    "tickers": 2,
+    "days": 2
+  },
+  "returns graph": "returns",
+  "tickers graph": "tickers"
+}`)), ShouldBeNil)
+			var e Liquidity
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values, ShouldResemble, experiments.Values{
+				"test tickers": "2",
+				"test samples": "8",
+			})
+			So(len(returnsGraph.Plots), ShouldEqual, 1)
+			So(len(tickersGraph.Plots), ShouldEqual, 2)
+			So(tickersGraph.Plots[0].Legend, ShouldEqual, "test synthetic")
+			So(tickersGraph.Plots[0].X, ShouldResemble, []float64{12.5, 13})
+			So(tickersGraph.Plots[1].X, ShouldResemble, []float64{12.5, 13})
+		})
+
+		Convey("with DB data", func() {
+			dbName := "db"
+			tickers := map[string]db.TickerRow{"A": {}}
+			pr := func(date string, p, v float32) db.PriceRow {
+				d, err := db.NewDateFromString(date)
+				if err != nil {
+					panic(err)
+				}
+				return db.TestPrice(d, p, p, p, v, true)
+			}
+			prices := map[string][]db.PriceRow{
+				"A": {
+					pr("2020-01-02 10:00:00", 100, 100),
+					pr("2020-01-02 10:30:00", 110, 300),
+					pr("2020-01-03 10:00:00", 110, 200),
+					pr("2020-01-03 10:30:00", 99, 200),
+				},
+			}
+			w := db.NewWriter(tmpdir, dbName)
+			So(w.WriteTickers(tickers), ShouldBeNil)
+			for t, p := range prices {
+				So(w.WritePrices(t, p), ShouldBeNil)
+			}
+
+			var cfg config.Liquidity
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "returns graph": "returns",
+  "volume graph": "volume"
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e Liquidity
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values, ShouldResemble, experiments.Values{
+				"test tickers": "1",
+				"test samples": "2",
+			})
+			So(len(returnsGraph.Plots), ShouldEqual, 1)
+			So(returnsGraph.Plots[0].X, ShouldResemble, []float64{10.5})
+			So(testutil.Round(returnsGraph.Plots[0].Y[0], 5), ShouldEqual, 0.1003)
+			So(len(volumeGraph.Plots), ShouldEqual, 1)
+			So(volumeGraph.Plots[0].X, ShouldResemble, []float64{10, 10.5})
+			So(volumeGraph.Plots[0].Y, ShouldResemble, []float64{0.375, 0.625})
+		})
+	})
+}
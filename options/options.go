@@ -0,0 +1,205 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package options is an experiment with simple option overlays, such as covered
+// calls and protective puts, over the price paths of the stocks.
+package options
+
+import (
+	"context"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Options struct {
+	config  *config.Options
+	context context.Context
+}
+
+var _ experiments.Experiment = &Options{}
+
+func (e *Options) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Options) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Options) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Options); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	it, err := experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j1.Merge(j2) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, e.newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+type jobResult struct {
+	overlay    *stats.Histogram // per-period log-profits with the overlay
+	hold       *stats.Histogram // per-period buy-and-hold log-profits
+	sumOverlay float64
+	sumHold    float64
+	sumPremium float64 // option premiums as a fraction of the price
+	periods    int
+	numTickers int
+}
+
+func (e *Options) newJobResult() *jobResult {
+	return &jobResult{
+		overlay: stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.Plot)),
+		hold:    stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.Plot)),
+	}
+}
+
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	j.overlay.AddHistogram(j2.overlay)
+	j.hold.AddHistogram(j2.hold)
+	j.sumOverlay += j2.sumOverlay
+	j.sumHold += j2.sumHold
+	j.sumPremium += j2.sumPremium
+	j.periods += j2.periods
+	j.numTickers += j2.numTickers
+	return j
+}
+
+// normCDF is the standard normal cumulative distribution function.
+func normCDF(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+// blackScholes price of a European call or put option with the current price
+// s, strike k, time to expiration t in years, the continuously compounded
+// risk-free rate r and the annualized volatility sigma.
+func blackScholes(s, k, t, r, sigma float64, call bool) float64 {
+	df := math.Exp(-r * t)
+	if sigma <= 0 || t <= 0 {
+		if call {
+			return math.Max(s-k*df, 0)
+		}
+		return math.Max(k*df-s, 0)
+	}
+	v := sigma * math.Sqrt(t)
+	d1 := (math.Log(s/k) + (r+sigma*sigma/2)*t) / v
+	d2 := d1 - v
+	if call {
+		return s*normCDF(d1) - k*df*normCDF(d2)
+	}
+	return k*df*normCDF(-d2) - s*normCDF(-d1)
+}
+
+// overlay computes the log-profit of the option strategy over a single period
+// with the log-profit of the stock lp and the option premium per unit price.
+func (e *Options) overlay(lp, premium float64) float64 {
+	st := math.Exp(lp) // price at expiration, relative to the start price
+	k := e.config.Moneyness
+	if e.config.Strategy == "protective put" {
+		return math.Log((st + math.Max(k-st, 0)) / (1 + premium))
+	}
+	return math.Log((st - math.Max(st-k, 0)) / (1 - premium))
+}
+
+func (e *Options) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := e.newJobResult()
+	n := e.config.Period
+	t := float64(n) / 252
+	call := e.config.Strategy == "covered call"
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		data := lp.Timeseries.Data()
+		if len(data) < n {
+			logging.Debugf(e.context, "skipping %s: too few samples: %d",
+				lp.Ticker, len(data))
+			continue
+		}
+		sigma := e.config.Volatility
+		if sigma == 0 {
+			sigma = stats.NewSample(data).Sigma() * math.Sqrt(252)
+		}
+		premium := blackScholes(1, e.config.Moneyness, t, e.config.Rate, sigma, call)
+		for i := 0; i+n <= len(data); i += n {
+			var sum float64
+			for _, x := range data[i : i+n] {
+				sum += x
+			}
+			o := e.overlay(sum, premium)
+			res.overlay.Add(o)
+			res.hold.Add(sum)
+			res.sumOverlay += o
+			res.sumHold += sum
+			res.sumPremium += premium
+			res.periods++
+		}
+		res.numTickers++
+	}
+	return res
+}
+
+func (e *Options) processTotal(total *jobResult) error {
+	err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	err = experiments.AddTypedValue(e.context, e.config.ID, "periods", experiments.IntValue(total.periods))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of periods")
+	}
+	if total.periods == 0 {
+		logging.Warningf(e.context, "no periods of %d days", e.config.Period)
+		return nil
+	}
+	n := float64(total.periods)
+	for _, v := range []struct {
+		key   string
+		value float64
+	}{
+		{"mean premium", total.sumPremium / n},
+		{"mean " + e.config.Strategy + " log-profit", total.sumOverlay / n},
+		{"mean buy-and-hold log-profit", total.sumHold / n},
+	} {
+		err := experiments.AddTypedValue(e.context, e.config.ID, v.key, experiments.FloatValue(v.value))
+		if err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", v.key)
+		}
+	}
+	c := e.config.Plot
+	dist := stats.NewHistogramDistribution(total.overlay)
+	if err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, e.config.Strategy); err != nil {
+		return errors.Annotate(err, "failed to plot %s", e.config.Strategy)
+	}
+	dist = stats.NewHistogramDistribution(total.hold)
+	if err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, "buy-and-hold"); err != nil {
+		return errors.Annotate(err, "failed to plot buy-and-hold")
+	}
+	return nil
+}
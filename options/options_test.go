@@ -0,0 +1,128 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_options")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("blackScholes works", t, func() {
+		So(testutil.Round(blackScholes(100, 100, 1, 0.05, 0.2, true), 5),
+			ShouldEqual, 10.451)
+		So(testutil.Round(blackScholes(100, 100, 1, 0.05, 0.2, false), 5),
+			ShouldEqual, 5.5735)
+		So(blackScholes(100, 90, 1, 0, 0, true), ShouldEqual, 10)
+		So(blackScholes(100, 90, 1, 0, 0, false), ShouldEqual, 0)
+	})
+
+	Convey("Options experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		graph, err := canvas.EnsureGraph(plot.KindXY, "dist", "g")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"A": {}}
+		var prices []db.PriceRow
+		for i, p := range []float32{100, 110, 99, 99, 121} {
+			d := db.NewDate(2020, 1, uint8(i+1))
+			prices = append(prices, db.TestPrice(d, p, p, p, 1000, true))
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		So(w.WritePrices("A", prices), ShouldBeNil)
+
+		Convey("covered call", func() {
+			var cfg config.Options
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "period": 2,
+  "volatility": 0.2,
+  "plot": {"graph": "dist", "buckets": {"n": 5, "min": -0.5, "max": 0.5}}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e Options
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			premium := blackScholes(1, 1, 2.0/252, 0, 0.2, true)
+			// Periods end at 0.99 and 1.2222 (capped at the strike of 1.0).
+			overlay := (math.Log(0.99/(1-premium)) + math.Log(1/(1-premium))) / 2
+			hold := (math.Log(0.99) + math.Log(121.0/99.0)) / 2
+			So(values["test tickers"], ShouldEqual, "1")
+			So(values["test periods"], ShouldEqual, "2")
+			So(values["test mean premium"], ShouldEqual, fmt.Sprintf("%.4g", premium))
+			So(values["test mean covered call log-profit"], ShouldEqual,
+				fmt.Sprintf("%.4g", overlay))
+			So(values["test mean buy-and-hold log-profit"], ShouldEqual,
+				fmt.Sprintf("%.4g", hold))
+			So(len(graph.Plots), ShouldEqual, 2)
+			So(graph.Plots[0].Legend, ShouldEqual, "test covered call p.d.f.")
+			So(graph.Plots[1].Legend, ShouldEqual, "test buy-and-hold p.d.f.")
+		})
+
+		Convey("protective put", func() {
+			var cfg config.Options
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "strategy": "protective put",
+  "moneyness": 0.95,
+  "period": 2,
+  "plot": {"graph": "dist"}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e Options
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test periods"], ShouldEqual, "2")
+			So(len(graph.Plots), ShouldEqual, 2)
+			So(graph.Plots[0].Legend, ShouldEqual, "test protective put p.d.f.")
+		})
+
+		Convey("config requires a plot", func() {
+			var cfg config.Options
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "data": {"daily distribution": {"name": "t"}}
+}`)), ShouldNotBeNil)
+		})
+	})
+}
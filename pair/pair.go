@@ -0,0 +1,169 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pair is an experiment with the rolling correlation and beta of a
+// pair of price series.
+package pair
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+	"gonum.org/v1/gonum/stat"
+)
+
+type Pair struct {
+	config  *config.Pair
+	context context.Context
+}
+
+var _ experiments.Experiment = &Pair{}
+
+func (e *Pair) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Pair) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Pair) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Pair); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	x, err := e.series(e.config.X)
+	if err != nil {
+		return errors.Annotate(err, "failed to get X series")
+	}
+	y, err := e.series(e.config.Y)
+	if err != nil {
+		return errors.Annotate(err, "failed to get Y series")
+	}
+	tss := stats.TimeseriesIntersect(x, y)
+	if err := e.processPair(tss[0], tss[1]); err != nil {
+		return errors.Annotate(err, "failed to process the pair")
+	}
+	return nil
+}
+
+// series reads the log-profits of a single price series.
+func (e *Pair) series(c *config.Source) (*stats.Timeseries, error) {
+	it, err := experiments.Source(e.context, c)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to get price series")
+	}
+	lps := iterator.ToSlice[experiments.LogProfits](it)
+	it.Close()
+	if len(lps) != 1 {
+		return nil, errors.Reason("expected exactly one series, got %d", len(lps))
+	}
+	return lps[0].Timeseries, nil
+}
+
+// correlation and beta of ys relative to xs. When the last result is false,
+// the values are undefined.
+func correlation(xs, ys []float64) (corr, beta float64, ok bool) {
+	if stats.NewSample(xs).Sigma() == 0 || stats.NewSample(ys).Sigma() == 0 {
+		return 0, 0, false
+	}
+	beta, _, err := experiments.LeastSquares(xs, ys)
+	if err != nil {
+		return 0, 0, false
+	}
+	return stat.Correlation(xs, ys, nil), beta, true
+}
+
+// betaStdErr is the standard error of the regression beta of ys relative to
+// xs, or NaN when it cannot be estimated.
+func betaStdErr(xs, ys []float64) float64 {
+	r, err := experiments.LinearRegression(xs, ys, nil)
+	if err != nil {
+		return math.NaN()
+	}
+	return r.InclineErr
+}
+
+func (e *Pair) processPair(x, y *stats.Timeseries) error {
+	xs, ys := x.Data(), y.Data()
+	if err := experiments.AddTypedValue(e.context, e.config.ID, "samples", experiments.IntValue(len(xs))); err != nil {
+		return errors.Annotate(err, "failed to add value for number of samples")
+	}
+	if corr, beta, ok := correlation(xs, ys); ok {
+		if err := experiments.AddTypedValue(e.context, e.config.ID, "correlation", experiments.FloatValue(corr)); err != nil {
+			return errors.Annotate(err, "failed to add value for correlation")
+		}
+		if err := experiments.AddTypedValue(e.context, e.config.ID, "beta", experiments.FloatValue(beta)); err != nil {
+			return errors.Annotate(err, "failed to add value for beta")
+		}
+		stderr := experiments.FloatValue(betaStdErr(xs, ys))
+		if err := experiments.AddTypedValue(e.context, e.config.ID, "beta stderr", stderr); err != nil {
+			return errors.Annotate(err, "failed to add value for beta stderr")
+		}
+	}
+	w := e.config.Window
+	var dates []db.Date
+	var corrs, betas []float64
+	for i := w; i <= len(xs); i++ {
+		corr, beta, ok := correlation(xs[i-w:i], ys[i-w:i])
+		if !ok {
+			continue
+		}
+		dates = append(dates, x.Dates()[i-1])
+		corrs = append(corrs, corr)
+		betas = append(betas, beta)
+	}
+	if len(dates) == 0 {
+		return nil
+	}
+	if err := e.plot(stats.NewTimeseries(dates, corrs), "correlation",
+		e.config.CorrelationGraph, e.config.CorrelationPlot); err != nil {
+		return errors.Annotate(err, "failed to plot correlation")
+	}
+	if err := e.plot(stats.NewTimeseries(dates, betas), "beta",
+		e.config.BetaGraph, e.config.BetaPlot); err != nil {
+		return errors.Annotate(err, "failed to plot beta")
+	}
+	return nil
+}
+
+func (e *Pair) plot(ts *stats.Timeseries, name, graph string, c *config.DistributionPlot) error {
+	legend := fmt.Sprintf("rolling %s", name)
+	if graph != "" {
+		plt, err := plot.NewSeriesPlot(ts)
+		if err != nil {
+			return errors.Annotate(err, "failed to create %s plot", legend)
+		}
+		plt.SetLegend(e.Prefix(legend)).SetYLabel(name)
+		if err := experiments.AddPlot(e.context, plt, graph); err != nil {
+			return errors.Annotate(err, "failed to add %s plot", legend)
+		}
+	}
+	if c != nil {
+		dist := experiments.NewSampleDistribution(ts.Data(), c)
+		if err := experiments.PlotDistribution(e.context, dist, c, e.config.ID, legend); err != nil {
+			return errors.Annotate(err, "failed to plot %s distribution", legend)
+		}
+	}
+	return nil
+}
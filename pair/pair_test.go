@@ -0,0 +1,114 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pair
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPair(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_pair")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Pair experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		corrGraph, err := canvas.EnsureGraph(plot.KindSeries, "corr", "s")
+		So(err, ShouldBeNil)
+		betaDistGraph, err := canvas.EnsureGraph(plot.KindXY, "beta dist", "d")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"X": {}, "Y": {}}
+		pr := func(date string, p float32) db.PriceRow {
+			d, err := db.NewDateFromString(date)
+			if err != nil {
+				panic(err)
+			}
+			return db.TestPrice(d, p, p, p, 1000.0, true)
+		}
+		// Y's log-profits are exactly twice X's.
+		prices := map[string][]db.PriceRow{
+			"X": {
+				pr("2020-01-01", 100),
+				pr("2020-01-02", 110),
+				pr("2020-01-03", 99),
+				pr("2020-01-06", 108.9),
+				pr("2020-01-07", 98.01),
+			},
+			"Y": {
+				pr("2020-01-01", 100),
+				pr("2020-01-02", 121),
+				pr("2020-01-03", 98.01),
+				pr("2020-01-06", 118.5921),
+				pr("2020-01-07", 96.059601),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		var cfg config.Pair
+		So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "x": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["X"]}},
+  "y": {"DB": {"DB path": "%[1]s", "DB": "%[2]s", "tickers": ["Y"]}},
+  "window": 3,
+  "correlation graph": "corr",
+  "beta plot": {"graph": "beta dist"}
+}`, tmpdir, dbName))), ShouldBeNil)
+		var e Pair
+		So(e.Run(ctx, &cfg), ShouldBeNil)
+		// The fit is exact up to the float32 precision of the prices.
+		stderr, err := strconv.ParseFloat(values["test beta stderr"], 64)
+		So(err, ShouldBeNil)
+		So(stderr, ShouldBeLessThan, 1e-5)
+		delete(values, "test beta stderr")
+		So(values, ShouldResemble, experiments.Values{
+			"test samples":     "4",
+			"test correlation": "1",
+			"test beta":        "2",
+		})
+		So(len(corrGraph.Plots), ShouldEqual, 1)
+		So(len(corrGraph.Plots[0].Y), ShouldEqual, 2)
+		So(len(betaDistGraph.Plots), ShouldEqual, 1)
+	})
+}
@@ -19,12 +19,15 @@ package portfolio
 import (
 	"context"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/experiments"
 	"github.com/stockparfait/experiments/config"
 	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/stockparfait/stats"
 	"github.com/stockparfait/stockparfait/table"
 )
@@ -57,17 +60,41 @@ func (p *Portfolio) Run(ctx context.Context, cfg config.ExperimentConfig) error
 		return errors.Reason("unexpected config type: %T", cfg)
 	}
 
-	t := table.NewTable(p.header()...)
+	var positions []*position
 	for _, pos := range p.config.Positions {
-		row, err := p.addPosition(ctx, pos)
+		if ctx.Err() != nil {
+			break
+		}
+		ps, err := p.loadPosition(pos)
+		if err != nil {
+			return errors.Annotate(err, "failed to load position for %s", pos.Ticker)
+		}
+		positions = append(positions, ps)
+	}
+	positions, err := p.matchLots(positions)
+	if err != nil {
+		return errors.Annotate(err, "failed to match sales to lots")
+	}
+	totals, err := p.totalValues(positions)
+	if err != nil {
+		return errors.Annotate(err, "failed to compute total portfolio value")
+	}
+	t := table.NewTable(p.header()...)
+	for _, pos := range positions {
+		row, err := p.addPosition(pos, totals)
 		if err != nil {
 			return errors.Annotate(err, "failed to add position for %s", pos.Ticker)
 		}
 		t.AddRow(row)
 	}
-	if err := p.writeTable(t); err != nil {
+	if err := p.writeTable(ctx, t); err != nil {
 		return errors.Annotate(err, "failed to write positions table")
 	}
+	if p.config.ValueGraph != "" {
+		if err := p.plotValue(ctx, positions); err != nil {
+			return errors.Annotate(err, "failed to plot portfolio value")
+		}
+	}
 	return nil
 }
 
@@ -77,6 +104,12 @@ func (p *Portfolio) header() []string {
 		switch c.Kind {
 		case "price", "value":
 			r[i] = fmt.Sprintf("%s %s", c.Kind, c.Date)
+		case "gain", "gain %", "annualized return", "weight", "realized gain", "unrealized gain":
+			if c.Date.IsZero() {
+				r[i] = c.Kind
+			} else {
+				r[i] = fmt.Sprintf("%s %s", c.Kind, c.Date)
+			}
 		default:
 			r[i] = c.Kind
 		}
@@ -93,7 +126,23 @@ func dataOnDate(ts *stats.Timeseries, d db.Date) (float64, error) {
 	return day.Data()[0], nil
 }
 
-func (p *Portfolio) addPosition(ctx context.Context, pos config.PortfolioPosition) (Row, error) {
+// sale of some shares of a lot.
+type sale struct {
+	date     db.Date
+	shares   int
+	proceeds float64
+}
+
+// position with its ticker info and price series. For a purchased lot, it also
+// has the sales matched against it.
+type position struct {
+	config.PortfolioPosition
+	tickerRow db.TickerRow
+	ts        *stats.Timeseries
+	sales     []sale
+}
+
+func (p *Portfolio) loadPosition(pos config.PortfolioPosition) (*position, error) {
 	tr, err := p.config.Reader.TickerRow(pos.Ticker)
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to read ticker info for '%s'", pos.Ticker)
@@ -102,8 +151,175 @@ func (p *Portfolio) addPosition(ctx context.Context, pos config.PortfolioPositio
 	if err != nil {
 		return nil, errors.Annotate(err, "failed to read prices for '%s'", pos.Ticker)
 	}
-	ts := stats.NewTimeseriesFromPrices(prices, stats.PriceCloseSplitAdjusted)
+	return &position{
+		PortfolioPosition: pos,
+		tickerRow:         tr,
+		ts:                stats.NewTimeseriesFromPrices(prices, stats.PriceCloseSplitAdjusted),
+	}, nil
+}
+
+// latest date and price in the Timeseries.
+func latest(ts *stats.Timeseries) (db.Date, float64, error) {
+	if len(ts.Data()) == 0 {
+		return db.Date{}, 0, errors.Reason("no price data")
+	}
+	last := len(ts.Data()) - 1
+	return ts.Dates()[last], ts.Data()[last], nil
+}
+
+// priceOn the given date, or the latest price when the date is zero. Returns
+// the actual date of the price.
+func priceOn(ts *stats.Timeseries, d db.Date) (db.Date, float64, error) {
+	if d.IsZero() {
+		return latest(ts)
+	}
+	price, err := dataOnDate(ts, d)
+	return d, price, err
+}
+
+// costBasis of the lot, or the proceeds of a sale.
+func (pos *position) costBasis() (float64, error) {
+	if pos.CostBasis != 0 {
+		return pos.CostBasis, nil
+	}
+	price, err := dataOnDate(pos.ts, pos.PurchaseDate)
+	if err != nil {
+		return 0, errors.Annotate(err, "no cost basis and no price data")
+	}
+	return price * math.Abs(float64(pos.Shares)), nil
+}
+
+// sharesOn the date held from the lot, net of the sales by that date.
+func (pos *position) sharesOn(d db.Date) int {
+	shares := pos.Shares
+	for _, s := range pos.sales {
+		if !d.Before(s.date) {
+			shares -= s.shares
+		}
+	}
+	return shares
+}
+
+// openShares held from the lot after all the sales.
+func (pos *position) openShares() int {
+	shares := pos.Shares
+	for _, s := range pos.sales {
+		shares -= s.shares
+	}
+	return shares
+}
+
+// gains of the lot on the date at the given price: realized by the sales by
+// that date, and unrealized for the shares still held.
+func (pos *position) gains(d db.Date, price float64) (realized, unrealized float64, err error) {
+	cb, err := pos.costBasis()
+	if err != nil {
+		return 0, 0, err
+	}
+	var perShare float64
+	if pos.Shares != 0 {
+		perShare = cb / float64(pos.Shares)
+	}
+	for _, s := range pos.sales {
+		if !d.Before(s.date) {
+			realized += s.proceeds - perShare*float64(s.shares)
+		}
+	}
+	unrealized = float64(pos.sharesOn(d)) * (price - perShare)
+	return realized, unrealized, nil
+}
 
+// matchLots assigns sales (positions with negative shares) to the purchased
+// lots of the same ticker according to the lot matching method, and returns
+// the lots.
+func (p *Portfolio) matchLots(positions []*position) ([]*position, error) {
+	var lots, sales []*position
+	for _, pos := range positions {
+		if pos.Shares < 0 {
+			sales = append(sales, pos)
+		} else {
+			lots = append(lots, pos)
+		}
+	}
+	sort.SliceStable(sales, func(i, j int) bool {
+		return sales[i].PurchaseDate.Before(sales[j].PurchaseDate)
+	})
+	for _, s := range sales {
+		var candidates []*position
+		for _, l := range lots {
+			if l.Ticker != s.Ticker || s.PurchaseDate.Before(l.PurchaseDate) {
+				continue
+			}
+			if p.config.LotMatching == "specific" && l.Lot != s.Lot {
+				continue
+			}
+			candidates = append(candidates, l)
+		}
+		switch p.config.LotMatching {
+		case "FIFO":
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return candidates[i].PurchaseDate.Before(candidates[j].PurchaseDate)
+			})
+		case "LIFO":
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return candidates[j].PurchaseDate.Before(candidates[i].PurchaseDate)
+			})
+		}
+		proceeds, err := s.costBasis()
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to get proceeds of %s sale on %s",
+				s.Ticker, s.PurchaseDate)
+		}
+		total := -s.Shares
+		remaining := total
+		for _, l := range candidates {
+			if remaining == 0 {
+				break
+			}
+			n := l.openShares()
+			if n > remaining {
+				n = remaining
+			}
+			if n <= 0 {
+				continue
+			}
+			l.sales = append(l.sales, sale{
+				date:     s.PurchaseDate,
+				shares:   n,
+				proceeds: proceeds * float64(n) / float64(total),
+			})
+			remaining -= n
+		}
+		if remaining > 0 {
+			return nil, errors.Reason("selling %d more shares of %s than held on %s",
+				remaining, s.Ticker, s.PurchaseDate)
+		}
+	}
+	return lots, nil
+}
+
+// totalValues of all the positions for each "weight" column, indexed by the
+// column number.
+func (p *Portfolio) totalValues(positions []*position) (map[int]float64, error) {
+	totals := make(map[int]float64)
+	for i, c := range p.config.Columns {
+		if c.Kind != "weight" {
+			continue
+		}
+		for _, pos := range positions {
+			d, price, err := priceOn(pos.ts, c.Date)
+			if err != nil {
+				return nil, errors.Annotate(err, "no price data for %s", pos.Ticker)
+			}
+			totals[i] += price * float64(pos.sharesOn(d))
+		}
+	}
+	return totals, nil
+}
+
+func (p *Portfolio) addPosition(pos *position, totals map[int]float64) (Row, error) {
+	tr := pos.tickerRow
+	ts := pos.ts
 	r := make(Row, len(p.config.Columns))
 	for i, c := range p.config.Columns {
 		switch c.Kind {
@@ -122,13 +338,9 @@ func (p *Portfolio) addPosition(ctx context.Context, pos config.PortfolioPositio
 		case "purchase date":
 			r[i] = pos.PurchaseDate.String()
 		case "cost basis":
-			cb := pos.CostBasis
-			if cb == 0 {
-				price, err := dataOnDate(ts, pos.PurchaseDate)
-				if err != nil {
-					return nil, errors.Annotate(err, "no cost basis and no price data")
-				}
-				cb = price * float64(pos.Shares)
+			cb, err := pos.costBasis()
+			if err != nil {
+				return nil, err
 			}
 			r[i] = fmt.Sprintf("%.2f", cb)
 		case "shares":
@@ -144,7 +356,60 @@ func (p *Portfolio) addPosition(ctx context.Context, pos config.PortfolioPositio
 			if err != nil {
 				return nil, errors.Annotate(err, "no price data")
 			}
-			r[i] = fmt.Sprintf("%.2f", price*float64(pos.Shares))
+			r[i] = fmt.Sprintf("%.2f", price*float64(pos.sharesOn(c.Date)))
+		case "latest price":
+			_, price, err := latest(ts)
+			if err != nil {
+				return nil, err
+			}
+			r[i] = fmt.Sprintf("%.2f", price)
+		case "lot":
+			r[i] = pos.Lot
+		case "open shares":
+			r[i] = fmt.Sprintf("%d", pos.openShares())
+		case "gain", "gain %", "annualized return", "realized gain", "unrealized gain":
+			d, price, err := priceOn(ts, c.Date)
+			if err != nil {
+				return nil, errors.Annotate(err, "no price data")
+			}
+			cb, err := pos.costBasis()
+			if err != nil {
+				return nil, err
+			}
+			realized, unrealized, err := pos.gains(d, price)
+			if err != nil {
+				return nil, err
+			}
+			gain := realized + unrealized
+			switch {
+			case c.Kind == "gain":
+				r[i] = fmt.Sprintf("%.2f", gain)
+			case c.Kind == "realized gain":
+				r[i] = fmt.Sprintf("%.2f", realized)
+			case c.Kind == "unrealized gain":
+				r[i] = fmt.Sprintf("%.2f", unrealized)
+			case cb == 0:
+				r[i] = "" // undefined for a zero cost basis
+			case c.Kind == "gain %":
+				r[i] = fmt.Sprintf("%.2f", 100*gain/cb)
+			default:
+				days := d.ToTime().Sub(pos.PurchaseDate.ToTime()).Hours() / 24
+				if days <= 0 {
+					r[i] = ""
+					break
+				}
+				r[i] = fmt.Sprintf("%.2f", 100*(math.Pow(1+gain/cb, 365.25/days)-1))
+			}
+		case "weight":
+			d, price, err := priceOn(ts, c.Date)
+			if err != nil {
+				return nil, errors.Annotate(err, "no price data")
+			}
+			if totals[i] == 0 {
+				r[i] = ""
+				break
+			}
+			r[i] = fmt.Sprintf("%.2f", 100*price*float64(pos.sharesOn(d))/totals[i])
 		default:
 			return nil, errors.Reason("unsupported column kind: '%s'", c.Kind)
 		}
@@ -152,19 +417,72 @@ func (p *Portfolio) addPosition(ctx context.Context, pos config.PortfolioPositio
 	return r, nil
 }
 
-func (p *Portfolio) writeTable(t *table.Table) error {
+// valueSeries is the mark-to-market value of the positions over time. A
+// position enters the series on its purchase date and is reduced by its sales,
+// and its price is carried forward over the dates when it's missing.
+func valueSeries(positions []*position) *stats.Timeseries {
+	dateSet := make(map[db.Date]struct{})
+	for _, pos := range positions {
+		for _, d := range pos.ts.Dates() {
+			if !d.Before(pos.PurchaseDate) {
+				dateSet[d] = struct{}{}
+			}
+		}
+	}
+	var dates []db.Date
+	for d := range dateSet {
+		dates = append(dates, d)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	data := make([]float64, len(dates))
+	for _, pos := range positions {
+		posDates := pos.ts.Dates()
+		j := -1 // index of the latest price on or before the current date
+		for i, d := range dates {
+			for j+1 < len(posDates) && !d.Before(posDates[j+1]) {
+				j++
+			}
+			if j < 0 || d.Before(pos.PurchaseDate) {
+				continue
+			}
+			data[i] += pos.ts.Data()[j] * float64(pos.sharesOn(d))
+		}
+	}
+	return stats.NewTimeseries(dates, data)
+}
+
+func (p *Portfolio) plotValue(ctx context.Context, positions []*position) error {
+	ts := valueSeries(positions)
+	if len(ts.Data()) == 0 {
+		return errors.Reason("no price data after purchase dates")
+	}
+	legend := p.Prefix("value")
+	plt, err := plot.NewSeriesPlot(ts)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	plt.SetYLabel("value").SetLegend(legend)
+	if err := experiments.AddPlot(ctx, plt, p.config.ValueGraph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	return nil
+}
+
+func (p *Portfolio) writeTable(ctx context.Context, t *table.Table) error {
 	if p.config.File == "" {
 		if err := t.WriteText(os.Stdout, table.Params{}); err != nil {
 			return errors.Annotate(err, "failed to write table to stdout")
 		}
 	} else {
-		f, err := os.OpenFile(p.config.File, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		path := experiments.OutputPath(ctx, p.config.File)
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
-			return errors.Annotate(err, "failed to open output CSV file '%s'", p.config.File)
+			return errors.Annotate(err, "failed to open output CSV file '%s'", path)
 		}
 		defer f.Close()
 		if err = t.WriteCSV(f, table.Params{}); err != nil {
-			return errors.Annotate(err, "failed to write CSV file '%s'", p.config.File)
+			return errors.Annotate(err, "failed to write CSV file '%s'", path)
 		}
 	}
 	return nil
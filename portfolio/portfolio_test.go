@@ -24,6 +24,7 @@ import (
 
 	"github.com/stockparfait/experiments/config"
 	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
 	"github.com/stockparfait/testutil"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -65,11 +66,13 @@ func TestPortfolio(t *testing.T) {
 				db.TestPrice(db.NewDate(2019, 1, 1), 10.0, 10.0, 10.0, 1000.0, true),
 				db.TestPrice(db.NewDate(2019, 1, 2), 12.0, 12.0, 12.0, 1100.0, true),
 				db.TestPrice(db.NewDate(2019, 1, 3), 11.0, 11.0, 11.0, 1200.0, true),
+				db.TestPrice(db.NewDate(2020, 1, 1), 12.375, 12.375, 12.375, 1200.0, true),
 			},
 			"B": {
 				db.TestPrice(db.NewDate(2019, 1, 1), 100.0, 100.0, 100.0, 100.0, true),
 				db.TestPrice(db.NewDate(2019, 1, 2), 120.0, 120.0, 120.0, 110.0, true),
 				db.TestPrice(db.NewDate(2019, 1, 3), 110.0, 110.0, 110.0, 120.0, true),
+				db.TestPrice(db.NewDate(2020, 1, 1), 130.0, 130.0, 130.0, 120.0, true),
 			},
 		}
 
@@ -123,5 +126,156 @@ func TestPortfolio(t *testing.T) {
 					"Industry B", "2019-01-01", "200.00", "2", "110.00", "220.00"},
 			})
 		})
+
+		Convey("Gains and weights on the latest date", func() {
+			var cfg config.Portfolio
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB path": "%s", "DB": "%s"},
+  "file": "%s",
+  "positions": [
+    {"ticker": "A", "purchase date": "2019-01-01", "shares": 10, "cost basis": 99},
+    {"ticker": "B", "purchase date": "2019-01-01", "shares": 2}
+  ],
+  "columns": [
+    {"kind": "ticker"},
+    {"kind": "latest price"},
+    {"kind": "gain"},
+    {"kind": "gain %%"},
+    {"kind": "annualized return"},
+    {"kind": "weight"},
+    {"kind": "weight", "date": "2019-01-03"}
+  ]
+}`, tmpdir, dbName, csvFile))), ShouldBeNil)
+			var pe Portfolio
+			So(pe.Run(ctx, &cfg), ShouldBeNil)
+
+			f, err := os.Open(csvFile)
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			r := csv.NewReader(f)
+			csvRows, err := r.ReadAll()
+			So(err, ShouldBeNil)
+			So(csvRows, ShouldResemble, [][]string{
+				{"ticker", "latest price", "gain", "gain %", "annualized return",
+					"weight", "weight 2019-01-03"},
+				{"A", "12.38", "24.75", "25.00", "25.02", "32.25", "33.33"},
+				{"B", "130.00", "60.00", "30.00", "30.02", "67.75", "66.67"},
+			})
+		})
+
+		Convey("Value graph", func() {
+			canvas := plot.NewCanvas()
+			ctx := plot.Use(ctx, canvas)
+			vg, err := canvas.EnsureGraph(plot.KindSeries, "vg", "plots")
+			So(err, ShouldBeNil)
+
+			var cfg config.Portfolio
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB path": "%s", "DB": "%s"},
+  "file": "%s",
+  "positions": [
+    {"ticker": "A", "purchase date": "2019-01-01", "shares": 10},
+    {"ticker": "B", "purchase date": "2019-01-02", "shares": 2}
+  ],
+  "value graph": "vg"
+}`, tmpdir, dbName, csvFile))), ShouldBeNil)
+			var pe Portfolio
+			So(pe.Run(ctx, &cfg), ShouldBeNil)
+			So(vg.Plots, ShouldResemble, []*plot.Plot{
+				{
+					Kind: plot.KindSeries,
+					Dates: []db.Date{
+						db.NewDate(2019, 1, 1),
+						db.NewDate(2019, 1, 2),
+						db.NewDate(2019, 1, 3),
+						db.NewDate(2020, 1, 1),
+					},
+					Y:         []float64{100, 360, 330, 383.75},
+					YLabel:    "value",
+					Legend:    "test value",
+					ChartType: plot.ChartLine,
+				},
+			})
+		})
+
+		Convey("Lots and sales", func() {
+			runLots := func(matching string, sold int) ([][]string, error) {
+				var cfg config.Portfolio
+				err := cfg.InitMessage(testutil.JSON(fmt.Sprintf(`{
+  "id": "test",
+  "data": {"DB path": "%s", "DB": "%s"},
+  "file": "%s",
+  "lot matching": "%s",
+  "positions": [
+    {"ticker": "A", "purchase date": "2019-01-01", "shares": 10, "cost basis": 100, "lot": "a1"},
+    {"ticker": "A", "purchase date": "2019-01-02", "shares": 10, "cost basis": 120, "lot": "a2"},
+    {"ticker": "A", "purchase date": "2019-01-03", "shares": %d, "lot": "a2"}
+  ],
+  "columns": [
+    {"kind": "lot"},
+    {"kind": "open shares"},
+    {"kind": "realized gain"},
+    {"kind": "unrealized gain"},
+    {"kind": "gain"},
+    {"kind": "value", "date": "2019-01-03"}
+  ]
+}`, tmpdir, dbName, csvFile, matching, -sold)))
+				So(err, ShouldBeNil)
+				var pe Portfolio
+				if err := pe.Run(ctx, &cfg); err != nil {
+					return nil, err
+				}
+				f, err := os.Open(csvFile)
+				So(err, ShouldBeNil)
+				defer f.Close()
+				return csv.NewReader(f).ReadAll()
+			}
+			header := []string{"lot", "open shares", "realized gain",
+				"unrealized gain", "gain", "value 2019-01-03"}
+
+			Convey("FIFO", func() {
+				rows, err := runLots("FIFO", 5)
+				So(err, ShouldBeNil)
+				So(rows, ShouldResemble, [][]string{
+					header,
+					{"a1", "5", "5.00", "11.88", "16.88", "55.00"},
+					{"a2", "10", "0.00", "3.75", "3.75", "110.00"},
+				})
+			})
+
+			Convey("LIFO", func() {
+				rows, err := runLots("LIFO", 5)
+				So(err, ShouldBeNil)
+				So(rows, ShouldResemble, [][]string{
+					header,
+					{"a1", "10", "0.00", "23.75", "23.75", "110.00"},
+					{"a2", "5", "-5.00", "1.88", "-3.12", "55.00"},
+				})
+			})
+
+			Convey("specific", func() {
+				rows, err := runLots("specific", 5)
+				So(err, ShouldBeNil)
+				So(rows[2], ShouldResemble,
+					[]string{"a2", "5", "-5.00", "1.88", "-3.12", "55.00"})
+			})
+
+			Convey("FIFO across lots", func() {
+				rows, err := runLots("FIFO", 15)
+				So(err, ShouldBeNil)
+				So(rows[1:], ShouldResemble, [][]string{
+					{"a1", "0", "10.00", "0.00", "10.00", "0.00"},
+					{"a2", "5", "-5.00", "1.88", "-3.12", "55.00"},
+				})
+			})
+
+			Convey("selling more than held", func() {
+				_, err := runLots("FIFO", 25)
+				So(err, ShouldNotBeNil)
+			})
+		})
 	})
 }
@@ -17,6 +17,7 @@ package powerdist
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"runtime"
 
@@ -24,6 +25,7 @@ import (
 	"github.com/stockparfait/experiments"
 	"github.com/stockparfait/experiments/config"
 	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
 	"github.com/stockparfait/stockparfait/stats"
 )
 
@@ -62,7 +64,7 @@ func distributionWithHistogram(ctx context.Context, c *config.CompoundDistributi
 	}
 	var ok bool
 	if dh, ok = source.(stats.DistributionWithHistogram); !ok {
-		dh, err = experiments.Compound(ctx, source, 1, c.CompoundType, &c.Params)
+		dh, err = experiments.Compound(ctx, source, 1, c)
 		if err != nil {
 			err = errors.Annotate(err, "failed to compound the source")
 			return
@@ -115,6 +117,25 @@ func (d *PowerDist) Run(ctx context.Context, cfg config.ExperimentConfig) error
 			name: "Sigmas",
 		})
 	}
+	if d.config.MedianDist != nil {
+		sts = append(sts, &statistic{
+			c: d.config.MedianDist,
+			f: func(dh stats.DistributionWithHistogram) float64 {
+				return dh.Quantile(0.5)
+			},
+			name: "medians",
+		})
+	}
+	for _, q := range d.config.QuantileDists {
+		p := q.Percentile
+		sts = append(sts, &statistic{
+			c: q.Plot,
+			f: func(dh stats.DistributionWithHistogram) float64 {
+				return dh.Quantile(p / 100)
+			},
+			name: fmt.Sprintf("%g%% quantiles", p),
+		})
+	}
 	if d.config.AlphaDist != nil {
 		alphaFn := func() func(stats.DistributionWithHistogram) float64 {
 			// Add an extra function closure to cache and hide these vars.
@@ -165,33 +186,51 @@ func (d *PowerDist) Run(ctx context.Context, cfg config.ExperimentConfig) error
 		cumulKurt = experiments.NewCumulativeStatistic(d.config.CumulKurt)
 	}
 
-	cumulHist := stats.NewHistogram(&d.config.Dist.Params.Buckets)
-	for i := 0; i < d.config.CumulSamples; i++ {
-		y := d.rand.Rand()
-		cumulMean.AddToAverage(y)
-		var mean, mad float64
-		if d.config.Dist.AnalyticalSource != nil {
-			mean = d.config.Dist.AnalyticalSource.Mean
-			mad = d.config.Dist.AnalyticalSource.MAD
-		} else {
-			mean = cumulHist.Mean()
-			mad = cumulHist.MAD()
+	// Each run is an independent stream of samples for the statistics configured
+	// with multiple runs.
+	runs := 1
+	for _, c := range []*config.CumulativeStatistic{
+		d.config.CumulMean, d.config.CumulMAD, d.config.CumulSigma,
+		d.config.CumulAlpha, d.config.CumulSkew, d.config.CumulKurt,
+	} {
+		if c != nil && c.Runs > runs {
+			runs = c.Runs
+		}
+	}
+	for r := 0; r < runs && ctx.Err() == nil; r++ {
+		cumulHist := stats.NewHistogram(&d.config.Dist.Params.Buckets)
+		for i := 0; i < d.config.CumulSamples && ctx.Err() == nil; i++ {
+			y := d.rand.Rand()
+			cumulMean.AddToAverage(y)
+			var mean, mad float64
+			if d.config.Dist.AnalyticalSource != nil {
+				mean = d.config.Dist.AnalyticalSource.Mean
+				mad = d.config.Dist.AnalyticalSource.MAD
+			} else {
+				mean = cumulHist.Mean()
+				mad = cumulHist.MAD()
+			}
+			diff := y - mean
+			cumulMAD.AddToAverage(math.Abs(diff))
+			dd := diff * diff
+			cumulSigma.AddToAverage(dd)
+			cumulSkew.AddToAverage(dd * diff)
+			cumulKurt.AddToAverage(dd * dd)
+			cumulHist.Add(y)
+			// Deriving alpha is expensive, skip if not needed.
+			if !cumulAlpha.Done() {
+				cumulAlpha.AddDirect(experiments.DeriveAlpha(
+					cumulHist,
+					mean,
+					mad,
+					d.config.AlphaParams,
+				))
+			}
 		}
-		diff := y - mean
-		cumulMAD.AddToAverage(math.Abs(diff))
-		dd := diff * diff
-		cumulSigma.AddToAverage(dd)
-		cumulSkew.AddToAverage(dd * diff)
-		cumulKurt.AddToAverage(dd * dd)
-		cumulHist.Add(y)
-		// Deriving alpha is expensive, skip if not needed.
-		if cumulAlpha != nil {
-			cumulAlpha.AddDirect(experiments.DeriveAlpha(
-				cumulHist,
-				mean,
-				mad,
-				d.config.AlphaParams,
-			))
+		for _, c := range []*experiments.CumulativeStatistic{
+			cumulMean, cumulMAD, cumulSigma, cumulAlpha, cumulSkew, cumulKurt,
+		} {
+			c.NextRun()
 		}
 	}
 	cumulSigma.Map(func(y float64) float64 {
@@ -227,6 +266,42 @@ func (d *PowerDist) Run(ctx context.Context, cfg config.ExperimentConfig) error
 	if err := cumulKurt.Plot(ctx, "kurtosis", d.Prefix("kurtosis")); err != nil {
 		return errors.Annotate(err, "failed to plot cumulative kurtosis")
 	}
+	cumuls := []struct {
+		name string
+		c    *experiments.CumulativeStatistic
+	}{
+		{"mean", cumulMean},
+		{"MAD", cumulMAD},
+		{"sigma", cumulSigma},
+		{"alpha", cumulAlpha},
+		{"skewness", cumulSkew},
+		{"kurtosis", cumulKurt},
+	}
+	for _, s := range cumuls {
+		if err := d.addConvergence(ctx, s.c, s.name); err != nil {
+			return errors.Annotate(err, "failed to add %s convergence", s.name)
+		}
+	}
+	return nil
+}
+
+// addConvergence adds the fitted convergence rate of the cumulative statistic
+// as a value, and plots it when configured.
+func (d *PowerDist) addConvergence(ctx context.Context, c *experiments.CumulativeStatistic, name string) error {
+	if c == nil {
+		return nil
+	}
+	rate, _, err := c.ConvergenceRate()
+	if err != nil {
+		logging.Warningf(ctx, "cannot fit %s convergence rate: %s", name, err.Error())
+		return nil
+	}
+	if err := experiments.AddTypedValue(ctx, d.config.ID, name+" convergence rate", experiments.FloatValue(rate)); err != nil {
+		return errors.Annotate(err, "failed to add value")
+	}
+	if err := c.PlotConvergence(ctx, d.Prefix(name+" convergence")); err != nil {
+		return errors.Annotate(err, "failed to plot convergence")
+	}
 	return nil
 }
 
@@ -248,7 +323,7 @@ func (d *PowerDist) plotStatistics(ctx context.Context, sts []*statistic) error
 	var distName string
 
 	intervals := []interval{}
-	workers := 2 * runtime.NumCPU()
+	workers := experiments.Workers(ctx, 2*runtime.NumCPU())
 	step := d.config.StatSamples / workers
 	if step < 1 {
 		step = 1
@@ -263,7 +338,7 @@ func (d *PowerDist) plotStatistics(ctx context.Context, sts []*statistic) error
 	}
 	f := func(i interval) *statsJobRes {
 		res := &statsJobRes{samples: make([][]float64, len(sts))}
-		for k := i.Start; k < i.End; k++ {
+		for k := i.Start; k < i.End && ctx.Err() == nil; k++ {
 			var err error
 			// Create a fresh distribution every time. This is particularly important
 			// for HistogramDistribution, as its histogram is always fixed.
@@ -292,7 +367,7 @@ func (d *PowerDist) plotStatistics(ctx context.Context, sts []*statistic) error
 	}
 	for j, s := range sts {
 		fullName := distName + " " + s.name
-		dh := stats.NewSampleDistribution(samples[j], &s.c.Buckets)
+		dh := experiments.NewSampleDistribution(samples[j], s.c)
 		err := experiments.PlotDistribution(ctx, dh, s.c, d.config.ID, fullName)
 		if err != nil {
 			return errors.Annotate(err, "failed to plot %s", d.Prefix(fullName))
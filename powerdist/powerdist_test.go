@@ -75,7 +75,8 @@ func TestDistribution(t *testing.T) {
   "cumulative mean": {
     "graph": "samples",
     "percentiles": [5, 95],
-    "plot expected": true
+    "plot expected": true,
+    "runs": 3
   },
   "cumulative MAD": {
     "graph": "samples",
@@ -116,6 +117,13 @@ func TestDistribution(t *testing.T) {
   "alpha distribution": {
     "graph": "alphas"
   },
+  "median distribution": {
+    "graph": "medians"
+  },
+  "quantile distributions": [
+    {"percentile": 1, "plot": {"graph": "quantiles"}},
+    {"percentile": 99, "plot": {"graph": "quantiles"}}
+  ],
   "statistic samples": 10
 }
 `
@@ -137,6 +145,12 @@ func TestDistribution(t *testing.T) {
 			alphasGraph, err := canvas.EnsureGraph(plot.KindXY, "alphas", "group")
 			So(err, ShouldBeNil)
 
+			mediansGraph, err := canvas.EnsureGraph(plot.KindXY, "medians", "group")
+			So(err, ShouldBeNil)
+
+			quantilesGraph, err := canvas.EnsureGraph(plot.KindXY, "quantiles", "group")
+			So(err, ShouldBeNil)
+
 			So(cfg.InitMessage(testutil.JSON(JSConfig)), ShouldBeNil)
 			var pd PowerDist
 			So(pd.Run(ctx, &cfg), ShouldBeNil)
@@ -146,6 +160,18 @@ func TestDistribution(t *testing.T) {
 			So(len(madsGraph.Plots), ShouldEqual, 1)
 			So(len(sigmasGraph.Plots), ShouldEqual, 1)
 			So(len(alphasGraph.Plots), ShouldEqual, 1)
+			So(values, ShouldContainKey, "mean convergence rate")
+			So(values, ShouldContainKey, "sigma convergence rate")
+			So(len(mediansGraph.Plots), ShouldEqual, 1)
+			So(mediansGraph.Plots[0].Legend, ShouldEqual, "T(a=3.00) medians p.d.f.")
+			So(len(quantilesGraph.Plots), ShouldEqual, 2)
+			So(quantilesGraph.Plots[1].Legend, ShouldEqual, "T(a=3.00) 99% quantiles p.d.f.")
+		})
+
+		Convey("quantile distribution requires a valid percentile", func() {
+			var q config.QuantileDistribution
+			So(q.InitMessage(testutil.JSON(`
+{"percentile": 100, "plot": {"graph": "g"}}`)), ShouldNotBeNil)
 		})
 	})
 }
@@ -0,0 +1,76 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package render
+
+import (
+	"image/color"
+	"io"
+
+	"github.com/fogleman/gg"
+)
+
+// pngDrawer rasterizes onto a gg.Context using its built-in bitmap font.
+type pngDrawer struct {
+	dc *gg.Context
+}
+
+var _ drawer = &pngDrawer{}
+
+func newPNGDrawer(width, height int) *pngDrawer {
+	dc := gg.NewContext(width, height)
+	dc.SetColor(color.White)
+	dc.Clear()
+	dc.SetLineWidth(1)
+	return &pngDrawer{dc: dc}
+}
+
+func (d *pngDrawer) polyline(pts []point, c color.Color, dashed bool) {
+	if len(pts) == 0 {
+		return
+	}
+	d.dc.NewSubPath()
+	for _, p := range pts {
+		d.dc.LineTo(p.X, p.Y)
+	}
+	if dashed {
+		d.dc.SetDash(6, 4)
+	}
+	d.dc.SetColor(c)
+	d.dc.Stroke()
+	d.dc.SetDash()
+}
+
+func (d *pngDrawer) dots(pts []point, c color.Color) {
+	for _, p := range pts {
+		d.dc.DrawCircle(p.X, p.Y, 2)
+	}
+	d.dc.SetColor(c)
+	d.dc.Fill()
+}
+
+func (d *pngDrawer) rect(x0, y0, x1, y1 float64, c color.Color) {
+	d.dc.DrawRectangle(x0, y0, x1-x0, y1-y0)
+	d.dc.SetColor(c)
+	d.dc.Fill()
+}
+
+func (d *pngDrawer) text(x, y float64, s string, ax float64, c color.Color) {
+	d.dc.SetColor(c)
+	d.dc.DrawStringAnchored(s, x, y, ax, 0.5)
+}
+
+func (d *pngDrawer) write(w io.Writer) error {
+	return d.dc.EncodePNG(w)
+}
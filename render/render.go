@@ -0,0 +1,388 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package render draws the graphs of a Canvas as static PNG or SVG images, for
+// use where the JS viewer is unavailable.
+//
+// The rendering approximates the JS viewer: each graph is a separate image
+// with its plots, a left and / or right Y axis, and a legend.
+package render
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+)
+
+// Format of the image.
+type Format string
+
+const (
+	PNG Format = "png"
+	SVG Format = "svg"
+)
+
+// Params of the rendered images.
+type Params struct {
+	Width  int // default: 800
+	Height int // of the plot area, excluding the legend; default: 400
+}
+
+// Layout constants, in pixels.
+const (
+	marginLeft   = 80
+	marginRight  = 80
+	marginTop    = 50
+	marginBottom = 40
+	legendLine   = 16
+	fontHeight   = 13
+	numTicks     = 5
+)
+
+// Matches the foreground colors of the JS viewer.
+var palette = []color.RGBA{
+	{0, 0, 0, 255},       // Black
+	{0, 0, 139, 255},     // DarkBlue
+	{0, 0, 255, 255},     // Blue
+	{0, 100, 0, 255},     // DarkGreen
+	{0, 128, 0, 255},     // Green
+	{0, 128, 128, 255},   // Teal
+	{25, 25, 112, 255},   // MidnightBlue
+	{75, 0, 130, 255},    // Indigo
+	{85, 107, 47, 255},   // DarkOliveGreen
+	{105, 105, 105, 255}, // DimGray
+	{107, 142, 35, 255},  // OliveDrab
+	{34, 139, 34, 255},   // ForestGreen
+	{0, 139, 139, 255},   // DarkCyan
+	{102, 205, 170, 255}, // MediumAquaMarine
+}
+
+var axisColor = color.RGBA{128, 128, 128, 255}
+
+type point struct{ X, Y float64 }
+
+// drawer is a minimal vector drawing backend in pixel coordinates, with Y
+// pointing down.
+type drawer interface {
+	polyline(pts []point, c color.Color, dashed bool)
+	dots(pts []point, c color.Color)
+	rect(x0, y0, x1, y1 float64, c color.Color)
+	// text with horizontal anchor ax: 0 = left, 0.5 = center, 1 = right, and
+	// vertical center at y.
+	text(x, y float64, s string, ax float64, c color.Color)
+	write(w io.Writer) error
+}
+
+func newDrawer(f Format, width, height int) (drawer, error) {
+	switch f {
+	case PNG:
+		return newPNGDrawer(width, height), nil
+	case SVG:
+		return newSVGDrawer(width, height), nil
+	}
+	return nil, errors.Reason("unsupported format '%s'", f)
+}
+
+// axis maps data values to pixels, possibly in log-scale.
+type axis struct {
+	min, max float64 // in transformed (log10 when log) coordinates
+	p0, p1   float64 // pixel range
+	log      bool
+	dates    bool // values are days since the epoch
+	label    string
+	hasData  bool
+}
+
+func (a *axis) transform(v float64) (float64, bool) {
+	if a.log {
+		if v <= 0 {
+			return 0, false
+		}
+		v = math.Log10(v)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+func (a *axis) add(v float64) {
+	t, ok := a.transform(v)
+	if !ok {
+		return
+	}
+	if !a.hasData {
+		a.min, a.max, a.hasData = t, t, true
+		return
+	}
+	a.min = math.Min(a.min, t)
+	a.max = math.Max(a.max, t)
+}
+
+// pixel of the data value v, when valid.
+func (a *axis) pixel(v float64) (float64, bool) {
+	t, ok := a.transform(v)
+	if !ok {
+		return 0, false
+	}
+	span := a.max - a.min
+	if span == 0 {
+		return (a.p0 + a.p1) / 2, true
+	}
+	return a.p0 + (t-a.min)/span*(a.p1-a.p0), true
+}
+
+// ticks returns the pixel positions and labels of the axis ticks.
+func (a *axis) ticks() ([]float64, []string) {
+	var ps []float64
+	var ls []string
+	for i := 0; i < numTicks; i++ {
+		t := a.min + (a.max-a.min)*float64(i)/float64(numTicks-1)
+		p := a.p0 + (a.p1-a.p0)*float64(i)/float64(numTicks-1)
+		v := t
+		if a.log {
+			v = math.Pow(10, t)
+		} else if math.Abs(v) < 1e-3*(a.max-a.min) {
+			v = 0 // avoid rounding noise like -1.2e-17
+		}
+		var l string
+		if a.dates {
+			t := epoch.ToTime().AddDate(0, 0, int(math.Round(v)))
+			l = db.NewDateFromTime(t).Date().String()
+		} else {
+			l = fmt.Sprintf("%.3g", v)
+		}
+		ps = append(ps, p)
+		ls = append(ls, l)
+		if a.max == a.min {
+			break
+		}
+	}
+	return ps, ls
+}
+
+var epoch = db.NewDate(1970, 1, 1)
+
+func days(d db.Date) float64 {
+	return math.Floor(d.ToTime().Sub(epoch.ToTime()).Hours() / 24)
+}
+
+// xs returns the X values of the plot, as days since the epoch for series.
+func xs(p *plot.Plot) []float64 {
+	if p.Kind != plot.KindSeries {
+		return p.X
+	}
+	res := make([]float64, len(p.Dates))
+	for i, d := range p.Dates {
+		res[i] = days(d)
+	}
+	return res
+}
+
+func joinLabels(labels map[string]struct{}, order []string) string {
+	var res []string
+	for _, l := range order {
+		if _, ok := labels[l]; ok {
+			res = append(res, l)
+			delete(labels, l)
+		}
+	}
+	return strings.Join(res, ", ")
+}
+
+// Render the graph of the group as an image in the given format.
+func Render(w io.Writer, group *plot.Group, graph *plot.Graph, f Format, p Params) error {
+	if p.Width <= 0 {
+		p.Width = 800
+	}
+	if p.Height <= 0 {
+		p.Height = 400
+	}
+	height := p.Height + legendLine*len(graph.Plots)
+	d, err := newDrawer(f, p.Width, height)
+	if err != nil {
+		return errors.Annotate(err, "failed to create drawer")
+	}
+	x := &axis{
+		p0:    marginLeft,
+		p1:    float64(p.Width - marginRight),
+		log:   group.XLogScale,
+		dates: graph.Kind == plot.KindSeries,
+		label: graph.XLabel,
+	}
+	yBottom := float64(p.Height - marginBottom)
+	left := &axis{p0: yBottom, p1: marginTop, log: graph.YLogScale}
+	right := &axis{p0: yBottom, p1: marginTop, log: graph.YLogScale}
+	leftLabels := make(map[string]struct{})
+	rightLabels := make(map[string]struct{})
+	var labelOrder []string
+	for _, plt := range graph.Plots {
+		y := right
+		labels := rightLabels
+		if plt.LeftAxis {
+			y = left
+			labels = leftLabels
+		}
+		labels[plt.YLabel] = struct{}{}
+		labelOrder = append(labelOrder, plt.YLabel)
+		for i, xv := range xs(plt) {
+			if _, ok := x.transform(xv); !ok {
+				continue
+			}
+			x.add(xv)
+			y.add(plt.Y[i])
+		}
+	}
+	// Share the X range within the group, like the JS viewer.
+	if graph.Kind == plot.KindSeries && group.MinDate != nil && group.MaxDate != nil {
+		x.add(days(*group.MinDate))
+		x.add(days(*group.MaxDate))
+	} else if graph.Kind == plot.KindXY && group.MinX != nil && group.MaxX != nil {
+		x.add(*group.MinX)
+		x.add(*group.MaxX)
+	}
+	left.label = joinLabels(leftLabels, labelOrder)
+	right.label = joinLabels(rightLabels, labelOrder)
+
+	title := graph.Title
+	if title == "" {
+		title = graph.ID
+	}
+	d.text(float64(p.Width)/2, marginTop/2, title, 0.5, palette[0])
+
+	// Axes.
+	d.polyline([]point{{x.p0, yBottom}, {x.p1, yBottom}}, axisColor, false)
+	ps, ls := x.ticks()
+	for i, px := range ps {
+		d.polyline([]point{{px, yBottom}, {px, yBottom + 4}}, axisColor, false)
+		d.text(px, yBottom+4+fontHeight/2+2, ls[i], 0.5, axisColor)
+	}
+	if x.label != "" {
+		d.text((x.p0+x.p1)/2, yBottom+4+fontHeight*3/2+4, x.label, 0.5, axisColor)
+	}
+	for _, y := range []*axis{left, right} {
+		if !y.hasData {
+			continue
+		}
+		xp, tickX, ax := x.p0, x.p0-4, 1.0
+		if y == right {
+			xp, tickX, ax = x.p1, x.p1+4, 0.0
+		}
+		d.polyline([]point{{xp, y.p0}, {xp, y.p1}}, axisColor, false)
+		ps, ls := y.ticks()
+		for i, py := range ps {
+			d.polyline([]point{{xp, py}, {tickX, py}}, axisColor, false)
+			d.text(tickX+(tickX-xp)/2, py, ls[i], ax, axisColor)
+		}
+		d.text(xp, y.p1-fontHeight, y.label, 0.5, axisColor)
+	}
+
+	// Plots and legend.
+	for i, plt := range graph.Plots {
+		c := palette[i%len(palette)]
+		y := right
+		if plt.LeftAxis {
+			y = left
+		}
+		var pts []point
+		for j, xv := range xs(plt) {
+			px, okX := x.pixel(xv)
+			py, okY := y.pixel(plt.Y[j])
+			if okX && okY {
+				pts = append(pts, point{px, py})
+			}
+		}
+		switch plt.ChartType {
+		case plot.ChartScatter:
+			d.dots(pts, c)
+		case plot.ChartBars:
+			drawBars(d, pts, y, c)
+		default:
+			d.polyline(pts, c, plt.ChartType == plot.ChartDashed)
+		}
+		ly := float64(p.Height) + float64(legendLine)*(float64(i)+0.5)
+		d.polyline([]point{{marginLeft, ly}, {marginLeft + 30, ly}}, c,
+			plt.ChartType == plot.ChartDashed)
+		d.text(marginLeft+36, ly, plt.Legend, 0, c)
+	}
+	if err := d.write(w); err != nil {
+		return errors.Annotate(err, "failed to write the image")
+	}
+	return nil
+}
+
+func drawBars(d drawer, pts []point, y *axis, c color.Color) {
+	if len(pts) == 0 {
+		return
+	}
+	width := 10.0
+	for i := 1; i < len(pts); i++ {
+		width = math.Min(width, math.Abs(pts[i].X-pts[i-1].X)*0.8)
+	}
+	base, ok := y.pixel(0)
+	if !ok || y.log { // no zero in log-scale; bars start at the bottom
+		base = y.p0
+	}
+	base = math.Max(math.Min(base, y.p0), y.p1)
+	for _, p := range pts {
+		d.rect(p.X-width/2, math.Min(p.Y, base), p.X+width/2, math.Max(p.Y, base), c)
+	}
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// FileName for the graph's image.
+func FileName(graph *plot.Graph, f Format) string {
+	return unsafeChars.ReplaceAllString(graph.ID, "_") + "." + string(f)
+}
+
+// WriteFiles renders all the graphs of the Canvas in the context into dir,
+// one file per graph named by FileName.
+func WriteFiles(ctx context.Context, dir string, f Format, p Params) error {
+	c := plot.Get(ctx)
+	if c == nil {
+		return errors.Reason("no Canvas in context")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Annotate(err, "failed to create '%s'", dir)
+	}
+	for _, group := range c.Groups {
+		for _, graph := range group.Graphs {
+			if len(graph.Plots) == 0 {
+				continue
+			}
+			path := filepath.Join(dir, FileName(graph, f))
+			file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return errors.Annotate(err, "cannot open file for writing :'%s'", path)
+			}
+			err = Render(file, group, graph, f, p)
+			file.Close()
+			if err != nil {
+				return errors.Annotate(err, "failed to render '%s'", path)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package render
+
+import (
+	"context"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_render")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("WriteFiles works", t, func() {
+		ctx := plot.Use(context.Background(), plot.NewCanvas())
+
+		g, err := plot.EnsureGraph(ctx, plot.KindXY, "dist", "xy")
+		So(err, ShouldBeNil)
+		g.Title = "Distribution <p>"
+		g.XLabel = "log-profit"
+		line, err := plot.NewXYPlot([]float64{1, 2, 3}, []float64{1, 4, 9})
+		So(err, ShouldBeNil)
+		line.SetLegend("squares").SetYLabel("y")
+		So(plot.Add(ctx, line, "dist"), ShouldBeNil)
+		bars, err := plot.NewXYPlot([]float64{1, 2, 3}, []float64{2, 3, 1})
+		So(err, ShouldBeNil)
+		bars.SetChartType(plot.ChartBars).SetLeftAxis(true).SetLegend("bars")
+		So(plot.Add(ctx, bars, "dist"), ShouldBeNil)
+
+		_, err = plot.EnsureGraph(ctx, plot.KindSeries, "price/AAPL", "ts")
+		So(err, ShouldBeNil)
+		dates := []db.Date{
+			db.NewDate(2020, 1, 1), db.NewDate(2020, 1, 2), db.NewDate(2020, 1, 3)}
+		ts, err := plot.NewSeriesPlot(stats.NewTimeseries(dates, []float64{10, 11, 9}))
+		So(err, ShouldBeNil)
+		ts.SetChartType(plot.ChartDashed).SetLegend("price")
+		So(plot.Add(ctx, ts, "price/AAPL"), ShouldBeNil)
+
+		Convey("as SVG", func() {
+			dir := filepath.Join(tmpdir, "svg")
+			So(WriteFiles(ctx, dir, SVG, Params{}), ShouldBeNil)
+			dist, err := os.ReadFile(filepath.Join(dir, "dist.svg"))
+			So(err, ShouldBeNil)
+			s := string(dist)
+			So(s, ShouldStartWith, `<?xml version="1.0" encoding="UTF-8"?>`)
+			So(s, ShouldContainSubstring, `width="800" height="432"`)
+			So(s, ShouldContainSubstring, ">Distribution &lt;p&gt;</text>")
+			So(s, ShouldContainSubstring, ">squares</text>")
+			So(s, ShouldContainSubstring, "<rect x=")
+			ts, err := os.ReadFile(filepath.Join(dir, "price_AAPL.svg"))
+			So(err, ShouldBeNil)
+			So(string(ts), ShouldContainSubstring, ">2020-01-01</text>")
+			So(string(ts), ShouldContainSubstring, `stroke-dasharray="6,4"`)
+		})
+
+		Convey("as PNG", func() {
+			dir := filepath.Join(tmpdir, "png")
+			So(WriteFiles(ctx, dir, PNG, Params{Width: 400, Height: 200}), ShouldBeNil)
+			f, err := os.Open(filepath.Join(dir, "dist.png"))
+			So(err, ShouldBeNil)
+			defer f.Close()
+			img, err := png.Decode(f)
+			So(err, ShouldBeNil)
+			So(img.Bounds().Dx(), ShouldEqual, 400)
+			So(img.Bounds().Dy(), ShouldEqual, 232)
+		})
+	})
+}
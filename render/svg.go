@@ -0,0 +1,96 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package render
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// svgDrawer accumulates SVG elements and writes them as a standalone document.
+type svgDrawer struct {
+	width, height int
+	body          bytes.Buffer
+}
+
+var _ drawer = &svgDrawer{}
+
+func newSVGDrawer(width, height int) *svgDrawer {
+	return &svgDrawer{width: width, height: height}
+}
+
+func svgColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+func (d *svgDrawer) polyline(pts []point, c color.Color, dashed bool) {
+	if len(pts) == 0 {
+		return
+	}
+	var coords []string
+	for _, p := range pts {
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", p.X, p.Y))
+	}
+	dash := ""
+	if dashed {
+		dash = ` stroke-dasharray="6,4"`
+	}
+	fmt.Fprintf(&d.body, `<polyline points="%s" fill="none" stroke="%s"%s/>`+"\n",
+		strings.Join(coords, " "), svgColor(c), dash)
+}
+
+func (d *svgDrawer) dots(pts []point, c color.Color) {
+	for _, p := range pts {
+		fmt.Fprintf(&d.body, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"/>`+"\n",
+			p.X, p.Y, svgColor(c))
+	}
+}
+
+func (d *svgDrawer) rect(x0, y0, x1, y1 float64, c color.Color) {
+	fmt.Fprintf(&d.body, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n",
+		x0, y0, x1-x0, y1-y0, svgColor(c))
+}
+
+func (d *svgDrawer) text(x, y float64, s string, ax float64, c color.Color) {
+	if s == "" {
+		return
+	}
+	anchor := "middle"
+	switch {
+	case ax < 0.5:
+		anchor = "start"
+	case ax > 0.5:
+		anchor = "end"
+	}
+	var esc bytes.Buffer
+	xml.EscapeText(&esc, []byte(s)) // never fails for bytes.Buffer
+	fmt.Fprintf(&d.body,
+		`<text x="%.1f" y="%.1f" text-anchor="%s" dominant-baseline="middle" fill="%s">%s</text>`+"\n",
+		x, y, anchor, svgColor(c), esc.String())
+}
+
+func (d *svgDrawer) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="%d">
+<rect width="100%%" height="100%%" fill="white"/>
+%s</svg>
+`, d.width, d.height, fontHeight-1, d.body.String())
+	return err
+}
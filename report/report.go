@@ -0,0 +1,163 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report renders the plots and values of a run into a single
+// self-contained HTML file.
+//
+// The plotting code in js/ is a copy of stockparfait/stockparfait/js. Chart.js
+// and its date adapter are either inlined from a local directory or loaded from
+// a CDN.
+package report
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/stockparfait/plot"
+)
+
+//go:embed js/main.js
+var mainJS string
+
+//go:embed js/plot.css
+var plotCSS string
+
+// Chart.js library files, as expected in the local JS directory, and their CDN
+// URLs used by default.
+const (
+	ChartJS          = "chart.min.js"
+	DateAdapterJS    = "chartjs-adapter-date-fns.bundle.min.js"
+	ChartJSURL       = "https://cdn.jsdelivr.net/npm/chart.js@3.9.1/dist/chart.min.js"
+	DateAdapterJSURL = "https://cdn.jsdelivr.net/npm/chartjs-adapter-date-fns@2.0.0/dist/chartjs-adapter-date-fns.bundle.min.js"
+)
+
+// Params of the report.
+type Params struct {
+	Title string // default: "Stock Parfait"
+	// Directory with ChartJS and DateAdapterJS files to inline. When empty, the
+	// libraries are loaded from the CDN.
+	JSDir string
+}
+
+type library struct {
+	URL    string
+	Inline template.JS
+}
+
+type valueRow struct {
+	Key   string
+	Value string
+}
+
+type reportData struct {
+	Title     string
+	CSS       template.CSS
+	Libraries []library
+	MainJS    template.JS
+	Data      template.JS
+	Values    []valueRow
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+{{.CSS}}
+.values { margin: 10px 20px 30px 20px; border-collapse: collapse; }
+.values td { padding: 2px 20px 2px 0px; font-family: monospace; }
+</style>
+{{range .Libraries}}{{if .URL}}<script src="{{.URL}}"></script>
+{{else}}<script>
+{{.Inline}}
+</script>
+{{end}}{{end}}<script>
+{{.MainJS}}
+</script>
+<script>
+var DATA = {{.Data}};
+window.onload = () => {
+    initPlots(document.getElementById('plots'), DATA);
+};
+</script>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Values}}<table class="values">
+{{range .Values}}<tr><td>{{.Key}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}<div class="plots" id="plots"></div>
+</body>
+</html>
+`))
+
+func libraries(jsDir string) ([]library, error) {
+	if jsDir == "" {
+		return []library{{URL: ChartJSURL}, {URL: DateAdapterJSURL}}, nil
+	}
+	var libs []library
+	for _, name := range []string{ChartJS, DateAdapterJS} {
+		path := filepath.Join(jsDir, name)
+		js, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to read '%s'", path)
+		}
+		libs = append(libs, library{Inline: template.JS(js)})
+	}
+	return libs, nil
+}
+
+// WriteHTML writes the Canvas and the Values from the context as an HTML
+// report. The Values are optional.
+func WriteHTML(ctx context.Context, w io.Writer, p Params) error {
+	var data bytes.Buffer
+	if err := plot.WriteJSON(ctx, &data); err != nil {
+		return errors.Annotate(err, "failed to encode plots")
+	}
+	libs, err := libraries(p.JSDir)
+	if err != nil {
+		return errors.Annotate(err, "failed to load JS libraries")
+	}
+	rd := reportData{
+		Title:     p.Title,
+		CSS:       template.CSS(plotCSS),
+		Libraries: libs,
+		MainJS:    template.JS(mainJS),
+		// JSON encoding escapes '<', so legends cannot terminate the script.
+		Data: template.JS(data.String()),
+	}
+	if rd.Title == "" {
+		rd.Title = "Stock Parfait"
+	}
+	values := experiments.GetValues(ctx)
+	for k, v := range values {
+		rd.Values = append(rd.Values, valueRow{Key: k, Value: v})
+	}
+	sort.Slice(rd.Values, func(i, j int) bool {
+		return rd.Values[i].Key < rd.Values[j].Key
+	})
+	if err := reportTemplate.Execute(w, &rd); err != nil {
+		return errors.Annotate(err, "failed to render the report")
+	}
+	return nil
+}
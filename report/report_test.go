@@ -0,0 +1,79 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReport(t *testing.T) {
+	t.Parallel()
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_report")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("WriteHTML works", t, func() {
+		ctx := context.Background()
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+
+		_, err := plot.EnsureGraph(ctx, plot.KindXY, "main", "top")
+		So(err, ShouldBeNil)
+		plt, err := plot.NewXYPlot([]float64{1, 2}, []float64{3, 4})
+		So(err, ShouldBeNil)
+		plt.SetLegend("</script><b>")
+		So(plot.Add(ctx, plt, "main"), ShouldBeNil)
+		So(experiments.AddValue(ctx, "", "tickers", "<10>"), ShouldBeNil)
+
+		Convey("with CDN libraries", func() {
+			var buf bytes.Buffer
+			So(WriteHTML(ctx, &buf, Params{}), ShouldBeNil)
+			html := buf.String()
+			So(html, ShouldContainSubstring, "<title>Stock Parfait</title>")
+			So(html, ShouldContainSubstring, `<script src="`+ChartJSURL+`"></script>`)
+			So(html, ShouldContainSubstring, "function initPlots(")
+			So(html, ShouldContainSubstring, `var DATA = {"Groups":[{"Kind":"KindXY"`)
+			So(html, ShouldContainSubstring, `"Legend":"\u003c/script\u003e\u003cb\u003e"`)
+			So(html, ShouldContainSubstring, "<tr><td>tickers</td><td>&lt;10&gt;</td></tr>")
+		})
+
+		Convey("with inlined libraries", func() {
+			So(testutil.WriteFile(filepath.Join(tmpdir, ChartJS), "var CHART;"), ShouldBeNil)
+			So(testutil.WriteFile(filepath.Join(tmpdir, DateAdapterJS), "var ADAPTER;"), ShouldBeNil)
+			var buf bytes.Buffer
+			So(WriteHTML(ctx, &buf, Params{Title: "test", JSDir: tmpdir}), ShouldBeNil)
+			html := buf.String()
+			So(html, ShouldContainSubstring, "<title>test</title>")
+			So(html, ShouldContainSubstring, "<script>\nvar CHART;\n</script>")
+			So(html, ShouldContainSubstring, "<script>\nvar ADAPTER;\n</script>")
+			So(html, ShouldNotContainSubstring, ChartJSURL)
+		})
+	})
+}
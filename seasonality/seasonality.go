@@ -0,0 +1,248 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package seasonality is an experiment with calendar effects in log-profits,
+// such as the day-of-week or the month-of-year effects.
+package seasonality
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+type Seasonality struct {
+	config  *config.Seasonality
+	context context.Context
+	buckets *stats.Buckets // of the per-bucket histograms
+}
+
+var _ experiments.Experiment = &Seasonality{}
+
+func (e *Seasonality) Prefix(s string) string {
+	return experiments.Prefix(e.config.ID, s)
+}
+
+func (e *Seasonality) AddValue(ctx context.Context, k, v string) error {
+	return experiments.AddValue(ctx, e.config.ID, k, v)
+}
+
+func (e *Seasonality) Run(ctx context.Context, cfg config.ExperimentConfig) error {
+	var ok bool
+	if e.config, ok = cfg.(*config.Seasonality); !ok {
+		return errors.Reason("unexpected config type: %T", cfg)
+	}
+	e.context = ctx
+	e.buckets = &e.config.Buckets
+	if c := e.config.Distribution; c != nil {
+		if b := experiments.LookupSharedBuckets(ctx, c); b != nil {
+			e.buckets = b
+		}
+	}
+	it, err := experiments.SourceMap(ctx, e.config.Data, e.processLogProfits)
+	if err != nil {
+		return errors.Annotate(err, "failed to process data")
+	}
+	defer it.Close()
+
+	f := func(j1, j2 *jobResult) *jobResult { return j1.Merge(j2) }
+	total := iterator.Reduce[*jobResult, *jobResult](it, newJobResult(), f)
+	if err := e.processTotal(total); err != nil {
+		return errors.Annotate(err, "failed to process final tally")
+	}
+	return nil
+}
+
+// bucketStats accumulates the log-profits of a single calendar bucket.
+type bucketStats struct {
+	n         int
+	sum       float64
+	sumSq     float64
+	histogram *stats.Histogram
+}
+
+func (b *bucketStats) Mean() float64 { return b.sum / float64(b.n) }
+
+// StdError of the mean.
+func (b *bucketStats) StdError() float64 {
+	if b.n < 2 {
+		return 0
+	}
+	n := float64(b.n)
+	mean := b.Mean()
+	variance := (b.sumSq - n*mean*mean) / (n - 1)
+	if variance < 0 {
+		return 0
+	}
+	return math.Sqrt(variance / n)
+}
+
+type jobResult struct {
+	buckets    map[int]*bucketStats
+	numTickers int
+}
+
+func newJobResult() *jobResult {
+	return &jobResult{buckets: make(map[int]*bucketStats)}
+}
+
+func (j *jobResult) Merge(j2 *jobResult) *jobResult {
+	for k, b2 := range j2.buckets {
+		b, ok := j.buckets[k]
+		if !ok {
+			j.buckets[k] = b2
+			continue
+		}
+		b.n += b2.n
+		b.sum += b2.sum
+		b.sumSq += b2.sumSq
+		b.histogram.AddHistogram(b2.histogram)
+	}
+	j.numTickers += j2.numTickers
+	return j
+}
+
+// bucket is the calendar bucket of the date.
+func (e *Seasonality) bucket(d db.Date) int {
+	switch e.config.By {
+	case "month":
+		return int(d.Month())
+	case "day of month":
+		return int(d.Day())
+	}
+	return int(d.ToTime().Weekday())
+}
+
+// bucketName is the human readable name of the bucket k.
+func (e *Seasonality) bucketName(k int) string {
+	switch e.config.By {
+	case "month":
+		return time.Month(k).String()[:3]
+	case "day of month":
+		return fmt.Sprintf("day %d", k)
+	}
+	return time.Weekday(k).String()[:3]
+}
+
+func (e *Seasonality) processLogProfits(lps []experiments.LogProfits) *jobResult {
+	res := newJobResult()
+	for _, lp := range lps {
+		if e.context.Err() != nil {
+			break
+		}
+		dates := lp.Timeseries.Dates()
+		for i, x := range lp.Timeseries.Data() {
+			k := e.bucket(dates[i])
+			b, ok := res.buckets[k]
+			if !ok {
+				b = &bucketStats{histogram: stats.NewHistogram(e.buckets)}
+				res.buckets[k] = b
+			}
+			b.n++
+			b.sum += x
+			b.sumSq += x * x
+			b.histogram.Add(x)
+		}
+		res.numTickers++
+	}
+	return res
+}
+
+func (e *Seasonality) addPlot(xs, ys []float64, graph, legend, yLabel string, chartType plot.ChartType) error {
+	plt, err := plot.NewXYPlot(xs, ys)
+	if err != nil {
+		return errors.Annotate(err, "failed to create plot '%s'", legend)
+	}
+	legend = e.Prefix(legend)
+	plt.SetLegend(legend).SetYLabel(yLabel).SetChartType(chartType)
+	if err := experiments.AddPlot(e.context, plt, graph); err != nil {
+		return errors.Annotate(err, "failed to add plot '%s'", legend)
+	}
+	return nil
+}
+
+func (e *Seasonality) processTotal(total *jobResult) error {
+	err := experiments.AddTypedValue(e.context, e.config.ID, "tickers", experiments.IntValue(total.numTickers))
+	if err != nil {
+		return errors.Annotate(err, "failed to add value for number of tickers")
+	}
+	var keys []int
+	for k := range total.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	xs := make([]float64, len(keys))
+	means := make([]float64, len(keys))
+	lows := make([]float64, len(keys))
+	highs := make([]float64, len(keys))
+	mads := make([]float64, len(keys))
+	for i, k := range keys {
+		b := total.buckets[k]
+		name := e.bucketName(k)
+		xs[i] = float64(k)
+		means[i] = b.Mean()
+		lows[i] = means[i] - b.StdError()
+		highs[i] = means[i] + b.StdError()
+		mads[i] = b.histogram.MAD()
+		for _, v := range []struct {
+			key   string
+			value experiments.Value
+		}{
+			{"mean", experiments.FloatValue(means[i])},
+			{"mean stderr", experiments.FloatValue(b.StdError())},
+			{"MAD", experiments.FloatValue(mads[i])},
+			{"samples", experiments.IntValue(b.n)},
+		} {
+			k := name + " " + v.key
+			if err := experiments.AddTypedValue(e.context, e.config.ID, k, v.value); err != nil {
+				return errors.Annotate(err, "failed to add value for %s", k)
+			}
+		}
+		dist := stats.NewHistogramDistribution(b.histogram)
+		err := experiments.PlotDistribution(e.context, dist, e.config.Distribution, e.config.ID, name)
+		if err != nil {
+			return errors.Annotate(err, "failed to plot %s distribution", name)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if g := e.config.MeanGraph; g != "" {
+		if err := e.addPlot(xs, means, g, "mean", "mean", plot.ChartBars); err != nil {
+			return err
+		}
+		if err := e.addPlot(xs, lows, g, "mean-stderr", "mean", plot.ChartDashed); err != nil {
+			return err
+		}
+		if err := e.addPlot(xs, highs, g, "mean+stderr", "mean", plot.ChartDashed); err != nil {
+			return err
+		}
+	}
+	if g := e.config.MADGraph; g != "" {
+		if err := e.addPlot(xs, mads, g, "MAD", "MAD", plot.ChartBars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
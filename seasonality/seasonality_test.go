@@ -0,0 +1,129 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seasonality
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSeasonality(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_seasonality")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("Seasonality experiment works", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		meanGraph, err := canvas.EnsureGraph(plot.KindXY, "mean", "g")
+		So(err, ShouldBeNil)
+		madGraph, err := canvas.EnsureGraph(plot.KindXY, "mad", "g")
+		So(err, ShouldBeNil)
+		distGraph, err := canvas.EnsureGraph(plot.KindXY, "dist", "dist")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"A": {}, "B": {}}
+		pr := func(date string, p float32) db.PriceRow {
+			d, err := db.NewDateFromString(date)
+			if err != nil {
+				panic(err)
+			}
+			return db.TestPrice(d, p, p, p, 1000.0, true)
+		}
+		// 2020-01-06 is Monday.
+		prices := map[string][]db.PriceRow{
+			"A": {
+				pr("2020-01-03", 100),
+				pr("2020-01-06", 110),
+				pr("2020-01-07", 110),
+				pr("2020-01-10", 100),
+				pr("2020-01-13", 110),
+			},
+			"B": {
+				pr("2020-01-03", 100),
+				pr("2020-01-06", 100),
+				pr("2020-01-07", 110),
+			},
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		Convey("by day of week", func() {
+			var cfg config.Seasonality
+			So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "mean graph": "mean",
+  "MAD graph": "mad",
+  "buckets": {"n": 3, "min": -0.2, "max": 0.2},
+  "distribution": {"graph": "dist", "keep zeros": true}
+}`, tmpdir, dbName))), ShouldBeNil)
+			var e Seasonality
+			So(e.Run(ctx, &cfg), ShouldBeNil)
+			So(values["test tickers"], ShouldEqual, "2")
+			So(values["test Mon mean"], ShouldEqual, "0.06354")
+			So(values["test Mon mean stderr"], ShouldEqual, "0.03177")
+			So(values["test Mon MAD"], ShouldEqual, "0.04236")
+			So(values["test Mon samples"], ShouldEqual, "3")
+			So(values["test Tue mean"], ShouldEqual, "0.04766")
+			So(values["test Tue samples"], ShouldEqual, "2")
+			So(values["test Fri mean"], ShouldEqual, "-0.09531")
+			So(values["test Fri mean stderr"], ShouldEqual, "0")
+
+			So(len(meanGraph.Plots), ShouldEqual, 3)
+			So(meanGraph.Plots[0].Legend, ShouldEqual, "test mean")
+			So(meanGraph.Plots[0].X, ShouldResemble, []float64{1, 2, 5})
+			So(testutil.RoundSlice(meanGraph.Plots[0].Y, 4), ShouldResemble,
+				[]float64{0.06354, 0.04766, -0.09531})
+			So(len(madGraph.Plots), ShouldEqual, 1)
+			So(len(distGraph.Plots), ShouldEqual, 3)
+			So(distGraph.Plots[0].Legend, ShouldEqual, "test Mon p.d.f.")
+		})
+
+		Convey("config requires a graph", func() {
+			var cfg config.Seasonality
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "data": {"daily distribution": {"name": "t"}},
+  "by": "month"
+}`)), ShouldNotBeNil)
+		})
+	})
+}
@@ -32,6 +32,7 @@ var _ Strategy = &BuySellIntraday{}
 
 func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogProfits, xactions bool) strategyResult {
 	var res strategyResult
+	res.name = lp.Ticker
 	if len(lp.Timeseries.Data()) == 0 {
 		logging.Warningf(ctx, "skipping %s: not enough price data", lp.Ticker)
 		return res
@@ -41,6 +42,11 @@ func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogPr
 	// Cumulative log-profit and the max. observed log-profit for the current
 	// position, and the log-profit for the entire strategy.
 	var logProfit, maxLogProfit, totalLogProfit float64
+	var peak float64 // peak cumulative log-profit for drawdowns
+	// Cumulative log-profit at the start of the current day, and whether the
+	// position was held at any time during the day.
+	var dayStart float64
+	var inMarket bool
 	for i, p := range lp.Timeseries.Data() {
 		date := lp.Timeseries.Dates()[i]
 		day := date.Date()
@@ -49,9 +55,18 @@ func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogPr
 		}
 		if day != res.endDate {
 			tradedToday = false
+			if i > 0 {
+				res.addDay(res.endDate, totalLogProfit+logProfit-dayStart, inMarket)
+				dayStart = totalLogProfit + logProfit
+				inMarket = bought
+			}
 		}
+		overnight := i > 0 && day != res.endDate
 		res.endDate = day
 		if bought {
+			if overnight {
+				res.overnightLogProfit += p
+			}
 			logProfit += p
 			if logProfit > maxLogProfit {
 				maxLogProfit = logProfit
@@ -60,6 +75,7 @@ func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogPr
 				bought = false
 				tradedToday = true
 				totalLogProfit += logProfit
+				res.trades = append(res.trades, logProfit)
 				logProfit = 0
 				maxLogProfit = 0
 				res.numSells++
@@ -68,6 +84,7 @@ func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogPr
 						buy: false, date: date, amount: 1})
 				}
 			}
+			peak = res.updateDrawdown(totalLogProfit+logProfit, peak)
 			continue
 		}
 		if s.buy(date, tradedToday) {
@@ -75,6 +92,7 @@ func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogPr
 			maxLogProfit = 0
 			bought = true
 			tradedToday = true
+			inMarket = true
 			res.numBuys++
 			if xactions {
 				res.transactions = append(res.transactions, transaction{
@@ -82,9 +100,11 @@ func (s BuySellIntraday) ExecuteTicker(ctx context.Context, lp experiments.LogPr
 			}
 		}
 	}
-	if bought {
+	if bought { // account for the open position
 		totalLogProfit += logProfit
+		res.trades = append(res.trades, logProfit)
 	}
+	res.addDay(res.endDate, totalLogProfit-dayStart, inMarket)
 	res.logProfit = totalLogProfit
 	return res
 }
@@ -16,6 +16,7 @@ package simulator
 
 import (
 	"context"
+	"math"
 	"testing"
 
 	"github.com/stockparfait/experiments"
@@ -81,6 +82,13 @@ func TestBuySellIntraday(t *testing.T) {
 				{buy: false, date: dt("2020-01-03 12:00:00"), amount: 1},
 			})
 			So(testutil.Round(res.logProfit, 5), ShouldEqual, -0.03+0.02-0.06)
+			So(res.days, ShouldEqual, 3)
+			So(res.Exposure(), ShouldEqual, 1)
+			// Daily log-profits: -0.03, 0.02, -0.06.
+			So(testutil.Round(res.Volatility(), 4), ShouldEqual,
+				testutil.Round(math.Sqrt(252*0.0032667/2), 4))
+			So(testutil.Round(res.Sortino(), 4), ShouldEqual,
+				testutil.Round(-0.07/3*math.Sqrt(252)/math.Sqrt(0.0045/3), 4))
 		})
 
 		Convey("buy at open, sell at trailing stop loss, may keep overnight", func() {
@@ -123,6 +131,7 @@ func TestBuySellIntraday(t *testing.T) {
 				{buy: true, date: dt("2020-01-03 09:00:00"), amount: 1},
 			})
 			So(testutil.Round(res.logProfit, 5), ShouldEqual, -0.01+0.02+0.1-0.06+0.01)
+			So(testutil.Round(res.overnightLogProfit, 5), ShouldEqual, 0.1)
 		})
 	})
 }
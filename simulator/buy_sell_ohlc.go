@@ -0,0 +1,130 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+)
+
+// BuySellOHLC is a strategy trading on daily OHLC bars with realistic fills at
+// the open, the close, or the target and stop loss levels touched within a bar.
+type BuySellOHLC struct {
+	config *config.BuySellOHLCStrategy
+}
+
+var _ PriceStrategy = &BuySellOHLC{}
+
+// ExecuteTicker is not supported, as log-profits have no intraday highs and
+// lows. The strategy always runs on prices via ExecutePrices.
+func (s BuySellOHLC) ExecuteTicker(ctx context.Context, lp experiments.LogProfits, xactions bool) strategyResult {
+	logging.Warningf(ctx, "skipping %s: %s requires prices", lp.Ticker, s.config.Name())
+	return strategyResult{}
+}
+
+func (s BuySellOHLC) ExecutePrices(ctx context.Context, p experiments.Prices, xactions bool) strategyResult {
+	var res strategyResult
+	res.name = p.Ticker
+	if len(p.Rows) == 0 {
+		logging.Warningf(ctx, "skipping %s: not enough price data", p.Ticker)
+		return res
+	}
+	buyAtOpen := s.config.Buy == "open"
+	var bought bool
+	var entry float64 // entry price of the current position
+	var days int      // number of bars the current position is held
+	soldIdx := -1     // index of the bar of the last sale
+	// Cumulative log-profit as of the previous close, and its peak.
+	var prevLogProfit, peak float64
+	var prevClose float64
+	for i, r := range p.Rows {
+		if i == 0 {
+			res.startDate = r.Date
+		}
+		res.endDate = r.Date
+		open := float64(r.OpenFullyAdjusted())
+		close := float64(r.CloseFullyAdjusted)
+		held := bought // position held since the previous bar
+		if !bought && i != soldIdx {
+			bought = true
+			days = 0
+			entry = close
+			if buyAtOpen {
+				entry = open
+			}
+			res.numBuys++
+			if xactions {
+				res.transactions = append(res.transactions, transaction{
+					buy: true, date: r.Date, amount: 1})
+			}
+		}
+		if held {
+			res.overnightLogProfit += math.Log(open / prevClose)
+		}
+		inMarket := held || (bought && buyAtOpen)
+		if inMarket {
+			days++
+			exit, ok := s.exit(entry, open, float64(r.HighFullyAdjusted()),
+				float64(r.LowFullyAdjusted()), close, days)
+			if ok {
+				bought = false
+				soldIdx = i
+				res.logProfit += math.Log(exit / entry)
+				res.trades = append(res.trades, math.Log(exit/entry))
+				res.numSells++
+				if xactions {
+					res.transactions = append(res.transactions, transaction{
+						buy: false, date: r.Date, amount: 1})
+				}
+			}
+		}
+		logProfit := res.logProfit
+		if bought {
+			logProfit += math.Log(close / entry)
+		}
+		res.addDay(r.Date, logProfit-prevLogProfit, inMarket)
+		peak = res.updateDrawdown(logProfit, peak)
+		prevLogProfit = logProfit
+		prevClose = close
+	}
+	if bought { // account for the open position
+		res.trades = append(res.trades, prevLogProfit-res.logProfit)
+	}
+	return res
+}
+
+// exit checks the sell conditions for a position entered at the entry price
+// and held for the given number of bars, and returns the fill price. A gap
+// through the stop loss or the target fills at the open.
+func (s BuySellOHLC) exit(entry, open, high, low, close float64, days int) (float64, bool) {
+	if c := s.config.StopLoss; c > 0 {
+		if stop := entry * c; low <= stop {
+			return math.Min(open, stop), true
+		}
+	}
+	if c := s.config.Target; c > 0 {
+		if target := entry * c; high >= target {
+			return math.Max(open, target), true
+		}
+	}
+	if days >= s.config.MaxDays {
+		return close, true
+	}
+	return 0, false
+}
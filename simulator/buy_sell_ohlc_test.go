@@ -0,0 +1,116 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBuySellOHLC(t *testing.T) {
+	t.Parallel()
+
+	Convey("buy-sell OHLC strategy", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+
+		bar := func(date string, open, high, low, close float32) db.PriceRow {
+			return db.TestPriceRow(dt(date), open, high, low, close, close, close, 1000, true)
+		}
+		p := experiments.Prices{
+			Ticker: "TEST",
+			Rows: []db.PriceRow{
+				bar("2020-01-01", 100, 105, 98, 102),  // buy at open
+				bar("2020-01-02", 103, 104, 101, 103), // sell at close after 2 days
+				bar("2020-01-03", 100, 111, 99, 105),  // buy at open, sell at target
+				bar("2020-01-04", 100, 101, 85, 95),   // buy at open, sell at stop loss
+				bar("2020-01-05", 80, 82, 79, 81),     // buy at open
+				bar("2020-01-06", 70, 72, 60, 65),     // gap below stop loss
+			},
+		}
+
+		Convey("buy at open", func() {
+			var cfg config.BuySellOHLCStrategy
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "target": 1.1,
+  "stop loss": 0.9,
+  "max days": 2
+}`)), ShouldBeNil)
+			s := BuySellOHLC{config: &cfg}
+			res := s.ExecutePrices(ctx, p, true)
+			So(res.transactions, ShouldResemble, []transaction{
+				{buy: true, date: dt("2020-01-01"), amount: 1},
+				{buy: false, date: dt("2020-01-02"), amount: 1},
+				{buy: true, date: dt("2020-01-03"), amount: 1},
+				{buy: false, date: dt("2020-01-03"), amount: 1},
+				{buy: true, date: dt("2020-01-04"), amount: 1},
+				{buy: false, date: dt("2020-01-04"), amount: 1},
+				{buy: true, date: dt("2020-01-05"), amount: 1},
+				{buy: false, date: dt("2020-01-06"), amount: 1},
+			})
+			So(res.numBuys, ShouldEqual, 4)
+			So(res.numSells, ShouldEqual, 4)
+			So(res.name, ShouldEqual, "TEST")
+			So(len(res.trades), ShouldEqual, 4)
+			So(res.WinRate(), ShouldEqual, 0.5)
+			So(res.startDate, ShouldResemble, dt("2020-01-01"))
+			So(res.endDate, ShouldResemble, dt("2020-01-06"))
+			So(testutil.Round(res.logProfit, 5), ShouldEqual,
+				testutil.Round(math.Log(1.03*1.1*0.9*70.0/80.0), 5))
+			// Peak after the target sale, down through the stop loss and the gap.
+			So(testutil.Round(res.maxDrawdown, 5), ShouldEqual,
+				testutil.Round(-math.Log(0.9*70.0/80.0), 5))
+			So(res.days, ShouldEqual, 6)
+			So(res.Exposure(), ShouldEqual, 1)
+			So(testutil.Round(res.overnightLogProfit, 5), ShouldEqual,
+				testutil.Round(math.Log(103.0/102.0*70.0/81.0), 5))
+			So(testutil.Round(res.sum, 5), ShouldEqual, testutil.Round(res.logProfit, 5))
+		})
+
+		Convey("buy at close", func() {
+			var cfg config.BuySellOHLCStrategy
+			So(cfg.InitMessage(testutil.JSON(`{"buy": "close"}`)), ShouldBeNil)
+			s := BuySellOHLC{config: &cfg}
+			res := s.ExecutePrices(ctx, p, true)
+			// Buy at close, sell at the next close, buy again on the next bar.
+			So(res.numBuys, ShouldEqual, 3)
+			So(res.numSells, ShouldEqual, 3)
+			So(res.transactions[1], ShouldResemble, transaction{
+				buy: false, date: dt("2020-01-02"), amount: 1})
+			So(res.Exposure(), ShouldEqual, 0.5)
+			So(testutil.Round(res.overnightLogProfit, 5), ShouldEqual,
+				testutil.Round(math.Log(103.0/102.0*100.0/105.0*70.0/81.0), 5))
+			So(testutil.Round(res.logProfit, 5), ShouldEqual,
+				testutil.Round(math.Log(103.0/102.0*95.0/105.0*65.0/81.0), 5))
+		})
+
+		Convey("config validation", func() {
+			var cfg config.BuySellOHLCStrategy
+			So(cfg.InitMessage(testutil.JSON(`{"target": 0.9}`)), ShouldNotBeNil)
+			So(cfg.InitMessage(testutil.JSON(`{"stop loss": 1.1}`)), ShouldNotBeNil)
+			So(cfg.InitMessage(testutil.JSON(`{"max days": 0}`)), ShouldNotBeNil)
+		})
+	})
+}
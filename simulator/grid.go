@@ -0,0 +1,167 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/stockparfait/table"
+)
+
+// Row of the grid table as the list of strings compatible with encoding/csv.
+type Row []string
+
+var _ table.Row = Row{}
+
+func (r Row) CSV() []string { return r }
+
+// gridStrategy is the copy of the configured strategy with the given target
+// and stop loss.
+func (e *Simulator) gridStrategy(target, stopLoss float64) (Strategy, error) {
+	switch c := e.config.Strategy.Config.(type) {
+	case *config.BuySellIntradayStrategy:
+		var sell []config.IntradaySell
+		for _, js := range []map[string]any{
+			{"target": target},
+			{"stop loss": stopLoss},
+		} {
+			var s config.IntradaySell
+			if err := s.InitMessage(js); err != nil {
+				return nil, errors.Annotate(err, "failed to init sell condition")
+			}
+			sell = append(sell, s)
+		}
+		for _, s := range c.Sell {
+			if s.Target == 0 && s.StopLoss == 0 {
+				sell = append(sell, s)
+			}
+		}
+		cc := *c
+		cc.Sell = sell
+		return newStrategy(&cc)
+	case *config.BuySellOHLCStrategy:
+		cc := *c
+		cc.Target = target
+		cc.StopLoss = stopLoss
+		return newStrategy(&cc)
+	}
+	return nil, errors.Reason(`grid is not supported for "%s"`,
+		e.config.Strategy.Name())
+}
+
+// meanProfit is the mean annualized log-profit over tickers.
+func meanProfit(res []strategyResult) float64 {
+	var sum float64
+	var n int
+	for _, r := range res {
+		if y := r.startDate.YearsTill(r.endDate); y > 0 {
+			sum += r.logProfit / y
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
+
+// runGrid executes the strategy for each grid cell and reports the matrix of
+// mean annualized profits with targets as rows and stop losses as columns.
+func (e *Simulator) runGrid(ctx context.Context) error {
+	g := e.config.Grid
+	header := []string{"target \\ stop loss"}
+	for _, s := range g.StopLosses {
+		header = append(header, fmt.Sprintf("%g", s))
+	}
+	t := table.NewTable(header...)
+	best := math.Inf(-1)
+	var bestTarget, bestStopLoss float64
+	for _, target := range g.Targets {
+		if ctx.Err() != nil {
+			break
+		}
+		row := Row{fmt.Sprintf("%g", target)}
+		for _, stopLoss := range g.StopLosses {
+			s, err := e.gridStrategy(target, stopLoss)
+			if err != nil {
+				return errors.Annotate(err, "failed to create strategy")
+			}
+			res, err := e.executeStrategy(ctx, s, e.config.Data)
+			if err != nil {
+				return errors.Annotate(err,
+					"failed to execute strategy for target=%g stop loss=%g",
+					target, stopLoss)
+			}
+			p := meanProfit(res)
+			if p > best {
+				best = p
+				bestTarget = target
+				bestStopLoss = stopLoss
+			}
+			if !e.config.LogProfit {
+				p = math.Exp(p)
+			}
+			row = append(row, fmt.Sprintf("%.4g", p))
+		}
+		t.AddRow(row)
+	}
+	if err := writeTable(t, experiments.OutputPath(ctx, e.config.Grid.File)); err != nil {
+		return errors.Annotate(err, "failed to write grid")
+	}
+	if math.IsInf(best, -1) {
+		return nil
+	}
+	if !e.config.LogProfit {
+		best = math.Exp(best)
+	}
+	for _, v := range []struct {
+		key string
+		x   float64
+	}{
+		{"best target", bestTarget},
+		{"best stop loss", bestStopLoss},
+		{"best profit", best},
+	} {
+		if err := experiments.AddTypedValue(ctx, e.config.ID, v.key, experiments.FloatValue(v.x)); err != nil {
+			return errors.Annotate(err, "failed to add %s value", v.key)
+		}
+	}
+	return nil
+}
+
+// writeTable to the CSV file f, or as text to stdout when f is "" or "-".
+func writeTable(t *table.Table, f string) error {
+	if f == "" || f == "-" {
+		if err := t.WriteText(os.Stdout, table.Params{}); err != nil {
+			return errors.Annotate(err, "failed to write table to stdout")
+		}
+		return nil
+	}
+	w, err := os.OpenFile(f, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Annotate(err, "failed to open output CSV file '%s'", f)
+	}
+	defer w.Close()
+	if err = t.WriteCSV(w, table.Params{}); err != nil {
+		return errors.Annotate(err, "failed to write CSV file '%s'", f)
+	}
+	return nil
+}
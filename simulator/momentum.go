@@ -0,0 +1,244 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+// PortfolioStrategy is a Strategy which trades all the tickers at once as a
+// single portfolio. When a strategy implements it, ExecuteTicker is not used.
+type PortfolioStrategy interface {
+	Strategy
+	// ExecutePortfolio over all the series sorted by ticker. A zero result
+	// means the strategy didn't apply.
+	ExecutePortfolio(ctx context.Context, lps []experiments.LogProfits, xactions bool) strategyResult
+}
+
+func (e *Simulator) executePortfolioStrategy(ctx context.Context, s PortfolioStrategy, src *config.Source) ([]strategyResult, error) {
+	lps, err := e.loadLogProfits(ctx, src)
+	if err != nil {
+		return nil, errors.Annotate(err,
+			`failed to execute "%s"`, e.config.Strategy.Name())
+	}
+	res := s.ExecutePortfolio(ctx, lps, false)
+	if res.IsZero() {
+		return nil, nil
+	}
+	return []strategyResult{res}, nil
+}
+
+// plotEquity plots the equity curves of the results which have one.
+func (e *Simulator) plotEquity(ctx context.Context, res []strategyResult) error {
+	if e.config.EquityGraph == "" {
+		return nil
+	}
+	for _, r := range res {
+		if r.equity == nil {
+			continue
+		}
+		legend := e.Prefix(r.name + " equity")
+		plt, err := plot.NewSeriesPlot(r.equity)
+		if err != nil {
+			return errors.Annotate(err, "failed to create plot '%s'", legend)
+		}
+		plt.SetYLabel("value").SetLegend(legend)
+		if err := experiments.AddPlot(ctx, plt, e.config.EquityGraph); err != nil {
+			return errors.Annotate(err, "failed to add plot '%s'", legend)
+		}
+	}
+	return nil
+}
+
+// CrossSectionalMomentum is a strategy holding the recent winners (and
+// optionally shorting the recent losers) among all the tickers.
+type CrossSectionalMomentum struct {
+	config *config.CrossSectionalMomentumStrategy
+}
+
+var _ PortfolioStrategy = &CrossSectionalMomentum{}
+
+// ExecuteTicker is not supported, as the strategy ranks all the tickers. It
+// always runs via ExecutePortfolio.
+func (s CrossSectionalMomentum) ExecuteTicker(ctx context.Context, lp experiments.LogProfits, xactions bool) strategyResult {
+	logging.Warningf(ctx, "skipping %s: %s requires a portfolio", lp.Ticker, s.config.Name())
+	return strategyResult{}
+}
+
+// alignedSeries of log-profits on the union of all the dates.
+type alignedSeries struct {
+	dates []db.Date
+	lps   [][]float64 // lps[ticker][date]; 0 when missing
+	first []int       // index of the first date with data for each ticker
+	last  []int       // index of the last date with data for each ticker
+}
+
+func alignSeries(lps []experiments.LogProfits) *alignedSeries {
+	dateSet := make(map[db.Date]struct{})
+	for _, lp := range lps {
+		for _, d := range lp.Timeseries.Dates() {
+			dateSet[d] = struct{}{}
+		}
+	}
+	res := &alignedSeries{
+		lps:   make([][]float64, len(lps)),
+		first: make([]int, len(lps)),
+		last:  make([]int, len(lps)),
+	}
+	for d := range dateSet {
+		res.dates = append(res.dates, d)
+	}
+	sort.Slice(res.dates, func(i, j int) bool { return res.dates[i].Before(res.dates[j]) })
+	index := make(map[db.Date]int, len(res.dates))
+	for i, d := range res.dates {
+		index[d] = i
+	}
+	for i, lp := range lps {
+		res.lps[i] = make([]float64, len(res.dates))
+		res.first[i] = len(res.dates)
+		res.last[i] = -1
+		for j, d := range lp.Timeseries.Dates() {
+			k := index[d]
+			res.lps[i][k] = lp.Timeseries.Data()[j]
+			if k < res.first[i] {
+				res.first[i] = k
+			}
+			if k > res.last[i] {
+				res.last[i] = k
+			}
+		}
+	}
+	return res
+}
+
+// rank returns the long and short legs at the end of the day t, as the indices
+// of the tickers which have the data for the entire lookback period.
+func (s CrossSectionalMomentum) rank(a *alignedSeries, t int) (long, short []int) {
+	type score struct {
+		i int
+		x float64
+	}
+	var scores []score
+	k := s.config.Lookback
+	for i, lps := range a.lps {
+		if a.first[i] > t-k+1 || a.last[i] < t {
+			continue
+		}
+		var sum float64
+		for _, x := range lps[t-k+1 : t+1] {
+			sum += x
+		}
+		scores = append(scores, score{i: i, x: sum})
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].x > scores[j].x })
+	n := int(s.config.Quantile * float64(len(scores)))
+	if n == 0 && len(scores) >= 2 {
+		n = 1
+	}
+	for j := 0; j < n; j++ {
+		long = append(long, scores[j].i)
+		if s.config.Short {
+			short = append(short, scores[len(scores)-1-j].i)
+		}
+	}
+	return
+}
+
+// legReturn is the simple return of an equally weighted leg on the day t.
+func legReturn(a *alignedSeries, leg []int, t int) float64 {
+	if len(leg) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, i := range leg {
+		sum += math.Exp(a.lps[i][t]) - 1
+	}
+	return sum / float64(len(leg))
+}
+
+func (s CrossSectionalMomentum) ExecutePortfolio(ctx context.Context, lps []experiments.LogProfits, xactions bool) strategyResult {
+	var res strategyResult
+	a := alignSeries(lps)
+	if len(a.dates) <= s.config.Lookback {
+		logging.Warningf(ctx, "skipping %s: too few dates: %d",
+			s.config.Name(), len(a.dates))
+		return res
+	}
+	res.name = "portfolio"
+	res.startDate = a.dates[0]
+	held := make(map[int]bool) // currently held tickers, long or short
+	var long, short []int
+	var peak float64
+	equity := make([]float64, len(a.dates))
+	for t := range a.dates {
+		res.endDate = a.dates[t]
+		// Returns of the positions opened at the end of the previous day.
+		var lp float64
+		inMarket := len(long) > 0
+		if inMarket {
+			r := legReturn(a, long, t)
+			if s.config.Short {
+				r = (r - legReturn(a, short, t)) / 2
+			}
+			lp = math.Log(math.Max(1+r, math.SmallestNonzeroFloat64))
+			res.logProfit += lp
+		}
+		res.addDay(a.dates[t], lp, inMarket)
+		peak = res.updateDrawdown(res.logProfit, peak)
+		equity[t] = math.Exp(res.logProfit)
+		if t+1 < s.config.Lookback || (t+1-s.config.Lookback)%s.config.Rebalance != 0 {
+			continue
+		}
+		long, short = s.rank(a, t)
+		next := make(map[int]bool)
+		for _, i := range append(append([]int{}, long...), short...) {
+			next[i] = true
+			if !held[i] {
+				res.numBuys++
+				if xactions {
+					res.transactions = append(res.transactions, transaction{
+						buy: true, date: a.dates[t], amount: 1 / float64(len(long)+len(short))})
+				}
+			}
+		}
+		var prev []int
+		for i := range held {
+			prev = append(prev, i)
+		}
+		sort.Ints(prev)
+		for _, i := range prev {
+			if !next[i] {
+				res.numSells++
+				if xactions {
+					res.transactions = append(res.transactions, transaction{
+						buy: false, date: a.dates[t], amount: 1 / float64(len(held))})
+				}
+			}
+		}
+		held = next
+	}
+	res.equity = stats.NewTimeseries(a.dates, equity)
+	return res
+}
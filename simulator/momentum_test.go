@@ -0,0 +1,129 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCrossSectionalMomentum(t *testing.T) {
+	t.Parallel()
+
+	Convey("cross-sectional momentum strategy", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+
+		var dates []db.Date
+		for i := 0; i < 6; i++ {
+			dates = append(dates, db.NewDate(2020, 1, uint8(i+1)))
+		}
+		series := func(ticker string, xs ...float64) experiments.LogProfits {
+			return experiments.LogProfits{
+				Ticker:     ticker,
+				Timeseries: stats.NewTimeseries(dates, xs),
+			}
+		}
+		lps := []experiments.LogProfits{
+			series("A", 0.1, 0.1, -0.05, 0, 0.02, 0),
+			series("B", 0, 0, 0.05, 0, 0, 0),
+			series("C", -0.1, -0.1, 0.02, 0, 0, 0),
+			series("D", 0, 0.05, 0, 0, 0, 0),
+		}
+
+		Convey("long-short", func() {
+			var cfg config.CrossSectionalMomentumStrategy
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "lookback": 2,
+  "rebalance": 2,
+  "quantile": 0.25,
+  "short": true
+}`)), ShouldBeNil)
+			s := CrossSectionalMomentum{config: &cfg}
+			res := s.ExecutePortfolio(ctx, lps, true)
+			// Long A / short C, then long B / short A, then long A / short D.
+			So(res.numBuys, ShouldEqual, 4)
+			So(res.numSells, ShouldEqual, 2)
+			day2 := ((math.Exp(-0.05) - 1) - (math.Exp(0.02) - 1)) / 2
+			day4 := (0 - (math.Exp(0.02) - 1)) / 2
+			So(testutil.Round(res.logProfit, 5), ShouldEqual,
+				testutil.Round(math.Log(1+day2)+math.Log(1+day4), 5))
+			So(testutil.Round(res.Exposure(), 5), ShouldEqual, testutil.Round(4.0/6.0, 5))
+			So(res.equity.Dates(), ShouldResemble, dates)
+			So(res.equity.Data()[1], ShouldEqual, 1)
+			So(testutil.Round(res.equity.Data()[5], 5), ShouldEqual,
+				testutil.Round(math.Exp(res.logProfit), 5))
+		})
+
+		Convey("long only, too few dates", func() {
+			var cfg config.CrossSectionalMomentumStrategy
+			So(cfg.InitMessage(testutil.JSON(`{"lookback": 6}`)), ShouldBeNil)
+			s := CrossSectionalMomentum{config: &cfg}
+			So(s.ExecutePortfolio(ctx, lps, false).IsZero(), ShouldBeTrue)
+		})
+
+		Convey("config validation", func() {
+			var cfg config.CrossSectionalMomentumStrategy
+			So(cfg.InitMessage(testutil.JSON(`{"quantile": 0.6}`)), ShouldNotBeNil)
+			So(cfg.InitMessage(testutil.JSON(`{"rebalance": 0}`)), ShouldNotBeNil)
+		})
+	})
+
+	Convey("cross-sectional momentum in simulator", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		equityGraph, err := canvas.EnsureGraph(plot.KindSeries, "equity", "group")
+		So(err, ShouldBeNil)
+
+		var cfg config.Simulator
+		So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "MAD": 0.01},
+    "tickers": 10,
+    "days": 30,
+    "seed": 42
+  },
+  "strategy": {"cross-sectional momentum": {
+    "lookback": 5,
+    "rebalance": 5,
+    "quantile": 0.2
+  }},
+  "equity graph": "equity"
+}`)), ShouldBeNil)
+		var simExp Simulator
+		So(simExp.Run(ctx, &cfg), ShouldBeNil)
+		So(len(equityGraph.Plots), ShouldEqual, 1)
+		So(equityGraph.Plots[0].Legend, ShouldEqual, "test portfolio equity")
+		So(values["test mean exposure"], ShouldNotBeEmpty)
+	})
+}
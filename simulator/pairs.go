@@ -0,0 +1,203 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sort"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/stats"
+
+	"gonum.org/v1/gonum/stat"
+)
+
+// PairStrategy is a Strategy which trades two synchronized series at once. When
+// a strategy implements it, ExecuteTicker is not used.
+type PairStrategy interface {
+	Strategy
+	// Pairs of indices into lps (sorted by ticker) to trade.
+	SelectPairs(ctx context.Context, lps []experiments.LogProfits) iterator.Iterator[experiments.IntPair]
+	// Concurrency-safe strategy execution for a pair of tickers. Only the pairs
+	// of series whose intersection satisfies the strategy's requirements are
+	// traded; otherwise the result is zero.
+	ExecutePair(ctx context.Context, x, y experiments.LogProfits, xactions bool) strategyResult
+}
+
+func (e *Simulator) executePairStrategy(ctx context.Context, s PairStrategy, src *config.Source) ([]strategyResult, error) {
+	lps, err := e.loadLogProfits(ctx, src)
+	if err != nil {
+		return nil, errors.Annotate(err,
+			`failed to execute "%s"`, e.config.Strategy.Name())
+	}
+	f := func(pairs []experiments.IntPair) []strategyResult {
+		var res []strategyResult
+		for _, p := range pairs {
+			r := s.ExecutePair(ctx, lps[p.X], lps[p.Y], false)
+			if !r.IsZero() {
+				res = append(res, r)
+			}
+		}
+		return res
+	}
+	batches := iterator.Batch(s.SelectPairs(ctx, lps), src.BatchSize)
+	pm := iterator.ParallelMap(ctx, experiments.Workers(ctx, 2*runtime.NumCPU()), batches, f)
+	defer pm.Close()
+	rf := func(res, r []strategyResult) []strategyResult { return append(res, r...) }
+	res := iterator.Reduce[[]strategyResult](pm, nil, rf)
+	// Parallel execution yields the pairs in any order.
+	sort.SliceStable(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res, nil
+}
+
+// reportPairs adds the log-profit and the number of trades of each pair as
+// values, and plots the distributions of the trade log-profits by pair.
+func (e *Simulator) reportPairs(ctx context.Context, res []strategyResult, c *config.PairsStrategy) error {
+	for _, r := range res {
+		k := r.name + " log-profit"
+		if err := experiments.AddTypedValue(ctx, e.config.ID, k, experiments.FloatValue(r.logProfit)); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+		k = r.name + " trades"
+		if err := experiments.AddTypedValue(ctx, e.config.ID, k, experiments.IntValue(len(r.trades))); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+		if c.PairPlot == nil || len(r.trades) == 0 {
+			continue
+		}
+		dist := experiments.NewSampleDistribution(r.trades, c.PairPlot)
+		legend := r.name + " trades"
+		if err := experiments.PlotDistribution(ctx, dist, c.PairPlot, e.config.ID, legend); err != nil {
+			return errors.Annotate(err, "failed to plot %s", legend)
+		}
+	}
+	return nil
+}
+
+// Pairs is a spread trading strategy for pairs of tickers.
+type Pairs struct {
+	config *config.PairsStrategy
+}
+
+var _ PairStrategy = &Pairs{}
+
+// ExecuteTicker is not supported, as the strategy needs pairs of series. It
+// always runs via ExecutePair.
+func (s Pairs) ExecuteTicker(ctx context.Context, lp experiments.LogProfits, xactions bool) strategyResult {
+	logging.Warningf(ctx, "skipping %s: %s requires pairs", lp.Ticker, s.config.Name())
+	return strategyResult{}
+}
+
+// SelectPairs yields the explicitly configured pairs which are present in lps,
+// or all the pairs of lps otherwise. The correlation requirement for the latter
+// is checked in ExecutePair.
+func (s Pairs) SelectPairs(ctx context.Context, lps []experiments.LogProfits) iterator.Iterator[experiments.IntPair] {
+	if len(s.config.Pairs) == 0 {
+		return experiments.SamplePairs(len(lps), 0, 0)
+	}
+	index := make(map[string]int)
+	for i, lp := range lps {
+		index[lp.Ticker] = i
+	}
+	var pairs []experiments.IntPair
+	for _, p := range s.config.Pairs {
+		x, okX := index[p[0]]
+		y, okY := index[p[1]]
+		if !okX || !okY {
+			logging.Warningf(ctx, "skipping pair %s/%s: no data", p[0], p[1])
+			continue
+		}
+		pairs = append(pairs, experiments.IntPair{X: x, Y: y})
+	}
+	return iterator.FromSlice(pairs)
+}
+
+func (s Pairs) ExecutePair(ctx context.Context, x, y experiments.LogProfits, xactions bool) strategyResult {
+	var res strategyResult
+	name := x.Ticker + "/" + y.Ticker
+	tss := stats.TimeseriesIntersect(x.Timeseries, y.Timeseries)
+	xs, ys, dates := tss[0].Data(), tss[1].Data(), tss[0].Dates()
+	w := s.config.Window
+	if len(xs) <= w {
+		logging.Debugf(ctx, "skipping %s: too few samples: %d", name, len(xs))
+		return res
+	}
+	if len(s.config.Pairs) == 0 {
+		if stat.Correlation(xs, ys, nil) < s.config.MinCorrelation {
+			return res
+		}
+	}
+	res.name = name
+	res.startDate = dates[0]
+	spread := make([]float64, len(xs))
+	var sum float64
+	for i := range xs {
+		sum += xs[i] - ys[i]
+		spread[i] = sum
+	}
+	var pos int // +1 for long, -1 for short spread, 0 for no position
+	var tradeLogProfit, peak float64
+	for i := range xs {
+		res.endDate = dates[i]
+		var lp float64
+		if pos != 0 {
+			lp = float64(pos) * (xs[i] - ys[i]) / 2
+			tradeLogProfit += lp
+			res.logProfit += lp
+		}
+		res.addDay(dates[i], lp, pos != 0)
+		peak = res.updateDrawdown(res.logProfit, peak)
+		if i+1 < w {
+			continue
+		}
+		sample := stats.NewSample(spread[i+1-w : i+1])
+		sigma := sample.Sigma()
+		if sigma == 0 {
+			continue
+		}
+		z := (spread[i] - sample.Mean()) / sigma
+		switch {
+		case pos == 0 && math.Abs(z) > s.config.Entry:
+			pos = 1
+			if z > 0 {
+				pos = -1
+			}
+			tradeLogProfit = 0
+			res.numBuys++
+			if xactions {
+				res.transactions = append(res.transactions, transaction{
+					buy: true, date: dates[i], amount: 1})
+			}
+		case pos != 0 && math.Abs(z) < s.config.Exit:
+			pos = 0
+			res.trades = append(res.trades, tradeLogProfit)
+			res.numSells++
+			if xactions {
+				res.transactions = append(res.transactions, transaction{
+					buy: false, date: dates[i], amount: 1})
+			}
+		}
+	}
+	if pos != 0 { // account for the open position
+		res.trades = append(res.trades, tradeLogProfit)
+	}
+	return res
+}
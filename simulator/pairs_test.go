@@ -0,0 +1,160 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/iterator"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/stockparfait/stats"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPairs(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_pairs")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("pairs strategy", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+
+		var dates []db.Date
+		for i := 0; i < 10; i++ {
+			dates = append(dates, db.NewDate(2020, 1, uint8(i+1)))
+		}
+		// The spread jumps on day 4 and reverts by day 8.
+		xs := []float64{0.01, -0.01, 0.01, -0.01, 0.1, 0.02, -0.05, -0.05, 0, 0}
+		ys := make([]float64, len(xs))
+		x := experiments.LogProfits{Ticker: "X", Timeseries: stats.NewTimeseries(dates, xs)}
+		y := experiments.LogProfits{Ticker: "Y", Timeseries: stats.NewTimeseries(dates, ys)}
+
+		var cfg config.PairsStrategy
+		So(cfg.InitMessage(testutil.JSON(`
+{
+  "pairs": [["X", "Y"]],
+  "window": 3,
+  "entry": 1,
+  "exit": 0.8
+}`)), ShouldBeNil)
+		s := Pairs{config: &cfg}
+
+		Convey("short the spread", func() {
+			res := s.ExecutePair(ctx, x, y, true)
+			So(res.name, ShouldEqual, "X/Y")
+			So(res.transactions, ShouldResemble, []transaction{
+				{buy: true, date: dates[4], amount: 1},
+				{buy: false, date: dates[8], amount: 1},
+			})
+			So(testutil.Round(res.logProfit, 5), ShouldEqual, 0.04)
+			So(testutil.RoundSlice(res.trades, 5), ShouldResemble, []float64{0.04})
+			So(res.Exposure(), ShouldEqual, 0.4)
+		})
+
+		Convey("long the spread", func() {
+			res := s.ExecutePair(ctx, y, x, false)
+			So(res.name, ShouldEqual, "Y/X")
+			So(testutil.Round(res.logProfit, 5), ShouldEqual, 0.04)
+			So(res.numBuys, ShouldEqual, 1)
+			So(res.numSells, ShouldEqual, 1)
+		})
+
+		Convey("too few samples", func() {
+			cfg.Window = 10
+			res := s.ExecutePair(ctx, x, y, false)
+			So(res.IsZero(), ShouldBeTrue)
+		})
+
+		Convey("selects pairs", func() {
+			lps := []experiments.LogProfits{x, y, {Ticker: "Z"}}
+			So(iterator.ToSlice(s.SelectPairs(ctx, lps)), ShouldResemble,
+				[]experiments.IntPair{{X: 0, Y: 1}})
+			cfg.Pairs = nil
+			So(len(iterator.ToSlice(s.SelectPairs(ctx, lps))), ShouldEqual, 3)
+		})
+
+		Convey("config validation", func() {
+			var c config.PairsStrategy
+			So(c.InitMessage(testutil.JSON(`{"pairs": [["A"]]}`)), ShouldNotBeNil)
+			So(c.InitMessage(testutil.JSON(`{"pairs": [["A", "A"]]}`)), ShouldNotBeNil)
+			So(c.InitMessage(testutil.JSON(`{"entry": 1, "exit": 1}`)), ShouldNotBeNil)
+		})
+	})
+
+	Convey("pairs strategy in simulator", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+		pairGraph, err := canvas.EnsureGraph(plot.KindXY, "pair", "group")
+		So(err, ShouldBeNil)
+
+		dbName := "db"
+		tickers := map[string]db.TickerRow{"X": {}, "Y": {}}
+		prices := make(map[string][]db.PriceRow)
+		px := 100.0
+		for i, lp := range []float64{0.01, -0.01, 0.01, -0.01, 0.1, 0.02, -0.05, -0.05, 0, 0} {
+			d := db.NewDate(2020, 1, uint8(i+1))
+			p := float32(px)
+			prices["X"] = append(prices["X"], db.TestPrice(d, p, p, p, 1000, true))
+			prices["Y"] = append(prices["Y"], db.TestPrice(d, 50, 50, 50, 1000, true))
+			px *= math.Exp(lp)
+		}
+		w := db.NewWriter(tmpdir, dbName)
+		So(w.WriteTickers(tickers), ShouldBeNil)
+		for t, p := range prices {
+			So(w.WritePrices(t, p), ShouldBeNil)
+		}
+
+		var cfg config.Simulator
+		So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {"DB path": "%s", "DB": "%s"}},
+  "strategy": {"pairs": {
+    "pairs": [["X", "Y"]],
+    "window": 3,
+    "entry": 1,
+    "exit": 0.8,
+    "pair plot": {"graph": "pair"}
+  }}
+}`, tmpdir, dbName))), ShouldBeNil)
+		var simExp Simulator
+		So(simExp.Run(ctx, &cfg), ShouldBeNil)
+		So(values["test num buys"], ShouldEqual, "1")
+		So(values["test X/Y trades"], ShouldEqual, "1")
+		So(values["test X/Y log-profit"], ShouldNotBeEmpty)
+		So(len(pairGraph.Plots), ShouldEqual, 1)
+		So(pairGraph.Plots[0].Legend, ShouldEqual, "test X/Y trades p.d.f.")
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/stockparfait/table"
+)
+
+// resultsHeader is the CSV header of the per-ticker results table.
+var resultsHeader = []string{
+	"ticker", "log-profit", "annual log-profit", "trades", "win rate",
+	"max drawdown", "start", "end",
+}
+
+// WinRate is the fraction of profitable trades. It is NaN when no trades are
+// recorded.
+func (s strategyResult) WinRate() float64 {
+	if len(s.trades) == 0 {
+		return math.NaN()
+	}
+	var wins int
+	for _, t := range s.trades {
+		if t > 0 {
+			wins++
+		}
+	}
+	return float64(wins) / float64(len(s.trades))
+}
+
+// resultRow is the row of the per-ticker results table for r.
+func resultRow(r strategyResult) Row {
+	var annual float64
+	if y := r.startDate.YearsTill(r.endDate); y > 0 {
+		annual = r.logProfit / y
+	}
+	return Row{
+		r.name,
+		fmt.Sprintf("%g", r.logProfit),
+		fmt.Sprintf("%g", annual),
+		fmt.Sprintf("%d", r.numBuys),
+		fmt.Sprintf("%g", r.WinRate()),
+		fmt.Sprintf("%g", r.Drawdown()),
+		r.startDate.String(),
+		r.endDate.String(),
+	}
+}
+
+// writeResults dumps the per-ticker results as a CSV table, if configured.
+func (e *Simulator) writeResults(ctx context.Context, res []strategyResult) error {
+	if e.config.File == "" {
+		return nil
+	}
+	t := table.NewTable(resultsHeader...)
+	for _, r := range res {
+		t.AddRow(resultRow(r))
+	}
+	if err := writeTable(t, experiments.OutputPath(ctx, e.config.File)); err != nil {
+		return errors.Annotate(err, "failed to write results table")
+	}
+	return nil
+}
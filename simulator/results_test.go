@@ -0,0 +1,92 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResults(t *testing.T) {
+	t.Parallel()
+
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_simulator_results")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
+	Convey("resultRow works", t, func() {
+		r := strategyResult{
+			name:        "TEST",
+			trades:      []float64{0.1, -0.05, 0.2, 0},
+			logProfit:   0.25,
+			startDate:   dt("2020-01-01"),
+			endDate:     dt("2021-01-01"),
+			numBuys:     4,
+			maxDrawdown: math.Log(2),
+		}
+		So(r.WinRate(), ShouldEqual, 0.5)
+		So(resultRow(r), ShouldResemble, Row{
+			"TEST", "0.25", "0.25", "4", "0.5", "0.5", "2020-01-01", "2021-01-01"})
+		So(math.IsNaN(strategyResult{}.WinRate()), ShouldBeTrue)
+	})
+
+	Convey("Simulator writes the results table", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		ctx = plot.Use(ctx, plot.NewCanvas())
+		ctx = experiments.UseValues(ctx, make(experiments.Values))
+
+		csvFile := filepath.Join(tmpdir, "results.csv")
+		var cfg config.Simulator
+		So(cfg.InitMessage(testutil.JSON(fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "MAD": 0.02},
+    "intraday distribution": {"name": "t", "MAD": 0.005},
+    "tickers": 3,
+    "days": 50,
+    "seed": 42
+  },
+  "strategy": {"buy-sell OHLC": {"max days": 5}},
+  "file": "%s"
+}`, csvFile))), ShouldBeNil)
+		var simExp Simulator
+		So(simExp.Run(ctx, &cfg), ShouldBeNil)
+		So(testutil.FileExists(csvFile), ShouldBeTrue)
+		csvData, err := os.ReadFile(csvFile)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(csvData)), "\n")
+		So(len(lines), ShouldEqual, 4)
+		So(lines[0], ShouldEqual, strings.Join(resultsHeader, ","))
+		So(lines[1], ShouldStartWith, "synthetic,")
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sort"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/experiments"
@@ -46,20 +47,114 @@ func (e *Simulator) Run(ctx context.Context, cfg config.ExperimentConfig) error
 	if e.config, ok = cfg.(*config.Simulator); !ok {
 		return errors.Reason("unexpected config type: %T", cfg)
 	}
-	var s Strategy
-	switch c := e.config.Strategy.Config.(type) {
-	case *config.BuySellIntradayStrategy:
-		s = &BuySellIntraday{config: c}
-	default:
-		return errors.Reason(`unsupported strategy "%s"`, c.Name())
+	if e.config.Grid != nil {
+		if err := e.runGrid(ctx); err != nil {
+			return errors.Annotate(err, "failed to run the strategy grid")
+		}
+		return nil
 	}
-	res, err := e.executeStrategy(ctx, s)
+	s, err := newStrategy(e.config.Strategy.Config)
 	if err != nil {
-		return errors.Annotate(err, "failled to execute strategy")
+		return errors.Annotate(err, "failed to create strategy")
+	}
+	var all []strategyResult
+	var returns, drawdowns []float64
+	for i := 0; i < e.config.Runs; i++ {
+		res, err := e.executeStrategy(ctx, s, e.runSource(i))
+		if err != nil {
+			return errors.Annotate(err, "failled to execute strategy")
+		}
+		all = append(all, res...)
+		if e.config.Runs > 1 {
+			ret, dd := runOutcome(res)
+			returns = append(returns, ret)
+			drawdowns = append(drawdowns, dd)
+		}
 	}
-	if err := e.reportResults(ctx, res); err != nil {
+	if err := e.reportResults(ctx, all); err != nil {
 		return errors.Annotate(err, "failed to report results")
 	}
+	if err := e.writeResults(ctx, all); err != nil {
+		return errors.Annotate(err, "failed to write results")
+	}
+	if e.config.Runs > 1 {
+		if err := e.reportRuns(ctx, returns, drawdowns); err != nil {
+			return errors.Annotate(err, "failed to report runs")
+		}
+	}
+	return nil
+}
+
+func newStrategy(c config.StrategyConfig) (Strategy, error) {
+	switch c := c.(type) {
+	case *config.BuySellIntradayStrategy:
+		return &BuySellIntraday{config: c}, nil
+	case *config.BuySellOHLCStrategy:
+		return &BuySellOHLC{config: c}, nil
+	case *config.PairsStrategy:
+		return &Pairs{config: c}, nil
+	case *config.CrossSectionalMomentumStrategy:
+		return &CrossSectionalMomentum{config: c}, nil
+	case *config.VolatilityTargetStrategy:
+		return newVolatilityTarget(c)
+	}
+	return nil, errors.Reason(`unsupported strategy "%s"`, c.Name())
+}
+
+// runSource is the data source for the i'th run. A seeded source is reseeded
+// for each run, so the runs are independent but reproducible.
+func (e *Simulator) runSource(i int) *config.Source {
+	if i == 0 || e.config.Data.Seed == 0 {
+		return e.config.Data
+	}
+	c := *e.config.Data
+	// Synthetic sources use up to 5 consecutive seeds for their distributions.
+	c.Seed += 5 * i
+	return &c
+}
+
+// runOutcome is the annualized log-profit and the max. drawdown of a single run,
+// both averaged over tickers. The drawdown is the fraction of the value lost
+// from its peak.
+func runOutcome(res []strategyResult) (logProfit, drawdown float64) {
+	var n, m int
+	for _, r := range res {
+		drawdown += r.Drawdown()
+		m++
+		if y := r.startDate.YearsTill(r.endDate); y > 0 {
+			logProfit += r.logProfit / y
+			n++
+		}
+	}
+	if n > 0 {
+		logProfit /= float64(n)
+	}
+	if m > 0 {
+		drawdown /= float64(m)
+	}
+	return
+}
+
+func (e *Simulator) reportRuns(ctx context.Context, returns, drawdowns []float64) error {
+	if !e.config.LogProfit {
+		for i, r := range returns {
+			returns[i] = math.Exp(r)
+		}
+	}
+	sort.Float64s(returns)
+	sort.Float64s(drawdowns)
+	for _, p := range e.config.Percentiles {
+		k := fmt.Sprintf("annual return p%g", p)
+		v := experiments.FloatValue(experiments.SortedQuantile(returns, p/100))
+		if err := experiments.AddTypedValue(ctx, e.config.ID, k, v); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+		k = fmt.Sprintf("max drawdown p%g", p)
+		v = experiments.FloatValue(experiments.SortedQuantile(drawdowns, p/100))
+		if err := experiments.AddTypedValue(ctx, e.config.ID, k, v); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+	}
 	return nil
 }
 
@@ -72,41 +167,134 @@ type transaction struct {
 
 // strategyResult for a single ticker run of a strategy.
 type strategyResult struct {
+	name   string    // ticker, or e.g. the name of the traded pair
+	trades []float64 // optional log-profits of individual trades
+	// Optional equity curve as the value factor relative to the start.
+	equity       *stats.Timeseries
 	logProfit    float64
 	startDate    db.Date
 	endDate      db.Date
 	transactions []transaction // optional
 	numBuys      int
 	numSells     int
+	// Part of logProfit earned between the last sample (close) of a day and
+	// the first sample (open) of the next day; the rest is intraday.
+	overnightLogProfit float64
+	// Max. drop of the cumulative log-profit from its running peak.
+	maxDrawdown float64
+	// Daily log-profit statistics.
+	days      int     // number of trading days
+	daysIn    int     // number of days with an open position
+	sum       float64 // sum of daily log-profits
+	sumSq     float64 // sum of squares of daily log-profits
+	sumDownSq float64 // sum of squares of negative daily log-profits
+	// Daily log-profits and whether a position was open on each day.
+	dailyDates    []db.Date
+	daily         []float64
+	dailyInMarket []bool
+	// For a result of a wrapper strategy, the result of the inner strategy.
+	unscaled *strategyResult
+}
+
+// addDay accounts for the log-profit of a single trading day.
+func (s *strategyResult) addDay(date db.Date, logProfit float64, inMarket bool) {
+	s.dailyDates = append(s.dailyDates, date)
+	s.daily = append(s.daily, logProfit)
+	s.dailyInMarket = append(s.dailyInMarket, inMarket)
+	s.days++
+	if inMarket {
+		s.daysIn++
+	}
+	s.sum += logProfit
+	s.sumSq += logProfit * logProfit
+	if logProfit < 0 {
+		s.sumDownSq += logProfit * logProfit
+	}
+}
+
+// Drawdown is the max. fraction of the value lost from its previous peak.
+func (s strategyResult) Drawdown() float64 { return 1 - math.Exp(-s.maxDrawdown) }
+
+// Volatility is the annualized standard deviation of daily log-profits,
+// assuming 252 trading days. It is NaN for fewer than 2 days.
+func (s strategyResult) Volatility() float64 {
+	if s.days < 2 {
+		return math.NaN()
+	}
+	n := float64(s.days)
+	mean := s.sum / n
+	variance := (s.sumSq - n*mean*mean) / (n - 1)
+	return math.Sqrt(math.Max(variance, 0) * 252)
+}
+
+// Sharpe ratio, annualized with 0 risk-free rate. It is NaN when undefined.
+func (s strategyResult) Sharpe() float64 {
+	v := s.Volatility()
+	if !(v > 0) {
+		return math.NaN()
+	}
+	return s.sum / float64(s.days) * 252 / v
+}
+
+// Sortino ratio, annualized with 0 target return. It is NaN when there are no
+// losing days.
+func (s strategyResult) Sortino() float64 {
+	if s.sumDownSq == 0 {
+		return math.NaN()
+	}
+	n := float64(s.days)
+	return s.sum / n * math.Sqrt(252) / math.Sqrt(s.sumDownSq/n)
+}
+
+// Exposure is the fraction of days with an open position.
+func (s strategyResult) Exposure() float64 {
+	if s.days == 0 {
+		return 0
+	}
+	return float64(s.daysIn) / float64(s.days)
+}
+
+// updateDrawdown with the current cumulative log-profit, given its running
+// peak so far. Returns the new peak.
+func (s *strategyResult) updateDrawdown(logProfit, peak float64) float64 {
+	if logProfit > peak {
+		return logProfit
+	}
+	if dd := peak - logProfit; dd > s.maxDrawdown {
+		s.maxDrawdown = dd
+	}
+	return peak
 }
 
 func (s strategyResult) IsZero() bool { return s.startDate.IsZero() }
 
+// annualize the log-profit x of the run r, if configured.
+func (e *Simulator) annualize(r strategyResult, x float64) float64 {
+	if !e.config.Annualize {
+		return x
+	}
+	y := r.startDate.YearsTill(r.endDate)
+	if y == 0 {
+		return 0
+	}
+	return x / y
+}
+
 func (e *Simulator) reportResults(ctx context.Context, res []strategyResult) error {
 	profits := make([]float64, len(res))
 	var numBuys, numSells int
 	for i, r := range res {
-		profits[i] = r.logProfit
+		profits[i] = e.annualize(r, r.logProfit)
 		numBuys += r.numBuys
 		numSells += r.numSells
 	}
-	if e.config.Annualize {
-		for i := range profits {
-			y := res[i].startDate.YearsTill(res[i].endDate)
-			if y == 0 {
-				profits[i] = 0
-			} else {
-				profits[i] /= y
-			}
-		}
-	}
 	if !e.config.LogProfit {
 		for i, s := range profits {
 			profits[i] = math.Exp(s)
 		}
 	}
 	if c := e.config.ProfitPlot; c != nil {
-		dist := stats.NewSampleDistribution(profits, &c.Buckets)
+		dist := experiments.NewSampleDistribution(profits, c)
 		name := "profits"
 		if e.config.LogProfit {
 			name = "log-profits"
@@ -116,15 +304,111 @@ func (e *Simulator) reportResults(ctx context.Context, res []strategyResult) err
 			return errors.Annotate(err, "failed to plot profits")
 		}
 	}
-	if err := e.AddValue(ctx, "num buys", fmt.Sprintf("%d", numBuys)); err != nil {
+	if err := e.reportStats(ctx, res); err != nil {
+		return errors.Annotate(err, "failed to report run statistics")
+	}
+	if err := e.reportScaling(ctx, res); err != nil {
+		return errors.Annotate(err, "failed to report scaling")
+	}
+	if err := e.plotEquity(ctx, res); err != nil {
+		return errors.Annotate(err, "failed to plot equity")
+	}
+	if c, ok := e.config.Strategy.Config.(*config.PairsStrategy); ok {
+		if err := e.reportPairs(ctx, res, c); err != nil {
+			return errors.Annotate(err, "failed to report pairs")
+		}
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "num buys", experiments.IntValue(numBuys)); err != nil {
 		return errors.Annotate(err, "failed to add num buys value")
 	}
-	if err := e.AddValue(ctx, "num sells", fmt.Sprintf("%d", numSells)); err != nil {
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "num sells", experiments.IntValue(numSells)); err != nil {
 		return errors.Annotate(err, "failed to add num sells value")
 	}
 	return nil
 }
 
+// reportScaling adds the mean annualized log-profit and volatility with and
+// without scaling by a wrapper strategy, if any.
+func (e *Simulator) reportScaling(ctx context.Context, res []strategyResult) error {
+	if len(res) == 0 || res[0].unscaled == nil {
+		return nil
+	}
+	unscaled := make([]strategyResult, len(res))
+	for i, r := range res {
+		unscaled[i] = *r.unscaled
+	}
+	meanVol := func(res []strategyResult) float64 {
+		var xs []float64
+		for _, r := range res {
+			if v := r.Volatility(); !math.IsNaN(v) {
+				xs = append(xs, v)
+			}
+		}
+		return stats.NewSample(xs).Mean()
+	}
+	for _, v := range []struct {
+		key   string
+		value float64
+	}{
+		{"mean annual log-profit", meanProfit(res)},
+		{"unscaled mean annual log-profit", meanProfit(unscaled)},
+		{"mean realized volatility", meanVol(res)},
+		{"unscaled mean realized volatility", meanVol(unscaled)},
+	} {
+		if err := experiments.AddTypedValue(ctx, e.config.ID, v.key, experiments.FloatValue(v.value)); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", v.key)
+		}
+	}
+	return nil
+}
+
+// reportStats plots the distributions and adds the mean values of the
+// per-ticker run statistics. Undefined (NaN) statistics are skipped. The
+// intraday and overnight attribution is in log-profits, annualized as the
+// profits.
+func (e *Simulator) reportStats(ctx context.Context, res []strategyResult) error {
+	for _, st := range []struct {
+		name string
+		f    func(strategyResult) float64
+		c    *config.DistributionPlot
+	}{
+		{"max drawdown", strategyResult.Drawdown, e.config.DrawdownPlot},
+		{"volatility", strategyResult.Volatility, e.config.VolatilityPlot},
+		{"Sharpe", strategyResult.Sharpe, e.config.SharpePlot},
+		{"Sortino", strategyResult.Sortino, e.config.SortinoPlot},
+		{"exposure", strategyResult.Exposure, e.config.ExposurePlot},
+		{"intraday log-profit", func(r strategyResult) float64 {
+			return e.annualize(r, r.logProfit-r.overnightLogProfit)
+		}, e.config.IntradayPlot},
+		{"overnight log-profit", func(r strategyResult) float64 {
+			return e.annualize(r, r.overnightLogProfit)
+		}, e.config.OvernightPlot},
+	} {
+		var xs []float64
+		for _, r := range res {
+			if x := st.f(r); !math.IsNaN(x) {
+				xs = append(xs, x)
+			}
+		}
+		if len(xs) == 0 {
+			continue
+		}
+		mean := stats.NewSample(xs).Mean()
+		k := "mean " + st.name
+		if err := experiments.AddTypedValue(ctx, e.config.ID, k, experiments.FloatValue(mean)); err != nil {
+			return errors.Annotate(err, "failed to add value for '%s'", k)
+		}
+		if st.c == nil {
+			continue
+		}
+		dist := experiments.NewSampleDistribution(xs, st.c)
+		if err := experiments.PlotDistribution(ctx, dist, st.c, e.config.ID, st.name); err != nil {
+			return errors.Annotate(err, "failed to plot %s", st.name)
+		}
+	}
+	return nil
+}
+
 // Strategy API.
 type Strategy interface {
 	// Concurrency-safe strategy execution for a single ticker. A zero result
@@ -133,10 +417,39 @@ type Strategy interface {
 	ExecuteTicker(ctx context.Context, lp experiments.LogProfits, xactions bool) strategyResult
 }
 
-func (e *Simulator) executeStrategy(ctx context.Context, s Strategy) ([]strategyResult, error) {
+// PriceStrategy is a Strategy which executes on OHLC price bars rather than
+// log-profits. When a strategy implements it, ExecuteTicker is not used.
+type PriceStrategy interface {
+	Strategy
+	ExecutePrices(ctx context.Context, p experiments.Prices, xactions bool) strategyResult
+}
+
+func (e *Simulator) executeStrategy(ctx context.Context, s Strategy, src *config.Source) ([]strategyResult, error) {
+	if vt, ok := s.(*VolatilityTarget); ok {
+		res, err := e.executeStrategy(ctx, vt.inner, src)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to execute inner strategy")
+		}
+		for i, r := range res {
+			res[i] = vt.scale(r)
+		}
+		return res, nil
+	}
+	if ps, ok := s.(PriceStrategy); ok {
+		return e.executePriceStrategy(ctx, ps, src)
+	}
+	if ps, ok := s.(PairStrategy); ok {
+		return e.executePairStrategy(ctx, ps, src)
+	}
+	if ps, ok := s.(PortfolioStrategy); ok {
+		return e.executePortfolioStrategy(ctx, ps, src)
+	}
 	f := func(lps []experiments.LogProfits) []strategyResult {
 		var res []strategyResult
 		for _, lp := range lps {
+			if ctx.Err() != nil {
+				break
+			}
 			r := s.ExecuteTicker(ctx, lp, false)
 			if !r.IsZero() {
 				res = append(res, r)
@@ -144,7 +457,42 @@ func (e *Simulator) executeStrategy(ctx context.Context, s Strategy) ([]strategy
 		}
 		return res
 	}
-	it, err := experiments.SourceMap(ctx, e.config.Data, f)
+	it, err := experiments.SourceMap(ctx, src, f)
+	if err != nil {
+		return nil, errors.Annotate(err,
+			`failed to execute "%s"`, e.config.Strategy.Name())
+	}
+	defer it.Close()
+	rf := func(res, r []strategyResult) []strategyResult { return append(res, r...) }
+	res := iterator.Reduce[[]strategyResult](it, nil, rf)
+	return res, nil
+}
+
+// loadLogProfits reads all the series from the source, sorted by ticker.
+func (e *Simulator) loadLogProfits(ctx context.Context, src *config.Source) ([]experiments.LogProfits, error) {
+	it, err := experiments.Source(ctx, src)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to read series")
+	}
+	defer it.Close()
+	lps := iterator.ToSlice[experiments.LogProfits](it)
+	// Sources may yield series in any order; keep the order stable.
+	sort.SliceStable(lps, func(i, j int) bool { return lps[i].Ticker < lps[j].Ticker })
+	return lps, nil
+}
+
+func (e *Simulator) executePriceStrategy(ctx context.Context, s PriceStrategy, src *config.Source) ([]strategyResult, error) {
+	f := func(ps []experiments.Prices) []strategyResult {
+		var res []strategyResult
+		for _, p := range ps {
+			r := s.ExecutePrices(ctx, p, false)
+			if !r.IsZero() {
+				res = append(res, r)
+			}
+		}
+		return res
+	}
+	it, err := experiments.SourceMapPrices(ctx, src, f)
 	if err != nil {
 		return nil, errors.Annotate(err,
 			`failed to execute "%s"`, e.config.Strategy.Name())
@@ -16,6 +16,11 @@ package simulator
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stockparfait/experiments"
@@ -42,6 +47,13 @@ func dt(date string) db.Date {
 func TestSimulator(t *testing.T) {
 	t.Parallel()
 
+	tmpdir, tmpdirErr := os.MkdirTemp("", "test_simulator")
+	defer os.RemoveAll(tmpdir)
+
+	Convey("Test setup succeeded", t, func() {
+		So(tmpdirErr, ShouldBeNil)
+	})
+
 	Convey("Simulator experiment works", t, func() {
 		ctx := context.Background()
 		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
@@ -51,6 +63,10 @@ func TestSimulator(t *testing.T) {
 		ctx = experiments.UseValues(ctx, values)
 		profitGraph, err := canvas.EnsureGraph(plot.KindXY, "profit", "group")
 		So(err, ShouldBeNil)
+		sharpeGraph, err := canvas.EnsureGraph(plot.KindXY, "sharpe", "group")
+		So(err, ShouldBeNil)
+		attributionGraph, err := canvas.EnsureGraph(plot.KindXY, "attribution", "group")
+		So(err, ShouldBeNil)
 
 		Convey("runs a strategy", func() {
 			var cfg config.Simulator
@@ -76,5 +92,139 @@ func TestSimulator(t *testing.T) {
 
 			So(len(profitGraph.Plots), ShouldEqual, 1)
 		})
+
+		Convey("runs a price strategy", func() {
+			var cfg config.Simulator
+			confJSON := `
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "MAD": 0.01},
+    "intraday distribution": {"name": "t", "MAD": 0.005},
+    "tickers": 2,
+    "days": 10,
+    "seed": 42
+  },
+  "strategy": {"buy-sell OHLC": {"target": 1.05, "stop loss": 0.95}},
+  "profit plot": {"graph": "profit"},
+  "Sharpe plot": {"graph": "sharpe"},
+  "intraday plot": {"graph": "attribution"},
+  "overnight plot": {"graph": "attribution"}
+}`
+			So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+			var simExp Simulator
+			So(simExp.Run(ctx, &cfg), ShouldBeNil)
+
+			So(len(profitGraph.Plots), ShouldEqual, 1)
+			So(values["test num buys"], ShouldEqual, "20")
+			So(values["test num sells"], ShouldEqual, "20")
+			So(len(sharpeGraph.Plots), ShouldEqual, 1)
+			So(sharpeGraph.Plots[0].Legend, ShouldEqual, "test Sharpe p.d.f.")
+			So(values["test mean exposure"], ShouldEqual, "1")
+			So(values["test mean Sharpe"], ShouldNotBeEmpty)
+			So(len(attributionGraph.Plots), ShouldEqual, 2)
+			So(attributionGraph.Plots[0].Legend, ShouldEqual, "test intraday log-profit p.d.f.")
+			So(attributionGraph.Plots[1].Legend, ShouldEqual, "test overnight log-profit p.d.f.")
+		})
+
+		Convey("runs Monte Carlo simulations", func() {
+			var cfg config.Simulator
+			confJSON := `
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "MAD": 0.01},
+    "intraday distribution": {"name": "t", "MAD": 0.005},
+    "tickers": 2,
+    "days": 300,
+    "seed": 42
+  },
+  "strategy": {"buy-sell OHLC": {"target": 1.05, "stop loss": 0.95}},
+  "profit plot": {"graph": "profit"},
+  "runs": 3
+}`
+			So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+			So(cfg.Percentiles, ShouldResemble, []float64{5, 50, 95})
+			var simExp Simulator
+			So(simExp.Run(ctx, &cfg), ShouldBeNil)
+
+			So(len(profitGraph.Plots), ShouldEqual, 1)
+			So(values["test num buys"], ShouldEqual, "1800")
+			for _, k := range []string{"annual return", "max drawdown"} {
+				low, err := strconv.ParseFloat(values["test "+k+" p5"], 64)
+				So(err, ShouldBeNil)
+				high, err := strconv.ParseFloat(values["test "+k+" p95"], 64)
+				So(err, ShouldBeNil)
+				So(low, ShouldBeLessThan, high)
+			}
+		})
+
+		Convey("sweeps a strategy grid", func() {
+			fileName := filepath.Join(tmpdir, "grid.csv")
+			var cfg config.Simulator
+			confJSON := fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "MAD": 0.01},
+    "intraday distribution": {"name": "t", "MAD": 0.005},
+    "tickers": 2,
+    "days": 100,
+    "seed": 42
+  },
+  "strategy": {"buy-sell OHLC": {"max days": 3}},
+  "grid": {
+    "targets": [1.01, 1.05, 1.1],
+    "stop losses": [0.9, 0.95],
+    "file": "%s"
+  }
+}`, fileName)
+			So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+			var simExp Simulator
+			So(simExp.Run(ctx, &cfg), ShouldBeNil)
+
+			data, err := os.ReadFile(fileName)
+			So(err, ShouldBeNil)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			So(len(lines), ShouldEqual, 4)
+			So(lines[0], ShouldEqual, `target \ stop loss,0.9,0.95`)
+			So(strings.HasPrefix(lines[2], "1.05,"), ShouldBeTrue)
+			So(values, ShouldContainKey, "test best target")
+			So(values, ShouldContainKey, "test best stop loss")
+			So(values, ShouldContainKey, "test best profit")
+			So(len(profitGraph.Plots), ShouldEqual, 0)
+		})
+
+		Convey("grid replaces intraday target and stop loss", func() {
+			var cfg config.Simulator
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "strategy": {"buy-sell intraday": {
+    "buy": "9:30",
+    "sell": [{"target": 1.2}, {"time": "15:30"}]
+  }},
+  "grid": {"targets": [1.05], "stop losses": [0.95]}
+}`)), ShouldBeNil)
+			simExp := Simulator{config: &cfg}
+			s, err := simExp.gridStrategy(1.05, 0.95)
+			So(err, ShouldBeNil)
+			sell := s.(*BuySellIntraday).config.Sell
+			So(len(sell), ShouldEqual, 3)
+			So(sell[0].Target, ShouldEqual, 1.05)
+			So(sell[1].StopLoss, ShouldEqual, 0.95)
+			So(sell[2].Time, ShouldNotBeNil)
+			// The original config is not modified.
+			So(len(cfg.Strategy.Config.(*config.BuySellIntradayStrategy).Sell), ShouldEqual, 2)
+		})
+
+		Convey("runs require a synthetic source", func() {
+			var cfg config.Simulator
+			So(cfg.InitMessage(testutil.JSON(`
+{
+  "data": {"DB": {"DB": "test"}},
+  "strategy": {"buy-sell OHLC": {}},
+  "runs": 2
+}`)), ShouldNotBeNil)
+		})
 	})
 }
@@ -0,0 +1,97 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+
+	"github.com/stockparfait/errors"
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/stockparfait/stats"
+)
+
+// VolatilityTarget is a wrapper strategy scaling the positions of the inner
+// strategy to the target volatility.
+type VolatilityTarget struct {
+	config *config.VolatilityTargetStrategy
+	inner  Strategy
+}
+
+var _ Strategy = &VolatilityTarget{}
+
+func newVolatilityTarget(c *config.VolatilityTargetStrategy) (*VolatilityTarget, error) {
+	inner, err := newStrategy(c.Strategy.Config)
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to create inner strategy")
+	}
+	return &VolatilityTarget{config: c, inner: inner}, nil
+}
+
+func (s VolatilityTarget) ExecuteTicker(ctx context.Context, lp experiments.LogProfits, xactions bool) strategyResult {
+	return s.scale(s.inner.ExecuteTicker(ctx, lp, xactions))
+}
+
+// scale the daily log-profits of the inner strategy's result r. The scale of
+// each day is based only on the preceding days.
+func (s VolatilityTarget) scale(r strategyResult) strategyResult {
+	if r.IsZero() {
+		return r
+	}
+	res := strategyResult{
+		name:         r.name,
+		startDate:    r.startDate,
+		endDate:      r.endDate,
+		transactions: r.transactions,
+		numBuys:      r.numBuys,
+		numSells:     r.numSells,
+		unscaled:     &r,
+	}
+	w := s.config.Window
+	var peak, sum, sumSq float64 // sums over the trailing window
+	for i, lp := range r.daily {
+		k := 1.0
+		if i >= w {
+			n := float64(w)
+			mean := sum / n
+			vol := math.Sqrt(math.Max(sumSq/n-mean*mean, 0) * 252)
+			k = s.config.MaxLeverage
+			if vol > 0 {
+				k = math.Min(k, s.config.Target/vol)
+			}
+		}
+		x := math.Log(math.Max(1+k*(math.Exp(lp)-1), math.SmallestNonzeroFloat64))
+		res.logProfit += x
+		res.addDay(r.dailyDates[i], x, r.dailyInMarket[i])
+		peak = res.updateDrawdown(res.logProfit, peak)
+		sum += lp
+		sumSq += lp * lp
+		if i >= w {
+			sum -= r.daily[i-w]
+			sumSq -= r.daily[i-w] * r.daily[i-w]
+		}
+	}
+	if r.equity != nil {
+		equity := make([]float64, len(res.daily))
+		var cum float64
+		for i, x := range res.daily {
+			cum += x
+			equity[i] = math.Exp(cum)
+		}
+		res.equity = stats.NewTimeseries(res.dailyDates, equity)
+	}
+	return res
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Stock Parfait
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stockparfait/experiments"
+	"github.com/stockparfait/experiments/config"
+	"github.com/stockparfait/logging"
+	"github.com/stockparfait/stockparfait/db"
+	"github.com/stockparfait/stockparfait/plot"
+	"github.com/stockparfait/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVolatilityTarget(t *testing.T) {
+	t.Parallel()
+
+	Convey("volatility target strategy", t, func() {
+		var cfg config.VolatilityTargetStrategy
+		So(cfg.InitMessage(testutil.JSON(`
+{
+  "strategy": {"buy-sell OHLC": {}},
+  "target": 0.1,
+  "window": 2
+}`)), ShouldBeNil)
+		s, err := newVolatilityTarget(&cfg)
+		So(err, ShouldBeNil)
+
+		Convey("scales daily log-profits", func() {
+			var r strategyResult
+			r.name = "test"
+			r.startDate = db.NewDate(2020, 1, 1)
+			r.numBuys = 3
+			daily := []float64{0.02, -0.02, 0.02, -0.02, 0.01}
+			for i, x := range daily {
+				r.endDate = db.NewDate(2020, 1, uint8(i+1))
+				r.addDay(r.endDate, x, true)
+				r.logProfit += x
+			}
+			res := s.scale(r)
+			So(res.name, ShouldEqual, "test")
+			So(res.numBuys, ShouldEqual, 3)
+			So(res.days, ShouldEqual, 5)
+			So(res.unscaled.logProfit, ShouldEqual, r.logProfit)
+			// The trailing volatility is 0.02*sqrt(252) from the 3rd day on.
+			k := 0.1 / (0.02 * math.Sqrt(252))
+			expected := 0.02 - 0.02
+			for _, x := range daily[2:] {
+				expected += math.Log(1 + k*(math.Exp(x)-1))
+			}
+			So(testutil.Round(res.logProfit, 5), ShouldEqual, testutil.Round(expected, 5))
+		})
+
+		Convey("zero result is not scaled", func() {
+			So(s.scale(strategyResult{}).IsZero(), ShouldBeTrue)
+		})
+
+		Convey("config validation", func() {
+			var c config.VolatilityTargetStrategy
+			So(c.InitMessage(testutil.JSON(`{"target": 0.1}`)), ShouldNotBeNil)
+			So(c.InitMessage(testutil.JSON(`
+{"strategy": {"buy-sell OHLC": {}}, "window": 1}`)), ShouldNotBeNil)
+		})
+	})
+
+	Convey("volatility target in simulator", t, func() {
+		ctx := context.Background()
+		ctx = logging.Use(ctx, logging.DefaultGoLogger(logging.Info))
+		canvas := plot.NewCanvas()
+		values := make(experiments.Values)
+		ctx = plot.Use(ctx, canvas)
+		ctx = experiments.UseValues(ctx, values)
+
+		var cfg config.Simulator
+		So(cfg.InitMessage(testutil.JSON(`
+{
+  "id": "test",
+  "data": {
+    "daily distribution": {"name": "t", "MAD": 0.02},
+    "intraday distribution": {"name": "t", "MAD": 0.005},
+    "tickers": 2,
+    "days": 100,
+    "seed": 42
+  },
+  "strategy": {"volatility target": {
+    "strategy": {"buy-sell OHLC": {"max days": 5}},
+    "target": 0.05
+  }}
+}`)), ShouldBeNil)
+		var simExp Simulator
+		So(simExp.Run(ctx, &cfg), ShouldBeNil)
+		vol, err := strconv.ParseFloat(values["test mean realized volatility"], 64)
+		So(err, ShouldBeNil)
+		unscaledVol, err := strconv.ParseFloat(values["test unscaled mean realized volatility"], 64)
+		So(err, ShouldBeNil)
+		So(vol, ShouldBeLessThan, unscaledVol)
+		So(values["test mean annual log-profit"], ShouldNotBeEmpty)
+		So(values["test unscaled mean annual log-profit"], ShouldNotBeEmpty)
+	})
+}
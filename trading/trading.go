@@ -18,6 +18,8 @@ package trading
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/stockparfait/errors"
 	"github.com/stockparfait/experiments"
@@ -104,15 +106,60 @@ func (e *Trading) processData(ctx context.Context) error {
 			return errors.Annotate(err, "failed to plot close")
 		}
 	}
-	if err := e.AddValue(ctx, "tickers", fmt.Sprintf("%d", res.tickers)); err != nil {
+	if err := e.processGaps(ctx, res); err != nil {
+		return errors.Annotate(err, "failed to process gaps")
+	}
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "tickers", experiments.IntValue(res.tickers)); err != nil {
 		return errors.Annotate(err, "failed to add tickers value")
 	}
-	if err := e.AddValue(ctx, "samples", fmt.Sprintf("%d", res.samples)); err != nil {
+	if err := experiments.AddTypedValue(ctx, e.config.ID, "samples", experiments.IntValue(res.samples)); err != nil {
 		return errors.Annotate(err, "failed to add samples value")
 	}
 	return nil
 }
 
+// gapLegend describes the i'th range of the previous day's log-profit.
+func (e *Trading) gapLegend(i int) string {
+	ts := e.config.Gaps.Thresholds
+	switch {
+	case i == 0:
+		return fmt.Sprintf("gap prev<%g", ts[0])
+	case i == len(ts):
+		return fmt.Sprintf("gap prev>=%g", ts[i-1])
+	}
+	return fmt.Sprintf("gap %g<=prev<%g", ts[i-1], ts[i])
+}
+
+func (e *Trading) processGaps(ctx context.Context, res *jobRes) error {
+	c := e.config.Gaps
+	if c == nil {
+		return nil
+	}
+	for i, h := range res.gaps {
+		legend := e.gapLegend(i)
+		err := experiments.AddTypedValue(ctx, e.config.ID, legend+" samples", experiments.IntValue(int(h.CountsTotal())))
+		if err != nil {
+			return errors.Annotate(err, "failed to add value for '%s' samples", legend)
+		}
+		if h.CountsTotal() == 0 {
+			continue
+		}
+		err = experiments.PlotDistribution(ctx, stats.NewHistogramDistribution(h),
+			c.Plot, e.config.ID, legend)
+		if err != nil {
+			return errors.Annotate(err, "failed to plot '%s'", legend)
+		}
+	}
+	if c.Scatter != nil {
+		err := experiments.PlotScatter(ctx, res.gapXs, res.gapYs, c.Scatter,
+			e.config.ID, "gap vs. close/open", "close/open")
+		if err != nil {
+			return errors.Annotate(err, "failed to plot gap scatter")
+		}
+	}
+	return nil
+}
+
 type jobRes struct {
 	ho      *stats.Histogram
 	co      *stats.Histogram
@@ -120,6 +167,9 @@ type jobRes struct {
 	high    *stats.Histogram
 	low     *stats.Histogram
 	close   *stats.Histogram
+	gaps    []*stats.Histogram // by the range of the previous log-profit
+	gapXs   []float64          // gaps for the scatter plot
+	gapYs   []float64          // close/open for the scatter plot
 	tickers int
 	samples int
 }
@@ -156,6 +206,13 @@ func (j *jobRes) Merge(j2 *jobRes) *jobRes {
 			panic(errors.Annotate(err, "failed to merge close histogram"))
 		}
 	}
+	for i := range j.gaps {
+		if err := j.gaps[i].AddHistogram(j2.gaps[i]); err != nil {
+			panic(errors.Annotate(err, "failed to merge gap histogram"))
+		}
+	}
+	j.gapXs = append(j.gapXs, j2.gapXs...)
+	j.gapYs = append(j.gapYs, j2.gapYs...)
 	j.tickers += j2.tickers
 	j.samples += j2.samples
 	return j
@@ -164,22 +221,28 @@ func (j *jobRes) Merge(j2 *jobRes) *jobRes {
 func (e *Trading) newJobRes() *jobRes {
 	var r jobRes
 	if e.config.HighOpenPlot != nil {
-		r.ho = stats.NewHistogram(&e.config.HighOpenPlot.Buckets)
+		r.ho = stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.HighOpenPlot))
 	}
 	if e.config.CloseOpenPlot != nil {
-		r.co = stats.NewHistogram(&e.config.CloseOpenPlot.Buckets)
+		r.co = stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.CloseOpenPlot))
 	}
 	if e.config.OpenPlot != nil {
-		r.open = stats.NewHistogram(&e.config.OpenPlot.Buckets)
+		r.open = stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.OpenPlot))
 	}
 	if e.config.HighPlot != nil {
-		r.high = stats.NewHistogram(&e.config.HighPlot.Buckets)
+		r.high = stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.HighPlot))
 	}
 	if e.config.LowPlot != nil {
-		r.low = stats.NewHistogram(&e.config.LowPlot.Buckets)
+		r.low = stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.LowPlot))
 	}
 	if e.config.ClosePlot != nil {
-		r.close = stats.NewHistogram(&e.config.ClosePlot.Buckets)
+		r.close = stats.NewHistogram(experiments.PlotBuckets(e.context, e.config.ClosePlot))
+	}
+	if c := e.config.Gaps; c != nil && c.Plot != nil {
+		r.gaps = make([]*stats.Histogram, len(c.Thresholds)+1)
+		for i := range r.gaps {
+			r.gaps[i] = stats.NewHistogram(experiments.PlotBuckets(e.context, c.Plot))
+		}
 	}
 	return &r
 }
@@ -196,15 +259,40 @@ func logProfits(t1, t2 *stats.Timeseries, normCoeff float64) *stats.Timeseries {
 	return ts
 }
 
+// addGaps adds overnight gaps of a single ticker to res. Open and close are
+// assumed to come from the same price rows.
+func (e *Trading) addGaps(res *jobRes, open, close []float64, normCoeff float64) {
+	c := e.config.Gaps
+	for i := 2; i < len(close); i++ {
+		gap := math.Log(open[i]) - math.Log(close[i-1])
+		if res.gaps != nil {
+			prev := math.Log(close[i-1]) - math.Log(close[i-2])
+			k := sort.SearchFloat64s(c.Thresholds, prev)
+			if k < len(c.Thresholds) && c.Thresholds[k] == prev {
+				k++
+			}
+			res.gaps[k].Add(gap / normCoeff)
+		}
+		if c.Scatter != nil {
+			res.gapXs = append(res.gapXs, gap)
+			res.gapYs = append(res.gapYs, math.Log(close[i])-math.Log(open[i]))
+		}
+	}
+}
+
 func (e *Trading) processPrices(prices []experiments.Prices) *jobRes {
 	res := e.newJobRes()
 	for _, p := range prices {
+		if e.context.Err() != nil {
+			break
+		}
 		open := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceOpenFullyAdjusted)
 		high := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceHighFullyAdjusted)
 		close := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceCloseFullyAdjusted)
 		closePrev := close.Shift(1)
 		lp := close.LogProfits(1, false)
-		mad := stats.NewSample(lp.Data()).MAD()
+		sample := stats.NewSample(lp.Data())
+		mad := sample.MAD()
 		if mad == 0 {
 			logging.Warningf(e.context, "skipping %s: MAD = 0", p.Ticker)
 			continue
@@ -212,14 +300,18 @@ func (e *Trading) processPrices(prices []experiments.Prices) *jobRes {
 		res.tickers++
 		res.samples += len(p.Rows)
 		var ho *stats.Timeseries
-		norm := func(c *config.DistributionPlot, n float64) float64 {
-			if c.Normalize {
-				return n
+		norm := func(c *config.DistributionPlot) float64 {
+			switch c.NormalizeBy {
+			case "MAD":
+				return mad
+			case "sigma", "IQR", "Qn":
+				s, _ := experiments.Scale(sample, c.NormalizeBy)
+				return s
 			}
 			return 1
 		}
 		if e.config.HighOpenPlot != nil {
-			ho = logProfits(high, open, norm(e.config.HighOpenPlot, mad))
+			ho = logProfits(high, open, norm(e.config.HighOpenPlot))
 			res.ho.Add(ho.Data()...)
 		}
 		if e.config.CloseOpenPlot != nil {
@@ -227,26 +319,35 @@ func (e *Trading) processPrices(prices []experiments.Prices) *jobRes {
 				f := func(i int) bool { return ho.Data()[i] < *e.config.Threshold }
 				close = close.Filter(f)
 			}
-			ts := logProfits(close, open, norm(e.config.CloseOpenPlot, mad))
+			ts := logProfits(close, open, norm(e.config.CloseOpenPlot))
 			res.co.Add(ts.Data()...)
 		}
 		if e.config.OpenPlot != nil {
-			ts := logProfits(open, closePrev, norm(e.config.OpenPlot, mad))
+			ts := logProfits(open, closePrev, norm(e.config.OpenPlot))
 			res.open.Add(ts.Data()...)
 		}
 		if e.config.HighPlot != nil {
-			ts := logProfits(high, closePrev, norm(e.config.HighPlot, mad))
+			ts := logProfits(high, closePrev, norm(e.config.HighPlot))
 			res.high.Add(ts.Data()...)
 		}
 		if e.config.LowPlot != nil {
 			low := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceLowFullyAdjusted)
-			ts := logProfits(low, closePrev, norm(e.config.LowPlot, mad))
+			ts := logProfits(low, closePrev, norm(e.config.LowPlot))
 			res.low.Add(ts.Data()...)
 		}
 		if e.config.ClosePlot != nil {
-			ts := logProfits(close, closePrev, norm(e.config.ClosePlot, mad))
+			ts := logProfits(close, closePrev, norm(e.config.ClosePlot))
 			res.close.Add(ts.Data()...)
 		}
+		if c := e.config.Gaps; c != nil {
+			normCoeff := 1.0
+			if c.Plot != nil {
+				normCoeff = norm(c.Plot)
+			}
+			// close may have been filtered above, so re-read it.
+			closeAll := stats.NewTimeseriesFromPrices(p.Rows, stats.PriceCloseFullyAdjusted)
+			e.addGaps(res, open.Data(), closeAll.Data(), normCoeff)
+		}
 	}
 	return res
 }
@@ -123,6 +123,43 @@ func TestTrading(t *testing.T) {
 			So(len(LowGraph.Plots), ShouldEqual, 1)
 			So(len(CloseGraph.Plots), ShouldEqual, 1)
 		})
+
+		Convey("with gap analysis", func() {
+			gapsGraph, err := canvas.EnsureGraph(plot.KindXY, "gaps", "group")
+			So(err, ShouldBeNil)
+			scatterGraph, err := canvas.EnsureGraph(plot.KindXY, "gap scatter", "group")
+			So(err, ShouldBeNil)
+
+			var cfg config.Trading
+			confJSON := fmt.Sprintf(`
+{
+  "id": "test",
+  "data": {"DB": {
+    "DB path": "%s",
+    "DB": "%s",
+    "tickers": ["A"]
+  }},
+  "gaps": {
+    "plot": {"graph": "gaps", "normalize": false},
+    "thresholds": [-0.01, 0.01],
+    "scatter": {"graph": "gap scatter", "plot derived": true}
+  }
+}`, tmpdir, dbName)
+			So(cfg.InitMessage(testutil.JSON(confJSON)), ShouldBeNil)
+			var tradingExp Trading
+			So(tradingExp.Run(ctx, &cfg), ShouldBeNil)
+
+			So(values["test gap prev<-0.01 samples"], ShouldEqual, "1")
+			So(values["test gap -0.01<=prev<0.01 samples"], ShouldEqual, "2")
+			So(values["test gap prev>=0.01 samples"], ShouldEqual, "0")
+			So(len(gapsGraph.Plots), ShouldEqual, 2)
+			So(gapsGraph.Plots[0].Legend, ShouldEqual, "test gap prev<-0.01 p.d.f.")
+			So(len(scatterGraph.Plots), ShouldEqual, 2)
+			So(testutil.RoundSlice(scatterGraph.Plots[0].X, 3), ShouldResemble,
+				[]float64{0.0388, -0.0198, -0.21})
+			So(testutil.RoundSlice(scatterGraph.Plots[0].Y, 3), ShouldResemble,
+				[]float64{-0.029, -0.0101, 0.22})
+		})
 	})
 
 }